@@ -0,0 +1,387 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	ixml "github.com/drakkan/webdav/internal/xml"
+)
+
+// Privilege is an RFC 3744 privilege in the "DAV:" namespace, such as
+// PrivilegeRead.
+type Privilege string
+
+// The privileges defined by RFC 3744 section 3.
+const (
+	PrivilegeRead                        Privilege = "read"
+	PrivilegeWrite                       Privilege = "write"
+	PrivilegeWriteProperties             Privilege = "write-properties"
+	PrivilegeWriteContent                Privilege = "write-content"
+	PrivilegeUnlock                      Privilege = "unlock"
+	PrivilegeReadACL                     Privilege = "read-acl"
+	PrivilegeReadCurrentUserPrivilegeSet Privilege = "read-current-user-privilege-set"
+	PrivilegeWriteACL                    Privilege = "write-acl"
+	PrivilegeBind                        Privilege = "bind"
+	PrivilegeUnbind                      Privilege = "unbind"
+	PrivilegeAll                         Privilege = "all"
+)
+
+// The special principals an ACE may apply to, defined by RFC 3744 section
+// 5.5.1. Any other ACE principal is the URL path of a principal resource.
+const (
+	PrincipalAll             = "DAV:all"
+	PrincipalAuthenticated   = "DAV:authenticated"
+	PrincipalUnauthenticated = "DAV:unauthenticated"
+	PrincipalSelf            = "DAV:self"
+	PrincipalOwner           = "DAV:owner"
+)
+
+// ACE is an access control entry, granting or denying privileges to a
+// principal.
+type ACE struct {
+	// Principal is one of the special principals, such as PrincipalAll, or
+	// the URL path of a principal resource.
+	Principal string
+	// Deny is whether the privileges are denied instead of granted.
+	Deny       bool
+	Privileges []Privilege
+	// Protected is whether the ACE cannot be modified or removed by the
+	// ACL method.
+	Protected bool
+	// Inherited, if non-empty, is the URL path of the resource the ACE is
+	// inherited from.
+	Inherited string
+}
+
+// AccessController reports the RFC 3744 access control properties of
+// resources: DAV:current-user-privilege-set, DAV:acl and DAV:owner. Clients
+// use them to hide the actions the user is not allowed to perform.
+//
+// The Handler does not enforce the privileges itself, this is left to the
+// FileSystem or to middlewares, except for the ACL method, which requires
+// the PrivilegeWriteACL privilege.
+type AccessController interface {
+	// Privileges returns the privileges of principal, as returned by
+	// Handler.Principal, on resource name.
+	Privileges(ctx context.Context, principal, name string) ([]Privilege, error)
+	// ACL returns the access control list of resource name.
+	ACL(ctx context.Context, name string) ([]ACE, error)
+	// Owner returns the URL path of the principal resource of the owner of
+	// resource name, or an empty string if there is none.
+	Owner(ctx context.Context, name string) (string, error)
+}
+
+// ACLSetter is an optional interface for an AccessController, enabling the
+// ACL method. Privileged principals use it to modify the access control
+// list of resources.
+type ACLSetter interface {
+	// SetACL replaces the ACEs of resource name which are neither protected
+	// nor inherited by acl. ACEs that cannot be set should be refused by
+	// returning an error wrapping os.ErrPermission.
+	SetACL(ctx context.Context, name string, acl []ACE) error
+}
+
+// aclSupportedPrivileges is the DAV:supported-privilege-set property value:
+// the aggregation tree of RFC 3744 section 3.12.
+var aclSupportedPrivileges = `<D:supported-privilege><D:privilege><D:all/></D:privilege>` +
+	`<D:supported-privilege><D:privilege><D:read/></D:privilege></D:supported-privilege>` +
+	`<D:supported-privilege><D:privilege><D:write/></D:privilege>` +
+	`<D:supported-privilege><D:privilege><D:write-properties/></D:privilege></D:supported-privilege>` +
+	`<D:supported-privilege><D:privilege><D:write-content/></D:privilege></D:supported-privilege>` +
+	`<D:supported-privilege><D:privilege><D:bind/></D:privilege></D:supported-privilege>` +
+	`<D:supported-privilege><D:privilege><D:unbind/></D:privilege></D:supported-privilege>` +
+	`</D:supported-privilege>` +
+	`<D:supported-privilege><D:privilege><D:unlock/></D:privilege></D:supported-privilege>` +
+	`<D:supported-privilege><D:privilege><D:read-acl/></D:privilege></D:supported-privilege>` +
+	`<D:supported-privilege><D:privilege><D:read-current-user-privilege-set/></D:privilege></D:supported-privilege>` +
+	`<D:supported-privilege><D:privilege><D:write-acl/></D:privilege></D:supported-privilege>` +
+	`</D:supported-privilege>`
+
+// aggregates reports whether privilege p contains privilege want.
+func (p Privilege) aggregates(want Privilege) bool {
+	switch p {
+	case want, PrivilegeAll:
+		return true
+	case PrivilegeWrite:
+		switch want {
+		case PrivilegeWriteProperties, PrivilegeWriteContent, PrivilegeBind, PrivilegeUnbind:
+			return true
+		}
+	}
+	return false
+}
+
+// known reports whether p is one of the privileges defined by RFC 3744.
+func (p Privilege) known() bool {
+	switch p {
+	case PrivilegeRead, PrivilegeWrite, PrivilegeWriteProperties, PrivilegeWriteContent,
+		PrivilegeUnlock, PrivilegeReadACL, PrivilegeReadCurrentUserPrivilegeSet, PrivilegeWriteACL,
+		PrivilegeBind, PrivilegeUnbind, PrivilegeAll:
+		return true
+	}
+	return false
+}
+
+func hasPrivilege(privileges []Privilege, want Privilege) bool {
+	for _, p := range privileges {
+		if p.aggregates(want) {
+			return true
+		}
+	}
+	return false
+}
+
+type accessControlKey struct{}
+
+type accessControl struct {
+	ac        AccessController
+	principal string
+}
+
+func withAccessControl(ctx context.Context, ac AccessController, principal string) context.Context {
+	return context.WithValue(ctx, accessControlKey{}, accessControl{ac: ac, principal: principal})
+}
+
+func accessControlFrom(ctx context.Context) (accessControl, bool) {
+	c, ok := ctx.Value(accessControlKey{}).(accessControl)
+	return c, ok
+}
+
+// withoutAccessControl reports whether ctx has no AccessController, in which
+// case the access control properties are dead properties.
+func withoutAccessControl(ctx context.Context) bool {
+	_, ok := accessControlFrom(ctx)
+	return !ok
+}
+
+func writePrivileges(sb *strings.Builder, privileges []Privilege) {
+	for _, p := range privileges {
+		sb.WriteString("<D:privilege><D:" + escapeXML(string(p)) + "/></D:privilege>")
+	}
+}
+
+func findCurrentUserPrivilegeSet(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	c, ok := accessControlFrom(ctx)
+	if !ok {
+		return "", ErrNotImplemented
+	}
+	privileges, err := c.ac.Privileges(ctx, c.principal, name)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	writePrivileges(&sb, privileges)
+	return sb.String(), nil
+}
+
+// findACL returns the DAV:acl property. It is reported as not found to the
+// principals lacking the read-acl privilege.
+func findACL(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	c, ok := accessControlFrom(ctx)
+	if !ok {
+		return "", ErrNotImplemented
+	}
+	privileges, err := c.ac.Privileges(ctx, c.principal, name)
+	if err != nil {
+		return "", err
+	}
+	if !hasPrivilege(privileges, PrivilegeReadACL) {
+		return "", ErrNotImplemented
+	}
+	acl, err := c.ac.ACL(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, ace := range acl {
+		sb.WriteString("<D:ace><D:principal>")
+		if strings.HasPrefix(ace.Principal, "DAV:") {
+			local := strings.TrimPrefix(ace.Principal, "DAV:")
+			if ace.Principal == PrincipalOwner {
+				sb.WriteString("<D:property><D:owner/></D:property>")
+			} else {
+				sb.WriteString("<D:" + escapeXML(local) + "/>")
+			}
+		} else {
+			sb.WriteString("<D:href>" + escapeXML(hrefPath(ace.Principal)) + "</D:href>")
+		}
+		sb.WriteString("</D:principal>")
+		if ace.Deny {
+			sb.WriteString("<D:deny>")
+		} else {
+			sb.WriteString("<D:grant>")
+		}
+		writePrivileges(&sb, ace.Privileges)
+		if ace.Deny {
+			sb.WriteString("</D:deny>")
+		} else {
+			sb.WriteString("</D:grant>")
+		}
+		if ace.Protected {
+			sb.WriteString("<D:protected/>")
+		}
+		if ace.Inherited != "" {
+			sb.WriteString("<D:inherited><D:href>" + escapeXML(hrefPath(ace.Inherited)) + "</D:href></D:inherited>")
+		}
+		sb.WriteString("</D:ace>")
+	}
+	return sb.String(), nil
+}
+
+func findACLOwner(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	c, ok := accessControlFrom(ctx)
+	if !ok {
+		return "", ErrNotImplemented
+	}
+	owner, err := c.ac.Owner(ctx, name)
+	if err != nil || owner == "" {
+		return "", err
+	}
+	return "<D:href>" + escapeXML(hrefPath(owner)) + "</D:href>", nil
+}
+
+func findSupportedPrivilegeSet(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	if _, ok := accessControlFrom(ctx); !ok {
+		return "", ErrNotImplemented
+	}
+	return aclSupportedPrivileges, nil
+}
+
+// readACL reads the DAV:acl body of an ACL request, defined by RFC 3744
+// section 8.1.
+func readACL(r io.Reader) ([]ACE, error) {
+	d := ixml.NewDecoder(r)
+	var root *searchNode
+	for root == nil {
+		t, err := next(d)
+		if err != nil {
+			if err == io.EOF {
+				err = errInvalidACL
+			}
+			return nil, err
+		}
+		if start, ok := t.(ixml.StartElement); ok {
+			if root, err = readSearchNode(d, start); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if root.name != (xml.Name{Space: "DAV:", Local: "acl"}) {
+		return nil, errInvalidACL
+	}
+	acl := []ACE{}
+	for _, n := range root.children {
+		if n.name != (xml.Name{Space: "DAV:", Local: "ace"}) {
+			continue
+		}
+		var ace ACE
+		principal := n.child("principal")
+		if principal == nil || len(principal.children) != 1 {
+			return nil, errInvalidACL
+		}
+		switch p := principal.children[0]; {
+		case p.name.Space != "DAV:":
+			return nil, errInvalidACL
+		case p.name.Local == "href":
+			ace.Principal = strings.TrimSpace(p.text)
+		case p.name.Local == "property":
+			if p.child("owner") == nil {
+				return nil, errInvalidACL
+			}
+			ace.Principal = PrincipalOwner
+		case p.name.Local == "all", p.name.Local == "authenticated", p.name.Local == "unauthenticated", p.name.Local == "self":
+			ace.Principal = "DAV:" + p.name.Local
+		default:
+			return nil, errInvalidACL
+		}
+		grant := n.child("grant")
+		if grant == nil {
+			grant, ace.Deny = n.child("deny"), true
+		}
+		if grant == nil {
+			return nil, errInvalidACL
+		}
+		for _, c := range grant.children {
+			if c.name != (xml.Name{Space: "DAV:", Local: "privilege"}) || len(c.children) != 1 || c.children[0].name.Space != "DAV:" {
+				return nil, errInvalidACL
+			}
+			ace.Privileges = append(ace.Privileges, Privilege(c.children[0].name.Local))
+		}
+		if len(ace.Privileges) == 0 {
+			return nil, errInvalidACL
+		}
+		acl = append(acl, ace)
+	}
+	return acl, nil
+}
+
+// handleACL serves the ACL method, defined by RFC 3744 section 8.1.
+func (h *Handler) handleACL(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	setter, ok := h.AccessController.(ACLSetter)
+	if !ok {
+		return http.StatusMethodNotAllowed, errUnsupportedMethod
+	}
+	release, status, err := h.confirmLocks(r, reqPath, "")
+	if err != nil {
+		return status, err
+	}
+	defer release()
+
+	ctx := r.Context()
+	if _, err := h.FileSystem.Stat(ctx, reqPath); err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
+		return http.StatusMethodNotAllowed, err
+	}
+	privileges, err := h.AccessController.Privileges(ctx, h.principal(r), reqPath)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !hasPrivilege(privileges, PrivilegeWriteACL) {
+		writeXMLError(w, http.StatusForbidden, "need-privileges")
+		return 0, os.ErrPermission
+	}
+	acl, err := readACL(r.Body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	for _, ace := range acl {
+		for _, p := range ace.Privileges {
+			if !p.known() {
+				writeXMLError(w, http.StatusForbidden, "not-supported-privilege")
+				return 0, errInvalidACL
+			}
+		}
+	}
+	if err := setter.SetACL(ctx, reqPath, acl); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testAccessController grants everything to admin and read to the others.
+type testAccessController struct {
+	acl []ACE
+	set bool
+}
+
+func (c *testAccessController) Privileges(ctx context.Context, principal, name string) ([]Privilege, error) {
+	if principal == "admin" {
+		return []Privilege{PrivilegeAll}, nil
+	}
+	return []Privilege{PrivilegeRead, PrivilegeReadCurrentUserPrivilegeSet}, nil
+}
+
+func (c *testAccessController) ACL(ctx context.Context, name string) ([]ACE, error) {
+	return c.acl, nil
+}
+
+func (c *testAccessController) Owner(ctx context.Context, name string) (string, error) {
+	return "/principals/admin", nil
+}
+
+func (c *testAccessController) SetACL(ctx context.Context, name string, acl []ACE) error {
+	c.acl, c.set = acl, true
+	return nil
+}
+
+func TestAccessControl(t *testing.T) {
+	fs, err := buildTestFS([]string{"write /f content"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	ac := &testAccessController{acl: []ACE{{
+		Principal:  "/principals/admin",
+		Privileges: []Privilege{PrivilegeAll},
+		Protected:  true,
+	}}}
+	h := &Handler{
+		FileSystem:       fs,
+		LockSystem:       NewMemLS(),
+		AccessController: ac,
+		Principal:        func(r *http.Request) string { return r.Header.Get("X-User") },
+	}
+	do := func(method, user, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/f", strings.NewReader(body))
+		r.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	const propfind = `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop>` +
+		`<D:current-user-privilege-set/><D:acl/><D:owner/></D:prop></D:propfind>`
+
+	w := do("PROPFIND", "bob", propfind)
+	body := w.Body.String()
+	for _, want := range []string{
+		`<D:current-user-privilege-set><D:privilege><D:read/></D:privilege><D:privilege><D:read-current-user-privilege-set/></D:privilege></D:current-user-privilege-set>`,
+		`<D:owner><D:href>/principals/admin</D:href></D:owner>`,
+		`<D:prop><D:acl></D:acl></D:prop><D:status>HTTP/1.1 404 Not Found</D:status>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("PROPFIND by bob: got %s, want %s", body, want)
+		}
+	}
+
+	w = do("PROPFIND", "admin", propfind)
+	want := `<D:acl><D:ace><D:principal><D:href>/principals/admin</D:href></D:principal>` +
+		`<D:grant><D:privilege><D:all/></D:privilege></D:grant><D:protected/></D:ace></D:acl>`
+	if body := w.Body.String(); !strings.Contains(body, want) {
+		t.Errorf("PROPFIND by admin: got %s, want %s", body, want)
+	}
+
+	const acl = `<?xml version="1.0"?><D:acl xmlns:D="DAV:">
+<D:ace><D:principal><D:authenticated/></D:principal>
+<D:grant><D:privilege><D:read/></D:privilege><D:privilege><D:write/></D:privilege></D:grant></D:ace>
+<D:ace><D:principal><D:href>/principals/bob</D:href></D:principal>
+<D:deny><D:privilege><D:write-acl/></D:privilege></D:deny></D:ace>
+</D:acl>`
+	if w := do("ACL", "bob", acl); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "need-privileges") {
+		t.Errorf("ACL by bob: got %d %s, want %d need-privileges", w.Code, w.Body.String(), http.StatusForbidden)
+	}
+	if ac.set {
+		t.Fatalf("ACL by bob: the ACL was set")
+	}
+	if w := do("ACL", "admin", `<D:acl xmlns:D="DAV:"><D:ace><D:principal><D:all/></D:principal>`+
+		`<D:grant><D:privilege><D:fly/></D:privilege></D:grant></D:ace></D:acl>`); w.Code != http.StatusForbidden {
+		t.Errorf("ACL with an unknown privilege: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := do("ACL", "admin", acl); w.Code != http.StatusOK {
+		t.Fatalf("ACL by admin: got %d, want %d", w.Code, http.StatusOK)
+	}
+	wantACL := []ACE{{
+		Principal:  PrincipalAuthenticated,
+		Privileges: []Privilege{PrivilegeRead, PrivilegeWrite},
+	}, {
+		Principal:  "/principals/bob",
+		Deny:       true,
+		Privileges: []Privilege{PrivilegeWriteACL},
+	}}
+	if !reflect.DeepEqual(ac.acl, wantACL) {
+		t.Errorf("ACL by admin: got %+v, want %+v", ac.acl, wantACL)
+	}
+
+	w = do("OPTIONS", "", "")
+	if got := w.Header().Get("DAV"); !strings.Contains(got, "access-control") {
+		t.Errorf("OPTIONS: DAV header %q does not advertise access-control", got)
+	}
+	if got := w.Header().Get("Allow"); !strings.Contains(got, "ACL") {
+		t.Errorf("OPTIONS: Allow header %q does not include ACL", got)
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheFlusher is an optional interface for FileSystems keeping caches,
+// such as the metadata and content caches of remote backends. The Admin API
+// uses it to let operators drop stale cached data.
+type CacheFlusher interface {
+	// FlushCache discards the cached data.
+	FlushCache() error
+}
+
+// Admin is an http.Handler exposing a JSON administrative API for a
+// Handler. It does not authenticate requests: it must be mounted at Prefix
+// on a separate listener or behind an authenticating middleware. The
+// endpoints, relative to Prefix, are:
+//
+//   - GET locks lists the locks, if the LockSystem implements
+//     LockEnumerator, and DELETE locks/{token} breaks a lock.
+//   - GET transfers lists the GET and PUT requests transferring data.
+//   - GET operations lists the asynchronous operations, if the Handler has
+//     Operations.
+//   - GET maintenance reports whether the maintenance mode is enabled and
+//     PUT maintenance, with a {"enabled": bool} body, toggles it. In
+//     maintenance mode the Handler only serves the requests that do not
+//     modify resources, the others get a "503 Service Unavailable" status.
+//   - POST cache/flush flushes the caches of the FileSystem, if it
+//     implements CacheFlusher.
+//
+// The Admin must be set as the Admin of the Handler, so that the Handler
+// reports its transfers and honors the maintenance mode. A zero Admin, not
+// created by NewAdmin, only serves the transfers and maintenance endpoints,
+// the others get a "503 Service Unavailable" status.
+type Admin struct {
+	// Prefix is the URL path the Admin handler is mounted at.
+	Prefix string
+
+	h           *Handler
+	maintenance int32 // accessed atomically
+
+	mu        sync.Mutex
+	transfers map[uint64]*transfer
+	gen       uint64
+}
+
+// NewAdmin returns a new Admin mounted at prefix, administering h.
+func NewAdmin(prefix string, h *Handler) *Admin {
+	return &Admin{
+		Prefix:    prefix,
+		h:         h,
+		transfers: make(map[uint64]*transfer),
+	}
+}
+
+// AdminLock is a lock as reported by the Admin API.
+type AdminLock struct {
+	Token     string    `json:"token"`
+	Root      string    `json:"root"`
+	ZeroDepth bool      `json:"zero_depth,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	OwnerXML  string    `json:"owner_xml,omitempty"`
+	LockNull  bool      `json:"lock_null,omitempty"`
+	Created   time.Time `json:"created,omitempty"`
+	// Expiry is the zero time for locks with an infinite duration.
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+// TransferStatus is a data transfer in progress, as reported by the Admin
+// API.
+type TransferStatus struct {
+	// ID identifies the transfer.
+	ID string `json:"id"`
+	// Method is the HTTP method of the request, "GET" or "PUT".
+	Method string `json:"method"`
+	// Path is the path of the request resource.
+	Path string `json:"path"`
+	// Principal is the principal issuing the request, if known.
+	Principal string `json:"principal,omitempty"`
+	// RemoteAddr is the network address of the client.
+	RemoteAddr string `json:"remote_addr"`
+	// Bytes is the number of bytes transferred so far.
+	Bytes int64 `json:"bytes"`
+	// Started is when the transfer started.
+	Started time.Time `json:"started"`
+}
+
+type transfer struct {
+	status TransferStatus
+	bytes  int64 // accessed atomically
+}
+
+// add records n more bytes transferred. It is a no-op on a nil transfer.
+func (t *transfer) add(n int) {
+	if t != nil {
+		atomic.AddInt64(&t.bytes, int64(n))
+	}
+}
+
+// transferReader counts the bytes read from a request body in t.
+type transferReader struct {
+	io.Reader
+	t *transfer
+}
+
+func (r transferReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.t.add(n)
+	return n, err
+}
+
+// startTransfer records the start of the transfer of resource name by r.
+// It returns nil, and the returned function does nothing, on a nil Admin.
+func (a *Admin) startTransfer(r *http.Request, name string) (*transfer, func()) {
+	if a == nil {
+		return nil, func() {}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gen++
+	id := a.gen
+	// A zero Admin, not created by NewAdmin, doesn't know the Handler.
+	principal := ""
+	if a.h != nil {
+		principal = a.h.principal(r)
+	}
+	t := &transfer{
+		status: TransferStatus{
+			ID:         strconv.FormatUint(id, 10),
+			Method:     r.Method,
+			Path:       name,
+			Principal:  principal,
+			RemoteAddr: r.RemoteAddr,
+			Started:    time.Now(),
+		},
+	}
+	if a.transfers == nil {
+		a.transfers = make(map[uint64]*transfer)
+	}
+	a.transfers[id] = t
+	return t, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.transfers, id)
+	}
+}
+
+// Transfers returns the data transfers in progress, oldest first.
+func (a *Admin) Transfers() []TransferStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	transfers := make([]TransferStatus, 0, len(a.transfers))
+	for _, t := range a.transfers {
+		status := t.status
+		status.Bytes = atomic.LoadInt64(&t.bytes)
+		transfers = append(transfers, status)
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].Started.Before(transfers[j].Started)
+	})
+	return transfers
+}
+
+// Maintenance reports whether the maintenance mode is enabled.
+func (a *Admin) Maintenance() bool {
+	return atomic.LoadInt32(&a.maintenance) != 0
+}
+
+// SetMaintenance enables or disables the maintenance mode.
+func (a *Admin) SetMaintenance(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&a.maintenance, v)
+}
+
+// refuses reports whether r must be refused because of the maintenance
+// mode. It is false on a nil Admin.
+func (a *Admin) refuses(r *http.Request) bool {
+	if a == nil || !a.Maintenance() {
+		return false
+	}
+	switch r.Method {
+	case "OPTIONS", "GET", "HEAD", "PROPFIND", "REPORT", "SEARCH":
+		return false
+	}
+	return true
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.Trim(strings.TrimPrefix(r.URL.Path, a.Prefix), "/")
+	var allow []string
+	switch {
+	case p == "locks", p == "transfers", p == "operations":
+		allow = []string{"GET", "HEAD"}
+	case strings.HasPrefix(p, "locks/"):
+		allow = []string{"DELETE"}
+	case p == "maintenance":
+		allow = []string{"GET", "HEAD", "PUT"}
+	case p == "cache/flush":
+		allow = []string{"POST"}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	allowed := false
+	for _, m := range allow {
+		allowed = allowed || r.Method == m
+	}
+	if !allowed {
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		v      interface{}
+		status = http.StatusOK
+		err    error
+	)
+	switch {
+	case a.h == nil && p != "transfers" && p != "maintenance":
+		// A zero Admin, not created by NewAdmin, doesn't know the Handler.
+		status, err = http.StatusServiceUnavailable, errNoHandler
+	case p == "locks":
+		v, status, err = a.locks()
+	case strings.HasPrefix(p, "locks/"):
+		status, err = a.breakLock(strings.TrimPrefix(p, "locks/"))
+	case p == "transfers":
+		v = a.Transfers()
+	case p == "operations":
+		if a.h.Operations == nil {
+			status, err = http.StatusNotImplemented, errNoOperations
+		} else {
+			v = a.h.Operations.List()
+		}
+	case p == "maintenance":
+		v, status, err = a.maintenanceMode(r)
+	case p == "cache/flush":
+		status, err = a.flushCache()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if v == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *Admin) locks() ([]AdminLock, int, error) {
+	le, ok := a.h.LockSystem.(LockEnumerator)
+	if !ok {
+		return nil, http.StatusNotImplemented, errLockNotSupported
+	}
+	active, err := le.Locks(time.Now())
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	locks := make([]AdminLock, 0, len(active))
+	for _, l := range active {
+		locks = append(locks, AdminLock{
+			Token:     l.Token,
+			Root:      l.Details.Root,
+			ZeroDepth: l.Details.ZeroDepth,
+			Principal: l.Details.Principal,
+			OwnerXML:  l.Details.OwnerXML,
+			LockNull:  l.Details.LockNull,
+			Created:   l.Details.Created,
+			Expiry:    l.Expiry,
+		})
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Root < locks[j].Root
+	})
+	return locks, http.StatusOK, nil
+}
+
+// breakLock removes the lock with the given token, whoever created it.
+func (a *Admin) breakLock(token string) (int, error) {
+	err := a.h.LockSystem.Unlock(time.Now(), token)
+	switch {
+	case err == nil:
+		return http.StatusNoContent, nil
+	case errors.Is(err, ErrNoSuchLock):
+		return http.StatusNotFound, err
+	case errors.Is(err, ErrLocked):
+		// The lock is held by a request in progress.
+		return http.StatusConflict, err
+	}
+	return http.StatusInternalServerError, err
+}
+
+func (a *Admin) maintenanceMode(r *http.Request) (interface{}, int, error) {
+	if r.Method == http.MethodPut {
+		var body struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		a.SetMaintenance(body.Enabled)
+	}
+	return struct {
+		Enabled bool `json:"enabled"`
+	}{a.Maintenance()}, http.StatusOK, nil
+}
+
+func (a *Admin) flushCache() (int, error) {
+	cf, ok := a.h.FileSystem.(CacheFlusher)
+	if !ok {
+		return http.StatusNotImplemented, errNoCache
+	}
+	if err := cf.FlushCache(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusNoContent, nil
+}
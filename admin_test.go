@@ -0,0 +1,159 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /dir", "write /dir/file content"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		Operations: NewOperations("/ops/"),
+	}
+	admin := NewAdmin("/admin/", h)
+	h.Admin = admin
+	do := func(handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	// Locks.
+	if w := do(h, "LOCK", "/dir/file", createLockBody); w.Code != http.StatusOK {
+		t.Fatalf("LOCK: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	w := do(admin, "GET", "/admin/locks", "")
+	var locks []AdminLock
+	if err := json.NewDecoder(w.Body).Decode(&locks); err != nil {
+		t.Fatalf("GET locks: %v", err)
+	}
+	if len(locks) != 1 || locks[0].Root != "/dir/file" || locks[0].Token == "" {
+		t.Fatalf("GET locks: got %+v, want a lock on /dir/file", locks)
+	}
+	if w := do(admin, "DELETE", "/admin/locks/"+locks[0].Token, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE lock: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := do(admin, "DELETE", "/admin/locks/"+locks[0].Token, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("DELETE lock again: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(h, "PUT", "/dir/file", "unlocked"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT after breaking the lock: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	// Transfers.
+	pr, pw := io.Pipe()
+	putDone := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/dir/upload", pr))
+		putDone <- w.Code
+	}()
+	pw.Write([]byte("12345"))
+	var transfers []TransferStatus
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		transfers = admin.Transfers()
+		if len(transfers) == 1 && transfers[0].Bytes == 5 {
+			break
+		}
+	}
+	if len(transfers) != 1 || transfers[0].Method != "PUT" || transfers[0].Path != "/dir/upload" || transfers[0].Bytes != 5 {
+		t.Fatalf("transfers: got %+v, want a PUT of /dir/upload with 5 bytes", transfers)
+	}
+	pw.Close()
+	if code := <-putDone; code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", code, http.StatusCreated)
+	}
+	if w := do(admin, "GET", "/admin/transfers", ""); strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("GET transfers: got %s, want []", w.Body.String())
+	}
+
+	// Maintenance mode.
+	if w := do(admin, "PUT", "/admin/maintenance", `{"enabled": true}`); !strings.Contains(w.Body.String(), `"enabled":true`) {
+		t.Fatalf("PUT maintenance: got %s", w.Body.String())
+	}
+	if w := do(h, "PUT", "/dir/file", "refused"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("PUT in maintenance mode: got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if w := do(h, "GET", "/dir/file", ""); w.Code != http.StatusOK || w.Body.String() != "unlocked" {
+		t.Fatalf("GET in maintenance mode: got status %d and %q", w.Code, w.Body.String())
+	}
+	for _, method := range []string{"PROPFIND", "REPORT", "SEARCH"} {
+		if w := do(h, method, "/dir/file", ""); w.Code == http.StatusServiceUnavailable {
+			t.Fatalf("%s in maintenance mode: got status %d", method, w.Code)
+		}
+	}
+	do(admin, "PUT", "/admin/maintenance", `{"enabled": false}`)
+	if w := do(h, "DELETE", "/dir/upload", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE after maintenance: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	// Other endpoints.
+	if w := do(admin, "GET", "/admin/operations", ""); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("GET operations: got status %d and %s", w.Code, w.Body.String())
+	}
+	if w := do(admin, "POST", "/admin/cache/flush", ""); w.Code != http.StatusNotImplemented {
+		t.Fatalf("POST cache/flush: got status %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+	if w := do(admin, "POST", "/admin/locks", ""); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Fatalf("POST locks: got status %d and Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestZeroAdmin(t *testing.T) {
+	h := &Handler{
+		FileSystem: NewMemFS(),
+		LockSystem: NewMemLS(),
+		Admin:      &Admin{},
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/file", strings.NewReader("content")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+}
+
+func TestZeroAdminServeHTTP(t *testing.T) {
+	admin := &Admin{}
+	testCases := []struct {
+		method, target string
+		want           int
+	}{
+		{"GET", "/locks", http.StatusServiceUnavailable},
+		{"DELETE", "/locks/token", http.StatusServiceUnavailable},
+		{"GET", "/operations", http.StatusServiceUnavailable},
+		{"POST", "/cache/flush", http.StatusServiceUnavailable},
+		{"GET", "/transfers", http.StatusOK},
+		{"GET", "/maintenance", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+		if w.Code != tc.want {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.target, w.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package aferofs adapts afero file systems to webdav.FileSystem, and the
+// other way around, so that the storage backends targeting afero can be
+// served over WebDAV, and the WebDAV file systems used by afero clients.
+//
+// It is a separate module, so that the webdav package itself does not
+// depend on afero.
+package aferofs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/drakkan/webdav"
+	"github.com/spf13/afero"
+)
+
+var errNotSupported = errors.New("aferofs: not supported")
+
+// NewFileSystem returns a webdav.FileSystem serving fs. The names are
+// slash-separated and rooted at the root of fs, use afero.NewBasePathFs to
+// serve a subtree.
+//
+// The returned FileSystem implements webdav.Chmoder.
+func NewFileSystem(fs afero.Fs) webdav.FileSystem {
+	return fileSystem{fs}
+}
+
+type fileSystem struct {
+	fs afero.Fs
+}
+
+// clean returns the slash-separated absolute name.
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (fs fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return fs.fs.Mkdir(clean(name), perm)
+}
+
+func (fs fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.fs.OpenFile(clean(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	// afero.File is a superset of webdav.File.
+	return f, nil
+}
+
+func (fs fileSystem) RemoveAll(ctx context.Context, name string) error {
+	if name = clean(name); name == "/" {
+		// Prohibit removing the virtual root directory.
+		return os.ErrInvalid
+	}
+	return fs.fs.RemoveAll(name)
+}
+
+func (fs fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = clean(oldName), clean(newName)
+	if oldName == "/" || newName == "/" {
+		// Prohibit renaming from or to the virtual root directory.
+		return os.ErrInvalid
+	}
+	return fs.fs.Rename(oldName, newName)
+}
+
+func (fs fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.fs.Stat(clean(name))
+}
+
+// Chmod implements webdav.Chmoder.
+func (fs fileSystem) Chmod(ctx context.Context, name string, mode os.FileMode) error {
+	return fs.fs.Chmod(clean(name), mode)
+}
+
+// NewFs returns an afero.Fs backed by fs. As afero has no contexts, the
+// methods of fs are called with context.Background.
+//
+// Chmod requires fs to implement webdav.Chmoder, Chtimes requires it to
+// implement webdav.Win32FS, and Chown is not supported.
+func NewFs(fs webdav.FileSystem) afero.Fs {
+	return &aferoFs{fs}
+}
+
+type aferoFs struct {
+	fs webdav.FileSystem
+}
+
+func (a *aferoFs) Name() string {
+	return "webdav"
+}
+
+func (a *aferoFs) Create(name string) (afero.File, error) {
+	return a.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (a *aferoFs) Mkdir(name string, perm os.FileMode) error {
+	return a.fs.Mkdir(context.Background(), name, perm)
+}
+
+func (a *aferoFs) MkdirAll(name string, perm os.FileMode) error {
+	name = clean(name)
+	fi, err := a.fs.Stat(context.Background(), name)
+	if err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if parent := path.Dir(name); parent != name {
+		if err := a.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := a.Mkdir(name, perm); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (a *aferoFs) Open(name string) (afero.File, error) {
+	return a.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (a *aferoFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := a.fs.OpenFile(context.Background(), name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: f, name: name}, nil
+}
+
+func (a *aferoFs) Remove(name string) error {
+	ctx := context.Background()
+	fi, err := a.fs.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		f, err := a.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		children, err := f.Readdir(1)
+		f.Close()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(children) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	return a.fs.RemoveAll(ctx, name)
+}
+
+func (a *aferoFs) RemoveAll(name string) error {
+	err := a.fs.RemoveAll(context.Background(), name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (a *aferoFs) Rename(oldName, newName string) error {
+	return a.fs.Rename(context.Background(), oldName, newName)
+}
+
+func (a *aferoFs) Stat(name string) (os.FileInfo, error) {
+	return a.fs.Stat(context.Background(), name)
+}
+
+func (a *aferoFs) Chmod(name string, mode os.FileMode) error {
+	chmoder, ok := a.fs.(webdav.Chmoder)
+	if !ok {
+		return &os.PathError{Op: "chmod", Path: name, Err: errNotSupported}
+	}
+	return chmoder.Chmod(context.Background(), name, mode)
+}
+
+func (a *aferoFs) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: errNotSupported}
+}
+
+func (a *aferoFs) Chtimes(name string, atime, mtime time.Time) error {
+	wfs, ok := a.fs.(webdav.Win32FS)
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: errNotSupported}
+	}
+	return wfs.Chtimes(context.Background(), name, atime, mtime)
+}
+
+// file is an afero.File backed by a webdav.File. The optional methods of
+// afero.File are implemented using the ones of the webdav.File, if any.
+type file struct {
+	webdav.File
+	name string
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if ra, ok := f.File.(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+	cur, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Seek(cur, io.SeekStart)
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(f.File, p)
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	if wa, ok := f.File.(io.WriterAt); ok {
+		return wa.WriteAt(p, off)
+	}
+	cur, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Seek(cur, io.SeekStart)
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return f.Write(p)
+}
+
+func (f *file) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *file) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *file) Sync() error {
+	if s, ok := f.File.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+func (f *file) Truncate(size int64) error {
+	if t, ok := f.File.(interface{ Truncate(int64) error }); ok {
+		return t.Truncate(size)
+	}
+	return &os.PathError{Op: "truncate", Path: f.name, Err: errNotSupported}
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package aferofs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/drakkan/webdav"
+	"github.com/spf13/afero"
+)
+
+func TestNewFileSystem(t *testing.T) {
+	mem := afero.NewMemMapFs()
+	h := &webdav.Handler{
+		FileSystem: NewFileSystem(mem),
+		LockSystem: webdav.NewMemLS(),
+	}
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("MKCOL", "/dir", ""); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := do("PUT", "/dir/file", "content"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if b, err := afero.ReadFile(mem, "/dir/file"); err != nil || string(b) != "content" {
+		t.Errorf("afero.ReadFile: got %q, %v, want %q", b, err, "content")
+	}
+	if w := do("GET", "/dir/file", ""); w.Body.String() != "content" {
+		t.Errorf("GET: got %q, want %q", w.Body.String(), "content")
+	}
+	w := do("PROPFIND", "/dir", "", "Depth", "1")
+	if !strings.Contains(w.Body.String(), "<D:href>/dir/file</D:href>") {
+		t.Errorf("PROPFIND: got %s, want /dir/file", w.Body.String())
+	}
+	if w := do("MOVE", "/dir/file", "", "Destination", "/moved"); w.Code != http.StatusCreated {
+		t.Errorf("MOVE: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := do("DELETE", "/dir", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if _, err := mem.Stat("/dir"); !os.IsNotExist(err) {
+		t.Errorf("Stat /dir: got %v, want not exist", err)
+	}
+	if _, err := mem.Stat("/moved"); err != nil {
+		t.Errorf("Stat /moved: %v", err)
+	}
+}
+
+func TestNewFs(t *testing.T) {
+	fs := NewFs(webdav.NewMemFS())
+	if err := fs.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := afero.WriteFile(fs, "/a/b/file", []byte("hello world"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if b, err := afero.ReadFile(fs, "/a/b/file"); err != nil || string(b) != "hello world" {
+		t.Errorf("ReadFile: got %q, %v, want %q", b, err, "hello world")
+	}
+
+	f, err := fs.Open("/a/b/file")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	p := make([]byte, 5)
+	if n, err := f.ReadAt(p, 6); err != nil || string(p[:n]) != "world" {
+		t.Errorf("ReadAt: got %q, %v, want %q", p[:n], err, "world")
+	}
+	f.Close()
+
+	fis, err := afero.ReadDir(fs, "/a")
+	if err != nil || len(fis) != 1 || fis[0].Name() != "b" {
+		t.Errorf("ReadDir: got %v, %v, want b", fis, err)
+	}
+	if err := fs.Remove("/a/b"); err == nil {
+		t.Errorf("Remove of a non-empty directory: got nil error")
+	}
+	if err := fs.Rename("/a/b/file", "/a/file"); err != nil {
+		t.Errorf("Rename: %v", err)
+	}
+	if err := fs.Remove("/a/b"); err != nil {
+		t.Errorf("Remove: %v", err)
+	}
+	if err := fs.RemoveAll("/missing"); err != nil {
+		t.Errorf("RemoveAll of a missing file: %v", err)
+	}
+	if ok, err := afero.Exists(fs, "/a/file"); !ok || err != nil {
+		t.Errorf("Exists: got %t, %v, want true", ok, err)
+	}
+}
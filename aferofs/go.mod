@@ -0,0 +1,12 @@
+module github.com/drakkan/webdav/aferofs
+
+go 1.20
+
+require (
+	github.com/drakkan/webdav v0.0.0-00010101000000-000000000000
+	github.com/spf13/afero v1.11.0
+)
+
+require golang.org/x/text v0.14.0 // indirect
+
+replace github.com/drakkan/webdav => ../
@@ -0,0 +1,129 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"encoding/xml"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var ancestorPropNames = []xml.Name{
+	{Space: "DAV:", Local: "resourcetype"},
+	{Space: "DAV:", Local: "displayname"},
+}
+
+// isAncestorProbe reports whether r is an OPTIONS or PROPFIND request to an
+// ancestor of h.Prefix, answered by serveAncestorProbe. See
+// Handler.AncestorProbes.
+func (h *Handler) isAncestorProbe(r *http.Request) bool {
+	if !h.AncestorProbes || r.Method != "OPTIONS" && r.Method != "PROPFIND" {
+		return false
+	}
+	prefix := strings.TrimSuffix(h.Prefix, "/")
+	if prefix == "" {
+		return false
+	}
+	p := path.Clean("/" + r.URL.Path)
+	return p == "/" || strings.HasPrefix(prefix, p+"/")
+}
+
+// serveAncestorProbe answers the probes of the ancestors of h.Prefix as
+// read-only collections, whose only member is the next ancestor.
+func (h *Handler) serveAncestorProbe(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "OPTIONS, PROPFIND")
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		return 0, nil
+	}
+	depth := infiniteDepth
+	if hdr := r.Header.Get("Depth"); hdr != "" {
+		if depth = parseDepth(hdr); depth == invalidDepth {
+			return http.StatusBadRequest, errInvalidDepth
+		}
+	}
+	pf, status, err := readPropfind(r.Body)
+	if err != nil {
+		return status, err
+	}
+	name := path.Clean("/" + r.URL.Path)
+	hrefs := []string{name}
+	if depth != 0 {
+		prefix := strings.TrimSuffix(h.Prefix, "/")
+		next, _, _ := strings.Cut(strings.TrimPrefix(prefix, strings.TrimSuffix(name, "/")+"/"), "/")
+		hrefs = append(hrefs, path.Join(name, next))
+	}
+	mw := multistatusWriter{w: w, canonical: h.CanonicalXML, ctx: r.Context()}
+	for _, href := range hrefs {
+		var pstats []Propstat
+		switch {
+		case pf.Propname != nil:
+			pstats = ancestorProps(href, nil, true)
+		case pf.Allprop != nil:
+			pstats = ancestorProps(href, append(append([]xml.Name(nil), ancestorPropNames...), pf.Include...), false)
+		default:
+			pstats = ancestorProps(href, pf.Prop, false)
+		}
+		if href != "/" {
+			href += "/"
+		}
+		if err := mw.write(makePropstatResponse(href, pstats)); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if err := mw.close(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+}
+
+// ancestorProps returns the status of the properties named pnames for the
+// ancestor name of the Handler prefix. If pnames is nil, all the properties
+// defined for ancestors are returned. If propname is true, only the names
+// of the properties are returned.
+func ancestorProps(name string, pnames []xml.Name, propname bool) []Propstat {
+	if pnames == nil {
+		pnames = ancestorPropNames
+	}
+	pstatOK := Propstat{Status: http.StatusOK}
+	pstatNotFound := Propstat{Status: http.StatusNotFound}
+	seen := make(map[xml.Name]bool)
+	for _, pn := range pnames {
+		if seen[pn] {
+			continue
+		}
+		seen[pn] = true
+		var innerXML string
+		switch pn {
+		case ancestorPropNames[0]:
+			innerXML = `<D:collection xmlns:D="DAV:"/>`
+		case ancestorPropNames[1]:
+			innerXML = escapeXML(path.Base(name))
+		default:
+			pstatNotFound.Props = append(pstatNotFound.Props, Property{XMLName: pn})
+			continue
+		}
+		if propname {
+			innerXML = ""
+		}
+		pstatOK.Props = append(pstatOK.Props, Property{
+			XMLName:  pn,
+			InnerXML: []byte(innerXML),
+		})
+	}
+	return makePropstats(pstatOK, pstatNotFound)
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAncestorProbes(t *testing.T) {
+	fs, err := buildTestFS([]string{"write /doc.docx content"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		Prefix:         "/dav/files/alice",
+		FileSystem:     fs,
+		LockSystem:     NewMemLS(),
+		AncestorProbes: true,
+	}
+	do := func(method, target, depth, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if depth != "" {
+			r.Header.Set("Depth", depth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	const propfind = `<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/></D:prop></D:propfind>`
+
+	for _, target := range []string{"/", "/dav", "/dav/files/"} {
+		w := do("OPTIONS", target, "", "")
+		if w.Code != http.StatusOK || w.Header().Get("DAV") != "1, 2" || w.Header().Get("MS-Author-Via") != "DAV" {
+			t.Errorf("OPTIONS %s: got %d with DAV %q, want %d with DAV %q", target, w.Code, w.Header().Get("DAV"), http.StatusOK, "1, 2")
+		}
+	}
+	w := do("PROPFIND", "/dav", "1", propfind)
+	if w.Code != StatusMulti {
+		t.Fatalf("PROPFIND: got status %d, want %d", w.Code, StatusMulti)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`<D:href>/dav/</D:href>`,
+		`<D:href>/dav/files/</D:href>`,
+		`<D:resourcetype><D:collection xmlns:D="DAV:"/></D:resourcetype>`,
+		`<D:getcontentlength></D:getcontentlength></D:prop><D:status>HTTP/1.1 404 Not Found</D:status>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("PROPFIND: got %q, want it to contain %q", body, want)
+		}
+	}
+	if w := do("PROPFIND", "/", "0", ""); strings.Count(w.Body.String(), "<D:response>") != 1 {
+		t.Errorf("PROPFIND depth 0: got %q, want a single response", w.Body.String())
+	}
+
+	// The served tree and the paths outside of Prefix are not affected.
+	if w := do("PROPFIND", "/dav/files/alice/doc.docx", "0", propfind); !strings.Contains(w.Body.String(), "<D:getcontentlength>7</D:getcontentlength>") {
+		t.Errorf("PROPFIND served file: got %q", w.Body.String())
+	}
+	if w := do("PROPFIND", "/dav/other", "0", ""); w.Code != http.StatusNotFound {
+		t.Errorf("PROPFIND outside of Prefix: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	h.AncestorProbes = false
+	if w := do("OPTIONS", "/dav", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("OPTIONS disabled: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
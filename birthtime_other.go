@@ -0,0 +1,27 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !darwin && !freebsd && !netbsd && !(linux && (amd64 || arm64 || riscv64 || loong64))
+
+package webdav
+
+import (
+	"os"
+	"time"
+)
+
+// birthTime returns a zero time: the platform does not expose birth times.
+func birthTime(_ string, _ os.FileInfo) time.Time {
+	return time.Time{}
+}
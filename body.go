@@ -0,0 +1,181 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+var (
+	// ErrBodyTooLarge is returned when reading a request body exceeding the
+	// limit of its BodyPipeline. PUT requests then fail with "413 Request
+	// Entity Too Large".
+	ErrBodyTooLarge = errors.New("webdav: request body too large")
+	// ErrBodyRejected wraps the errors of the BodyScanners rejecting a
+	// request body. PUT requests then fail with "403 Forbidden".
+	ErrBodyRejected = errors.New("webdav: request body rejected")
+)
+
+// BodyScanner inspects a request body as it is read, such as an antivirus.
+type BodyScanner interface {
+	// Write is called with the successive bytes of the body. An error
+	// rejects the body.
+	io.Writer
+	// Finish is called once the whole body is read. An error rejects the
+	// body.
+	Finish() error
+}
+
+// Spool keeps a copy of a request body as it is read, so that it can be
+// read again, for example to resume or retry an upload.
+type Spool interface {
+	io.Writer
+	// Replay returns a reader of the bytes written so far.
+	Replay() (io.Reader, error)
+}
+
+// NewMemSpool returns a Spool keeping up to max bytes in memory. Writing
+// more fails with ErrBodyTooLarge.
+func NewMemSpool(max int64) Spool {
+	return &memSpool{max: max}
+}
+
+type memSpool struct {
+	max int64
+	buf bytes.Buffer
+}
+
+func (s *memSpool) Write(p []byte) (int, error) {
+	if int64(s.buf.Len()+len(p)) > s.max {
+		return 0, ErrBodyTooLarge
+	}
+	return s.buf.Write(p)
+}
+
+func (s *memSpool) Replay() (io.Reader, error) {
+	return bytes.NewReader(s.buf.Bytes()), nil
+}
+
+// BodyPipeline builds the reader of a request body, so that the features
+// inspecting uploads share a single read path. The stages are applied in a
+// fixed order: the size limit, the byte count, the hashes, the scanners and
+// the spool, so that the bytes beyond the limit are never hashed, scanned
+// or spooled. A BodyPipeline builds the reader of a single body.
+//
+// The zero value reads the body unchanged, counting its bytes.
+type BodyPipeline struct {
+	limit    int64
+	hashes   []hash.Hash
+	scanners []BodyScanner
+	spool    Spool
+}
+
+// NewBodyPipeline returns an empty BodyPipeline.
+func NewBodyPipeline() *BodyPipeline {
+	return &BodyPipeline{}
+}
+
+// Limit makes the body fail with ErrBodyTooLarge if it exceeds n bytes. A
+// non positive n removes the limit.
+func (p *BodyPipeline) Limit(n int64) *BodyPipeline {
+	p.limit = n
+	return p
+}
+
+// Hash adds hashes computed over the body.
+func (p *BodyPipeline) Hash(hs ...hash.Hash) *BodyPipeline {
+	p.hashes = append(p.hashes, hs...)
+	return p
+}
+
+// Scan adds a scanner of the body.
+func (p *BodyPipeline) Scan(s BodyScanner) *BodyPipeline {
+	p.scanners = append(p.scanners, s)
+	return p
+}
+
+// Spool sets the spool keeping a copy of the body.
+func (p *BodyPipeline) Spool(s Spool) *BodyPipeline {
+	p.spool = s
+	return p
+}
+
+// Reader returns the reader of the body read from r through the stages of
+// p.
+func (p *BodyPipeline) Reader(r io.Reader) *BodyReader {
+	return &BodyReader{r: r, p: *p}
+}
+
+// BodyReader reads a request body through the stages of a BodyPipeline.
+type BodyReader struct {
+	r   io.Reader
+	p   BodyPipeline
+	n   int64
+	err error
+}
+
+// N returns the number of bytes read so far.
+func (r *BodyReader) N() int64 {
+	return r.n
+}
+
+// Read implements io.Reader.
+func (r *BodyReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.p.limit > 0 && int64(len(b)) > r.p.limit-r.n+1 {
+		// One byte more than the limit is enough to detect a larger body.
+		b = b[:r.p.limit-r.n+1]
+	}
+	n, err := r.r.Read(b)
+	if r.p.limit > 0 && r.n+int64(n) > r.p.limit {
+		r.err = ErrBodyTooLarge
+		return 0, r.err
+	}
+	r.n += int64(n)
+	chunk := b[:n]
+	for _, h := range r.p.hashes {
+		h.Write(chunk)
+	}
+	for _, s := range r.p.scanners {
+		if _, scanErr := s.Write(chunk); scanErr != nil {
+			r.err = fmt.Errorf("%w: %v", ErrBodyRejected, scanErr)
+			return 0, r.err
+		}
+	}
+	if r.p.spool != nil {
+		if _, spoolErr := r.p.spool.Write(chunk); spoolErr != nil {
+			r.err = spoolErr
+			return 0, r.err
+		}
+	}
+	if err == io.EOF {
+		for _, s := range r.p.scanners {
+			if scanErr := s.Finish(); scanErr != nil {
+				r.err = fmt.Errorf("%w: %v", ErrBodyRejected, scanErr)
+				return n, r.err
+			}
+		}
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
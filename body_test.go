@@ -0,0 +1,133 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testScanner rejects the bodies containing bad, and records what it
+// scanned.
+type testScanner struct {
+	scanned  bytes.Buffer
+	finished bool
+}
+
+func (s *testScanner) Write(p []byte) (int, error) {
+	s.scanned.Write(p)
+	if bytes.Contains(s.scanned.Bytes(), []byte("bad")) {
+		return 0, errors.New("bad content")
+	}
+	return len(p), nil
+}
+
+func (s *testScanner) Finish() error {
+	s.finished = true
+	if s.scanned.Len() == 0 {
+		return errors.New("empty content")
+	}
+	return nil
+}
+
+func TestBodyPipeline(t *testing.T) {
+	hash := sha256.New()
+	scanner := &testScanner{}
+	spool := NewMemSpool(100)
+	r := NewBodyPipeline().Limit(10).Hash(hash).Scan(scanner).Spool(spool).Reader(strings.NewReader("hello"))
+	b, err := io.ReadAll(r)
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("ReadAll: got %q, %v, want %q", b, err, "hello")
+	}
+	want := sha256.Sum256([]byte("hello"))
+	if r.N() != 5 || !bytes.Equal(hash.Sum(nil), want[:]) || scanner.scanned.String() != "hello" || !scanner.finished {
+		t.Errorf("got %d bytes, hash %x, scanned %q, finished %t", r.N(), hash.Sum(nil), scanner.scanned.String(), scanner.finished)
+	}
+	replay, err := spool.Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(replay); string(b) != "hello" {
+		t.Errorf("Replay: got %q, want %q", b, "hello")
+	}
+
+	testCases := []struct {
+		desc    string
+		body    string
+		limit   int64
+		spool   int64
+		wantErr error
+	}{
+		{"at limit", "0123456789", 10, 100, nil},
+		{"too large", "0123456789x", 10, 100, ErrBodyTooLarge},
+		{"rejected", "a bad body", 0, 100, ErrBodyRejected},
+		{"rejected on finish", "", 0, 100, ErrBodyRejected},
+		{"spool full", "0123456789", 0, 5, ErrBodyTooLarge},
+	}
+	for _, tc := range testCases {
+		scanner := &testScanner{}
+		spool := NewMemSpool(tc.spool)
+		r := NewBodyPipeline().Limit(tc.limit).Scan(scanner).Spool(spool).Reader(strings.NewReader(tc.body))
+		_, err := io.ReadAll(r)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: got %v, want %v", tc.desc, err, tc.wantErr)
+		}
+		if tc.wantErr == ErrBodyTooLarge && tc.limit > 0 && (scanner.scanned.Len() > int(tc.limit) || r.N() > tc.limit) {
+			t.Errorf("%s: scanned %q and counted %d bytes beyond the limit", tc.desc, scanner.scanned.String(), r.N())
+		}
+	}
+}
+
+func TestUploadPipeline(t *testing.T) {
+	h := &Handler{
+		FileSystem: NewMemFS(),
+		LockSystem: NewMemLS(),
+		UploadPipeline: func(r *http.Request, name string, p *BodyPipeline) {
+			p.Limit(10).Scan(&testScanner{})
+		},
+	}
+	testCases := []struct {
+		desc, body string
+		want       int
+	}{
+		{"accepted", "good", http.StatusCreated},
+		{"too large", "good but too large", http.StatusRequestEntityTooLarge},
+		{"rejected", "bad", http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/file", strings.NewReader(tc.body)))
+		if w.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.want)
+		}
+	}
+	f, err := h.FileSystem.OpenFile(context.Background(), "/", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	children, err := f.Readdir(-1)
+	if err != nil || len(children) != 1 || children[0].Name() != "file" || children[0].Size() != 4 {
+		t.Errorf("Readdir: got %v, %v, want only the accepted file", children, err)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package caldav adds CalDAV, defined by RFC 4791, to a webdav.Handler.
+//
+// Calendars are collections of the FileSystem of the Handler, created by
+// MKCALENDAR, whose members are the iCalendar objects of the calendar.
+// Scheduling implements the scheduling inbox and outbox collections of RFC
+// 6638, so that the invitations sent by clients such as Apple Calendar are
+// delivered to the inboxes of the other principals of the server.
+package caldav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/drakkan/webdav"
+)
+
+// Namespace is the XML namespace of the CalDAV elements.
+const Namespace = "urn:ietf:params:xml:ns:caldav"
+
+var (
+	calendarDataName         = xml.Name{Space: Namespace, Local: "calendar-data"}
+	componentSetName         = xml.Name{Space: Namespace, Local: "supported-calendar-component-set"}
+	errCalendarPropsRejected = errors.New("caldav: calendar properties rejected")
+	errNoPropStore           = errors.New("caldav: the handler has no PropStore")
+	homeSetName              = xml.Name{Space: Namespace, Local: "calendar-home-set"}
+)
+
+// defaultComponents are the components supported by the calendars created
+// without a supported-calendar-component-set.
+var defaultComponents = []string{"VEVENT", "VTODO"}
+
+// maxCalendarData is the maximum size of the calendar-data properties.
+const maxCalendarData = 1 << 20
+
+// maxMkcalendarBody is the maximum size of the bodies of the MKCALENDAR
+// requests.
+const maxMkcalendarBody = 1 << 20
+
+// Calendars serves the calendar collections of a webdav.Handler, whose
+// PropStore records which collections are calendars. It implements the
+// MKCALENDAR method, the calendar-query and calendar-multiget reports and
+// the calendar-data property of the calendar members, and reports the
+// calendar-home-set of the principals.
+type Calendars struct {
+	// Filter evaluates the filters of the calendar-query reports. If nil,
+	// DefaultFilter is used.
+	Filter Filter
+	// Scheduling, if non-nil, serves the scheduling inboxes and outboxes
+	// too.
+	Scheduling *Scheduling
+	// HomeSet, if non-nil, returns the FileSystem path of the collection
+	// containing the calendars of principal, such as "/calendars/alice",
+	// reported by the calendar-home-set property. See
+	// webdav.Handler.Principal.
+	HomeSet func(principal string) string
+}
+
+type calendarsKey struct{}
+
+// calendars is the Calendars serving a request, see calendarsKey.
+type calendars struct {
+	*Calendars
+	h *webdav.Handler
+	// principal is the principal issuing the request.
+	principal string
+}
+
+// Handler registers the CalDAV properties and reports with h, and returns a
+// handler serving the MKCALENDAR requests and passing the other ones to h.
+// It must be called before h serves requests.
+func (c *Calendars) Handler(h *webdav.Handler) http.Handler {
+	h.RegisterResourceType(calendarType)
+	// The value of the component set is the dead property stored by
+	// MKCALENDAR: registering it only makes it protected.
+	h.RegisterLiveProperty(componentSetName, func(context.Context, string, os.FileInfo) (string, error) {
+		return "", webdav.ErrNotImplemented
+	}, nil)
+	h.RegisterLiveProperty(calendarDataName, findCalendarData, nil)
+	h.RegisterLiveProperty(homeSetName, findHomeSet, nil)
+	cals := &calendars{Calendars: c, h: h}
+	h.RegisterReport(calendarQueryName, cals.calendarQuery)
+	h.RegisterReport(calendarMultigetName, cals.calendarMultiget)
+	next := http.Handler(h)
+	if c.Scheduling != nil {
+		next = c.Scheduling.Handler(h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cal := &calendars{Calendars: c, h: h}
+		if h.Principal != nil {
+			cal.principal = h.Principal(r)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), calendarsKey{}, cal))
+		switch r.Method {
+		case "MKCALENDAR":
+			status, err := cal.mkcalendar(w, r)
+			if status != 0 {
+				http.Error(w, http.StatusText(status), status)
+			}
+			if h.Logger != nil {
+				h.Logger(r, status, err)
+			}
+			return
+		case http.MethodOptions:
+			next.ServeHTTP(w, r)
+			// Nothing is written by a successful OPTIONS, so the headers
+			// can still be changed.
+			if dav := w.Header().Get("DAV"); dav != "" {
+				w.Header().Set("DAV", dav+", calendar-access")
+				w.Header().Set("Allow", w.Header().Get("Allow")+", MKCALENDAR")
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// PrincipalProps returns the calendar-home-set property of principal, to be
+// added to its webdav.PrincipalInfo. prefix is the Prefix of the
+// webdav.Handler.
+func (c *Calendars) PrincipalProps(prefix, principal string) []webdav.Property {
+	return []webdav.Property{{
+		XMLName:  homeSetName,
+		InnerXML: []byte(homeSetHref(prefix, c.HomeSet(principal))),
+	}}
+}
+
+func homeSetHref(prefix, home string) string {
+	href := (&url.URL{Path: path.Join("/", prefix, home) + "/"}).EscapedPath()
+	return `<D:href xmlns:D="DAV:">` + escape(href) + `</D:href>`
+}
+
+// isCalendar reports whether collection name is a calendar.
+func (c *calendars) isCalendar(ctx context.Context, name string) (bool, error) {
+	if c.h.PropStore == nil {
+		return false, nil
+	}
+	props, err := c.h.PropStore.Get(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	_, ok := props[componentSetName]
+	return ok, nil
+}
+
+// mkcalendar creates the calendar collection requested by r, defined by RFC
+// 4791 section 5.3.1. The collection is created by a MKCOL request served by
+// the webdav.Handler, so that it is subject to its locks and checks.
+func (c *calendars) mkcalendar(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	if c.h.PropStore == nil {
+		return http.StatusForbidden, errNoPropStore
+	}
+	var body struct {
+		Set []struct {
+			Prop struct {
+				Props []struct {
+					XMLName  xml.Name
+					Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+					InnerXML []byte `xml:",innerxml"`
+					Comps    []struct {
+						Name string `xml:"name,attr"`
+					} `xml:"urn:ietf:params:xml:ns:caldav comp"`
+				} `xml:",any"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: set"`
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxMkcalendarBody+1))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(data) > maxMkcalendarBody {
+		return http.StatusRequestEntityTooLarge, webdav.ErrBodyTooLarge
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := xml.Unmarshal(data, &body); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	comps := defaultComponents
+	var props []webdav.Property
+	for _, set := range body.Set {
+		for _, p := range set.Prop.Props {
+			if p.XMLName == componentSetName {
+				comps = nil
+				for _, comp := range p.Comps {
+					comps = append(comps, strings.ToUpper(comp.Name))
+				}
+				continue
+			}
+			props = append(props, webdav.Property{XMLName: p.XMLName, Lang: p.Lang, InnerXML: p.InnerXML})
+		}
+	}
+	var set strings.Builder
+	for _, comp := range comps {
+		set.WriteString(`<C:comp xmlns:C="` + Namespace + `" name="` + escape(comp) + `"/>`)
+	}
+	props = append(props, webdav.Property{XMLName: componentSetName, InnerXML: []byte(set.String())})
+
+	mkcol := r.Clone(r.Context())
+	mkcol.Method = "MKCOL"
+	mkcol.Body = http.NoBody
+	mkcol.ContentLength = 0
+	rec := &statusRecorder{ResponseWriter: w}
+	c.h.ServeHTTP(rec, mkcol)
+	if rec.status != http.StatusCreated {
+		return 0, nil
+	}
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, c.h.Prefix))
+	pstats, err := c.h.PatchProps(r, name, []webdav.Proppatch{{Props: props}})
+	if err == nil {
+		for _, ps := range pstats {
+			if ps.Status != http.StatusOK {
+				err = errCalendarPropsRejected
+			}
+		}
+	}
+	if err != nil {
+		// The calendar is created with all of its properties or not at
+		// all.
+		if rmErr := c.h.FileSystem.RemoveAll(r.Context(), name); rmErr != nil {
+			return http.StatusInternalServerError, rmErr
+		}
+		return http.StatusForbidden, err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return 0, nil
+}
+
+// statusRecorder records the status of a response, only writing it if it is
+// not "201 Created".
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		if status != http.StatusCreated {
+			r.ResponseWriter.WriteHeader(status)
+		}
+	}
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.status == http.StatusCreated {
+		return len(p), nil
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// calendarType returns the calendar resource type of the calendars.
+func calendarType(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+	c, _ := ctx.Value(calendarsKey{}).(*calendars)
+	if c == nil || !fi.IsDir() {
+		return "", nil
+	}
+	if ok, err := c.isCalendar(ctx, name); err != nil || !ok {
+		return "", err
+	}
+	return `<C:calendar xmlns:C="` + Namespace + `"/>`, nil
+}
+
+// findHomeSet returns the calendar-home-set property, defined by RFC 4791
+// section 6.2.1, of the principal issuing the request.
+func findHomeSet(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+	c, _ := ctx.Value(calendarsKey{}).(*calendars)
+	if c == nil || c.HomeSet == nil || c.principal == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return homeSetHref(c.h.Prefix, c.HomeSet(c.principal)), nil
+}
+
+// findCalendarData returns the calendar-data property, defined by RFC 4791
+// section 9.6, of the members of the calendars: their iCalendar object.
+func findCalendarData(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+	c, _ := ctx.Value(calendarsKey{}).(*calendars)
+	if c == nil || fi.IsDir() || fi.Size() > maxCalendarData {
+		return "", webdav.ErrNotImplemented
+	}
+	if ok, err := c.isCalendar(ctx, path.Dir(path.Clean("/"+name))); err != nil || !ok {
+		if err == nil {
+			err = webdav.ErrNotImplemented
+		}
+		return "", err
+	}
+	data, err := readFile(ctx, c.h.FileSystem, name)
+	if err != nil {
+		return "", err
+	}
+	return escape(string(data)), nil
+}
+
+// readFile returns the content of file name, up to maxCalendarData bytes.
+func readFile(ctx context.Context, fs webdav.FileSystem, name string) ([]byte, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, maxCalendarData))
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package caldav
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/drakkan/webdav"
+)
+
+const event = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:event-1\r\n" +
+	"SUMMARY:Team meeting\r\n" +
+	"DTSTART:20240110T100000Z\r\n" +
+	"DTEND:20240110T110000Z\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func newTestCalendars() (*webdav.Handler, http.Handler) {
+	h := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+		PropStore:  webdav.NewMemPropStore(),
+	}
+	return h, (&Calendars{}).Handler(h)
+}
+
+func TestMkcalendar(t *testing.T) {
+	h, ch := newTestCalendars()
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<C:mkcalendar xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:set><D:prop>
+    <D:displayname>Work</D:displayname>
+    <C:supported-calendar-component-set><C:comp name="VEVENT"/></C:supported-calendar-component-set>
+  </D:prop></D:set>
+</C:mkcalendar>`
+	if w := do(ch, "", "MKCALENDAR", "/dav/work/", body); w.Code != http.StatusCreated {
+		t.Fatalf("MKCALENDAR: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := do(ch, "", "MKCALENDAR", "/dav/home/", ""); w.Code != http.StatusCreated {
+		t.Fatalf("MKCALENDAR without body: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := do(ch, "", "MKCOL", "/dav/files/", ""); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	testCases := []struct {
+		desc, target string
+		want         int
+	}{
+		{"existing collection", "/dav/work/", http.StatusMethodNotAllowed},
+		{"missing parent", "/dav/a/b/", http.StatusConflict},
+	}
+	for _, tc := range testCases {
+		if w := do(ch, "", "MKCALENDAR", tc.target, ""); w.Code != tc.want {
+			t.Errorf("MKCALENDAR %s: got status %d, want %d", tc.desc, w.Code, tc.want)
+		}
+	}
+
+	propfind := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop>` +
+		`<D:resourcetype/><D:displayname/><C:supported-calendar-component-set xmlns:C="urn:ietf:params:xml:ns:caldav"/>` +
+		`</D:prop></D:propfind>`
+	propTests := []struct {
+		target string
+		want   []string
+	}{
+		{"/dav/work/", []string{
+			`<C:calendar xmlns:C="urn:ietf:params:xml:ns:caldav"/>`,
+			`<D:displayname>Work</D:displayname>`,
+			`<C:comp xmlns:C="urn:ietf:params:xml:ns:caldav" name="VEVENT"/></supported-calendar-component-set>`,
+		}},
+		{"/dav/home/", []string{
+			`<C:calendar xmlns:C="urn:ietf:params:xml:ns:caldav"/>`,
+			`name="VEVENT"/><C:comp xmlns:C="urn:ietf:params:xml:ns:caldav" name="VTODO"/>`,
+		}},
+	}
+	for _, tc := range propTests {
+		w := do(ch, "", "PROPFIND", tc.target, propfind, "Depth", "0")
+		for _, want := range tc.want {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("PROPFIND %s: got %q, want it to contain %q", tc.target, w.Body.String(), want)
+			}
+		}
+	}
+	if w := do(ch, "", "PROPFIND", "/dav/files/", propfind, "Depth", "0"); strings.Contains(w.Body.String(), "<C:calendar") ||
+		!strings.Contains(w.Body.String(), "<D:collection") {
+		t.Errorf("PROPFIND collection: got %q, want only the collection resourcetype", w.Body.String())
+	}
+
+	proppatch := `<?xml version="1.0" encoding="utf-8"?><D:propertyupdate xmlns:D="DAV:"><D:set><D:prop>` +
+		`<C:supported-calendar-component-set xmlns:C="urn:ietf:params:xml:ns:caldav"/>` +
+		`</D:prop></D:set></D:propertyupdate>`
+	if w := do(ch, "", "PROPPATCH", "/dav/files/", proppatch); !strings.Contains(w.Body.String(), "403 Forbidden") {
+		t.Errorf("PROPPATCH component set: got %q, want 403 Forbidden", w.Body.String())
+	}
+	props, err := h.PropStore.Get(context.Background(), "/files")
+	if err != nil || len(props) != 0 {
+		t.Errorf("PropStore.Get: got %v, %v, want no properties", props, err)
+	}
+}
+
+// rejectingPropStore refuses to patch the properties in the "x:" namespace.
+type rejectingPropStore struct {
+	webdav.PropStore
+}
+
+func (s rejectingPropStore) Patch(ctx context.Context, name string, patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			if p.XMLName.Space == "x:" {
+				return []webdav.Propstat{{Status: http.StatusForbidden, Props: []webdav.Property{{XMLName: p.XMLName}}}}, nil
+			}
+		}
+	}
+	return s.PropStore.Patch(ctx, name, patches)
+}
+
+func TestMkcalendarRejectedProps(t *testing.T) {
+	h, ch := newTestCalendars()
+	h.PropStore = rejectingPropStore{h.PropStore}
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<C:mkcalendar xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:set><D:prop><X:color xmlns:X="x:">red</X:color></D:prop></D:set>
+</C:mkcalendar>`
+	if w := do(ch, "", "MKCALENDAR", "/dav/work/", body); w.Code != http.StatusForbidden {
+		t.Errorf("MKCALENDAR: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if _, err := h.FileSystem.Stat(context.Background(), "/work"); !os.IsNotExist(err) {
+		t.Errorf("Stat: got %v, want not exist", err)
+	}
+}
+
+func TestMkcalendarForbiddenNamespace(t *testing.T) {
+	h, ch := newTestCalendars()
+	h.DeniedPropNamespaces = []string{"x:"}
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<C:mkcalendar xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:set><D:prop><X:color xmlns:X="x:">red</X:color></D:prop></D:set>
+</C:mkcalendar>`
+	if w := do(ch, "", "MKCALENDAR", "/dav/work/", body); w.Code != http.StatusForbidden {
+		t.Errorf("MKCALENDAR: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if _, err := h.FileSystem.Stat(context.Background(), "/work"); !os.IsNotExist(err) {
+		t.Errorf("Stat: got %v, want not exist", err)
+	}
+}
+
+func TestMkcalendarTooLarge(t *testing.T) {
+	h, ch := newTestCalendars()
+	body := `<C:mkcalendar xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">` + strings.Repeat(" ", maxMkcalendarBody) + `</C:mkcalendar>`
+	if w := do(ch, "", "MKCALENDAR", "/dav/work/", body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("MKCALENDAR: got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if _, err := h.FileSystem.Stat(context.Background(), "/work"); !os.IsNotExist(err) {
+		t.Errorf("Stat: got %v, want not exist", err)
+	}
+}
+
+func TestCalendarHomeSet(t *testing.T) {
+	h := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+		PropStore:  webdav.NewMemPropStore(),
+		Principal: func(r *http.Request) string {
+			user, _, _ := r.BasicAuth()
+			return user
+		},
+	}
+	c := &Calendars{HomeSet: func(principal string) string { return "/calendars/" + principal }}
+	ch := c.Handler(h)
+	propfind := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop>` +
+		`<C:calendar-home-set xmlns:C="urn:ietf:params:xml:ns:caldav"/></D:prop></D:propfind>`
+	w := do(ch, "alice", "PROPFIND", "/dav/", propfind, "Depth", "0")
+	if want := `<D:href xmlns:D="DAV:">/dav/calendars/alice/</D:href>`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("PROPFIND: got %q, want it to contain %q", w.Body.String(), want)
+	}
+
+	props := c.PrincipalProps("/dav", "bob b&b")
+	if len(props) != 1 || props[0].XMLName != homeSetName || string(props[0].InnerXML) != `<D:href xmlns:D="DAV:">/dav/calendars/bob%20b&amp;b/</D:href>` {
+		t.Errorf("PrincipalProps: got %+v", props)
+	}
+}
+
+func TestCalendarsOptions(t *testing.T) {
+	_, ch := newTestCalendars()
+	w := do(ch, "", "OPTIONS", "/dav/", "")
+	if dav := w.Header().Get("DAV"); !strings.HasSuffix(dav, ", calendar-access") {
+		t.Errorf("DAV: got %q, want calendar-access", dav)
+	}
+	if allow := w.Header().Get("Allow"); !strings.Contains(allow, "MKCALENDAR") {
+		t.Errorf("Allow: got %q, want MKCALENDAR", allow)
+	}
+}
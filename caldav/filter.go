@@ -0,0 +1,224 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package caldav
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/drakkan/webdav/internal/contentline"
+)
+
+// CompFilter is a comp-filter element of a calendar-query report, defined
+// by RFC 4791 section 9.7.1. A component matches if it has the name Name
+// and matches the TimeRange, if any, and all of the Props and Comps
+// filters.
+type CompFilter struct {
+	Name string
+	// IsNotDefined, if true, matches if no component is named Name.
+	IsNotDefined bool
+	TimeRange    *TimeRange
+	Props        []PropFilter
+	Comps        []CompFilter
+}
+
+// PropFilter is a prop-filter element, defined by RFC 4791 section 9.7.2.
+type PropFilter struct {
+	Name string
+	// IsNotDefined, if true, matches if the component has no property
+	// named Name.
+	IsNotDefined bool
+	TimeRange    *TimeRange
+	TextMatch    *TextMatch
+	Params       []ParamFilter
+}
+
+// ParamFilter is a param-filter element, defined by RFC 4791 section 9.7.3.
+type ParamFilter struct {
+	Name string
+	// IsNotDefined, if true, matches if the property has no parameter
+	// named Name.
+	IsNotDefined bool
+	TextMatch    *TextMatch
+}
+
+// TextMatch is a text-match element, defined by RFC 4791 section 9.7.5,
+// matching the values containing Text.
+type TextMatch struct {
+	Text string
+	// Collation is "i;ascii-casemap", the default, or "i;octet".
+	Collation       string
+	NegateCondition bool
+}
+
+// TimeRange is a time-range element, defined by RFC 4791 section 9.9. A
+// zero Start or End means that the range is unbounded.
+type TimeRange struct {
+	Start, End time.Time
+}
+
+// Filter evaluates the filters of the calendar-query reports.
+type Filter interface {
+	// Match reports whether the calendar object resource name, whose
+	// content is data, matches filter. ctx is the request context.
+	Match(ctx context.Context, name string, data []byte, filter CompFilter) (bool, error)
+}
+
+// DefaultFilter is the Filter used if Calendars.Filter is nil. It does not
+// expand recurrences: the recurring components match the time ranges
+// ending after their start, and the clients filter their instances.
+// Floating times are compared as UTC times.
+type DefaultFilter struct{}
+
+// Match implements Filter. The resources that are not iCalendar objects
+// never match.
+func (DefaultFilter) Match(ctx context.Context, name string, data []byte, filter CompFilter) (bool, error) {
+	cal, err := contentline.Parse(string(data))
+	if err != nil {
+		return false, nil
+	}
+	return matchComps([]*contentline.Component{cal}, filter), nil
+}
+
+// matchComps reports whether comps, the children of a component, match f.
+func matchComps(comps []*contentline.Component, f CompFilter) bool {
+	for _, c := range comps {
+		if c.Name != strings.ToUpper(f.Name) {
+			continue
+		}
+		if f.IsNotDefined {
+			return false
+		}
+		if matchComp(c, f) {
+			return true
+		}
+	}
+	return f.IsNotDefined
+}
+
+func matchComp(c *contentline.Component, f CompFilter) bool {
+	if f.TimeRange != nil && !overlaps(c, *f.TimeRange) {
+		return false
+	}
+	for _, pf := range f.Props {
+		if !matchProp(c, pf) {
+			return false
+		}
+	}
+	for _, cf := range f.Comps {
+		if !matchComps(c.Children, cf) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchProp(c *contentline.Component, f PropFilter) bool {
+	found := false
+	for _, p := range c.Props {
+		if p.Name != strings.ToUpper(f.Name) {
+			continue
+		}
+		found = true
+		if f.IsNotDefined {
+			return false
+		}
+		if f.TimeRange != nil {
+			t, _, err := propTime(p)
+			if err != nil || !f.TimeRange.contains(t) {
+				continue
+			}
+		}
+		if f.TextMatch != nil && !f.TextMatch.match(p.Value) {
+			continue
+		}
+		ok := true
+		for _, pf := range f.Params {
+			if !matchParam(p, pf) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return !found && f.IsNotDefined
+}
+
+func matchParam(p contentline.Property, f ParamFilter) bool {
+	v, ok := p.Params[strings.ToUpper(f.Name)]
+	if !ok || f.IsNotDefined {
+		return !ok && f.IsNotDefined
+	}
+	return f.TextMatch == nil || f.TextMatch.match(v)
+}
+
+func (m *TextMatch) match(v string) bool {
+	text := m.Text
+	if m.Collation != "i;octet" {
+		v, text = strings.ToLower(v), strings.ToLower(text)
+	}
+	return strings.Contains(v, text) != m.NegateCondition
+}
+
+func (tr TimeRange) contains(t time.Time) bool {
+	return (tr.Start.IsZero() || !t.Before(tr.Start)) && (tr.End.IsZero() || t.Before(tr.End))
+}
+
+// overlaps reports whether component c overlaps tr, as defined by RFC 4791
+// section 9.9. The components without dates, such as the to-dos without
+// start and due dates, overlap any range.
+func overlaps(c *contentline.Component, tr TimeRange) bool {
+	p, ok := c.Prop("DTSTART")
+	if !ok {
+		p, ok = c.Prop("DUE")
+	}
+	if !ok {
+		return true
+	}
+	start, date, err := propTime(p)
+	if err != nil {
+		return true
+	}
+	if !tr.End.IsZero() && !start.Before(tr.End) {
+		return false
+	}
+	_, rrule := c.Prop("RRULE")
+	_, rdate := c.Prop("RDATE")
+	if rrule || rdate {
+		return true
+	}
+	end := start
+	if p, ok := c.Prop("DTEND"); ok {
+		end, _, err = propTime(p)
+	} else if p, ok := c.Prop("DUE"); ok {
+		end, _, err = propTime(p)
+	} else if p, ok := c.Prop("DURATION"); ok {
+		var d time.Duration
+		d, err = parseDuration(strings.TrimSpace(p.Value))
+		end = start.Add(d)
+	} else if date {
+		end = start.AddDate(0, 0, 1)
+	}
+	if err != nil {
+		return true
+	}
+	if end.After(start) {
+		return tr.Start.IsZero() || end.After(tr.Start)
+	}
+	return tr.Start.IsZero() || !start.Before(tr.Start)
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package caldav
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultFilter(t *testing.T) {
+	calendar := func(lines ...string) string {
+		return "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\n" + strings.Join(lines, "\r\n") + "\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	}
+	day := func(d int) time.Time {
+		return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	events := func(f CompFilter) CompFilter {
+		return CompFilter{Name: "VCALENDAR", Comps: []CompFilter{f}}
+	}
+	inRange := func(start, end time.Time) CompFilter {
+		return events(CompFilter{Name: "VEVENT", TimeRange: &TimeRange{Start: start, End: end}})
+	}
+	testCases := []struct {
+		desc   string
+		data   string
+		filter CompFilter
+		want   bool
+	}{
+		{"not iCalendar", "hello", CompFilter{Name: "VCALENDAR"}, false},
+		{"other root", calendar(), CompFilter{Name: "VCARD"}, false},
+		{"before range", calendar("DTSTART:20240101T100000Z", "DTEND:20240101T110000Z"), inRange(day(2), day(3)), false},
+		{"in range", calendar("DTSTART:20240102T100000Z", "DTEND:20240102T110000Z"), inRange(day(2), day(3)), true},
+		{"ends at range start", calendar("DTSTART:20240101T230000Z", "DTEND:20240102T000000Z"), inRange(day(2), day(3)), false},
+		{"unbounded end", calendar("DTSTART:20240105T100000Z"), inRange(day(2), time.Time{}), true},
+		{"duration", calendar("DTSTART:20240101T230000Z", "DURATION:PT2H"), inRange(day(2), day(3)), true},
+		{"all day", calendar("DTSTART;VALUE=DATE:20240102"), inRange(day(2).Add(12*time.Hour), day(3)), true},
+		{"time zone", calendar("DTSTART;TZID=America/New_York:20240101T220000"), inRange(day(2), day(3)), true},
+		{"recurring", calendar("DTSTART:20231201T100000Z", "DTEND:20231201T110000Z", "RRULE:FREQ=WEEKLY"), inRange(day(2), day(3)), true},
+		{"recurring later", calendar("DTSTART:20240201T100000Z", "RRULE:FREQ=WEEKLY"), inRange(day(2), day(3)), false},
+		{"text match", calendar("SUMMARY:Team Meeting"),
+			events(CompFilter{Name: "VEVENT", Props: []PropFilter{{Name: "summary", TextMatch: &TextMatch{Text: "meeting"}}}}), true},
+		{"octet text match", calendar("SUMMARY:Team Meeting"),
+			events(CompFilter{Name: "VEVENT", Props: []PropFilter{{Name: "SUMMARY", TextMatch: &TextMatch{Text: "meeting", Collation: "i;octet"}}}}), false},
+		{"negated text match", calendar("SUMMARY:Team Meeting"),
+			events(CompFilter{Name: "VEVENT", Props: []PropFilter{{Name: "SUMMARY", TextMatch: &TextMatch{Text: "lunch", NegateCondition: true}}}}), true},
+		{"prop not defined", calendar("SUMMARY:Team Meeting"),
+			events(CompFilter{Name: "VEVENT", Props: []PropFilter{{Name: "LOCATION", IsNotDefined: true}}}), true},
+		{"quoted param", calendar(`ATTENDEE;CN="Doe: John";PARTSTAT=ACCEPTED:mailto:john@example.com`),
+			events(CompFilter{Name: "VEVENT", Props: []PropFilter{{Name: "ATTENDEE", Params: []ParamFilter{{Name: "PARTSTAT", TextMatch: &TextMatch{Text: "accepted"}}}}}}), true},
+		{"param not defined", calendar(`ATTENDEE;CN="Doe: John":mailto:john@example.com`),
+			events(CompFilter{Name: "VEVENT", Props: []PropFilter{{Name: "ATTENDEE", Params: []ParamFilter{{Name: "PARTSTAT", IsNotDefined: true}}}}}), true},
+	}
+	for _, tc := range testCases {
+		got, err := DefaultFilter{}.Match(context.Background(), "/cal/event.ics", []byte(tc.data), tc.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package caldav
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drakkan/webdav/internal/contentline"
+)
+
+var errInvalidDuration = errors.New("caldav: invalid duration")
+
+// propTime returns the value of p as a DATE or DATE-TIME, and whether it is
+// a DATE. Floating times, and the ones of unknown time zones, are in UTC.
+func propTime(p contentline.Property) (t time.Time, date bool, err error) {
+	loc := time.UTC
+	if tzid := p.Params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	v := strings.TrimSpace(p.Value)
+	switch {
+	case len(v) == 8:
+		t, err = time.ParseInLocation("20060102", v, loc)
+		return t, true, err
+	case strings.HasSuffix(v, "Z"):
+		t, err = time.Parse("20060102T150405Z", v)
+	default:
+		t, err = time.ParseInLocation("20060102T150405", v, loc)
+	}
+	return t, false, err
+}
+
+// parseDuration parses an iCalendar duration, defined by RFC 5545 section
+// 3.3.6, such as "P1D" or "-PT1H30M".
+func parseDuration(s string) (time.Duration, error) {
+	neg := false
+	switch {
+	case strings.HasPrefix(s, "-"):
+		neg, s = true, s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+	if !strings.HasPrefix(s, "P") || len(s) < 3 {
+		return 0, errInvalidDuration
+	}
+	var d time.Duration
+	inTime := false
+	n := ""
+	for _, c := range s[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			n += string(c)
+			continue
+		case c == 'T' && n == "":
+			inTime = true
+			continue
+		}
+		v, err := strconv.Atoi(n)
+		if err != nil {
+			return 0, errInvalidDuration
+		}
+		n = ""
+		switch {
+		case c == 'W' && !inTime:
+			d += time.Duration(v) * 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			d += time.Duration(v) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(v) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(v) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(v) * time.Second
+		default:
+			return 0, errInvalidDuration
+		}
+	}
+	if n != "" {
+		return 0, errInvalidDuration
+	}
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
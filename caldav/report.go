@@ -0,0 +1,300 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package caldav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drakkan/webdav"
+)
+
+var (
+	calendarMultigetName = xml.Name{Space: Namespace, Local: "calendar-multiget"}
+	calendarQueryName    = xml.Name{Space: Namespace, Local: "calendar-query"}
+)
+
+// reportProp is the DAV:prop element of a report, naming the properties to
+// report.
+type reportProp struct {
+	Names []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+func (p *reportProp) names() []xml.Name {
+	names := make([]xml.Name, 0, len(p.Names))
+	for _, n := range p.Names {
+		names = append(names, n.XMLName)
+	}
+	return names
+}
+
+// The xml elements of the filters are decoded into these types, and then
+// converted to the exported ones.
+type (
+	xmlCompFilter struct {
+		Name         string          `xml:"name,attr"`
+		IsNotDefined *struct{}       `xml:"urn:ietf:params:xml:ns:caldav is-not-defined"`
+		TimeRange    *xmlTimeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+		Props        []xmlPropFilter `xml:"urn:ietf:params:xml:ns:caldav prop-filter"`
+		Comps        []xmlCompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	}
+	xmlPropFilter struct {
+		Name         string           `xml:"name,attr"`
+		IsNotDefined *struct{}        `xml:"urn:ietf:params:xml:ns:caldav is-not-defined"`
+		TimeRange    *xmlTimeRange    `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+		TextMatch    *xmlTextMatch    `xml:"urn:ietf:params:xml:ns:caldav text-match"`
+		Params       []xmlParamFilter `xml:"urn:ietf:params:xml:ns:caldav param-filter"`
+	}
+	xmlParamFilter struct {
+		Name         string        `xml:"name,attr"`
+		IsNotDefined *struct{}     `xml:"urn:ietf:params:xml:ns:caldav is-not-defined"`
+		TextMatch    *xmlTextMatch `xml:"urn:ietf:params:xml:ns:caldav text-match"`
+	}
+	xmlTextMatch struct {
+		Text            string `xml:",chardata"`
+		Collation       string `xml:"collation,attr"`
+		NegateCondition string `xml:"negate-condition,attr"`
+	}
+	xmlTimeRange struct {
+		Start string `xml:"start,attr"`
+		End   string `xml:"end,attr"`
+	}
+)
+
+func (f *xmlCompFilter) filter() (CompFilter, error) {
+	cf := CompFilter{Name: f.Name, IsNotDefined: f.IsNotDefined != nil}
+	var err error
+	if cf.TimeRange, err = f.TimeRange.timeRange(); err != nil {
+		return cf, err
+	}
+	for _, p := range f.Props {
+		pf, err := p.filter()
+		if err != nil {
+			return cf, err
+		}
+		cf.Props = append(cf.Props, pf)
+	}
+	for _, c := range f.Comps {
+		f, err := c.filter()
+		if err != nil {
+			return cf, err
+		}
+		cf.Comps = append(cf.Comps, f)
+	}
+	return cf, nil
+}
+
+func (f *xmlPropFilter) filter() (PropFilter, error) {
+	pf := PropFilter{Name: f.Name, IsNotDefined: f.IsNotDefined != nil, TextMatch: f.TextMatch.textMatch()}
+	var err error
+	if pf.TimeRange, err = f.TimeRange.timeRange(); err != nil {
+		return pf, err
+	}
+	for _, p := range f.Params {
+		pf.Params = append(pf.Params, ParamFilter{
+			Name:         p.Name,
+			IsNotDefined: p.IsNotDefined != nil,
+			TextMatch:    p.TextMatch.textMatch(),
+		})
+	}
+	return pf, nil
+}
+
+func (m *xmlTextMatch) textMatch() *TextMatch {
+	if m == nil {
+		return nil
+	}
+	return &TextMatch{Text: m.Text, Collation: m.Collation, NegateCondition: m.NegateCondition == "yes"}
+}
+
+func (tr *xmlTimeRange) timeRange() (*TimeRange, error) {
+	if tr == nil {
+		return nil, nil
+	}
+	var r TimeRange
+	var err error
+	if tr.Start != "" {
+		if r.Start, err = time.Parse("20060102T150405Z", tr.Start); err != nil {
+			return nil, webdav.ErrInvalidReport
+		}
+	}
+	if tr.End != "" {
+		if r.End, err = time.Parse("20060102T150405Z", tr.End); err != nil {
+			return nil, webdav.ErrInvalidReport
+		}
+	}
+	if tr.Start == "" && tr.End == "" {
+		return nil, webdav.ErrInvalidReport
+	}
+	return &r, nil
+}
+
+// calendarQuery writes the calendar-query report, defined by RFC 4791
+// section 7.8, of the calendar objects matching the filter of the report.
+func (c *calendars) calendarQuery(ctx context.Context, w http.ResponseWriter, r *http.Request, report webdav.Report) error {
+	var body struct {
+		Prop   *reportProp `xml:"DAV: prop"`
+		Filter *struct {
+			CompFilter xmlCompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+		} `xml:"urn:ietf:params:xml:ns:caldav filter"`
+	}
+	if err := xml.Unmarshal(report.Body, &body); err != nil || body.Prop == nil || body.Filter == nil {
+		return webdav.ErrInvalidReport
+	}
+	filter, err := body.Filter.CompFilter.filter()
+	if err != nil {
+		return err
+	}
+	var evaluator Filter = DefaultFilter{}
+	if c.Filter != nil {
+		evaluator = c.Filter
+	}
+	depth := report.Depth
+	if r.Header.Get("Depth") == "" {
+		// The clients omitting the Depth header query the members of the
+		// calendar, not the calendar itself.
+		depth = 1
+	}
+	names, err := members(ctx, c.h.FileSystem, report.Name, depth)
+	if err != nil {
+		return err
+	}
+	mw := c.h.NewMultiStatusWriter(ctx, w)
+	for _, name := range names {
+		data, err := readFile(ctx, c.h.FileSystem, name)
+		if err != nil {
+			return err
+		}
+		ok, err := evaluator.Match(ctx, name, data, filter)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		pstats, err := c.h.Props(ctx, name, body.Prop.names())
+		if err != nil {
+			return err
+		}
+		if err := mw.Write(name, false, pstats); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// members returns the names of the files within name, up to depth, or name
+// itself if it is a file.
+func members(ctx context.Context, fs webdav.FileSystem, name string, depth int) ([]string, error) {
+	fi, err := fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{name}, nil
+	}
+	if depth == 0 {
+		return nil, nil
+	}
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	var names []string
+	for _, child := range children {
+		if webdav.IsUploadName(child.Name()) {
+			continue
+		}
+		childName := path.Join(name, child.Name())
+		if !child.IsDir() {
+			names = append(names, childName)
+		} else if depth < 0 {
+			descendants, err := members(ctx, fs, childName, depth)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, descendants...)
+		}
+	}
+	return names, nil
+}
+
+// stripPrefix returns the FileSystem name of the path p of a resource
+// served by a handler with the given prefix, or false if p is outside of
+// the handler. Unlike strings.TrimPrefix, it only strips whole segments.
+func stripPrefix(prefix, p string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix != "" && p != prefix && !strings.HasPrefix(p, prefix+"/") {
+		return "", false
+	}
+	return path.Clean("/" + p[len(prefix):]), true
+}
+
+// calendarMultiget writes the calendar-multiget report, defined by RFC 4791
+// section 7.9, of the resources named by the hrefs of the report.
+func (c *calendars) calendarMultiget(ctx context.Context, w http.ResponseWriter, r *http.Request, report webdav.Report) error {
+	var body struct {
+		Prop  *reportProp `xml:"DAV: prop"`
+		Hrefs []string    `xml:"DAV: href"`
+	}
+	if err := xml.Unmarshal(report.Body, &body); err != nil || body.Prop == nil {
+		return webdav.ErrInvalidReport
+	}
+	mw := c.h.NewMultiStatusWriter(ctx, w)
+	for _, href := range body.Hrefs {
+		u, err := url.Parse(strings.TrimSpace(href))
+		if err != nil {
+			return webdav.ErrInvalidReport
+		}
+		name, ok := stripPrefix(c.h.Prefix, u.Path)
+		if !ok {
+			// The resources outside of the handler cannot be reported.
+			return webdav.ErrInvalidReport
+		}
+		fi, err := c.h.FileSystem.Stat(ctx, name)
+		if os.IsNotExist(err) {
+			if err := mw.WriteStatus(name, http.StatusNotFound); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		pstats, err := c.h.Props(ctx, name, body.Prop.names())
+		if err != nil {
+			return err
+		}
+		if err := mw.Write(name, fi.IsDir(), pstats); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
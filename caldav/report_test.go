@@ -0,0 +1,132 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package caldav
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newTestCalendar(t *testing.T) http.Handler {
+	t.Helper()
+	_, ch := newTestCalendars()
+	if w := do(ch, "", "MKCALENDAR", "/dav/cal/", ""); w.Code != http.StatusCreated {
+		t.Fatalf("MKCALENDAR: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	task := strings.NewReplacer("VEVENT", "VTODO", "event-1", "task-1", "Team meeting", "Review").Replace(event)
+	later := strings.NewReplacer("event-1", "event-2", "20240110", "20240320").Replace(event)
+	for name, data := range map[string]string{"event.ics": event, "task.ics": task, "later.ics": later} {
+		if w := do(ch, "", "PUT", "/dav/cal/"+name, data); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: got status %d, want %d", name, w.Code, http.StatusCreated)
+		}
+	}
+	return ch
+}
+
+func TestCalendarQuery(t *testing.T) {
+	ch := newTestCalendar(t)
+	query := func(filter string) string {
+		return `<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop><D:getetag/><C:calendar-data/></D:prop>
+  <C:filter><C:comp-filter name="VCALENDAR">` + filter + `</C:comp-filter></C:filter>
+</C:calendar-query>`
+	}
+	testCases := []struct {
+		desc, filter string
+		want         []string
+	}{{
+		"all", "",
+		[]string{"event.ics", "later.ics", "task.ics"},
+	}, {
+		"events", `<C:comp-filter name="VEVENT"/>`,
+		[]string{"event.ics", "later.ics"},
+	}, {
+		"events in January", `<C:comp-filter name="VEVENT"><C:time-range start="20240101T000000Z" end="20240201T000000Z"/></C:comp-filter>`,
+		[]string{"event.ics"},
+	}, {
+		"summary", `<C:comp-filter name="VTODO"><C:prop-filter name="SUMMARY"><C:text-match>review</C:text-match></C:prop-filter></C:comp-filter>`,
+		[]string{"task.ics"},
+	}, {
+		"no events", `<C:comp-filter name="VEVENT"><C:is-not-defined/></C:comp-filter>`,
+		[]string{"task.ics"},
+	}}
+	for _, tc := range testCases {
+		w := do(ch, "", "REPORT", "/dav/cal/", query(tc.filter), "Depth", "1")
+		if w.Code != http.StatusMultiStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, http.StatusMultiStatus)
+			continue
+		}
+		body := w.Body.String()
+		var got []string
+		for _, name := range []string{"event.ics", "later.ics", "task.ics"} {
+			if strings.Contains(body, "<D:href>/dav/cal/"+name+"</D:href>") {
+				got = append(got, name)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: got %v, want %v", tc.desc, got, tc.want)
+		}
+		if len(got) > 0 && (!strings.Contains(body, "<D:getetag>") || !strings.Contains(body, "BEGIN:VCALENDAR")) {
+			t.Errorf("%s: got %q, want the etag and the calendar data", tc.desc, body)
+		}
+	}
+
+	if w := do(ch, "", "REPORT", "/dav/cal/", query(`<C:comp-filter name="VEVENT"><C:time-range start="2024"/></C:comp-filter>`), "Depth", "1"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid time range: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	w := do(ch, "", "REPORT", "/dav/cal/", query(`<C:comp-filter name="VJOURNAL"/>`), "Depth", "1")
+	if w.Code != http.StatusMultiStatus || strings.Contains(w.Body.String(), "<D:response>") {
+		t.Errorf("no match: got status %d, body %q, want an empty multistatus", w.Code, w.Body.String())
+	}
+	w = do(ch, "", "REPORT", "/dav/cal/", query(`<C:comp-filter name="VTODO"/>`))
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "<D:href>/dav/cal/task.ics</D:href>") {
+		t.Errorf("no Depth: got status %d, body %q, want the task", w.Code, w.Body.String())
+	}
+}
+
+func TestCalendarMultiget(t *testing.T) {
+	ch := newTestCalendar(t)
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop><C:calendar-data/></D:prop>
+  <D:href>/dav/cal/task.ics</D:href>
+  <D:href>/dav/cal/missing.ics</D:href>
+</C:calendar-multiget>`
+	w := do(ch, "", "REPORT", "/dav/cal/", body, "Depth", "1")
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("REPORT: got status %d, want %d", w.Code, http.StatusMultiStatus)
+	}
+	got := w.Body.String()
+	for _, want := range []string{
+		`<D:response><D:href>/dav/cal/task.ics</D:href><D:propstat><D:prop><calendar-data xmlns="urn:ietf:params:xml:ns:caldav">BEGIN:VCALENDAR&#xD;&#xA;`,
+		`UID:task-1`,
+		`<D:response><D:href>/dav/cal/missing.ics</D:href><D:status>HTTP/1.1 404 Not Found</D:status></D:response>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("REPORT: got %q, want it to contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "event-1") {
+		t.Errorf("REPORT: got %q, want only the requested resources", got)
+	}
+	for _, href := range []string{"/other/task.ics", "/davx/cal/task.ics"} {
+		outside := strings.Replace(body, "/dav/cal/task.ics", href, 1)
+		if w := do(ch, "", "REPORT", "/dav/cal/", outside, "Depth", "1"); w.Code != http.StatusBadRequest {
+			t.Errorf("REPORT %s outside the handler: got status %d, want %d", href, w.Code, http.StatusBadRequest)
+		}
+	}
+}
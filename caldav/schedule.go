@@ -0,0 +1,331 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package caldav
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/drakkan/webdav"
+	"github.com/drakkan/webdav/internal/contentline"
+)
+
+// maxMessageSize is the maximum size of the iTIP messages posted to an
+// outbox.
+const maxMessageSize = 1 << 20
+
+var (
+	errInvalidMessage = errors.New("caldav: invalid iTIP message")
+	errNotSender      = errors.New("caldav: the principal is not the sender of the iTIP message")
+)
+
+// Scheduling serves the RFC 6638 scheduling inbox and outbox of the
+// principals of a webdav.Handler. The inboxes and outboxes are collections
+// of the FileSystem of the Handler, created when first written to, such as
+// by the delivery of a message: reading them before fails with "404 Not
+// Found". The iTIP messages posted to an outbox, such as invitations, are
+// stored in the inboxes of the recipients that are principals of the server.
+// The principal posting a message must be its sender, the organizer of a
+// request or the attendee of a reply, as resolved by Recipient. Free-busy
+// requests and the delivery to external recipients are not supported.
+type Scheduling struct {
+	// Inbox returns the FileSystem path of the scheduling inbox of
+	// principal, for example "/calendars/alice/inbox".
+	Inbox func(principal string) string
+	// Outbox returns the FileSystem path of the scheduling outbox of
+	// principal, for example "/calendars/alice/outbox".
+	Outbox func(principal string) string
+	// Recipient returns the principal whose calendar user address is
+	// address, such as "mailto:bob@example.com", or an empty string if it
+	// is not a principal of the server.
+	Recipient func(ctx context.Context, address string) string
+}
+
+type schedulingKey struct{}
+
+// scheduling is the Scheduling serving a request of principal, see
+// schedulingKey.
+type scheduling struct {
+	*Scheduling
+	principal string
+}
+
+// Handler registers the scheduling properties with h, and returns a handler
+// serving the requests posted to the outboxes and passing the other ones to
+// h. It must be called before h serves requests. See webdav.Handler.Principal.
+func (s *Scheduling) Handler(h *webdav.Handler) http.Handler {
+	h.RegisterResourceType(scheduleType)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := ""
+		if h.Principal != nil {
+			principal = h.Principal(r)
+		}
+		if principal != "" {
+			name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, h.Prefix))
+			inbox, outbox := path.Clean(s.Inbox(principal)), path.Clean(s.Outbox(principal))
+			if (name == inbox || name == outbox) && !isRead(r.Method) {
+				if err := mkdirAll(r.Context(), h.FileSystem, name); err != nil {
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+			}
+			if name == outbox && r.Method == http.MethodPost {
+				status, err := s.post(w, r, h, principal)
+				if status != 0 {
+					http.Error(w, http.StatusText(status), status)
+				}
+				if h.Logger != nil {
+					h.Logger(r, status, err)
+				}
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), schedulingKey{}, &scheduling{s, principal}))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isRead reports whether method only reads resources.
+func isRead(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND", "REPORT", "SEARCH":
+		return true
+	}
+	return false
+}
+
+// PrincipalProps returns the scheduling properties of principal, to be
+// added to its webdav.PrincipalInfo: the CalDAV schedule-inbox-URL,
+// schedule-outbox-URL and calendar-user-address-set. prefix is the Prefix
+// of the webdav.Handler and addresses are the calendar user addresses of
+// the principal.
+func (s *Scheduling) PrincipalProps(prefix, principal string, addresses ...string) []webdav.Property {
+	href := func(p string) string {
+		return `<D:href xmlns:D="DAV:">` + escape(p) + `</D:href>`
+	}
+	collection := func(p string) string {
+		return href((&url.URL{Path: path.Join("/", prefix, p) + "/"}).EscapedPath())
+	}
+	var set strings.Builder
+	for _, a := range addresses {
+		set.WriteString(href(a))
+	}
+	return []webdav.Property{{
+		XMLName:  xml.Name{Space: Namespace, Local: "schedule-inbox-URL"},
+		InnerXML: []byte(collection(s.Inbox(principal))),
+	}, {
+		XMLName:  xml.Name{Space: Namespace, Local: "schedule-outbox-URL"},
+		InnerXML: []byte(collection(s.Outbox(principal))),
+	}, {
+		XMLName:  xml.Name{Space: Namespace, Local: "calendar-user-address-set"},
+		InnerXML: []byte(set.String()),
+	}}
+}
+
+// scheduleType returns the resource type of the scheduling inbox and outbox
+// of the principal of the request.
+func scheduleType(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+	s, _ := ctx.Value(schedulingKey{}).(*scheduling)
+	if s == nil || !fi.IsDir() {
+		return "", nil
+	}
+	switch path.Clean("/" + name) {
+	case path.Clean(s.Inbox(s.principal)):
+		return `<C:schedule-inbox xmlns:C="` + Namespace + `"/>`, nil
+	case path.Clean(s.Outbox(s.principal)):
+		return `<C:schedule-outbox xmlns:C="` + Namespace + `"/>`, nil
+	}
+	return "", nil
+}
+
+// post delivers the iTIP message posted by principal to its outbox, defined
+// by RFC 6638 section 3.2.
+func (s *Scheduling) post(w http.ResponseWriter, r *http.Request, h *webdav.Handler, principal string) (status int, err error) {
+	ctx := r.Context()
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(body) > maxMessageSize {
+		return http.StatusRequestEntityTooLarge, errInvalidMessage
+	}
+	msg, err := parseMessage(string(body))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	// RFC 6638 section 3.2.2 requires the sender to be a calendar user
+	// address of the principal.
+	senders := msg.senders()
+	if len(senders) == 0 {
+		return http.StatusForbidden, errNotSender
+	}
+	for _, sender := range senders {
+		if s.Recipient(ctx, sender) != principal {
+			return http.StatusForbidden, errNotSender
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	b.WriteString(`<C:schedule-response xmlns:D="DAV:" xmlns:C="` + Namespace + `">`)
+	for _, recipient := range msg.recipients() {
+		// The request statuses are defined by RFC 5546 section 3.6.
+		status := "5.3;No scheduling support for user"
+		if principal := s.Recipient(ctx, recipient); principal != "" && !msg.freeBusy {
+			if err := deliver(ctx, h.FileSystem, s.Inbox(principal), body); err != nil {
+				return http.StatusInternalServerError, err
+			}
+			status = "2.0;Success"
+		}
+		b.WriteString(`<C:response><C:recipient><D:href>` + escape(recipient) + `</D:href></C:recipient>`)
+		b.WriteString(`<C:request-status>` + escape(status) + `</C:request-status></C:response>`)
+	}
+	b.WriteString(`</C:schedule-response>`)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, b.String())
+	return 0, nil
+}
+
+// deliver stores the iTIP message in inbox, creating it if needed.
+func deliver(ctx context.Context, fs webdav.FileSystem, inbox string, message []byte) error {
+	if err := mkdirAll(ctx, fs, inbox); err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	f, err := fs.OpenFile(ctx, path.Join(inbox, hex.EncodeToString(id)+".ics"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(message); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mkdirAll creates the collection name and its parents, if needed.
+func mkdirAll(ctx context.Context, fs webdav.FileSystem, name string) error {
+	name = path.Clean("/" + name)
+	if fi, err := fs.Stat(ctx, name); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("caldav: %s is not a collection", name)
+		}
+		return nil
+	}
+	if name != "/" {
+		if err := mkdirAll(ctx, fs, path.Dir(name)); err != nil {
+			return err
+		}
+	}
+	if err := fs.Mkdir(ctx, name, 0777); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// message is the scheduling information of an iTIP message, defined by RFC
+// 5546.
+type message struct {
+	method    string
+	organizer string
+	attendees []string
+	freeBusy  bool
+}
+
+// replies reports whether m is sent by an attendee to the organizer.
+func (m *message) replies() bool {
+	switch m.method {
+	case "REPLY", "REFRESH", "COUNTER":
+		return true
+	}
+	return false
+}
+
+// senders returns the calendar user addresses of the senders of m: the
+// organizer of the requests, and the attendees of the replies.
+func (m *message) senders() []string {
+	if m.replies() {
+		return m.attendees
+	}
+	if m.organizer == "" {
+		return nil
+	}
+	return []string{m.organizer}
+}
+
+// recipients returns the calendar user addresses of the recipients of m,
+// as defined by RFC 6638 section 3.2: the attendees of the requests sent
+// by the organizer, and the organizer of the replies.
+func (m *message) recipients() []string {
+	if m.replies() {
+		if m.organizer == "" {
+			return nil
+		}
+		return []string{m.organizer}
+	}
+	var recipients []string
+	seen := make(map[string]bool)
+	for _, a := range m.attendees {
+		if !seen[a] && !strings.EqualFold(a, m.organizer) {
+			seen[a] = true
+			recipients = append(recipients, a)
+		}
+	}
+	return recipients
+}
+
+// parseMessage parses the scheduling information of the iCalendar object
+// data.
+func parseMessage(data string) (*message, error) {
+	cal, err := contentline.Parse(data)
+	if err != nil || cal.Name != "VCALENDAR" {
+		return nil, errInvalidMessage
+	}
+	m := &message{}
+	if p, ok := cal.Prop("METHOD"); ok {
+		m.method = strings.ToUpper(strings.TrimSpace(p.Value))
+	}
+	if m.method == "" {
+		return nil, errInvalidMessage
+	}
+	for _, c := range cal.Children {
+		if c.Name == "VFREEBUSY" {
+			m.freeBusy = true
+		}
+		for _, p := range c.Props {
+			switch p.Name {
+			case "ORGANIZER":
+				m.organizer = strings.TrimSpace(p.Value)
+			case "ATTENDEE":
+				m.attendees = append(m.attendees, strings.TrimSpace(p.Value))
+			}
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,217 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package caldav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/drakkan/webdav"
+)
+
+const invitation = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"METHOD:REQUEST\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:meeting-1\r\n" +
+	"ORGANIZER:mailto:alice@example.com\r\n" +
+	"ATTENDEE;PARTSTAT=ACCEPTED:mailto:alice@example.com\r\n" +
+	"ATTENDEE;CN=Bob;PARTSTAT=NEEDS-ACTION:mailto:bob@\r\n" +
+	" example.com\r\n" +
+	"ATTENDEE:mailto:carol@example.org\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func newTestScheduling() (*webdav.Handler, http.Handler) {
+	h := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+		Principal: func(r *http.Request) string {
+			user, _, _ := r.BasicAuth()
+			return user
+		},
+	}
+	s := &Scheduling{
+		Inbox:  func(principal string) string { return "/calendars/" + principal + "/inbox" },
+		Outbox: func(principal string) string { return "/calendars/" + principal + "/outbox" },
+		Recipient: func(ctx context.Context, address string) string {
+			user, domain, _ := strings.Cut(strings.TrimPrefix(address, "mailto:"), "@")
+			if domain != "example.com" {
+				return ""
+			}
+			return user
+		},
+	}
+	return h, s.Handler(h)
+}
+
+func do(h http.Handler, user, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.SetBasicAuth(user, "password")
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestSchedulingDeliver(t *testing.T) {
+	h, sh := newTestScheduling()
+	w := do(sh, "alice", "POST", "/dav/calendars/alice/outbox/", invitation, "Content-Type", "text/calendar")
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`<C:response><C:recipient><D:href>mailto:bob@example.com</D:href></C:recipient><C:request-status>2.0;Success</C:request-status></C:response>`,
+		`<C:response><C:recipient><D:href>mailto:carol@example.org</D:href></C:recipient><C:request-status>5.3;No scheduling support for user</C:request-status></C:response>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("POST: response %q does not contain %q", body, want)
+		}
+	}
+	if strings.Contains(body, "alice@example.com") {
+		t.Errorf("POST: response %q contains the organizer", body)
+	}
+
+	ctx := context.Background()
+	f, err := h.FileSystem.OpenFile(ctx, "/calendars/bob/inbox", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil || len(children) != 1 {
+		t.Fatalf("Readdir: got %d children, %v, want 1", len(children), err)
+	}
+	w = do(sh, "bob", "GET", "/dav/calendars/bob/inbox/"+children[0].Name(), "")
+	if got := w.Body.String(); got != invitation {
+		t.Errorf("GET: got %q, want %q", got, invitation)
+	}
+	if _, err := h.FileSystem.Stat(ctx, "/calendars/alice/inbox"); !os.IsNotExist(err) {
+		t.Errorf("Stat organizer inbox: got %v, want not exist", err)
+	}
+}
+
+const reply = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"METHOD:REPLY\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:meeting-1\r\n" +
+	"ORGANIZER:mailto:alice@example.com\r\n" +
+	"ATTENDEE;PARTSTAT=ACCEPTED:mailto:bob@example.com\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestSchedulingReply(t *testing.T) {
+	h, sh := newTestScheduling()
+	w := do(sh, "bob", "POST", "/dav/calendars/bob/outbox", reply)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "mailto:alice@example.com") || strings.Contains(body, "carol") {
+		t.Errorf("POST: got response %q, want only the organizer", body)
+	}
+	if _, err := h.FileSystem.Stat(context.Background(), "/calendars/alice/inbox"); err != nil {
+		t.Errorf("Stat organizer inbox: %v", err)
+	}
+}
+
+func TestSchedulingErrors(t *testing.T) {
+	_, sh := newTestScheduling()
+	testCases := []struct {
+		desc, user, target, body string
+		want                     int
+	}{
+		{"not an iTIP message", "alice", "/dav/calendars/alice/outbox/", "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n", http.StatusBadRequest},
+		{"message too large", "alice", "/dav/calendars/alice/outbox/", strings.Repeat("x", maxMessageSize+1), http.StatusRequestEntityTooLarge},
+		// The outbox of another principal is served by the webdav.Handler.
+		{"other outbox", "bob", "/dav/calendars/alice/outbox/", invitation, http.StatusMethodNotAllowed},
+		// The principal must be the sender of the message.
+		{"not the organizer", "bob", "/dav/calendars/bob/outbox/", invitation, http.StatusForbidden},
+		{"not the attendee", "carol", "/dav/calendars/carol/outbox/", reply, http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		if w := do(sh, tc.user, "POST", tc.target, tc.body); w.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.want)
+		}
+	}
+}
+
+func TestSchedulingResourceType(t *testing.T) {
+	h, sh := newTestScheduling()
+	propfind := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/></D:prop></D:propfind>`
+	// Reading the inbox doesn't create it, the delivery of a message does,
+	// as posting a message creates the outbox.
+	if w := do(sh, "alice", "PROPFIND", "/dav/calendars/alice/inbox/", propfind, "Depth", "0"); w.Code != http.StatusNotFound {
+		t.Errorf("PROPFIND missing inbox: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if _, err := h.FileSystem.Stat(context.Background(), "/calendars/alice/inbox"); !os.IsNotExist(err) {
+		t.Errorf("Stat inbox: got %v, want not exist", err)
+	}
+	if w := do(sh, "bob", "POST", "/dav/calendars/bob/outbox/", reply); w.Code != http.StatusOK {
+		t.Fatalf("POST reply: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := do(sh, "alice", "POST", "/dav/calendars/alice/outbox/", invitation); w.Code != http.StatusOK {
+		t.Fatalf("POST invitation: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	testCases := []struct {
+		target, want string
+	}{
+		{"/dav/calendars/alice/inbox/", `<C:schedule-inbox xmlns:C="urn:ietf:params:xml:ns:caldav"/>`},
+		{"/dav/calendars/alice/outbox/", `<C:schedule-outbox xmlns:C="urn:ietf:params:xml:ns:caldav"/>`},
+	}
+	for _, tc := range testCases {
+		w := do(sh, "alice", "PROPFIND", tc.target, propfind, "Depth", "0")
+		if w.Code != http.StatusMultiStatus {
+			t.Errorf("%s: got status %d, want %d", tc.target, w.Code, http.StatusMultiStatus)
+			continue
+		}
+		if body := w.Body.String(); !strings.Contains(body, tc.want) || !strings.Contains(body, "collection") {
+			t.Errorf("%s: got %q, want it to contain %q", tc.target, body, tc.want)
+		}
+	}
+	w := do(sh, "alice", "PROPFIND", "/dav/calendars/", propfind, "Depth", "0")
+	if body := w.Body.String(); w.Code != http.StatusMultiStatus || strings.Contains(body, "schedule-") || !strings.Contains(body, "collection") {
+		t.Errorf("/dav/calendars/: got status %d, body %q", w.Code, body)
+	}
+}
+
+func TestSchedulingPrincipalProps(t *testing.T) {
+	s := &Scheduling{
+		Inbox:  func(principal string) string { return "/calendars/" + principal + "/inbox" },
+		Outbox: func(principal string) string { return "/calendars/" + principal + "/outbox" },
+	}
+	props := s.PrincipalProps("/dav", "alice b&b", "mailto:alice@example.com")
+	want := map[string]string{
+		"schedule-inbox-URL":        `<D:href xmlns:D="DAV:">/dav/calendars/alice%20b&amp;b/inbox/</D:href>`,
+		"schedule-outbox-URL":       `<D:href xmlns:D="DAV:">/dav/calendars/alice%20b&amp;b/outbox/</D:href>`,
+		"calendar-user-address-set": `<D:href xmlns:D="DAV:">mailto:alice@example.com</D:href>`,
+	}
+	if len(props) != len(want) {
+		t.Fatalf("got %d properties, want %d", len(props), len(want))
+	}
+	for _, p := range props {
+		if p.XMLName.Space != Namespace || string(p.InnerXML) != want[p.XMLName.Local] {
+			t.Errorf("%s: got %q, want %q", p.XMLName.Local, p.InnerXML, want[p.XMLName.Local])
+		}
+	}
+}
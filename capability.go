@@ -0,0 +1,178 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Capability is an optional interface of the FileSystem, or of its files,
+// as detected by Handler.Capabilities.
+type Capability struct {
+	// Name is the feature provided by the interface, such as "quota".
+	Name string
+	// Interface is the name of the optional interface, such as "QuotaFS".
+	Interface string
+	// Supported reports whether the interface is implemented.
+	Supported bool
+	// Warning, if not empty, describes how the Handler is degraded because
+	// the interface is not implemented, such as a configured feature that
+	// was disabled.
+	Warning string
+}
+
+// Capabilities is the capability report of a Handler.
+type Capabilities []Capability
+
+// Warnings returns the warnings of the capabilities, if any.
+func (c Capabilities) Warnings() []string {
+	var warnings []string
+	for _, v := range c {
+		if v.Warning != "" {
+			warnings = append(warnings, v.Warning)
+		}
+	}
+	return warnings
+}
+
+// String returns the report, one capability per line, to be logged.
+func (c Capabilities) String() string {
+	var b strings.Builder
+	for _, v := range c {
+		state := "unsupported"
+		if v.Supported {
+			state = "supported"
+		}
+		fmt.Fprintf(&b, "%s (%s): %s", v.Name, v.Interface, state)
+		if v.Warning != "" {
+			fmt.Fprintf(&b, ": %s", v.Warning)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Capabilities probes h.FileSystem, and the root collection it serves, for
+// the optional interfaces of this package, and returns the report. Handlers
+// are configured by setting their fields, so embedders should call it once
+// h is configured, before serving requests, for example to log the report.
+//
+// The features configured in h that depend on a missing interface are
+// disabled, with a warning: PresignPolicy without a Presigner, QuotaWarnings
+// without a QuotaFS, CanChown without a Chowner and ResumableUploads without
+// an AppendFS. The warnings also report the other degraded modes, such as
+// missing dead properties support.
+func (h *Handler) Capabilities(ctx context.Context) Capabilities {
+	fs := h.FileSystem
+	fi, _ := fs.Stat(ctx, "/")
+	var f File
+	if v, err := fs.OpenFile(ctx, "/", os.O_RDONLY, 0); err == nil {
+		f = v
+		defer f.Close()
+	}
+	var c Capabilities
+	add := func(name, iface string, supported bool, warning string) {
+		if supported {
+			warning = ""
+		}
+		c = append(c, Capability{Name: name, Interface: iface, Supported: supported, Warning: warning})
+	}
+	_, ok := f.(DeadPropsHolder)
+	warning := ""
+	if h.PropStore == nil {
+		warning = "no PropStore is set and the files cannot hold dead properties: PROPPATCH requests fail"
+	}
+	add("dead properties", "DeadPropsHolder", ok, warning)
+	_, ok = fs.(ETagFS)
+	_, fiOK := fi.(ETager)
+	add("etags", "ETagFS", ok || fiOK, "")
+	_, ok = fi.(FileIDer)
+	add("file IDs", "FileIDer", ok, "")
+	_, ok = fi.(ContentTyper)
+	add("content types", "ContentTyper", ok, "")
+	_, ok = fi.(CreationTimer)
+	add("creation dates", "CreationTimer", ok, "")
+	_, ok = f.(io.WriterAt)
+	warning = ""
+	if h.PartialUpdates {
+		warning = "partial updates seek and write the files instead of using io.WriterAt"
+	}
+	add("range writes", "io.WriterAt", ok, warning)
+	_, ok = fs.(QuotaFS)
+	warning = ""
+	if len(h.QuotaWarnings) > 0 {
+		warning = "QuotaWarnings is disabled"
+	}
+	if !ok {
+		h.QuotaWarnings = nil
+	}
+	add("quota", "QuotaFS", ok, warning)
+	_, ok = fs.(Presigner)
+	warning = ""
+	if h.PresignPolicy != nil {
+		warning = "PresignPolicy is disabled"
+	}
+	if !ok {
+		h.PresignPolicy = nil
+	}
+	add("presigned URLs", "Presigner", ok, warning)
+	_, ok = fs.(Chowner)
+	warning = ""
+	if h.CanChown != nil {
+		warning = "CanChown is disabled"
+	}
+	if !ok {
+		h.CanChown = nil
+	}
+	add("owner changes", "Chowner", ok, warning)
+	_, ok = fs.(AppendFS)
+	warning = ""
+	if h.ResumableUploads != nil {
+		warning = "ResumableUploads is disabled"
+	}
+	if !ok {
+		h.ResumableUploads = nil
+	}
+	add("resumable uploads", "AppendFS", ok, warning)
+	_, ok = fs.(OwnerFS)
+	add("owners", "OwnerFS", ok, "")
+	_, ok = fs.(Chmoder)
+	add("permission changes", "Chmoder", ok, "")
+	_, ok = fs.(ModeFS)
+	add("mode policies", "ModeFS", ok, "")
+	_, ok = fs.(Win32FS)
+	add("Windows properties", "Win32FS", ok, "")
+	_, ok = fs.(ContentHasher)
+	add("checksums", "ContentHasher", ok, "")
+	_, ok = fs.(Pinner)
+	add("pinning", "Pinner", ok, "")
+	_, ok = fs.(VersionedFS)
+	add("versions", "VersionedFS", ok, "")
+	_, ok = fs.(SyncTokenFS)
+	add("sync tokens", "SyncTokenFS", ok, "")
+	_, ok = fs.(Prefetcher)
+	add("prefetching", "Prefetcher", ok, "")
+	_, ok = fs.(CacheFlusher)
+	warning = ""
+	if h.Admin != nil {
+		warning = "the Admin API cannot flush caches"
+	}
+	add("cache flushing", "CacheFlusher", ok, warning)
+	return c
+}
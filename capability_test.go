@@ -0,0 +1,69 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	h := &Handler{
+		FileSystem:    Dir(t.TempDir()),
+		LockSystem:    NewMemLS(),
+		QuotaWarnings: []int{90},
+		PresignPolicy: func(r *http.Request, name string) bool { return true },
+	}
+	c := h.Capabilities(context.Background())
+	supported := make(map[string]bool)
+	for _, v := range c {
+		supported[v.Interface] = v.Supported
+	}
+	for iface, want := range map[string]bool{
+		"io.WriterAt":     true,
+		"Win32FS":         true,
+		"QuotaFS":         false,
+		"Presigner":       false,
+		"DeadPropsHolder": false,
+	} {
+		if got, ok := supported[iface]; !ok || got != want {
+			t.Errorf("%s: got supported %t (reported %t), want %t", iface, got, ok, want)
+		}
+	}
+	if h.QuotaWarnings != nil || h.PresignPolicy != nil {
+		t.Errorf("got QuotaWarnings %v and PresignPolicy set %t, want both disabled", h.QuotaWarnings, h.PresignPolicy != nil)
+	}
+	warnings := strings.Join(c.Warnings(), "\n")
+	for _, want := range []string{"QuotaWarnings", "PresignPolicy", "PropStore"} {
+		if !strings.Contains(warnings, want) {
+			t.Errorf("warnings: got %q, want them to mention %s", warnings, want)
+		}
+	}
+	if s := c.String(); !strings.Contains(s, "quota (QuotaFS): unsupported: QuotaWarnings is disabled\n") {
+		t.Errorf("String: got %q, want the quota line", s)
+	}
+
+	h = &Handler{
+		FileSystem: NewMemFS(),
+		LockSystem: NewMemLS(),
+	}
+	for _, v := range h.Capabilities(context.Background()) {
+		if v.Interface == "DeadPropsHolder" && (!v.Supported || v.Warning != "") {
+			t.Errorf("memFS: got %+v, want dead properties supported", v)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package carddav adds CardDAV, defined by RFC 6352, to a webdav.Handler.
+//
+// Address books are collections of the FileSystem of the Handler, created
+// by extended MKCOL requests (RFC 5689), whose members are vCard files.
+package carddav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/drakkan/webdav"
+)
+
+// Namespace is the XML namespace of the CardDAV elements.
+const Namespace = "urn:ietf:params:xml:ns:carddav"
+
+var (
+	addressDataName          = xml.Name{Space: Namespace, Local: "address-data"}
+	errAddressBookRejected   = errors.New("carddav: address book properties rejected")
+	errNoPropStore           = errors.New("carddav: the handler has no PropStore")
+	homeSetName              = xml.Name{Space: Namespace, Local: "addressbook-home-set"}
+	resourceTypeName         = xml.Name{Space: "DAV:", Local: "resourcetype"}
+	supportedAddressDataName = xml.Name{Space: Namespace, Local: "supported-address-data"}
+)
+
+// maxAddressData is the maximum size of the address-data properties.
+const maxAddressData = 1 << 20
+
+// maxMkcolBody is the maximum size of the bodies of the extended MKCOL
+// requests.
+const maxMkcolBody = 1 << 20
+
+// AddressBooks serves the address book collections of a webdav.Handler,
+// whose PropStore records which collections are address books. It
+// implements the extended MKCOL requests creating address books, the
+// addressbook-query and addressbook-multiget reports and the address-data
+// property of the address book members.
+type AddressBooks struct {
+	// Filter evaluates the filters of the addressbook-query reports. If
+	// nil, DefaultFilter is used.
+	Filter Filter
+	// HomeSet, if non-nil, returns the FileSystem path of the collection
+	// containing the address books of principal, such as
+	// "/contacts/alice", reported by the addressbook-home-set property. See
+	// webdav.Handler.Principal.
+	HomeSet func(principal string) string
+}
+
+type addressBooksKey struct{}
+
+// addressBooks are the AddressBooks serving a request, see addressBooksKey.
+type addressBooks struct {
+	*AddressBooks
+	h *webdav.Handler
+	// principal is the principal issuing the request.
+	principal string
+}
+
+// Handler registers the CardDAV properties and reports with h, and returns
+// a handler serving the extended MKCOL requests creating address books and
+// passing the other ones to h. It must be called before h serves requests.
+func (a *AddressBooks) Handler(h *webdav.Handler) http.Handler {
+	h.RegisterResourceType(addressBookType)
+	// The value of the supported address data is the dead property stored
+	// when creating the address book: registering it only makes it
+	// protected.
+	h.RegisterLiveProperty(supportedAddressDataName, func(context.Context, string, os.FileInfo) (string, error) {
+		return "", webdav.ErrNotImplemented
+	}, nil)
+	h.RegisterLiveProperty(addressDataName, findAddressData, nil)
+	h.RegisterLiveProperty(homeSetName, findHomeSet, nil)
+	books := &addressBooks{AddressBooks: a, h: h}
+	h.RegisterReport(addressbookQueryName, books.addressbookQuery)
+	h.RegisterReport(addressbookMultigetName, books.addressbookMultiget)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ab := &addressBooks{AddressBooks: a, h: h}
+		if h.Principal != nil {
+			ab.principal = h.Principal(r)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), addressBooksKey{}, ab))
+		switch r.Method {
+		case "MKCOL":
+			if r.ContentLength == 0 {
+				break
+			}
+			status, err := ab.mkcol(w, r)
+			if status != 0 {
+				http.Error(w, http.StatusText(status), status)
+			}
+			if h.Logger != nil {
+				h.Logger(r, status, err)
+			}
+			return
+		case http.MethodOptions:
+			h.ServeHTTP(w, r)
+			// Nothing is written by a successful OPTIONS, so the headers
+			// can still be changed.
+			if dav := w.Header().Get("DAV"); dav != "" {
+				w.Header().Set("DAV", dav+", addressbook")
+			}
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// PrincipalProps returns the addressbook-home-set property of principal,
+// to be added to its webdav.PrincipalInfo. prefix is the Prefix of the
+// webdav.Handler.
+func (a *AddressBooks) PrincipalProps(prefix, principal string) []webdav.Property {
+	return []webdav.Property{{
+		XMLName:  homeSetName,
+		InnerXML: []byte(homeSetHref(prefix, a.HomeSet(principal))),
+	}}
+}
+
+func homeSetHref(prefix, home string) string {
+	href := (&url.URL{Path: path.Join("/", prefix, home) + "/"}).EscapedPath()
+	return `<D:href xmlns:D="DAV:">` + escape(href) + `</D:href>`
+}
+
+// isAddressBook reports whether collection name is an address book.
+func (a *addressBooks) isAddressBook(ctx context.Context, name string) (bool, error) {
+	if a.h.PropStore == nil {
+		return false, nil
+	}
+	props, err := a.h.PropStore.Get(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	_, ok := props[supportedAddressDataName]
+	return ok, nil
+}
+
+// mkcol serves the extended MKCOL request r, defined by RFC 5689, creating
+// an address book if the requested resourcetype is addressbook. The other
+// requests are served by the webdav.Handler, as are the collections, so
+// that they are subject to its locks and checks.
+func (a *addressBooks) mkcol(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	var body struct {
+		Set []struct {
+			Prop struct {
+				Props []struct {
+					XMLName  xml.Name
+					Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+					InnerXML []byte `xml:",innerxml"`
+					Types    []struct {
+						XMLName xml.Name
+					} `xml:",any"`
+				} `xml:",any"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: set"`
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxMkcolBody+1))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(data) > maxMkcolBody {
+		return http.StatusRequestEntityTooLarge, webdav.ErrBodyTooLarge
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := xml.Unmarshal(data, &body); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	addressBook := false
+	var props []webdav.Property
+	for _, set := range body.Set {
+		for _, p := range set.Prop.Props {
+			if p.XMLName != resourceTypeName {
+				props = append(props, webdav.Property{XMLName: p.XMLName, Lang: p.Lang, InnerXML: p.InnerXML})
+				continue
+			}
+			for _, t := range p.Types {
+				if t.XMLName == (xml.Name{Space: Namespace, Local: "addressbook"}) {
+					addressBook = true
+				}
+			}
+		}
+	}
+	if !addressBook {
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		a.h.ServeHTTP(w, r)
+		return 0, nil
+	}
+	if a.h.PropStore == nil {
+		return http.StatusForbidden, errNoPropStore
+	}
+	props = append(props, webdav.Property{
+		XMLName:  supportedAddressDataName,
+		InnerXML: []byte(`<C:address-data-type xmlns:C="` + Namespace + `" content-type="text/vcard" version="3.0"/>`),
+	})
+
+	mkcol := r.Clone(r.Context())
+	mkcol.Body = http.NoBody
+	mkcol.ContentLength = 0
+	rec := &statusRecorder{ResponseWriter: w}
+	a.h.ServeHTTP(rec, mkcol)
+	if rec.status != http.StatusCreated {
+		return 0, nil
+	}
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, a.h.Prefix))
+	pstats, err := a.h.PatchProps(r, name, []webdav.Proppatch{{Props: props}})
+	if err == nil {
+		for _, ps := range pstats {
+			if ps.Status != http.StatusOK {
+				err = errAddressBookRejected
+			}
+		}
+	}
+	if err != nil {
+		// The address book is created with all of its properties or not
+		// at all.
+		if rmErr := a.h.FileSystem.RemoveAll(r.Context(), name); rmErr != nil {
+			return http.StatusInternalServerError, rmErr
+		}
+		return http.StatusForbidden, err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return 0, nil
+}
+
+// statusRecorder records the status of a response, only writing it if it is
+// not "201 Created".
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		if status != http.StatusCreated {
+			r.ResponseWriter.WriteHeader(status)
+		}
+	}
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.status == http.StatusCreated {
+		return len(p), nil
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// addressBookType returns the addressbook resource type of the address
+// books.
+func addressBookType(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+	a, _ := ctx.Value(addressBooksKey{}).(*addressBooks)
+	if a == nil || !fi.IsDir() {
+		return "", nil
+	}
+	if ok, err := a.isAddressBook(ctx, name); err != nil || !ok {
+		return "", err
+	}
+	return `<C:addressbook xmlns:C="` + Namespace + `"/>`, nil
+}
+
+// findHomeSet returns the addressbook-home-set property, defined by RFC
+// 6352 section 7.1.1, of the principal issuing the request.
+func findHomeSet(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+	a, _ := ctx.Value(addressBooksKey{}).(*addressBooks)
+	if a == nil || a.HomeSet == nil || a.principal == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return homeSetHref(a.h.Prefix, a.HomeSet(a.principal)), nil
+}
+
+// findAddressData returns the address-data property, defined by RFC 6352
+// section 10.4, of the members of the address books: their vCard.
+func findAddressData(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+	a, _ := ctx.Value(addressBooksKey{}).(*addressBooks)
+	if a == nil || fi.IsDir() || fi.Size() > maxAddressData {
+		return "", webdav.ErrNotImplemented
+	}
+	if ok, err := a.isAddressBook(ctx, path.Dir(path.Clean("/"+name))); err != nil || !ok {
+		if err == nil {
+			err = webdav.ErrNotImplemented
+		}
+		return "", err
+	}
+	data, err := readFile(ctx, a.h.FileSystem, name)
+	if err != nil {
+		return "", err
+	}
+	return escape(string(data)), nil
+}
+
+// readFile returns the content of file name, up to maxAddressData bytes.
+func readFile(ctx context.Context, fs webdav.FileSystem, name string) ([]byte, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, maxAddressData))
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
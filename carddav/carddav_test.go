@@ -0,0 +1,129 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package carddav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/drakkan/webdav"
+)
+
+const mkcolAddressBook = `<?xml version="1.0" encoding="utf-8"?>
+<D:mkcol xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+  <D:set><D:prop>
+    <D:resourcetype><D:collection/><C:addressbook/></D:resourcetype>
+    <D:displayname>Friends</D:displayname>
+  </D:prop></D:set>
+</D:mkcol>`
+
+func newTestAddressBooks() (*webdav.Handler, http.Handler) {
+	h := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+		PropStore:  webdav.NewMemPropStore(),
+		Principal: func(r *http.Request) string {
+			user, _, _ := r.BasicAuth()
+			return user
+		},
+	}
+	a := &AddressBooks{
+		HomeSet: func(principal string) string { return "/contacts/" + principal },
+	}
+	return h, a.Handler(h)
+}
+
+func do(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.SetBasicAuth("alice", "password")
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAddressBookMkcol(t *testing.T) {
+	h, ah := newTestAddressBooks()
+	h.DeniedPropNamespaces = []string{"x:"}
+	if w := do(ah, "MKCOL", "/dav/friends/", mkcolAddressBook); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL address book: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := do(ah, "MKCOL", "/dav/files/", ""); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	testCases := []struct {
+		desc, target, body string
+		want               int
+	}{
+		{"existing collection", "/dav/friends/", mkcolAddressBook, http.StatusMethodNotAllowed},
+		{"missing parent", "/dav/a/b/", mkcolAddressBook, http.StatusConflict},
+		{"invalid body", "/dav/c/", "<D:mkcol", http.StatusBadRequest},
+		{"other resourcetype", "/dav/d/", strings.Replace(mkcolAddressBook, "<C:addressbook/>", "", 1), http.StatusUnsupportedMediaType},
+		{"forbidden namespace", "/dav/e/", strings.Replace(mkcolAddressBook, "</D:prop>", `<X:color xmlns:X="x:">red</X:color></D:prop>`, 1), http.StatusForbidden},
+		{"after a forbidden namespace", "/dav/e/", mkcolAddressBook, http.StatusCreated},
+		{"too large body", "/dav/f/", strings.Replace(mkcolAddressBook, "</D:prop>", strings.Repeat(" ", maxMkcolBody)+"</D:prop>", 1), http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range testCases {
+		if w := do(ah, "MKCOL", tc.target, tc.body); w.Code != tc.want {
+			t.Errorf("MKCOL %s: got status %d, want %d", tc.desc, w.Code, tc.want)
+		}
+	}
+
+	propfind := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop>` +
+		`<D:resourcetype/><D:displayname/><C:supported-address-data xmlns:C="urn:ietf:params:xml:ns:carddav"/>` +
+		`</D:prop></D:propfind>`
+	w := do(ah, "PROPFIND", "/dav/friends/", propfind, "Depth", "0")
+	for _, want := range []string{
+		`<D:collection xmlns:D="DAV:"/><C:addressbook xmlns:C="urn:ietf:params:xml:ns:carddav"/>`,
+		`<D:displayname>Friends</D:displayname>`,
+		`content-type="text/vcard" version="3.0"/>`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("PROPFIND address book: got %q, want it to contain %q", w.Body.String(), want)
+		}
+	}
+	if w := do(ah, "PROPFIND", "/dav/files/", propfind, "Depth", "0"); strings.Contains(w.Body.String(), "<C:addressbook") {
+		t.Errorf("PROPFIND collection: got %q, want no addressbook resourcetype", w.Body.String())
+	}
+}
+
+func TestAddressBookHomeSet(t *testing.T) {
+	_, ah := newTestAddressBooks()
+	propfind := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop>` +
+		`<C:addressbook-home-set xmlns:C="urn:ietf:params:xml:ns:carddav"/></D:prop></D:propfind>`
+	w := do(ah, "PROPFIND", "/dav/", propfind, "Depth", "0")
+	if want := `<D:href xmlns:D="DAV:">/dav/contacts/alice/</D:href>`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("PROPFIND: got %q, want it to contain %q", w.Body.String(), want)
+	}
+
+	a := &AddressBooks{HomeSet: func(principal string) string { return "/contacts/" + principal }}
+	props := a.PrincipalProps("/dav", "bob b&b")
+	if len(props) != 1 || props[0].XMLName != homeSetName || string(props[0].InnerXML) != `<D:href xmlns:D="DAV:">/dav/contacts/bob%20b&amp;b/</D:href>` {
+		t.Errorf("PrincipalProps: got %+v", props)
+	}
+}
+
+func TestAddressBooksOptions(t *testing.T) {
+	_, ah := newTestAddressBooks()
+	w := do(ah, "OPTIONS", "/dav/", "")
+	if dav := w.Header().Get("DAV"); !strings.HasSuffix(dav, ", addressbook") {
+		t.Errorf("DAV: got %q, want addressbook", dav)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package carddav
+
+import (
+	"context"
+	"strings"
+
+	"github.com/drakkan/webdav/internal/contentline"
+)
+
+// CardFilter is the filter element of an addressbook-query report, defined
+// by RFC 6352 section 10.5. A vCard matches if any of the Props filters
+// match or, if AllOf is true, if all of them match. A filter without Props
+// filters matches all the vCards.
+type CardFilter struct {
+	AllOf bool
+	Props []PropFilter
+}
+
+// PropFilter is a prop-filter element, defined by RFC 6352 section 10.5.1.
+// It matches if a property named Name matches any of the TextMatches and
+// Params filters or, if AllOf is true, all of them. A filter without
+// TextMatches and Params filters matches if the property is defined.
+type PropFilter struct {
+	Name string
+	// IsNotDefined, if true, matches if the vCard has no property named
+	// Name.
+	IsNotDefined bool
+	AllOf        bool
+	TextMatches  []TextMatch
+	Params       []ParamFilter
+}
+
+// ParamFilter is a param-filter element, defined by RFC 6352 section
+// 10.5.2.
+type ParamFilter struct {
+	Name string
+	// IsNotDefined, if true, matches if the property has no parameter
+	// named Name.
+	IsNotDefined bool
+	TextMatch    *TextMatch
+}
+
+// TextMatch is a text-match element, defined by RFC 6352 section 10.5.4.
+type TextMatch struct {
+	Text string
+	// Collation is "i;unicode-casemap", the default, "i;ascii-casemap" or
+	// "i;octet".
+	Collation string
+	// MatchType is "equals", "contains", the default, "starts-with" or
+	// "ends-with".
+	MatchType       string
+	NegateCondition bool
+}
+
+// Filter evaluates the filters of the addressbook-query reports.
+type Filter interface {
+	// Match reports whether the address object resource name, whose
+	// content is data, matches filter. ctx is the request context.
+	Match(ctx context.Context, name string, data []byte, filter CardFilter) (bool, error)
+}
+
+// DefaultFilter is the Filter used if AddressBooks.Filter is nil.
+type DefaultFilter struct{}
+
+// Match implements Filter. The resources that are not vCards never match.
+func (DefaultFilter) Match(ctx context.Context, name string, data []byte, filter CardFilter) (bool, error) {
+	card, err := contentline.Parse(string(data))
+	if err != nil || card.Name != "VCARD" {
+		return false, nil
+	}
+	if len(filter.Props) == 0 {
+		return true, nil
+	}
+	for _, pf := range filter.Props {
+		if matchProp(card, pf) != filter.AllOf {
+			return !filter.AllOf, nil
+		}
+	}
+	return filter.AllOf, nil
+}
+
+func matchProp(card *contentline.Component, f PropFilter) bool {
+	found := false
+	for _, p := range card.Props {
+		if p.Name != strings.ToUpper(f.Name) {
+			continue
+		}
+		found = true
+		if f.IsNotDefined {
+			return false
+		}
+		if matchPropValue(p, f) {
+			return true
+		}
+	}
+	return !found && f.IsNotDefined
+}
+
+// matchPropValue reports whether property p matches the text-match and
+// param-filter elements of f.
+func matchPropValue(p contentline.Property, f PropFilter) bool {
+	if len(f.TextMatches) == 0 && len(f.Params) == 0 {
+		return true
+	}
+	for _, tm := range f.TextMatches {
+		if tm.match(p.Value) != f.AllOf {
+			return !f.AllOf
+		}
+	}
+	for _, pf := range f.Params {
+		if matchParam(p, pf) != f.AllOf {
+			return !f.AllOf
+		}
+	}
+	return f.AllOf
+}
+
+func matchParam(p contentline.Property, f ParamFilter) bool {
+	v, ok := p.Params[strings.ToUpper(f.Name)]
+	if !ok || f.IsNotDefined {
+		return !ok && f.IsNotDefined
+	}
+	return f.TextMatch == nil || f.TextMatch.match(v)
+}
+
+func (m *TextMatch) match(v string) bool {
+	text := m.Text
+	switch m.Collation {
+	case "i;octet":
+	case "i;ascii-casemap":
+		v, text = asciiLower(v), asciiLower(text)
+	default:
+		v, text = strings.ToLower(v), strings.ToLower(text)
+	}
+	var ok bool
+	switch m.MatchType {
+	case "equals":
+		ok = v == text
+	case "starts-with":
+		ok = strings.HasPrefix(v, text)
+	case "ends-with":
+		ok = strings.HasSuffix(v, text)
+	default:
+		ok = strings.Contains(v, text)
+	}
+	return ok != m.NegateCondition
+}
+
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
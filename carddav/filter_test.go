@@ -0,0 +1,72 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package carddav
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDefaultFilter(t *testing.T) {
+	card := vcard("1", "Élodie Durand", "elodie@example.com")
+	fn := func(tm TextMatch) CardFilter {
+		return CardFilter{Props: []PropFilter{{Name: "FN", TextMatches: []TextMatch{tm}}}}
+	}
+	testCases := []struct {
+		desc   string
+		data   string
+		filter CardFilter
+		want   bool
+	}{
+		{"not a vCard", "hello", CardFilter{}, false},
+		{"other object", "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n", CardFilter{}, false},
+		{"no filters", card, CardFilter{}, true},
+		{"unicode casemap", card, fn(TextMatch{Text: "élodie"}), true},
+		{"ascii casemap", card, fn(TextMatch{Text: "élodie", Collation: "i;ascii-casemap"}), false},
+		{"octet", card, fn(TextMatch{Text: "durand", Collation: "i;octet"}), false},
+		{"equals", card, fn(TextMatch{Text: "élodie durand", MatchType: "equals"}), true},
+		{"prop anyof", card, CardFilter{Props: []PropFilter{{
+			Name:        "FN",
+			TextMatches: []TextMatch{{Text: "x"}, {Text: "durand"}},
+		}}}, true},
+		{"prop allof", card, CardFilter{Props: []PropFilter{{
+			Name:        "FN",
+			AllOf:       true,
+			TextMatches: []TextMatch{{Text: "x"}, {Text: "durand"}},
+		}}}, false},
+		{"param and text", card, CardFilter{Props: []PropFilter{{
+			Name:        "EMAIL",
+			AllOf:       true,
+			TextMatches: []TextMatch{{Text: "example.com", MatchType: "ends-with"}},
+			Params:      []ParamFilter{{Name: "type", TextMatch: &TextMatch{Text: "work", MatchType: "equals"}}},
+		}}}, true},
+		{"param not defined", card, CardFilter{Props: []PropFilter{{
+			Name:   "EMAIL",
+			Params: []ParamFilter{{Name: "PREF", IsNotDefined: true}},
+		}}}, true},
+		{"prop defined", card, CardFilter{Props: []PropFilter{{Name: "UID"}}}, true},
+		{"prop not defined", card, CardFilter{Props: []PropFilter{{Name: "UID", IsNotDefined: true}}}, false},
+	}
+	for _, tc := range testCases {
+		got, err := DefaultFilter{}.Match(context.Background(), "/book/card.vcf", []byte(tc.data), tc.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package carddav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/drakkan/webdav"
+)
+
+var (
+	addressbookMultigetName = xml.Name{Space: Namespace, Local: "addressbook-multiget"}
+	addressbookQueryName    = xml.Name{Space: Namespace, Local: "addressbook-query"}
+)
+
+// reportProp is the DAV:prop element of a report, naming the properties to
+// report.
+type reportProp struct {
+	Names []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+func (p *reportProp) names() []xml.Name {
+	names := make([]xml.Name, 0, len(p.Names))
+	for _, n := range p.Names {
+		names = append(names, n.XMLName)
+	}
+	return names
+}
+
+// The xml elements of the filters are decoded into these types, and then
+// converted to the exported ones.
+type (
+	xmlFilter struct {
+		Test  string          `xml:"test,attr"`
+		Props []xmlPropFilter `xml:"urn:ietf:params:xml:ns:carddav prop-filter"`
+	}
+	xmlPropFilter struct {
+		Name         string           `xml:"name,attr"`
+		Test         string           `xml:"test,attr"`
+		IsNotDefined *struct{}        `xml:"urn:ietf:params:xml:ns:carddav is-not-defined"`
+		TextMatches  []xmlTextMatch   `xml:"urn:ietf:params:xml:ns:carddav text-match"`
+		Params       []xmlParamFilter `xml:"urn:ietf:params:xml:ns:carddav param-filter"`
+	}
+	xmlParamFilter struct {
+		Name         string        `xml:"name,attr"`
+		IsNotDefined *struct{}     `xml:"urn:ietf:params:xml:ns:carddav is-not-defined"`
+		TextMatch    *xmlTextMatch `xml:"urn:ietf:params:xml:ns:carddav text-match"`
+	}
+	xmlTextMatch struct {
+		Text            string `xml:",chardata"`
+		Collation       string `xml:"collation,attr"`
+		MatchType       string `xml:"match-type,attr"`
+		NegateCondition string `xml:"negate-condition,attr"`
+	}
+)
+
+func (f *xmlFilter) filter() CardFilter {
+	cf := CardFilter{AllOf: f.Test == "allof"}
+	for _, p := range f.Props {
+		pf := PropFilter{Name: p.Name, IsNotDefined: p.IsNotDefined != nil, AllOf: p.Test == "allof"}
+		for _, tm := range p.TextMatches {
+			pf.TextMatches = append(pf.TextMatches, *tm.textMatch())
+		}
+		for _, param := range p.Params {
+			pf.Params = append(pf.Params, ParamFilter{
+				Name:         param.Name,
+				IsNotDefined: param.IsNotDefined != nil,
+				TextMatch:    param.TextMatch.textMatch(),
+			})
+		}
+		cf.Props = append(cf.Props, pf)
+	}
+	return cf
+}
+
+func (m *xmlTextMatch) textMatch() *TextMatch {
+	if m == nil {
+		return nil
+	}
+	return &TextMatch{Text: m.Text, Collation: m.Collation, MatchType: m.MatchType, NegateCondition: m.NegateCondition == "yes"}
+}
+
+// addressbookQuery writes the addressbook-query report, defined by RFC 6352
+// section 8.6, of the vCards matching the filter of the report.
+func (a *addressBooks) addressbookQuery(ctx context.Context, w http.ResponseWriter, r *http.Request, report webdav.Report) error {
+	var body struct {
+		Prop   *reportProp `xml:"DAV: prop"`
+		Filter *xmlFilter  `xml:"urn:ietf:params:xml:ns:carddav filter"`
+		Limit  struct {
+			NResults int `xml:"urn:ietf:params:xml:ns:carddav nresults"`
+		} `xml:"urn:ietf:params:xml:ns:carddav limit"`
+	}
+	if err := xml.Unmarshal(report.Body, &body); err != nil || body.Prop == nil || body.Filter == nil || body.Limit.NResults < 0 {
+		return webdav.ErrInvalidReport
+	}
+	filter := body.Filter.filter()
+	var evaluator Filter = DefaultFilter{}
+	if a.Filter != nil {
+		evaluator = a.Filter
+	}
+	names, err := members(ctx, a.h.FileSystem, report.Name, report.Depth)
+	if err != nil {
+		return err
+	}
+	mw := a.h.NewMultiStatusWriter(ctx, w)
+	matches := 0
+	for _, name := range names {
+		data, err := readFile(ctx, a.h.FileSystem, name)
+		if err != nil {
+			return err
+		}
+		ok, err := evaluator.Match(ctx, name, data, filter)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if body.Limit.NResults > 0 && matches == body.Limit.NResults {
+			// RFC 6352 section 8.6.1: the truncated results end with
+			// the status of the request URI.
+			if err := mw.WriteStatus(report.Name, http.StatusInsufficientStorage); err != nil {
+				return err
+			}
+			break
+		}
+		matches++
+		pstats, err := a.h.Props(ctx, name, body.Prop.names())
+		if err != nil {
+			return err
+		}
+		if err := mw.Write(name, false, pstats); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// members returns the names of the files within name, up to depth, or name
+// itself if it is a file.
+func members(ctx context.Context, fs webdav.FileSystem, name string, depth int) ([]string, error) {
+	fi, err := fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{name}, nil
+	}
+	if depth == 0 {
+		return nil, nil
+	}
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	var names []string
+	for _, child := range children {
+		if webdav.IsUploadName(child.Name()) {
+			continue
+		}
+		childName := path.Join(name, child.Name())
+		if !child.IsDir() {
+			names = append(names, childName)
+		} else if depth < 0 {
+			descendants, err := members(ctx, fs, childName, depth)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, descendants...)
+		}
+	}
+	return names, nil
+}
+
+// stripPrefix returns the FileSystem name of the path p of a resource
+// served by a handler with the given prefix, or false if p is outside of
+// the handler. Unlike strings.TrimPrefix, it only strips whole segments.
+func stripPrefix(prefix, p string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix != "" && p != prefix && !strings.HasPrefix(p, prefix+"/") {
+		return "", false
+	}
+	return path.Clean("/" + p[len(prefix):]), true
+}
+
+// addressbookMultiget writes the addressbook-multiget report, defined by
+// RFC 6352 section 8.7, of the resources named by the hrefs of the report.
+func (a *addressBooks) addressbookMultiget(ctx context.Context, w http.ResponseWriter, r *http.Request, report webdav.Report) error {
+	var body struct {
+		Prop  *reportProp `xml:"DAV: prop"`
+		Hrefs []string    `xml:"DAV: href"`
+	}
+	if err := xml.Unmarshal(report.Body, &body); err != nil || body.Prop == nil {
+		return webdav.ErrInvalidReport
+	}
+	mw := a.h.NewMultiStatusWriter(ctx, w)
+	for _, href := range body.Hrefs {
+		u, err := url.Parse(strings.TrimSpace(href))
+		if err != nil {
+			return webdav.ErrInvalidReport
+		}
+		name, ok := stripPrefix(a.h.Prefix, u.Path)
+		if !ok {
+			// The resources outside of the handler cannot be reported.
+			return webdav.ErrInvalidReport
+		}
+		fi, err := a.h.FileSystem.Stat(ctx, name)
+		if os.IsNotExist(err) {
+			if err := mw.WriteStatus(name, http.StatusNotFound); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		pstats, err := a.h.Props(ctx, name, body.Prop.names())
+		if err != nil {
+			return err
+		}
+		if err := mw.Write(name, fi.IsDir(), pstats); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
@@ -0,0 +1,147 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package carddav
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func vcard(uid, fn, email string) string {
+	return "BEGIN:VCARD\r\nVERSION:3.0\r\nUID:" + uid + "\r\nFN:" + fn + "\r\nEMAIL;TYPE=work:" + email + "\r\nEND:VCARD\r\n"
+}
+
+func newTestAddressBook(t *testing.T) http.Handler {
+	t.Helper()
+	_, ah := newTestAddressBooks()
+	if w := do(ah, "MKCOL", "/dav/book/", mkcolAddressBook); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	for name, data := range map[string]string{
+		"alice.vcf": vcard("1", "Alice Smith", "alice@example.com"),
+		"bob.vcf":   vcard("2", "Bob Jones", "bob@example.org"),
+		"carol.vcf": vcard("3", "Carol Smith", "carol@example.org"),
+	} {
+		if w := do(ah, "PUT", "/dav/book/"+name, data); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: got status %d, want %d", name, w.Code, http.StatusCreated)
+		}
+	}
+	return ah
+}
+
+func TestAddressbookQuery(t *testing.T) {
+	ah := newTestAddressBook(t)
+	query := func(filter, limit string) string {
+		return `<?xml version="1.0" encoding="utf-8"?>
+<C:addressbook-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+  <D:prop><D:getetag/><C:address-data/></D:prop>
+  <C:filter` + filter + `</C:filter>` + limit + `
+</C:addressbook-query>`
+	}
+	testCases := []struct {
+		desc, filter, limit string
+		want                []string
+	}{{
+		"all", ">", "",
+		[]string{"alice.vcf", "bob.vcf", "carol.vcf"},
+	}, {
+		"name contains", `><C:prop-filter name="FN"><C:text-match>smith</C:text-match></C:prop-filter>`, "",
+		[]string{"alice.vcf", "carol.vcf"},
+	}, {
+		"email ends with", `><C:prop-filter name="EMAIL"><C:text-match match-type="ends-with">.org</C:text-match></C:prop-filter>`, "",
+		[]string{"bob.vcf", "carol.vcf"},
+	}, {
+		"anyof", `><C:prop-filter name="FN"><C:text-match match-type="starts-with">alice</C:text-match></C:prop-filter>` +
+			`<C:prop-filter name="EMAIL"><C:text-match match-type="equals">bob@example.org</C:text-match></C:prop-filter>`, "",
+		[]string{"alice.vcf", "bob.vcf"},
+	}, {
+		"allof", ` test="allof"><C:prop-filter name="FN"><C:text-match>smith</C:text-match></C:prop-filter>` +
+			`<C:prop-filter name="EMAIL"><C:text-match>.org</C:text-match></C:prop-filter>`, "",
+		[]string{"carol.vcf"},
+	}, {
+		"negated", `><C:prop-filter name="FN"><C:text-match negate-condition="yes">smith</C:text-match></C:prop-filter>`, "",
+		[]string{"bob.vcf"},
+	}, {
+		"param", `><C:prop-filter name="EMAIL"><C:param-filter name="TYPE"><C:text-match match-type="equals">WORK</C:text-match></C:param-filter></C:prop-filter>`, "",
+		[]string{"alice.vcf", "bob.vcf", "carol.vcf"},
+	}, {
+		"not defined", `><C:prop-filter name="TEL"><C:is-not-defined/></C:prop-filter>`, "",
+		[]string{"alice.vcf", "bob.vcf", "carol.vcf"},
+	}, {
+		"limit", ">", `<C:limit><C:nresults>2</C:nresults></C:limit>`,
+		[]string{"alice.vcf", "bob.vcf"},
+	}}
+	for _, tc := range testCases {
+		w := do(ah, "REPORT", "/dav/book/", query(tc.filter, tc.limit), "Depth", "1")
+		if w.Code != http.StatusMultiStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, http.StatusMultiStatus)
+			continue
+		}
+		body := w.Body.String()
+		var got []string
+		for _, name := range []string{"alice.vcf", "bob.vcf", "carol.vcf"} {
+			if strings.Contains(body, "<D:href>/dav/book/"+name+"</D:href>") {
+				got = append(got, name)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.desc, got, tc.want)
+		}
+		if !strings.Contains(body, "BEGIN:VCARD") {
+			t.Errorf("%s: got %q, want the address data", tc.desc, body)
+		}
+		if truncated := strings.Contains(body, "507 Insufficient Storage"); truncated != (tc.limit != "") {
+			t.Errorf("%s: got %q, want truncated %t", tc.desc, body, tc.limit != "")
+		}
+	}
+	if w := do(ah, "REPORT", "/dav/book/", `<C:addressbook-query xmlns:C="urn:ietf:params:xml:ns:carddav"/>`, "Depth", "1"); w.Code != http.StatusBadRequest {
+		t.Errorf("no filter: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestAddressbookMultiget(t *testing.T) {
+	ah := newTestAddressBook(t)
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<C:addressbook-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+  <D:prop><C:address-data/></D:prop>
+  <D:href>/dav/book/bob.vcf</D:href>
+  <D:href>/dav/book/missing.vcf</D:href>
+</C:addressbook-multiget>`
+	w := do(ah, "REPORT", "/dav/book/", body, "Depth", "1")
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("REPORT: got status %d, want %d", w.Code, http.StatusMultiStatus)
+	}
+	got := w.Body.String()
+	for _, want := range []string{
+		`<D:response><D:href>/dav/book/bob.vcf</D:href><D:propstat><D:prop><address-data xmlns="urn:ietf:params:xml:ns:carddav">BEGIN:VCARD&#xD;&#xA;`,
+		`FN:Bob Jones`,
+		`<D:response><D:href>/dav/book/missing.vcf</D:href><D:status>HTTP/1.1 404 Not Found</D:status></D:response>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("REPORT: got %q, want it to contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "Alice") {
+		t.Errorf("REPORT: got %q, want only the requested resources", got)
+	}
+	for _, href := range []string{"/other/bob.vcf", "/davx/book/bob.vcf"} {
+		outside := strings.Replace(body, "/dav/book/bob.vcf", href, 1)
+		if w := do(ah, "REPORT", "/dav/book/", outside, "Depth", "1"); w.Code != http.StatusBadRequest {
+			t.Errorf("REPORT %s outside the handler: got status %d, want %d", href, w.Code, http.StatusBadRequest)
+		}
+	}
+}
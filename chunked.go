@@ -0,0 +1,536 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxChunks is the maximum number of chunks of an upload.
+const maxChunks = 10000
+
+// defaultMaxChunkedUploadSize is the maximum size of the chunks of an
+// upload if Handler.MaxChunkedUploadSize is zero.
+const defaultMaxChunkedUploadSize = 10 << 30
+
+// ChunkStore holds the chunks of the chunked uploads in progress, until
+// they are assembled into the uploaded file. See Handler.ChunkStore.
+//
+// Uploads and chunks are identified by names that are valid file names,
+// not starting with a dot.
+type ChunkStore interface {
+	// CreateUpload creates an empty upload. It returns an error satisfying
+	// os.IsExist if the upload already exists.
+	CreateUpload(ctx context.Context, upload string) error
+	// WriteChunk stores the chunk of the upload read from r, replacing
+	// the chunk with the same name, if any. It returns an error satisfying
+	// os.IsNotExist if the upload does not exist.
+	WriteChunk(ctx context.Context, upload, chunk string, r io.Reader) error
+	// Chunks returns the chunks of the upload, in any order, of which the
+	// Handler uses the name, size and modification time. It returns an
+	// error satisfying os.IsNotExist if the upload does not exist.
+	Chunks(ctx context.Context, upload string) ([]os.FileInfo, error)
+	// OpenChunk opens a chunk of the upload for reading.
+	OpenChunk(ctx context.Context, upload, chunk string) (io.ReadCloser, error)
+	// RemoveUpload removes the upload and its chunks. It returns an error
+	// satisfying os.IsNotExist if the upload does not exist.
+	RemoveUpload(ctx context.Context, upload string) error
+}
+
+// A ChunkDir implements ChunkStore using the native file system restricted
+// to a specific directory tree, with a directory per upload. The uploads
+// abandoned by the clients are never removed, they can be purged by
+// removing the directories not modified for some time.
+//
+// An empty ChunkDir is treated as ".".
+type ChunkDir string
+
+func (d ChunkDir) resolve(elem ...string) string {
+	dir := string(d)
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Join(append([]string{dir}, elem...)...)
+}
+
+func (d ChunkDir) CreateUpload(ctx context.Context, upload string) error {
+	return os.Mkdir(d.resolve(upload), 0700)
+}
+
+func (d ChunkDir) WriteChunk(ctx context.Context, upload, chunk string, r io.Reader) error {
+	// The chunk is written to a temporary file first, so that a chunk
+	// interrupted by the client never replaces a complete one.
+	f, err := os.CreateTemp(d.resolve(upload), ".chunk-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), d.resolve(upload, chunk))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (d ChunkDir) Chunks(ctx context.Context, upload string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(d.resolve(upload))
+	if err != nil {
+		return nil, err
+	}
+	var chunks []os.FileInfo
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Replaced by a concurrent WriteChunk.
+				continue
+			}
+			return nil, err
+		}
+		chunks = append(chunks, fi)
+	}
+	return chunks, nil
+}
+
+func (d ChunkDir) OpenChunk(ctx context.Context, upload, chunk string) (io.ReadCloser, error) {
+	return os.Open(d.resolve(upload, chunk))
+}
+
+func (d ChunkDir) RemoveUpload(ctx context.Context, upload string) error {
+	dir := d.resolve(upload)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// chunkingName matches the names of the chunks uploaded by the ownCloud
+// clients: the name of the file, the transfer id, the number of chunks and
+// the index of the chunk.
+var chunkingName = regexp.MustCompile(`^(.+)-chunking-([^-]+)-([0-9]+)-([0-9]+)$`)
+
+func (h *Handler) isUploadsRequest(r *http.Request) bool {
+	return h.UploadsPrefix != "" && isWithin(slashClean(r.URL.Path), slashClean(h.UploadsPrefix))
+}
+
+func (h *Handler) isChunkedUpload(r *http.Request) bool {
+	if h.ChunkStore == nil {
+		return false
+	}
+	return h.isUploadsRequest(r) || r.Method == "PUT" && r.Header.Get("OC-Chunked") != ""
+}
+
+func (h *Handler) serveChunkedUpload(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	if h.isUploadsRequest(r) {
+		return h.serveUploads(w, r)
+	}
+	return h.handleChunkPut(w, r)
+}
+
+// uploadID returns the name of the upload identified by elem, unique to the
+// principal of r.
+func (h *Handler) uploadID(r *http.Request, elem ...string) string {
+	hash := sha256.New()
+	io.WriteString(hash, h.principal(r))
+	for _, e := range elem {
+		io.WriteString(hash, "\x00"+e)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// handleChunkPut stores a chunk uploaded by the ownCloud chunking
+// protocol, and assembles the file once all of its chunks are received.
+func (h *Handler) handleChunkPut(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	dir, base := path.Split(slashClean(reqPath))
+	m := chunkingName.FindStringSubmatch(base)
+	if m == nil {
+		return http.StatusBadRequest, errInvalidChunk
+	}
+	count, err := strconv.Atoi(m[3])
+	if err != nil || count == 0 || count > maxChunks {
+		return http.StatusBadRequest, errInvalidChunk
+	}
+	index, err := strconv.Atoi(m[4])
+	if err != nil || index >= count {
+		return http.StatusBadRequest, errInvalidChunk
+	}
+	target := dir + m[1]
+	// The locks of the file are confirmed before storing each chunk, so
+	// that the clients do not upload a whole file that cannot be written.
+	release, status, err := h.confirmLocks(r, target, "")
+	if err != nil {
+		return status, err
+	}
+	release()
+
+	ctx := r.Context()
+	// The chunks carry the size of the whole file, so that an upload not
+	// fitting in the quota is refused from its first chunk.
+	if total, err := strconv.ParseInt(r.Header.Get("OC-Total-Length"), 10, 64); err == nil && total >= 0 {
+		if status, err := h.checkQuota(ctx, target, total); err != nil {
+			return status, err
+		}
+	}
+	upload := h.uploadID(r, target, m[2], m[3])
+	if err := h.ChunkStore.CreateUpload(ctx, upload); err != nil && !os.IsExist(err) {
+		return http.StatusInternalServerError, err
+	}
+	if status, err := h.writeChunk(ctx, upload, strconv.Itoa(index), r.Body); err != nil {
+		return status, err
+	}
+	chunks, err := h.ChunkStore.Chunks(ctx, upload)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if len(chunks) < count {
+		return http.StatusCreated, nil
+	}
+	return h.assembleUpload(w, r, upload, chunks, target)
+}
+
+// writeChunk stores the chunk of upload read from body, within the limits
+// to the number of chunks and to their total size.
+func (h *Handler) writeChunk(ctx context.Context, upload, chunk string, body io.Reader) (status int, err error) {
+	chunks, err := h.ChunkStore.Chunks(ctx, upload)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusConflict, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	var size int64
+	replaced := false
+	for _, c := range chunks {
+		if c.Name() == chunk {
+			replaced = true
+			continue
+		}
+		size += c.Size()
+	}
+	if !replaced && len(chunks) >= maxChunks {
+		return http.StatusRequestEntityTooLarge, errTooManyChunks
+	}
+	max := h.MaxChunkedUploadSize
+	if max == 0 {
+		max = defaultMaxChunkedUploadSize
+	}
+	if max > 0 {
+		if size >= max {
+			return http.StatusRequestEntityTooLarge, ErrBodyTooLarge
+		}
+		body = NewBodyPipeline().Limit(max - size).Reader(body)
+	}
+	if err := h.ChunkStore.WriteChunk(ctx, upload, chunk, body); err != nil {
+		if errors.Is(err, ErrBodyTooLarge) {
+			return http.StatusRequestEntityTooLarge, err
+		}
+		if os.IsNotExist(err) {
+			return http.StatusConflict, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+}
+
+// serveUploads serves the requests to the Nextcloud upload collections,
+// under h.UploadsPrefix.
+func (h *Handler) serveUploads(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	rel := strings.TrimPrefix(slashClean(r.URL.Path), slashClean(h.UploadsPrefix))
+	if rel == "" || rel == "/" {
+		return http.StatusMethodNotAllowed, errUnsupportedMethod
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case "MKCOL":
+		if r.ContentLength > 0 {
+			return http.StatusUnsupportedMediaType, nil
+		}
+		if err := h.ChunkStore.CreateUpload(ctx, h.uploadID(r, rel)); err != nil {
+			if os.IsExist(err) {
+				return http.StatusMethodNotAllowed, err
+			}
+			return http.StatusInternalServerError, err
+		}
+		return http.StatusCreated, nil
+	case "PUT":
+		dir, chunk := path.Split(rel)
+		if strings.HasPrefix(chunk, ".") {
+			return http.StatusBadRequest, errInvalidChunk
+		}
+		if status, err := h.writeChunk(ctx, h.uploadID(r, path.Clean(dir)), chunk, r.Body); err != nil {
+			return status, err
+		}
+		return http.StatusCreated, nil
+	case "PROPFIND":
+		return h.listUpload(w, r, rel)
+	case "MOVE":
+		dir, name := path.Split(rel)
+		if name != ".file" {
+			return http.StatusForbidden, errUnsupportedMethod
+		}
+		u, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || u.Path == "" {
+			return http.StatusBadRequest, errInvalidDestination
+		}
+		if u.Host != "" && u.Host != r.Host {
+			return http.StatusBadGateway, errInvalidDestination
+		}
+		target, status, err := h.stripPrefix(u.Path)
+		if err != nil {
+			return status, err
+		}
+		if r.Header.Get("Overwrite") == "F" {
+			if _, err := h.FileSystem.Stat(ctx, target); err == nil {
+				return http.StatusPreconditionFailed, nil
+			}
+		}
+		upload := h.uploadID(r, path.Clean(dir))
+		chunks, err := h.ChunkStore.Chunks(ctx, upload)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return http.StatusNotFound, err
+			}
+			return http.StatusInternalServerError, err
+		}
+		return h.assembleUpload(w, r, upload, chunks, target)
+	case "DELETE":
+		if err := h.ChunkStore.RemoveUpload(ctx, h.uploadID(r, rel)); err != nil {
+			if os.IsNotExist(err) {
+				return http.StatusNotFound, err
+			}
+			return http.StatusInternalServerError, err
+		}
+		return http.StatusNoContent, nil
+	}
+	return http.StatusMethodNotAllowed, errUnsupportedMethod
+}
+
+// listUpload answers the PROPFIND request r for the upload collection rel,
+// listing its chunks, so that the clients can resume an interrupted upload.
+func (h *Handler) listUpload(w http.ResponseWriter, r *http.Request, rel string) (status int, err error) {
+	pf, status, err := readPropfind(r.Body)
+	if err != nil {
+		return status, err
+	}
+	ctx := r.Context()
+	chunks, err := h.ChunkStore.Chunks(ctx, h.uploadID(r, path.Clean(rel)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	pnames := []xml.Name{
+		{Space: "DAV:", Local: "resourcetype"},
+		{Space: "DAV:", Local: "getcontentlength"},
+		{Space: "DAV:", Local: "getlastmodified"},
+	}
+	if pf.Prop != nil {
+		pnames = pf.Prop
+	}
+	// chunkProps returns the propstats of the upload collection if fi is
+	// nil, or of its chunk fi.
+	chunkProps := func(fi os.FileInfo) []Propstat {
+		pstatOK := Propstat{Status: http.StatusOK}
+		pstatNotFound := Propstat{Status: http.StatusNotFound}
+		for _, pn := range pnames {
+			value, ok := "", true
+			switch {
+			case pn == xml.Name{Space: "DAV:", Local: "resourcetype"}:
+				if fi == nil {
+					value = `<D:collection xmlns:D="DAV:"/>`
+				}
+			case pn == xml.Name{Space: "DAV:", Local: "getcontentlength"} && fi != nil:
+				value = strconv.FormatInt(fi.Size(), 10)
+			case pn == xml.Name{Space: "DAV:", Local: "getlastmodified"} && fi != nil:
+				value = fi.ModTime().UTC().Format(http.TimeFormat)
+			default:
+				ok = false
+			}
+			if ok {
+				pstatOK.Props = append(pstatOK.Props, Property{XMLName: pn, InnerXML: []byte(value)})
+			} else {
+				pstatNotFound.Props = append(pstatNotFound.Props, Property{XMLName: pn})
+			}
+		}
+		var pstats []Propstat
+		for _, pstat := range []Propstat{pstatOK, pstatNotFound} {
+			if len(pstat.Props) > 0 {
+				pstats = append(pstats, pstat)
+			}
+		}
+		return pstats
+	}
+
+	href := path.Join(slashClean(h.UploadsPrefix), rel) + "/"
+	mw := multistatusWriter{w: w, canonical: h.CanonicalXML, ctx: ctx}
+	writeErr := mw.write(makePropstatResponse(href, chunkProps(nil)))
+	if parseDepth(r.Header.Get("Depth")) != 0 {
+		names := make([]string, len(chunks))
+		byName := make(map[string]os.FileInfo, len(chunks))
+		for i, c := range chunks {
+			names[i] = c.Name()
+			byName[c.Name()] = c
+		}
+		sortChunks(names)
+		for _, name := range names {
+			if writeErr != nil {
+				break
+			}
+			writeErr = mw.write(makePropstatResponse(href+name, chunkProps(byName[name])))
+		}
+	}
+	closeErr := mw.close()
+	if writeErr != nil {
+		return http.StatusInternalServerError, writeErr
+	}
+	if closeErr != nil {
+		return http.StatusInternalServerError, closeErr
+	}
+	return 0, nil
+}
+
+// assembleUpload writes the chunks of upload to the file target, as a PUT
+// request with their concatenation as body would, and removes the upload
+// once done. The headers of r, such as OC-Total-Length and X-OC-MTime,
+// apply to the assembled file.
+func (h *Handler) assembleUpload(w http.ResponseWriter, r *http.Request, upload string, chunks []os.FileInfo, target string) (status int, err error) {
+	names := make([]string, len(chunks))
+	var size int64
+	for i, c := range chunks {
+		names[i] = c.Name()
+		size += c.Size()
+	}
+	if status, err := h.checkQuota(r.Context(), target, size); err != nil {
+		return status, err
+	}
+	sortChunks(names)
+	ctx := withAssembledUpload(r.Context())
+	body := &chunkReader{ctx: ctx, store: h.ChunkStore, upload: upload, chunks: names}
+	defer body.Close()
+
+	put := r.Clone(ctx)
+	put.Method = "PUT"
+	put.URL.Path, put.URL.RawPath = h.Prefix+target, ""
+	put.Body, put.ContentLength, put.Trailer = body, -1, nil
+	for _, k := range []string{"Content-Length", "Content-Range", "Destination", "OC-Chunked", "Overwrite"} {
+		put.Header.Del(k)
+	}
+	status, err = h.handlePut(w, put)
+	if err == nil {
+		h.ChunkStore.RemoveUpload(ctx, upload)
+	}
+	return status, err
+}
+
+// sortChunks sorts the names of chunks in the order in which they are
+// assembled: numerically if they are all numbers, as sent by the clients,
+// otherwise lexicographically.
+func sortChunks(chunks []string) {
+	numbers := make(map[string]uint64, len(chunks))
+	for _, c := range chunks {
+		n, err := strconv.ParseUint(c, 10, 64)
+		if err != nil {
+			sort.Strings(chunks)
+			return
+		}
+		numbers[c] = n
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return numbers[chunks[i]] < numbers[chunks[j]]
+	})
+}
+
+// chunkReader reads the concatenation of the chunks of an upload.
+type chunkReader struct {
+	ctx    context.Context
+	store  ChunkStore
+	upload string
+	chunks []string
+	cur    io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.cur == nil {
+			if len(cr.chunks) == 0 {
+				return 0, io.EOF
+			}
+			f, err := cr.store.OpenChunk(cr.ctx, cr.upload, cr.chunks[0])
+			if err != nil {
+				return 0, err
+			}
+			cr.cur, cr.chunks = f, cr.chunks[1:]
+		}
+		n, err := cr.cur.Read(p)
+		if err == io.EOF {
+			cr.cur.Close()
+			cr.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.cur == nil {
+		return nil
+	}
+	err := cr.cur.Close()
+	cr.cur = nil
+	return err
+}
+
+type assembledUploadKey struct{}
+
+// withAssembledUpload marks the PUT requests writing an assembled upload,
+// which are never redirected to a presigned URL.
+func withAssembledUpload(ctx context.Context) context.Context {
+	return context.WithValue(ctx, assembledUploadKey{}, true)
+}
+
+func isAssembledUpload(ctx context.Context) bool {
+	ok, _ := ctx.Value(assembledUploadKey{}).(bool)
+	return ok
+}
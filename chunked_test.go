@@ -0,0 +1,165 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChunkedUpload(t *testing.T) {
+	dir, chunks := t.TempDir(), t.TempDir()
+	h := &Handler{
+		FileSystem:    Dir(dir),
+		LockSystem:    NewMemLS(),
+		ChunkStore:    ChunkDir(chunks),
+		UploadsPrefix: "/uploads",
+	}
+	do := func(method, target, body string, hdrs ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(hdrs); i += 2 {
+			r.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	checkFile := func(desc, name, want string) {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s: ReadFile: %v", desc, err)
+		}
+		if string(b) != want {
+			t.Errorf("%s: got content %q, want %q", desc, b, want)
+		}
+		entries, err := os.ReadDir(chunks)
+		if err != nil {
+			t.Fatalf("%s: ReadDir: %v", desc, err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("%s: got %d uploads left, want none", desc, len(entries))
+		}
+	}
+
+	// ownCloud chunking, with the chunks received out of order.
+	for _, c := range []struct{ index, body string }{{"2", "baz"}, {"0", "foo"}, {"1", "bar"}} {
+		w := do("PUT", "/f.txt-chunking-1234-3-"+c.index, c.body, "OC-Chunked", "1", "OC-Total-Length", "9")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("chunk %s: got status %d, want %d", c.index, w.Code, http.StatusCreated)
+		}
+		if got := w.Header().Get("ETag") != ""; got != (c.index == "1") {
+			t.Errorf("chunk %s: got ETag %t", c.index, got)
+		}
+	}
+	checkFile("ownCloud chunking", "f.txt", "foobarbaz")
+	if w := do("PUT", "/f.txt-chunking-1234-3-3", "x", "OC-Chunked", "1"); w.Code != http.StatusBadRequest {
+		t.Errorf("chunk out of range: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// Nextcloud chunking, with numeric chunk names, and an aborted upload.
+	type step struct {
+		method, target, body string
+		hdrs                 []string
+		want                 int
+	}
+	for _, s := range []step{
+		{"MKCOL", "/uploads/alice/u1", "", nil, http.StatusCreated},
+		{"MKCOL", "/uploads/alice/u1", "", nil, http.StatusMethodNotAllowed},
+		{"PUT", "/uploads/alice/u1/10", " world", nil, http.StatusCreated},
+		{"PUT", "/uploads/alice/u1/9", "hello", nil, http.StatusCreated},
+		{"PUT", "/uploads/alice/u2/1", "nope", nil, http.StatusConflict},
+		{"MKCOL", "/uploads/alice/u3", "", nil, http.StatusCreated},
+		{"DELETE", "/uploads/alice/u3", "", nil, http.StatusNoContent},
+		{"DELETE", "/uploads/alice/u3", "", nil, http.StatusNotFound},
+		{"MOVE", "/uploads/alice/u1/.file", "", []string{"Destination", "/g.txt", "OC-Total-Length", "12"}, http.StatusBadRequest},
+		{"MOVE", "/uploads/alice/u1/.file", "", []string{"Destination", "/g.txt", "OC-Total-Length", "11"}, http.StatusCreated},
+	} {
+		if w := do(s.method, s.target, s.body, s.hdrs...); w.Code != s.want {
+			t.Fatalf("%s %s: got status %d, want %d", s.method, s.target, w.Code, s.want)
+		}
+	}
+	checkFile("Nextcloud chunking", "g.txt", "hello world")
+}
+
+func TestChunkedUploadLimits(t *testing.T) {
+	dir := t.TempDir()
+	h := &Handler{
+		FileSystem:           &quotaFS{Dir(dir), 8},
+		LockSystem:           NewMemLS(),
+		ChunkStore:           ChunkDir(t.TempDir()),
+		UploadsPrefix:        "/uploads",
+		MaxChunkedUploadSize: 6,
+	}
+	do := func(method, target, body string, hdrs ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(hdrs); i += 2 {
+			r.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	type step struct {
+		method, target, body string
+		hdrs                 []string
+		want                 int
+	}
+	for _, s := range []step{
+		{"PUT", "/f.txt-chunking-1-2-0", "foo", []string{"OC-Chunked", "1", "OC-Total-Length", "9"}, http.StatusInsufficientStorage},
+		{"MKCOL", "/uploads/u1", "", nil, http.StatusCreated},
+		{"PUT", "/uploads/u1/1", "hello", nil, http.StatusCreated},
+		{"PUT", "/uploads/u1/2", " world", nil, http.StatusRequestEntityTooLarge},
+		{"PUT", "/uploads/u1/1", "hi", nil, http.StatusCreated},
+		{"PUT", "/uploads/u1/2", "!", nil, http.StatusCreated},
+		{"PROPFIND", "/uploads/u2", "", []string{"Depth", "1"}, http.StatusNotFound},
+	} {
+		if w := do(s.method, s.target, s.body, s.hdrs...); w.Code != s.want {
+			t.Fatalf("%s %s: got status %d, want %d", s.method, s.target, w.Code, s.want)
+		}
+	}
+
+	// The chunks are listed, so that an interrupted upload can resume.
+	w := do("PROPFIND", "/uploads/u1", "", "Depth", "1")
+	if w.Code != StatusMulti {
+		t.Fatalf("PROPFIND: got status %d, want %d", w.Code, StatusMulti)
+	}
+	for _, want := range []string{
+		`<D:href>/uploads/u1/</D:href><D:propstat><D:prop><D:resourcetype><D:collection xmlns:D="DAV:"/></D:resourcetype>`,
+		`<D:href>/uploads/u1/1</D:href><D:propstat><D:prop><D:resourcetype></D:resourcetype><D:getcontentlength>2</D:getcontentlength>`,
+		`<D:href>/uploads/u1/2</D:href><D:propstat><D:prop><D:resourcetype></D:resourcetype><D:getcontentlength>1</D:getcontentlength>`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("PROPFIND: got %s, want it to contain %s", w.Body.String(), want)
+		}
+	}
+
+	// The quota is checked before the chunks are assembled.
+	h.FileSystem = &quotaFS{Dir(dir), 2}
+	if w := do("MOVE", "/uploads/u1/.file", "", "Destination", "/g.txt"); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("MOVE over quota: got status %d, want %d", w.Code, http.StatusInsufficientStorage)
+	}
+	h.FileSystem = &quotaFS{Dir(dir), 8}
+	if w := do("MOVE", "/uploads/u1/.file", "", "Destination", "/g.txt"); w.Code != http.StatusCreated {
+		t.Errorf("MOVE: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "g.txt")); err != nil || string(b) != "hi!" {
+		t.Errorf("got content %q, %v, want %q", b, err, "hi!")
+	}
+}
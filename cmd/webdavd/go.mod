@@ -0,0 +1,9 @@
+module github.com/drakkan/webdav/cmd/webdavd
+
+go 1.20
+
+require github.com/drakkan/webdav v0.0.0
+
+require golang.org/x/sys v0.30.0 // indirect
+
+replace github.com/drakkan/webdav => ../..
@@ -0,0 +1,142 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Command webdavd is a minimal WebDAV server built on the webdav package.
+// It is a reference integration and a quick test server, not a production
+// ready daemon.
+//
+// It is a separate module, so that its dependencies never become the ones
+// of the library. Build it from its directory, for example using
+// "go run . -h".
+//
+// Every flag can also be set using an environment variable named after the
+// flag, upper cased, with dashes replaced by underscores and a WEBDAVD_
+// prefix, for example WEBDAVD_ADDR or WEBDAVD_TLS_CERT. Flags given on the
+// command line take precedence.
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/drakkan/webdav"
+)
+
+func main() {
+	var (
+		addr      = flag.String("addr", ":8080", "address to listen on")
+		root      = flag.String("root", "", "directory to serve, an in-memory file system is used if empty")
+		prefix    = flag.String("prefix", "", "URL path prefix to strip from WebDAV resource paths")
+		tlsCert   = flag.String("tls-cert", "", "TLS certificate file, enables HTTPS together with -tls-key")
+		tlsKey    = flag.String("tls-key", "", "TLS private key file")
+		user      = flag.String("user", "", "user name for HTTP basic authentication, authentication is disabled if empty")
+		password  = flag.String("password", "", "password for HTTP basic authentication")
+		lockNull  = flag.Bool("lock-null", false, "enable the RFC 2518 lock-null resources compatibility mode")
+		logErrors = flag.Bool("log", true, "log requests")
+	)
+	flag.Parse()
+	if err := setFromEnv(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+
+	var fs webdav.FileSystem = webdav.NewMemFS()
+	if *root != "" {
+		fs = webdav.Dir(*root)
+	}
+	h := &webdav.Handler{
+		Prefix:            *prefix,
+		FileSystem:        fs,
+		LockSystem:        webdav.NewMemLS(),
+		LockNullResources: *lockNull,
+	}
+	if *logErrors {
+		h.Logger = func(r *http.Request, status int, err error) {
+			if err != nil {
+				log.Printf("%s %s: %d %v", r.Method, r.URL.Path, status, err)
+				return
+			}
+			log.Printf("%s %s: %d", r.Method, r.URL.Path, status)
+		}
+	}
+	for _, warning := range h.Capabilities(context.Background()).Warnings() {
+		log.Printf("warning: %s", warning)
+	}
+	var handler http.Handler = h
+	if *user != "" {
+		// The requests are authenticated, so the features restricted to
+		// the principal that started them, such as the locks and the
+		// resumable uploads, are tied to the user.
+		h.Principal = func(r *http.Request) string {
+			u, _, _ := r.BasicAuth()
+			return u
+		}
+		handler = basicAuth(handler, *user, *password)
+	}
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: handler,
+	}
+	webdav.Timeouts{}.Apply(srv)
+	var err error
+	if *tlsCert != "" || *tlsKey != "" {
+		log.Printf("serving HTTPS on %s", *addr)
+		err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		log.Printf("serving HTTP on %s", *addr)
+		err = srv.ListenAndServe()
+	}
+	log.Fatal(err)
+}
+
+// setFromEnv sets the flags not given on the command line from the
+// corresponding WEBDAVD_ environment variables.
+func setFromEnv(fset *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	fset.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		name := "WEBDAVD_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(name); ok {
+			if setErr := fset.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", v, name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+func basicAuth(next http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="webdavd"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
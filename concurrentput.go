@@ -0,0 +1,102 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ConcurrentPutMode is what happens when a PUT request writes a file another
+// PUT request, without a lock, is still writing.
+type ConcurrentPutMode int
+
+const (
+	// ConcurrentPutLastWriterWins lets both requests proceed. Each is
+	// written to a temporary file renamed over the target once complete,
+	// so the last upload to complete wins and readers never see a
+	// partially written file.
+	ConcurrentPutLastWriterWins ConcurrentPutMode = iota
+	// ConcurrentPutReject refuses the second request with 423 Locked.
+	ConcurrentPutReject
+	// ConcurrentPutConflictCopy writes the second request to a conflict copy
+	// next to the target, such as "report (conflict 1).txt", returned in the
+	// Content-Location header of the response.
+	ConcurrentPutConflictCopy
+)
+
+// ConcurrentPuts tracks the PUT requests in progress, applying Mode to the
+// concurrent ones. Each share, served by its own Handler, can have its own
+// ConcurrentPuts. A ConcurrentPuts must not be copied after first use.
+type ConcurrentPuts struct {
+	Mode ConcurrentPutMode
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// begin registers a PUT request to name, returning the name to write to and
+// a function to call once the request is done.
+func (c *ConcurrentPuts) begin(ctx context.Context, fs FileSystem, name string) (target string, end func(), err error) {
+	if c == nil {
+		return name, func() {}, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active[name] > 0 {
+		switch c.Mode {
+		case ConcurrentPutReject:
+			return "", nil, errConcurrentPut
+		case ConcurrentPutConflictCopy:
+			if name, err = c.conflictName(ctx, fs, name); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	if c.active == nil {
+		c.active = make(map[string]int)
+	}
+	c.active[name]++
+	return name, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.active[name]--; c.active[name] == 0 {
+			delete(c.active, name)
+		}
+	}, nil
+}
+
+// conflictName returns the first name of a conflict copy of name that
+// neither exists nor is being written.
+func (c *ConcurrentPuts) conflictName(ctx context.Context, fs FileSystem, name string) (string, error) {
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		copyName := path.Join(dir, fmt.Sprintf("%s (conflict %d)%s", stem, i, ext))
+		if c.active[copyName] > 0 {
+			continue
+		}
+		if _, err := fs.Stat(ctx, copyName); os.IsNotExist(err) {
+			return copyName, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
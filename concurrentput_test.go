@@ -0,0 +1,273 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConcurrentPuts(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		mode       ConcurrentPutMode
+		wantStatus int
+		wantCopy   string
+		wantFinal  string
+	}{{
+		"last writer wins",
+		ConcurrentPutLastWriterWins,
+		http.StatusCreated,
+		"",
+		"first",
+	}, {
+		"reject",
+		ConcurrentPutReject,
+		http.StatusLocked,
+		"",
+		"first",
+	}, {
+		"conflict copy",
+		ConcurrentPutConflictCopy,
+		http.StatusCreated,
+		"/doc (conflict 1).txt",
+		"first",
+	}}
+
+	for _, tc := range testCases {
+		fs, err := buildTestFS([]string{"write /doc.txt old"})
+		if err != nil {
+			t.Fatalf("%s: cannot create test filesystem: %v", tc.desc, err)
+		}
+		puts := &ConcurrentPuts{Mode: tc.mode}
+		h := &Handler{
+			FileSystem:     fs,
+			LockSystem:     NewMemLS(),
+			ConcurrentPuts: puts,
+		}
+		get := func(name string) string {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", hrefPath(name), nil))
+			return w.Body.String()
+		}
+
+		// The first upload is held in progress until its body is closed.
+		pr, pw := io.Pipe()
+		firstDone := make(chan int)
+		go func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("PUT", "/doc.txt", pr))
+			firstDone <- w.Code
+		}()
+		pw.Write([]byte("fir"))
+		for {
+			puts.mu.Lock()
+			n := puts.active["/doc.txt"]
+			puts.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if got := get("/doc.txt"); got != "old" {
+			t.Errorf("%s: during the first upload: got %q, want %q", tc.desc, got, "old")
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/doc.txt", strings.NewReader("second")))
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: second upload: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+		}
+		if got, want := w.Header().Get("Content-Location"), hrefPath(tc.wantCopy); tc.wantCopy != "" && got != want {
+			t.Errorf("%s: second upload: got Content-Location %q, want %q", tc.desc, got, want)
+		}
+		if tc.wantCopy != "" {
+			if got := get(tc.wantCopy); got != "second" {
+				t.Errorf("%s: conflict copy: got %q, want %q", tc.desc, got, "second")
+			}
+		}
+
+		pw.Write([]byte("st"))
+		pw.Close()
+		if code := <-firstDone; code != http.StatusCreated {
+			t.Errorf("%s: first upload: got status %d, want %d", tc.desc, code, http.StatusCreated)
+		}
+		if got := get("/doc.txt"); got != tc.wantFinal {
+			t.Errorf("%s: after both uploads: got %q, want %q", tc.desc, got, tc.wantFinal)
+		}
+		if len(puts.active) != 0 {
+			t.Errorf("%s: uploads still tracked: %v", tc.desc, puts.active)
+		}
+		names, err := find(context.Background(), nil, fs, "/")
+		if err != nil {
+			t.Fatalf("%s: find: %v", tc.desc, err)
+		}
+		for _, name := range names {
+			if IsUploadName(name) {
+				t.Errorf("%s: temporary file %s left behind", tc.desc, name)
+			}
+		}
+	}
+}
+
+func TestPutCollection(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /d", "write /d/f content"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{FileSystem: fs, LockSystem: NewMemLS()}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/d", strings.NewReader("x")))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if _, err := fs.Stat(context.Background(), "/d/f"); err != nil {
+		t.Errorf("the collection was overwritten: %v", err)
+	}
+}
+
+func TestPutLockedDuringUpload(t *testing.T) {
+	fs, err := buildTestFS([]string{"write /doc.txt old"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	puts := &ConcurrentPuts{}
+	h := &Handler{FileSystem: fs, LockSystem: NewMemLS(), ConcurrentPuts: puts}
+
+	pr, pw := io.Pipe()
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/doc.txt", pr))
+		done <- w.Code
+	}()
+	pw.Write([]byte("new"))
+	for {
+		puts.mu.Lock()
+		n := puts.active["/doc.txt"]
+		puts.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("LOCK", "/doc.txt", strings.NewReader(`<D:lockinfo xmlns:D="DAV:">`+
+		`<D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("LOCK during the upload: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	pw.Close()
+	if code := <-done; code != http.StatusLocked {
+		t.Errorf("upload: got status %d, want %d", code, http.StatusLocked)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/doc.txt", nil))
+	if got := w.Body.String(); got != "old" {
+		t.Errorf("after the refused upload: got %q, want %q", got, "old")
+	}
+}
+
+func TestPutKeepsFileState(t *testing.T) {
+	ctx := context.Background()
+	propName := xml.Name{Space: "urn:test", Local: "color"}
+	for _, puts := range []*ConcurrentPuts{nil, {}} {
+		desc := "in place"
+		if puts != nil {
+			desc = "temporary file"
+		}
+
+		// The dead properties held by the File.
+		mem, err := buildTestFS([]string{"write /doc.txt old"})
+		if err != nil {
+			t.Fatalf("%s: cannot create test filesystem: %v", desc, err)
+		}
+		h := &Handler{FileSystem: mem, LockSystem: NewMemLS(), ConcurrentPuts: puts}
+		if _, err := patchDead(ctx, mem, nil, "/doc.txt", []Proppatch{{Props: []Property{{XMLName: propName, InnerXML: []byte("red")}}}}); err != nil {
+			t.Fatalf("%s: patchDead: %v", desc, err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/doc.txt", strings.NewReader("new")))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: PUT: got status %d, want %d", desc, w.Code, http.StatusCreated)
+		}
+		f, err := mem.OpenFile(ctx, "/doc.txt", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("%s: OpenFile: %v", desc, err)
+		}
+		props, err := f.(DeadPropsHolder).DeadProps()
+		f.Close()
+		if err != nil || string(props[propName].InnerXML) != "red" {
+			t.Errorf("%s: got dead properties %v, %v, want the color", desc, props, err)
+		}
+
+		// The changes journaled.
+		sfs := NewSyncFS(mem)
+		h.FileSystem = sfs
+		token, _ := sfs.(SyncTokenFS).SyncToken(ctx, "/")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/doc.txt", strings.NewReader("newer")))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: PUT to NewSyncFS: got status %d, want %d", desc, w.Code, http.StatusCreated)
+		}
+		changes, _, err := sfs.(SyncTokenFS).Changes(ctx, "/", token, infiniteDepth)
+		if err != nil || len(changes) != 1 || changes[0] != (SyncChange{Name: "/doc.txt"}) {
+			t.Errorf("%s: got changes %v, %v, want /doc.txt only", desc, changes, err)
+		}
+		if n := len(sfs.(*syncFS).journal); n != 1 {
+			t.Errorf("%s: got %d journaled changes, want 1", desc, n)
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PROPFIND", "/", nil))
+		if strings.Contains(w.Body.String(), ".webdav-upload-") {
+			t.Errorf("%s: PROPFIND lists a temporary file: %s", desc, w.Body.String())
+		}
+
+		// The permission bits, and the dead properties of a PropStore.
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "doc.txt"), []byte("old"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		h = &Handler{FileSystem: Dir(dir), LockSystem: NewMemLS(), PropStore: NewMemPropStore(), ConcurrentPuts: puts}
+		if _, err := h.PropStore.Patch(ctx, "/doc.txt", []Proppatch{{Props: []Property{{XMLName: propName, InnerXML: []byte("blue")}}}}); err != nil {
+			t.Fatalf("%s: Patch: %v", desc, err)
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/doc.txt", strings.NewReader("new")))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: PUT to Dir: got status %d, want %d", desc, w.Code, http.StatusCreated)
+		}
+		if fi, err := os.Stat(filepath.Join(dir, "doc.txt")); err != nil || fi.Mode().Perm() != 0640 {
+			t.Errorf("%s: got mode %v, %v, want %v", desc, fi.Mode().Perm(), err, os.FileMode(0640))
+		}
+		if props, err := h.PropStore.Get(ctx, "/doc.txt"); err != nil || string(props[propName].InnerXML) != "blue" {
+			t.Errorf("%s: got PropStore properties %v, %v, want the color", desc, props, err)
+		}
+	}
+
+	d := DurableDir{Rules: []DurabilityRule{{Pattern: "/db/journal", Durability: DurabilitySyncDir}}}
+	if got := d.durability(uploadName("/db/journal")); got != DurabilitySyncDir {
+		t.Errorf("durability of a temporary upload file: got %v, want %v", got, DurabilitySyncDir)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// checkPreconditions evaluates the If-Match, If-None-Match and
+// If-Unmodified-Since headers of the request r, modifying resource name,
+// as defined by RFC 7232 section 6, so that clients can implement
+// optimistic concurrency. It returns "412 Precondition Failed" if they do
+// not hold. If-Modified-Since only applies to GET and HEAD requests and is
+// ignored.
+func (h *Handler) checkPreconditions(r *http.Request, name string) (status int, err error) {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	ifUnmodifiedSince := r.Header.Get("If-Unmodified-Since")
+	if ifMatch == "" && ifNoneMatch == "" && ifUnmodifiedSince == "" {
+		return 0, nil
+	}
+	ctx := r.Context()
+	fi, err := h.FileSystem.Stat(ctx, name)
+	if err != nil && !os.IsNotExist(err) {
+		if os.IsPermission(err) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	exists := err == nil
+	etag := ""
+	if exists {
+		if etag, err = findETag(ctx, h.FileSystem, h.LockSystem, name, fi); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if ifMatch != "" {
+		if !exists || !matchETags(ifMatch, etag, false) {
+			return http.StatusPreconditionFailed, errPreconditionFailed
+		}
+	} else if ifUnmodifiedSince != "" && exists {
+		if t, err := http.ParseTime(ifUnmodifiedSince); err == nil && fi.ModTime().Truncate(time.Second).After(t) {
+			return http.StatusPreconditionFailed, errPreconditionFailed
+		}
+	}
+	if ifNoneMatch != "" && exists && matchETags(ifNoneMatch, etag, true) {
+		return http.StatusPreconditionFailed, errPreconditionFailed
+	}
+	return 0, nil
+}
+
+// matchETags reports whether the If-Match or If-None-Match header value s
+// matches etag, the current ETag of an existing resource, using the weak
+// comparison if weak is true and the strong one otherwise, see RFC 7232
+// section 2.3.2.
+func matchETags(s, etag string, weak bool) bool {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return true
+	}
+	if !weak && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if strings.HasPrefix(v, "W/") {
+			if !weak {
+				continue
+			}
+			v = v[2:]
+		}
+		if v == etag {
+			return true
+		}
+	}
+	return false
+}
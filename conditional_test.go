@@ -0,0 +1,77 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	h := &Handler{
+		FileSystem: Dir(t.TempDir()),
+		LockSystem: NewMemLS(),
+		PropStore:  NewMemPropStore(),
+	}
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := do("PUT", "/f", "v1")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	etag := w.Header().Get("ETag")
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	const proppatch = `<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><D:displayname>f</D:displayname></D:prop></D:set></D:propertyupdate>`
+
+	testCases := []struct {
+		desc, method, target, body string
+		headers                    []string
+		wantStatus                 int
+	}{
+		{"create if none match", "PUT", "/new", "x", []string{"If-None-Match", "*"}, http.StatusCreated},
+		{"overwrite if none match", "PUT", "/new", "y", []string{"If-None-Match", "*"}, http.StatusPreconditionFailed},
+		{"stale If-Match", "PUT", "/f", "v2", []string{"If-Match", `"stale"`}, http.StatusPreconditionFailed},
+		{"weak If-Match", "PUT", "/f", "v2", []string{"If-Match", "W/" + etag}, http.StatusPreconditionFailed},
+		{"If-Match on missing", "PUT", "/missing", "v2", []string{"If-Match", "*"}, http.StatusPreconditionFailed},
+		{"modified since", "PUT", "/f", "v2", []string{"If-Unmodified-Since", past}, http.StatusPreconditionFailed},
+		{"If-Match wins", "PROPPATCH", "/f", proppatch, []string{"If-Match", etag, "If-Unmodified-Since", past}, StatusMulti},
+		{"matching If-None-Match", "PROPPATCH", "/f", proppatch, []string{"If-None-Match", `"a", W/` + etag}, http.StatusPreconditionFailed},
+		{"If-Modified-Since ignored", "DELETE", "/new", "", []string{"If-Modified-Since", future}, http.StatusNoContent},
+		{"stale MOVE", "MOVE", "/f", "", []string{"Destination", "/g", "If-Match", `"stale"`}, http.StatusPreconditionFailed},
+		{"stale COPY", "COPY", "/f", "", []string{"Destination", "/g", "If-Match", `"stale"`}, http.StatusPreconditionFailed},
+		{"MKCOL if none match", "MKCOL", "/f", "", []string{"If-None-Match", "*"}, http.StatusPreconditionFailed},
+		{"stale DELETE", "DELETE", "/f", "", []string{"If-Match", `"stale"`}, http.StatusPreconditionFailed},
+		{"unmodified since", "PUT", "/f", "v2", []string{"If-Match", `"other", ` + etag, "If-Unmodified-Since", future}, http.StatusCreated},
+	}
+	for _, tc := range testCases {
+		if w := do(tc.method, tc.target, tc.body, tc.headers...); w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+		}
+	}
+	if w := do("GET", "/f", ""); w.Body.String() != "v2" {
+		t.Errorf("GET: got %q, want %q", w.Body.String(), "v2")
+	}
+}
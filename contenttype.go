@@ -0,0 +1,119 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"mime"
+	"os"
+	"path"
+	"strings"
+)
+
+// ContentTypes configures how a Handler resolves the content type of files,
+// reported by the DAV:getcontenttype property and the Content-Type header of
+// GET responses.
+//
+// The content type of a file is, in order of precedence:
+//   - its DAV:getcontenttype dead property, if Overrides is true;
+//   - the one reported by its os.FileInfo, if it implements ContentTyper,
+//     for example the one stored by an object store;
+//   - the one of its extension in Extensions;
+//   - the one of its extension according to mime.TypeByExtension;
+//   - the one detected from its first 512 bytes, using
+//     http.DetectContentType, unless NoSniff is true, in which case it is
+//     "application/octet-stream".
+type ContentTypes struct {
+	// Extensions maps lower case file extensions, such as ".md", to
+	// content types. The extensions of files are matched
+	// case-insensitively.
+	Extensions map[string]string
+	// NoSniff disables detecting the content type of files from their
+	// content, which requires opening and reading them.
+	NoSniff bool
+	// Overrides allows clients to override the content type of files by
+	// setting their DAV:getcontenttype property using PROPPATCH. It
+	// requires a PropStore.
+	Overrides bool
+}
+
+var contentTypePropName = xml.Name{Space: "DAV:", Local: "getcontenttype"}
+
+type contentTypesKey struct{}
+
+func withContentTypes(ctx context.Context, c *ContentTypes) context.Context {
+	return context.WithValue(ctx, contentTypesKey{}, c)
+}
+
+// contentTypes returns the ContentTypes of the Handler serving ctx.
+func contentTypes(ctx context.Context) *ContentTypes {
+	c, _ := ctx.Value(contentTypesKey{}).(*ContentTypes)
+	if c == nil {
+		return &ContentTypes{}
+	}
+	return c
+}
+
+// contentTypeOverrides reports whether the content type of files can be
+// overridden using PROPPATCH.
+func contentTypeOverrides(ctx context.Context) bool {
+	return contentTypes(ctx).Overrides
+}
+
+// knownContentType returns the content type of file name, unless it must be
+// detected from its content, in which case it returns "". It ignores the
+// overrides.
+func knownContentType(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+	if do, ok := fi.(ContentTyper); ok {
+		ctype, err := do.ContentType(ctx)
+		if err != ErrNotImplemented && (ctype != "" || err != nil) {
+			return ctype, err
+		}
+	}
+	c := contentTypes(ctx)
+	ext := path.Ext(name)
+	if ctype := c.Extensions[strings.ToLower(ext)]; ctype != "" {
+		return ctype, nil
+	}
+	if ctype := mime.TypeByExtension(ext); ctype != "" {
+		return ctype, nil
+	}
+	if c.NoSniff {
+		return "application/octet-stream", nil
+	}
+	return "", nil
+}
+
+// overriddenContentType returns the content type of file name set using
+// PROPPATCH, or "" if it has none.
+func overriddenContentType(ctx context.Context, ps PropStore, name string) (string, error) {
+	if ps == nil || !contentTypeOverrides(ctx) {
+		return "", nil
+	}
+	deadProps, err := ps.Get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	p, ok := deadProps[contentTypePropName]
+	if !ok {
+		return "", nil
+	}
+	ctype := strings.TrimSpace(string(p.InnerXML))
+	if _, _, err := mime.ParseMediaType(ctype); err != nil {
+		return "", nil
+	}
+	return ctype, nil
+}
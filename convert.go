@@ -0,0 +1,148 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Converter converts files to another format.
+type Converter interface {
+	// Convert writes to w the content of file name, read from f,
+	// converted to format. It returns ErrNotImplemented if the file
+	// cannot be converted to format.
+	Convert(ctx context.Context, name, format string, f File, w io.Writer) error
+}
+
+// ConverterFunc is an adapter to use a function as a Converter.
+type ConverterFunc func(ctx context.Context, name, format string, f File, w io.Writer) error
+
+// Convert calls c(ctx, name, format, f, w).
+func (c ConverterFunc) Convert(ctx context.Context, name, format string, f File, w io.Writer) error {
+	return c(ctx, name, format, f, w)
+}
+
+// Conversions serves files converted to other formats, requested by GET
+// with the convert query parameter, such as "/report.docx?convert=pdf", for
+// example to show previews. The results are cached in memory as virtual
+// resources: they are not part of the FileSystem, are not listed by
+// PROPFIND and are converted again when the file changes.
+//
+// A Conversions must not be copied after first use.
+type Conversions struct {
+	// Converters are the converters to each format, keyed by the value of
+	// the convert query parameter, such as "pdf". The Content-Type of the
+	// results is the one of the format as a file extension.
+	Converters map[string]Converter
+	// CacheSize is the maximum total size, in bytes, of the cached
+	// results. The default is 64 MiB.
+	CacheSize int64
+
+	mu     sync.Mutex
+	cache  map[conversionKey][]byte
+	cached int64
+}
+
+// conversionKey identifies the conversion of a version of a file.
+type conversionKey struct {
+	name    string
+	size    int64
+	modTime time.Time
+	format  string
+}
+
+// convert returns the content of file name, read from f, converted to
+// format, converting it unless it is cached.
+func (c *Conversions) convert(ctx context.Context, name, format string, f File, fi os.FileInfo) ([]byte, error) {
+	key := conversionKey{slashClean(name), fi.Size(), fi.ModTime(), format}
+	c.mu.Lock()
+	b, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+
+	converter, ok := c.Converters[format]
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	var buf bytes.Buffer
+	if err := converter.Convert(ctx, name, format, f, &buf); err != nil {
+		return nil, err
+	}
+	b = buf.Bytes()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size := c.CacheSize
+	if size <= 0 {
+		size = 64 << 20
+	}
+	if int64(len(b)) > size {
+		return b, nil
+	}
+	if c.cache == nil {
+		c.cache = make(map[conversionKey][]byte)
+	}
+	for k, v := range c.cache {
+		if c.cached+int64(len(b)) <= size {
+			break
+		}
+		delete(c.cache, k)
+		c.cached -= int64(len(v))
+	}
+	if _, ok := c.cache[key]; !ok {
+		c.cache[key] = b
+		c.cached += int64(len(b))
+	}
+	return b, nil
+}
+
+// serveConversion serves file reqPath, read from f, converted to the format
+// requested by the convert query parameter of r.
+func (h *Handler) serveConversion(w http.ResponseWriter, r *http.Request, reqPath string, f File, fi os.FileInfo) (status int, err error) {
+	ctx := r.Context()
+	format := strings.ToLower(r.URL.Query().Get("convert"))
+	if _, ok := h.Conversions.Converters[format]; !ok {
+		return http.StatusUnsupportedMediaType, errUnsupportedConversion
+	}
+	etag, err := fileETag(ctx, h.FileSystem, h.LockSystem, reqPath, f, fi)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	b, err := h.Conversions.convert(ctx, reqPath, format, f, fi)
+	if err == ErrNotImplemented {
+		return http.StatusUnsupportedMediaType, errUnsupportedConversion
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// The ETag of the result is derived from the one of the file, so that
+	// it changes with it but differs from it.
+	w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+format+`"`)
+	if ctype := mime.TypeByExtension("." + format); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	http.ServeContent(w, h.limitRanges(r), reqPath+"."+format, fi.ModTime(), bytes.NewReader(b))
+	return 0, nil
+}
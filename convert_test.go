@@ -0,0 +1,135 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConversions(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /a", "write /a/doc.txt hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		Conversions: &Conversions{
+			Converters: map[string]Converter{
+				"html": ConverterFunc(func(ctx context.Context, name, format string, f File, w io.Writer) error {
+					calls++
+					if !strings.HasSuffix(name, ".txt") {
+						return ErrNotImplemented
+					}
+					b, err := io.ReadAll(f)
+					if err != nil {
+						return err
+					}
+					_, err = io.WriteString(w, "<p>"+string(b)+"</p>")
+					return err
+				}),
+			},
+		},
+	}
+	do := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader("")))
+		return w
+	}
+
+	w := do("GET", "/a/doc.txt?convert=html")
+	if w.Code != http.StatusOK || w.Body.String() != "<p>hello</p>" {
+		t.Fatalf("GET converted: got %d %q, want %d %q", w.Code, w.Body.String(), http.StatusOK, "<p>hello</p>")
+	}
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("Content-Type: got %q, want text/html", got)
+	}
+	etag := w.Header().Get("ETag")
+	if orig := do("GET", "/a/doc.txt"); orig.Body.String() != "hello" || orig.Header().Get("ETag") == etag {
+		t.Errorf("GET original: got %q, ETag %s, want %q and an ETag other than %s", orig.Body.String(), orig.Header().Get("ETag"), "hello", etag)
+	}
+
+	// The result is cached until the file changes.
+	if w := do("HEAD", "/a/doc.txt?convert=html"); w.Code != http.StatusOK || w.Header().Get("ETag") != etag {
+		t.Errorf("HEAD converted: got %d, ETag %s, want %d, ETag %s", w.Code, w.Header().Get("ETag"), http.StatusOK, etag)
+	}
+	if calls != 1 {
+		t.Errorf("cached conversion: got %d calls, want 1", calls)
+	}
+	r := httptest.NewRequest("PUT", "/a/doc.txt", strings.NewReader("bye"))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if w := do("GET", "/a/doc.txt?convert=html"); w.Body.String() != "<p>bye</p>" || calls != 2 {
+		t.Errorf("GET modified: got %q after %d calls, want %q after 2 calls", w.Body.String(), calls, "<p>bye</p>")
+	}
+
+	testCases := []struct {
+		desc, target string
+		want         int
+	}{
+		{"unknown format", "/a/doc.txt?convert=pdf", http.StatusUnsupportedMediaType},
+		{"unsupported file", "/a/other.bin?convert=html", http.StatusNotFound},
+		{"collection", "/a?convert=html", http.StatusMethodNotAllowed},
+	}
+	for _, tc := range testCases {
+		if w := do("GET", tc.target); w.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.want)
+		}
+	}
+	if _, err := fs.OpenFile(context.Background(), "/a/doc.bin", os.O_RDWR|os.O_CREATE, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if w := do("GET", "/a/doc.bin?convert=html"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("unconvertible file: got status %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestConversionsCacheSize(t *testing.T) {
+	c := &Conversions{
+		CacheSize: 10,
+		Converters: map[string]Converter{
+			"x": ConverterFunc(func(ctx context.Context, name, format string, f File, w io.Writer) error {
+				_, err := io.WriteString(w, name)
+				return err
+			}),
+		},
+	}
+	fs, err := buildTestFS([]string{"write /aaaa x", "write /bbbb x", "write /cccccccccccc x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, name := range []string{"/aaaa", "/bbbb", "/cccccccccccc"} {
+		fi, err := fs.Stat(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.convert(ctx, name, "x", nil, fi); err != nil {
+			t.Fatalf("convert %s: %v", name, err)
+		}
+		if c.cached > c.CacheSize {
+			t.Errorf("convert %s: cached %d bytes, want at most %d", name, c.cached, c.CacheSize)
+		}
+	}
+	if len(c.cache) != 2 {
+		t.Errorf("got %d cached results, want 2", len(c.cache))
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DirDefaults are the defaults applied to the files and collections created
+// below a collection, for example the tags of a department or a retention
+// category. They are applied by PUT, MKCOL and LOCK requests creating
+// resources, before responding: if they cannot be applied, the new resource
+// is removed and the request fails.
+type DirDefaults struct {
+	// Path is the slash-separated name of the collection, such as "/hr".
+	// The defaults apply to the resources created at any depth below it.
+	// If several DirDefaults apply, the ones of the innermost collections
+	// take precedence.
+	Path string
+	// Props are the dead properties set on the new resources. They require
+	// a PropStore, or a FileSystem whose files implement DeadPropsHolder.
+	Props []Property
+	// Templates maps lower case file extensions, such as ".docx", to the
+	// initial content of the new files created empty, by a PUT request
+	// without body or by a LOCK request.
+	Templates map[string][]byte
+}
+
+// dirDefaults returns the dead properties and the template to apply to the
+// resource name, created by the current request.
+func (h *Handler) dirDefaults(name string, isDir bool) (props []Property, template []byte) {
+	name = slashClean(name)
+	var defaults []DirDefaults
+	for _, d := range h.DirDefaults {
+		if root := slashClean(d.Path); name != root && isWithin(name, root) {
+			defaults = append(defaults, d)
+		}
+	}
+	// Apply the outermost defaults first.
+	sort.SliceStable(defaults, func(i, j int) bool {
+		return len(slashClean(defaults[i].Path)) < len(slashClean(defaults[j].Path))
+	})
+	index := make(map[xml.Name]int)
+	ext := strings.ToLower(path.Ext(name))
+	for _, d := range defaults {
+		for _, p := range d.Props {
+			if i, ok := index[p.XMLName]; ok {
+				props[i] = p
+				continue
+			}
+			index[p.XMLName] = len(props)
+			props = append(props, p)
+		}
+		if t, ok := d.Templates[ext]; ok && !isDir {
+			template = t
+		}
+	}
+	return props, template
+}
+
+// applyDirDefaults applies the DirDefaults to the resource name, just
+// created by the current request. empty reports whether the new resource is
+// an empty file. If they cannot be applied, the resource is removed.
+func (h *Handler) applyDirDefaults(ctx context.Context, name string, isDir, empty bool) (status int, err error) {
+	props, template := h.dirDefaults(name, isDir)
+	defer func() {
+		if err != nil {
+			h.FileSystem.RemoveAll(ctx, name)
+		}
+	}()
+	if template != nil && empty {
+		f, err := h.FileSystem.OpenFile(ctx, name, os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		_, err = f.Write(template)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if len(props) == 0 {
+		return 0, nil
+	}
+	pstats, err := patchDead(ctx, h.FileSystem, h.PropStore, name, []Proppatch{{Props: props}})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	for _, pstat := range pstats {
+		if pstat.Status != http.StatusOK {
+			return http.StatusInternalServerError, errDirDefaults
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDirDefaults(t *testing.T) {
+	dept := xml.Name{Space: "urn:x", Local: "dept"}
+	retention := xml.Name{Space: "urn:x", Local: "retention"}
+	prop := func(pn xml.Name, v string) Property {
+		return Property{XMLName: pn, InnerXML: []byte(v)}
+	}
+	defaults := []DirDefaults{{
+		Path:  "/hr/legal",
+		Props: []Property{prop(dept, "Legal"), prop(retention, "7y")},
+	}, {
+		Path:      "/hr",
+		Props:     []Property{prop(dept, "HR")},
+		Templates: map[string][]byte{".txt": []byte("template")},
+	}}
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "hr", "legal"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		FileSystem:  Dir(root),
+		LockSystem:  NewMemLS(),
+		PropStore:   NewMemPropStore(),
+		DirDefaults: defaults,
+	}
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc        string
+		method      string
+		path        string
+		body        string
+		wantProps   []Property
+		wantContent string
+	}{
+		{"mkcol", "MKCOL", "/hr/legal/cases", "", []Property{prop(dept, "Legal"), prop(retention, "7y")}, ""},
+		{"empty put", "PUT", "/hr/a.txt", "", []Property{prop(dept, "HR")}, "template"},
+		{"put", "PUT", "/hr/b.txt", "data", []Property{prop(dept, "HR")}, "data"},
+		{"lock", "LOCK", "/hr/c.txt", createLockBody, []Property{prop(dept, "HR")}, "template"},
+		{"nested put", "PUT", "/hr/legal/d.bin", "", []Property{prop(dept, "Legal"), prop(retention, "7y")}, ""},
+		{"outside", "PUT", "/e.txt", "", nil, ""},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if w.Code >= 300 {
+			t.Fatalf("%s: got status %d", tc.desc, w.Code)
+		}
+		props, err := h.PropStore.Get(ctx, tc.path)
+		if err != nil {
+			t.Fatalf("%s: get props: %v", tc.desc, err)
+		}
+		var got []Property
+		for _, p := range tc.wantProps {
+			got = append(got, props[p.XMLName])
+		}
+		if len(props) != len(tc.wantProps) || !reflect.DeepEqual(got, tc.wantProps) {
+			t.Errorf("%s: got props %v, want %v", tc.desc, props, tc.wantProps)
+		}
+		if tc.method == "MKCOL" {
+			continue
+		}
+		f, err := h.FileSystem.OpenFile(ctx, tc.path, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("%s: open: %v", tc.desc, err)
+		}
+		content, _ := io.ReadAll(f)
+		f.Close()
+		if string(content) != tc.wantContent {
+			t.Errorf("%s: got content %q, want %q", tc.desc, content, tc.wantContent)
+		}
+	}
+
+	// Without a PropStore, the properties cannot be set, and the new
+	// resources are removed.
+	h.PropStore = nil
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/hr/f.txt", strings.NewReader("data")))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("put without PropStore: got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if _, err := h.FileSystem.Stat(ctx, "/hr/f.txt"); !os.IsNotExist(err) {
+		t.Errorf("put without PropStore: got %v, want the file removed", err)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	ixml "github.com/drakkan/webdav/internal/xml"
+)
+
+var listingDiffReportName = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "listing-diff"}
+
+// ListingDiff is the difference between the listings of a collection at two
+// points in time. A resource created and then modified is only added, and a
+// resource created and then removed is not reported.
+type ListingDiff struct {
+	// From and To are the sync tokens of the two points in time.
+	From, To string
+	// Added are the names of the members created after From.
+	Added []string
+	// Modified are the names of the members existing at From and modified,
+	// or replaced, after it.
+	Modified []string
+	// Removed are the names of the members existing at From and removed,
+	// or renamed, after it.
+	Removed []string
+}
+
+// DiffFS is an optional interface for a SyncTokenFS, computing the changes
+// of a collection between two of its sync tokens from its journal, so that
+// embedders can replicate a tree, or notify its changes, without walking
+// it. The FileSystems returned by NewSyncFS implement it.
+//
+// A Handler serving a DiffFS supports the listing-diff REPORT, in the
+// "https://github.com/drakkan/webdav" namespace.
+type DiffFS interface {
+	SyncTokenFS
+	// Diff returns the changes of the members of collection name between
+	// the sync tokens from and to, or the current state if to is empty.
+	// depth is 1 for the immediate members or -1 for all of them. It
+	// returns ErrInvalidSyncToken if a token is unknown or too old, or if
+	// to is older than from.
+	Diff(ctx context.Context, name, from, to string, depth int) (*ListingDiff, error)
+	// SyncTokenAt returns the sync token of collection name at time t. It
+	// returns ErrInvalidSyncToken if the journal does not go back to t.
+	SyncTokenAt(ctx context.Context, name string, t time.Time) (string, error)
+}
+
+// DiffTimes returns the changes of the members of collection name between
+// the times from and to, using the journal of fs. depth is as for
+// DiffFS.Diff. It returns ErrNotImplemented if fs does not implement
+// DiffFS.
+func DiffTimes(ctx context.Context, fs FileSystem, name string, from, to time.Time, depth int) (*ListingDiff, error) {
+	dfs, ok := fs.(DiffFS)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	fromToken, err := dfs.SyncTokenAt(ctx, name, from)
+	if err != nil {
+		return nil, err
+	}
+	toToken, err := dfs.SyncTokenAt(ctx, name, to)
+	if err != nil {
+		return nil, err
+	}
+	return dfs.Diff(ctx, name, fromToken, toToken, depth)
+}
+
+// listingDiff is the body of a listing-diff REPORT. The starting point is
+// either a sync token or a RFC 3339 time, and so is the optional end point.
+type listingDiff struct {
+	XMLName ixml.Name `xml:"https://github.com/drakkan/webdav listing-diff"`
+	From    string    `xml:"https://github.com/drakkan/webdav from"`
+	To      string    `xml:"https://github.com/drakkan/webdav to"`
+	Since   string    `xml:"https://github.com/drakkan/webdav since"`
+	Until   string    `xml:"https://github.com/drakkan/webdav until"`
+}
+
+// syncTokenAt returns the sync token of collection name for the token or
+// the time of a listing-diff REPORT, or "" if both are empty.
+func syncTokenAt(ctx context.Context, fs DiffFS, name, token, t string) (string, error) {
+	if token != "" || t == "" {
+		return token, nil
+	}
+	tm, err := time.Parse(time.RFC3339, t)
+	if err != nil {
+		return "", ErrInvalidReport
+	}
+	return fs.SyncTokenAt(ctx, name, tm)
+}
+
+// listingDiffReport serves the listing-diff REPORT, whose response lists
+// the hrefs of the members added, modified and removed between two sync
+// tokens or times. The Depth header is infinity for all the members of the
+// collection, the immediate members are reported otherwise.
+func (h *Handler) listingDiffReport(ctx context.Context, w http.ResponseWriter, r *http.Request, report Report) error {
+	dfs, ok := h.FileSystem.(DiffFS)
+	if !ok {
+		return os.ErrPermission
+	}
+	var ld listingDiff
+	if err := ixml.NewDecoder(bytes.NewReader(report.Body)).Decode(&ld); err != nil {
+		return ErrInvalidReport
+	}
+	depth := 1
+	if report.Depth == infiniteDepth {
+		depth = infiniteDepth
+	}
+	fi, err := h.FileSystem.Stat(ctx, report.Name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return ErrInvalidReport
+	}
+	from, err := syncTokenAt(ctx, dfs, report.Name, strings.TrimSpace(ld.From), strings.TrimSpace(ld.Since))
+	if err == nil && from == "" {
+		err = ErrInvalidReport
+	}
+	var to string
+	if err == nil {
+		to, err = syncTokenAt(ctx, dfs, report.Name, strings.TrimSpace(ld.To), strings.TrimSpace(ld.Until))
+	}
+	var diff *ListingDiff
+	if err == nil {
+		diff, err = dfs.Diff(ctx, report.Name, from, to, depth)
+	}
+	if errors.Is(err, ErrInvalidSyncToken) {
+		writeXMLError(w, http.StatusForbidden, "valid-sync-token")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	buf.WriteString(`<W:listing-diff xmlns:D="DAV:" xmlns:W="https://github.com/drakkan/webdav">`)
+	fmt.Fprintf(&buf, "<W:from>%s</W:from><W:to>%s</W:to>", escapeXML(diff.From), escapeXML(diff.To))
+	for _, l := range []struct {
+		elem  string
+		names []string
+	}{{"added", diff.Added}, {"modified", diff.Modified}, {"removed", diff.Removed}} {
+		for _, name := range l.names {
+			href := hrefPath(path.Join(h.Prefix, name))
+			fmt.Fprintf(&buf, "<W:%s><D:href>%s</D:href></W:%s>", l.elem, escapeXML(href), l.elem)
+		}
+	}
+	buf.WriteString(`</W:listing-diff>`)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
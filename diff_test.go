@@ -0,0 +1,134 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListingDiff(t *testing.T) {
+	mem, err := buildTestFS([]string{
+		"mkdir /dir",
+		"write /dir/a 1",
+		"write /dir/b 2",
+		"mkdir /dir/sub",
+	})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	sfs := NewSyncFS(mem)
+	fs := sfs.(DiffFS)
+	h := &Handler{
+		FileSystem: sfs,
+		LockSystem: NewMemLS(),
+	}
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	ctx := context.Background()
+	start := time.Now()
+	token0, err := fs.SyncToken(ctx, "/dir")
+	if err != nil {
+		t.Fatalf("SyncToken: %v", err)
+	}
+	do("PUT", "/dir/a", "new")
+	do("DELETE", "/dir/b", "")
+	do("PUT", "/dir/sub/c", "3")
+	do("PUT", "/dir/tmp", "4")
+	do("DELETE", "/dir/tmp", "")
+	token1, err := fs.SyncToken(ctx, "/dir")
+	if err != nil {
+		t.Fatalf("SyncToken: %v", err)
+	}
+	do("PUT", "/dir/d", "5")
+
+	testCases := []struct {
+		desc, from, to string
+		depth          int
+		want           *ListingDiff
+	}{{
+		"depth 1",
+		token0, token1, 1,
+		&ListingDiff{From: token0, To: token1, Modified: []string{"/dir/a"}, Removed: []string{"/dir/b"}},
+	}, {
+		"depth infinity",
+		token0, token1, infiniteDepth,
+		&ListingDiff{From: token0, To: token1, Added: []string{"/dir/sub/c"}, Modified: []string{"/dir/a"}, Removed: []string{"/dir/b"}},
+	}, {
+		"up to now",
+		token1, "", 1,
+		&ListingDiff{From: token1, Added: []string{"/dir/d"}},
+	}}
+	for _, tc := range testCases {
+		got, err := fs.Diff(ctx, "/dir", tc.from, tc.to, tc.depth)
+		if err != nil {
+			t.Errorf("%s: Diff: %v", tc.desc, err)
+			continue
+		}
+		if tc.want.To == "" {
+			tc.want.To = got.To
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.desc, got, tc.want)
+		}
+	}
+	if _, err := fs.Diff(ctx, "/dir", token1, token0, 1); err != ErrInvalidSyncToken {
+		t.Errorf("reversed tokens: got %v, want %v", err, ErrInvalidSyncToken)
+	}
+	if _, err := fs.SyncTokenAt(ctx, "/dir", start.Add(-time.Hour)); err != ErrInvalidSyncToken {
+		t.Errorf("SyncTokenAt before the journal: got %v, want %v", err, ErrInvalidSyncToken)
+	}
+	diff, err := DiffTimes(ctx, sfs, "/dir", start, time.Now(), 1)
+	if err != nil {
+		t.Fatalf("DiffTimes: %v", err)
+	}
+	if diff.From != token0 || len(diff.Added) != 1 || len(diff.Modified) != 1 || len(diff.Removed) != 1 {
+		t.Errorf("DiffTimes: got %+v, want the changes since %s", diff, token0)
+	}
+
+	w := do("REPORT", "/dir", `<W:listing-diff xmlns:W="https://github.com/drakkan/webdav"><W:since>`+
+		start.Format(time.RFC3339Nano)+`</W:since></W:listing-diff>`, "Depth", "infinity")
+	for _, want := range []string{
+		"<W:from>" + token0 + "</W:from>",
+		"<W:added><D:href>/dir/sub/c</D:href></W:added>",
+		"<W:added><D:href>/dir/d</D:href></W:added>",
+		"<W:modified><D:href>/dir/a</D:href></W:modified>",
+		"<W:removed><D:href>/dir/b</D:href></W:removed>",
+	} {
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("REPORT: got %d %s, want %d and %s", w.Code, w.Body.String(), http.StatusOK, want)
+		}
+	}
+	w = do("REPORT", "/dir", `<W:listing-diff xmlns:W="https://github.com/drakkan/webdav"><W:from>urn:unknown</W:from></W:listing-diff>`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "<D:valid-sync-token/>") {
+		t.Errorf("REPORT with an invalid token: got %d %s, want %d and valid-sync-token", w.Code, w.Body.String(), http.StatusForbidden)
+	}
+	w = do("PROPFIND", "/dir", `<D:propfind xmlns:D="DAV:"><D:prop><D:supported-report-set/></D:prop></D:propfind>`, "Depth", "0")
+	if !strings.Contains(w.Body.String(), "listing-diff") {
+		t.Errorf("supported-report-set: got %s, want listing-diff", w.Body.String())
+	}
+}
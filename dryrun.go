@@ -0,0 +1,65 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path"
+)
+
+// dryRunHeader is the vendor request header making DELETE, COPY and MOVE
+// requests evaluate their preconditions without changing anything. Its value
+// must be "T". The response has the status the request would have had, and
+// echoes the header.
+const dryRunHeader = "X-Dry-Run"
+
+func isDryRun(r *http.Request) bool {
+	return r.Header.Get(dryRunHeader) == "T"
+}
+
+// dryRun returns the status of a DELETE of src, if dst is empty, or of a COPY
+// or MOVE of src to dst, without performing it. The locks, the tree limits
+// and the other policies of the request must already have been checked.
+func (h *Handler) dryRun(ctx context.Context, w http.ResponseWriter, src, dst string, overwrite bool) (int, error) {
+	w.Header().Set(dryRunHeader, "T")
+	if _, err := h.FileSystem.Stat(ctx, src); err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		} else if os.IsPermission(err) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	if dst == "" {
+		return http.StatusNoContent, nil
+	}
+	if _, err := h.FileSystem.Stat(ctx, dst); err == nil {
+		if !overwrite {
+			return http.StatusPreconditionFailed, os.ErrExist
+		}
+		return http.StatusNoContent, nil
+	} else if !os.IsNotExist(err) {
+		return http.StatusForbidden, err
+	}
+	// Section 9.8.5 says that "409 (Conflict) - A resource cannot be created
+	// at the destination until one or more intermediate collections have
+	// been created."
+	if fi, err := h.FileSystem.Stat(ctx, path.Dir(dst)); err != nil || !fi.IsDir() {
+		return http.StatusConflict, errNotADirectory
+	}
+	return http.StatusCreated, nil
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		method      string
+		path        string
+		destination string
+		overwrite   string
+		wantStatus  int
+	}{
+		{"delete", "DELETE", "/a", "", "", http.StatusNoContent},
+		{"delete missing", "DELETE", "/missing", "", "", http.StatusNotFound},
+		{"delete locked", "DELETE", "/locked", "", "", http.StatusLocked},
+		{"copy", "COPY", "/a", "/c", "", http.StatusCreated},
+		{"copy over", "COPY", "/a", "/b", "", http.StatusNoContent},
+		{"copy without overwrite", "COPY", "/a", "/b", "F", http.StatusPreconditionFailed},
+		{"move", "MOVE", "/a", "/c", "", http.StatusCreated},
+		{"move to missing parent", "MOVE", "/a", "/x/y", "", http.StatusConflict},
+		{"move over locked", "MOVE", "/a", "/locked", "T", http.StatusLocked},
+	}
+	for _, tc := range testCases {
+		fs, err := buildTestFS([]string{
+			"mkdir /a",
+			"write /a/f content",
+			"mkdir /b",
+			"touch /locked",
+		})
+		if err != nil {
+			t.Fatalf("%s: cannot create test filesystem: %v", tc.desc, err)
+		}
+		h := &Handler{
+			FileSystem: fs,
+			LockSystem: NewMemLS(),
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("LOCK", "/locked", strings.NewReader(createLockBody)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: lock: got status %d, want %d", tc.desc, w.Code, http.StatusOK)
+		}
+
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		r.Header.Set("X-Dry-Run", "T")
+		if tc.destination != "" {
+			r.Header.Set("Destination", tc.destination)
+		}
+		if tc.overwrite != "" {
+			r.Header.Set("Overwrite", tc.overwrite)
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+		}
+		if got := w.Header().Get("X-Dry-Run"); tc.wantStatus < 300 && got != "T" {
+			t.Errorf("%s: got X-Dry-Run %q, want %q", tc.desc, got, "T")
+		}
+		for _, name := range []string{"/a", "/a/f", "/b", "/locked"} {
+			if _, err := fs.Stat(context.Background(), name); err != nil {
+				t.Errorf("%s: %s: got %v, want it unchanged", tc.desc, name, err)
+			}
+		}
+		if _, err := fs.Stat(context.Background(), "/c"); err == nil {
+			t.Errorf("%s: got /c created, want it not to exist", tc.desc)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+)
+
+// Durability is the guarantee a DurableDir gives about the writes it
+// acknowledges surviving a power failure.
+type Durability int
+
+const (
+	// DurabilityNone leaves flushing the writes to the operating system.
+	DurabilityNone Durability = iota
+	// DurabilitySyncFile syncs the content of written files, and created
+	// directories, before acknowledging them.
+	DurabilitySyncFile
+	// DurabilitySyncDir also syncs the parent directories of created,
+	// renamed and moved resources, so that their names are durable too.
+	DurabilitySyncDir
+)
+
+// DurabilityRule applies a Durability to the resources whose slash-separated
+// name, such as "/db/journal", matches Pattern, using path.Match syntax.
+type DurabilityRule struct {
+	Pattern    string
+	Durability Durability
+}
+
+// A DurableDir is a Dir that syncs the writes of PUT, MKCOL, COPY and MOVE
+// requests, and of resumable uploads, to stable storage before they are
+// acknowledged, according to their Durability.
+//
+// The Durability of a resource is the one of the first of Rules matching its
+// name, or Default. Directories are not synced on Windows.
+type DurableDir struct {
+	Dir
+	Default Durability
+	Rules   []DurabilityRule
+}
+
+// durability returns the Durability of resource name.
+func (d DurableDir) durability(name string) Durability {
+	name = slashClean(name)
+	if target, ok := uploadTarget(name); ok {
+		// The temporary file of an upload is durable as its target.
+		name = target
+	}
+	for _, r := range d.Rules {
+		if ok, _ := path.Match(r.Pattern, name); ok {
+			return r.Durability
+		}
+	}
+	return d.Default
+}
+
+func (d DurableDir) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := d.Dir.Mkdir(ctx, name, perm); err != nil {
+		return err
+	}
+	switch d.durability(name) {
+	case DurabilitySyncDir:
+		if err := syncDir(filepath.Dir(d.resolve(name))); err != nil {
+			return err
+		}
+		fallthrough
+	case DurabilitySyncFile:
+		return syncDir(d.resolve(name))
+	}
+	return nil
+}
+
+func (d DurableDir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	f, err := d.Dir.OpenFile(ctx, name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	durability := d.durability(name)
+	if durability == DurabilityNone {
+		return f, nil
+	}
+	df, ok := f.(dirFile)
+	if !ok {
+		return f, nil
+	}
+	return durableFile{
+		dirFile:    df,
+		durability: durability,
+		created:    flag&os.O_CREATE != 0,
+	}, nil
+}
+
+// Append implements AppendFS. The appended content is synced like the one
+// of the files written through OpenFile.
+func (d DurableDir) Append(ctx context.Context, name string, offset int64, r io.Reader) (int64, error) {
+	f, err := d.OpenFile(ctx, name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
+	n, err := appendFile(f, offset, r)
+	if err == nil && d.durability(name) == DurabilitySyncDir {
+		err = syncDir(filepath.Dir(d.resolve(name)))
+	}
+	return n, err
+}
+
+func (d DurableDir) Rename(ctx context.Context, oldName, newName string) error {
+	if err := d.Dir.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	if d.durability(newName) != DurabilitySyncDir {
+		// The content of the resource is unchanged by a rename.
+		return nil
+	}
+	oldDir, newDir := filepath.Dir(d.resolve(oldName)), filepath.Dir(d.resolve(newName))
+	if err := syncDir(newDir); err != nil {
+		return err
+	}
+	if oldDir != newDir {
+		return syncDir(oldDir)
+	}
+	return nil
+}
+
+// durableFile is a file of a DurableDir open for writing, synced when
+// closed.
+type durableFile struct {
+	dirFile
+	durability Durability
+	// created reports whether the file was opened with O_CREATE, so that
+	// its name may need to be synced.
+	created bool
+}
+
+func (f durableFile) Close() error {
+	err := f.File.Sync()
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && f.created && f.durability == DurabilitySyncDir {
+		err = syncDir(filepath.Dir(f.File.Name()))
+	}
+	return err
+}
+
+// syncDir syncs the directory dir of the native file system.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
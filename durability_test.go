@@ -0,0 +1,130 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDurableDir(t *testing.T) {
+	root := t.TempDir()
+	fs := DurableDir{
+		Dir:     Dir(root),
+		Default: DurabilitySyncFile,
+		Rules: []DurabilityRule{
+			{Pattern: "/tmp/*", Durability: DurabilityNone},
+			{Pattern: "/db/*", Durability: DurabilitySyncDir},
+		},
+	}
+	for name, want := range map[string]Durability{
+		"/file":        DurabilitySyncFile,
+		"/tmp/scratch": DurabilityNone,
+		"/db/journal":  DurabilitySyncDir,
+		"/db/":         DurabilitySyncFile,
+	} {
+		if got := fs.durability(name); got != want {
+			t.Errorf("durability of %s: got %d, want %d", name, got, want)
+		}
+	}
+
+	ctx := context.Background()
+	if err := fs.Mkdir(ctx, "/tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile(ctx, "/tmp/scratch", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(durableFile); ok {
+		t.Errorf("open file without durability: got a synced file")
+	}
+	f.Close()
+
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	}
+	for _, r := range []*http.Request{
+		httptest.NewRequest("MKCOL", "/db", nil),
+		httptest.NewRequest("PUT", "/db/journal.tmp", strings.NewReader("entry")),
+		httptest.NewRequest("MOVE", "/db/journal.tmp", nil),
+	} {
+		if r.Method == "MOVE" {
+			r.Header.Set("Destination", "/db/journal")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s %s: got status %d, want %d", r.Method, r.URL.Path, w.Code, http.StatusCreated)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(root, "db", "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "entry" {
+		t.Errorf("got content %q, want %q", b, "entry")
+	}
+}
+
+func TestDurableDirResumableUpload(t *testing.T) {
+	root := t.TempDir()
+	h := &Handler{
+		FileSystem:       DurableDir{Dir: Dir(root), Default: DurabilitySyncDir},
+		LockSystem:       NewMemLS(),
+		ResumableUploads: &ResumableUploads{},
+	}
+	if _, ok := h.FileSystem.(AppendFS); !ok {
+		t.Fatal("DurableDir: got a FileSystem without Append")
+	}
+	do := func(method, target, body string, hdrs ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Tus-Resumable", "1.0.0")
+		r.Header.Set("Content-Type", "application/offset+octet-stream")
+		for i := 0; i < len(hdrs); i += 2 {
+			r.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("f.txt"))
+	if w := do("POST", "/", "", "Upload-Length", "11", "Upload-Metadata", metadata); w.Code != http.StatusCreated {
+		t.Fatalf("POST: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := do("PATCH", "/f.txt", "hello", "Upload-Offset", "0"); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := do("PATCH", "/f.txt", "hello", "Upload-Offset", "0"); w.Code != http.StatusConflict {
+		t.Fatalf("PATCH at a wrong offset: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := do("PATCH", "/f.txt", " world", "Upload-Offset", "5"); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	b, err := os.ReadFile(filepath.Join(root, "f.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello world" {
+		t.Errorf("got content %q, want %q", b, "hello world")
+	}
+}
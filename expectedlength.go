@@ -0,0 +1,67 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+// expectedLength returns the size of the body of the PUT request r
+// announced by the client, or -1. Clients sending chunked bodies announce
+// it with the OC-Total-Length header, used by the ownCloud and Nextcloud
+// clients, or the X-Expected-Entity-Length header, used by the macOS
+// Finder.
+func expectedLength(r *http.Request) (int64, error) {
+	s := r.Header.Get("OC-Total-Length")
+	if s == "" {
+		s = r.Header.Get("X-Expected-Entity-Length")
+	}
+	if s == "" {
+		return -1, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || r.ContentLength >= 0 && r.ContentLength != n {
+		return -1, errInvalidExpectedLength
+	}
+	return n, nil
+}
+
+// checkQuota returns "507 Insufficient Storage" if the quota of the
+// collection of file name has not enough space left to write n bytes,
+// before the body is transferred. The space used by name, if it exists, is
+// considered available since it is overwritten.
+func (h *Handler) checkQuota(ctx context.Context, name string, n int64) (status int, err error) {
+	qfs, ok := h.FileSystem.(QuotaFS)
+	if !ok {
+		return 0, nil
+	}
+	_, available, err := qfs.Quota(ctx, path.Dir(name))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if available < 0 {
+		return 0, nil
+	}
+	if fi, err := h.FileSystem.Stat(ctx, name); err == nil && !fi.IsDir() {
+		available += fi.Size()
+	}
+	if n > available {
+		return StatusInsufficientStorage, errQuotaExceeded
+	}
+	return 0, nil
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExpectedLength(t *testing.T) {
+	mem, err := buildTestFS([]string{"write /big 0123456789"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: quotaFS{mem, 10},
+		LockSystem: NewMemLS(),
+	}
+	testCases := []struct {
+		desc, target, body, header, value string
+		chunked                           bool
+		wantStatus                        int
+	}{
+		{"complete", "/a", "hello", "OC-Total-Length", "5", true, http.StatusCreated},
+		{"truncated", "/b", "hel", "OC-Total-Length", "5", true, http.StatusBadRequest},
+		{"longer", "/b", "hello!", "X-Expected-Entity-Length", "5", true, http.StatusBadRequest},
+		{"complete Finder upload", "/c", "hello", "X-Expected-Entity-Length", "5", true, http.StatusCreated},
+		{"invalid", "/b", "hello", "OC-Total-Length", "five", true, http.StatusBadRequest},
+		{"Content-Length mismatch", "/b", "hello", "OC-Total-Length", "4", false, http.StatusBadRequest},
+		{"over quota", "/b", "hello", "OC-Total-Length", "11", true, StatusInsufficientStorage},
+		{"overwrite within quota", "/big", "01234567890123456789", "OC-Total-Length", "20", true, http.StatusCreated},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest("PUT", tc.target, strings.NewReader(tc.body))
+		if tc.chunked {
+			r.ContentLength = -1
+		}
+		r.Header.Set(tc.header, tc.value)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+		}
+	}
+	for name, want := range map[string]bool{"/a": true, "/b": false, "/c": true} {
+		if _, err := mem.Stat(context.Background(), name); (err == nil) != want {
+			t.Errorf("%s: got stored %t, want %t", name, err == nil, want)
+		}
+	}
+}
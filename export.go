@@ -0,0 +1,242 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// exportPropsRecord is the PAX record holding the dead properties of the
+// entries of the archives written by Export.
+const exportPropsRecord = "WEBDAV.props"
+
+// Export writes the subtree rooted at root of fs to w as a tar archive,
+// including the content of the files and their dead properties, stored in
+// ps if it is non-nil or held by the files if they implement DeadPropsHolder
+// otherwise.
+// The archive can be restored to any FileSystem using Import, for example
+// to migrate from a Dir to an object storage backend without losing the
+// WebDAV metadata.
+//
+// The entry names are relative to root, that is the "." entry. The dead
+// properties are stored in the "WEBDAV.props" PAX record, so that the
+// archive can also be read by standard tools. File systems storing their
+// properties as files, such as the sidecar PropStore, should be wrapped,
+// for example using HideSidecars, to not export them as content.
+func Export(ctx context.Context, w io.Writer, fs FileSystem, ps PropStore, root string) error {
+	root = slashClean(root)
+	fi, err := fs.Stat(ctx, root)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	err = walkFS(ctx, fs, infiniteDepth, root, fi, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return exportEntry(ctx, tw, fs, ps, root, name, info)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func exportEntry(ctx context.Context, tw *tar.Writer, fs FileSystem, ps PropStore, root, name string, fi os.FileInfo) error {
+	rel := "."
+	if name != root {
+		rel = strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+	}
+	hdr := &tar.Header{
+		Name:    rel,
+		Mode:    int64(fi.Mode().Perm()),
+		ModTime: fi.ModTime(),
+		Format:  tar.FormatPAX,
+	}
+	if fi.IsDir() {
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	} else {
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = fi.Size()
+	}
+
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	props, err := deadPropsOf(ctx, f, ps, name)
+	if err != nil {
+		return err
+	}
+	if len(props) > 0 {
+		data, err := encodeProps(props)
+		if err != nil {
+			return err
+		}
+		hdr.PAXRecords = map[string]string{exportPropsRecord: string(data)}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return nil
+	}
+	n, err := io.Copy(tw, f)
+	if err != nil {
+		return err
+	}
+	if n != fi.Size() {
+		return fmt.Errorf("webdav: %s changed while being exported", name)
+	}
+	return nil
+}
+
+// Import restores the archive written by Export, read from r, to the
+// subtree rooted at root of fs, that must be an existing collection.
+// Existing files are replaced. The dead properties are stored in ps if it is
+// non-nil, or patched into the files if they implement DeadPropsHolder
+// otherwise.
+//
+// The modification times are not restored, since the FileSystem interface
+// can't set them.
+func Import(ctx context.Context, r io.Reader, fs FileSystem, ps PropStore, root string) error {
+	root = slashClean(root)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel := path.Clean(hdr.Name)
+		if path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("webdav: invalid archive entry %q", hdr.Name)
+		}
+		name := path.Join(root, rel)
+		if err := importEntry(ctx, tr, fs, ps, name, hdr); err != nil {
+			return err
+		}
+	}
+}
+
+func importEntry(ctx context.Context, tr *tar.Reader, fs FileSystem, ps PropStore, name string, hdr *tar.Header) error {
+	perm := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if fi, err := fs.Stat(ctx, name); err == nil && fi.IsDir() {
+			break
+		}
+		if err := fs.Mkdir(ctx, name, perm); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		_, copyErr := io.Copy(f, tr)
+		if closeErr := f.Close(); copyErr == nil {
+			copyErr = closeErr
+		}
+		if copyErr != nil {
+			return copyErr
+		}
+	default:
+		return fmt.Errorf("webdav: unsupported archive entry %q", hdr.Name)
+	}
+
+	var props map[xml.Name]Property
+	if data, ok := hdr.PAXRecords[exportPropsRecord]; ok {
+		var err error
+		if props, err = decodeProps([]byte(data)); err != nil {
+			return err
+		}
+	}
+	// The properties of the archive replace the existing ones.
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	existing, err := deadPropsOf(ctx, f, ps, name)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	remove := Proppatch{Remove: true}
+	for n := range existing {
+		if _, ok := props[n]; !ok {
+			remove.Props = append(remove.Props, Property{XMLName: n})
+		}
+	}
+	set := Proppatch{}
+	for _, p := range props {
+		set.Props = append(set.Props, p)
+	}
+	var patches []Proppatch
+	if len(remove.Props) > 0 {
+		patches = append(patches, remove)
+	}
+	if len(set.Props) > 0 {
+		patches = append(patches, set)
+	}
+	if len(patches) == 0 {
+		return nil
+	}
+	pstats, err := patchDead(ctx, fs, ps, name, patches)
+	if err != nil {
+		return err
+	}
+	for _, pstat := range pstats {
+		if pstat.Status != http.StatusOK {
+			return fmt.Errorf("webdav: cannot restore the properties of %s: %s", name, StatusText(pstat.Status))
+		}
+	}
+	if len(pstats) == 0 {
+		return fmt.Errorf("webdav: cannot restore the properties of %s", name)
+	}
+	return nil
+}
+
+// deadPropsOf returns the dead properties of f, the opened resource name,
+// from ps if it is non-nil or from f if it implements DeadPropsHolder
+// otherwise.
+func deadPropsOf(ctx context.Context, f File, ps PropStore, name string) (map[xml.Name]Property, error) {
+	if ps != nil {
+		return ps.Get(ctx, name)
+	}
+	if dph, ok := f.(DeadPropsHolder); ok {
+		return dph.DeadProps()
+	}
+	return nil, nil
+}
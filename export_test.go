@@ -0,0 +1,141 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src, err := buildTestFS([]string{
+		"mkdir /a",
+		"mkdir /a/b",
+		"write /a/b/file content",
+		"write /a/other data",
+		"touch /outside",
+	})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	color := func(v string) Property {
+		return Property{XMLName: xml.Name{Space: "ns", Local: "color"}, InnerXML: []byte(v)}
+	}
+	for name, v := range map[string]string{"/a": "red", "/a/b/file": "blue"} {
+		if _, err := patch(ctx, src, nil, nil, name, []Proppatch{{Props: []Property{color(v)}}}); err != nil {
+			t.Fatalf("patch %s: %v", name, err)
+		}
+	}
+
+	// Export from the memFS, that holds the dead properties, and import
+	// into a Dir, that stores them in a PropStore.
+	var buf bytes.Buffer
+	if err := Export(ctx, &buf, src, nil, "/a"); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	dir := Dir(t.TempDir())
+	dst := HideSidecars(dir)
+	ps := NewSidecarPropStore(dir)
+	if err := dst.Mkdir(ctx, "/restored", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The properties not in the archive are removed.
+	stale := Property{XMLName: xml.Name{Space: "ns", Local: "stale"}}
+	if _, err := ps.Patch(ctx, "/restored", []Proppatch{{Props: []Property{stale}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Import(ctx, &buf, dst, ps, "/restored"); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	wantContent := map[string]string{"/restored/b/file": "content", "/restored/other": "data"}
+	wantProps := map[string]string{"/restored": "red", "/restored/b/file": "blue"}
+	// check checks the content of fs and the properties returned by
+	// deadProps.
+	check := func(fs FileSystem, deadProps func(name string) (map[xml.Name]Property, error)) {
+		t.Helper()
+		for name, want := range wantContent {
+			f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatalf("OpenFile %s: %v", name, err)
+			}
+			got, err := io.ReadAll(f)
+			f.Close()
+			if err != nil || string(got) != want {
+				t.Fatalf("%s: got %q, %v, want %q", name, got, err, want)
+			}
+		}
+		for name, want := range wantProps {
+			got, err := deadProps(name)
+			if err != nil {
+				t.Fatalf("dead properties of %s: %v", name, err)
+			}
+			if want := map[xml.Name]Property{color("").XMLName: color(want)}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("dead properties of %s: got %v, want %v", name, got, want)
+			}
+		}
+		if _, err := fs.Stat(ctx, "/restored/outside"); !os.IsNotExist(err) {
+			t.Fatalf("Stat outside: got %v, want not exist", err)
+		}
+	}
+	check(dst, func(name string) (map[xml.Name]Property, error) {
+		return ps.Get(ctx, name)
+	})
+
+	// And back, from the Dir and its PropStore to a new memFS.
+	buf.Reset()
+	if err := Export(ctx, &buf, dst, ps, "/"); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	mem := NewMemFS()
+	if err := Import(ctx, &buf, mem, nil, "/"); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	check(mem, func(name string) (map[xml.Name]Property, error) {
+		f, err := mem.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.(DeadPropsHolder).DeadProps()
+	})
+}
+
+func TestImportInvalidEntry(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewMemFS()
+	if err := fs.Mkdir(context.Background(), "/root", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Import(context.Background(), &buf, fs, nil, "/root"); err == nil {
+		t.Fatalf("Import: got nil error, want non-nil")
+	}
+	if _, err := fs.Stat(context.Background(), "/evil"); !os.IsNotExist(err) {
+		t.Fatalf("Stat /evil: got %v, want not exist", err)
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is the error returned by FaultFS and FaultLS for injected
+// failures if FaultConfig.Err is nil.
+var ErrInjectedFault = errors.New("webdav: injected fault")
+
+// FaultConfig configures the faults injected by the wrappers returned by
+// NewFaultFS and NewFaultLS. The zero value injects no faults.
+//
+// Faults are decided by a pseudo-random generator initialized with Seed, so
+// a sequence of operations always results in the same faults.
+type FaultConfig struct {
+	// Seed initializes the pseudo-random generator.
+	Seed int64
+	// ErrorRate is the probability, between 0 and 1, for an operation to fail
+	// with Err.
+	ErrorRate float64
+	// Err is the error returned by failed operations. If nil,
+	// ErrInjectedFault is used.
+	Err error
+	// Latency is added to each operation.
+	Latency time.Duration
+	// Jitter is the upper bound of a random delay added to Latency.
+	Jitter time.Duration
+	// PartialWriteRate is the probability, between 0 and 1, for a File's
+	// Write to write only part of the given bytes and to return
+	// io.ErrShortWrite.
+	PartialWriteRate float64
+	// Ops restricts the injected errors and latencies to the named
+	// operations, for example "OpenFile", "Write" or "Create". Operations are
+	// named after the methods of the FileSystem, File and LockSystem
+	// interfaces. If empty, all the operations are affected.
+	Ops []string
+}
+
+type faultInjector struct {
+	cfg FaultConfig
+	ops map[string]bool
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newFaultInjector(cfg FaultConfig) *faultInjector {
+	fi := &faultInjector{
+		cfg: cfg,
+		rng: rand.New(rand.NewSource(cfg.Seed)),
+	}
+	if len(cfg.Ops) > 0 {
+		fi.ops = make(map[string]bool, len(cfg.Ops))
+		for _, op := range cfg.Ops {
+			fi.ops[op] = true
+		}
+	}
+	return fi
+}
+
+func (fi *faultInjector) float64() float64 {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.rng.Float64()
+}
+
+// inject delays the operation op as configured and returns a non-nil error
+// if op must fail.
+func (fi *faultInjector) inject(op string) error {
+	if fi.ops != nil && !fi.ops[op] {
+		return nil
+	}
+	delay := fi.cfg.Latency
+	if fi.cfg.Jitter > 0 {
+		fi.mu.Lock()
+		delay += time.Duration(fi.rng.Int63n(int64(fi.cfg.Jitter)))
+		fi.mu.Unlock()
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if fi.cfg.ErrorRate > 0 && fi.float64() < fi.cfg.ErrorRate {
+		if fi.cfg.Err != nil {
+			return fi.cfg.Err
+		}
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+// partialWrite returns how many of n bytes must be written, and whether the
+// write is partial.
+func (fi *faultInjector) partialWrite(n int) (int, bool) {
+	if n == 0 || fi.cfg.PartialWriteRate <= 0 || (fi.ops != nil && !fi.ops["Write"]) {
+		return n, false
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.rng.Float64() >= fi.cfg.PartialWriteRate {
+		return n, false
+	}
+	return fi.rng.Intn(n), true
+}
+
+// NewFaultFS returns a FileSystem wrapping fs that injects errors, latencies
+// and partial writes according to cfg. It is meant for testing how clients
+// and hooks behave under backend failures.
+func NewFaultFS(fs FileSystem, cfg FaultConfig) FileSystem {
+	return &faultFS{
+		fs: fs,
+		fi: newFaultInjector(cfg),
+	}
+}
+
+type faultFS struct {
+	fs FileSystem
+	fi *faultInjector
+}
+
+func (fs *faultFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := fs.fi.inject("Mkdir"); err != nil {
+		return err
+	}
+	return fs.fs.Mkdir(ctx, name, perm)
+}
+
+func (fs *faultFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	if err := fs.fi.inject("OpenFile"); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	ff := &faultFile{f: f, fi: fs.fi}
+	if dph, ok := f.(DeadPropsHolder); ok {
+		return &faultDeadPropsFile{faultFile: ff, dph: dph}, nil
+	}
+	return ff, nil
+}
+
+func (fs *faultFS) RemoveAll(ctx context.Context, name string) error {
+	if err := fs.fi.inject("RemoveAll"); err != nil {
+		return err
+	}
+	return fs.fs.RemoveAll(ctx, name)
+}
+
+func (fs *faultFS) Rename(ctx context.Context, oldName, newName string) error {
+	if err := fs.fi.inject("Rename"); err != nil {
+		return err
+	}
+	return fs.fs.Rename(ctx, oldName, newName)
+}
+
+func (fs *faultFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if err := fs.fi.inject("Stat"); err != nil {
+		return nil, err
+	}
+	return fs.fs.Stat(ctx, name)
+}
+
+type faultFile struct {
+	f  File
+	fi *faultInjector
+}
+
+func (f *faultFile) Close() error {
+	err := f.fi.inject("Close")
+	closeErr := f.f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fi.inject("Read"); err != nil {
+		return 0, err
+	}
+	return f.f.Read(p)
+}
+
+func (f *faultFile) Readdir(count int) ([]os.FileInfo, error) {
+	if err := f.fi.inject("Readdir"); err != nil {
+		return nil, err
+	}
+	return f.f.Readdir(count)
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.fi.inject("Seek"); err != nil {
+		return 0, err
+	}
+	return f.f.Seek(offset, whence)
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if err := f.fi.inject("Stat"); err != nil {
+		return nil, err
+	}
+	return f.f.Stat()
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fi.inject("Write"); err != nil {
+		return 0, err
+	}
+	if n, partial := f.fi.partialWrite(len(p)); partial {
+		n, err := f.f.Write(p[:n])
+		if err != nil {
+			return n, err
+		}
+		return n, io.ErrShortWrite
+	}
+	return f.f.Write(p)
+}
+
+// faultDeadPropsFile is a faultFile preserving the optional DeadPropsHolder
+// interface of the wrapped File.
+type faultDeadPropsFile struct {
+	*faultFile
+	dph DeadPropsHolder
+}
+
+func (f *faultDeadPropsFile) DeadProps() (map[xml.Name]Property, error) {
+	if err := f.fi.inject("DeadProps"); err != nil {
+		return nil, err
+	}
+	return f.dph.DeadProps()
+}
+
+func (f *faultDeadPropsFile) Patch(patches []Proppatch) ([]Propstat, error) {
+	if err := f.fi.inject("Patch"); err != nil {
+		return nil, err
+	}
+	return f.dph.Patch(patches)
+}
+
+// NewFaultLS returns a LockSystem wrapping ls that injects errors and
+// latencies according to cfg. The PartialWriteRate of cfg is ignored.
+func NewFaultLS(ls LockSystem, cfg FaultConfig) LockSystem {
+	return &faultLS{
+		ls: ls,
+		fi: newFaultInjector(cfg),
+	}
+}
+
+type faultLS struct {
+	ls LockSystem
+	fi *faultInjector
+}
+
+func (ls *faultLS) Confirm(now time.Time, name0, name1 string, conditions ...Condition) (func(), error) {
+	if err := ls.fi.inject("Confirm"); err != nil {
+		return nil, err
+	}
+	return ls.ls.Confirm(now, name0, name1, conditions...)
+}
+
+func (ls *faultLS) Create(now time.Time, details LockDetails) (string, error) {
+	if err := ls.fi.inject("Create"); err != nil {
+		return "", err
+	}
+	return ls.ls.Create(now, details)
+}
+
+func (ls *faultLS) Refresh(now time.Time, token string, duration time.Duration) (LockDetails, error) {
+	if err := ls.fi.inject("Refresh"); err != nil {
+		return LockDetails{}, err
+	}
+	return ls.ls.Refresh(now, token, duration)
+}
+
+func (ls *faultLS) Unlock(now time.Time, token string) error {
+	if err := ls.fi.inject("Unlock"); err != nil {
+		return err
+	}
+	return ls.ls.Unlock(now, token)
+}
+
+func (ls *faultLS) GetByName(name string) (string, time.Time, LockDetails, error) {
+	if err := ls.fi.inject("GetByName"); err != nil {
+		return "", time.Time{}, LockDetails{}, err
+	}
+	return ls.ls.GetByName(name)
+}
+
+func (ls *faultLS) Delete(now time.Time, name string) error {
+	deleter, ok := ls.ls.(LockDeleter)
+	if !ok {
+		return nil
+	}
+	if err := ls.fi.inject("Delete"); err != nil {
+		return err
+	}
+	return deleter.Delete(now, name)
+}
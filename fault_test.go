@@ -0,0 +1,119 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFaultFS(t *testing.T) {
+	ctx := context.Background()
+
+	// The zero FaultConfig injects no faults.
+	fs := NewFaultFS(NewMemFS(), FaultConfig{})
+	testFS(t, fs)
+
+	errBackend := errors.New("backend failure")
+	fs = NewFaultFS(NewMemFS(), FaultConfig{
+		ErrorRate: 1,
+		Err:       errBackend,
+		Ops:       []string{"Mkdir"},
+	})
+	if err := fs.Mkdir(ctx, "/dir", 0777); err != errBackend {
+		t.Fatalf("Mkdir: got %v, want %v", err, errBackend)
+	}
+	f, err := fs.OpenFile(ctx, "/file", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, ok := f.(DeadPropsHolder); !ok {
+		t.Fatalf("OpenFile: DeadPropsHolder not preserved")
+	}
+	f.Close()
+
+	fs = NewFaultFS(NewMemFS(), FaultConfig{
+		PartialWriteRate: 1,
+	})
+	f, err = fs.OpenFile(ctx, "/file", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	n, err := f.Write([]byte("hello world"))
+	if err != io.ErrShortWrite {
+		t.Fatalf("Write: got %v, want %v", err, io.ErrShortWrite)
+	}
+	if n >= len("hello world") {
+		t.Fatalf("Write: got %d bytes written, want less than %d", n, len("hello world"))
+	}
+	f.Close()
+}
+
+func TestFaultFSDeterministic(t *testing.T) {
+	ctx := context.Background()
+	run := func() []bool {
+		fs := NewFaultFS(NewMemFS(), FaultConfig{
+			Seed:      42,
+			ErrorRate: 0.5,
+		})
+		var results []bool
+		for i := 0; i < 64; i++ {
+			_, err := fs.Stat(ctx, "/")
+			results = append(results, err == ErrInjectedFault)
+		}
+		return results
+	}
+	a, b := run(), run()
+	failures := 0
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("operation #%d: results differ with the same seed", i)
+		}
+		if a[i] {
+			failures++
+		}
+	}
+	if failures == 0 || failures == len(a) {
+		t.Fatalf("got %d failures out of %d operations", failures, len(a))
+	}
+}
+
+func TestFaultLS(t *testing.T) {
+	now := time.Now()
+	ls := NewFaultLS(NewMemLS(), FaultConfig{
+		ErrorRate: 1,
+		Ops:       []string{"Unlock"},
+	})
+	token, err := ls.Create(now, LockDetails{Root: "/file", Duration: infiniteTimeout})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := ls.Unlock(now, token); err != ErrInjectedFault {
+		t.Fatalf("Unlock: got %v, want %v", err, ErrInjectedFault)
+	}
+	if _, _, _, err := ls.GetByName("/file"); err != nil {
+		t.Fatalf("GetByName: %v", err)
+	}
+	if err := ls.(LockDeleter).Delete(now, "/file"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, _, err := ls.GetByName("/file"); err != ErrNoSuchLock {
+		t.Fatalf("GetByName after Delete: got %v, want %v", err, ErrNoSuchLock)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import "net/http"
+
+// Feature names an optional extension of the Handler that can be enabled or
+// disabled per request using Handler.FeatureFlags.
+type Feature string
+
+// The features that Handler.FeatureFlags is consulted for.
+const (
+	// FeatureAsyncOperations allows COPY, MOVE and DELETE requests to be
+	// run asynchronously. See Handler.Operations.
+	FeatureAsyncOperations Feature = "async-operations"
+	// FeatureChecksumTrailers verifies PUT request bodies against the
+	// checksum sent in their Content-MD5 or X-Checksum trailer. Without it,
+	// the trailers are ignored.
+	FeatureChecksumTrailers Feature = "checksum-trailers"
+	// FeaturePartialUpdates allows updating byte ranges of files, if
+	// Handler.PartialUpdates is set.
+	FeaturePartialUpdates Feature = "partial-updates"
+	// FeaturePresign allows GET and PUT requests to be redirected to the
+	// storage backend. See Handler.PresignPolicy.
+	FeaturePresign Feature = "presign"
+)
+
+// featureEnabled reports whether feature is enabled for the request r on
+// resource name.
+func (h *Handler) featureEnabled(r *http.Request, feature Feature, name string) bool {
+	if h.FeatureFlags == nil {
+		return true
+	}
+	return h.FeatureFlags(r, feature, h.principal(r), name)
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	fs, err := buildTestFS([]string{
+		"mkdir /paid",
+		"touch /paid/file",
+		"mkdir /free",
+		"touch /free/file",
+	})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	type call struct {
+		feature         Feature
+		principal, name string
+	}
+	var calls []call
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		Operations: NewOperations("/ops/"),
+		Principal: func(r *http.Request) string {
+			user, _, _ := r.BasicAuth()
+			return user
+		},
+		FeatureFlags: func(r *http.Request, feature Feature, principal, name string) bool {
+			calls = append(calls, call{feature, principal, name})
+			return principal == "alice" || strings.HasPrefix(name, "/paid/")
+		},
+	}
+	del := func(user, target string) int {
+		r := httptest.NewRequest("DELETE", target, nil)
+		r.SetBasicAuth(user, "password")
+		r.Header.Set("Prefer", "respond-async")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	testCases := []struct {
+		user, target string
+		want         int
+	}{
+		{"bob", "/free/file", http.StatusNoContent},
+		{"bob", "/paid/file", http.StatusAccepted},
+		{"alice", "/free", http.StatusAccepted},
+	}
+	for _, tc := range testCases {
+		calls = nil
+		if got := del(tc.user, tc.target); got != tc.want {
+			t.Errorf("DELETE %s as %s: got status %d, want %d", tc.target, tc.user, got, tc.want)
+		}
+		want := []call{{FeatureAsyncOperations, tc.user, tc.target}}
+		if len(calls) != 1 || calls[0] != want[0] {
+			t.Errorf("DELETE %s as %s: got calls %v, want %v", tc.target, tc.user, calls, want)
+		}
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -63,8 +64,15 @@ type FileSystem interface {
 // A File is returned by a FileSystem's OpenFile method and can be served by a
 // Handler.
 //
+// When the Handler walks a collection, it calls Readdir with a positive
+// count: it must return at most count members and io.EOF at the end of the
+// directory, as os.File does. For compatibility, the directories returning
+// all their members on each call are detected, but not the other listings
+// that never end.
+//
 // A File may optionally implement the DeadPropsHolder interface, if it can
-// load and save dead properties.
+// load and save dead properties. It is not used when the Handler has a
+// PropStore.
 type File interface {
 	http.File
 	io.Writer
@@ -120,7 +128,13 @@ func (d Dir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMo
 	if err != nil {
 		return nil, err
 	}
-	return f, nil
+	return dirFile{f}, nil
+}
+
+// OverwritesInPlace implements OverwritingFS: the local files can be
+// overwritten by other processes while they are served.
+func (d Dir) OverwritesInPlace() bool {
+	return true
 }
 
 func (d Dir) RemoveAll(ctx context.Context, name string) error {
@@ -152,7 +166,117 @@ func (d Dir) Stat(ctx context.Context, name string) (os.FileInfo, error) {
 	if name = d.resolve(name); name == "" {
 		return nil, os.ErrNotExist
 	}
-	return os.Stat(name)
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return dirFileInfo{fi, name}, nil
+}
+
+// Append implements AppendFS.
+func (d Dir) Append(ctx context.Context, name string, offset int64, r io.Reader) (int64, error) {
+	f, err := d.OpenFile(ctx, name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
+	return appendFile(f, offset, r)
+}
+
+// appendFile appends the content of r to f, whose size must be offset, and
+// closes f.
+func appendFile(f File, offset int64, r io.Reader) (int64, error) {
+	fi, err := f.Stat()
+	if err == nil && fi.Size() != offset {
+		err = ErrOffsetMismatch
+	}
+	var n int64
+	if err == nil {
+		n, err = io.Copy(f, r)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// Chtimes implements Win32FS.
+func (d Dir) Chtimes(ctx context.Context, name string, atime, mtime time.Time) error {
+	if name = d.resolve(name); name == "" {
+		return os.ErrNotExist
+	}
+	return os.Chtimes(name, atime, mtime)
+}
+
+// SetWin32Attributes implements Win32FS. Only FILE_ATTRIBUTE_READONLY is
+// mapped, to the owner write permission bit.
+func (d Dir) SetWin32Attributes(ctx context.Context, name string, attrs uint32) error {
+	return d.setReadOnly(name, attrs&win32AttrReadOnly != 0, ModePolicy{})
+}
+
+// setReadOnly clears the write permission bits of resource name, or sets the
+// write bits of p, unless it is already writable.
+func (d Dir) setReadOnly(name string, readOnly bool, p ModePolicy) error {
+	if name = d.resolve(name); name == "" {
+		return os.ErrNotExist
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	perm := fi.Mode().Perm()
+	switch {
+	case readOnly:
+		perm &^= 0222
+	case perm&p.writeBits() == 0:
+		perm |= p.writeBits()
+	default:
+		return nil
+	}
+	if perm == fi.Mode().Perm() {
+		return nil
+	}
+	return os.Chmod(name, perm)
+}
+
+// Chmod implements Chmoder.
+func (d Dir) Chmod(ctx context.Context, name string, mode os.FileMode) error {
+	if name = d.resolve(name); name == "" {
+		return os.ErrNotExist
+	}
+	return os.Chmod(name, mode)
+}
+
+// dirFile is a File of a Dir. Its FileInfos implement CreationTimer.
+type dirFile struct {
+	*os.File
+}
+
+func (f dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	for i, fi := range fis {
+		fis[i] = dirFileInfo{fi, filepath.Join(f.File.Name(), fi.Name())}
+	}
+	return fis, err
+}
+
+func (f dirFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return dirFileInfo{fi, f.File.Name()}, nil
+}
+
+// dirFileInfo is the os.FileInfo of the file at path in a Dir.
+type dirFileInfo struct {
+	os.FileInfo
+	path string
+}
+
+// CreationTime implements CreationTimer, on the platforms exposing the
+// birth time of files.
+func (fi dirFileInfo) CreationTime() time.Time {
+	return birthTime(fi.path, fi.FileInfo)
 }
 
 // NewMemFS returns a new in-memory FileSystem implementation.
@@ -335,6 +459,7 @@ func (fs *memFS) OpenFile(ctx context.Context, name string, flag int, perm os.Fi
 		if flag&(os.O_WRONLY|os.O_RDWR) != 0 && flag&os.O_TRUNC != 0 {
 			n.mu.Lock()
 			n.data = nil
+			n.shared = false
 			n.mu.Unlock()
 		}
 	}
@@ -343,11 +468,34 @@ func (fs *memFS) OpenFile(ctx context.Context, name string, flag int, perm os.Fi
 	for cName, c := range n.children {
 		children = append(children, c.stat(cName))
 	}
-	return &memFile{
+	// List the children in a stable order, so that PROPFIND offsets are
+	// meaningful.
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Name() < children[j].Name()
+	})
+	f := &memFile{
 		n:                n,
 		nameSnapshot:     frag,
 		childrenSnapshot: children,
-	}, nil
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		// Read-only handles see the content as it was when they were
+		// opened, even if the file is overwritten, moved or removed
+		// while they are being read.
+		n.mu.Lock()
+		if !n.mode.IsDir() {
+			f.snapshot = &memFileInfo{
+				name:    frag,
+				size:    int64(len(n.data)),
+				mode:    n.mode,
+				modTime: n.modTime,
+			}
+			f.data = n.data
+			n.shared = true
+		}
+		n.mu.Unlock()
+	}
+	return f, nil
 }
 
 func (fs *memFS) RemoveAll(ctx context.Context, name string) error {
@@ -446,6 +594,9 @@ type memFSNode struct {
 	mode      os.FileMode
 	modTime   time.Time
 	deadProps map[xml.Name]Property
+	// shared is set when data is referenced by a read-only memFile
+	// snapshot, so writes must copy it before modifying it in place.
+	shared bool
 }
 
 func (n *memFSNode) stat(name string) *memFileInfo {
@@ -513,6 +664,9 @@ type memFile struct {
 	n                *memFSNode
 	nameSnapshot     string
 	childrenSnapshot []os.FileInfo
+	// snapshot and data are set for read-only handles to regular files.
+	snapshot *memFileInfo
+	data     []byte
 	// pos is protected by n.mu.
 	pos int
 }
@@ -533,10 +687,14 @@ func (f *memFile) Read(p []byte) (int, error) {
 	if f.n.mode.IsDir() {
 		return 0, os.ErrInvalid
 	}
-	if f.pos >= len(f.n.data) {
+	data := f.n.data
+	if f.snapshot != nil {
+		data = f.data
+	}
+	if f.pos >= len(data) {
 		return 0, io.EOF
 	}
-	n := copy(p, f.n.data[f.pos:])
+	n := copy(p, data[f.pos:])
 	f.pos += n
 	return n, nil
 }
@@ -579,7 +737,11 @@ func (f *memFile) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		npos += int(offset)
 	case io.SeekEnd:
-		npos = len(f.n.data) + int(offset)
+		if f.snapshot != nil {
+			npos = len(f.data) + int(offset)
+		} else {
+			npos = len(f.n.data) + int(offset)
+		}
 	default:
 		npos = -1
 	}
@@ -591,6 +753,9 @@ func (f *memFile) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.snapshot != nil {
+		return f.snapshot, nil
+	}
 	return f.n.stat(f.nameSnapshot), nil
 }
 
@@ -603,6 +768,10 @@ func (f *memFile) Write(p []byte) (int, error) {
 		return 0, os.ErrInvalid
 	}
 	if f.pos < len(f.n.data) {
+		if f.n.shared {
+			f.n.data = append([]byte(nil), f.n.data...)
+			f.n.shared = false
+		}
 		n := copy(f.n.data[f.pos:], p)
 		f.pos += n
 		p = p[n:]
@@ -690,6 +859,9 @@ func copyFiles(ctx context.Context, fs FileSystem, src, dst string, overwrite bo
 	if recursion == 1000 {
 		return http.StatusInternalServerError, errRecursionTooDeep
 	}
+	if err := ctx.Err(); err != nil {
+		return http.StatusInternalServerError, err
+	}
 	recursion++
 
 	// TODO: section 9.8.3 says that "Note that an infinite-depth COPY of /A/
@@ -803,6 +975,7 @@ func copyFiles(ctx context.Context, fs FileSystem, src, dst string, overwrite bo
 			return http.StatusInternalServerError, closeErr
 		}
 	}
+	reportProgress(ctx)
 
 	if created {
 		return http.StatusCreated, nil
@@ -846,12 +1019,15 @@ func walkFS(ctx context.Context, fs FileSystem, depth int, name string, info os.
 		defer lister.Close()
 
 		for {
-			batch, err := lister.Next(1000)
+			batch, err := lister.Next(walkBatchSize)
 			finished := errors.Is(err, io.EOF)
 			if err != nil && !finished {
 				return walkFn(name, info, err)
 			}
 			for _, fileInfo := range batch {
+				if IsUploadName(fileInfo.Name()) {
+					continue
+				}
 				filename := path.Join(name, fileInfo.Name())
 				err = walkFS(ctx, fs, depth, filename, fileInfo, walkFn)
 				if err != nil {
@@ -866,20 +1042,70 @@ func walkFS(ctx context.Context, fs FileSystem, depth int, name string, info os.
 		}
 	}
 
-	fileInfos, err := f.Readdir(0)
-	f.Close()
-	if err != nil {
-		return walkFn(name, info, err)
+	// Read the directory in batches, so that listing large directories
+	// doesn't hold all their members in memory.
+	defer f.Close()
+	var first []os.FileInfo
+	for batch, empty := 0, 0; ; batch++ {
+		fileInfos, err := f.Readdir(walkBatchSize)
+		// The end of the directory is reported by io.EOF. A File ignoring
+		// count returns all the members at once, and then either empty
+		// batches, so that too many empty batches in a row end the
+		// directory as well, or all the members again, so that a second
+		// batch repeating the first one ends it too.
+		switch batch {
+		case 0:
+			first = fileInfos
+		case 1:
+			if len(fileInfos) > 0 && sameNames(fileInfos, first) {
+				return nil
+			}
+			first = nil
+		}
+		if len(fileInfos) == 0 {
+			empty++
+		} else {
+			empty = 0
+		}
+		finished := errors.Is(err, io.EOF) || len(fileInfos) > walkBatchSize ||
+			empty >= walkMaxEmptyBatches
+		if err != nil && !errors.Is(err, io.EOF) {
+			return walkFn(name, info, err)
+		}
+		for _, fileInfo := range fileInfos {
+			if IsUploadName(fileInfo.Name()) {
+				continue
+			}
+			filename := path.Join(name, fileInfo.Name())
+			err = walkFS(ctx, fs, depth, filename, fileInfo, walkFn)
+			if err != nil {
+				if err != filepath.SkipDir {
+					return err
+				}
+			}
+		}
+		if finished {
+			return nil
+		}
 	}
+}
 
-	for _, fileInfo := range fileInfos {
-		filename := path.Join(name, fileInfo.Name())
-		err = walkFS(ctx, fs, depth, filename, fileInfo, walkFn)
-		if err != nil {
-			if err != filepath.SkipDir {
-				return err
-			}
+// sameNames reports whether a and b list the same names in the same order.
+func sameNames(a, b []os.FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name() != b[i].Name() {
+			return false
 		}
 	}
-	return nil
+	return true
 }
+
+// walkBatchSize is the number of directory members read at once by walkFS.
+const walkBatchSize = 1000
+
+// walkMaxEmptyBatches is the number of empty batches in a row after which
+// walkFS considers a directory listed, see walkFS.
+const walkMaxEmptyBatches = 3
@@ -820,6 +820,81 @@ func TestMemFileWriteAllocs(t *testing.T) {
 	}
 }
 
+func TestMemFileSnapshot(t *testing.T) {
+	ctx := context.Background()
+	fs := NewMemFS()
+	write := func(flag int, data string) {
+		f, err := fs.OpenFile(ctx, "/file", flag, 0666)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	write(os.O_RDWR|os.O_CREATE|os.O_TRUNC, "old content")
+
+	testCases := []struct {
+		desc   string
+		change func()
+	}{{
+		"overwrite",
+		func() { write(os.O_RDWR|os.O_TRUNC, "new data") },
+	}, {
+		"write in place",
+		func() { write(os.O_RDWR, "NEW") },
+	}, {
+		"rename",
+		func() {
+			if err := fs.Rename(ctx, "/file", "/renamed"); err != nil {
+				t.Fatalf("Rename: %v", err)
+			}
+			if err := fs.Rename(ctx, "/renamed", "/file"); err != nil {
+				t.Fatalf("Rename: %v", err)
+			}
+		},
+	}}
+
+	for _, tc := range testCases {
+		f, err := fs.OpenFile(ctx, "/file", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("%s: OpenFile: %v", tc.desc, err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatalf("%s: Stat: %v", tc.desc, err)
+		}
+		want := make([]byte, fi.Size())
+		if _, err := io.ReadFull(f, want); err != nil {
+			t.Fatalf("%s: ReadFull: %v", tc.desc, err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatalf("%s: Seek: %v", tc.desc, err)
+		}
+		head := make([]byte, 3)
+		if _, err := io.ReadFull(f, head); err != nil {
+			t.Fatalf("%s: ReadFull: %v", tc.desc, err)
+		}
+
+		tc.change()
+
+		rest, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("%s: ReadAll: %v", tc.desc, err)
+		}
+		if got := string(head) + string(rest); got != string(want) {
+			t.Errorf("%s: got %q, want %q", tc.desc, got, want)
+		}
+		if got, _ := f.Stat(); got.Size() != fi.Size() || !got.ModTime().Equal(fi.ModTime()) {
+			t.Errorf("%s: Stat changed while the file was open", tc.desc)
+		}
+		f.Close()
+	}
+}
+
 func BenchmarkMemFileWrite(b *testing.B) {
 	ctx := context.Background()
 	fs := NewMemFS()
@@ -0,0 +1,49 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/url"
+	"unicode/utf8"
+)
+
+// InvalidNamePolicy is how a Handler lists the resources whose names are not
+// valid UTF-8, such as files created by legacy software on a native file
+// system. Many clients fail to parse the listings containing them.
+type InvalidNamePolicy int
+
+const (
+	// InvalidNamesEscape lists the resources with invalid names, percent
+	// encoding the invalid bytes of their hrefs. The invalid bytes of the
+	// properties derived from their names, such as DAV:displayname, are
+	// replaced by the Unicode replacement character.
+	InvalidNamesEscape InvalidNamePolicy = iota
+	// InvalidNamesSkip omits the resources with invalid names, and their
+	// members, from PROPFIND responses.
+	InvalidNamesSkip
+)
+
+// hrefPath returns the percent-encoded form of the slash-separated path p,
+// used in the hrefs of responses. Spaces, '#', '?', '%', non-ASCII and
+// invalid UTF-8 bytes are escaped, so that clients can always decode it.
+func hrefPath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// skipName reports whether the resource with the given base name is omitted
+// from listings by h.InvalidNames.
+func (h *Handler) skipName(name string) bool {
+	return h.InvalidNames == InvalidNamesSkip && !utf8.ValidString(name)
+}
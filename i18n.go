@@ -0,0 +1,89 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MessageCatalog localizes the human-readable bodies of the responses that
+// have no XML body, such as "404 Not Found". Status codes and the XML
+// precondition and postcondition codes are never localized, so that clients
+// can rely on them.
+type MessageCatalog interface {
+	// Message returns the message for the given status code and error in
+	// the language identified by the BCP 47 tag lang, for example "it" or
+	// "pt-BR". err may be nil. It returns false if the catalog has no
+	// message for lang.
+	Message(lang string, status int, err error) (string, bool)
+}
+
+// statusMessage returns the body of a response with the given status code
+// and the language of the body, if localized by h.Messages.
+func (h *Handler) statusMessage(r *http.Request, status int, err error) (msg, lang string) {
+	if h.Messages != nil {
+		for _, lang := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+			if msg, ok := h.Messages.Message(lang, status, err); ok {
+				return msg, lang
+			}
+		}
+	}
+	if err == errInsecureCredentials {
+		return insecureCredentialsMessage, ""
+	}
+	if tle, ok := err.(*treeLimitError); ok {
+		return tle.message(), ""
+	}
+	return StatusText(status), ""
+}
+
+// parseAcceptLanguage returns the language tags of the Accept-Language HTTP
+// header, ordered by decreasing quality. Tags with zero quality and the "*"
+// wildcard are skipped.
+func parseAcceptLanguage(s string) []string {
+	type langQ struct {
+		lang string
+		q    float64
+	}
+	var langs []langQ
+	for _, v := range strings.Split(s, ",") {
+		lang, params, _ := strings.Cut(v, ";")
+		lang = strings.TrimSpace(lang)
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		if p := strings.TrimSpace(params); strings.HasPrefix(p, "q=") {
+			var err error
+			if q, err = strconv.ParseFloat(p[2:], 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			langs = append(langs, langQ{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].q > langs[j].q
+	})
+	ret := make([]string, len(langs))
+	for i, l := range langs {
+		ret[i] = l.lang
+	}
+	return ret
+}
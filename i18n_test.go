@@ -0,0 +1,85 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want []string
+	}{
+		{"", []string{}},
+		{"it", []string{"it"}},
+		{"fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", []string{"fr-CH", "fr", "en", "de"}},
+		{"en;q=0.5, it", []string{"it", "en"}},
+		{"en;q=0, it;q=bad, de", []string{"de"}},
+	}
+
+	for _, tc := range testCases {
+		if got := parseAcceptLanguage(tc.s); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseAcceptLanguage(%q): got %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+type testCatalog map[string]map[int]string
+
+func (c testCatalog) Message(lang string, status int, err error) (string, bool) {
+	msg, ok := c[lang][status]
+	return msg, ok
+}
+
+func TestMessageCatalog(t *testing.T) {
+	h := &Handler{
+		FileSystem: NewMemFS(),
+		LockSystem: NewMemLS(),
+		Messages: testCatalog{
+			"it": {http.StatusNotFound: "Non trovato"},
+		},
+	}
+	testCases := []struct {
+		acceptLanguage string
+		wantBody       string
+		wantLanguage   string
+	}{
+		{"", "Not Found", ""},
+		{"de", "Not Found", ""},
+		{"de, it;q=0.5", "Non trovato", "it"},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", "/missing", nil)
+		if tc.acceptLanguage != "" {
+			r.Header.Set("Accept-Language", tc.acceptLanguage)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%q: got status %d, want %d", tc.acceptLanguage, w.Code, http.StatusNotFound)
+		}
+		if got := w.Body.String(); got != tc.wantBody {
+			t.Errorf("%q: got body %q, want %q", tc.acceptLanguage, got, tc.wantBody)
+		}
+		if got := w.Header().Get("Content-Language"); got != tc.wantLanguage {
+			t.Errorf("%q: got Content-Language %q, want %q", tc.acceptLanguage, got, tc.wantLanguage)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package contentline parses the content lines of the iCalendar objects,
+// defined by RFC 5545, and of the vCard objects, defined by RFC 6350.
+package contentline
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+)
+
+// ErrInvalid is returned when parsing malformed objects.
+var ErrInvalid = errors.New("contentline: invalid object")
+
+// Component is a component, such as VCALENDAR, VEVENT or VCARD.
+type Component struct {
+	Name     string
+	Props    []Property
+	Children []*Component
+}
+
+// Property is a content line of a component: GROUP.NAME;PARAM=VALUE:VALUE.
+type Property struct {
+	// Group is the vCard group of the property, if any.
+	Group  string
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Prop returns the first property of c named name, if any.
+func (c *Component) Prop(name string) (Property, bool) {
+	for _, p := range c.Props {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Property{}, false
+}
+
+// Parse parses the object data, made of a single component. The names of
+// the components, properties and parameters are upper cased.
+func Parse(data string) (*Component, error) {
+	var (
+		root  *Component
+		stack []*Component
+	)
+	handle := func(line string) error {
+		if line == "" {
+			return nil
+		}
+		p, err := parseProperty(line)
+		if err != nil {
+			return err
+		}
+		switch p.Name {
+		case "BEGIN":
+			c := &Component{Name: strings.ToUpper(p.Value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, c)
+			} else if root == nil {
+				root = c
+			} else {
+				return ErrInvalid
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(p.Value) {
+				return ErrInvalid
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return ErrInvalid
+			}
+			c := stack[len(stack)-1]
+			c.Props = append(c.Props, p)
+		}
+		return nil
+	}
+	var line string
+	sc := bufio.NewScanner(strings.NewReader(data))
+	sc.Buffer(nil, len(data)+1)
+	for sc.Scan() {
+		// Long lines are folded with CRLF followed by a space or a tab.
+		l := strings.TrimSuffix(sc.Text(), "\r")
+		if strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t") {
+			line += l[1:]
+			continue
+		}
+		if err := handle(line); err != nil {
+			return nil, err
+		}
+		line = l
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if err := handle(line); err != nil {
+		return nil, err
+	}
+	if root == nil || len(stack) > 0 {
+		return nil, ErrInvalid
+	}
+	return root, nil
+}
+
+// parseProperty parses a content line. The parameter values may be quoted,
+// to contain the ";", ":" and "," characters.
+func parseProperty(line string) (Property, error) {
+	p := Property{}
+	i := strings.IndexAny(line, ";:")
+	if i <= 0 {
+		return p, ErrInvalid
+	}
+	p.Name = strings.ToUpper(line[:i])
+	if group, name, ok := strings.Cut(p.Name, "."); ok {
+		p.Group, p.Name = group, name
+	}
+	for line[i] == ';' {
+		line = line[i+1:]
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			return p, ErrInvalid
+		}
+		name := strings.ToUpper(line[:eq])
+		line = line[eq+1:]
+		var value string
+		if strings.HasPrefix(line, `"`) {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				return p, ErrInvalid
+			}
+			value, line = line[1:end+1], line[end+2:]
+			i = 0
+		} else if i = strings.IndexAny(line, ";:"); i >= 0 {
+			value = line[:i]
+		} else {
+			return p, ErrInvalid
+		}
+		if line == "" {
+			return p, ErrInvalid
+		}
+		if p.Params == nil {
+			p.Params = make(map[string]string)
+		}
+		p.Params[name] = value
+		if !strings.HasPrefix(line[i:], ";") && !strings.HasPrefix(line[i:], ":") {
+			return p, ErrInvalid
+		}
+	}
+	p.Value = line[i+1:]
+	return p, nil
+}
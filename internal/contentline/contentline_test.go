@@ -0,0 +1,58 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package contentline
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	data := "BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"SUMMARY:A long\r\n" +
+		"  summary\r\n" +
+		"ATTENDEE;CN=\"Doe; John\":mailto:john@example.com\r\n" +
+		"item1.EMAIL;type=work:john@example.com\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	c, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "VCALENDAR" || len(c.Children) != 1 || c.Children[0].Name != "VEVENT" {
+		t.Fatalf("got %+v, want a VCALENDAR with a VEVENT", c)
+	}
+	ev := c.Children[0]
+	if p, _ := ev.Prop("SUMMARY"); p.Value != "A long summary" {
+		t.Errorf("SUMMARY: got %q, want %q", p.Value, "A long summary")
+	}
+	if p, _ := ev.Prop("ATTENDEE"); p.Params["CN"] != "Doe; John" || p.Value != "mailto:john@example.com" {
+		t.Errorf("ATTENDEE: got %+v", p)
+	}
+	if p, _ := ev.Prop("EMAIL"); p.Group != "ITEM1" || p.Params["TYPE"] != "work" || p.Value != "john@example.com" {
+		t.Errorf("EMAIL: got %+v", p)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"BEGIN:VCALENDAR\r\n",
+		"BEGIN:VCALENDAR\r\nEND:VEVENT\r\n",
+		"SUMMARY:x\r\n",
+		"BEGIN:VCALENDAR\r\nX;P=\"unterminated:x\r\nEND:VCALENDAR\r\n",
+		"BEGIN:VCARD\r\nEND:VCARD\r\nBEGIN:VCARD\r\nEND:VCARD\r\n",
+	} {
+		if _, err := Parse(invalid); err == nil {
+			t.Errorf("Parse(%q): got no error", invalid)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// WritableFS is a fs.FS whose files can be opened for writing. See IOFS.
+type WritableFS interface {
+	fs.FS
+	// OpenFile opens the named file like os.OpenFile. If flag allows
+	// writing, the returned file must implement io.Writer.
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+}
+
+// MkdirFS is a fs.FS supporting the creation of directories. See IOFS.
+type MkdirFS interface {
+	fs.FS
+	// Mkdir creates the named directory like os.Mkdir.
+	Mkdir(name string, perm fs.FileMode) error
+}
+
+// RemoveFS is a fs.FS supporting the removal of files and directory trees.
+// See IOFS.
+type RemoveFS interface {
+	fs.FS
+	// RemoveAll removes the named file or directory tree like os.RemoveAll.
+	RemoveAll(name string) error
+}
+
+// RenameFS is a fs.FS supporting renames. See IOFS.
+type RenameFS interface {
+	fs.FS
+	// Rename renames oldName to newName like os.Rename.
+	Rename(oldName, newName string) error
+}
+
+// IOFS returns a FileSystem serving fsys, so that the implementations of the
+// standard io/fs interfaces, such as os.DirFS, embed.FS or testing/fstest.MapFS,
+// can be served by a Handler.
+//
+// The writes use the WritableFS, MkdirFS, RemoveFS and RenameFS extension
+// interfaces, if implemented by fsys, and fail with fs.ErrPermission
+// otherwise: a fs.FS implementing none of them is served read-only. Without
+// RenameFS, MOVE requests fail but the uploads written to a temporary file
+// first are copied over their target. The files are seekable, as required to
+// serve GET requests, if they implement io.Seeker, and listable if they
+// implement fs.ReadDirFile, as fs.FS directories should.
+func IOFS(fsys fs.FS) FileSystem {
+	return ioFS{fsys}
+}
+
+type ioFS struct {
+	fsys fs.FS
+}
+
+// resolve returns the io/fs name of the FileSystem name, or "" if name is
+// invalid.
+func (f ioFS) resolve(name string) string {
+	name = strings.TrimPrefix(slashClean(name), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return ""
+	}
+	return name
+}
+
+func (f ioFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if name = f.resolve(name); name == "" {
+		return os.ErrNotExist
+	}
+	fsys, ok := f.fsys.(MkdirFS)
+	if !ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+	}
+	return fsys.Mkdir(name, perm)
+}
+
+func (f ioFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	if name = f.resolve(name); name == "" {
+		return nil, os.ErrNotExist
+	}
+	var file fs.File
+	var err error
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		file, err = f.fsys.Open(name)
+	} else if fsys, ok := f.fsys.(WritableFS); ok {
+		file, err = fsys.OpenFile(name, flag, perm)
+	} else {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioFile{file, name}, nil
+}
+
+func (f ioFS) RemoveAll(ctx context.Context, name string) error {
+	if name = f.resolve(name); name == "" {
+		return os.ErrNotExist
+	}
+	if name == "." {
+		// Prohibit removing the virtual root directory.
+		return os.ErrInvalid
+	}
+	fsys, ok := f.fsys.(RemoveFS)
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	return fsys.RemoveAll(name)
+}
+
+func (f ioFS) Rename(ctx context.Context, oldName, newName string) error {
+	if oldName = f.resolve(oldName); oldName == "" {
+		return os.ErrNotExist
+	}
+	if newName = f.resolve(newName); newName == "" {
+		return os.ErrNotExist
+	}
+	if oldName == "." || newName == "." {
+		// Prohibit renaming from or to the virtual root directory.
+		return os.ErrInvalid
+	}
+	fsys, ok := f.fsys.(RenameFS)
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrPermission}
+	}
+	return fsys.Rename(oldName, newName)
+}
+
+func (f ioFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if name = f.resolve(name); name == "" {
+		return nil, os.ErrNotExist
+	}
+	return fs.Stat(f.fsys, name)
+}
+
+// ioFile is a File opened by an ioFS.
+type ioFile struct {
+	fs.File
+	name string
+}
+
+func (f ioFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: ErrNotImplemented}
+	}
+	return s.Seek(offset, whence)
+}
+
+func (f ioFile) Readdir(count int) ([]os.FileInfo, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: ErrNotImplemented}
+	}
+	for {
+		entries, err := d.ReadDir(count)
+		fis := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			fi, infoErr := entry.Info()
+			if infoErr != nil {
+				if os.IsNotExist(infoErr) {
+					// The entry was removed after being listed.
+					continue
+				}
+				return fis, infoErr
+			}
+			fis = append(fis, fi)
+		}
+		// A batch whose entries were all removed is read again: an empty
+		// batch must not look like the end of the directory.
+		if len(fis) > 0 || len(entries) == 0 || err != nil || count <= 0 {
+			return fis, err
+		}
+	}
+}
+
+func (f ioFile) Write(p []byte) (int, error) {
+	w, ok := f.File.(io.Writer)
+	if !ok {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	return w.Write(p)
+}
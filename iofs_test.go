@@ -0,0 +1,172 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// osFS is a WritableFS, MkdirFS, RemoveFS and RenameFS backed by the native
+// file system.
+type osFS struct {
+	fs.FS
+	root string
+}
+
+func newOSFS(root string) osFS {
+	return osFS{os.DirFS(root), root}
+}
+
+func (f osFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	return os.OpenFile(filepath.Join(f.root, name), flag, perm)
+}
+
+func (f osFS) Mkdir(name string, perm fs.FileMode) error {
+	return os.Mkdir(filepath.Join(f.root, name), perm)
+}
+
+func (f osFS) RemoveAll(name string) error {
+	return os.RemoveAll(filepath.Join(f.root, name))
+}
+
+func (f osFS) Rename(oldName, newName string) error {
+	return os.Rename(filepath.Join(f.root, oldName), filepath.Join(f.root, newName))
+}
+
+func TestIOFS(t *testing.T) {
+	h := &Handler{
+		FileSystem: IOFS(newOSFS(t.TempDir())),
+		LockSystem: NewMemLS(),
+	}
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	testCases := []struct {
+		method, target, body string
+		headers              []string
+		wantStatus           int
+	}{
+		{"MKCOL", "/dir", "", nil, http.StatusCreated},
+		{"PUT", "/dir/a.txt", "hello", nil, http.StatusCreated},
+		{"PUT", "/dir/a.txt", "hello world", nil, http.StatusCreated},
+		{"MOVE", "/dir/a.txt", "", []string{"Destination", "/dir/b.txt"}, http.StatusCreated},
+		{"COPY", "/dir", "", []string{"Destination", "/copy"}, http.StatusCreated},
+		{"DELETE", "/dir", "", nil, http.StatusNoContent},
+		{"DELETE", "/", "", nil, http.StatusMethodNotAllowed},
+		{"GET", "/dir/b.txt", "", nil, http.StatusNotFound},
+		{"GET", "/../x", "", nil, http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		if w := do(tc.method, tc.target, tc.body, tc.headers...); w.Code != tc.wantStatus {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.target, w.Code, tc.wantStatus)
+		}
+	}
+	w := do("GET", "/copy/b.txt", "", "Range", "bytes=6-")
+	if got, _ := io.ReadAll(w.Body); w.Code != http.StatusPartialContent || string(got) != "world" {
+		t.Errorf("GET range: got %d %q, want %d %q", w.Code, got, http.StatusPartialContent, "world")
+	}
+	w = do("PROPFIND", "/", "", "Depth", "1")
+	if !strings.Contains(w.Body.String(), "<D:href>/copy/</D:href>") {
+		t.Errorf("PROPFIND: got %q, want the copy collection listed", w.Body.String())
+	}
+}
+
+// noRenameFS is an osFS that does not implement RenameFS.
+type noRenameFS struct {
+	fs.FS
+	f osFS
+}
+
+func (f noRenameFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	return f.f.OpenFile(name, flag, perm)
+}
+
+func (f noRenameFS) RemoveAll(name string) error {
+	return f.f.RemoveAll(name)
+}
+
+func TestIOFSNoRename(t *testing.T) {
+	dir := t.TempDir()
+	f := newOSFS(dir)
+	h := &Handler{
+		FileSystem: IOFS(noRenameFS{f.FS, f}),
+		LockSystem: NewMemLS(),
+	}
+	testCases := []struct {
+		desc, body, length string
+	}{
+		{"PUT", "hello", ""},
+		{"PUT with OC-Total-Length", "hello world", "11"},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest("PUT", "/a.txt", strings.NewReader(tc.body))
+		if tc.length != "" {
+			r.Header.Set("OC-Total-Length", tc.length)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, http.StatusCreated)
+			continue
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(got) != tc.body {
+			t.Errorf("%s: got %q, %v, want %q", tc.desc, got, err, tc.body)
+		}
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("got %d entries, %v, want only the uploaded file", len(entries), err)
+	}
+}
+
+func TestIOFSReadOnly(t *testing.T) {
+	h := &Handler{
+		FileSystem: IOFS(fstest.MapFS{
+			"dir/a.txt": &fstest.MapFile{Data: []byte("hello")},
+		}),
+		LockSystem: NewMemLS(),
+	}
+	testCases := []struct {
+		method, target, body string
+		wantStatus           int
+	}{
+		{"GET", "/dir/a.txt", "", http.StatusOK},
+		{"PROPFIND", "/dir", "", StatusMulti},
+		{"PUT", "/dir/b.txt", "content", http.StatusForbidden},
+		{"MKCOL", "/new", "", http.StatusForbidden},
+		{"DELETE", "/dir/a.txt", "", http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.target, w.Code, tc.wantStatus)
+		}
+	}
+}
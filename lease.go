@@ -0,0 +1,183 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Leases lets processes that do not speak WebDAV, such as batch jobs and
+// indexers, lock resources in the same LockSystem used by a Handler, so that
+// they coordinate with WebDAV clients. A lease is an exclusive write lock,
+// identified by its token like any other lock.
+//
+// Leases is also an http.Handler, meant for admin endpoints, that must be
+// mounted at Prefix:
+//
+//   - a POST request for Prefix acquires a lease, the request body is a JSON
+//     object with the "root", "zero_depth", "owner" and "timeout" fields,
+//     the timeout is in seconds and zero means infinite;
+//   - a PUT request for Prefix + token refreshes the lease, the request body
+//     is a JSON object with the "timeout" field;
+//   - a DELETE request for Prefix + token releases the lease.
+//
+// Successful POST and PUT requests return the Lease as JSON.
+type Leases struct {
+	// Prefix is the URL path the Leases handler is mounted at.
+	Prefix string
+	// LockSystem is the lock management system shared with the Handler.
+	LockSystem LockSystem
+}
+
+// Lease is a lock acquired through Leases.
+type Lease struct {
+	// Token is the lock token.
+	Token string `json:"token"`
+	// Root is the locked resource.
+	Root string `json:"root"`
+	// ZeroDepth is whether the lock has zero depth.
+	ZeroDepth bool `json:"zero_depth,omitempty"`
+	// Owner identifies the process holding the lease.
+	Owner string `json:"owner,omitempty"`
+	// Expiry is when the lease expires, zero means never.
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+func newLease(token string, now time.Time, ld LockDetails) Lease {
+	l := Lease{
+		Token:     token,
+		Root:      ld.Root,
+		ZeroDepth: ld.ZeroDepth,
+		Owner:     ld.Principal,
+	}
+	if ld.Duration >= 0 {
+		l.Expiry = now.Add(ld.Duration)
+	}
+	return l
+}
+
+// Acquire locks root on behalf of owner. A zero or negative timeout means
+// that the lease never expires. It returns ErrLocked if root is already
+// locked.
+func (l *Leases) Acquire(root string, zeroDepth bool, owner string, timeout time.Duration) (Lease, error) {
+	if timeout <= 0 {
+		timeout = infiniteTimeout
+	}
+	now := time.Now()
+	ld := LockDetails{
+		Root:      slashClean(root),
+		Duration:  timeout,
+		OwnerXML:  "<D:href>" + escape(owner) + "</D:href>",
+		ZeroDepth: zeroDepth,
+		Principal: owner,
+	}
+	token, err := l.LockSystem.Create(now, ld)
+	if err != nil {
+		return Lease{}, err
+	}
+	return newLease(token, now, ld), nil
+}
+
+// Refresh refreshes the lease identified by token. A zero or negative
+// timeout means that the lease never expires.
+func (l *Leases) Refresh(token string, timeout time.Duration) (Lease, error) {
+	if timeout <= 0 {
+		timeout = infiniteTimeout
+	}
+	now := time.Now()
+	ld, err := l.LockSystem.Refresh(now, token, timeout)
+	if err != nil {
+		return Lease{}, err
+	}
+	return newLease(token, now, ld), nil
+}
+
+// Confirm confirms that the lease identified by token covers the resource
+// name and holds it, so that no other lock can be created or released until
+// the returned release function is called. It should be called around each
+// modification made under the lease.
+func (l *Leases) Confirm(token, name string) (release func(), err error) {
+	return l.LockSystem.Confirm(time.Now(), slashClean(name), "", Condition{Token: token})
+}
+
+// Release releases the lease identified by token.
+func (l *Leases) Release(token string) error {
+	return l.LockSystem.Unlock(time.Now(), token)
+}
+
+type leaseRequest struct {
+	Root      string `json:"root"`
+	ZeroDepth bool   `json:"zero_depth"`
+	Owner     string `json:"owner"`
+	Timeout   int64  `json:"timeout"`
+}
+
+func (l *Leases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, l.Prefix), "/")
+	var (
+		lease  Lease
+		err    error
+		status = http.StatusOK
+	)
+	switch {
+	case r.Method == http.MethodPost && token == "":
+		var req leaseRequest
+		if json.NewDecoder(r.Body).Decode(&req) != nil || req.Root == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lease, err = l.Acquire(req.Root, req.ZeroDepth, req.Owner, time.Duration(req.Timeout)*time.Second)
+		status = http.StatusCreated
+	case r.Method == http.MethodPut && token != "":
+		var req leaseRequest
+		if json.NewDecoder(r.Body).Decode(&req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lease, err = l.Refresh(token, time.Duration(req.Timeout)*time.Second)
+	case r.Method == http.MethodDelete && token != "":
+		err = l.Release(token)
+		status = http.StatusNoContent
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch err {
+	case nil:
+	case ErrLocked:
+		w.WriteHeader(StatusLocked)
+		return
+	case ErrNoSuchLock:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case ErrForbidden:
+		w.WriteHeader(http.StatusForbidden)
+		return
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(lease)
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeases(t *testing.T) {
+	ls := NewMemLS()
+	leases := &Leases{LockSystem: ls}
+	h := &Handler{
+		FileSystem: NewMemFS(),
+		LockSystem: ls,
+	}
+	lock := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("LOCK", "/dir/file", strings.NewReader(createLockBody)))
+		if token := rec.Header().Get("Lock-Token"); token != "" {
+			ls.Unlock(time.Now(), token[1:len(token)-1])
+		}
+		return rec.Code
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("MKCOL", "/dir", nil))
+
+	lease, err := leases.Acquire("/dir", false, "indexer", time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if lease.Owner != "indexer" || lease.Root != "/dir" || lease.Expiry.IsZero() {
+		t.Fatalf("Acquire: got %+v", lease)
+	}
+	if _, err := leases.Acquire("/dir/file", true, "batch", 0); err != ErrLocked {
+		t.Fatalf("Acquire over a lease: got %v, want %v", err, ErrLocked)
+	}
+	if got := lock(); got != StatusLocked {
+		t.Fatalf("LOCK over a lease: got status %d, want %d", got, StatusLocked)
+	}
+	release, err := leases.Confirm(lease.Token, "/dir/file")
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if err := leases.Release(lease.Token); err != ErrLocked {
+		t.Fatalf("Release while confirmed: got %v, want %v", err, ErrLocked)
+	}
+	release()
+	if lease, err = leases.Refresh(lease.Token, 0); err != nil || !lease.Expiry.IsZero() {
+		t.Fatalf("Refresh: got %+v, %v", lease, err)
+	}
+	if err := leases.Release(lease.Token); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := lock(); got != http.StatusCreated {
+		t.Fatalf("LOCK after Release: got status %d, want %d", got, http.StatusCreated)
+	}
+}
+
+func TestLeasesHTTP(t *testing.T) {
+	leases := &Leases{Prefix: "/leases/", LockSystem: NewMemLS()}
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		leases.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do("POST", "/leases/", `{"root":"/a","owner":"job","timeout":60}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST: got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+	var lease Lease
+	if err := json.NewDecoder(rec.Body).Decode(&lease); err != nil {
+		t.Fatalf("POST: decode: %v", err)
+	}
+	testCases := []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"POST", "/leases/", `{"root":"/a/b"}`, StatusLocked},
+		{"POST", "/leases/", `{}`, http.StatusBadRequest},
+		{"PUT", "/leases/" + lease.Token, `{"timeout":120}`, http.StatusOK},
+		{"PUT", "/leases/unknown", `{"timeout":120}`, http.StatusNotFound},
+		{"GET", "/leases/" + lease.Token, "", http.StatusMethodNotAllowed},
+		{"DELETE", "/leases/" + lease.Token, "", http.StatusNoContent},
+		{"DELETE", "/leases/" + lease.Token, "", http.StatusNotFound},
+		{"POST", "/leases/", `{"root":"/a/b"}`, http.StatusCreated},
+	}
+	for _, tc := range testCases {
+		if rec := do(tc.method, tc.target, tc.body); rec.Code != tc.want {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.target, rec.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+	"sort"
+	"strings"
+)
+
+// LivePropertyGetter returns the value, as inner XML, of a live property
+// registered using Handler.RegisterLiveProperty. ctx is the request context
+// and name and fi identify the resource. It returns ErrNotImplemented if the
+// property is not defined for the resource.
+type LivePropertyGetter func(ctx context.Context, name string, fi os.FileInfo) (string, error)
+
+// LivePropertySetter sets p, or removes it if remove is true, on the
+// resource identified by name and fi, while serving a PROPPATCH request
+// whose context is ctx. It returns a function reverting the change, called
+// if other patches of the same request fail, see DeadPropsHolder.Patch. A
+// permission error makes the patch fail with "403 Forbidden".
+type LivePropertySetter func(ctx context.Context, name string, fi os.FileInfo, remove bool, p Property) (undo func() error, err error)
+
+// RegisterLiveProperty registers the live property pn, so that embedders
+// can expose computed properties, such as ownCloud permissions or custom
+// checksums. It replaces the property implemented by this package with the
+// same name, if any.
+//
+// Like the live properties not defined by RFC 4918, registered properties
+// are only reported when requested by name, including the include element
+// of allprop requests. If setter is nil, the property is protected.
+//
+// RegisterLiveProperty must be called before serving requests.
+func (h *Handler) RegisterLiveProperty(pn xml.Name, getter LivePropertyGetter, setter LivePropertySetter) {
+	if h.liveProps == nil {
+		h.liveProps = make(map[xml.Name]liveProp)
+	}
+	prop := liveProp{
+		dir:       true,
+		onlyNamed: true,
+	}
+	if getter != nil {
+		prop.findFn = func(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+			return getter(ctx, name, fi)
+		}
+	}
+	if setter != nil {
+		prop.patchFn = func(ctx context.Context, fs FileSystem, name string, remove bool, p Property) (func() error, error) {
+			fi, err := fs.Stat(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			return setter(ctx, name, fi, remove, p)
+		}
+	}
+	h.liveProps[pn] = prop
+}
+
+// ResourceTypeFunc returns the resource types, as inner XML, added to the
+// DAV:resourcetype property of the resource identified by name and fi,
+// such as the CalDAV calendar type. ctx is the request context.
+type ResourceTypeFunc func(ctx context.Context, name string, fi os.FileInfo) (string, error)
+
+// RegisterResourceType registers fn, so that extensions such as CalDAV and
+// CardDAV can add their resource types to the DAV:resourcetype property,
+// after the collection type of the collections. The types of the functions
+// are added in the order they are registered.
+//
+// RegisterResourceType must be called before serving requests.
+func (h *Handler) RegisterResourceType(fn ResourceTypeFunc) {
+	h.resourceTypes = append(h.resourceTypes, fn)
+}
+
+type resourceTypesKey struct{}
+
+func withResourceTypes(ctx context.Context, fns []ResourceTypeFunc) context.Context {
+	return context.WithValue(ctx, resourceTypesKey{}, fns)
+}
+
+type livePropsKey struct{}
+
+func withLiveProps(ctx context.Context, props map[xml.Name]liveProp) context.Context {
+	return context.WithValue(ctx, livePropsKey{}, props)
+}
+
+// findLiveProp returns the live property pn, looking up first the ones
+// registered using Handler.RegisterLiveProperty.
+func findLiveProp(ctx context.Context, pn xml.Name) (liveProp, bool) {
+	if props, ok := ctx.Value(livePropsKey{}).(map[xml.Name]liveProp); ok {
+		if prop, ok := props[pn]; ok {
+			return prop, true
+		}
+	}
+	prop, ok := liveProps[pn]
+	return prop, ok
+}
+
+func init() {
+	// The RFC 3253 discovery properties are registered here, as they are
+	// computed from liveProps itself. They are only reported when requested
+	// by name, as required by RFC 3253 section 3.1.
+	liveProps[xml.Name{Space: "DAV:", Local: "supported-live-property-set"}] = liveProp{
+		findFn:    findSupportedLivePropertySet,
+		dir:       true,
+		onlyNamed: true,
+	}
+	liveProps[xml.Name{Space: "DAV:", Local: "supported-report-set"}] = liveProp{
+		findFn:    findSupportedReportSet,
+		dir:       true,
+		onlyNamed: true,
+	}
+}
+
+// xmlElement returns an empty XML element named pn.
+func xmlElement(pn xml.Name) string {
+	if pn.Space == "DAV:" {
+		return "<D:" + pn.Local + "/>"
+	}
+	return "<" + pn.Local + ` xmlns="` + escapeXML(pn.Space) + `"/>`
+}
+
+func findSupportedLivePropertySet(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	props := make(map[xml.Name]liveProp, len(liveProps))
+	for pn, prop := range liveProps {
+		props[pn] = prop
+	}
+	if registered, ok := ctx.Value(livePropsKey{}).(map[xml.Name]liveProp); ok {
+		for pn, prop := range registered {
+			props[pn] = prop
+		}
+	}
+	var pnames []xml.Name
+	for pn, prop := range props {
+		if prop.findFn != nil && (prop.dir || !fi.IsDir()) && (prop.supported == nil || prop.supported(fs, fi)) {
+			pnames = append(pnames, pn)
+		}
+	}
+	sortNames(pnames)
+	var b strings.Builder
+	for _, pn := range pnames {
+		b.WriteString(`<D:supported-live-property xmlns:D="DAV:"><D:prop>`)
+		b.WriteString(xmlElement(pn))
+		b.WriteString(`</D:prop></D:supported-live-property>`)
+	}
+	return b.String(), nil
+}
+
+func findSupportedReportSet(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	var b strings.Builder
+	for _, pn := range supportedReports(ctx, fs) {
+		b.WriteString(`<D:supported-report xmlns:D="DAV:"><D:report>`)
+		b.WriteString(xmlElement(pn))
+		b.WriteString(`</D:report></D:supported-report>`)
+	}
+	return b.String(), nil
+}
+
+// sortNames sorts pnames by namespace and local name.
+func sortNames(pnames []xml.Name) {
+	sort.Slice(pnames, func(i, j int) bool {
+		if pnames[i].Space != pnames[j].Space {
+			return pnames[i].Space < pnames[j].Space
+		}
+		return pnames[i].Local < pnames[j].Local
+	})
+}
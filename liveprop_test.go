@@ -0,0 +1,217 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRegisterLiveProperty(t *testing.T) {
+	fs, err := buildTestFS([]string{"touch /file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	}
+	permissions := xml.Name{Space: "http://owncloud.org/ns", Local: "permissions"}
+	h.RegisterLiveProperty(permissions, func(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+		if ctx.Value(testCtxKey{}) != "request" {
+			t.Errorf("permissions: the getter did not receive the request context")
+		}
+		if fi.IsDir() {
+			return "RDNVCK", nil
+		}
+		return "RDNVW", nil
+	}, nil)
+	labels := make(map[string]string)
+	label := xml.Name{Space: "ns", Local: "label"}
+	h.RegisterLiveProperty(label, func(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+		v, ok := labels[name]
+		if !ok {
+			return "", ErrNotImplemented
+		}
+		return v, nil
+	}, func(ctx context.Context, name string, fi os.FileInfo, remove bool, p Property) (func() error, error) {
+		prev, existed := labels[name]
+		if remove {
+			delete(labels, name)
+		} else {
+			labels[name] = string(p.InnerXML)
+		}
+		return func() error {
+			if existed {
+				labels[name] = prev
+			} else {
+				delete(labels, name)
+			}
+			return nil
+		}, nil
+	})
+
+	do := func(method, body string) string {
+		r := httptest.NewRequest(method, "/file", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), testCtxKey{}, "request"))
+		r.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != StatusMulti {
+			t.Fatalf("%s %s: got status %d, want %d", method, body, w.Code, StatusMulti)
+		}
+		return w.Body.String()
+	}
+	const (
+		propfind = `<D:propfind xmlns:D="DAV:" xmlns:O="http://owncloud.org/ns" xmlns:Z="ns">` +
+			`<D:prop><O:permissions/><Z:label/></D:prop></D:propfind>`
+		setLabel = `<D:propertyupdate xmlns:D="DAV:" xmlns:Z="ns">` +
+			`<D:set><D:prop><Z:label>red</Z:label></D:prop></D:set></D:propertyupdate>`
+		setPermissions = `<D:propertyupdate xmlns:D="DAV:" xmlns:O="http://owncloud.org/ns" xmlns:Z="ns">` +
+			`<D:set><D:prop><Z:label>blue</Z:label><O:permissions>R</O:permissions></D:prop></D:set></D:propertyupdate>`
+	)
+
+	if got := do("PROPFIND", propfind); !strings.Contains(got, ">RDNVW</") || !strings.Contains(got, "404 Not Found") {
+		t.Fatalf("PROPFIND: got %s, want permissions and a missing label", got)
+	}
+	if got := do("PROPFIND", ""); strings.Contains(got, "permissions") {
+		t.Fatalf("PROPFIND allprop: got %s, want no registered properties", got)
+	}
+	if got := do("PROPPATCH", setLabel); !strings.Contains(got, "200 OK") || labels["/file"] != "red" {
+		t.Fatalf("PROPPATCH: got %s and label %q, want red", got, labels["/file"])
+	}
+	got := do("PROPPATCH", setPermissions)
+	if !strings.Contains(got, "403 Forbidden") || !strings.Contains(got, "424 Failed Dependency") || labels["/file"] != "red" {
+		t.Fatalf("PROPPATCH protected: got %s and label %q, want 403 and red", got, labels["/file"])
+	}
+	if got := do("PROPFIND", propfind); !strings.Contains(got, ">red</") {
+		t.Fatalf("PROPFIND: got %s, want the label", got)
+	}
+}
+
+type testCtxKey struct{}
+
+func TestSupportedLivePropertySet(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /dir", "touch /dir/file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	}
+	h.RegisterLiveProperty(xml.Name{Space: "http://owncloud.org/ns", Local: "permissions"},
+		func(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+			return "RDNVW", nil
+		}, nil)
+	propfind := func(target, prop string) string {
+		body := `<D:propfind xmlns:D="DAV:"><D:prop><D:` + prop + `/></D:prop></D:propfind>`
+		r := httptest.NewRequest("PROPFIND", target, strings.NewReader(body))
+		r.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	supported := func(prop string) string {
+		return `<D:supported-live-property xmlns:D="DAV:"><D:prop>` + prop + "</D:prop></D:supported-live-property>"
+	}
+
+	testCases := []struct {
+		target      string
+		want, avoid []string
+	}{{
+		target: "/dir/file",
+		want: []string{
+			supported("<D:getetag/>"),
+			supported("<D:getcontentlength/>"),
+			supported("<D:supported-live-property-set/>"),
+			supported(`<permissions xmlns="http://owncloud.org/ns"/>`),
+		},
+		avoid: []string{
+			// Hidden and dead-only properties are not live.
+			supported("<D:getcontentlanguage/>"),
+		},
+	}, {
+		target: "/dir",
+		want: []string{
+			supported("<D:resourcetype/>"),
+			supported(`<permissions xmlns="http://owncloud.org/ns"/>`),
+		},
+		avoid: []string{
+			supported("<D:getcontentlength/>"),
+		},
+	}}
+	for _, tc := range testCases {
+		got := propfind(tc.target, "supported-live-property-set")
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: got %s, want %s", tc.target, got, want)
+			}
+		}
+		for _, avoid := range tc.avoid {
+			if strings.Contains(got, avoid) {
+				t.Errorf("%s: got %s, want no %s", tc.target, got, avoid)
+			}
+		}
+	}
+
+	if got := propfind("/dir", "supported-report-set"); !strings.Contains(got, "<D:supported-report-set></D:supported-report-set>") {
+		t.Errorf("supported-report-set: got %s, want an empty set", got)
+	}
+	if got := propfind("/dir", "allprop"); strings.Contains(got, "supported-live-property-set") {
+		t.Errorf("allprop: got %s, want no supported-live-property-set", got)
+	}
+}
+
+func TestRegisterResourceType(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /cal", "mkdir /book", "touch /file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	}
+	typeOf := func(dir, elem string) ResourceTypeFunc {
+		return func(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+			if name != dir {
+				return "", nil
+			}
+			return "<" + elem + ` xmlns="urn:test"/>`, nil
+		}
+	}
+	h.RegisterResourceType(typeOf("/cal", "calendar"))
+	h.RegisterResourceType(typeOf("/book", "addressbook"))
+	testCases := []struct {
+		target, want string
+	}{
+		{"/cal", `<D:resourcetype><D:collection xmlns:D="DAV:"/><calendar xmlns="urn:test"/></D:resourcetype>`},
+		{"/book", `<D:resourcetype><D:collection xmlns:D="DAV:"/><addressbook xmlns="urn:test"/></D:resourcetype>`},
+		{"/file", `<D:resourcetype></D:resourcetype>`},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest("PROPFIND", tc.target, strings.NewReader(`<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/></D:prop></D:propfind>`))
+		r.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("%s: got %q, want it to contain %q", tc.target, w.Body.String(), tc.want)
+		}
+	}
+}
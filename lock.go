@@ -20,7 +20,10 @@ package webdav
 
 import (
 	"container/heap"
+	"crypto/rand"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"path"
 	"strconv"
 	"strings"
@@ -37,6 +40,9 @@ var (
 	ErrLocked = errors.New("webdav: locked")
 	// ErrNoSuchLock is returned by a LockSystem's Refresh and Unlock methods.
 	ErrNoSuchLock = errors.New("webdav: no such lock")
+	// ErrLockLimitExceeded is returned by a LimitedLocker's CreateWithLimits
+	// method.
+	ErrLockLimitExceeded = errors.New("webdav: lock limit exceeded")
 )
 
 // Condition can match a WebDAV resource, based on a token or ETag.
@@ -126,6 +132,107 @@ type LockDeleter interface {
 	Delete(now time.Time, name string) error
 }
 
+// ActiveLock is a lock that applies to a resource, as reported by lock
+// discovery.
+type ActiveLock struct {
+	// Token identifies the lock.
+	Token string
+	// Expiry is when the lock expires. It is the zero time for locks with an
+	// infinite duration.
+	Expiry time.Time
+	// Details are the lock's metadata.
+	Details LockDetails
+}
+
+// LockLister extends a LockSystem to report every lock applying to a
+// resource. GetByName returns only the nearest lock, while a resource can be
+// covered by its own zero-depth lock and by an infinite-depth lock held on
+// one of its ancestors.
+type LockLister interface {
+	// GetAllByName returns all the locks applying to name: the lock rooted
+	// at name, if any, and the infinite-depth locks rooted at its ancestors.
+	// It returns an empty slice and a nil error if no lock applies.
+	GetAllByName(name string) ([]ActiveLock, error)
+}
+
+// TokenLookup extends a LockSystem to look up locks by token. The Handler
+// uses it to validate UNLOCK requests before unlocking.
+type TokenLookup interface {
+	// GetByToken returns the details and the expiration time of the lock
+	// with the given token. The expiration time is the zero time for locks
+	// with an infinite duration.
+	// It returns ErrNoSuchLock if no lock with the given token is found.
+	GetByToken(token string) (LockDetails, time.Time, error)
+}
+
+// LockLimits are the limits to the number of locks a LockSystem can hold.
+// A zero limit means no limit.
+type LockLimits struct {
+	// MaxTotal is the maximum number of locks.
+	MaxTotal int
+	// MaxPerPrincipal is the maximum number of locks for each principal, as
+	// recorded in LockDetails.Principal. Anonymous locks are not limited.
+	MaxPerPrincipal int
+	// MaxPerSubtree maps slash-separated resource names to the maximum
+	// number of locks rooted at or below them.
+	MaxPerSubtree map[string]int
+	// Status is the HTTP status the Handler writes if a limit is exceeded.
+	// If zero, "423 Locked" is used.
+	Status int
+}
+
+func (l *LockLimits) isZero() bool {
+	return l.MaxTotal == 0 && l.MaxPerPrincipal == 0 && len(l.MaxPerSubtree) == 0
+}
+
+// LimitedLocker extends a LockSystem to enforce LockLimits when creating
+// locks. The Handler only enforces the limits on LOCK requests, the
+// temporary locks taken while serving other requests are not limited.
+type LimitedLocker interface {
+	// CreateWithLimits is like Create but it returns ErrLockLimitExceeded,
+	// without creating the lock, if the lock would exceed limits.
+	CreateWithLimits(now time.Time, details LockDetails, limits LockLimits) (token string, err error)
+}
+
+// LockNullLister extends a LockSystem to list the lock-null resources within
+// a collection, so that they can be reported in PROPFIND responses.
+type LockNullLister interface {
+	// LockNullChildren returns the locks whose details have LockNull set and
+	// whose root is an immediate child of name.
+	LockNullChildren(name string) ([]ActiveLock, error)
+}
+
+// LockEnumerator extends a LockSystem to list all of its locks, so that
+// they can be inspected and broken using the Admin API.
+type LockEnumerator interface {
+	// Locks returns all the locks that are not expired at now.
+	Locks(now time.Time) ([]ActiveLock, error)
+}
+
+// LockOwnerSwapper extends a LockSystem to change the owner of a lock without
+// unlocking it, so that no other client can take the lock in between.
+type LockOwnerSwapper interface {
+	// SwapOwner sets the OwnerXML of the lock with the given token to
+	// ownerXML, if it is oldOwnerXML, and refreshes the lock like Refresh.
+	// It returns ErrConfirmationFailed, leaving the lock unchanged, if the
+	// OwnerXML is not oldOwnerXML.
+	SwapOwner(now time.Time, token, oldOwnerXML, ownerXML string, duration time.Duration) (LockDetails, error)
+}
+
+// LockReplacer extends a LockSystem to replace a lock by a new one
+// atomically, so that taking over a lock neither lets another client lock
+// the resource in between nor loses the lock if the new one is refused.
+type LockReplacer interface {
+	// Replace removes the lock with the given token and creates a lock with
+	// the given details in its place, enforcing limits like CreateWithLimits
+	// as if the removed lock did not exist. Zero limits are not enforced.
+	// If the new lock cannot be created, the lock with the given token is
+	// left unchanged and the error of CreateWithLimits is returned. It
+	// returns ErrNoSuchLock if there is no lock with the given token, and
+	// ErrLocked if it is held by a Confirm call.
+	Replace(now time.Time, token string, details LockDetails, limits LockLimits) (string, error)
+}
+
 // LockDetails are a lock's metadata.
 type LockDetails struct {
 	// Root is the root resource name being locked. For a zero-depth lock, the
@@ -142,14 +249,40 @@ type LockDetails struct {
 	// ZeroDepth is whether the lock has zero depth. If it does not have zero
 	// depth, it has infinite depth.
 	ZeroDepth bool
+	// Principal is the name of the principal that created the lock, if
+	// known. See Handler.Principal.
+	Principal string
+	// LockNull is whether the lock was created on an unmapped URL without
+	// creating the resource, as described by RFC 2518 for lock-null
+	// resources. See Handler.LockNullResources.
+	LockNull bool
+	// Created is when the lock was created. If zero, it is set by the
+	// LockSystem when creating the lock, and it is preserved by Refresh.
+	Created time.Time
 }
 
-// NewMemLS returns a new in-memory LockSystem.
+// NewMemLS returns a new in-memory LockSystem. Its lock tokens are
+// opaquelocktoken URIs, as described in RFC 4918 Appendix C, that some
+// clients require.
+//
+// The returned LockSystem implements encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler, so that its lock table can be saved on
+// shutdown and restored at startup.
 func NewMemLS() LockSystem {
+	return NewMemLSScheme("")
+}
+
+// NewMemLSScheme is like NewMemLS, but its lock tokens are random UUIDs
+// prefixed by the given URI scheme and a colon, such as "urn:uuid". An empty
+// scheme means "opaquelocktoken".
+func NewMemLSScheme(scheme string) LockSystem {
+	if scheme == "" {
+		scheme = "opaquelocktoken"
+	}
 	return &memLS{
 		byName:  make(map[string]*memLSNode),
 		byToken: make(map[string]*memLSNode),
-		gen:     uint64(time.Now().Unix()),
+		scheme:  scheme + ":",
 	}
 }
 
@@ -157,15 +290,24 @@ type memLS struct {
 	mu      sync.Mutex
 	byName  map[string]*memLSNode
 	byToken map[string]*memLSNode
-	gen     uint64
+	scheme  string
 	// byExpiry only contains those nodes whose LockDetails have a finite
 	// Duration and are yet to expire.
 	byExpiry byExpiry
 }
 
 func (m *memLS) nextToken() string {
-	m.gen++
-	return strconv.FormatUint(m.gen, 10)
+	for {
+		var u [16]byte
+		rand.Read(u[:])
+		// Set the version (4) and the variant (RFC 4122) bits.
+		u[6] = u[6]&0x0f | 0x40
+		u[8] = u[8]&0x3f | 0x80
+		token := fmt.Sprintf("%s%x-%x-%x-%x-%x", m.scheme, u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+		if m.byToken[token] == nil {
+			return token
+		}
+	}
 }
 
 func (m *memLS) collectExpiredNodes(now time.Time) {
@@ -271,15 +413,78 @@ func (m *memLS) Create(now time.Time, details LockDetails) (string, error) {
 	if !m.canCreate(details.Root, details.ZeroDepth) {
 		return "", ErrLocked
 	}
+	return m.createLock(now, details), nil
+}
+
+func (m *memLS) CreateWithLimits(now time.Time, details LockDetails, limits LockLimits) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectExpiredNodes(now)
+	details.Root = slashClean(details.Root)
+
+	if !m.canCreate(details.Root, details.ZeroDepth) {
+		return "", ErrLocked
+	}
+	if m.exceedsLimits(details, limits) {
+		return "", ErrLockLimitExceeded
+	}
+	return m.createLock(now, details), nil
+}
+
+// exceedsLimits returns whether creating a lock with the given details would
+// exceed limits.
+func (m *memLS) exceedsLimits(details LockDetails, limits LockLimits) bool {
+	if limits.MaxTotal > 0 && len(m.byToken) >= limits.MaxTotal {
+		return true
+	}
+	if limits.MaxPerPrincipal > 0 && details.Principal != "" {
+		count := 0
+		for _, n := range m.byToken {
+			if n.details.Principal == details.Principal {
+				count++
+			}
+		}
+		if count >= limits.MaxPerPrincipal {
+			return true
+		}
+	}
+	for subtree, max := range limits.MaxPerSubtree {
+		subtree = slashClean(subtree)
+		if max <= 0 || !isWithin(details.Root, subtree) {
+			continue
+		}
+		count := 0
+		for _, n := range m.byToken {
+			if isWithin(n.details.Root, subtree) {
+				count++
+			}
+		}
+		if count >= max {
+			return true
+		}
+	}
+	return false
+}
+
+// isWithin returns whether the clean name is root or one of its descendants.
+func isWithin(name, root string) bool {
+	return root == "/" || name == root || strings.HasPrefix(name, root+"/")
+}
+
+// createLock creates a lock that canCreate allowed. The caller must hold m.mu.
+func (m *memLS) createLock(now time.Time, details LockDetails) string {
 	n := m.create(details.Root)
 	n.token = m.nextToken()
 	m.byToken[n.token] = n
 	n.details = details
+	if n.details.Created.IsZero() {
+		n.details.Created = now
+	}
 	if n.details.Duration >= 0 {
 		n.expiry = now.Add(n.details.Duration)
 		heap.Push(&m.byExpiry, n)
 	}
-	return n.token, nil
+	return n.token
 }
 
 func (m *memLS) Refresh(now time.Time, token string, duration time.Duration) (LockDetails, error) {
@@ -294,6 +499,67 @@ func (m *memLS) Refresh(now time.Time, token string, duration time.Duration) (Lo
 	if n.held {
 		return LockDetails{}, ErrLocked
 	}
+	m.refresh(now, n, duration)
+	return n.details, nil
+}
+
+func (m *memLS) Replace(now time.Time, token string, details LockDetails, limits LockLimits) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectExpiredNodes(now)
+	details.Root = slashClean(details.Root)
+
+	n := m.byToken[token]
+	if n == nil {
+		return "", ErrNoSuchLock
+	}
+	if n.held {
+		return "", ErrLocked
+	}
+	old, expiry := n.details, n.expiry
+	m.remove(n)
+	err := ErrLocked
+	if m.canCreate(details.Root, details.ZeroDepth) {
+		if !m.exceedsLimits(details, limits) {
+			return m.createLock(now, details), nil
+		}
+		err = ErrLockLimitExceeded
+	}
+	// Put the removed lock back, with its token and expiry.
+	n = m.create(old.Root)
+	n.token = token
+	m.byToken[token] = n
+	n.details = old
+	if old.Duration >= 0 {
+		n.expiry = expiry
+		heap.Push(&m.byExpiry, n)
+	}
+	return "", err
+}
+
+func (m *memLS) SwapOwner(now time.Time, token, oldOwnerXML, ownerXML string, duration time.Duration) (LockDetails, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectExpiredNodes(now)
+
+	n := m.byToken[token]
+	if n == nil {
+		return LockDetails{}, ErrNoSuchLock
+	}
+	if n.held {
+		return LockDetails{}, ErrLocked
+	}
+	if n.details.OwnerXML != oldOwnerXML {
+		return LockDetails{}, ErrConfirmationFailed
+	}
+	n.details.OwnerXML = ownerXML
+	m.refresh(now, n, duration)
+	return n.details, nil
+}
+
+// refresh sets the duration of the lock n, and its expiry from now. The
+// caller must hold m.mu.
+func (m *memLS) refresh(now time.Time, n *memLSNode, duration time.Duration) {
 	if n.byExpiryIndex >= 0 {
 		heap.Remove(&m.byExpiry, n.byExpiryIndex)
 	}
@@ -302,7 +568,6 @@ func (m *memLS) Refresh(now time.Time, token string, duration time.Duration) (Lo
 		n.expiry = now.Add(n.details.Duration)
 		heap.Push(&m.byExpiry, n)
 	}
-	return n.details, nil
 }
 
 func (m *memLS) Unlock(now time.Time, token string) error {
@@ -355,6 +620,176 @@ func (m *memLS) GetByName(name string) (string, time.Time, LockDetails, error) {
 	}
 }
 
+func (m *memLS) GetByToken(token string) (LockDetails, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectExpiredNodes(time.Now())
+
+	n := m.byToken[token]
+	if n == nil {
+		return LockDetails{}, time.Time{}, ErrNoSuchLock
+	}
+	return n.details, n.expiry, nil
+}
+
+func (m *memLS) GetAllByName(name string) ([]ActiveLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectExpiredNodes(time.Now())
+
+	var locks []ActiveLock
+	walkToRoot(slashClean(name), func(name0 string, first bool) bool {
+		n := m.byName[name0]
+		if n == nil || n.token == "" {
+			return true
+		}
+		if first || !n.details.ZeroDepth {
+			locks = append(locks, ActiveLock{
+				Token:   n.token,
+				Expiry:  n.expiry,
+				Details: n.details,
+			})
+		}
+		return true
+	})
+	return locks, nil
+}
+
+func (m *memLS) LockNullChildren(name string) ([]ActiveLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectExpiredNodes(time.Now())
+
+	name = slashClean(name)
+	var locks []ActiveLock
+	for token, n := range m.byToken {
+		if n.details.LockNull && n.details.Root != "/" && path.Dir(n.details.Root) == name {
+			locks = append(locks, ActiveLock{
+				Token:   token,
+				Expiry:  n.expiry,
+				Details: n.details,
+			})
+		}
+	}
+	return locks, nil
+}
+
+func (m *memLS) Locks(now time.Time) ([]ActiveLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectExpiredNodes(now)
+
+	locks := make([]ActiveLock, 0, len(m.byToken))
+	for token, n := range m.byToken {
+		locks = append(locks, ActiveLock{
+			Token:   token,
+			Expiry:  n.expiry,
+			Details: n.details,
+		})
+	}
+	return locks, nil
+}
+
+// memLSSnapshot is the serialized form of a memLS.
+type memLSSnapshot struct {
+	Version int                 `json:"version"`
+	Locks   []memLSSnapshotLock `json:"locks"`
+}
+
+type memLSSnapshotLock struct {
+	Token     string        `json:"token"`
+	Root      string        `json:"root"`
+	Duration  time.Duration `json:"duration"`
+	Expiry    time.Time     `json:"expiry,omitempty"`
+	OwnerXML  string        `json:"owner_xml,omitempty"`
+	ZeroDepth bool          `json:"zero_depth,omitempty"`
+	Principal string        `json:"principal,omitempty"`
+	LockNull  bool          `json:"lock_null,omitempty"`
+	Created   time.Time     `json:"created,omitempty"`
+}
+
+// MarshalBinary returns a snapshot of the locks held by m. Whether a lock is
+// currently held by a Confirm call is not part of the snapshot.
+func (m *memLS) MarshalBinary() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectExpiredNodes(time.Now())
+
+	snapshot := memLSSnapshot{
+		Version: 1,
+		Locks:   make([]memLSSnapshotLock, 0, len(m.byToken)),
+	}
+	for token, n := range m.byToken {
+		snapshot.Locks = append(snapshot.Locks, memLSSnapshotLock{
+			Token:     token,
+			Root:      n.details.Root,
+			Duration:  n.details.Duration,
+			Expiry:    n.expiry,
+			OwnerXML:  n.details.OwnerXML,
+			ZeroDepth: n.details.ZeroDepth,
+			Principal: n.details.Principal,
+			LockNull:  n.details.LockNull,
+			Created:   n.details.Created,
+		})
+	}
+	return json.Marshal(snapshot)
+}
+
+// UnmarshalBinary replaces the locks held by m with the ones in a snapshot
+// returned by MarshalBinary. Locks expired in the meantime are discarded.
+func (m *memLS) UnmarshalBinary(data []byte) error {
+	var snapshot memLSSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != 1 {
+		return errInvalidLockSnapshot
+	}
+
+	// Restore the snapshot into a new memLS, so that m is left untouched if
+	// the snapshot is invalid.
+	tmp := &memLS{
+		byName:  make(map[string]*memLSNode),
+		byToken: make(map[string]*memLSNode),
+	}
+	now := time.Now()
+	for _, l := range snapshot.Locks {
+		root := slashClean(l.Root)
+		if l.Token == "" || tmp.byToken[l.Token] != nil {
+			return errInvalidLockSnapshot
+		}
+		if l.Duration >= 0 && !now.Before(l.Expiry) {
+			continue
+		}
+		if !tmp.canCreate(root, l.ZeroDepth) {
+			return errInvalidLockSnapshot
+		}
+		n := tmp.create(root)
+		n.token = l.Token
+		tmp.byToken[n.token] = n
+		n.details = LockDetails{
+			Root:      root,
+			Duration:  l.Duration,
+			OwnerXML:  l.OwnerXML,
+			ZeroDepth: l.ZeroDepth,
+			Principal: l.Principal,
+			LockNull:  l.LockNull,
+			Created:   l.Created,
+		}
+		if n.details.Duration >= 0 {
+			n.expiry = l.Expiry
+			heap.Push(&tmp.byExpiry, n)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.byName = tmp.byName
+	m.byToken = tmp.byToken
+	m.byExpiry = tmp.byExpiry
+	return nil
+}
+
 func (m *memLS) canCreate(name string, zeroDepth bool) bool {
 	return walkToRoot(name, func(name0 string, first bool) bool {
 		n := m.byName[name0]
@@ -488,14 +923,54 @@ const infiniteTimeout = -1
 
 // parseTimeout parses the Timeout HTTP header, as per section 10.7. If s is
 // empty, an infiniteTimeout is returned.
-func parseTimeout(s string) (time.Duration, error) {
+//
+// The header may list several values, in order of preference. The first one
+// not exceeding max is returned, infinite timeouts exceed any positive max.
+// If no value is acceptable, max is returned. A zero or negative max means
+// that any value is acceptable.
+func parseTimeout(s string, max time.Duration) (time.Duration, error) {
 	if s == "" {
-		return infiniteTimeout, nil
+		s = "Infinite"
+	}
+	values := strings.Split(s, ",")
+	durations := make([]time.Duration, len(values))
+	for i, v := range values {
+		d, err := parseTimeType(strings.TrimSpace(v))
+		if err != nil {
+			return 0, err
+		}
+		durations[i] = d
 	}
-	if i := strings.IndexByte(s, ','); i >= 0 {
-		s = s[:i]
+	for _, d := range durations {
+		if max <= 0 || (d != infiniteTimeout && d <= max) {
+			return d, nil
+		}
 	}
-	s = strings.TrimSpace(s)
+	return max, nil
+}
+
+// minTimeout returns the timeout granted to a lock whose requested timeout,
+// already limited to max, is d. Finite timeouts shorter than min, if positive,
+// are raised to min, but never above max. Otherwise, zero timeouts are
+// refused, since such locks would expire before the response reaches the
+// client.
+func minTimeout(d, min, max time.Duration) (time.Duration, error) {
+	if max > 0 && min > max {
+		min = max
+	}
+	switch {
+	case d == infiniteTimeout:
+		return d, nil
+	case min > 0 && d < min:
+		return min, nil
+	case d <= 0:
+		return 0, errInvalidTimeout
+	}
+	return d, nil
+}
+
+// parseTimeType parses a single TimeType value of the Timeout HTTP header.
+func parseTimeType(s string) (time.Duration, error) {
 	if s == "Infinite" {
 		return infiniteTimeout, nil
 	}
@@ -7,8 +7,11 @@ package webdav
 import (
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"path"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -321,6 +324,302 @@ func TestMemLSNonCanonicalRoot(t *testing.T) {
 	}
 }
 
+func TestMemLSGetAllByName(t *testing.T) {
+	now := time.Now()
+	m := NewMemLS().(*memLS)
+	create := func(root string, zeroDepth bool) string {
+		token, err := m.Create(now, LockDetails{
+			Root:      root,
+			Duration:  infiniteTimeout,
+			ZeroDepth: zeroDepth,
+		})
+		if err != nil {
+			t.Fatalf("Create %q: %v", root, err)
+		}
+		return token
+	}
+	tokA := create("/a", false)
+	create("/x", true)
+	create("/x/y", true)
+
+	testCases := []struct {
+		name string
+		want []string
+	}{
+		{"/", nil},
+		{"/a", []string{"/a"}},
+		{"/a/b", []string{"/a"}},
+		{"/a/b/c", []string{"/a"}},
+		{"/x", []string{"/x"}},
+		{"/x/y", []string{"/x/y"}},
+		{"/x/z", nil},
+	}
+	for _, tc := range testCases {
+		locks, err := m.GetAllByName(tc.name)
+		if err != nil {
+			t.Fatalf("GetAllByName %q: %v", tc.name, err)
+		}
+		var got []string
+		for _, l := range locks {
+			got = append(got, l.Details.Root)
+			if l.Details.Root == "/a" && l.Token != tokA {
+				t.Errorf("GetAllByName %q: token for /a: got %q, want %q", tc.name, l.Token, tokA)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("GetAllByName %q:\ngot  %q\nwant %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMemLSCreateWithLimits(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := NewMemLS().(*memLS)
+	limits := LockLimits{
+		MaxTotal:        4,
+		MaxPerPrincipal: 2,
+		MaxPerSubtree:   map[string]int{"/a": 1},
+	}
+	testCases := []struct {
+		root, principal string
+		wantErr         error
+	}{
+		{"/a/1", "alice", nil},
+		{"/a/2", "bob", ErrLockLimitExceeded},
+		{"/b/1", "alice", nil},
+		{"/b/2", "alice", ErrLockLimitExceeded},
+		{"/b/2", "bob", nil},
+		{"/b/3", "", nil},
+		{"/b/4", "", ErrLockLimitExceeded},
+		{"/b/1", "carol", ErrLocked},
+	}
+	for i, tc := range testCases {
+		_, err := m.CreateWithLimits(now, LockDetails{
+			Root:      tc.root,
+			Duration:  infiniteTimeout,
+			ZeroDepth: true,
+			Principal: tc.principal,
+		}, limits)
+		if err != tc.wantErr {
+			t.Fatalf("#%d: CreateWithLimits %q by %q: got %v, want %v", i, tc.root, tc.principal, err, tc.wantErr)
+		}
+		if err := m.consistent(); err != nil {
+			t.Fatalf("#%d: inconsistent state: %v", i, err)
+		}
+	}
+	// Create is not limited.
+	if _, err := m.Create(now, LockDetails{Root: "/c", Duration: infiniteTimeout}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+}
+
+func TestMemLSSnapshot(t *testing.T) {
+	now := time.Now()
+	m := NewMemLS().(*memLS)
+	details := []LockDetails{{
+		Root:      "/a",
+		Duration:  infiniteTimeout,
+		OwnerXML:  "<D:href>owner</D:href>",
+		Principal: "alice",
+	}, {
+		Root:      "/b/c",
+		Duration:  time.Hour,
+		ZeroDepth: true,
+	}, {
+		Root:     "/expired",
+		Duration: 0,
+	}}
+	tokens := make([]string, len(details))
+	for i, d := range details {
+		token, err := m.Create(now, d)
+		if err != nil {
+			t.Fatalf("Create %q: %v", d.Root, err)
+		}
+		tokens[i] = token
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	restored := NewMemLS().(*memLS)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if err := restored.consistent(); err != nil {
+		t.Fatalf("UnmarshalBinary: inconsistent state: %v", err)
+	}
+	for i, d := range details[:2] {
+		token, _, got, err := restored.GetByName(d.Root)
+		if err != nil {
+			t.Fatalf("GetByName %q: %v", d.Root, err)
+		}
+		if !got.Created.Equal(now) {
+			t.Errorf("GetByName %q: got created %v, want %v", d.Root, got.Created, now)
+		}
+		got.Created = time.Time{}
+		if token != tokens[i] || !reflect.DeepEqual(got, d) {
+			t.Errorf("GetByName %q: got %q %+v, want %q %+v", d.Root, token, got, tokens[i], d)
+		}
+	}
+	if _, _, _, err := restored.GetByName("/expired"); err != ErrNoSuchLock {
+		t.Errorf("GetByName /expired: got %v, want %v", err, ErrNoSuchLock)
+	}
+	if err := restored.Unlock(now, tokens[0]); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	token, err := restored.Create(now, LockDetails{Root: "/d", Duration: infiniteTimeout})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for _, tok := range tokens {
+		if token == tok {
+			t.Fatalf("Create: token %q reused after UnmarshalBinary", token)
+		}
+	}
+
+	if err := restored.UnmarshalBinary([]byte(`{"version":2}`)); err == nil {
+		t.Fatalf("UnmarshalBinary: unsupported version accepted")
+	}
+	if _, _, _, err := restored.GetByName("/d"); err != nil {
+		t.Fatalf("GetByName /d after a failed UnmarshalBinary: %v", err)
+	}
+}
+
+func TestMemLSGetByToken(t *testing.T) {
+	now := time.Now()
+	m := NewMemLS().(*memLS)
+	details := LockDetails{
+		Root:     "/a/b",
+		Duration: time.Hour,
+		OwnerXML: "<D:href>owner</D:href>",
+	}
+	token, err := m.Create(now, details)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	details.Created = now
+	got, expiry, err := m.GetByToken(token)
+	if err != nil {
+		t.Fatalf("GetByToken: %v", err)
+	}
+	if !reflect.DeepEqual(got, details) {
+		t.Fatalf("GetByToken: got %+v, want %+v", got, details)
+	}
+	if want := now.Add(time.Hour); !expiry.Equal(want) {
+		t.Fatalf("GetByToken: got expiry %v, want %v", expiry, want)
+	}
+	if err := m.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if _, _, err := m.GetByToken(token); err != ErrNoSuchLock {
+		t.Fatalf("GetByToken after Unlock: got %v, want %v", err, ErrNoSuchLock)
+	}
+}
+
+func TestMemLSSwapOwner(t *testing.T) {
+	now := time.Now()
+	m := NewMemLS().(*memLS)
+	token, err := m.Create(now, LockDetails{
+		Root:     "/a",
+		Duration: time.Minute,
+		OwnerXML: "old",
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := m.SwapOwner(now, token, "other", "new", time.Hour); err != ErrConfirmationFailed {
+		t.Fatalf("SwapOwner with the wrong owner: got %v, want %v", err, ErrConfirmationFailed)
+	}
+	later := now.Add(30 * time.Second)
+	ld, err := m.SwapOwner(later, token, "old", "new", time.Hour)
+	if err != nil {
+		t.Fatalf("SwapOwner: %v", err)
+	}
+	if ld.OwnerXML != "new" || ld.Duration != time.Hour {
+		t.Fatalf("SwapOwner: got owner %q and duration %v, want %q and %v", ld.OwnerXML, ld.Duration, "new", time.Hour)
+	}
+	if _, expiry, _ := m.GetByToken(token); !expiry.Equal(later.Add(time.Hour)) {
+		t.Fatalf("SwapOwner: got expiry %v, want %v", expiry, later.Add(time.Hour))
+	}
+	if _, err := m.SwapOwner(now, "missing", "new", "newer", time.Hour); err != ErrNoSuchLock {
+		t.Fatalf("SwapOwner of a missing lock: got %v, want %v", err, ErrNoSuchLock)
+	}
+}
+
+func TestMemLSReplace(t *testing.T) {
+	now := time.Now()
+	m := NewMemLS().(*memLS)
+	token, err := m.Create(now, LockDetails{
+		Root:      "/a",
+		Duration:  time.Minute,
+		Principal: "alice",
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := m.Create(now, LockDetails{Root: "/b", Duration: time.Minute, Principal: "bob"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	details := LockDetails{Root: "/a", Duration: time.Hour, Principal: "bob"}
+	if _, err := m.Replace(now, token, details, LockLimits{MaxPerPrincipal: 1}); err != ErrLockLimitExceeded {
+		t.Fatalf("Replace over the limit: got %v, want %v", err, ErrLockLimitExceeded)
+	}
+	ld, expiry, err := m.GetByToken(token)
+	if err != nil || ld.Principal != "alice" || !expiry.Equal(now.Add(time.Minute)) {
+		t.Fatalf("GetByToken after a refused Replace: got %+v, %v, %v, want the lock of alice", ld, expiry, err)
+	}
+	if _, err := m.Replace(now, token, LockDetails{Root: "/b", Duration: time.Hour}, LockLimits{}); err != ErrLocked {
+		t.Fatalf("Replace with a locked root: got %v, want %v", err, ErrLocked)
+	}
+	newToken, err := m.Replace(now, token, details, LockLimits{})
+	if err != nil {
+		t.Fatalf("Replace: %v", err)
+	}
+	if _, _, err := m.GetByToken(token); err != ErrNoSuchLock {
+		t.Fatalf("GetByToken of the replaced lock: got %v, want %v", err, ErrNoSuchLock)
+	}
+	if ld, _, err := m.GetByToken(newToken); err != nil || ld.Principal != "bob" {
+		t.Fatalf("GetByToken of the new lock: got %+v, %v, want the lock of bob", ld, err)
+	}
+	if _, err := m.Replace(now, token, details, LockLimits{}); err != ErrNoSuchLock {
+		t.Fatalf("Replace of a missing lock: got %v, want %v", err, ErrNoSuchLock)
+	}
+}
+
+func TestMemLSTokenScheme(t *testing.T) {
+	uuid := `[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`
+	testCases := []struct {
+		scheme string
+		want   *regexp.Regexp
+	}{
+		{"", regexp.MustCompile(`^opaquelocktoken:` + uuid + `$`)},
+		{"urn:uuid", regexp.MustCompile(`^urn:uuid:` + uuid + `$`)},
+	}
+	now := time.Now()
+	for _, tc := range testCases {
+		m := NewMemLSScheme(tc.scheme)
+		seen := make(map[string]bool)
+		for i := 0; i < 3; i++ {
+			token, err := m.Create(now, LockDetails{
+				Root:     fmt.Sprintf("/%d", i),
+				Duration: -1,
+			})
+			if err != nil {
+				t.Fatalf("scheme %q: Create: %v", tc.scheme, err)
+			}
+			if !tc.want.MatchString(token) {
+				t.Errorf("scheme %q: got token %q, want a match for %s", tc.scheme, token, tc.want)
+			}
+			if seen[token] {
+				t.Errorf("scheme %q: duplicate token %q", tc.scheme, token)
+			}
+			seen[token] = true
+		}
+	}
+}
+
 func TestMemLSExpiry(t *testing.T) {
 	m := NewMemLS().(*memLS)
 	testCases := []string{
@@ -362,6 +661,7 @@ func TestMemLSExpiry(t *testing.T) {
 	}
 
 	tokens := map[string]string{}
+	created := map[string]time.Time{}
 	zTime := time.Unix(0, 0)
 	now := zTime
 	for i, tc := range testCases {
@@ -397,6 +697,7 @@ func TestMemLSExpiry(t *testing.T) {
 					t.Fatalf("test case #%d %q: Create: %v", i, tc, err)
 				}
 				tokens[root] = token
+				created[root] = now
 
 			case "refresh":
 				token := tokens[root]
@@ -411,6 +712,7 @@ func TestMemLSExpiry(t *testing.T) {
 					Root:      root,
 					Duration:  dur,
 					ZeroDepth: true,
+					Created:   created[root],
 				}
 				if got != want {
 					t.Fatalf("test case #%d %q:\ngot  %v\nwant %v", i, tc, got, want)
@@ -719,17 +1021,92 @@ func TestParseTimeout(t *testing.T) {
 		// infinite-length lock, if available, otherwise a timeout of 4.1
 		// billion seconds, if available."
 		//
-		// The Go WebDAV package always supports infinite length locks,
-		// and ignores the fallback after the comma.
+		// Without a maximum timeout, the Go WebDAV package always supports
+		// infinite length locks.
 		"Infinite, Second-4100000000",
 		infiniteTimeout,
 		nil,
+	}, {
+		"Infinite, junk",
+		0,
+		errInvalidTimeout,
 	}}
 
 	for _, tc := range testCases {
-		got, gotErr := parseTimeout(tc.s)
+		got, gotErr := parseTimeout(tc.s, 0)
 		if got != tc.want || gotErr != tc.wantErr {
 			t.Errorf("parsing %q:\ngot  %v, %v\nwant %v, %v", tc.s, got, gotErr, tc.want, tc.wantErr)
 		}
 	}
 }
+
+func TestParseTimeoutMax(t *testing.T) {
+	const max = 600 * time.Second
+	testCases := []struct {
+		s    string
+		want time.Duration
+	}{
+		{"", max},
+		{"Infinite", max},
+		{"Infinite, Second-600", 600 * time.Second},
+		{"Second-3600, Second-60", 60 * time.Second},
+		{"Second-3600, Infinite", max},
+		{"Second-0", 0},
+		{"Second-30", 30 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseTimeout(tc.s, max)
+		if err != nil || got != tc.want {
+			t.Errorf("parsing %q:\ngot  %v, %v\nwant %v, <nil>", tc.s, got, err, tc.want)
+		}
+	}
+}
+
+func TestMinTimeout(t *testing.T) {
+	testCases := []struct {
+		d, min, max time.Duration
+		want        time.Duration
+		wantErr     error
+	}{
+		{0, 0, 0, 0, errInvalidTimeout},
+		{time.Second, 0, 0, time.Second, nil},
+		{infiniteTimeout, 0, 0, infiniteTimeout, nil},
+		{0, time.Minute, 0, time.Minute, nil},
+		{time.Second, time.Minute, 0, time.Minute, nil},
+		{time.Hour, time.Minute, 0, time.Hour, nil},
+		{infiniteTimeout, time.Minute, 0, infiniteTimeout, nil},
+		{0, time.Hour, time.Minute, time.Minute, nil},
+	}
+	for _, tc := range testCases {
+		got, err := minTimeout(tc.d, tc.min, tc.max)
+		if got != tc.want || err != tc.wantErr {
+			t.Errorf("minTimeout(%v, %v, %v): got %v, %v, want %v, %v", tc.d, tc.min, tc.max, got, err, tc.want, tc.wantErr)
+		}
+	}
+
+	for _, tc := range []struct {
+		min         time.Duration
+		wantStatus  int
+		wantTimeout string
+	}{
+		{0, http.StatusBadRequest, ""},
+		{time.Hour, http.StatusCreated, "<D:timeout>Second-3600</D:timeout>"},
+	} {
+		h := &Handler{
+			FileSystem:     NewMemFS(),
+			LockSystem:     NewMemLS(),
+			MinLockTimeout: tc.min,
+		}
+		r := httptest.NewRequest("LOCK", "/file", strings.NewReader(createLockBody))
+		r.Header.Set("Timeout", "Second-0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.wantStatus {
+			t.Errorf("min %v: got status %d, want %d", tc.min, w.Code, tc.wantStatus)
+		}
+		if !strings.Contains(w.Body.String(), tc.wantTimeout) {
+			t.Errorf("min %v: got %s, want it to contain %s", tc.min, w.Body.String(), tc.wantTimeout)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"image"
+	_ "image/gif"  // register the GIF format for ImageExtractor
+	_ "image/jpeg" // register the JPEG format for ImageExtractor
+	_ "image/png"  // register the PNG format for ImageExtractor
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	mediaWidthPropName     = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "width"}
+	mediaHeightPropName    = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "height"}
+	mediaDurationPropName  = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "duration"}
+	mediaDateTakenPropName = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "date-taken"}
+	mediaCodecPropName     = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "codec"}
+)
+
+// MediaInfo are the media attributes of a file. The zero value of an
+// attribute means that it is unknown.
+type MediaInfo struct {
+	// Width and Height are the dimensions, in pixels, of an image or video.
+	Width, Height int
+	// Duration is the playing time of an audio or video file.
+	Duration time.Duration
+	// DateTaken is when a photo or video was taken, such as the EXIF
+	// DateTimeOriginal. Its location is ignored: the date is reported
+	// without time zone, as it is usually in the local time of the camera.
+	DateTaken time.Time
+	// Codec is the name of the format or of the codec, such as "jpeg" or
+	// "h264".
+	Codec string
+}
+
+// MediaExtractor extracts the media attributes of files.
+type MediaExtractor interface {
+	// ExtractMedia returns the media attributes of file name, whose
+	// content is read from f. It returns ErrNotImplemented if the format
+	// of the file is not supported.
+	ExtractMedia(ctx context.Context, name string, f File) (MediaInfo, error)
+}
+
+// MediaMetadata exposes the media attributes of files as the width, height,
+// duration, date-taken and codec properties in the
+// "https://github.com/drakkan/webdav" namespace, so that gallery clients can
+// build their views without downloading the files. The attributes are only
+// extracted when these properties are requested by name, and are cached.
+//
+// A MediaMetadata must not be copied after first use.
+type MediaMetadata struct {
+	// Extractor extracts the attributes. If nil, ImageExtractor is used.
+	Extractor MediaExtractor
+	// CacheSize is the number of files whose attributes are cached. The
+	// default is 1000.
+	CacheSize int
+
+	mu    sync.Mutex
+	cache map[mediaKey]MediaInfo
+}
+
+// mediaKey identifies a version of a file, so that the cached attributes
+// of modified files are not used.
+type mediaKey struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// info returns the media attributes of file name, extracting them unless
+// they are cached.
+func (m *MediaMetadata) info(ctx context.Context, fs FileSystem, name string, fi os.FileInfo) (MediaInfo, error) {
+	key := mediaKey{slashClean(name), fi.Size(), fi.ModTime()}
+	m.mu.Lock()
+	info, ok := m.cache[key]
+	m.mu.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	defer f.Close()
+	var extractor MediaExtractor = ImageExtractor{}
+	if m.Extractor != nil {
+		extractor = m.Extractor
+	}
+	info, err = extractor.ExtractMedia(ctx, name, f)
+	if err == ErrNotImplemented {
+		// Unsupported formats are cached too, with no attributes.
+		info, err = MediaInfo{}, nil
+	}
+	if err != nil {
+		return MediaInfo{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	size := m.CacheSize
+	if size <= 0 {
+		size = 1000
+	}
+	if m.cache == nil {
+		m.cache = make(map[mediaKey]MediaInfo)
+	}
+	for k := range m.cache {
+		if len(m.cache) < size {
+			break
+		}
+		delete(m.cache, k)
+	}
+	m.cache[key] = info
+	return info, nil
+}
+
+type mediaMetadataKey struct{}
+
+func withMediaMetadata(ctx context.Context, m *MediaMetadata) context.Context {
+	return context.WithValue(ctx, mediaMetadataKey{}, m)
+}
+
+// withoutMediaMetadata reports whether ctx has no MediaMetadata, in which
+// case the media properties are dead properties.
+func withoutMediaMetadata(ctx context.Context) bool {
+	m, _ := ctx.Value(mediaMetadataKey{}).(*MediaMetadata)
+	return m == nil
+}
+
+// mediaFindFn returns the findFn of a media property, formatting the
+// attributes with format, which returns an empty string if the attribute is
+// unknown.
+func mediaFindFn(format func(MediaInfo) string) func(context.Context, FileSystem, LockSystem, string, os.FileInfo) (string, error) {
+	return func(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+		m, _ := ctx.Value(mediaMetadataKey{}).(*MediaMetadata)
+		if m == nil {
+			return "", ErrNotImplemented
+		}
+		info, err := m.info(ctx, fs, name, fi)
+		if err != nil {
+			return "", err
+		}
+		if v := format(info); v != "" {
+			return escapeXML(v), nil
+		}
+		return "", ErrNotImplemented
+	}
+}
+
+func formatMediaInt(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+var (
+	findMediaWidth  = mediaFindFn(func(info MediaInfo) string { return formatMediaInt(info.Width) })
+	findMediaHeight = mediaFindFn(func(info MediaInfo) string { return formatMediaInt(info.Height) })
+	// The duration is reported in seconds, with millisecond precision.
+	findMediaDuration = mediaFindFn(func(info MediaInfo) string {
+		if info.Duration <= 0 {
+			return ""
+		}
+		return strconv.FormatFloat(info.Duration.Seconds(), 'f', 3, 64)
+	})
+	findMediaDateTaken = mediaFindFn(func(info MediaInfo) string {
+		if info.DateTaken.IsZero() {
+			return ""
+		}
+		return info.DateTaken.Format("2006-01-02T15:04:05")
+	})
+	findMediaCodec = mediaFindFn(func(info MediaInfo) string { return info.Codec })
+)
+
+// ImageExtractor is a MediaExtractor for GIF, JPEG and PNG images,
+// reporting their dimensions, their format as the codec and, for JPEG
+// images, the EXIF DateTimeOriginal. It only reads the headers of the
+// files.
+type ImageExtractor struct{}
+
+// maxImageHeader is how much of a file ImageExtractor reads. The EXIF data,
+// including a thumbnail, is at most 64 KiB.
+const maxImageHeader = 256 << 10
+
+// ExtractMedia implements MediaExtractor.
+func (ImageExtractor) ExtractMedia(ctx context.Context, name string, f File) (MediaInfo, error) {
+	header, err := io.ReadAll(io.LimitReader(f, maxImageHeader))
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(header))
+	if err != nil {
+		return MediaInfo{}, ErrNotImplemented
+	}
+	info := MediaInfo{Width: cfg.Width, Height: cfg.Height, Codec: format}
+	if format == "jpeg" {
+		info.DateTaken = exifDateTaken(header)
+	}
+	return info, nil
+}
+
+// exifDateTaken returns the EXIF DateTimeOriginal, or the DateTime, of the
+// JPEG image starting with header, or the zero time.
+func exifDateTaken(header []byte) time.Time {
+	// Find the APP1 segment holding the EXIF data, among the segments
+	// following the SOI marker.
+	if len(header) < 2 || header[0] != 0xff || header[1] != 0xd8 {
+		return time.Time{}
+	}
+	var tiff []byte
+	for p := 2; p+4 <= len(header) && header[p] == 0xff; {
+		marker := header[p+1]
+		n := int(binary.BigEndian.Uint16(header[p+2:]))
+		if marker == 0xda || n < 2 || p+2+n > len(header) {
+			// Start of scan, the image data follows, or a malformed
+			// segment.
+			break
+		}
+		if seg := header[p+4 : p+2+n]; marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			tiff = seg[6:]
+			break
+		}
+		p += 2 + n
+	}
+	if len(tiff) < 8 {
+		return time.Time{}
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return time.Time{}
+	}
+	// tag returns the offset of the value of the given tag in the IFD at
+	// offset off, and its count, or -1.
+	tag := func(off uint32, want uint16) (int, int) {
+		if int64(off)+2 > int64(len(tiff)) {
+			return -1, 0
+		}
+		n := int(order.Uint16(tiff[off:]))
+		for i := 0; i < n; i++ {
+			e := int(off) + 2 + 12*i
+			if e+12 > len(tiff) {
+				break
+			}
+			if order.Uint16(tiff[e:]) == want {
+				return e + 8, int(order.Uint32(tiff[e+4:]))
+			}
+		}
+		return -1, 0
+	}
+	// ascii returns the ASCII value, longer than 4 bytes, of the given tag
+	// in the IFD at offset off.
+	ascii := func(off uint32, want uint16) string {
+		entry, count := tag(off, want)
+		if entry < 0 || count <= 4 {
+			return ""
+		}
+		start := int64(order.Uint32(tiff[entry:]))
+		if start+int64(count) > int64(len(tiff)) {
+			return ""
+		}
+		return string(bytes.TrimRight(tiff[start:start+int64(count)], "\x00"))
+	}
+	ifd0 := order.Uint32(tiff[4:])
+	var v string
+	if entry, _ := tag(ifd0, 0x8769); entry >= 0 {
+		// DateTimeOriginal, in the EXIF IFD.
+		v = ascii(order.Uint32(tiff[entry:]), 0x9003)
+	}
+	if v == "" {
+		// DateTime, in IFD0.
+		v = ascii(ifd0, 0x0132)
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", v)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
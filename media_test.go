@@ -0,0 +1,169 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// exifJPEG returns a JPEG image of the given size, with an EXIF
+// DateTimeOriginal.
+func exifJPEG(t *testing.T, width, height int, taken string) []byte {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// A little endian TIFF header, IFD0 pointing to the EXIF IFD, which
+	// holds the DateTimeOriginal.
+	le := binary.LittleEndian
+	tiff := []byte("II*\x00")
+	tiff = le.AppendUint32(tiff, 8)
+	tiff = le.AppendUint16(tiff, 1)
+	tiff = append(le.AppendUint16(le.AppendUint16(tiff, 0x8769), 4), le.AppendUint32(le.AppendUint32(nil, 1), 26)...)
+	tiff = le.AppendUint32(tiff, 0)
+	tiff = le.AppendUint16(tiff, 1)
+	tiff = append(le.AppendUint16(le.AppendUint16(tiff, 0x9003), 2), le.AppendUint32(le.AppendUint32(nil, uint32(len(taken)+1)), 44)...)
+	tiff = le.AppendUint32(tiff, 0)
+	tiff = append(tiff, taken+"\x00"...)
+	seg := append([]byte("Exif\x00\x00"), tiff...)
+
+	out := []byte{0xff, 0xd8, 0xff, 0xe1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(seg)+2))
+	out = append(out, seg...)
+	return append(out, img.Bytes()[2:]...)
+}
+
+// zeroSegmentJPEG returns a JFIF JPEG image of the given size with a
+// zero-length APP2 segment following its SOF segment, which
+// image.DecodeConfig never reads for JFIF images.
+func zeroSegmentJPEG(t *testing.T, width, height int) []byte {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := img.Bytes()
+	sof := bytes.Index(b, []byte{0xff, 0xc0})
+	if sof < 0 {
+		t.Fatal("no SOF segment")
+	}
+	end := sof + 2 + int(binary.BigEndian.Uint16(b[sof+2:]))
+	out := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10}
+	out = append(out, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"...)
+	out = append(out, b[2:end]...)
+	out = append(out, 0xff, 0xe2, 0x00, 0x00)
+	return append(out, b[end:]...)
+}
+
+type countingExtractor struct {
+	calls int
+}
+
+func (e *countingExtractor) ExtractMedia(ctx context.Context, name string, f File) (MediaInfo, error) {
+	e.calls++
+	return ImageExtractor{}.ExtractMedia(ctx, name, f)
+}
+
+func TestMediaMetadata(t *testing.T) {
+	var pngImg bytes.Buffer
+	if err := png.Encode(&pngImg, image.NewGray(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewMemFS()
+	ctx := context.Background()
+	for name, content := range map[string][]byte{
+		"/a.png":   pngImg.Bytes(),
+		"/b.jpg":   exifJPEG(t, 16, 8, "2021:07:04 12:30:00"),
+		"/c.txt":   []byte("text"),
+		"/d.png.x": pngImg.Bytes()[:20],
+		"/e.jpg":   zeroSegmentJPEG(t, 16, 8),
+	} {
+		f, err := fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(content)
+		f.Close()
+	}
+	extractor := &countingExtractor{}
+	h := &Handler{
+		FileSystem:    fs,
+		LockSystem:    NewMemLS(),
+		MediaMetadata: &MediaMetadata{Extractor: extractor},
+	}
+	propfind := func(name string) string {
+		body := `<?xml version="1.0"?><D:propfind xmlns:D="DAV:" xmlns:W="https://github.com/drakkan/webdav"><D:prop>` +
+			`<W:width/><W:height/><W:codec/><W:date-taken/><W:duration/></D:prop></D:propfind>`
+		r := httptest.NewRequest("PROPFIND", name, strings.NewReader(body))
+		r.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	testCases := []struct {
+		name string
+		want []string
+	}{{
+		"/a.png",
+		[]string{">40</width>", ">30</height>", ">png</codec>"},
+	}, {
+		"/b.jpg",
+		[]string{">16</width>", ">8</height>", ">jpeg</codec>", ">2021-07-04T12:30:00</date-taken>"},
+	}, {
+		"/c.txt",
+		[]string{`<D:status>HTTP/1.1 404 Not Found</D:status>`},
+	}, {
+		"/d.png.x",
+		[]string{`<D:status>HTTP/1.1 404 Not Found</D:status>`},
+	}, {
+		"/e.jpg",
+		[]string{">16</width>", ">8</height>", ">jpeg</codec>"},
+	}}
+	for _, tc := range testCases {
+		body := propfind(tc.name)
+		for _, want := range tc.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: got %s, want %s", tc.name, body, want)
+			}
+		}
+		if strings.Contains(body, "200 OK") != (len(tc.want) > 1) {
+			t.Errorf("%s: unexpected propstats %s", tc.name, body)
+		}
+	}
+	if extractor.calls != len(testCases) {
+		t.Errorf("extractions: got %d, want %d", extractor.calls, len(testCases))
+	}
+	for _, tc := range testCases {
+		propfind(tc.name)
+	}
+	if extractor.calls != len(testCases) {
+		t.Errorf("extractions with a warm cache: got %d, want %d", extractor.calls, len(testCases))
+	}
+
+	// Without MediaMetadata, the properties are dead.
+	h.MediaMetadata = nil
+	if body := propfind("/a.png"); strings.Contains(body, "200 OK") {
+		t.Errorf("without MediaMetadata: got %s", body)
+	}
+}
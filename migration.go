@@ -0,0 +1,389 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// MigrationTracker records the progress of a MigrationFS.
+//
+// A name is migrated once the new backend is authoritative for it, that is
+// once it was written, created, removed or copied to the new backend. The
+// names below a migrated directory are migrated too.
+type MigrationTracker interface {
+	// IsMigrated reports whether name was marked as migrated.
+	IsMigrated(ctx context.Context, name string) (bool, error)
+	// SetMigrated marks name as migrated.
+	SetMigrated(ctx context.Context, name string) error
+}
+
+// NewMemMigrationTracker returns a new in-memory MigrationTracker.
+func NewMemMigrationTracker() MigrationTracker {
+	return &memMigrationTracker{names: make(map[string]bool)}
+}
+
+type memMigrationTracker struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+func (t *memMigrationTracker) IsMigrated(ctx context.Context, name string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.names[name], nil
+}
+
+func (t *memMigrationTracker) SetMigrated(ctx context.Context, name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.names[name] = true
+	return nil
+}
+
+// MigrationFS is a FileSystem that moves files from an old backend to a new
+// one while serving them, so that the storage backend behind a Handler can be
+// switched live.
+//
+// Files that were not migrated yet are read from the old backend, and
+// directory listings merge both backends. All the changes are applied to the
+// new backend only: a file is copied to it before being modified or renamed,
+// and removed names are hidden from the old backend. Migrate copies files
+// eagerly, for example from a background job. The old backend is never
+// modified.
+type MigrationFS struct {
+	from, to FileSystem
+	tracker  MigrationTracker
+}
+
+// NewMigrationFS returns a MigrationFS moving files from the FileSystem from
+// to the FileSystem to and recording its progress in tracker.
+func NewMigrationFS(from, to FileSystem, tracker MigrationTracker) *MigrationFS {
+	return &MigrationFS{
+		from:    from,
+		to:      to,
+		tracker: tracker,
+	}
+}
+
+// migrated reports whether name, or one of its parents, is migrated.
+func (fs *MigrationFS) migrated(ctx context.Context, name string) (bool, error) {
+	for name = slashClean(name); ; name = path.Dir(name) {
+		ok, err := fs.tracker.IsMigrated(ctx, name)
+		if ok || err != nil {
+			return ok, err
+		}
+		if name == "/" {
+			return false, nil
+		}
+	}
+}
+
+// Migrate copies name, recursively if it is a directory, from the old
+// backend to the new one, unless already migrated, and marks it as migrated.
+// Names that exist in neither backend are marked as migrated too.
+func (fs *MigrationFS) Migrate(ctx context.Context, name string) error {
+	name = slashClean(name)
+	if ok, err := fs.migrated(ctx, name); ok || err != nil {
+		return err
+	}
+	fi, err := fs.from.Stat(ctx, name)
+	if os.IsNotExist(err) {
+		return fs.tracker.SetMigrated(ctx, name)
+	}
+	if err != nil {
+		return err
+	}
+	if err := fs.mkdirParents(ctx, name); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if _, err := fs.to.Stat(ctx, name); os.IsNotExist(err) {
+			if err := fs.to.Mkdir(ctx, name, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		children, err := readDir(ctx, fs.from, name)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := fs.Migrate(ctx, path.Join(name, child.Name())); err != nil {
+				return err
+			}
+		}
+		return fs.tracker.SetMigrated(ctx, name)
+	}
+	if err := fs.copyFile(ctx, name, fi); err != nil {
+		return err
+	}
+	return fs.tracker.SetMigrated(ctx, name)
+}
+
+// copyFile copies the file name from the old backend to the new one.
+func (fs *MigrationFS) copyFile(ctx context.Context, name string, fi os.FileInfo) error {
+	src, err := fs.from.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := fs.to.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// mkdirParents creates in the new backend the parents of name that exist
+// only in the old one.
+func (fs *MigrationFS) mkdirParents(ctx context.Context, name string) error {
+	dir := path.Dir(name)
+	if dir == name {
+		return nil
+	}
+	if _, err := fs.to.Stat(ctx, dir); !os.IsNotExist(err) {
+		return err
+	}
+	fi, err := fs.Stat(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return os.ErrInvalid
+	}
+	if err := fs.mkdirParents(ctx, dir); err != nil {
+		return err
+	}
+	if err := fs.to.Mkdir(ctx, dir, fi.Mode().Perm()); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Mkdir implements FileSystem.
+func (fs *MigrationFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = slashClean(name)
+	if _, err := fs.Stat(ctx, name); err == nil {
+		return os.ErrExist
+	}
+	if err := fs.mkdirParents(ctx, name); err != nil {
+		return err
+	}
+	if err := fs.to.Mkdir(ctx, name, perm); err != nil {
+		return err
+	}
+	return fs.tracker.SetMigrated(ctx, name)
+}
+
+// OpenFile implements FileSystem.
+func (fs *MigrationFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	name = slashClean(name)
+	migrated, err := fs.migrated(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if !migrated {
+			if err := fs.mkdirParents(ctx, name); err != nil {
+				return nil, err
+			}
+			if flag&os.O_TRUNC == 0 {
+				if err := fs.Migrate(ctx, name); err != nil {
+					return nil, err
+				}
+			}
+		}
+		f, err := fs.to.OpenFile(ctx, name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		if !migrated {
+			if err := fs.tracker.SetMigrated(ctx, name); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		return f, nil
+	}
+	if migrated {
+		return fs.to.OpenFile(ctx, name, flag, perm)
+	}
+	f, err := fs.from.OpenFile(ctx, name, flag, perm)
+	if os.IsNotExist(err) {
+		return fs.to.OpenFile(ctx, name, flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return f, nil
+	}
+	return &migrationDir{File: f, fs: fs, ctx: ctx, name: name}, nil
+}
+
+// RemoveAll implements FileSystem.
+func (fs *MigrationFS) RemoveAll(ctx context.Context, name string) error {
+	name = slashClean(name)
+	if name == "/" {
+		// Prohibit removing the virtual root directory.
+		return os.ErrInvalid
+	}
+	if _, err := fs.Stat(ctx, name); err != nil {
+		return err
+	}
+	if err := fs.to.RemoveAll(ctx, name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return fs.tracker.SetMigrated(ctx, name)
+}
+
+// Rename implements FileSystem.
+func (fs *MigrationFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = slashClean(oldName), slashClean(newName)
+	if err := fs.Migrate(ctx, oldName); err != nil {
+		return err
+	}
+	if ok, err := fs.migrated(ctx, newName); err != nil {
+		return err
+	} else if !ok {
+		if _, err := fs.from.Stat(ctx, newName); err == nil {
+			// Renaming over a name of the old backend replaces it.
+			if err := fs.to.RemoveAll(ctx, newName); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := fs.mkdirParents(ctx, newName); err != nil {
+			return err
+		}
+	}
+	if err := fs.to.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	return fs.tracker.SetMigrated(ctx, newName)
+}
+
+// Stat implements FileSystem.
+func (fs *MigrationFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = slashClean(name)
+	migrated, err := fs.migrated(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !migrated {
+		fi, err := fs.from.Stat(ctx, name)
+		if !os.IsNotExist(err) {
+			return fi, err
+		}
+	}
+	return fs.to.Stat(ctx, name)
+}
+
+// readDir returns the members of the directory name of fs.
+func readDir(ctx context.Context, fs FileSystem, name string) ([]os.FileInfo, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(0)
+}
+
+// migrationDir is a directory of the old backend of a MigrationFS, whose
+// listing is merged with the one of the new backend.
+type migrationDir struct {
+	File
+	fs       *MigrationFS
+	ctx      context.Context
+	name     string
+	children []os.FileInfo
+	pos      int
+	listed   bool
+}
+
+// list merges the members of the directory in both backends. The members
+// migrated are listed from the new backend only.
+func (d *migrationDir) list() error {
+	children, err := readDir(d.ctx, d.fs.to, d.name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	seen := make(map[string]bool, len(children))
+	for _, c := range children {
+		seen[c.Name()] = true
+	}
+	old, err := d.File.Readdir(0)
+	if err != nil {
+		return err
+	}
+	for _, c := range old {
+		if seen[c.Name()] {
+			continue
+		}
+		migrated, err := d.fs.tracker.IsMigrated(d.ctx, path.Join(d.name, c.Name()))
+		if err != nil {
+			return err
+		}
+		if !migrated {
+			children = append(children, c)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	d.children = children
+	d.listed = true
+	return nil
+}
+
+func (d *migrationDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		if err := d.list(); err != nil {
+			return nil, err
+		}
+	}
+	old := d.pos
+	if old >= len(d.children) {
+		// The os.File Readdir docs say that at the end of a directory,
+		// the error is io.EOF if count > 0 and nil if count <= 0.
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	if count > 0 {
+		d.pos += count
+		if d.pos > len(d.children) {
+			d.pos = len(d.children)
+		}
+	} else {
+		d.pos = len(d.children)
+		old = 0
+	}
+	return d.children[old:d.pos], nil
+}
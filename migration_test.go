@@ -0,0 +1,125 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMigrationFS(t *testing.T) {
+	ctx := context.Background()
+	from, err := buildTestFS([]string{
+		"mkdir /a",
+		"write /a/f old",
+		"write /a/g old",
+		"mkdir /b",
+		"write /b/f old",
+	})
+	if err != nil {
+		t.Fatalf("cannot create old filesystem: %v", err)
+	}
+	to := NewMemFS()
+	tracker := NewMemMigrationTracker()
+	fs := NewMigrationFS(from, to, tracker)
+
+	read := func(fs FileSystem, name string) string {
+		t.Helper()
+		f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("open %s: %v", name, err)
+		}
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		return string(b)
+	}
+	list := func(fs FileSystem, name string) []string {
+		t.Helper()
+		children, err := readDir(ctx, fs, name)
+		if err != nil {
+			t.Fatalf("list %s: %v", name, err)
+		}
+		var names []string
+		for _, c := range children {
+			names = append(names, c.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+	exists := func(fs FileSystem, name string) bool {
+		_, err := fs.Stat(ctx, name)
+		return err == nil
+	}
+
+	if got := read(fs, "/a/f"); got != "old" {
+		t.Errorf("read unmigrated file: got %q, want %q", got, "old")
+	}
+	if exists(to, "/a/f") {
+		t.Errorf("read unmigrated file: got a copy in the new backend, want none")
+	}
+
+	f, err := fs.OpenFile(ctx, "/a/h", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Fatalf("create /a/h: %v", err)
+	}
+	f.Write([]byte("new"))
+	f.Close()
+	if !exists(to, "/a/h") || exists(from, "/a/h") {
+		t.Errorf("create file: want it in the new backend only")
+	}
+
+	if err := fs.RemoveAll(ctx, "/a/g"); err != nil {
+		t.Fatalf("remove /a/g: %v", err)
+	}
+	if exists(fs, "/a/g") {
+		t.Errorf("remove file: got it still visible")
+	}
+	if !exists(from, "/a/g") {
+		t.Errorf("remove file: got it removed from the old backend")
+	}
+	if got, want := list(fs, "/a"), []string{"f", "h"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merged listing: got %v, want %v", got, want)
+	}
+
+	if err := fs.Rename(ctx, "/a/f", "/c"); err != nil {
+		t.Fatalf("rename /a/f: %v", err)
+	}
+	if exists(fs, "/a/f") || read(fs, "/c") != "old" {
+		t.Errorf("rename file: want /a/f moved to /c")
+	}
+	if !exists(from, "/a/f") {
+		t.Errorf("rename file: got it removed from the old backend")
+	}
+
+	if err := fs.Migrate(ctx, "/"); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if got := read(to, "/b/f"); got != "old" {
+		t.Errorf("migrate: got %q, want %q", got, "old")
+	}
+	if got, want := list(to, "/a"), []string{"h"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("migrate: got %v in the new backend, want %v", got, want)
+	}
+	if ok, _ := tracker.IsMigrated(ctx, "/"); !ok {
+		t.Errorf("migrate: got the root not marked as migrated")
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"os"
+)
+
+// ModePolicy configures how the Unix permission bits of resources are exposed
+// to clients, and the ones given to the resources they create. The zero value
+// is the default policy of Dir.
+type ModePolicy struct {
+	// FileMode and DirMode are the permission bits of the files and
+	// directories created by clients, regardless of the umask. Zero leaves
+	// them to the Handler, which asks for 0666 and 0777, and to the umask.
+	FileMode, DirMode os.FileMode
+	// ExecutableBits are the permission bits set by making a file executable
+	// with the executable property, which reports a file as executable if
+	// any of them is set. Zero means 0100, the owner execute bit, as in
+	// mod_dav.
+	ExecutableBits os.FileMode
+	// WriteBits are the permission bits set by clearing the read-only
+	// attribute of the Win32FileAttributes property, which reports a
+	// resource as read-only if none of them is set. Setting the read-only
+	// attribute clears all the write bits. Zero means 0200, the owner write
+	// bit.
+	WriteBits os.FileMode
+}
+
+func (p ModePolicy) executableBits() os.FileMode {
+	if p.ExecutableBits == 0 {
+		return 0100
+	}
+	return p.ExecutableBits.Perm()
+}
+
+func (p ModePolicy) writeBits() os.FileMode {
+	if p.WriteBits == 0 {
+		return 0200
+	}
+	return p.WriteBits.Perm()
+}
+
+// ModeFS is an optional interface for the FileSystem, reporting the
+// ModePolicy of its resources.
+type ModeFS interface {
+	ModePolicy() ModePolicy
+}
+
+// modePolicy returns the ModePolicy of fs.
+func modePolicy(fs FileSystem) ModePolicy {
+	if mfs, ok := fs.(ModeFS); ok {
+		return mfs.ModePolicy()
+	}
+	return ModePolicy{}
+}
+
+// A ModeDir is a Dir with a ModePolicy, such as a share exposed to Windows
+// clients whose files should be group writable.
+type ModeDir struct {
+	Dir
+	Policy ModePolicy
+}
+
+// ModePolicy implements ModeFS.
+func (d ModeDir) ModePolicy() ModePolicy {
+	return d.Policy
+}
+
+func (d ModeDir) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if d.Policy.DirMode == 0 {
+		return d.Dir.Mkdir(ctx, name, perm)
+	}
+	if err := d.Dir.Mkdir(ctx, name, d.Policy.DirMode.Perm()); err != nil {
+		return err
+	}
+	// Override the umask.
+	return d.Dir.Chmod(ctx, name, d.Policy.DirMode.Perm())
+}
+
+func (d ModeDir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	if d.Policy.FileMode == 0 || flag&os.O_CREATE == 0 {
+		return d.Dir.OpenFile(ctx, name, flag, perm)
+	}
+	_, err := d.Dir.Stat(ctx, name)
+	created := os.IsNotExist(err)
+	f, err := d.Dir.OpenFile(ctx, name, flag, d.Policy.FileMode.Perm())
+	if err != nil || !created {
+		return f, err
+	}
+	// Override the umask.
+	if err := d.Dir.Chmod(ctx, name, d.Policy.FileMode.Perm()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// SetWin32Attributes implements Win32FS. Only FILE_ATTRIBUTE_READONLY is
+// mapped, to the write permission bits of the policy.
+func (d ModeDir) SetWin32Attributes(ctx context.Context, name string, attrs uint32) error {
+	return d.Dir.setReadOnly(name, attrs&win32AttrReadOnly != 0, d.Policy)
+}
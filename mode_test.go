@@ -0,0 +1,101 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestModeDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix permission bits are not supported on Windows")
+	}
+	dir := t.TempDir()
+	fs := ModeDir{
+		Dir: Dir(dir),
+		Policy: ModePolicy{
+			FileMode:       0660,
+			DirMode:        0770,
+			ExecutableBits: 0110,
+			WriteBits:      0220,
+		},
+	}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		PropStore:  NewMemPropStore(),
+	}
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	mode := func(name string) os.FileMode {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Stat %s: %v", name, err)
+		}
+		return fi.Mode().Perm()
+	}
+
+	if w := do("MKCOL", "/d", ""); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if got, want := mode("d"), os.FileMode(0770); got != want {
+		t.Errorf("MKCOL: got mode %v, want %v", got, want)
+	}
+	if w := do("PUT", "/d/f", "content"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if got, want := mode("d/f"), os.FileMode(0660); got != want {
+		t.Errorf("PUT: got mode %v, want %v", got, want)
+	}
+
+	const executable = `<D:propertyupdate xmlns:D="DAV:" xmlns:A="http://apache.org/dav/props/"><D:set><D:prop><A:executable>T</A:executable></D:prop></D:set></D:propertyupdate>`
+	if w := do("PROPPATCH", "/d/f", executable); w.Code != StatusMulti || !strings.Contains(w.Body.String(), "200 OK") {
+		t.Fatalf("PROPPATCH executable: got %d %s", w.Code, w.Body.String())
+	}
+	if got, want := mode("d/f"), os.FileMode(0770); got != want {
+		t.Errorf("PROPPATCH executable: got mode %v, want %v", got, want)
+	}
+
+	const readOnly = `<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:"><D:set><D:prop><Z:Win32FileAttributes>%s</Z:Win32FileAttributes></D:prop></D:set></D:propertyupdate>`
+	if w := do("PROPPATCH", "/d/f", strings.Replace(readOnly, "%s", "00000021", 1)); w.Code != StatusMulti {
+		t.Fatalf("PROPPATCH read-only: got status %d", w.Code)
+	}
+	if got, want := mode("d/f"), os.FileMode(0550); got != want {
+		t.Errorf("PROPPATCH read-only: got mode %v, want %v", got, want)
+	}
+	fi, err := fs.Stat(context.Background(), "/d/f")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if attrs := win32Attributes(fs, fi); attrs&win32AttrReadOnly == 0 {
+		t.Errorf("got attributes %08X, want read-only", attrs)
+	}
+	if w := do("PROPPATCH", "/d/f", strings.Replace(readOnly, "%s", "00000020", 1)); w.Code != StatusMulti {
+		t.Fatalf("PROPPATCH writable: got status %d", w.Code)
+	}
+	if got, want := mode("d/f"), os.FileMode(0770); got != want {
+		t.Errorf("PROPPATCH writable: got mode %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Chtimer is an optional interface for the FileSystem, changing the times
+// of resources. It lets PUT requests preserve the modification time of the
+// uploaded files sent by the ownCloud and Nextcloud clients and by rclone in
+// the X-OC-MTime header, so that they are not uploaded again by the next
+// sync. FileSystems implementing Win32FS implement it.
+type Chtimer interface {
+	// Chtimes changes the access and modification times of resource name.
+	// A zero time is left unchanged.
+	Chtimes(ctx context.Context, name string, atime, mtime time.Time) error
+}
+
+// ocMTime returns the modification time in the X-OC-MTime header of the
+// request r, in seconds since the Unix epoch, possibly fractional, or the
+// zero time if it is missing.
+func ocMTime(r *http.Request) (time.Time, error) {
+	s := r.Header.Get("X-OC-MTime")
+	if s == "" {
+		return time.Time{}, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 || math.IsInf(v, 0) || v > math.MaxInt64/1e9 {
+		return time.Time{}, errInvalidMTime
+	}
+	sec, frac := math.Modf(v)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// setModTime sets the modification time of file name to mtime, if the
+// FileSystem implements Chtimer, and reports whether it did.
+func (h *Handler) setModTime(ctx context.Context, name string, mtime time.Time) (bool, error) {
+	c, ok := h.FileSystem.(Chtimer)
+	if !ok {
+		return false, nil
+	}
+	if err := c.Chtimes(ctx, name, time.Time{}, mtime); err != nil {
+		if err == ErrNotImplemented {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
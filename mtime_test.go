@@ -0,0 +1,121 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOCMTime(t *testing.T) {
+	dir := t.TempDir()
+	h := &Handler{
+		FileSystem: Dir(dir),
+		LockSystem: NewMemLS(),
+	}
+	testCases := []struct {
+		desc, mtime  string
+		wantStatus   int
+		wantAccepted bool
+		want         time.Time
+	}{
+		{"seconds", "1600000000", http.StatusCreated, true, time.Unix(1600000000, 0)},
+		{"fractional", "1600000000.5", http.StatusCreated, true, time.Unix(1600000000, 5e8)},
+		{"invalid", "yesterday", http.StatusBadRequest, false, time.Time{}},
+		{"negative", "-1", http.StatusBadRequest, false, time.Time{}},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest("PUT", "/f", strings.NewReader("content"))
+		r.Header.Set("X-OC-MTime", tc.mtime)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+			continue
+		}
+		if got := w.Header().Get("X-OC-MTime") == "accepted"; got != tc.wantAccepted {
+			t.Errorf("%s: got accepted %t, want %t", tc.desc, got, tc.wantAccepted)
+		}
+		if tc.want.IsZero() {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(dir, "f"))
+		if err != nil {
+			t.Fatalf("%s: Stat: %v", tc.desc, err)
+		}
+		if !fi.ModTime().Equal(tc.want) {
+			t.Errorf("%s: got modification time %v, want %v", tc.desc, fi.ModTime(), tc.want)
+		}
+	}
+
+	// Without a Chtimer, the modification time is not accepted.
+	mem, err := buildTestFS(nil)
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h.FileSystem = mem
+	r := httptest.NewRequest("PUT", "/f", strings.NewReader("content"))
+	r.Header.Set("X-OC-MTime", "1600000000")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated || w.Header().Get("X-OC-MTime") != "" {
+		t.Errorf("memFS: got %d with X-OC-MTime %q, want %d without it", w.Code, w.Header().Get("X-OC-MTime"), http.StatusCreated)
+	}
+}
+
+// failingChtimesFS fails to set the modification times of its files.
+type failingChtimesFS struct {
+	FileSystem
+}
+
+func (failingChtimesFS) Chtimes(ctx context.Context, name string, atime, mtime time.Time) error {
+	return errors.New("chtimes failed")
+}
+
+func TestOCMTimeError(t *testing.T) {
+	var logged error
+	fs := failingChtimesFS{NewMemFS()}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		Logger: func(r *http.Request, status int, err error) {
+			if err != nil {
+				logged = err
+			}
+		},
+	}
+	r := httptest.NewRequest("PUT", "/f", strings.NewReader("content"))
+	r.Header.Set("X-OC-MTime", "1600000000")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	// The file is stored, so the request succeeds without accepting the
+	// modification time.
+	if w.Code != http.StatusCreated || w.Header().Get("X-OC-MTime") != "" {
+		t.Errorf("PUT: got %d with X-OC-MTime %q, want %d without it", w.Code, w.Header().Get("X-OC-MTime"), http.StatusCreated)
+	}
+	if logged == nil || logged.Error() != "chtimes failed" {
+		t.Errorf("got logged error %v, want chtimes failed", logged)
+	}
+	if _, err := fs.Stat(context.Background(), "/f"); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+}
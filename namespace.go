@@ -0,0 +1,162 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+
+	ixml "github.com/drakkan/webdav/internal/xml"
+)
+
+// Namespace is a vendor XML namespace registered using
+// Handler.RegisterNamespace, such as the "http://owncloud.org/ns" namespace
+// of the ownCloud properties.
+type Namespace struct {
+	// Space is the XML namespace name.
+	Space string
+	// Prefix, if not empty, is declared on the multistatus element of the
+	// responses and used for the properties in Space, instead of declaring
+	// the namespace as the default one of each property. Some clients only
+	// recognize the properties of their vendor with the usual prefix, such
+	// as "oc".
+	Prefix string
+	// Decode, if non-nil, parses the properties in Space set by PROPPATCH
+	// requests, returning the property to store, for example after
+	// validating or normalizing its value. An error fails the patch of the
+	// property with "409 Conflict".
+	Decode func(ctx context.Context, p Property) (Property, error)
+	// Encode, if non-nil, returns the properties in Space as written in the
+	// multistatus responses, such as those of PROPFIND, PROPPATCH and REPORT
+	// requests, for example to rewrite values stored in an older format.
+	Encode func(ctx context.Context, p Property) Property
+}
+
+// RegisterNamespace registers ns, so that embedders can declare the vendor
+// namespaces of their extensions without changes to the XML parsers and
+// encoders of this package. It replaces the namespace registered with the
+// same name, if any. It panics if the prefix of ns is invalid or is already
+// used by another namespace.
+//
+// RegisterNamespace must be called before serving requests.
+func (h *Handler) RegisterNamespace(ns Namespace) {
+	if ns.Prefix != "" {
+		if ns.Prefix == "D" || strings.HasPrefix(strings.ToLower(ns.Prefix), "xml") ||
+			strings.ContainsAny(ns.Prefix, ": \t\r\n<>&\"'") {
+			panic("webdav: invalid namespace prefix " + ns.Prefix)
+		}
+		for _, v := range h.namespaces {
+			if v.Prefix == ns.Prefix && v.Space != ns.Space {
+				panic("webdav: namespace prefix " + ns.Prefix + " already registered")
+			}
+		}
+	}
+	if h.namespaces == nil {
+		h.namespaces = make(map[string]Namespace)
+	}
+	h.namespaces[ns.Space] = ns
+}
+
+type namespacesKey struct{}
+
+func withNamespaces(ctx context.Context, namespaces map[string]Namespace) context.Context {
+	return context.WithValue(ctx, namespacesKey{}, namespaces)
+}
+
+func findNamespaces(ctx context.Context) map[string]Namespace {
+	if ctx == nil {
+		return nil
+	}
+	namespaces, _ := ctx.Value(namespacesKey{}).(map[string]Namespace)
+	return namespaces
+}
+
+// decodeNamespaces decodes the properties set by patches in the registered
+// namespaces. It returns the Propstats failing patches if a property cannot
+// be decoded, or nil.
+func decodeNamespaces(ctx context.Context, patches []Proppatch) []Propstat {
+	namespaces := findNamespaces(ctx)
+	if len(namespaces) == 0 {
+		return nil
+	}
+	for _, patch := range patches {
+		if patch.Remove {
+			continue
+		}
+		for i, p := range patch.Props {
+			ns, ok := namespaces[p.XMLName.Space]
+			if !ok || ns.Decode == nil {
+				continue
+			}
+			decoded, err := ns.Decode(ctx, p)
+			if err != nil {
+				return patchFailed(patches, p.XMLName, http.StatusConflict)
+			}
+			decoded.XMLName = p.XMLName
+			patch.Props[i] = decoded
+		}
+	}
+	return nil
+}
+
+// namespaceAttrs returns the declarations of the prefixes of the registered
+// namespaces, sorted by prefix.
+func namespaceAttrs(namespaces map[string]Namespace) []ixml.Attr {
+	var attrs []ixml.Attr
+	for _, ns := range namespaces {
+		if ns.Prefix == "" {
+			continue
+		}
+		attrs = append(attrs, ixml.Attr{
+			Name:  ixml.Name{Space: "xmlns", Local: ns.Prefix},
+			Value: ns.Space,
+		})
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].Name.Local < attrs[j].Name.Local
+	})
+	return attrs
+}
+
+// encodeNamespaces returns a copy of r whose properties in the registered
+// namespaces are encoded, and use the namespace prefix, if any.
+func encodeNamespaces(ctx context.Context, namespaces map[string]Namespace, r *response) *response {
+	if len(namespaces) == 0 {
+		return r
+	}
+	encoded := *r
+	encoded.Propstat = make([]propstat, len(r.Propstat))
+	for i, ps := range r.Propstat {
+		ps.Prop = append([]Property(nil), ps.Prop...)
+		for k, p := range ps.Prop {
+			ns, ok := namespaces[p.XMLName.Space]
+			if !ok {
+				continue
+			}
+			if ns.Encode != nil && len(p.InnerXML) > 0 {
+				p = ns.Encode(ctx, p)
+				p.XMLName = ps.Prop[k].XMLName
+			}
+			if ns.Prefix != "" {
+				p.XMLName.Space, p.XMLName.Local = "", ns.Prefix+":"+p.XMLName.Local
+			}
+			ps.Prop[k] = p
+		}
+		encoded.Propstat[i] = ps
+	}
+	return &encoded
+}
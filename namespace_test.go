@@ -0,0 +1,111 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegisterNamespace(t *testing.T) {
+	h := &Handler{
+		FileSystem: Dir(t.TempDir()),
+		LockSystem: NewMemLS(),
+		PropStore:  NewMemPropStore(),
+	}
+	h.RegisterNamespace(Namespace{
+		Space:  "http://owncloud.org/ns",
+		Prefix: "oc",
+		Decode: func(ctx context.Context, p Property) (Property, error) {
+			v := strings.TrimSpace(string(p.InnerXML))
+			if v != "0" && v != "1" {
+				return p, errors.New("not a boolean")
+			}
+			p.InnerXML = []byte(v)
+			return p, nil
+		},
+		Encode: func(ctx context.Context, p Property) Property {
+			if string(p.InnerXML) == "1" {
+				p.InnerXML = []byte("true")
+			} else {
+				p.InnerXML = []byte("false")
+			}
+			return p
+		},
+	})
+	do := func(method, body string) (int, string) {
+		r := httptest.NewRequest(method, "/dir", strings.NewReader(body))
+		r.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	if code, _ := do("MKCOL", ""); code != http.StatusCreated {
+		t.Fatalf("MKCOL: got status %d, want %d", code, http.StatusCreated)
+	}
+	code, body := do("PROPPATCH", `<D:propertyupdate xmlns:D="DAV:" xmlns:oc="http://owncloud.org/ns">`+
+		`<D:set><D:prop><oc:favorite>maybe</oc:favorite><D:displayname>f</D:displayname></D:prop></D:set></D:propertyupdate>`)
+	if code != StatusMulti || !strings.Contains(body, "409 Conflict") || !strings.Contains(body, "424 Failed Dependency") {
+		t.Fatalf("invalid PROPPATCH: got %d %q, want the favorite property to fail with 409", code, body)
+	}
+	code, body = do("PROPPATCH", `<D:propertyupdate xmlns:D="DAV:" xmlns:oc="http://owncloud.org/ns">`+
+		`<D:set><D:prop><oc:favorite> 1 </oc:favorite></D:prop></D:set></D:propertyupdate>`)
+	if code != StatusMulti || !strings.Contains(body, "200 OK") {
+		t.Fatalf("PROPPATCH: got %d %q, want 200 OK", code, body)
+	}
+	code, body = do("PROPFIND", `<D:propfind xmlns:D="DAV:" xmlns:oc="http://owncloud.org/ns">`+
+		`<D:prop><oc:favorite/><oc:missing/></D:prop></D:propfind>`)
+	if code != StatusMulti {
+		t.Fatalf("PROPFIND: got status %d, want %d", code, StatusMulti)
+	}
+	for _, want := range []string{
+		`<D:multistatus xmlns:oc="http://owncloud.org/ns" xmlns:D="DAV:">`,
+		`<oc:favorite>true</oc:favorite>`,
+		`<oc:missing></oc:missing>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("PROPFIND: got %q, want it to contain %q", body, want)
+		}
+	}
+	if code, _ := do(http.MethodOptions, ""); code != http.StatusOK {
+		t.Errorf("OPTIONS: got status %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestRegisterNamespaceInvalidPrefix(t *testing.T) {
+	for _, prefix := range []string{"D", "xmlns", "a:b"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("prefix %q: got no panic, want one", prefix)
+				}
+			}()
+			(&Handler{}).RegisterNamespace(Namespace{Space: "urn:test", Prefix: prefix})
+		}()
+	}
+	h := &Handler{}
+	h.RegisterNamespace(Namespace{Space: "urn:a", Prefix: "a"})
+	defer func() {
+		if recover() == nil {
+			t.Errorf("duplicated prefix: got no panic, want one")
+		}
+	}()
+	h.RegisterNamespace(Namespace{Space: "urn:b", Prefix: "a"})
+}
@@ -0,0 +1,298 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operation states reported by OperationStatus.
+const (
+	OperationRunning   = "running"
+	OperationCompleted = "completed"
+	OperationFailed    = "failed"
+	OperationCanceled  = "canceled"
+)
+
+// defaultOperationRetention is how long finished operations are kept if
+// Operations.Retention is zero.
+const defaultOperationRetention = time.Hour
+
+// Operations tracks the COPY, MOVE and DELETE requests that clients asked to
+// run asynchronously by sending a "Prefer: respond-async" header, as defined
+// in RFC 7240. Such requests are answered with "202 Accepted" and a Location
+// header pointing to the status of the operation.
+//
+// Operations is also an http.Handler that must be mounted at Prefix: a GET
+// request for Prefix + id returns the status of the operation as JSON and a
+// DELETE request cancels it. The IDs are random, and an operation is only
+// visible to the principal that started it, see Principal.
+type Operations struct {
+	// Prefix is the URL path the Operations handler is mounted at. It is
+	// used to build the Location header of accepted requests.
+	Prefix string
+	// Retention is how long the status of finished operations is kept. If
+	// zero, finished operations are kept for one hour.
+	Retention time.Duration
+	// Principal, if non-nil, returns the principal issuing the status and
+	// cancel requests, and must identify them as Handler.Principal does for
+	// the requests starting the operations. The operations started by
+	// another principal are reported as not found. If nil, the requests are
+	// anonymous, so only the operations started anonymously are visible.
+	Principal func(*http.Request) string
+
+	mu  sync.Mutex
+	ops map[string]*operation
+}
+
+// NewOperations returns a new Operations mounted at prefix.
+func NewOperations(prefix string) *Operations {
+	return &Operations{
+		Prefix: prefix,
+		ops:    make(map[string]*operation),
+	}
+}
+
+// OperationStatus is the status of an asynchronous operation.
+type OperationStatus struct {
+	// ID identifies the operation.
+	ID string `json:"id"`
+	// Method is the HTTP method of the request, for example "COPY".
+	Method string `json:"method"`
+	// Path is the path of the request resource.
+	Path string `json:"path"`
+	// Destination is the destination path for COPY and MOVE requests.
+	Destination string `json:"destination,omitempty"`
+	// State is one of OperationRunning, OperationCompleted,
+	// OperationFailed and OperationCanceled.
+	State string `json:"state"`
+	// Items is the number of resources processed so far.
+	Items int64 `json:"items"`
+	// Status is the HTTP status of the finished operation.
+	Status int `json:"status,omitempty"`
+	// Error is the error of a failed operation.
+	Error string `json:"error,omitempty"`
+	// Started is when the operation started.
+	Started time.Time `json:"started"`
+	// Finished is when the operation finished, if it did.
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+type operation struct {
+	cancel    context.CancelFunc
+	items     int64 // accessed atomically
+	principal string
+
+	// status is protected by Operations.mu.
+	status OperationStatus
+}
+
+type operationKey struct{}
+
+// reportProgress increments the number of processed items of the operation
+// running with ctx, if any.
+func reportProgress(ctx context.Context) {
+	if op, ok := ctx.Value(operationKey{}).(*operation); ok {
+		atomic.AddInt64(&op.items, 1)
+	}
+}
+
+// start runs fn in a new goroutine, on behalf of principal, and returns the
+// ID of the operation. release is called once fn returns.
+func (o *Operations) start(r *http.Request, principal, dst string, release func(), fn func(ctx context.Context) (int, error)) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.collectFinished(time.Now())
+
+	id := newOperationID()
+	for o.ops[id] != nil {
+		id = newOperationID()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	op := &operation{
+		cancel:    cancel,
+		principal: principal,
+		status: OperationStatus{
+			ID:          id,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Destination: dst,
+			State:       OperationRunning,
+			Started:     time.Now(),
+		},
+	}
+	if o.ops == nil {
+		o.ops = make(map[string]*operation)
+	}
+	o.ops[id] = op
+
+	go func() {
+		defer release()
+		defer cancel()
+		status, err := fn(context.WithValue(ctx, operationKey{}, op))
+
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		op.status.Status = status
+		op.status.Finished = time.Now()
+		switch {
+		case ctx.Err() != nil:
+			op.status.State = OperationCanceled
+		case err != nil:
+			op.status.State = OperationFailed
+			op.status.Error = err.Error()
+		default:
+			op.status.State = OperationCompleted
+		}
+	}()
+	return id
+}
+
+// newOperationID returns a new random operation ID, so that the IDs cannot
+// be guessed.
+func newOperationID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// collectFinished removes the operations finished before the retention
+// period. The caller must hold o.mu.
+func (o *Operations) collectFinished(now time.Time) {
+	retention := o.Retention
+	if retention == 0 {
+		retention = defaultOperationRetention
+	}
+	for id, op := range o.ops {
+		if !op.status.Finished.IsZero() && now.Sub(op.status.Finished) > retention {
+			delete(o.ops, id)
+		}
+	}
+}
+
+// Get returns the status of the operation with the given ID.
+func (o *Operations) Get(id string) (OperationStatus, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.collectFinished(time.Now())
+
+	op, ok := o.ops[id]
+	if !ok {
+		return OperationStatus{}, false
+	}
+	status := op.status
+	status.Items = atomic.LoadInt64(&op.items)
+	return status, true
+}
+
+// List returns the status of all the operations, oldest first.
+func (o *Operations) List() []OperationStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.collectFinished(time.Now())
+
+	list := make([]OperationStatus, 0, len(o.ops))
+	for _, op := range o.ops {
+		status := op.status
+		status.Items = atomic.LoadInt64(&op.items)
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+// Cancel cancels the operation with the given ID. It returns false if there
+// is no such operation.
+func (o *Operations) Cancel(id string) bool {
+	o.mu.Lock()
+	op, ok := o.ops[id]
+	o.mu.Unlock()
+	if ok {
+		op.cancel()
+	}
+	return ok
+}
+
+// location returns the URL path of the status of the operation id.
+func (o *Operations) location(id string) string {
+	return path.Join("/", o.Prefix, id)
+}
+
+// startedBy reports whether the operation with the given ID exists and was
+// started by principal.
+func (o *Operations) startedBy(id, principal string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	op, ok := o.ops[id]
+	return ok && op.principal == principal
+}
+
+func (o *Operations) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, o.Prefix), "/")
+	principal := ""
+	if o.Principal != nil {
+		principal = o.Principal(r)
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		status, ok := o.Get(id)
+		if !ok || !o.startedBy(id, principal) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case http.MethodDelete:
+		if !o.startedBy(id, principal) || !o.Cancel(id) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// respondAsync returns whether the request r for resource name must be run
+// asynchronously.
+func (h *Handler) respondAsync(r *http.Request, name string) bool {
+	if h.Operations == nil || !h.featureEnabled(r, FeatureAsyncOperations, name) {
+		return false
+	}
+	return hasPreference(r, "respond-async")
+}
+
+// runAsync starts fn as an asynchronous operation and writes the "202
+// Accepted" response. release is called once fn returns.
+func (h *Handler) runAsync(w http.ResponseWriter, r *http.Request, dst string, release func(), fn func(ctx context.Context) (int, error)) (int, error) {
+	id := h.Operations.start(r, h.principal(r), dst, release, fn)
+	w.Header().Set("Location", h.Operations.location(id))
+	w.Header().Set("Preference-Applied", "respond-async")
+	return http.StatusAccepted, nil
+}
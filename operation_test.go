@@ -0,0 +1,215 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func waitOperation(t *testing.T, ops *Operations, id string) OperationStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status, ok := ops.Get(id)
+		if !ok {
+			t.Fatalf("operation %q not found", id)
+		}
+		if status.State != OperationRunning {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("operation %q did not finish", id)
+	return OperationStatus{}
+}
+
+func TestAsyncOperations(t *testing.T) {
+	fs, err := buildTestFS([]string{
+		"mkdir /a",
+		"touch /a/1",
+		"touch /a/2",
+		"mkdir /a/b",
+		"touch /a/b/3",
+	})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	ops := NewOperations("/ops/")
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		Operations: ops,
+	}
+	do := func(method, path string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for len(headers) >= 2 {
+			req.Header.Add(headers[0], headers[1])
+			headers = headers[2:]
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	ctx := context.Background()
+
+	// Without the Prefer header requests are synchronous.
+	if rec := do("COPY", "/a", "Destination", "/sync"); rec.Code != http.StatusCreated {
+		t.Fatalf("COPY: got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+
+	rec := do("COPY", "/a", "Destination", "/c", "Prefer", "respond-async")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("async COPY: got status %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	location := rec.Header().Get("Location")
+	if location == "" {
+		t.Fatalf("async COPY: missing Location header")
+	}
+	req := httptest.NewRequest("GET", location, nil)
+	statusRec := httptest.NewRecorder()
+	ops.ServeHTTP(statusRec, req)
+	var status OperationStatus
+	if err := json.NewDecoder(statusRec.Body).Decode(&status); err != nil {
+		t.Fatalf("decoding operation status: %v", err)
+	}
+	status = waitOperation(t, ops, status.ID)
+	if status.State != OperationCompleted || status.Status != http.StatusCreated {
+		t.Fatalf("async COPY: got state %q status %d, want %q %d", status.State, status.Status,
+			OperationCompleted, http.StatusCreated)
+	}
+	if status.Items != 5 {
+		t.Fatalf("async COPY: got %d items, want 5", status.Items)
+	}
+	if _, err := fs.Stat(ctx, "/c/b/3"); err != nil {
+		t.Fatalf("async COPY: %v", err)
+	}
+
+	rec = do("DELETE", "/c", "Prefer", "respond-async")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("async DELETE: got status %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	id := rec.Header().Get("Location")[len("/ops/"):]
+	if status := waitOperation(t, ops, id); status.State != OperationCompleted {
+		t.Fatalf("async DELETE: got state %q, want %q", status.State, OperationCompleted)
+	}
+	if _, err := fs.Stat(ctx, "/c"); err == nil {
+		t.Fatalf("async DELETE: /c still exists")
+	}
+
+	// The lock taken for the operation is released once it finishes.
+	rec = do("MOVE", "/a", "Destination", "/m", "Prefer", "respond-async")
+	id = rec.Header().Get("Location")[len("/ops/"):]
+	if status := waitOperation(t, ops, id); status.State != OperationCompleted {
+		t.Fatalf("async MOVE: got state %q, want %q", status.State, OperationCompleted)
+	}
+	if rec := do("DELETE", "/m"); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE after async MOVE: got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+}
+
+func TestAsyncOperationCancel(t *testing.T) {
+	memFS, err := buildTestFS([]string{
+		"mkdir /a",
+		"touch /a/1",
+		"touch /a/2",
+		"touch /a/3",
+		"touch /a/4",
+	})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	ops := NewOperations("/ops/")
+	h := &Handler{
+		FileSystem: NewFaultFS(memFS, FaultConfig{Latency: 20 * time.Millisecond}),
+		LockSystem: NewMemLS(),
+		Operations: ops,
+	}
+	req := httptest.NewRequest("COPY", "/a", nil)
+	req.Header.Set("Destination", "/b")
+	req.Header.Set("Prefer", "respond-async")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("async COPY: got status %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	location := rec.Header().Get("Location")
+	rec = httptest.NewRecorder()
+	ops.ServeHTTP(rec, httptest.NewRequest("DELETE", location, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("cancel: got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if status := waitOperation(t, ops, location[len("/ops/"):]); status.State != OperationCanceled {
+		t.Fatalf("canceled COPY: got state %q, want %q", status.State, OperationCanceled)
+	}
+}
+
+func TestAsyncOperationPrincipal(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /a", "touch /a/1"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	principal := func(r *http.Request) string {
+		user, _, _ := r.BasicAuth()
+		return user
+	}
+	ops := NewOperations("/ops/")
+	ops.Principal = principal
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		Operations: ops,
+		Principal:  principal,
+	}
+	req := httptest.NewRequest("COPY", "/a", nil)
+	req.SetBasicAuth("alice", "")
+	req.Header.Set("Destination", "/b")
+	req.Header.Set("Prefer", "respond-async")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("async COPY: got status %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	location := rec.Header().Get("Location")
+	if id := location[len("/ops/"):]; len(id) != 32 {
+		t.Fatalf("operation ID %q: got %d characters, want 32", id, len(id))
+	}
+
+	testCases := []struct {
+		method, user string
+		want         int
+	}{
+		{"GET", "", http.StatusNotFound},
+		{"GET", "bob", http.StatusNotFound},
+		{"DELETE", "bob", http.StatusNotFound},
+		{"GET", "alice", http.StatusOK},
+		{"DELETE", "alice", http.StatusNoContent},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, location, nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, "")
+		}
+		rec := httptest.NewRecorder()
+		ops.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s by %q: got status %d, want %d", tc.method, tc.user, rec.Code, tc.want)
+		}
+	}
+}
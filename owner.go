@@ -0,0 +1,120 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"os"
+	"strings"
+)
+
+var (
+	ownerPropName = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "owner"}
+	groupPropName = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "group"}
+)
+
+// OwnerFS is an optional interface for the FileSystem, reporting the owner
+// and the group of resources, for example the POSIX ones, as the owner and
+// group properties in the "https://github.com/drakkan/webdav" namespace.
+// These properties are only returned when requested by name.
+type OwnerFS interface {
+	// Owner returns the names of the owner and of the group of resource
+	// name. Numeric IDs may be returned for unnamed owners and groups.
+	Owner(ctx context.Context, name string) (owner, group string, err error)
+}
+
+// Chowner is an optional interface for an OwnerFS, making the owner and group
+// properties writable using PROPPATCH by the principals allowed by
+// Handler.CanChown.
+type Chowner interface {
+	// Chown changes the owner and the group of resource name. An empty
+	// owner or group is left unchanged. Unknown names should be reported
+	// by returning an error wrapping os.ErrInvalid.
+	Chown(ctx context.Context, name string, owner, group string) error
+}
+
+type chownKey struct{}
+
+// withChown returns a context allowing the owner and group properties to be
+// patched.
+func withChown(ctx context.Context) context.Context {
+	return context.WithValue(ctx, chownKey{}, true)
+}
+
+func supportsOwner(fs FileSystem, _ os.FileInfo) bool {
+	_, ok := fs.(OwnerFS)
+	return ok
+}
+
+func findOwner(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	owner, _, err := fs.(OwnerFS).Owner(ctx, name)
+	return escapeXML(owner), err
+}
+
+func findGroup(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	_, group, err := fs.(OwnerFS).Owner(ctx, name)
+	return escapeXML(group), err
+}
+
+func patchOwner(ctx context.Context, fs FileSystem, name string, remove bool, p Property) (func() error, error) {
+	return patchOwnership(ctx, fs, name, remove, p, false)
+}
+
+func patchGroup(ctx context.Context, fs FileSystem, name string, remove bool, p Property) (func() error, error) {
+	return patchOwnership(ctx, fs, name, remove, p, true)
+}
+
+// patchOwnership changes the owner, or the group, of resource name. The
+// properties cannot be removed.
+func patchOwnership(ctx context.Context, fs FileSystem, name string, remove bool, p Property, group bool) (func() error, error) {
+	chowner, ok := fs.(Chowner)
+	if allowed, _ := ctx.Value(chownKey{}).(bool); !ok || !allowed {
+		return nil, os.ErrPermission
+	}
+	v := strings.TrimSpace(string(p.InnerXML))
+	if remove || v == "" {
+		return nil, errInvalidPropValue
+	}
+	prevOwner, prevGroup, err := fs.(OwnerFS).Owner(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	chown := func(v, prevOwner, prevGroup string) error {
+		if group {
+			if v == prevGroup {
+				return nil
+			}
+			return chowner.Chown(ctx, name, "", v)
+		}
+		if v == prevOwner {
+			return nil
+		}
+		return chowner.Chown(ctx, name, v, "")
+	}
+	if err := chown(v, prevOwner, prevGroup); err != nil {
+		if errors.Is(err, os.ErrInvalid) {
+			return nil, errInvalidPropValue
+		}
+		return nil, err
+	}
+	return func() error {
+		if group {
+			return chown(prevGroup, "", v)
+		}
+		return chown(prevOwner, v, "")
+	}, nil
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build unix
+
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Owner implements OwnerFS.
+func (d Dir) Owner(ctx context.Context, name string) (owner, group string, err error) {
+	if name = d.resolve(name); name == "" {
+		return "", "", os.ErrNotExist
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return "", "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", "", ErrNotImplemented
+	}
+	owner = strconv.FormatUint(uint64(st.Uid), 10)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	group = strconv.FormatUint(uint64(st.Gid), 10)
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return owner, group, nil
+}
+
+// Chown implements Chowner. The owner and group can be names or numeric IDs.
+func (d Dir) Chown(ctx context.Context, name string, owner, group string) error {
+	if name = d.resolve(name); name == "" {
+		return os.ErrNotExist
+	}
+	uid, gid := -1, -1
+	if owner != "" {
+		id := owner
+		if u, err := user.Lookup(owner); err == nil {
+			id = u.Uid
+		}
+		var err error
+		if uid, err = strconv.Atoi(id); err != nil {
+			return fmt.Errorf("unknown user %q: %w", owner, os.ErrInvalid)
+		}
+	}
+	if group != "" {
+		id := group
+		if g, err := user.LookupGroup(group); err == nil {
+			id = g.Gid
+		}
+		var err error
+		if gid, err = strconv.Atoi(id); err != nil {
+			return fmt.Errorf("unknown group %q: %w", group, os.ErrInvalid)
+		}
+	}
+	return os.Chown(name, uid, gid)
+}
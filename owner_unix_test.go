@@ -0,0 +1,85 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build unix
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOwnerProperties(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	owner, group, err := Dir(root).Owner(context.Background(), "/file")
+	if err != nil {
+		t.Fatalf("owner: %v", err)
+	}
+	if u, err := user.Current(); err == nil && owner != u.Username {
+		t.Errorf("owner: got %q, want %q", owner, u.Username)
+	}
+
+	const propfind = `<D:propfind xmlns:D="DAV:" xmlns:W="https://github.com/drakkan/webdav">` +
+		`<D:prop><W:owner/><W:group/></D:prop></D:propfind>`
+	proppatch := func(value string) string {
+		return `<D:propertyupdate xmlns:D="DAV:" xmlns:W="https://github.com/drakkan/webdav">` +
+			`<D:set><D:prop><W:owner>` + value + `</W:owner></D:prop></D:set></D:propertyupdate>`
+	}
+	h := &Handler{
+		FileSystem: Dir(root),
+		LockSystem: NewMemLS(),
+		Principal:  func(r *http.Request) string { return r.Header.Get("X-User") },
+		CanChown:   func(r *http.Request, principal string) bool { return principal == "admin" },
+	}
+
+	r := httptest.NewRequest("PROPFIND", "/file", strings.NewReader(propfind))
+	r.Header.Set("Depth", "0")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	for _, want := range []string{">" + escapeXML(owner) + "</", ">" + escapeXML(group) + "</"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("propfind: got %s, want it to contain %s", w.Body.String(), want)
+		}
+	}
+
+	testCases := []struct {
+		desc       string
+		user       string
+		value      string
+		wantStatus string
+	}{
+		{"unprivileged principal", "bob", owner, "403 Forbidden"},
+		{"privileged principal", "admin", owner, "200 OK"},
+		{"unknown user", "admin", "no such user", "409 Conflict"},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest("PROPPATCH", "/file", strings.NewReader(proppatch(tc.value)))
+		r.Header.Set("X-User", tc.user)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if !strings.Contains(w.Body.String(), tc.wantStatus) {
+			t.Errorf("%s: got %s, want status %s", tc.desc, w.Body.String(), tc.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// propfindOffsetHeader is the vendor request header paging the members of the
+// collection listed by a PROPFIND. Its value is the number of members to skip
+// before the first one listed. The collection itself is always listed.
+//
+// Offsets are only meaningful as long as the FileSystem lists the collection
+// in a stable order and the collection is not changed between the requests.
+const propfindOffsetHeader = "X-Propfind-Offset"
+
+// parsePropfindOffset returns the offset requested by r, which is zero if r
+// has no propfindOffsetHeader.
+func parsePropfindOffset(r *http.Request) (int, error) {
+	hdr := r.Header.Get(propfindOffsetHeader)
+	if hdr == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(hdr)
+	if err != nil || n < 0 {
+		return 0, errInvalidPropfindOffset
+	}
+	return n, nil
+}
+
+// propfindPager counts the members listed by a PROPFIND, skipping the first
+// offset ones and refusing those after the first max ones, if max is
+// positive.
+type propfindPager struct {
+	offset, max int
+	skipped     int
+	listed      int
+}
+
+// next reports whether the next member must be listed. It returns
+// errPropfindTruncated once max members have been listed.
+func (p *propfindPager) next() (bool, error) {
+	if p.skipped < p.offset {
+		p.skipped++
+		return false, nil
+	}
+	if p.max > 0 && p.listed >= p.max {
+		return false, errPropfindTruncated
+	}
+	p.listed++
+	return true, nil
+}
+
+// truncatedResponse returns the response appended to a PROPFIND multistatus
+// whose members have been truncated. The client can ask for the next members
+// with a propfindOffsetHeader of p.offset+p.listed.
+func (p *propfindPager) truncatedResponse(href string) *response {
+	return limitResponse(href, fmt.Sprintf("Only %d members have been listed, starting at offset %d.", p.listed, p.offset))
+}
+
+// limitResponse returns the response appended to a multistatus whose
+// responses have been truncated, as defined by RFC 5323 section 5.2.
+func limitResponse(href, description string) *response {
+	return &response{
+		Href:   []string{hrefPath(href)},
+		Status: fmt.Sprintf("HTTP/1.1 %d %s", http.StatusInsufficientStorage, StatusText(http.StatusInsufficientStorage)),
+		Error: &xmlError{
+			InnerXML: []byte(`<D:number-of-matches-within-limits/>`),
+		},
+		ResponseDescription: description,
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPropfindPaging(t *testing.T) {
+	fs, err := buildTestFS([]string{
+		"mkdir /dir",
+		"touch /dir/a",
+		"touch /dir/b",
+		"touch /dir/c",
+		"touch /dir/d",
+		"touch /dir/e",
+	})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem:         fs,
+		LockSystem:         NewMemLS(),
+		MaxPropfindResults: 2,
+	}
+	hrefRE := regexp.MustCompile(`<D:href>([^<]*)</D:href>`)
+	propfind := func(offset string) (int, []string, string) {
+		r := httptest.NewRequest("PROPFIND", "/dir", strings.NewReader(
+			`<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/></D:prop></D:propfind>`))
+		r.Header.Set("Depth", "1")
+		if offset != "" {
+			r.Header.Set("X-Propfind-Offset", offset)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var hrefs []string
+		for _, m := range hrefRE.FindAllStringSubmatch(w.Body.String(), -1) {
+			hrefs = append(hrefs, m[1])
+		}
+		return w.Code, hrefs, w.Body.String()
+	}
+
+	var members []string
+	for _, offset := range []string{"", "2", "4"} {
+		code, hrefs, body := propfind(offset)
+		if code != StatusMulti {
+			t.Fatalf("offset %q: got status %d, want %d", offset, code, StatusMulti)
+		}
+		if len(hrefs) == 0 || hrefs[0] != "/dir/" {
+			t.Fatalf("offset %q: got hrefs %v, want the collection first", offset, hrefs)
+		}
+		truncated := strings.Contains(body, "<D:number-of-matches-within-limits/>")
+		if want := offset != "4"; truncated != want {
+			t.Errorf("offset %q: got truncated %t, want %t", offset, truncated, want)
+		}
+		if truncated {
+			if !strings.Contains(body, "HTTP/1.1 507 Insufficient Storage") {
+				t.Errorf("offset %q: got %s, want a 507 response", offset, body)
+			}
+			if hrefs[len(hrefs)-1] != "/dir/" {
+				t.Errorf("offset %q: got hrefs %v, want the truncation reported on the collection", offset, hrefs)
+			}
+			hrefs = hrefs[:len(hrefs)-1]
+		}
+		members = append(members, hrefs[1:]...)
+	}
+	if got, want := strings.Join(members, " "), "/dir/a /dir/b /dir/c /dir/d /dir/e"; got != want {
+		t.Errorf("members: got %q, want %q", got, want)
+	}
+
+	if code, _, _ := propfind("-1"); code != http.StatusBadRequest {
+		t.Errorf("negative offset: got status %d, want %d", code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// partialUpdateType is the media type of the body of the SabreDAV PATCH
+// requests, see https://sabre.io/dav/http-patch/.
+const partialUpdateType = "application/x-sabredav-partialupdate"
+
+// partialUpdates reports whether the request r may update a byte range of
+// file name. See Handler.PartialUpdates.
+func (h *Handler) partialUpdates(r *http.Request, name string) bool {
+	return h.PartialUpdates && h.featureEnabled(r, FeaturePartialUpdates, name)
+}
+
+// parseContentRange parses the Content-Range header s of a PUT request,
+// such as "bytes 100-199/1000", and returns the offset and the length of
+// the range. The complete length, if any, is ignored.
+func parseContentRange(s string) (offset, length int64, err error) {
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, errInvalidContentRange
+	}
+	spec, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, errInvalidContentRange
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, errInvalidContentRange
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errInvalidContentRange
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, errInvalidContentRange
+	}
+	if total != "*" {
+		if n, err := strconv.ParseInt(total, 10, 64); err != nil || n <= end {
+			return 0, 0, errInvalidContentRange
+		}
+	}
+	return start, end - start + 1, nil
+}
+
+// parseUpdateRange parses the X-Update-Range header s of a SabreDAV PATCH
+// request to a file of the given size, and returns the offset of the range
+// and its length, or -1 if it extends to the end of the body.
+func parseUpdateRange(s string, size int64) (offset, length int64, status int, err error) {
+	if s == "append" {
+		return size, -1, 0, nil
+	}
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok {
+		return 0, 0, http.StatusBadRequest, errInvalidContentRange
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, http.StatusBadRequest, errInvalidContentRange
+	}
+	if first == "" {
+		// The last bytes of the file.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, http.StatusBadRequest, errInvalidContentRange
+		}
+		if n > size {
+			return 0, 0, http.StatusRequestedRangeNotSatisfiable, errRangeNotSatisfiable
+		}
+		return size - n, n, 0, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, http.StatusBadRequest, errInvalidContentRange
+	}
+	if start > size {
+		return 0, 0, http.StatusRequestedRangeNotSatisfiable, errRangeNotSatisfiable
+	}
+	if last == "" {
+		return start, -1, 0, nil
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, http.StatusBadRequest, errInvalidContentRange
+	}
+	return start, end - start + 1, 0, nil
+}
+
+// handlePartialPut serves a PUT request with a Content-Range header,
+// writing the body in place at the offset of the range.
+func (h *Handler) handlePartialPut(w http.ResponseWriter, r *http.Request, reqPath string) (status int, err error) {
+	offset, length, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	created := false
+	if fi, err := h.FileSystem.Stat(r.Context(), reqPath); err == nil {
+		if fi.IsDir() {
+			return http.StatusMethodNotAllowed, errIsADirectory
+		}
+	} else if os.IsNotExist(err) {
+		created = true
+	} else {
+		return http.StatusInternalServerError, err
+	}
+	status, err = h.writeRange(w, r, reqPath, offset, length)
+	if status == http.StatusNoContent && created {
+		status = http.StatusCreated
+	}
+	return status, err
+}
+
+// handlePatch serves the SabreDAV PATCH requests, updating a byte range of
+// an existing file.
+func (h *Handler) handlePatch(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	if !h.partialUpdates(r, reqPath) {
+		return http.StatusBadRequest, errUnsupportedMethod
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != partialUpdateType {
+		return http.StatusUnsupportedMediaType, errUnsupportedPatch
+	}
+	fi, err := h.FileSystem.Stat(r.Context(), reqPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
+		if os.IsPermission(err) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	if fi.IsDir() {
+		return http.StatusMethodNotAllowed, errIsADirectory
+	}
+	offset, length, status, err := parseUpdateRange(r.Header.Get("X-Update-Range"), fi.Size())
+	if err != nil {
+		return status, err
+	}
+	return h.writeRange(w, r, reqPath, offset, length)
+}
+
+// writeRange writes the body of r to file name at offset, using io.WriterAt
+// if the File implements it. length, unless -1, is the expected length of
+// the body.
+func (h *Handler) writeRange(w http.ResponseWriter, r *http.Request, name string, offset, length int64) (status int, err error) {
+	if length >= 0 && r.ContentLength >= 0 && r.ContentLength != length {
+		return http.StatusBadRequest, errInvalidContentRange
+	}
+	ctx := r.Context()
+	if status, err := h.checkRetention(ctx, w, name); err != nil {
+		return status, err
+	}
+	if status, err := h.checkPreconditions(r, name); err != nil {
+		return status, err
+	}
+	release, status, err := h.confirmLocks(r, name, "")
+	if err != nil {
+		return status, err
+	}
+	defer release()
+	// The range must start within the file, or at its end, so that it
+	// grows by the length of the body at most, and the growth must fit
+	// the quota.
+	var size int64
+	if fi, err := h.FileSystem.Stat(ctx, name); err == nil {
+		size = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return http.StatusInternalServerError, err
+	}
+	if offset > size {
+		return http.StatusRequestedRangeNotSatisfiable, errRangeNotSatisfiable
+	}
+	n := length
+	if n < 0 {
+		n = r.ContentLength
+	}
+	if n >= 0 && offset+n > size {
+		if status, err := h.checkQuota(ctx, name, offset+n); err != nil {
+			return status, err
+		}
+	}
+	f, err := h.FileSystem.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		if os.IsPermission(err) {
+			return http.StatusForbidden, err
+		}
+		if os.IsNotExist(err) {
+			return http.StatusConflict, err
+		}
+		return http.StatusNotFound, err
+	}
+	t, done := h.Admin.startTransfer(r, name)
+	defer done()
+	pipeline := NewBodyPipeline()
+	if h.UploadPipeline != nil {
+		h.UploadPipeline(r, name, pipeline)
+	}
+	body := io.Reader(pipeline.Reader(transferReader{r.Body, t}))
+	if length >= 0 {
+		body = io.LimitReader(body, length)
+	}
+	var written int64
+	var copyErr error
+	if wa, ok := f.(io.WriterAt); ok {
+		written, copyErr = io.Copy(io.NewOffsetWriter(wa, offset), body)
+	} else if _, copyErr = f.Seek(offset, io.SeekStart); copyErr == nil {
+		written, copyErr = io.Copy(f, body)
+	}
+	if copyErr == nil && length >= 0 && written != length {
+		copyErr = errInvalidContentRange
+	}
+	fi, statErr := f.Stat()
+	closeErr := f.Close()
+	switch {
+	case errors.Is(copyErr, ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge, copyErr
+	case errors.Is(copyErr, ErrBodyRejected):
+		return http.StatusForbidden, copyErr
+	case errors.Is(copyErr, errInvalidContentRange):
+		return http.StatusBadRequest, copyErr
+	}
+	if copyErr != nil {
+		return http.StatusMethodNotAllowed, copyErr
+	}
+	if statErr != nil {
+		return http.StatusMethodNotAllowed, statErr
+	}
+	if closeErr != nil {
+		return http.StatusMethodNotAllowed, closeErr
+	}
+	etag, err := findETag(ctx, h.FileSystem, h.LockSystem, name, fi)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("ETag", etag)
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPartialUpdates(t *testing.T) {
+	dir := t.TempDir()
+	h := &Handler{
+		FileSystem:     Dir(dir),
+		LockSystem:     NewMemLS(),
+		PartialUpdates: true,
+	}
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := do("PUT", "/f", "0123456789"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	const patchType = "application/x-sabredav-partialupdate"
+	testCases := []struct {
+		desc, method, body string
+		headers            []string
+		wantStatus         int
+		want               string
+	}{{
+		"PUT range", "PUT", "ab",
+		[]string{"Content-Range", "bytes 2-3/10"},
+		http.StatusNoContent, "01ab456789",
+	}, {
+		"PUT range with unknown length", "PUT", "cd",
+		[]string{"Content-Range", "bytes 9-10/*"},
+		http.StatusNoContent, "01ab45678cd",
+	}, {
+		"PUT range length mismatch", "PUT", "abc",
+		[]string{"Content-Range", "bytes 0-1/11"},
+		http.StatusBadRequest, "01ab45678cd",
+	}, {
+		"PUT invalid range", "PUT", "ab",
+		[]string{"Content-Range", "bytes 3-2/11"},
+		http.StatusBadRequest, "01ab45678cd",
+	}, {
+		"PUT range past the end", "PUT", "x",
+		[]string{"Content-Range", "bytes 1125899906842624-1125899906842624/*"},
+		http.StatusRequestedRangeNotSatisfiable, "01ab45678cd",
+	}, {
+		"PATCH range", "PATCH", "XY",
+		[]string{"Content-Type", patchType, "X-Update-Range", "bytes=0-1"},
+		http.StatusNoContent, "XYab45678cd",
+	}, {
+		"PATCH open range", "PATCH", "Z",
+		[]string{"Content-Type", patchType, "X-Update-Range", "bytes=4-"},
+		http.StatusNoContent, "XYabZ5678cd",
+	}, {
+		"PATCH last bytes", "PATCH", "ef",
+		[]string{"Content-Type", patchType, "X-Update-Range", "bytes=-2"},
+		http.StatusNoContent, "XYabZ5678ef",
+	}, {
+		"PATCH append", "PATCH", "!",
+		[]string{"Content-Type", patchType, "X-Update-Range", "append"},
+		http.StatusNoContent, "XYabZ5678ef!",
+	}, {
+		"PATCH unsatisfiable range", "PATCH", "x",
+		[]string{"Content-Type", patchType, "X-Update-Range", "bytes=20-"},
+		http.StatusRequestedRangeNotSatisfiable, "XYabZ5678ef!",
+	}, {
+		"PATCH unsupported type", "PATCH", "x",
+		[]string{"Content-Type", "text/plain", "X-Update-Range", "bytes=0-0"},
+		http.StatusUnsupportedMediaType, "XYabZ5678ef!",
+	}, {
+		"PATCH missing range", "PATCH", "x",
+		[]string{"Content-Type", patchType},
+		http.StatusBadRequest, "XYabZ5678ef!",
+	}}
+	for _, tc := range testCases {
+		w := do(tc.method, "/f", tc.body, tc.headers...)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "f"))
+		if err != nil {
+			t.Fatalf("%s: ReadFile: %v", tc.desc, err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got content %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+	if w := do("PATCH", "/missing", "x", "Content-Type", patchType, "X-Update-Range", "append"); w.Code != http.StatusNotFound {
+		t.Errorf("PATCH missing file: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	h.FileSystem = &quotaFS{FileSystem: Dir(dir), available: 2}
+	if w := do("PATCH", "/f", "abc", "Content-Type", patchType, "X-Update-Range", "append"); w.Code != StatusInsufficientStorage {
+		t.Errorf("PATCH over quota: got status %d, want %d", w.Code, StatusInsufficientStorage)
+	}
+	h.FileSystem = NewMemFS()
+	if w := do("PUT", "/f", "x", "Content-Range", "bytes 1125899906842624-1125899906842624/*"); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("PUT range past the end of memFS: got status %d, want %d", w.Code, http.StatusRequestedRangeNotSatisfiable)
+	}
+	h.FileSystem = Dir(dir)
+	w := do("OPTIONS", "/f", "")
+	if allow, dav := w.Header().Get("Allow"), w.Header().Get("DAV"); !strings.Contains(allow, "PATCH") || !strings.Contains(dav, "sabredav-partialupdate") {
+		t.Errorf("OPTIONS: got Allow %q and DAV %q, want PATCH and sabredav-partialupdate", allow, dav)
+	}
+
+	h.PartialUpdates = false
+	if w := do("PATCH", "/f", "x", "Content-Type", patchType, "X-Update-Range", "append"); w.Code != http.StatusBadRequest {
+		t.Errorf("PATCH disabled: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do("PUT", "/f", "new", "Content-Range", "bytes 0-2/3"); w.Code != http.StatusCreated {
+		t.Errorf("PUT disabled: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "f")); string(got) != "new" {
+		t.Errorf("PUT disabled: got content %q, want %q", got, "new")
+	}
+}
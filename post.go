@@ -0,0 +1,79 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// PostHandler serves a POST request to the collection name, such as a form
+// based upload or a custom RPC. ctx is the request context, carrying the
+// values set by the Handler, and principal is the authenticated principal,
+// as returned by Handler.Principal.
+//
+// If it returns an error before writing anything, the request fails with
+// "404 Not Found" for os.ErrNotExist, "403 Forbidden" for os.ErrPermission,
+// "413 Request Entity Too Large" for ErrBodyTooLarge and "500 Internal
+// Server Error" otherwise.
+type PostHandler func(ctx context.Context, w http.ResponseWriter, r *http.Request, name, principal string) error
+
+// RegisterPostHandler registers fn to serve the POST requests to the
+// collection at prefix, a FileSystem path, and to the collections below it,
+// which otherwise fail with "405 Method Not Allowed". The handler registered
+// with the longest prefix matching the collection wins. It replaces the
+// handler registered with the same prefix, if any. POST requests to files
+// are served like GET requests.
+//
+// RegisterPostHandler must be called before serving requests.
+func (h *Handler) RegisterPostHandler(prefix string, fn PostHandler) {
+	if h.postHandlers == nil {
+		h.postHandlers = make(map[string]PostHandler)
+	}
+	h.postHandlers[slashClean(prefix)] = fn
+}
+
+// postHandler returns the PostHandler serving the collection name, or nil.
+func (h *Handler) postHandler(name string) PostHandler {
+	var fn PostHandler
+	matched := -1
+	for prefix, v := range h.postHandlers {
+		if len(prefix) <= matched {
+			continue
+		}
+		if name == prefix || prefix == "/" || strings.HasPrefix(name, prefix+"/") {
+			fn, matched = v, len(prefix)
+		}
+	}
+	return fn
+}
+
+func (h *Handler) servePost(w http.ResponseWriter, r *http.Request, name string, fn PostHandler) (status int, err error) {
+	if err := fn(r.Context(), w, r, name, h.principal(r)); err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return http.StatusNotFound, err
+		case errors.Is(err, os.ErrPermission):
+			return http.StatusForbidden, err
+		case errors.Is(err, ErrBodyTooLarge):
+			return http.StatusRequestEntityTooLarge, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRegisterPostHandler(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /uploads", "mkdir /uploads/sub", "mkdir /other", "write /uploads/f content"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		Principal: func(r *http.Request) string {
+			user, _, _ := r.BasicAuth()
+			return user
+		},
+	}
+	h.RegisterPostHandler("/uploads", func(ctx context.Context, w http.ResponseWriter, r *http.Request, name, principal string) error {
+		if principal == "" {
+			return os.ErrPermission
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		f, err := h.FileSystem.OpenFile(ctx, name+"/from-"+principal, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := f.Write(body); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	})
+	do := func(method, target, user, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if user != "" {
+			r.SetBasicAuth(user, "password")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	testCases := []struct {
+		target, user string
+		wantStatus   int
+	}{
+		{"/uploads", "alice", http.StatusCreated},
+		{"/uploads/sub/", "bob", http.StatusCreated},
+		{"/uploads", "", http.StatusForbidden},
+		{"/other", "alice", http.StatusMethodNotAllowed},
+		{"/uploads/f", "alice", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		if w := do("POST", tc.target, tc.user, "data"); w.Code != tc.wantStatus {
+			t.Errorf("POST %s: got status %d, want %d", tc.target, w.Code, tc.wantStatus)
+		}
+	}
+	for _, name := range []string{"/uploads/from-alice", "/uploads/sub/from-bob"} {
+		if w := do("GET", name, "", ""); w.Code != http.StatusOK || w.Body.String() != "data" {
+			t.Errorf("GET %s: got %d %q, want %d %q", name, w.Code, w.Body.String(), http.StatusOK, "data")
+		}
+	}
+	for target, want := range map[string]bool{"/uploads/sub": true, "/other": false} {
+		allow := do("OPTIONS", target, "", "").Header().Get("Allow")
+		if got := strings.Contains(allow, "POST"); got != want {
+			t.Errorf("OPTIONS %s: got Allow %q, want POST listed %t", target, allow, want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hasPreference returns whether r has a "Prefer" header, defined by RFC 7240,
+// with the preference pref, such as "respond-async" or "return=minimal".
+func hasPreference(r *http.Request, pref string) bool {
+	for _, v := range r.Header.Values("Prefer") {
+		for _, p := range strings.Split(v, ",") {
+			// Ignore the preference parameters, if any.
+			p, _, _ = strings.Cut(p, ";")
+			if strings.EqualFold(strings.ReplaceAll(p, " ", ""), pref) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// returnMinimal returns whether r asks for a minimal PROPFIND or PROPPATCH
+// response, either with "Prefer: return=minimal", as described by RFC 8144
+// section 2.1, or with the legacy "Brief: t" header of Microsoft clients. It
+// sets the response headers acknowledging the preference.
+func returnMinimal(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Brief, Prefer")
+	if hasPreference(r, "return=minimal") {
+		w.Header().Set("Preference-Applied", "return=minimal")
+		return true
+	}
+	return strings.EqualFold(r.Header.Get("Brief"), "t")
+}
+
+// minimalPropstats returns pstats without the properties which are not found,
+// unless there are no others.
+func minimalPropstats(pstats []Propstat) []Propstat {
+	ret := make([]Propstat, 0, len(pstats))
+	for _, pstat := range pstats {
+		if pstat.Status == http.StatusNotFound {
+			continue
+		}
+		ret = append(ret, pstat)
+	}
+	if len(ret) == 0 {
+		// A response must have a propstat.
+		return pstats
+	}
+	return ret
+}
+
+// allPropstatsOK returns whether all the properties of pstats have been
+// processed successfully.
+func allPropstatsOK(pstats []Propstat) bool {
+	for _, pstat := range pstats {
+		if pstat.Status != http.StatusOK {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReturnMinimal(t *testing.T) {
+	fs, err := buildTestFS([]string{"touch /file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	}
+	do := func(method, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/file", strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	const propfindBody = `<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:missing/></D:prop></D:propfind>`
+	const proppatchBody = `<D:propertyupdate xmlns:D="DAV:" xmlns:Z="ns"><D:set><D:prop><Z:p>v</Z:p></D:prop></D:set></D:propertyupdate>`
+
+	testCases := []struct {
+		desc      string
+		headers   []string
+		minimal   bool
+		preferred bool
+	}{
+		{"no preference", nil, false, false},
+		{"prefer", []string{"Prefer", "return=minimal"}, true, true},
+		{"prefer with others", []string{"Prefer", "respond-async, return=minimal"}, true, true},
+		{"brief", []string{"Brief", "t"}, true, false},
+		{"brief false", []string{"Brief", "f"}, false, false},
+	}
+	for _, tc := range testCases {
+		w := do("PROPFIND", propfindBody, tc.headers...)
+		if w.Code != StatusMulti {
+			t.Errorf("%s: propfind: got status %d, want %d", tc.desc, w.Code, StatusMulti)
+			continue
+		}
+		if got := strings.Contains(w.Body.String(), "404 Not Found"); got == tc.minimal {
+			t.Errorf("%s: propfind: got 404 propstat %t, want %t", tc.desc, got, !tc.minimal)
+		}
+		if !strings.Contains(w.Body.String(), "<D:getcontentlength>0</D:getcontentlength>") {
+			t.Errorf("%s: propfind: got %s, want the content length", tc.desc, w.Body.String())
+		}
+		if got := w.Header().Get("Preference-Applied") == "return=minimal"; got != tc.preferred {
+			t.Errorf("%s: propfind: got Preference-Applied %t, want %t", tc.desc, got, tc.preferred)
+		}
+
+		w = do("PROPPATCH", proppatchBody, tc.headers...)
+		want := StatusMulti
+		if tc.minimal {
+			want = http.StatusNoContent
+		}
+		if w.Code != want {
+			t.Errorf("%s: proppatch: got status %d, want %d", tc.desc, w.Code, want)
+		}
+	}
+
+	// A missing property is reported when there is nothing else to report.
+	w := do("PROPFIND", `<D:propfind xmlns:D="DAV:"><D:prop><D:missing/></D:prop></D:propfind>`, "Prefer", "return=minimal")
+	if !strings.Contains(w.Body.String(), "404 Not Found") {
+		t.Errorf("only missing: got %s, want a 404 propstat", w.Body.String())
+	}
+
+	// Failed patches are still reported.
+	w = do("PROPPATCH", `<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><D:getetag>x</D:getetag></D:prop></D:set></D:propertyupdate>`, "Prefer", "return=minimal")
+	if w.Code != StatusMulti || !strings.Contains(w.Body.String(), "403 Forbidden") {
+		t.Errorf("protected: got %d %s, want a 403 propstat", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+)
+
+// Prefetcher is implemented by backends with metadata or content caches that
+// can be warmed ahead of the client, such as object store adapters.
+//
+// Both methods are hints: they are called asynchronously, with a context not
+// bound to any request, and their failures are ignored.
+type Prefetcher interface {
+	// PrefetchDir warms the cached listing of the directory name.
+	PrefetchDir(ctx context.Context, name string)
+	// PrefetchContent warms n bytes of the cached content of the file name,
+	// starting at offset off.
+	PrefetchContent(ctx context.Context, name string, off, n int64)
+}
+
+// PrefetchConfig configures the access pattern detection of NewPrefetchFS.
+type PrefetchConfig struct {
+	// Dirs is the maximum number of subdirectories of a listed directory
+	// whose listings are prefetched, anticipating a folder by folder
+	// traversal. Zero disables directory prefetching.
+	Dirs int
+	// ReadAhead is the number of bytes prefetched ahead of a file that is
+	// being read sequentially, such as a streamed media file. Zero disables
+	// content prefetching.
+	ReadAhead int64
+	// SequentialReads is the number of consecutive sequential reads, possibly
+	// spanning several requests, after which a file is considered streamed.
+	// Zero means 2.
+	SequentialReads int
+	// Workers is the maximum number of concurrent prefetches. Prefetches
+	// that would exceed it are dropped. Zero means 4.
+	Workers int
+	// Scheduler, if non-nil, rate limits the prefetches, each of which is
+	// granted one token with PriorityLow.
+	Scheduler *Scheduler
+}
+
+// maxPrefetchState bounds the number of files and directories whose access
+// pattern is tracked at any time.
+const maxPrefetchState = 1024
+
+// NewPrefetchFS returns a FileSystem that detects the access patterns of
+// clients on fs and asks p to warm its caches ahead of them.
+//
+// Listing a directory prefetches the listings of its first config.Dirs
+// subdirectories, and reading a file sequentially prefetches the next
+// config.ReadAhead bytes. p is usually the backend behind fs itself.
+func NewPrefetchFS(fs FileSystem, p Prefetcher, config PrefetchConfig) FileSystem {
+	if config.SequentialReads <= 0 {
+		config.SequentialReads = 2
+	}
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+	return &prefetchFS{
+		FileSystem: fs,
+		p:          p,
+		config:     config,
+		sem:        make(chan struct{}, config.Workers),
+		dirs:       make(map[string]bool),
+		reads:      make(map[string]*readPattern),
+	}
+}
+
+type prefetchFS struct {
+	FileSystem
+	p      Prefetcher
+	config PrefetchConfig
+	sem    chan struct{}
+	// wg tracks the running prefetches, so that tests can wait for them.
+	wg sync.WaitGroup
+
+	mu    sync.Mutex
+	dirs  map[string]bool
+	reads map[string]*readPattern
+}
+
+// readPattern is the observed read pattern of a file.
+type readPattern struct {
+	// end is the offset following the last read.
+	end int64
+	// sequential is the number of consecutive reads that started at end.
+	sequential int
+	// prefetched is the offset up to which the content was prefetched.
+	prefetched int64
+}
+
+// async runs fn in the background, unless config.Workers prefetches are
+// already running.
+func (fs *prefetchFS) async(fn func(ctx context.Context)) {
+	select {
+	case fs.sem <- struct{}{}:
+	default:
+		return
+	}
+	fs.wg.Add(1)
+	go func() {
+		defer fs.wg.Done()
+		defer func() { <-fs.sem }()
+		ctx := context.Background()
+		if s := fs.config.Scheduler; s != nil && s.Wait(ctx, PriorityLow, 1) != nil {
+			return
+		}
+		fn(ctx)
+	}()
+}
+
+func (fs *prefetchFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		fs.forget(name)
+		return f, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return f, nil
+	}
+	if fi.IsDir() {
+		fs.prefetchSubdirs(name)
+		return f, nil
+	}
+	if fs.config.ReadAhead <= 0 {
+		return f, nil
+	}
+	return &prefetchFile{File: f, fs: fs, name: slashClean(name)}, nil
+}
+
+func (fs *prefetchFS) RemoveAll(ctx context.Context, name string) error {
+	fs.forget(name)
+	return fs.FileSystem.RemoveAll(ctx, name)
+}
+
+func (fs *prefetchFS) Rename(ctx context.Context, oldName, newName string) error {
+	fs.forget(oldName)
+	fs.forget(newName)
+	return fs.FileSystem.Rename(ctx, oldName, newName)
+}
+
+// FlushCache implements CacheFlusher. It drops the observed access
+// patterns and flushes the caches of the underlying FileSystem, if any.
+func (fs *prefetchFS) FlushCache() error {
+	fs.mu.Lock()
+	fs.dirs = make(map[string]bool)
+	fs.reads = make(map[string]*readPattern)
+	fs.mu.Unlock()
+	if cf, ok := fs.FileSystem.(CacheFlusher); ok {
+		return cf.FlushCache()
+	}
+	return nil
+}
+
+// forget drops the tracked state of name and of its descendants.
+func (fs *prefetchFS) forget(name string) {
+	name = slashClean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for n := range fs.dirs {
+		if isWithin(n, name) {
+			delete(fs.dirs, n)
+		}
+	}
+	for n := range fs.reads {
+		if isWithin(n, name) {
+			delete(fs.reads, n)
+		}
+	}
+}
+
+// prefetchSubdirs prefetches the listings of the first subdirectories of the
+// directory name, the first time name is listed.
+func (fs *prefetchFS) prefetchSubdirs(name string) {
+	if fs.config.Dirs <= 0 {
+		return
+	}
+	name = slashClean(name)
+	fs.mu.Lock()
+	if fs.dirs[name] {
+		fs.mu.Unlock()
+		return
+	}
+	if len(fs.dirs) >= maxPrefetchState {
+		fs.dirs = make(map[string]bool)
+	}
+	fs.dirs[name] = true
+	fs.mu.Unlock()
+
+	fs.async(func(ctx context.Context) {
+		f, err := fs.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		n := 0
+		for n < fs.config.Dirs {
+			fis, err := f.Readdir(fs.config.Dirs)
+			for _, fi := range fis {
+				if fi.IsDir() && n < fs.config.Dirs {
+					fs.p.PrefetchDir(ctx, path.Join(name, fi.Name()))
+					n++
+				}
+			}
+			if err != nil || len(fis) == 0 {
+				return
+			}
+		}
+	})
+}
+
+// observeRead records a read of n bytes at offset off of the file name, and
+// prefetches the content that follows once the reads are sequential.
+func (fs *prefetchFS) observeRead(name string, off int64, n int) {
+	fs.mu.Lock()
+	rp := fs.reads[name]
+	if rp == nil {
+		if len(fs.reads) >= maxPrefetchState {
+			fs.reads = make(map[string]*readPattern)
+		}
+		rp = &readPattern{}
+		fs.reads[name] = rp
+	}
+	if off == rp.end {
+		rp.sequential++
+	} else {
+		rp.sequential = 0
+		rp.prefetched = 0
+	}
+	rp.end = off + int64(n)
+	if rp.sequential < fs.config.SequentialReads || rp.prefetched-rp.end >= fs.config.ReadAhead/2 {
+		fs.mu.Unlock()
+		return
+	}
+	start := rp.end
+	if rp.prefetched > start {
+		start = rp.prefetched
+	}
+	length := rp.end + fs.config.ReadAhead - start
+	rp.prefetched = start + length
+	fs.mu.Unlock()
+
+	fs.async(func(ctx context.Context) {
+		fs.p.PrefetchContent(ctx, name, start, length)
+	})
+}
+
+type prefetchFile struct {
+	File
+	fs   *prefetchFS
+	name string
+	off  int64
+}
+
+func (f *prefetchFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if n > 0 {
+		f.fs.observeRead(f.name, f.off, n)
+		f.off += int64(n)
+	}
+	return n, err
+}
+
+func (f *prefetchFile) Seek(offset int64, whence int) (int64, error) {
+	off, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.off = off
+	}
+	return off, err
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordingPrefetcher struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (p *recordingPrefetcher) PrefetchDir(ctx context.Context, name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, "dir "+name)
+}
+
+func (p *recordingPrefetcher) PrefetchContent(ctx context.Context, name string, off, n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, fmt.Sprintf("content %s %d %d", name, off, n))
+}
+
+func (p *recordingPrefetcher) reset() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	calls := p.calls
+	p.calls = nil
+	sort.Strings(calls)
+	return calls
+}
+
+func TestPrefetchFS(t *testing.T) {
+	ctx := context.Background()
+	memFS, err := buildTestFS([]string{
+		"mkdir /a",
+		"mkdir /a/b",
+		"mkdir /a/c",
+		"mkdir /a/d",
+		"touch /a/file",
+		"write /media " + strings.Repeat("x", 100),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &recordingPrefetcher{}
+	fs := NewPrefetchFS(memFS, p, PrefetchConfig{
+		Dirs:            2,
+		ReadAhead:       20,
+		SequentialReads: 2,
+	}).(*prefetchFS)
+
+	open := func(name string) File {
+		f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile %s: %v", name, err)
+		}
+		return f
+	}
+
+	open("/a").Close()
+	fs.wg.Wait()
+	// memFS lists in no particular order, any two subdirectories will do.
+	got := p.reset()
+	if len(got) != 2 || got[0] == got[1] {
+		t.Fatalf("listing /a: got %q, want two subdirectories", got)
+	}
+	for _, call := range got {
+		if call != "dir /a/b" && call != "dir /a/c" && call != "dir /a/d" {
+			t.Fatalf("listing /a: got %q, want subdirectories of /a", got)
+		}
+	}
+	open("/a").Close()
+	fs.wg.Wait()
+	if got := p.reset(); len(got) != 0 {
+		t.Fatalf("listing /a again: got %q, want no prefetches", got)
+	}
+
+	// Random access does not trigger prefetching.
+	f := open("/media")
+	buf := make([]byte, 10)
+	for _, off := range []int64{50, 10, 80} {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	fs.wg.Wait()
+	if got := p.reset(); len(got) != 0 {
+		t.Fatalf("random reads: got %q, want no prefetches", got)
+	}
+
+	// Sequential reads, even across handles, prefetch ahead of the reader.
+	for off := int64(0); off < 50; off += 10 {
+		f := open("/media")
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		fs.wg.Wait()
+	}
+	got, want := p.reset(), []string{"content /media 30 20", "content /media 50 20"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("sequential reads: got %q, want %q", got, want)
+	}
+
+	// Writing a file resets its read pattern.
+	w, err := fs.OpenFile(ctx, "/media", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	f = open("/media")
+	if _, err := f.Seek(50, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	f.Read(buf)
+	f.Close()
+	fs.wg.Wait()
+	if got := p.reset(); len(got) != 0 {
+		t.Fatalf("read after write: got %q, want no prefetches", got)
+	}
+}
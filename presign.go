@@ -0,0 +1,54 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+)
+
+// Presigner is an optional interface for the FileSystems backed by object
+// storage, such as S3 or GCS, that can grant temporary direct access to the
+// content of a resource.
+//
+// See Handler.PresignPolicy.
+type Presigner interface {
+	// Presign returns a URL allowing the client to transfer the content of
+	// resource name directly with the storage, using the HTTP method, GET
+	// or PUT. It returns ErrNotImplemented if the transfer must be served
+	// by the Handler, for example for small files.
+	Presign(ctx context.Context, method, name string) (string, error)
+}
+
+// redirectPresigned redirects r to a presigned URL for resource name, if
+// allowed, and reports whether it did.
+func (h *Handler) redirectPresigned(w http.ResponseWriter, r *http.Request, name string) (bool, error) {
+	if h.PresignPolicy == nil {
+		return false, nil
+	}
+	p, ok := h.FileSystem.(Presigner)
+	if !ok || !h.featureEnabled(r, FeaturePresign, name) || !h.PresignPolicy(r, name) {
+		return false, nil
+	}
+	u, err := p.Presign(r.Context(), r.Method, name)
+	if err == ErrNotImplemented {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+	return true, nil
+}
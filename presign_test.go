@@ -0,0 +1,88 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type presignFS struct {
+	FileSystem
+}
+
+func (fs presignFS) Presign(ctx context.Context, method, name string) (string, error) {
+	if strings.HasPrefix(name, "/small") {
+		return "", ErrNotImplemented
+	}
+	return "https://storage.example.com" + name + "?method=" + method, nil
+}
+
+func TestPresign(t *testing.T) {
+	fs, err := buildTestFS([]string{"touch /file", "touch /small", "mkdir /dir", "touch /locked"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	ls := NewMemLS()
+	h := &Handler{
+		FileSystem: presignFS{fs},
+		LockSystem: ls,
+		PresignPolicy: func(r *http.Request, name string) bool {
+			return r.Header.Get("X-Direct") == "1"
+		},
+	}
+	lockRec := httptest.NewRecorder()
+	lockReq := httptest.NewRequest("LOCK", "/locked", strings.NewReader(createLockBody))
+	h.ServeHTTP(lockRec, lockReq)
+	if lockRec.Code != http.StatusOK {
+		t.Fatalf("LOCK: got status %d, want %d", lockRec.Code, http.StatusOK)
+	}
+
+	testCases := []struct {
+		method, target string
+		direct         bool
+		verifyWrites   bool
+		wantStatus     int
+		wantLocation   string
+	}{
+		{"GET", "/file", true, false, http.StatusTemporaryRedirect, "https://storage.example.com/file?method=GET"},
+		{"GET", "/file", false, false, http.StatusOK, ""},
+		{"HEAD", "/file", true, false, http.StatusOK, ""},
+		{"GET", "/small", true, false, http.StatusOK, ""},
+		{"GET", "/dir", true, false, http.StatusMethodNotAllowed, ""},
+		{"GET", "/missing", true, false, http.StatusNotFound, ""},
+		{"PUT", "/new", true, false, http.StatusTemporaryRedirect, "https://storage.example.com/new?method=PUT"},
+		{"PUT", "/new", true, true, http.StatusCreated, ""},
+		{"PUT", "/locked", true, false, StatusLocked, ""},
+	}
+	for _, tc := range testCases {
+		h.VerifyWrites = tc.verifyWrites
+		r := httptest.NewRequest(tc.method, tc.target, strings.NewReader("content"))
+		if tc.direct {
+			r.Header.Set("X-Direct", "1")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.target, w.Code, tc.wantStatus)
+		}
+		if got := w.Header().Get("Location"); got != tc.wantLocation {
+			t.Errorf("%s %s: got location %q, want %q", tc.method, tc.target, got, tc.wantLocation)
+		}
+	}
+}
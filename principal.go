@@ -0,0 +1,251 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// principalsPath is the path of the virtual principal collection served by
+// a Handler with Principals.
+const principalsPath = "/principals"
+
+// PrincipalInfo describes a principal resource.
+type PrincipalInfo struct {
+	// Name is the name of the principal, as returned by Handler.Principal.
+	// It is the last segment of the URL path of the principal resource.
+	Name string
+	// DisplayName is the DAV:displayname of the principal resource. If
+	// empty, Name is used.
+	DisplayName string
+	// Props are additional properties of the principal resource, such as
+	// the CalDAV calendar-home-set.
+	Props []Property
+}
+
+// PrincipalResolver resolves the principals listed by the virtual
+// "/principals/" collection of a Handler, so that CalDAV, CardDAV and ACL
+// aware clients can discover the principal resource of the user, as
+// reported by the DAV:current-user-principal property, and its properties.
+type PrincipalResolver interface {
+	// LookupPrincipal returns the principal named name, or an error wrapping
+	// os.ErrNotExist.
+	LookupPrincipal(ctx context.Context, name string) (PrincipalInfo, error)
+	// ListPrincipals returns the members of the principal collection. It
+	// may return only some of them, for example just the principal of the
+	// user issuing the request, see Handler.Principal.
+	ListPrincipals(ctx context.Context) ([]PrincipalInfo, error)
+}
+
+type principalCollectionKey struct{}
+
+func withPrincipalCollection(ctx context.Context, href string) context.Context {
+	return context.WithValue(ctx, principalCollectionKey{}, href)
+}
+
+func findPrincipalCollectionSet(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	href, ok := ctx.Value(principalCollectionKey{}).(string)
+	if !ok {
+		return "", ErrNotImplemented
+	}
+	return `<D:href xmlns:D="DAV:">` + escapeXML(hrefPath(href)) + `</D:href>`, nil
+}
+
+// principalCollectionHref returns the URL path of the principal collection.
+func (h *Handler) principalCollectionHref() string {
+	return path.Join("/", h.Prefix, principalsPath) + "/"
+}
+
+// principalURL returns the URL path of the principal resource of the user
+// issuing r, or an empty string for anonymous requests.
+func (h *Handler) principalURL(r *http.Request) string {
+	name := h.principal(r)
+	if name == "" {
+		return ""
+	}
+	return h.principalCollectionHref() + name + "/"
+}
+
+// isPrincipalRequest reports whether r targets the principal collection
+// served by h, or one of its members.
+func (h *Handler) isPrincipalRequest(r *http.Request) bool {
+	if h.Principals == nil {
+		return false
+	}
+	reqPath, _, err := h.stripPrefix(r.URL.Path)
+	return err == nil && isWithin(slashClean(reqPath), principalsPath)
+}
+
+// servePrincipals serves the read-only principal collection and its
+// members.
+func (h *Handler) servePrincipals(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("Allow", "OPTIONS, PROPFIND")
+		dav := "1"
+		if h.AccessController != nil {
+			dav += ", access-control"
+		}
+		w.Header().Set("DAV", dav)
+		return 0, nil
+	case "PROPFIND":
+	default:
+		return http.StatusMethodNotAllowed, errUnsupportedMethod
+	}
+
+	ctx := r.Context()
+	name := strings.TrimPrefix(strings.TrimPrefix(slashClean(reqPath), principalsPath), "/")
+	if strings.Contains(name, "/") {
+		return http.StatusNotFound, os.ErrNotExist
+	}
+	var self *PrincipalInfo
+	if name != "" {
+		p, err := h.Principals.LookupPrincipal(ctx, name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return http.StatusNotFound, err
+			}
+			return http.StatusInternalServerError, err
+		}
+		self = &p
+	}
+	depth := 1
+	if hdr := r.Header.Get("Depth"); hdr != "" {
+		depth = parseDepth(hdr)
+		if depth == invalidDepth {
+			return http.StatusBadRequest, errInvalidDepth
+		}
+	}
+	if depth == infiniteDepth {
+		return http.StatusForbidden, errInvalidDepth
+	}
+	pf, status, err := readPropfind(r.Body)
+	if err != nil {
+		return status, err
+	}
+
+	mw := multistatusWriter{w: w, canonical: h.CanonicalXML, ctx: ctx}
+	writeErr := mw.write(makePropstatResponse(h.principalHref(self), h.principalPropstats(ctx, self, pf)))
+	if writeErr == nil && self == nil && depth != 0 {
+		var members []PrincipalInfo
+		if members, writeErr = h.Principals.ListPrincipals(ctx); writeErr == nil {
+			for i := range members {
+				writeErr = mw.write(makePropstatResponse(h.principalHref(&members[i]), h.principalPropstats(ctx, &members[i], pf)))
+				if writeErr != nil {
+					break
+				}
+			}
+		}
+	}
+	if h.listingAborted(r, &mw, writeErr) {
+		return 0, writeErr
+	}
+	closeErr := mw.close()
+	if writeErr != nil {
+		return http.StatusInternalServerError, writeErr
+	}
+	if closeErr != nil {
+		return http.StatusInternalServerError, closeErr
+	}
+	return 0, nil
+}
+
+// principalHref returns the URL path of principal p, or of the principal
+// collection if p is nil.
+func (h *Handler) principalHref(p *PrincipalInfo) string {
+	if p == nil {
+		return h.principalCollectionHref()
+	}
+	return h.principalCollectionHref() + p.Name + "/"
+}
+
+// principalProps returns the properties of principal p, or of the principal
+// collection if p is nil.
+func (h *Handler) principalProps(ctx context.Context, p *PrincipalInfo) []Property {
+	resourceType := `<D:collection xmlns:D="DAV:"/>`
+	displayName := ""
+	if p != nil {
+		resourceType += `<D:principal xmlns:D="DAV:"/>`
+		displayName = p.DisplayName
+		if displayName == "" {
+			displayName = p.Name
+		}
+	}
+	props := []Property{
+		{XMLName: xml.Name{Space: "DAV:", Local: "resourcetype"}, InnerXML: []byte(resourceType)},
+		{XMLName: xml.Name{Space: "DAV:", Local: "displayname"}, InnerXML: []byte(escapeXML(displayName))},
+	}
+	if cup, err := findCurrentUserPrincipal(ctx, nil, nil, "", nil); err == nil {
+		props = append(props, Property{XMLName: xml.Name{Space: "DAV:", Local: "current-user-principal"}, InnerXML: []byte(cup)})
+	}
+	props = append(props, Property{
+		XMLName:  xml.Name{Space: "DAV:", Local: "principal-collection-set"},
+		InnerXML: []byte(`<D:href xmlns:D="DAV:">` + escapeXML(hrefPath(h.principalCollectionHref())) + `</D:href>`),
+	})
+	if p != nil {
+		props = append(props, Property{
+			XMLName:  xml.Name{Space: "DAV:", Local: "principal-URL"},
+			InnerXML: []byte(`<D:href xmlns:D="DAV:">` + escapeXML(hrefPath(h.principalHref(p))) + `</D:href>`),
+		})
+		props = append(props, p.Props...)
+	}
+	return props
+}
+
+// principalPropstats returns the Propstats of principal p, or of the
+// principal collection if p is nil, requested by pf.
+func (h *Handler) principalPropstats(ctx context.Context, p *PrincipalInfo, pf propfind) []Propstat {
+	return staticPropstats(h.principalProps(ctx, p), pf)
+}
+
+// staticPropstats returns the Propstats of a virtual resource whose
+// properties are props, requested by pf.
+func staticPropstats(props []Property, pf propfind) []Propstat {
+	if pf.Propname != nil {
+		pstat := Propstat{Status: http.StatusOK}
+		for _, prop := range props {
+			pstat.Props = append(pstat.Props, Property{XMLName: prop.XMLName})
+		}
+		return []Propstat{pstat}
+	}
+	if pf.Allprop != nil {
+		return []Propstat{{Status: http.StatusOK, Props: props}}
+	}
+	pstatOK := Propstat{Status: http.StatusOK}
+	pstatNotFound := Propstat{Status: http.StatusNotFound}
+	for _, pn := range pf.Prop {
+		found := false
+		for _, prop := range props {
+			if prop.XMLName == pn {
+				pstatOK.Props = append(pstatOK.Props, prop)
+				found = true
+				break
+			}
+		}
+		if !found {
+			pstatNotFound.Props = append(pstatNotFound.Props, Property{XMLName: pn})
+		}
+	}
+	return makePropstats(pstatOK, pstatNotFound)
+}
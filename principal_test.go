@@ -0,0 +1,132 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+type testPrincipals []PrincipalInfo
+
+func (p testPrincipals) LookupPrincipal(ctx context.Context, name string) (PrincipalInfo, error) {
+	for _, info := range p {
+		if info.Name == name {
+			return info, nil
+		}
+	}
+	return PrincipalInfo{}, os.ErrNotExist
+}
+
+func (p testPrincipals) ListPrincipals(ctx context.Context) ([]PrincipalInfo, error) {
+	return p, nil
+}
+
+func TestPrincipals(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /principals", "write /f content"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		Prefix:     "/dav",
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		Principal:  func(r *http.Request) string { return "alice" },
+		Principals: testPrincipals{{
+			Name:        "alice",
+			DisplayName: "Alice Liddell",
+			Props: []Property{{
+				XMLName:  xml.Name{Space: "urn:ietf:params:xml:ns:caldav", Local: "calendar-home-set"},
+				InnerXML: []byte(`<D:href xmlns:D="DAV:">/dav/calendars/alice/</D:href>`),
+			}},
+		}, {
+			Name: "bob",
+		}},
+	}
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	const discovery = `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop>` +
+		`<D:current-user-principal/><D:principal-collection-set/></D:prop></D:propfind>`
+
+	testCases := []struct {
+		desc, method, target, body, depth string
+		wantStatus                        int
+		want                              []string
+	}{{
+		"discovery on a file",
+		"PROPFIND", "/dav/f", discovery, "0",
+		StatusMulti,
+		[]string{
+			`<D:current-user-principal><D:href xmlns:D="DAV:">/dav/principals/alice/</D:href></D:current-user-principal>`,
+			`<D:principal-collection-set><D:href xmlns:D="DAV:">/dav/principals/</D:href></D:principal-collection-set>`,
+		},
+	}, {
+		"principal resource",
+		"PROPFIND", "/dav/principals/alice/", `<?xml version="1.0"?><D:propfind xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:prop>` +
+			`<D:resourcetype/><D:displayname/><D:principal-URL/><C:calendar-home-set/><D:getetag/></D:prop></D:propfind>`, "0",
+		StatusMulti,
+		[]string{
+			`<D:resourcetype><D:collection xmlns:D="DAV:"/><D:principal xmlns:D="DAV:"/></D:resourcetype>`,
+			`<D:displayname>Alice Liddell</D:displayname>`,
+			`<D:principal-URL><D:href xmlns:D="DAV:">/dav/principals/alice/</D:href></D:principal-URL>`,
+			`/dav/calendars/alice/`,
+			`<D:prop><D:getetag></D:getetag></D:prop><D:status>HTTP/1.1 404 Not Found</D:status>`,
+		},
+	}, {
+		"principal collection",
+		"PROPFIND", "/dav/principals/", `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:displayname/></D:prop></D:propfind>`, "1",
+		StatusMulti,
+		[]string{
+			`<D:href>/dav/principals/</D:href>`,
+			`<D:href>/dav/principals/alice/</D:href>`,
+			`<D:href>/dav/principals/bob/</D:href><D:propstat><D:prop><D:displayname>bob</D:displayname>`,
+		},
+	}, {
+		"unknown principal",
+		"PROPFIND", "/dav/principals/carol/", "", "0",
+		http.StatusNotFound,
+		nil,
+	}, {
+		"read-only",
+		"PUT", "/dav/principals/alice/x", "content", "",
+		http.StatusMethodNotAllowed,
+		nil,
+	}}
+
+	for _, tc := range testCases {
+		w := do(tc.method, tc.target, tc.body, "Depth", tc.depth)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s: got %s, want %s", tc.desc, w.Body.String(), want)
+			}
+		}
+	}
+}
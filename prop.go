@@ -25,11 +25,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"mime"
 	"net/http"
 	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -102,7 +102,10 @@ type DeadPropsHolder interface {
 
 	// Patch patches the dead properties held.
 	//
-	// Patching is atomic; either all or no patches succeed. It returns (nil,
+	// Patching is atomic; either all or no patches succeed. The Handler
+	// applies the changes to writable live properties of the same PROPPATCH
+	// request before calling Patch, and reverts them unless all patches
+	// succeed, so Patch must never apply a part of the patches. It returns (nil,
 	// non-nil) if an internal server error occurred, otherwise the Propstats
 	// collectively contain one Property for each proposed patch Property. If
 	// all patches succeed, Patch returns a slice of length one and a Propstat
@@ -114,14 +117,37 @@ type DeadPropsHolder interface {
 	Patch([]Proppatch) ([]Propstat, error)
 }
 
-// liveProps contains all supported, protected DAV: properties.
-var liveProps = map[xml.Name]struct {
+// liveProp implements a live property.
+type liveProp struct {
 	// findFn implements the propfind function of this property. If nil,
 	// it indicates a hidden property.
 	findFn func(context.Context, FileSystem, LockSystem, string, os.FileInfo) (string, error)
 	// dir is true if the property applies to directories.
 	dir bool
-}{
+	// supported, if non-nil, reports whether the property is available for
+	// the given file. It is used for properties backed by optional
+	// interfaces.
+	supported func(FileSystem, os.FileInfo) bool
+	// patchFn, if non-nil, makes the property writable using PROPPATCH. It
+	// sets, or removes if remove is true, the property and returns a
+	// function reverting the change, so that PROPPATCH requests can be
+	// rolled back as a unit. A permission error makes the patch fail with
+	// "403 Forbidden" and an invalid value, reported by wrapping
+	// errInvalidPropValue, with "409 Conflict".
+	patchFn func(ctx context.Context, fs FileSystem, name string, remove bool, p Property) (undo func() error, err error)
+	// onlyNamed is true if the property is only reported when requested by
+	// name, and not by propname and allprop requests.
+	onlyNamed bool
+	// dead is true if the property can be set using PROPPATCH as a dead
+	// property, whose value then takes precedence over findFn.
+	dead bool
+	// deadIf, if non-nil, makes the property behave as if dead was true
+	// for the requests whose context it returns true for.
+	deadIf func(ctx context.Context) bool
+}
+
+// liveProps contains all supported, protected DAV: properties.
+var liveProps = map[xml.Name]liveProp{
 	{Space: "DAV:", Local: "resourcetype"}: {
 		findFn: findResourceType,
 		dir:    true,
@@ -129,6 +155,7 @@ var liveProps = map[xml.Name]struct {
 	{Space: "DAV:", Local: "displayname"}: {
 		findFn: findDisplayName,
 		dir:    true,
+		dead:   true,
 	},
 	{Space: "DAV:", Local: "getcontentlength"}: {
 		findFn: findContentLength,
@@ -146,16 +173,19 @@ var liveProps = map[xml.Name]struct {
 		dir: true,
 	},
 	{Space: "DAV:", Local: "creationdate"}: {
-		findFn: nil,
-		dir:    false,
+		findFn:    findCreationDate,
+		dir:       true,
+		supported: hasCreationTime,
 	},
 	{Space: "DAV:", Local: "getcontentlanguage"}: {
 		findFn: nil,
 		dir:    false,
+		dead:   true,
 	},
-	{Space: "DAV:", Local: "getcontenttype"}: {
+	contentTypePropName: {
 		findFn: findContentType,
 		dir:    false,
+		deadIf: contentTypeOverrides,
 	},
 	{Space: "DAV:", Local: "getetag"}: {
 		findFn: findETag,
@@ -174,15 +204,213 @@ var liveProps = map[xml.Name]struct {
 		findFn: findSupportedLock,
 		dir:    true,
 	},
+	fileIDPropName: {
+		findFn:    findFileID,
+		dir:       true,
+		supported: supportsFileID,
+	},
+	{Space: "DAV:", Local: "current-user-principal"}: {
+		findFn:    findCurrentUserPrincipal,
+		dir:       true,
+		onlyNamed: true,
+	},
+	mediaWidthPropName: {
+		findFn:    findMediaWidth,
+		dir:       false,
+		onlyNamed: true,
+		deadIf:    withoutMediaMetadata,
+	},
+	mediaHeightPropName: {
+		findFn:    findMediaHeight,
+		dir:       false,
+		onlyNamed: true,
+		deadIf:    withoutMediaMetadata,
+	},
+	mediaDurationPropName: {
+		findFn:    findMediaDuration,
+		dir:       false,
+		onlyNamed: true,
+		deadIf:    withoutMediaMetadata,
+	},
+	mediaDateTakenPropName: {
+		findFn:    findMediaDateTaken,
+		dir:       false,
+		onlyNamed: true,
+		deadIf:    withoutMediaMetadata,
+	},
+	mediaCodecPropName: {
+		findFn:    findMediaCodec,
+		dir:       false,
+		onlyNamed: true,
+		deadIf:    withoutMediaMetadata,
+	},
+	{Space: "DAV:", Local: "version-history"}: {
+		findFn:    findVersionHistory,
+		dir:       false,
+		supported: supportsVersions,
+		onlyNamed: true,
+	},
+	{Space: "DAV:", Local: "checked-in"}: {
+		findFn:    findCheckedIn,
+		dir:       false,
+		supported: supportsVersions,
+		onlyNamed: true,
+	},
+	{Space: "DAV:", Local: "principal-collection-set"}: {
+		findFn:    findPrincipalCollectionSet,
+		dir:       true,
+		onlyNamed: true,
+	},
+	{Space: "DAV:", Local: "current-user-privilege-set"}: {
+		findFn:    findCurrentUserPrivilegeSet,
+		dir:       true,
+		onlyNamed: true,
+		deadIf:    withoutAccessControl,
+	},
+	{Space: "DAV:", Local: "acl"}: {
+		findFn:    findACL,
+		dir:       true,
+		onlyNamed: true,
+		deadIf:    withoutAccessControl,
+	},
+	{Space: "DAV:", Local: "owner"}: {
+		findFn:    findACLOwner,
+		dir:       true,
+		onlyNamed: true,
+		deadIf:    withoutAccessControl,
+	},
+	{Space: "DAV:", Local: "supported-privilege-set"}: {
+		findFn:    findSupportedPrivilegeSet,
+		dir:       true,
+		onlyNamed: true,
+		deadIf:    withoutAccessControl,
+	},
+	pinnedPropName: {
+		findFn:    findPinned,
+		dir:       true,
+		supported: supportsPinned,
+		patchFn:   patchPinned,
+	},
+	checksumsPropName: {
+		findFn:    findChecksums,
+		dir:       false,
+		supported: supportsContentHashes,
+		onlyNamed: true,
+	},
+	contentHashPropName: {
+		findFn:    findContentHash,
+		dir:       false,
+		supported: supportsContentHashes,
+		onlyNamed: true,
+	},
+	executablePropName: {
+		findFn:    findExecutable,
+		dir:       false,
+		patchFn:   patchExecutable,
+		onlyNamed: true,
+	},
+	ownerPropName: {
+		findFn:    findOwner,
+		dir:       true,
+		supported: supportsOwner,
+		patchFn:   patchOwner,
+		onlyNamed: true,
+	},
+	groupPropName: {
+		findFn:    findGroup,
+		dir:       true,
+		supported: supportsOwner,
+		patchFn:   patchGroup,
+		onlyNamed: true,
+	},
+	// The Windows properties are set by Windows clients on every upload:
+	// the changes the FileSystem can't apply are accepted and ignored, so
+	// that the uploads don't fail. See Win32FS.
+	win32CreationTimePropName: {
+		findFn:    findWin32CreationTime,
+		dir:       true,
+		patchFn:   patchWin32CreationTime,
+		onlyNamed: true,
+	},
+	win32LastAccessTimePropName: {
+		findFn:    findWin32LastAccessTime,
+		dir:       true,
+		patchFn:   patchWin32LastAccessTime,
+		onlyNamed: true,
+	},
+	win32LastModifiedTimePropName: {
+		findFn:    findWin32LastModifiedTime,
+		dir:       true,
+		patchFn:   patchWin32LastModifiedTime,
+		onlyNamed: true,
+	},
+	win32FileAttributesPropName: {
+		findFn:    findWin32FileAttributes,
+		dir:       true,
+		patchFn:   patchWin32FileAttributes,
+		onlyNamed: true,
+	},
+	// RFC 4331 quota properties are not returned by allprop.
+	{Space: "DAV:", Local: "quota-available-bytes"}: {
+		findFn:    findQuotaAvailableBytes,
+		dir:       true,
+		supported: supportsQuota,
+		onlyNamed: true,
+	},
+	{Space: "DAV:", Local: "quota-used-bytes"}: {
+		findFn:    findQuotaUsedBytes,
+		dir:       true,
+		supported: supportsQuota,
+		onlyNamed: true,
+	},
+	syncTokenPropName: {
+		findFn:    findSyncToken,
+		dir:       true,
+		supported: supportsSyncToken,
+		onlyNamed: true,
+	},
+	quotaWarningPropName: {
+		findFn:    findQuotaWarning,
+		dir:       true,
+		supported: supportsQuota,
+		onlyNamed: true,
+	},
 }
 
+// quotaWarningPropName is the name of the vendor property reporting the
+// highest Handler.QuotaWarnings threshold crossed by a collection.
+var quotaWarningPropName = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "quota-warning"}
+
+// fileIDPropName is the name of the vendor property exposing FileIDer IDs.
+// It uses the ownCloud namespace, as understood by Nextcloud and ownCloud
+// clients.
+var fileIDPropName = xml.Name{Space: "http://owncloud.org/ns", Local: "fileid"}
+
+// pinnedPropName is the name of the property exposing and setting the Pinner
+// state of a resource. Unlike the other live properties, it can be set and
+// removed using PROPPATCH.
+var pinnedPropName = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "pinned"}
+
+// checksumsPropName is the name of the ownCloud property reporting the
+// checksums of a file, as understood by Nextcloud and ownCloud clients.
+var checksumsPropName = xml.Name{Space: "http://owncloud.org/ns", Local: "checksums"}
+
+// contentHashPropName is the name of the vendor property reporting the
+// checksums of a file.
+var contentHashPropName = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "getcontenthash"}
+
+// executablePropName is the name of the Apache mod_dav property exposing
+// the owner execute permission bit of a file, used by Unix clients such as
+// cadaver and davfs2.
+var executablePropName = xml.Name{Space: "http://apache.org/dav/props/", Local: "executable"}
+
 // TODO(nigeltao) merge props and allprop?
 
 // props returns the status of the properties named pnames for resource name.
 //
 // Each Propstat has a unique status and each property name will only be part
 // of one Propstat element.
-func props(ctx context.Context, fs FileSystem, ls LockSystem, name string, pnames []xml.Name, fi os.FileInfo) ([]Propstat, error) {
+func props(ctx context.Context, fs FileSystem, ls LockSystem, ps PropStore, name string, pnames []xml.Name, fi os.FileInfo) ([]Propstat, error) {
 	if fi == nil {
 		var err error
 		fi, err = fs.Stat(ctx, name)
@@ -192,13 +420,10 @@ func props(ctx context.Context, fs FileSystem, ls LockSystem, name string, pname
 	}
 	isDir := fi.IsDir()
 
-	var deadProps map[xml.Name]Property
-	/*if dph, ok := f.(DeadPropsHolder); ok {
-		deadProps, err = dph.DeadProps()
-		if err != nil {
-			return nil, err
-		}
-	}*/
+	deadProps, err := readDeadProps(ctx, fs, ps, name)
+	if err != nil {
+		return nil, err
+	}
 
 	pstatOK := Propstat{Status: http.StatusOK}
 	pstatNotFound := Propstat{Status: http.StatusNotFound}
@@ -209,8 +434,14 @@ func props(ctx context.Context, fs FileSystem, ls LockSystem, name string, pname
 			continue
 		}
 		// Otherwise, it must either be a live property or we don't know it.
-		if prop := liveProps[pn]; prop.findFn != nil && (prop.dir || !isDir) {
+		if prop, _ := findLiveProp(ctx, pn); prop.findFn != nil && (prop.dir || !isDir) && (prop.supported == nil || prop.supported(fs, fi)) {
 			innerXML, err := prop.findFn(ctx, fs, ls, name, fi)
+			if err == ErrNotImplemented {
+				pstatNotFound.Props = append(pstatNotFound.Props, Property{
+					XMLName: pn,
+				})
+				continue
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -228,7 +459,7 @@ func props(ctx context.Context, fs FileSystem, ls LockSystem, name string, pname
 }
 
 // propnames returns the property names defined for resource name.
-func propnames(ctx context.Context, fs FileSystem, _ LockSystem, name string, fi os.FileInfo) ([]xml.Name, error) {
+func propnames(ctx context.Context, fs FileSystem, _ LockSystem, ps PropStore, name string, fi os.FileInfo) ([]xml.Name, error) {
 	if fi == nil {
 		var err error
 		fi, err = fs.Stat(ctx, name)
@@ -238,26 +469,44 @@ func propnames(ctx context.Context, fs FileSystem, _ LockSystem, name string, fi
 	}
 	isDir := fi.IsDir()
 
-	var deadProps map[xml.Name]Property
-	/*if dph, ok := f.(DeadPropsHolder); ok {
-		deadProps, err = dph.DeadProps()
-		if err != nil {
-			return nil, err
-		}
-	}*/
+	deadProps, err := readDeadProps(ctx, fs, ps, name)
+	if err != nil {
+		return nil, err
+	}
 
 	pnames := make([]xml.Name, 0, len(liveProps)+len(deadProps))
 	for pn, prop := range liveProps {
-		if prop.findFn != nil && (prop.dir || !isDir) {
+		if _, ok := deadProps[pn]; ok {
+			continue
+		}
+		if prop.findFn != nil && !prop.onlyNamed && (prop.dir || !isDir) && (prop.supported == nil || prop.supported(fs, fi)) {
 			pnames = append(pnames, pn)
 		}
 	}
-	/*for pn := range deadProps {
+	for pn := range deadProps {
 		pnames = append(pnames, pn)
-	}*/
+	}
 	return pnames, nil
 }
 
+// readDeadProps returns the dead properties of resource name. They are
+// read from ps if it is non-nil, otherwise from the File of the resource if
+// it implements DeadPropsHolder, consistently with patchDead.
+func readDeadProps(ctx context.Context, fs FileSystem, ps PropStore, name string) (map[xml.Name]Property, error) {
+	if ps != nil {
+		return ps.Get(ctx, name)
+	}
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if dph, ok := f.(DeadPropsHolder); ok {
+		return dph.DeadProps()
+	}
+	return nil, nil
+}
+
 // allprop returns the properties defined for resource name and the properties
 // named in include.
 //
@@ -266,8 +515,8 @@ func propnames(ctx context.Context, fs FileSystem, _ LockSystem, name string, fi
 // returned if they are named in 'include'.
 //
 // See http://www.webdav.org/specs/rfc4918.html#METHOD_PROPFIND
-func allprop(ctx context.Context, fs FileSystem, ls LockSystem, name string, include []xml.Name, fi os.FileInfo) ([]Propstat, error) {
-	pnames, err := propnames(ctx, fs, ls, name, fi)
+func allprop(ctx context.Context, fs FileSystem, ls LockSystem, ps PropStore, name string, include []xml.Name, fi os.FileInfo) ([]Propstat, error) {
+	pnames, err := propnames(ctx, fs, ls, ps, name, fi)
 	if err != nil {
 		return nil, err
 	}
@@ -281,12 +530,34 @@ func allprop(ctx context.Context, fs FileSystem, ls LockSystem, name string, inc
 			pnames = append(pnames, pn)
 		}
 	}
-	return props(ctx, fs, ls, name, pnames, fi)
+	return props(ctx, fs, ls, ps, name, pnames, fi)
 }
 
 // patch patches the properties of resource name. The return values are
 // constrained in the same manner as DeadPropsHolder.Patch.
-func patch(ctx context.Context, fs FileSystem, _ LockSystem, name string, patches []Proppatch) ([]Propstat, error) {
+func patch(ctx context.Context, fs FileSystem, ls LockSystem, ps PropStore, name string, patches []Proppatch) ([]Propstat, error) {
+	var fi os.FileInfo
+	// patchFn returns the function patching pn, or nil if pn is not a
+	// writable live property of the resource. protected reports whether pn
+	// is a live property that cannot be patched at all.
+	patchFn := func(pn xml.Name) (fn func(context.Context, FileSystem, string, bool, Property) (func() error, error), protected bool) {
+		prop, ok := findLiveProp(ctx, pn)
+		if !ok || prop.patchFn == nil {
+			return nil, ok && !prop.dead && (prop.deadIf == nil || !prop.deadIf(ctx))
+		}
+		if prop.supported != nil {
+			if fi == nil {
+				var err error
+				if fi, err = fs.Stat(ctx, name); err != nil {
+					return nil, true
+				}
+			}
+			if !prop.supported(fs, fi) {
+				return nil, true
+			}
+		}
+		return prop.patchFn, false
+	}
 	conflict := false
 loop:
 	for _, patch := range patches {
@@ -296,7 +567,7 @@ loop:
 			if p.XMLName.Local == "getlastmodified" {
 				continue
 			}
-			if _, ok := liveProps[p.XMLName]; ok {
+			if _, protected := patchFn(p.XMLName); protected {
 				conflict = true
 				break loop
 			}
@@ -312,7 +583,7 @@ loop:
 		}
 		for _, patch := range patches {
 			for _, p := range patch.Props {
-				if _, ok := liveProps[p.XMLName]; ok {
+				if _, protected := patchFn(p.XMLName); protected {
 					pstatForbidden.Props = append(pstatForbidden.Props, Property{XMLName: p.XMLName})
 				} else {
 					pstatFailedDep.Props = append(pstatFailedDep.Props, Property{XMLName: p.XMLName})
@@ -322,6 +593,102 @@ loop:
 		return makePropstats(pstatForbidden, pstatFailedDep), nil
 	}
 
+	// Apply the writable live properties first, remembering how to revert
+	// them, and then the dead properties as a unit.
+	var (
+		live  []Property
+		undos []func() error
+		dead  []Proppatch
+	)
+	rollback := func() error {
+		var err error
+		for i := len(undos) - 1; i >= 0; i-- {
+			if undoErr := undos[i](); undoErr != nil && err == nil {
+				err = undoErr
+			}
+		}
+		return err
+	}
+	for _, patch := range patches {
+		var props []Property
+		for _, p := range patch.Props {
+			fn, _ := patchFn(p.XMLName)
+			if fn == nil {
+				props = append(props, p)
+				continue
+			}
+			undo, err := fn(ctx, fs, name, patch.Remove, p)
+			if err != nil {
+				if undoErr := rollback(); undoErr != nil {
+					return nil, undoErr
+				}
+				status := http.StatusForbidden
+				switch {
+				case errors.Is(err, os.ErrPermission):
+				case errors.Is(err, errInvalidPropValue):
+					status = http.StatusConflict
+				default:
+					return nil, err
+				}
+				return patchFailed(patches, p.XMLName, status), nil
+			}
+			live = append(live, Property{XMLName: p.XMLName})
+			undos = append(undos, undo)
+		}
+		if len(props) > 0 {
+			dead = append(dead, Proppatch{Remove: patch.Remove, Props: props})
+		}
+	}
+	if len(dead) == 0 {
+		return []Propstat{{Status: http.StatusOK, Props: live}}, nil
+	}
+	ret, err := patchDead(ctx, fs, ps, name, dead)
+	if err == nil && len(ret) == 1 && ret[0].Status == http.StatusOK {
+		ret[0].Props = append(ret[0].Props, live...)
+		return ret, nil
+	}
+	if undoErr := rollback(); undoErr != nil && err == nil {
+		err = undoErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(live) > 0 {
+		ret = append(ret, Propstat{Status: StatusFailedDependency, Props: live})
+	}
+	return ret, nil
+}
+
+// patchFailed returns the Propstats of patches failed because the patch
+// of property pn failed with the given status.
+func patchFailed(patches []Proppatch, pn xml.Name, status int) []Propstat {
+	pstatFailed := Propstat{Status: status}
+	pstatFailedDep := Propstat{Status: StatusFailedDependency}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			if p.XMLName == pn {
+				pstatFailed.Props = append(pstatFailed.Props, Property{XMLName: p.XMLName})
+			} else {
+				pstatFailedDep.Props = append(pstatFailedDep.Props, Property{XMLName: p.XMLName})
+			}
+		}
+	}
+	return makePropstats(pstatFailed, pstatFailedDep)
+}
+
+// patchDead patches the dead properties of resource name. They are stored
+// in ps if it is non-nil, otherwise in the File of the resource if it
+// implements DeadPropsHolder.
+func patchDead(ctx context.Context, fs FileSystem, ps PropStore, name string, patches []Proppatch) ([]Propstat, error) {
+	if ps != nil {
+		if _, err := fs.Stat(ctx, name); err != nil {
+			if errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+				return patchesForbidden(patches), nil
+			}
+			return nil, err
+		}
+		return patchPropStore(ctx, ps, name, patches)
+	}
 	f, err := fs.OpenFile(ctx, name, os.O_RDWR, 0)
 	if err != nil {
 		stat, statErr := fs.Stat(ctx, name)
@@ -339,21 +706,34 @@ loop:
 		if err != nil {
 			return nil, err
 		}
-		// http://www.webdav.org/specs/rfc4918.html#ELEMENT_propstat says that
-		// "The contents of the prop XML element must only list the names of
-		// properties to which the result in the status element applies."
-		for _, pstat := range ret {
-			for i, p := range pstat.Props {
-				pstat.Props[i] = Property{XMLName: p.XMLName}
-			}
-		}
-		return ret, nil
+		return propstatNames(ret), nil
 	}
-	// The file doesn't implement the optional DeadPropsHolder interface, so
-	// all patches are forbidden.
+	// The file doesn't implement the optional DeadPropsHolder interface and
+	// there is no PropStore, so all patches are forbidden.
 	return patchesForbidden(patches), nil
 }
 
+func patchPropStore(ctx context.Context, ps PropStore, name string, patches []Proppatch) ([]Propstat, error) {
+	ret, err := ps.Patch(ctx, name, patches)
+	if err != nil {
+		return nil, err
+	}
+	return propstatNames(ret), nil
+}
+
+// propstatNames strips the property values from pstats.
+func propstatNames(pstats []Propstat) []Propstat {
+	// http://www.webdav.org/specs/rfc4918.html#ELEMENT_propstat says that
+	// "The contents of the prop XML element must only list the names of
+	// properties to which the result in the status element applies."
+	for _, pstat := range pstats {
+		for i, p := range pstat.Props {
+			pstat.Props[i] = Property{XMLName: p.XMLName}
+		}
+	}
+	return pstats
+}
+
 func patchesForbidden(patches []Proppatch) []Propstat {
 	pstat := Propstat{Status: http.StatusForbidden}
 	for _, patch := range patches {
@@ -385,10 +765,19 @@ func escapeXML(s string) string {
 }
 
 func findResourceType(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	rt := ""
 	if fi.IsDir() {
-		return `<D:collection xmlns:D="DAV:"/>`, nil
+		rt = `<D:collection xmlns:D="DAV:"/>`
+	}
+	fns, _ := ctx.Value(resourceTypesKey{}).([]ResourceTypeFunc)
+	for _, fn := range fns {
+		v, err := fn(ctx, name, fi)
+		if err != nil {
+			return "", err
+		}
+		rt += v
 	}
-	return "", nil
+	return rt, nil
 }
 
 func findDisplayName(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
@@ -407,6 +796,31 @@ func findLastModified(ctx context.Context, fs FileSystem, ls LockSystem, name st
 	return fi.ModTime().UTC().Format(http.TimeFormat), nil
 }
 
+// CreationTimer is an optional interface for the os.FileInfo objects
+// returned by the FileSystem. If implemented, the creation time of the file
+// is reported by the DAV:creationdate property, otherwise the property is
+// not available.
+type CreationTimer interface {
+	// CreationTime returns the creation time of the file. A zero time is
+	// unknown and not reported.
+	CreationTime() time.Time
+}
+
+func hasCreationTime(fs FileSystem, fi os.FileInfo) bool {
+	_, ok := fi.(CreationTimer)
+	return ok
+}
+
+func findCreationDate(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	if ct, ok := fi.(CreationTimer); ok {
+		if t := ct.CreationTime(); !t.IsZero() {
+			// RFC 4918 section 15.1 requires the date-time format of RFC 3339.
+			return t.UTC().Format(time.RFC3339), nil
+		}
+	}
+	return "", ErrNotImplemented
+}
+
 // ErrNotImplemented should be returned by optional interfaces if they
 // want the original implementation to be used.
 var ErrNotImplemented = errors.New("not implemented")
@@ -417,34 +831,57 @@ var ErrNotImplemented = errors.New("not implemented")
 // If this interface is defined then it will be used to read the
 // content type from the object.
 //
-// If this interface is not defined the file will be opened and the
-// content type will be guessed from the initial contents of the file.
+// If this interface is not defined the content type will be guessed from
+// the extension or the initial contents of the file. See ContentTypes.
+//
+// Backends that already know the content type and the ETag of their files,
+// such as databases and object stores, should return os.FileInfo objects
+// implementing both ContentTyper and ETager, from Stat, Readdir and the Stat
+// method of their Files: PROPFIND and GET requests then never read the
+// files to sniff their content type.
 type ContentTyper interface {
 	// ContentType returns the content type for the file.
 	//
-	// If this returns error ErrNotImplemented then the error will
-	// be ignored and the base implementation will be used
-	// instead.
+	// If this returns error ErrNotImplemented, or an empty content type,
+	// then the base implementation will be used instead.
 	ContentType(ctx context.Context) (string, error)
 }
 
-func findContentType(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
-	if do, ok := fi.(ContentTyper); ok {
-		ctype, err := do.ContentType(ctx)
-		if err != ErrNotImplemented {
-			return ctype, err
+// contentLanguage returns the value of the Content-Language header for file
+// name, set as its getcontentlanguage dead property, or "" if it has none.
+func contentLanguage(ctx context.Context, ps PropStore, name string) (string, error) {
+	if ps == nil {
+		return "", nil
+	}
+	deadProps, err := ps.Get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	p, ok := deadProps[xml.Name{Space: "DAV:", Local: "getcontentlanguage"}]
+	if !ok {
+		return "", nil
+	}
+	lang := strings.TrimSpace(string(p.InnerXML))
+	// Only language tags, possibly comma separated, are valid values.
+	for _, c := range lang {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == ',' || c == ' ') {
+			return "", nil
 		}
 	}
+	return lang, nil
+}
+
+func findContentType(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	ctype, err := knownContentType(ctx, name, fi)
+	if ctype != "" || err != nil {
+		return ctype, err
+	}
 	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 	// This implementation is based on serveContent's code in the standard net/http package.
-	ctype := mime.TypeByExtension(filepath.Ext(name))
-	if ctype != "" {
-		return ctype, nil
-	}
 	// Read a chunk to decide between utf-8 text and binary.
 	var buf [512]byte
 	n, err := io.ReadFull(f, buf[:])
@@ -464,7 +901,13 @@ func findContentType(ctx context.Context, fs FileSystem, ls LockSystem, name str
 // for the object.
 //
 // If this interface is not defined an ETag will be computed using the
-// ModTime() and the Size() methods of the os.FileInfo object.
+// ModTime() and the Size() methods of the os.FileInfo object, unless the
+// FileSystem implements ETagFS.
+//
+// The File objects returned by the FileSystem may implement it too, for
+// example if the ETag is only known once the content is open. It is then
+// used by GET and HEAD requests, and should be consistent with the one
+// reported by the os.FileInfo objects or the FileSystem.
 type ETager interface {
 	// ETag returns an ETag for the file.  This should be of the
 	// form "value" or W/"value"
@@ -475,6 +918,32 @@ type ETager interface {
 	ETag(ctx context.Context) (string, error)
 }
 
+// ETagFS is an optional interface for the FileSystem, supplying the ETags
+// of resources whose os.FileInfo objects don't implement ETager, for example
+// from a content hash, the version ID of an object store or the revision of
+// a database, when modification times are unreliable.
+type ETagFS interface {
+	// ETag returns the ETag of resource name, whose os.FileInfo is fi, in
+	// the form "value" or W/"value".
+	//
+	// If this returns error ErrNotImplemented then the error will
+	// be ignored and the base implementation will be used
+	// instead.
+	ETag(ctx context.Context, name string, fi os.FileInfo) (string, error)
+}
+
+// fileETag returns the ETag of the file name open as f, whose os.FileInfo is
+// fi.
+func fileETag(ctx context.Context, fs FileSystem, ls LockSystem, name string, f File, fi os.FileInfo) (string, error) {
+	if do, ok := f.(ETager); ok {
+		etag, err := do.ETag(ctx)
+		if err != ErrNotImplemented {
+			return etag, err
+		}
+	}
+	return findETag(ctx, fs, ls, name, fi)
+}
+
 func findETag(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
 	if do, ok := fi.(ETager); ok {
 		etag, err := do.ETag(ctx)
@@ -482,36 +951,466 @@ func findETag(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi
 			return etag, err
 		}
 	}
+	if do, ok := fs.(ETagFS); ok {
+		etag, err := do.ETag(ctx, name, fi)
+		if err != ErrNotImplemented {
+			return etag, err
+		}
+	}
 	// The Apache http 2.4 web server by default concatenates the
 	// modification time and size of a file. We replicate the heuristic
 	// with nanosecond granularity.
 	return fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size()), nil
 }
 
-func findSupportedLock(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
-	return `` +
-		`<D:lockentry xmlns:D="DAV:">` +
+// lockNullPropNames are the properties defined for lock-null resources.
+var lockNullPropNames = []xml.Name{
+	{Space: "DAV:", Local: "resourcetype"},
+	{Space: "DAV:", Local: "lockdiscovery"},
+	{Space: "DAV:", Local: "supportedlock"},
+}
+
+// lockNullProps returns the status of the properties named pnames for the
+// lock-null resource locked by l. If pnames is nil, all the properties
+// defined for lock-null resources are returned. If propname is true, only
+// the names of the properties are returned.
+func lockNullProps(l ActiveLock, pnames []xml.Name, propname bool) []Propstat {
+	if pnames == nil {
+		pnames = lockNullPropNames
+	}
+	pstatOK := Propstat{Status: http.StatusOK}
+	pstatNotFound := Propstat{Status: http.StatusNotFound}
+	for _, pn := range pnames {
+		var innerXML string
+		switch pn {
+		case lockNullPropNames[0]:
+			// A lock-null resource has an empty resourcetype.
+		case lockNullPropNames[1]:
+			var b strings.Builder
+			writeActiveLock(&b, l)
+			innerXML = b.String()
+		case lockNullPropNames[2]:
+			innerXML, _ = findSupportedLock(context.Background(), nil, nil, l.Details.Root, nil)
+		default:
+			pstatNotFound.Props = append(pstatNotFound.Props, Property{XMLName: pn})
+			continue
+		}
+		if propname {
+			innerXML = ""
+		}
+		pstatOK.Props = append(pstatOK.Props, Property{
+			XMLName:  pn,
+			InnerXML: []byte(innerXML),
+		})
+	}
+	return makePropstats(pstatOK, pstatNotFound)
+}
+
+// FileIDer is an optional interface for the os.FileInfo objects
+// returned by the FileSystem.
+//
+// If this interface is defined then it will be used to read a stable
+// identifier for the file, such as an inode number or an object ID. The
+// identifier must not change when the file is renamed or moved, so that
+// clients can track files across renames. It is reported as the
+// oc:fileid property.
+//
+// If this interface is not defined the oc:fileid property is not reported.
+type FileIDer interface {
+	// FileID returns a stable identifier for the file.
+	//
+	// If this returns error ErrNotImplemented then the oc:fileid
+	// property will not be reported for the file.
+	FileID(ctx context.Context) (string, error)
+}
+
+func supportsFileID(_ FileSystem, fi os.FileInfo) bool {
+	_, ok := fi.(FileIDer)
+	return ok
+}
+
+func findFileID(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	if do, ok := fi.(FileIDer); ok {
+		id, err := do.FileID(ctx)
+		if err != nil {
+			return "", err
+		}
+		return escapeXML(id), nil
+	}
+	return "", ErrNotImplemented
+}
+
+// Pinner is an optional interface for the FileSystem. Pinned resources
+// should be exempted from automatic cleanup, such as trash purge, version
+// pruning, tiering and cache eviction, by the components implementing it.
+//
+// The pin state is exposed as a property that can be set using PROPPATCH:
+// "1" pins the resource, "0" or removing the property unpins it.
+type Pinner interface {
+	// Pin pins or unpins the named resource.
+	Pin(ctx context.Context, name string, pinned bool) error
+	// Pinned reports whether the named resource is pinned.
+	Pinned(ctx context.Context, name string) (bool, error)
+}
+
+func supportsPinned(fs FileSystem, _ os.FileInfo) bool {
+	_, ok := fs.(Pinner)
+	return ok
+}
+
+func findPinned(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	pinner, ok := fs.(Pinner)
+	if !ok {
+		return "", ErrNotImplemented
+	}
+	pinned, err := pinner.Pinned(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if pinned {
+		return "1", nil
+	}
+	return "0", nil
+}
+
+// patchPinned sets the pin state of resource name, which is cleared when the
+// property is removed or its value is empty, "0" or "false".
+func patchPinned(ctx context.Context, fs FileSystem, name string, remove bool, p Property) (func() error, error) {
+	pinner := fs.(Pinner)
+	v := strings.TrimSpace(string(p.InnerXML))
+	pinned := !remove && v != "" && v != "0" && v != "false"
+	prev, err := pinner.Pinned(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := pinner.Pin(ctx, name, pinned); err != nil {
+		return nil, err
+	}
+	return func() error {
+		if prev == pinned {
+			return nil
+		}
+		return pinner.Pin(ctx, name, prev)
+	}, nil
+}
+
+// Chmoder is an optional interface for the FileSystem, changing the
+// permission bits of resources. It makes the Apache mod_dav executable
+// property writable using PROPPATCH.
+type Chmoder interface {
+	// Chmod changes the permission bits of resource name to mode.
+	Chmod(ctx context.Context, name string, mode os.FileMode) error
+}
+
+func findExecutable(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	if fi.Mode().Perm()&modePolicy(fs).executableBits() != 0 {
+		return "T", nil
+	}
+	return "F", nil
+}
+
+// patchExecutable sets or clears the execute permission bits of file name,
+// which are the owner one by default, as in mod_dav. The property cannot be
+// removed.
+func patchExecutable(ctx context.Context, fs FileSystem, name string, remove bool, p Property) (func() error, error) {
+	chmoder, ok := fs.(Chmoder)
+	if !ok {
+		return nil, os.ErrPermission
+	}
+	var executable bool
+	switch v := strings.TrimSpace(string(p.InnerXML)); {
+	case remove:
+		return nil, errInvalidPropValue
+	case v == "T":
+		executable = true
+	case v == "F":
+	default:
+		return nil, errInvalidPropValue
+	}
+	fi, err := fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, os.ErrPermission
+	}
+	bits := modePolicy(fs).executableBits()
+	prev := fi.Mode().Perm()
+	perm := prev &^ bits
+	if executable {
+		perm |= bits
+	}
+	if perm == prev {
+		return func() error { return nil }, nil
+	}
+	if err := chmoder.Chmod(ctx, name, perm); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return chmoder.Chmod(ctx, name, prev)
+	}, nil
+}
+
+// QuotaFS is an optional interface for the FileSystem, reporting the
+// RFC 4331 quota of collections as the DAV:quota-used-bytes and
+// DAV:quota-available-bytes properties. Clients use them to show how much
+// space is left.
+type QuotaFS interface {
+	// Quota returns the bytes used by the collection name and the bytes
+	// still available to it. A negative available value means that there
+	// is no limit.
+	Quota(ctx context.Context, name string) (used, available int64, err error)
+}
+
+func supportsQuota(fs FileSystem, fi os.FileInfo) bool {
+	_, ok := fs.(QuotaFS)
+	return ok && fi.IsDir()
+}
+
+func findQuotaAvailableBytes(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	_, available, err := fs.(QuotaFS).Quota(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if available < 0 {
+		// Without a limit there is no meaningful value to report.
+		return "", ErrNotImplemented
+	}
+	return strconv.FormatInt(available, 10), nil
+}
+
+func findQuotaUsedBytes(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	used, _, err := fs.(QuotaFS).Quota(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(used, 10), nil
+}
+
+type quotaWarningsKey struct{}
+
+func withQuotaWarnings(ctx context.Context, thresholds []int) context.Context {
+	return context.WithValue(ctx, quotaWarningsKey{}, thresholds)
+}
+
+// quotaWarning returns the highest of the Handler.QuotaWarnings thresholds
+// in ctx crossed by the usage of the quota of collection name, or 0 if
+// none is crossed or the quota is unlimited.
+func quotaWarning(ctx context.Context, fs FileSystem, name string) (int, error) {
+	thresholds, _ := ctx.Value(quotaWarningsKey{}).([]int)
+	qfs, ok := fs.(QuotaFS)
+	if !ok || len(thresholds) == 0 {
+		return 0, nil
+	}
+	used, available, err := qfs.Quota(ctx, name)
+	if err != nil || available < 0 || used+available <= 0 {
+		return 0, err
+	}
+	usage := float64(used) * 100 / float64(used+available)
+	warning := 0
+	for _, t := range thresholds {
+		if usage >= float64(t) && t > warning {
+			warning = t
+		}
+	}
+	return warning, nil
+}
+
+func findQuotaWarning(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	warning, err := quotaWarning(ctx, fs, name)
+	if err != nil {
+		return "", err
+	}
+	if warning == 0 {
+		return "", ErrNotImplemented
+	}
+	return strconv.Itoa(warning) + "%", nil
+}
+
+// ContentHasher is an optional interface for the FileSystem exposing the
+// checksums of files, so that sync clients can avoid transferring unchanged
+// files. The checksums are reported by the ownCloud checksums property, by
+// the getcontenthash vendor property and by the OC-Checksum header of GET
+// and PUT responses.
+type ContentHasher interface {
+	// ContentHashes returns the hex encoded checksums of file name, keyed
+	// by algorithm, for example "SHA1", "MD5" or "ADLER32". It returns
+	// ErrNotImplemented if no checksum is available.
+	ContentHashes(ctx context.Context, name string) (map[string]string, error)
+}
+
+// checksumHeaderAlgorithms are the algorithms reported by the OC-Checksum
+// header, by preference.
+var checksumHeaderAlgorithms = []string{"SHA1", "MD5", "ADLER32"}
+
+func supportsContentHashes(fs FileSystem, _ os.FileInfo) bool {
+	_, ok := fs.(ContentHasher)
+	return ok
+}
+
+// contentHashes returns the checksums of file name, formatted as
+// "ALGORITHM:hash" and sorted by algorithm.
+func contentHashes(ctx context.Context, fs FileSystem, name string) ([]string, error) {
+	hasher, ok := fs.(ContentHasher)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	hashes, err := hasher.ContentHashes(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(hashes) == 0 {
+		return nil, ErrNotImplemented
+	}
+	ret := make([]string, 0, len(hashes))
+	for alg, sum := range hashes {
+		ret = append(ret, strings.ToUpper(alg)+":"+sum)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func findChecksums(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	hashes, err := contentHashes(ctx, fs, name)
+	if err != nil {
+		return "", err
+	}
+	return `<oc:checksum xmlns:oc="http://owncloud.org/ns">` + escapeXML(strings.Join(hashes, " ")) +
+		`</oc:checksum>`, nil
+}
+
+func findContentHash(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	hashes, err := contentHashes(ctx, fs, name)
+	if err != nil {
+		return "", err
+	}
+	return escapeXML(strings.Join(hashes, " ")), nil
+}
+
+// checksumHeader returns the value of the OC-Checksum header for file name,
+// or an empty string if no checksum is available.
+func checksumHeader(ctx context.Context, fs FileSystem, name string) (string, error) {
+	hashes, err := contentHashes(ctx, fs, name)
+	if err == ErrNotImplemented {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, alg := range checksumHeaderAlgorithms {
+		for _, h := range hashes {
+			if strings.HasPrefix(h, alg+":") {
+				return h, nil
+			}
+		}
+	}
+	return hashes[0], nil
+}
+
+// LockEntry is a lock scope and lock type pair, as reported by the
+// DAV:supportedlock property. Scope is "exclusive" or "shared" and Type is
+// "write", the other entries are ignored. The Handler only grants exclusive
+// write locks, and only if they are supported.
+type LockEntry struct {
+	Scope string
+	Type  string
+}
+
+// lockEntryXML are the DAV:lockentry elements of the valid LockEntry
+// values, so that the property never contains markup from a
+// SupportedLocker.
+var lockEntryXML = map[LockEntry]string{
+	{Scope: "exclusive", Type: "write"}: `<D:lockentry xmlns:D="DAV:">` +
 		`<D:lockscope><D:exclusive/></D:lockscope>` +
 		`<D:locktype><D:write/></D:locktype>` +
-		`</D:lockentry>`, nil
+		`</D:lockentry>`,
+	{Scope: "shared", Type: "write"}: `<D:lockentry xmlns:D="DAV:">` +
+		`<D:lockscope><D:shared/></D:lockscope>` +
+		`<D:locktype><D:write/></D:locktype>` +
+		`</D:lockentry>`,
 }
 
-func findLockDiscovery(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
-	token, expiration, ld, err := ls.GetByName(name)
+// defaultLockEntries are the locks supported by the Handler.
+var defaultLockEntries = []LockEntry{{Scope: "exclusive", Type: "write"}}
+
+// SupportedLocker is an optional interface for the os.FileInfo objects
+// returned by the FileSystem.
+//
+// If this interface is defined then it will be used to report the locks
+// supported by the file, for example a file on a read-only mount may support
+// no locks at all. If no locks are supported, LOCK requests are rejected and
+// OPTIONS responses do not advertise the compliance class 2.
+//
+// If this interface is not defined, exclusive write locks are reported.
+type SupportedLocker interface {
+	// SupportedLocks returns the locks supported by the file.
+	//
+	// If this returns error ErrNotImplemented then the error will
+	// be ignored and the base implementation will be used
+	// instead.
+	SupportedLocks(ctx context.Context) ([]LockEntry, error)
+}
+
+// supportedLocks returns the valid lock entries supported by fi.
+func supportedLocks(ctx context.Context, fi os.FileInfo) ([]LockEntry, error) {
+	if do, ok := fi.(SupportedLocker); ok {
+		entries, err := do.SupportedLocks(ctx)
+		if err != ErrNotImplemented {
+			if err != nil {
+				return nil, err
+			}
+			valid := make([]LockEntry, 0, len(entries))
+			for _, e := range entries {
+				if _, ok := lockEntryXML[e]; ok {
+					valid = append(valid, e)
+				}
+			}
+			return valid, nil
+		}
+	}
+	return defaultLockEntries, nil
+}
+
+func findSupportedLock(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	entries, err := supportedLocks(ctx, fi)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
-	depth := "infinity"
-	if ld.ZeroDepth {
-		depth = "0"
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString(lockEntryXML[e])
 	}
-	var timeout string
-	if ld.Duration == infiniteTimeout {
-		timeout = "Infinite"
+	return b.String(), nil
+}
+
+func findLockDiscovery(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	var locks []ActiveLock
+	if ll, ok := ls.(LockLister); ok {
+		var err error
+		locks, err = ll.GetAllByName(name)
+		if err != nil {
+			return "", nil
+		}
 	} else {
-		timeout = fmt.Sprintf("Second-%d", time.Until(expiration)/time.Second)
+		token, expiration, ld, err := ls.GetByName(name)
+		if err != nil {
+			return "", nil
+		}
+		locks = []ActiveLock{{Token: token, Expiry: expiration, Details: ld}}
+	}
+	var b strings.Builder
+	for _, l := range locks {
+		writeActiveLock(&b, l)
+	}
+	return b.String(), nil
+}
+
+func writeActiveLock(b *strings.Builder, l ActiveLock) {
+	depth := "infinity"
+	if l.Details.ZeroDepth {
+		depth = "0"
 	}
-	return fmt.Sprintf(
+	fmt.Fprintf(b,
 		"<D:activelock>"+
 			"<D:locktype><D:write/></D:locktype>"+
 			"<D:lockscope><D:exclusive/></D:lockscope>"+
@@ -521,6 +1420,7 @@ func findLockDiscovery(ctx context.Context, fs FileSystem, ls LockSystem, name s
 			"<D:locktoken><D:href>%s</D:href></D:locktoken>"+
 			"<D:lockroot><D:href>%s</D:href></D:lockroot>"+
 			"</D:activelock>",
-		depth, ld.OwnerXML, timeout, escape(token), escape(ld.Root),
-	), nil
+		depth, l.Details.OwnerXML, lockTimeout(l.Details, l.Expiry, time.Now()), escape(l.Token),
+		escape(lockRoot(l.Details)),
+	)
 }
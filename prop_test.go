@@ -6,14 +6,22 @@ package webdav
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMemPS(t *testing.T) {
@@ -345,7 +353,7 @@ func TestMemPS(t *testing.T) {
 				}},
 			}, {
 				Props: []Property{{
-					XMLName:  xml.Name{Space: "DAV:", Local: "displayname"},
+					XMLName:  xml.Name{Space: "DAV:", Local: "resourcetype"},
 					InnerXML: []byte("xxx"),
 				}},
 			}},
@@ -353,7 +361,7 @@ func TestMemPS(t *testing.T) {
 				Status:   http.StatusForbidden,
 				XMLError: statForbiddenError,
 				Props: []Property{{
-					XMLName: xml.Name{Space: "DAV:", Local: "displayname"},
+					XMLName: xml.Name{Space: "DAV:", Local: "resourcetype"},
 				}},
 			}, {
 				Status: StatusFailedDependency,
@@ -534,7 +542,7 @@ func TestMemPS(t *testing.T) {
 			var propstats []Propstat
 			switch op.op {
 			case "propname":
-				pnames, err := propnames(ctx, fs, ls, op.name, nil)
+				pnames, err := propnames(ctx, fs, ls, nil, op.name, nil)
 				if err != nil {
 					t.Errorf("%s: got error %v, want nil", desc, err)
 					continue
@@ -546,11 +554,11 @@ func TestMemPS(t *testing.T) {
 				}
 				continue
 			case "allprop":
-				propstats, err = allprop(ctx, fs, ls, op.name, op.pnames, nil)
+				propstats, err = allprop(ctx, fs, ls, nil, op.name, op.pnames, nil)
 			case "propfind":
-				propstats, err = props(ctx, fs, ls, op.name, op.pnames, nil)
+				propstats, err = props(ctx, fs, ls, nil, op.name, op.pnames, nil)
 			case "proppatch":
-				propstats, err = patch(ctx, fs, ls, op.name, op.patches)
+				propstats, err = patch(ctx, fs, ls, nil, op.name, op.patches)
 			default:
 				t.Fatalf("%s: %s not implemented", desc, op.op)
 			}
@@ -726,3 +734,908 @@ func TestFindETagOverride(t *testing.T) {
 		t.Fatalf("ETag wrong want %q got %q", originalETag, ETag)
 	}
 }
+
+type multiLockLS struct {
+	LockSystem
+	locks []ActiveLock
+}
+
+func (ls multiLockLS) GetAllByName(name string) ([]ActiveLock, error) {
+	return ls.locks, nil
+}
+
+func TestFindLockDiscoveryAllLocks(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /dir", "touch /dir/file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	ctx := context.Background()
+	fi, err := fs.Stat(ctx, "/dir/file")
+	if err != nil {
+		t.Fatalf("cannot Stat /dir/file: %v", err)
+	}
+	ls := multiLockLS{
+		LockSystem: NewMemLS(),
+		locks: []ActiveLock{{
+			Token:   "opaquelocktoken:1",
+			Details: LockDetails{Root: "/dir/file", Duration: infiniteTimeout, ZeroDepth: true},
+		}, {
+			Token:   "opaquelocktoken:2",
+			Details: LockDetails{Root: "/dir", Duration: infiniteTimeout},
+		}},
+	}
+	got, err := findLockDiscovery(ctx, fs, ls, "/dir/file", fi)
+	if err != nil {
+		t.Fatalf("findLockDiscovery /dir/file failed: %v", err)
+	}
+	if n := strings.Count(got, "<D:activelock>"); n != 2 {
+		t.Fatalf("activelock count: got %d, want 2\n%s", n, got)
+	}
+	for _, l := range ls.locks {
+		if !strings.Contains(got, "<D:href>"+l.Token+"</D:href>") {
+			t.Errorf("token %q not found in %s", l.Token, got)
+		}
+	}
+
+	// No activelock is reported for unlocked resources.
+	got, err = findLockDiscovery(ctx, fs, NewMemLS(), "/dir/file", fi)
+	if err != nil {
+		t.Fatalf("findLockDiscovery /dir/file failed: %v", err)
+	}
+	if got != "" {
+		t.Fatalf("lockdiscovery without locks: got %q, want empty", got)
+	}
+}
+
+type overrideFileID struct {
+	os.FileInfo
+	id  string
+	err error
+}
+
+func (o *overrideFileID) FileID(ctx context.Context) (string, error) {
+	return o.id, o.err
+}
+
+func TestFindFileID(t *testing.T) {
+	fs, err := buildTestFS([]string{"touch /file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	ctx := context.Background()
+	fi, err := fs.Stat(ctx, "/file")
+	if err != nil {
+		t.Fatalf("cannot Stat /file: %v", err)
+	}
+	pnames := []xml.Name{fileIDPropName}
+
+	// Without FileIDer the property is not available.
+	pstats, err := props(ctx, fs, nil, nil, "/file", pnames, fi)
+	if err != nil {
+		t.Fatalf("props /file failed: %v", err)
+	}
+	if len(pstats) != 1 || pstats[0].Status != http.StatusNotFound {
+		t.Fatalf("props without FileIDer: got %v, want 404", pstats)
+	}
+	names, err := propnames(ctx, fs, nil, nil, "/file", fi)
+	if err != nil {
+		t.Fatalf("propnames /file failed: %v", err)
+	}
+	for _, pn := range names {
+		if pn == fileIDPropName {
+			t.Fatalf("propnames without FileIDer: unexpected %v", pn)
+		}
+	}
+
+	o := &overrideFileID{fi, "id<1>", nil}
+	pstats, err = props(ctx, fs, nil, nil, "/file", pnames, o)
+	if err != nil {
+		t.Fatalf("props /file failed: %v", err)
+	}
+	want := []Propstat{{
+		Status: http.StatusOK,
+		Props: []Property{{
+			XMLName:  fileIDPropName,
+			InnerXML: []byte("id&lt;1&gt;"),
+		}},
+	}}
+	if !reflect.DeepEqual(pstats, want) {
+		t.Fatalf("props with FileIDer: got %v, want %v", pstats, want)
+	}
+
+	// ErrNotImplemented hides the property.
+	o = &overrideFileID{fi, "", ErrNotImplemented}
+	pstats, err = props(ctx, fs, nil, nil, "/file", pnames, o)
+	if err != nil {
+		t.Fatalf("props /file failed: %v", err)
+	}
+	if len(pstats) != 1 || pstats[0].Status != http.StatusNotFound {
+		t.Fatalf("props with ErrNotImplemented: got %v, want 404", pstats)
+	}
+}
+
+type pinFS struct {
+	FileSystem
+	pinned map[string]bool
+	err    error
+}
+
+func (fs *pinFS) Pin(ctx context.Context, name string, pinned bool) error {
+	if fs.err != nil {
+		return fs.err
+	}
+	fs.pinned[name] = pinned
+	return nil
+}
+
+func (fs *pinFS) Pinned(ctx context.Context, name string) (bool, error) {
+	return fs.pinned[name], nil
+}
+
+func TestPinner(t *testing.T) {
+	memFS, err := buildTestFS([]string{"touch /file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	ctx := context.Background()
+	fs := &pinFS{FileSystem: memFS, pinned: make(map[string]bool)}
+	pinnedProp := func(v string) Property {
+		return Property{XMLName: pinnedPropName, InnerXML: []byte(v)}
+	}
+	deadProp := Property{XMLName: xml.Name{Space: "ns", Local: "dead"}, InnerXML: []byte("v")}
+	liveProp := Property{XMLName: xml.Name{Space: "DAV:", Local: "getcontentlength"}, InnerXML: []byte("1")}
+
+	testCases := []struct {
+		desc       string
+		patches    []Proppatch
+		pinErr     error
+		want       []Propstat
+		wantPinned bool
+	}{{
+		desc:    "pin",
+		patches: []Proppatch{{Props: []Property{pinnedProp("1")}}},
+		want: []Propstat{{
+			Status: http.StatusOK,
+			Props:  []Property{{XMLName: pinnedPropName}},
+		}},
+		wantPinned: true,
+	}, {
+		desc:    "unpin by removing the property",
+		patches: []Proppatch{{Remove: true, Props: []Property{{XMLName: pinnedPropName}}}},
+		want: []Propstat{{
+			Status: http.StatusOK,
+			Props:  []Property{{XMLName: pinnedPropName}},
+		}},
+	}, {
+		desc:    "pin with a dead property",
+		patches: []Proppatch{{Props: []Property{deadProp, pinnedProp("1")}}},
+		want: []Propstat{{
+			Status: http.StatusOK,
+			Props:  []Property{{XMLName: deadProp.XMLName}, {XMLName: pinnedPropName}},
+		}},
+		wantPinned: true,
+	}, {
+		desc:    "unpin with a protected property",
+		patches: []Proppatch{{Props: []Property{pinnedProp("0"), liveProp}}},
+		want: []Propstat{{
+			Status:   http.StatusForbidden,
+			XMLError: `<D:cannot-modify-protected-property xmlns:D="DAV:"/>`,
+			Props:    []Property{{XMLName: liveProp.XMLName}},
+		}, {
+			Status: StatusFailedDependency,
+			Props:  []Property{{XMLName: pinnedPropName}},
+		}},
+		wantPinned: true,
+	}, {
+		desc:    "pin forbidden",
+		patches: []Proppatch{{Props: []Property{pinnedProp("0"), deadProp}}},
+		pinErr:  os.ErrPermission,
+		want: []Propstat{{
+			Status: http.StatusForbidden,
+			Props:  []Property{{XMLName: pinnedPropName}},
+		}, {
+			Status: StatusFailedDependency,
+			Props:  []Property{{XMLName: deadProp.XMLName}},
+		}},
+		wantPinned: true,
+	}}
+
+	for _, tc := range testCases {
+		fs.err = tc.pinErr
+		got, err := patch(ctx, fs, nil, nil, "/file", tc.patches)
+		if err != nil {
+			t.Fatalf("%s: patch: %v", tc.desc, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: got %v, want %v", tc.desc, got, tc.want)
+		}
+		pstats, err := props(ctx, fs, nil, nil, "/file", []xml.Name{pinnedPropName}, nil)
+		if err != nil {
+			t.Fatalf("%s: props: %v", tc.desc, err)
+		}
+		want := "0"
+		if tc.wantPinned {
+			want = "1"
+		}
+		if len(pstats) != 1 || len(pstats[0].Props) != 1 || string(pstats[0].Props[0].InnerXML) != want {
+			t.Fatalf("%s: got pinned %v, want %s", tc.desc, pstats, want)
+		}
+	}
+
+	// Without Pinner the property is protected.
+	got, err := patch(ctx, memFS, nil, nil, "/file", []Proppatch{{Props: []Property{pinnedProp("1")}}})
+	if err != nil {
+		t.Fatalf("patch without Pinner: %v", err)
+	}
+	if len(got) != 1 || got[0].Status != http.StatusForbidden {
+		t.Fatalf("patch without Pinner: got %v, want 403", got)
+	}
+}
+
+func TestPatchAtomic(t *testing.T) {
+	ctx := context.Background()
+	dir := Dir(t.TempDir())
+	if err := os.WriteFile(filepath.Join(string(dir), "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Dir files don't hold dead properties, so patching them fails.
+	fs := &pinFS{FileSystem: dir, pinned: make(map[string]bool)}
+	deadProp := Property{XMLName: xml.Name{Space: "ns", Local: "dead"}, InnerXML: []byte("v")}
+	got, err := patch(ctx, fs, nil, nil, "/file", []Proppatch{
+		{Props: []Property{{XMLName: pinnedPropName, InnerXML: []byte("1")}}},
+		{Props: []Property{deadProp}},
+	})
+	if err != nil {
+		t.Fatalf("patch: %v", err)
+	}
+	want := []Propstat{{
+		Status: http.StatusForbidden,
+		Props:  []Property{{XMLName: deadProp.XMLName}},
+	}, {
+		Status: StatusFailedDependency,
+		Props:  []Property{{XMLName: pinnedPropName}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if fs.pinned["/file"] {
+		t.Fatalf("the pin state was not rolled back")
+	}
+
+	// With a PropStore the same patches succeed together.
+	ps := NewMemPropStore()
+	got, err = patch(ctx, fs, nil, ps, "/file", []Proppatch{
+		{Props: []Property{{XMLName: pinnedPropName, InnerXML: []byte("1")}}},
+		{Props: []Property{deadProp}},
+	})
+	if err != nil {
+		t.Fatalf("patch with PropStore: %v", err)
+	}
+	if len(got) != 1 || got[0].Status != http.StatusOK || len(got[0].Props) != 2 || !fs.pinned["/file"] {
+		t.Fatalf("patch with PropStore: got %v, want both properties patched", got)
+	}
+}
+
+type quotaFS struct {
+	FileSystem
+	available int64
+}
+
+func (fs quotaFS) Quota(ctx context.Context, name string) (int64, int64, error) {
+	return 1024, fs.available, nil
+}
+
+func TestQuota(t *testing.T) {
+	memFS, err := buildTestFS([]string{"mkdir /dir", "touch /dir/file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	ctx := context.Background()
+	used := xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+	available := xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	pnames := []xml.Name{used, available}
+
+	testCases := []struct {
+		desc string
+		fs   FileSystem
+		name string
+		want []Propstat
+	}{{
+		desc: "limited",
+		fs:   quotaFS{memFS, 2048},
+		name: "/dir",
+		want: []Propstat{{
+			Status: http.StatusOK,
+			Props: []Property{
+				{XMLName: used, InnerXML: []byte("1024")},
+				{XMLName: available, InnerXML: []byte("2048")},
+			},
+		}},
+	}, {
+		desc: "unlimited",
+		fs:   quotaFS{memFS, -1},
+		name: "/dir",
+		want: []Propstat{{
+			Status: http.StatusOK,
+			Props:  []Property{{XMLName: used, InnerXML: []byte("1024")}},
+		}, {
+			Status: http.StatusNotFound,
+			Props:  []Property{{XMLName: available}},
+		}},
+	}, {
+		desc: "file",
+		fs:   quotaFS{memFS, 2048},
+		name: "/dir/file",
+		want: []Propstat{{
+			Status: http.StatusNotFound,
+			Props:  []Property{{XMLName: used}, {XMLName: available}},
+		}},
+	}, {
+		desc: "without QuotaFS",
+		fs:   memFS,
+		name: "/dir",
+		want: []Propstat{{
+			Status: http.StatusNotFound,
+			Props:  []Property{{XMLName: used}, {XMLName: available}},
+		}},
+	}}
+
+	for _, tc := range testCases {
+		got, err := props(ctx, tc.fs, nil, nil, tc.name, pnames, nil)
+		if err != nil {
+			t.Fatalf("%s: props: %v", tc.desc, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.desc, got, tc.want)
+		}
+		// The quota properties are not returned by allprop.
+		names, err := propnames(ctx, tc.fs, nil, nil, tc.name, nil)
+		if err != nil {
+			t.Fatalf("%s: propnames: %v", tc.desc, err)
+		}
+		for _, pn := range names {
+			if pn == used || pn == available {
+				t.Errorf("%s: propnames: got %v, want no quota properties", tc.desc, names)
+			}
+		}
+	}
+}
+
+type hashFS struct {
+	FileSystem
+}
+
+func (fs hashFS) ContentHashes(ctx context.Context, name string) (map[string]string, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"sha256": fmt.Sprintf("%x", sha256.Sum256(data)),
+		"md5":    fmt.Sprintf("%x", md5.Sum(data)),
+	}, nil
+}
+
+func TestContentHasher(t *testing.T) {
+	const (
+		md5Empty    = "MD5:d41d8cd98f00b204e9800998ecf8427e"
+		sha256Empty = "SHA256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		md5Content  = "MD5:9a0364b9e99bb480dd25e1f0284c8555"
+	)
+	memFS, err := buildTestFS([]string{"touch /file", "mkdir /dir"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	ctx := context.Background()
+	fs := hashFS{memFS}
+	pnames := []xml.Name{checksumsPropName, contentHashPropName}
+	got, err := props(ctx, fs, nil, nil, "/file", pnames, nil)
+	if err != nil {
+		t.Fatalf("props: %v", err)
+	}
+	want := []Propstat{{
+		Status: http.StatusOK,
+		Props: []Property{{
+			XMLName:  checksumsPropName,
+			InnerXML: []byte(`<oc:checksum xmlns:oc="http://owncloud.org/ns">` + md5Empty + " " + sha256Empty + `</oc:checksum>`),
+		}, {
+			XMLName:  contentHashPropName,
+			InnerXML: []byte(md5Empty + " " + sha256Empty),
+		}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("props:\ngot  %v\nwant %v", got, want)
+	}
+	if got, err = props(ctx, fs, nil, nil, "/dir", pnames, nil); err != nil || got[0].Status != http.StatusNotFound {
+		t.Fatalf("props of a directory: got %v, %v, want 404", got, err)
+	}
+
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	}
+	for _, tc := range []struct {
+		method, body, want string
+	}{
+		{"GET", "", md5Empty},
+		{"PUT", "content", md5Content},
+		{"GET", "", md5Content},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, "/file", strings.NewReader(tc.body)))
+		if got := w.Header().Get("OC-Checksum"); got != tc.want {
+			t.Errorf("%s: got OC-Checksum %q, want %q", tc.method, got, tc.want)
+		}
+	}
+}
+
+// failingHashFS fails to compute the checksums of its files.
+type failingHashFS struct {
+	FileSystem
+}
+
+func (failingHashFS) ContentHashes(ctx context.Context, name string) (map[string]string, error) {
+	return nil, errors.New("hashing failed")
+}
+
+func TestContentHasherError(t *testing.T) {
+	var logged []string
+	h := &Handler{
+		FileSystem: failingHashFS{NewMemFS()},
+		LockSystem: NewMemLS(),
+		Logger: func(r *http.Request, status int, err error) {
+			if err != nil {
+				logged = append(logged, fmt.Sprintf("%s %d %v", r.Method, status, err))
+			}
+		},
+	}
+	// The file is stored and served, without its checksum.
+	for _, tc := range []struct {
+		method, body string
+		wantStatus   int
+	}{
+		{"PUT", "content", http.StatusCreated},
+		{"GET", "", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, "/file", strings.NewReader(tc.body)))
+		if w.Code != tc.wantStatus || w.Header().Get("OC-Checksum") != "" {
+			t.Errorf("%s: got status %d and OC-Checksum %q, want %d without it", tc.method, w.Code, w.Header().Get("OC-Checksum"), tc.wantStatus)
+		}
+	}
+	want := []string{"PUT 201 hashing failed", "GET 200 hashing failed"}
+	if strings.Join(logged, ",") != strings.Join(want, ",") {
+		t.Errorf("got logged errors %q, want %q", logged, want)
+	}
+}
+
+func TestWritableDisplayName(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "photo-0001.jpg"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := Dir(root)
+	ctx := context.Background()
+	ps := NewMemPropStore()
+	displayName := xml.Name{Space: "DAV:", Local: "displayname"}
+	pnames := []xml.Name{displayName}
+
+	for _, name := range []string{"/dir", "/dir/photo-0001.jpg"} {
+		got, err := patch(ctx, fs, nil, ps, name, []Proppatch{{
+			Props: []Property{{XMLName: displayName, InnerXML: []byte("Holiday")}},
+		}})
+		if err != nil {
+			t.Fatalf("%s: patch: %v", name, err)
+		}
+		want := []Propstat{{Status: http.StatusOK, Props: []Property{{XMLName: displayName}}}}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: patch: got %v, want %v", name, got, want)
+		}
+		got, err = props(ctx, fs, nil, ps, name, pnames, nil)
+		if err != nil {
+			t.Fatalf("%s: props: %v", name, err)
+		}
+		want = []Propstat{{
+			Status: http.StatusOK,
+			Props:  []Property{{XMLName: displayName, InnerXML: []byte("Holiday")}},
+		}}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: props: got %v, want %v", name, got, want)
+		}
+		names, err := propnames(ctx, fs, nil, ps, name, nil)
+		if err != nil {
+			t.Fatalf("%s: propnames: %v", name, err)
+		}
+		n := 0
+		for _, pn := range names {
+			if pn == displayName {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Fatalf("%s: propnames: got displayname %d times, want 1", name, n)
+		}
+	}
+
+	// Removing the property restores the name derived from the path.
+	if _, err := patch(ctx, fs, nil, ps, "/dir/photo-0001.jpg", []Proppatch{{
+		Remove: true,
+		Props:  []Property{{XMLName: displayName}},
+	}}); err != nil {
+		t.Fatalf("patch: %v", err)
+	}
+	got, err := props(ctx, fs, nil, ps, "/dir/photo-0001.jpg", pnames, nil)
+	if err != nil {
+		t.Fatalf("props: %v", err)
+	}
+	want := []Propstat{{
+		Status: http.StatusOK,
+		Props:  []Property{{XMLName: displayName, InnerXML: []byte("photo-0001.jpg")}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("props after remove: got %v, want %v", got, want)
+	}
+}
+
+type creationFileInfo struct {
+	os.FileInfo
+	creation time.Time
+}
+
+func (fi creationFileInfo) CreationTime() time.Time {
+	return fi.creation
+}
+
+func TestCreationDate(t *testing.T) {
+	memFS, err := buildTestFS([]string{"touch /file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	ctx := context.Background()
+	creationDate := xml.Name{Space: "DAV:", Local: "creationdate"}
+	fi, err := memFS.Stat(ctx, "/file")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	created := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.FixedZone("CET", 3600))
+
+	testCases := []struct {
+		desc string
+		fi   os.FileInfo
+		want []Propstat
+	}{{
+		desc: "CreationTimer",
+		fi:   creationFileInfo{fi, created},
+		want: []Propstat{{
+			Status: http.StatusOK,
+			Props:  []Property{{XMLName: creationDate, InnerXML: []byte("2021-03-04T04:06:07Z")}},
+		}},
+	}, {
+		desc: "unknown creation time",
+		fi:   creationFileInfo{fi, time.Time{}},
+		want: []Propstat{{
+			Status: http.StatusNotFound,
+			Props:  []Property{{XMLName: creationDate}},
+		}},
+	}, {
+		desc: "without CreationTimer",
+		fi:   fi,
+		want: []Propstat{{
+			Status: http.StatusNotFound,
+			Props:  []Property{{XMLName: creationDate}},
+		}},
+	}}
+	for _, tc := range testCases {
+		got, err := props(ctx, memFS, nil, nil, "/file", []xml.Name{creationDate}, tc.fi)
+		if err != nil {
+			t.Fatalf("%s: props: %v", tc.desc, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+
+	// The FileInfos of Dir implement CreationTimer, a zero time meaning
+	// that the platform or the file system does not report birth times.
+	root := t.TempDir()
+	before := time.Now().Add(-time.Second)
+	if err := os.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dfi, err := Dir(root).Stat(ctx, "/file")
+	if err != nil {
+		t.Fatalf("Dir Stat: %v", err)
+	}
+	ct, ok := dfi.(CreationTimer)
+	if !ok {
+		t.Fatalf("Dir Stat: got %T, want a CreationTimer", dfi)
+	}
+	if c := ct.CreationTime(); !c.IsZero() && (c.Before(before) || c.After(time.Now().Add(time.Second))) {
+		t.Errorf("Dir CreationTime: got %v, want the time the file was created", c)
+	}
+}
+
+func TestQuotaWarnings(t *testing.T) {
+	memFS, err := buildTestFS([]string{"mkdir /dir"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	propfind := `<D:propfind xmlns:D="DAV:" xmlns:W="https://github.com/drakkan/webdav">` +
+		`<D:prop><W:quota-warning/></D:prop></D:propfind>`
+
+	testCases := []struct {
+		desc      string
+		available int64
+		want      string
+	}{
+		{"below thresholds", 2048, ""},
+		{"first threshold", 200, "80%"},
+		{"highest threshold", 100, "90%"},
+		{"unlimited", -1, ""},
+	}
+	for _, tc := range testCases {
+		h := &Handler{
+			FileSystem:    quotaFS{memFS, tc.available},
+			LockSystem:    NewMemLS(),
+			QuotaWarnings: []int{90, 80},
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/dir/file", strings.NewReader("content")))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: PUT: got status %d, want %d", tc.desc, w.Code, http.StatusCreated)
+		}
+		if got := w.Header().Get("X-Quota-Warning"); got != tc.want {
+			t.Errorf("%s: PUT: got X-Quota-Warning %q, want %q", tc.desc, got, tc.want)
+		}
+		r := httptest.NewRequest("PROPFIND", "/dir", strings.NewReader(propfind))
+		r.Header.Set("Depth", "0")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		found := strings.Contains(w.Body.String(), ">"+tc.want+"</quota-warning>")
+		if tc.want != "" && !found || tc.want == "" && !strings.Contains(w.Body.String(), "404 Not Found") {
+			t.Errorf("%s: PROPFIND: got %s, want quota-warning %q", tc.desc, w.Body.String(), tc.want)
+		}
+	}
+}
+
+func TestExecutableProperty(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "script.sh"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := Dir(root)
+	ctx := context.Background()
+	pnames := []xml.Name{executablePropName}
+
+	find := func() string {
+		t.Helper()
+		pstats, err := props(ctx, fs, nil, nil, "/script.sh", pnames, nil)
+		if err != nil {
+			t.Fatalf("props: %v", err)
+		}
+		if len(pstats) != 1 || pstats[0].Status != http.StatusOK {
+			t.Fatalf("props: got %v, want the executable property", pstats)
+		}
+		return string(pstats[0].Props[0].InnerXML)
+	}
+	if got := find(); got != "F" {
+		t.Errorf("initial value: got %q, want %q", got, "F")
+	}
+
+	testCases := []struct {
+		desc       string
+		remove     bool
+		value      string
+		wantStatus int
+		wantValue  string
+		wantPerm   os.FileMode
+	}{
+		{"set", false, "T", http.StatusOK, "T", 0744},
+		{"invalid value", false, "yes", http.StatusConflict, "T", 0744},
+		{"remove", true, "", http.StatusConflict, "T", 0744},
+		{"clear", false, "F", http.StatusOK, "F", 0644},
+	}
+	for _, tc := range testCases {
+		pstats, err := patch(ctx, fs, nil, nil, "/script.sh", []Proppatch{{
+			Remove: tc.remove,
+			Props:  []Property{{XMLName: executablePropName, InnerXML: []byte(tc.value)}},
+		}})
+		if err != nil {
+			t.Fatalf("%s: patch: %v", tc.desc, err)
+		}
+		if len(pstats) != 1 || pstats[0].Status != tc.wantStatus {
+			t.Errorf("%s: got %v, want status %d", tc.desc, pstats, tc.wantStatus)
+		}
+		if got := find(); got != tc.wantValue {
+			t.Errorf("%s: got value %q, want %q", tc.desc, got, tc.wantValue)
+		}
+		fi, err := os.Stat(filepath.Join(root, "script.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != tc.wantPerm {
+			t.Errorf("%s: got mode %v, want %v", tc.desc, got, tc.wantPerm)
+		}
+	}
+}
+
+// versionFS is a FileSystem reporting the version of its files as ETags.
+type versionFS struct {
+	FileSystem
+	version string
+}
+
+func (fs versionFS) ETag(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+	if fi.IsDir() {
+		return "", ErrNotImplemented
+	}
+	return `"` + fs.version + `"`, nil
+}
+
+// etagFile is a File with its own ETag.
+type etagFile struct {
+	File
+}
+
+func (f etagFile) ETag(ctx context.Context) (string, error) {
+	return `"open"`, nil
+}
+
+// etagFileFS is a FileSystem whose files opened read-only are etagFiles.
+type etagFileFS struct {
+	FileSystem
+}
+
+func (fs etagFileFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil || flag != os.O_RDONLY {
+		return f, err
+	}
+	return etagFile{f}, nil
+}
+
+func TestETagFS(t *testing.T) {
+	mem, err := buildTestFS([]string{"mkdir /dir", "write /dir/file content"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	ctx := context.Background()
+	fs := versionFS{mem, "v42"}
+	for _, name := range []string{"/dir", "/dir/file"} {
+		fi, err := fs.Stat(ctx, name)
+		if err != nil {
+			t.Fatalf("cannot Stat %s: %v", name, err)
+		}
+		etag, err := findETag(ctx, fs, nil, name, fi)
+		if err != nil {
+			t.Fatalf("findETag %s failed: %v", name, err)
+		}
+		if want := `"v42"`; (etag == want) == fi.IsDir() {
+			t.Errorf("findETag %s: got %q", name, etag)
+		}
+	}
+
+	for _, tc := range []struct {
+		fs   FileSystem
+		want string
+	}{
+		{fs, `"v42"`},
+		{etagFileFS{fs}, `"open"`},
+	} {
+		h := &Handler{
+			FileSystem: tc.fs,
+			LockSystem: NewMemLS(),
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/dir/file", nil))
+		if got := w.Header().Get("ETag"); got != tc.want {
+			t.Errorf("GET: got ETag %q, want %q", got, tc.want)
+		}
+	}
+}
+
+// metaFS is a FileSystem whose os.FileInfo objects know the content type and
+// ETag of files, and which counts the reads of their content.
+type metaFS struct {
+	FileSystem
+	reads int
+}
+
+type metaFileInfo struct {
+	os.FileInfo
+}
+
+func (fi metaFileInfo) ContentType(ctx context.Context) (string, error) {
+	return "application/x-stored", nil
+}
+
+func (fi metaFileInfo) ETag(ctx context.Context) (string, error) {
+	return `"stored"`, nil
+}
+
+func (fs *metaFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := fs.FileSystem.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return metaFileInfo{fi}, nil
+}
+
+func (fs *metaFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return metaFile{f, fs}, nil
+}
+
+type metaFile struct {
+	File
+	fs *metaFS
+}
+
+func (f metaFile) Read(p []byte) (int, error) {
+	f.fs.reads++
+	return f.File.Read(p)
+}
+
+func (f metaFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return metaFileInfo{fi}, nil
+}
+
+func (f metaFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	for i, fi := range fis {
+		fis[i] = metaFileInfo{fi}
+	}
+	return fis, err
+}
+
+func TestFileInfoMetadata(t *testing.T) {
+	mem, err := buildTestFS([]string{"mkdir /dir", "write /dir/blob content"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	fs := &metaFS{FileSystem: mem}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	}
+	r := httptest.NewRequest("PROPFIND", "/dir", strings.NewReader(
+		`<D:propfind xmlns:D="DAV:"><D:prop><D:getcontenttype/><D:getetag/></D:prop></D:propfind>`))
+	r.Header.Set("Depth", "1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	for _, want := range []string{
+		"<D:getcontenttype>application/x-stored</D:getcontenttype>",
+		`<D:getetag>"stored"</D:getetag>`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("propfind: got %s, want it to contain %s", w.Body.String(), want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("HEAD", "/dir/blob", nil))
+	if got, want := w.Header().Get("Content-Type"), "application/x-stored"; got != want {
+		t.Errorf("head: got Content-Type %q, want %q", got, want)
+	}
+	if got, want := w.Header().Get("ETag"), `"stored"`; got != want {
+		t.Errorf("head: got ETag %q, want %q", got, want)
+	}
+	if fs.reads != 0 {
+		t.Errorf("got %d reads of the content, want none", fs.reads)
+	}
+}
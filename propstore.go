@@ -0,0 +1,143 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// PropStore stores the dead properties of resources by name, independently
+// of the FileSystem, for example in a database.
+//
+// When a PropStore is set, the Handler reads and patches all dead properties
+// through it, even if the files implement DeadPropsHolder, so that the
+// PropStore is their only source of truth. It keeps the PropStore in sync
+// when resources are deleted, copied and moved.
+type PropStore interface {
+	// Get returns the dead properties of resource name.
+	Get(ctx context.Context, name string) (map[xml.Name]Property, error)
+	// Patch patches the dead properties of resource name. The return
+	// values are constrained in the same manner as DeadPropsHolder.Patch.
+	Patch(ctx context.Context, name string, patches []Proppatch) ([]Propstat, error)
+	// Delete deletes the dead properties of resource name and of its
+	// descendants.
+	Delete(ctx context.Context, name string) error
+	// CopyMove copies, or moves if move is true, the dead properties of
+	// resource src to dst, replacing the ones of dst. If recursive is true,
+	// the dead properties of the descendants of src are copied or moved too,
+	// and the ones of the descendants of dst are replaced.
+	CopyMove(ctx context.Context, src, dst string, move, recursive bool) error
+}
+
+// NewMemPropStore returns a new in-memory PropStore.
+func NewMemPropStore() PropStore {
+	return &memPropStore{
+		props: make(map[string]map[xml.Name]Property),
+	}
+}
+
+type memPropStore struct {
+	mu    sync.Mutex
+	props map[string]map[xml.Name]Property
+}
+
+func (s *memPropStore) Get(ctx context.Context, name string) (map[xml.Name]Property, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	props := s.props[slashClean(name)]
+	if len(props) == 0 {
+		return nil, nil
+	}
+	ret := make(map[xml.Name]Property, len(props))
+	for k, v := range props {
+		ret[k] = v
+	}
+	return ret, nil
+}
+
+func (s *memPropStore) Patch(ctx context.Context, name string, patches []Proppatch) ([]Propstat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name = slashClean(name)
+	pstat := Propstat{Status: http.StatusOK}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, Property{XMLName: p.XMLName})
+			if patch.Remove {
+				delete(s.props[name], p.XMLName)
+				continue
+			}
+			if s.props[name] == nil {
+				s.props[name] = make(map[xml.Name]Property)
+			}
+			s.props[name][p.XMLName] = p
+		}
+	}
+	if len(s.props[name]) == 0 {
+		delete(s.props, name)
+	}
+	return []Propstat{pstat}, nil
+}
+
+func (s *memPropStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteTree(slashClean(name), true)
+	return nil
+}
+
+// deleteTree deletes the properties of name and, if recursive is true, of
+// its descendants. The caller must hold s.mu.
+func (s *memPropStore) deleteTree(name string, recursive bool) {
+	for k := range s.props {
+		if k == name || (recursive && isWithin(k, name)) {
+			delete(s.props, k)
+		}
+	}
+}
+
+func (s *memPropStore) CopyMove(ctx context.Context, src, dst string, move, recursive bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, dst = slashClean(src), slashClean(dst)
+	copied := make(map[string]map[xml.Name]Property)
+	for k, props := range s.props {
+		if k != src && (!recursive || !isWithin(k, src)) {
+			continue
+		}
+		c := make(map[xml.Name]Property, len(props))
+		for pn, p := range props {
+			c[pn] = p
+		}
+		copied[path.Join(dst, strings.TrimPrefix(k, src))] = c
+		if move {
+			delete(s.props, k)
+		}
+	}
+	s.deleteTree(dst, recursive)
+	for k, props := range copied {
+		s.props[k] = props
+	}
+	return nil
+}
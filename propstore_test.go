@@ -0,0 +1,184 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMemPropStore(t *testing.T) {
+	ctx := context.Background()
+	ps := NewMemPropStore().(*memPropStore)
+	p := func(v string) Property {
+		return Property{XMLName: xml.Name{Space: "ns", Local: "p"}, InnerXML: []byte(v)}
+	}
+	for _, name := range []string{"/a", "/a/b", "/a/b/c", "/ab", "/d"} {
+		if _, err := ps.Patch(ctx, name, []Proppatch{{Props: []Property{p(name)}}}); err != nil {
+			t.Fatalf("Patch %q: %v", name, err)
+		}
+	}
+	names := func() []string {
+		var ret []string
+		for name, props := range ps.props {
+			for _, prop := range props {
+				ret = append(ret, name+"="+string(prop.InnerXML))
+			}
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	testCases := []struct {
+		desc string
+		op   func() error
+		want []string
+	}{{
+		desc: "copy depth 0",
+		op:   func() error { return ps.CopyMove(ctx, "/a", "/x", false, false) },
+		want: []string{"/a/b/c=/a/b/c", "/a/b=/a/b", "/a=/a", "/ab=/ab", "/d=/d", "/x=/a"},
+	}, {
+		desc: "copy replacing the destination",
+		op:   func() error { return ps.CopyMove(ctx, "/a/b", "/x", false, true) },
+		want: []string{"/a/b/c=/a/b/c", "/a/b=/a/b", "/a=/a", "/ab=/ab", "/d=/d", "/x/c=/a/b/c", "/x=/a/b"},
+	}, {
+		desc: "move",
+		op:   func() error { return ps.CopyMove(ctx, "/a", "/y", true, true) },
+		want: []string{"/ab=/ab", "/d=/d", "/x/c=/a/b/c", "/x=/a/b", "/y/b/c=/a/b/c", "/y/b=/a/b", "/y=/a"},
+	}, {
+		desc: "delete",
+		op:   func() error { return ps.Delete(ctx, "/y") },
+		want: []string{"/ab=/ab", "/d=/d", "/x/c=/a/b/c", "/x=/a/b"},
+	}, {
+		desc: "remove the last property",
+		op: func() error {
+			_, err := ps.Patch(ctx, "/d", []Proppatch{{Remove: true, Props: []Property{p("")}}})
+			return err
+		},
+		want: []string{"/ab=/ab", "/x/c=/a/b/c", "/x=/a/b"},
+	}, {
+		desc: "copy the root",
+		op:   func() error { return ps.CopyMove(ctx, "/", "/r", false, true) },
+		want: []string{"/ab=/ab", "/r/ab=/ab", "/r/x/c=/a/b/c", "/r/x=/a/b", "/x/c=/a/b/c", "/x=/a/b"},
+	}}
+
+	for _, tc := range testCases {
+		if err := tc.op(); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		if got := names(); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s:\ngot  %q\nwant %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestHandlerPropStore(t *testing.T) {
+	ps := NewMemPropStore()
+	h := &Handler{
+		FileSystem: Dir(t.TempDir()),
+		LockSystem: NewMemLS(),
+		PropStore:  ps,
+	}
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	const proppatch = `<D:propertyupdate xmlns:D="DAV:" xmlns:Z="ns">` +
+		`<D:set><D:prop><Z:color>red</Z:color></D:prop></D:set></D:propertyupdate>`
+	const propfind = `<D:propfind xmlns:D="DAV:" xmlns:Z="ns"><D:prop><Z:color/></D:prop></D:propfind>`
+
+	if w := do("MKCOL", "/dir", ""); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := do("PUT", "/dir/file", "content"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	for _, target := range []string{"/dir", "/dir/file"} {
+		w := do("PROPPATCH", target, proppatch)
+		if w.Code != StatusMulti || !strings.Contains(w.Body.String(), "200 OK") {
+			t.Fatalf("PROPPATCH %s: got %d %s", target, w.Code, w.Body.String())
+		}
+	}
+	if w := do("MOVE", "/dir", "", "Destination", "/moved"); w.Code != http.StatusCreated {
+		t.Fatalf("MOVE: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	w := do("PROPFIND", "/moved/file", propfind, "Depth", "0")
+	if !strings.Contains(w.Body.String(), ">red</") {
+		t.Fatalf("PROPFIND after MOVE: got %s, want the color property", w.Body.String())
+	}
+	if w := do("DELETE", "/moved", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	for _, name := range []string{"/dir", "/dir/file", "/moved", "/moved/file"} {
+		if props, _ := ps.Get(context.Background(), name); len(props) != 0 {
+			t.Fatalf("Get %s: got %v, want no properties", name, props)
+		}
+	}
+}
+
+func TestHandlerPropStoreDeadPropsHolder(t *testing.T) {
+	ctx := context.Background()
+	fs := NewMemFS()
+	ps := NewMemPropStore()
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		PropStore:  ps,
+	}
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := do("PUT", "/file", "content"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	w := do("PROPPATCH", "/file", `<D:propertyupdate xmlns:D="DAV:" xmlns:Z="ns">`+
+		`<D:set><D:prop><Z:color>red</Z:color></D:prop></D:set></D:propertyupdate>`)
+	if w.Code != StatusMulti || !strings.Contains(w.Body.String(), "200 OK") {
+		t.Fatalf("PROPPATCH: got %d %s", w.Code, w.Body.String())
+	}
+	w = do("PROPFIND", "/file", `<D:propfind xmlns:D="DAV:" xmlns:Z="ns"><D:prop><Z:color/></D:prop></D:propfind>`)
+	if body := w.Body.String(); !strings.Contains(body, ">red</") || strings.Contains(body, "404") {
+		t.Fatalf("PROPFIND: got %s, want the color property", body)
+	}
+
+	// The property is stored in the PropStore, not held by the file.
+	if props, _ := ps.Get(ctx, "/file"); len(props) != 1 {
+		t.Fatalf("PropStore Get: got %v, want the color property", props)
+	}
+	f, err := fs.OpenFile(ctx, "/file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+	if props, _ := f.(DeadPropsHolder).DeadProps(); len(props) != 0 {
+		t.Fatalf("DeadProps: got %v, want no properties", props)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultMaxRanges is the maximum number of ranges of a GET request if
+// Handler.MaxRanges is zero.
+const defaultMaxRanges = 100
+
+// limitRanges returns r, or a copy of r without its Range header if it
+// requests more ranges than allowed by h.MaxRanges. The full content is
+// then served, as allowed by RFC 7233 section 3.1, instead of a
+// multipart/byteranges response costly to produce.
+func (h *Handler) limitRanges(r *http.Request) *http.Request {
+	max := h.MaxRanges
+	if max == 0 {
+		max = defaultMaxRanges
+	}
+	ranges := r.Header.Get("Range")
+	if max < 0 || ranges == "" || strings.Count(ranges, ",")+1 <= max {
+		return r
+	}
+	r = r.Clone(r.Context())
+	r.Header.Del("Range")
+	return r
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMultiRangeGet(t *testing.T) {
+	fs, err := buildTestFS([]string{"write /f 0123456789"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		MaxRanges:  2,
+	}
+	get := func(ranges string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/f", nil)
+		r.Header.Set("Range", ranges)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("bytes=0-1,5-6")
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("two ranges: got status %d, want %d", w.Code, http.StatusPartialContent)
+	}
+	mt, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mt != "multipart/byteranges" {
+		t.Fatalf("two ranges: got Content-Type %q, want multipart/byteranges", w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("two ranges: NextPart: %v", err)
+		}
+		b, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Range")+" "+string(b))
+	}
+	want := []string{"bytes 0-1/10 01", "bytes 5-6/10 56"}
+	if len(parts) != len(want) || parts[0] != want[0] || parts[1] != want[1] {
+		t.Errorf("two ranges: got parts %q, want %q", parts, want)
+	}
+
+	w = get("bytes=0-0,2-2,4-4")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("too many ranges: got %d %q, want %d with the full content", w.Code, w.Body.String(), http.StatusOK)
+	}
+
+	h.MaxRanges = -1
+	if w = get("bytes=0-0,2-2,4-4"); w.Code != http.StatusPartialContent {
+		t.Errorf("unlimited ranges: got status %d, want %d", w.Code, http.StatusPartialContent)
+	}
+}
+
+// weakETagFS is a FileSystem reporting weak ETags.
+type weakETagFS struct {
+	FileSystem
+}
+
+func (fs weakETagFS) ETag(ctx context.Context, name string, fi os.FileInfo) (string, error) {
+	return `W/"weak"`, nil
+}
+
+func TestIfRange(t *testing.T) {
+	mem, err := buildTestFS([]string{"write /f 0123456789"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: mem,
+		LockSystem: NewMemLS(),
+	}
+	get := func(ifRange string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/f", nil)
+		r.Header.Set("Range", "bytes=2-3")
+		if ifRange != "" {
+			r.Header.Set("If-Range", ifRange)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := get("")
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	fi, err := mem.Stat(context.Background(), "/f")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	testCases := []struct {
+		desc, ifRange string
+		wantStatus    int
+		wantBody      string
+	}{
+		{"matching ETag", etag, http.StatusPartialContent, "23"},
+		{"other ETag", `"other"`, http.StatusOK, "0123456789"},
+		{"matching date", lastModified, http.StatusPartialContent, "23"},
+		{"older date", fi.ModTime().Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusOK, "0123456789"},
+	}
+	for _, tc := range testCases {
+		if w := get(tc.ifRange); w.Code != tc.wantStatus || w.Body.String() != tc.wantBody {
+			t.Errorf("%s: got %d %q, want %d %q", tc.desc, w.Code, w.Body.String(), tc.wantStatus, tc.wantBody)
+		}
+	}
+
+	// Weak ETags never match If-Range, RFC 7233 section 3.2.
+	h.FileSystem = weakETagFS{mem}
+	if w := get(`W/"weak"`); w.Code != http.StatusOK {
+		t.Errorf("weak ETag: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	ixml "github.com/drakkan/webdav/internal/xml"
+)
+
+// ErrInvalidReport is returned by a ReportHandler when the report body is
+// malformed. The request is then refused with "400 Bad Request".
+var ErrInvalidReport = errors.New("webdav: invalid report")
+
+// Report is a REPORT request, defined by RFC 3253 section 3.6.
+type Report struct {
+	// XMLName is the name of the root element of the body, which identifies
+	// the report.
+	XMLName xml.Name
+	// Name is the resource the report is requested for.
+	Name string
+	// Depth is the Depth header of the request: 0, which is the default, 1,
+	// or -1 for infinity.
+	Depth int
+	// Body is the request body, to be decoded with encoding/xml.
+	Body []byte
+}
+
+// ReportHandler writes the response to a REPORT request whose body is report.
+// ctx is the request context.
+//
+// If it returns an error before writing anything, the request fails with
+// "404 Not Found" for os.ErrNotExist, "403 Forbidden" for os.ErrPermission,
+// "400 Bad Request" for ErrInvalidReport and "500 Internal Server Error"
+// otherwise.
+type ReportHandler func(ctx context.Context, w http.ResponseWriter, r *http.Request, report Report) error
+
+// RegisterReport registers the report named pn, such as a versioning,
+// CalDAV or CardDAV report. It replaces the report with the same name, if
+// any. The registered reports are listed by the DAV:supported-report-set
+// property.
+//
+// RegisterReport must be called before serving requests.
+func (h *Handler) RegisterReport(pn xml.Name, fn ReportHandler) {
+	if h.reports == nil {
+		h.reports = make(map[xml.Name]ReportHandler)
+	}
+	h.reports[pn] = fn
+}
+
+type reportsKey struct{}
+
+func withReports(ctx context.Context, reports map[xml.Name]ReportHandler) context.Context {
+	return context.WithValue(ctx, reportsKey{}, reports)
+}
+
+// builtinReports returns the reports implemented by this package that are
+// supported by h.FileSystem.
+func (h *Handler) builtinReports() map[xml.Name]ReportHandler {
+	reports := make(map[xml.Name]ReportHandler)
+	if _, ok := h.FileSystem.(SyncTokenFS); ok {
+		reports[syncCollectionReportName] = h.syncCollectionReport
+	}
+	if _, ok := h.FileSystem.(VersionedFS); ok {
+		reports[versionTreeReportName] = h.versionTreeReport
+	}
+	if _, ok := h.FileSystem.(DiffFS); ok {
+		reports[listingDiffReportName] = h.listingDiffReport
+	}
+	return reports
+}
+
+// supportedReports returns the names of the reports registered with the
+// Handler serving ctx, and of the ones implemented by this package that are
+// supported by fs.
+func supportedReports(ctx context.Context, fs FileSystem) []xml.Name {
+	reports, _ := ctx.Value(reportsKey{}).(map[xml.Name]ReportHandler)
+	pnames := make([]xml.Name, 0, len(reports)+3)
+	for pn := range reports {
+		pnames = append(pnames, pn)
+	}
+	if _, ok := fs.(SyncTokenFS); ok && reports[syncCollectionReportName] == nil {
+		pnames = append(pnames, syncCollectionReportName)
+	}
+	if _, ok := fs.(VersionedFS); ok && reports[versionTreeReportName] == nil {
+		pnames = append(pnames, versionTreeReportName)
+	}
+	if _, ok := fs.(DiffFS); ok && reports[listingDiffReportName] == nil {
+		pnames = append(pnames, listingDiffReportName)
+	}
+	sortNames(pnames)
+	return pnames
+}
+
+// readReport reads the body of the REPORT request r for resource name.
+func readReport(r *http.Request, name string) (Report, error) {
+	report := Report{Name: name}
+	if hdr := r.Header.Get("Depth"); hdr != "" {
+		if report.Depth = parseDepth(hdr); report.Depth == invalidDepth {
+			return report, errInvalidDepth
+		}
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return report, err
+	}
+	report.Body = body
+	d := ixml.NewDecoder(bytes.NewReader(body))
+	for {
+		t, err := next(d)
+		if err != nil {
+			return report, ErrInvalidReport
+		}
+		if start, ok := t.(ixml.StartElement); ok {
+			report.XMLName = xml.Name(start.Name)
+			return report, nil
+		}
+	}
+}
+
+func (h *Handler) handleReport(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	ctx := r.Context()
+	if _, err := h.FileSystem.Stat(ctx, reqPath); err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		} else if os.IsPermission(err) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusMethodNotAllowed, err
+	}
+	report, err := readReport(r, reqPath)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	fn, ok := h.reports[report.XMLName]
+	if !ok {
+		fn, ok = h.builtinReports()[report.XMLName]
+	}
+	if !ok {
+		// RFC 3253 section 3.6, DAV:supported-report precondition.
+		writeXMLError(w, http.StatusForbidden, "supported-report")
+		return 0, errUnsupportedReport
+	}
+	if err := fn(ctx, w, r, report); err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return http.StatusNotFound, err
+		case errors.Is(err, os.ErrPermission):
+			return http.StatusForbidden, err
+		case errors.Is(err, ErrInvalidReport):
+			return http.StatusBadRequest, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+}
+
+// Props returns the status of the properties named pnames for resource name,
+// as reported by PROPFIND. ctx must be the context of a request served by h,
+// such as the one passed to a ReportHandler.
+func (h *Handler) Props(ctx context.Context, name string, pnames []xml.Name) ([]Propstat, error) {
+	return props(ctx, h.FileSystem, h.LockSystem, h.PropStore, name, pnames, nil)
+}
+
+// MultiStatusWriter writes the "207 Multi-Status" response of a report, see
+// Handler.NewMultiStatusWriter.
+type MultiStatusWriter struct {
+	h  *Handler
+	mw multistatusWriter
+}
+
+// NewMultiStatusWriter returns a MultiStatusWriter writing the responses of
+// a REPORT request served by h to w. ctx is the request context. Close must
+// be called once the responses are written.
+func (h *Handler) NewMultiStatusWriter(ctx context.Context, w http.ResponseWriter) *MultiStatusWriter {
+	return &MultiStatusWriter{
+		h:  h,
+		mw: multistatusWriter{w: w, canonical: h.CanonicalXML, ctx: ctx},
+	}
+}
+
+// href returns the href of resource name, a collection if dir is true.
+func (m *MultiStatusWriter) href(name string, dir bool) string {
+	href := path.Join("/", m.h.Prefix, name)
+	if dir && href != "/" {
+		href += "/"
+	}
+	return href
+}
+
+// Write writes the response with the properties pstats of resource name, a
+// collection if dir is true.
+func (m *MultiStatusWriter) Write(name string, dir bool, pstats []Propstat) error {
+	return m.mw.write(makePropstatResponse(m.href(name, dir), pstats))
+}
+
+// WriteStatus writes the response with the status of resource name, such as
+// "404 Not Found" for a resource that does not exist.
+func (m *MultiStatusWriter) WriteStatus(name string, status int) error {
+	return m.mw.write(&response{
+		Href:   []string{hrefPath(m.href(name, false))},
+		Status: fmt.Sprintf("HTTP/1.1 %d %s", status, StatusText(status)),
+	})
+}
+
+// Close completes the response, which is an empty multistatus if nothing was
+// written.
+func (m *MultiStatusWriter) Close() error {
+	if len(m.mw.pending) == 0 {
+		if err := m.mw.writeHeader(); err != nil {
+			return err
+		}
+	}
+	return m.mw.close()
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegisterReport(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /dir", "touch /dir/file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	}
+	echo := xml.Name{Space: "urn:test", Local: "echo"}
+	h.RegisterReport(echo, func(ctx context.Context, w http.ResponseWriter, r *http.Request, report Report) error {
+		var body struct {
+			Text string `xml:"text"`
+		}
+		if err := xml.Unmarshal(report.Body, &body); err != nil || body.Text == "" {
+			return ErrInvalidReport
+		}
+		fmt.Fprintf(w, "%s %d %s", report.Name, report.Depth, body.Text)
+		return nil
+	})
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("REPORT", "/dir/file", `<echo xmlns="urn:test"><text>hello</text></echo>`, "Depth", "1")
+	if got, want := w.Body.String(), "/dir/file 1 hello"; w.Code != http.StatusOK || got != want {
+		t.Errorf("echo: got %d %q, want %d %q", w.Code, got, http.StatusOK, want)
+	}
+
+	testCases := []struct {
+		desc   string
+		target string
+		body   string
+		want   int
+		inBody string
+	}{
+		{"invalid report", "/dir", `<echo xmlns="urn:test"/>`, http.StatusBadRequest, ""},
+		{"unsupported report", "/dir", `<D:version-tree xmlns:D="DAV:"/>`, http.StatusForbidden, "<D:supported-report/>"},
+		{"empty body", "/dir", ``, http.StatusBadRequest, ""},
+		{"missing resource", "/missing", `<echo xmlns="urn:test"><text>x</text></echo>`, http.StatusNotFound, ""},
+	}
+	for _, tc := range testCases {
+		w := do("REPORT", tc.target, tc.body)
+		if w.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.want)
+		}
+		if !strings.Contains(w.Body.String(), tc.inBody) {
+			t.Errorf("%s: got body %q, want %q", tc.desc, w.Body.String(), tc.inBody)
+		}
+	}
+
+	w = do("PROPFIND", "/dir", `<D:propfind xmlns:D="DAV:"><D:prop><D:supported-report-set/></D:prop></D:propfind>`, "Depth", "0")
+	if want := `<D:supported-report xmlns:D="DAV:"><D:report><echo xmlns="urn:test"/></D:report></D:supported-report>`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("supported-report-set: got %s, want %s", w.Body.String(), want)
+	}
+	w = do("OPTIONS", "/dir", "")
+	if got := w.Header().Get("Allow"); !strings.Contains(got, "REPORT") {
+		t.Errorf("OPTIONS: got Allow %q, want REPORT", got)
+	}
+}
+
+func TestReportMultiStatusWriter(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /dir", "write /dir/file hello"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		Prefix:     "/dav",
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	}
+	list := xml.Name{Space: "urn:test", Local: "list"}
+	h.RegisterReport(list, func(ctx context.Context, w http.ResponseWriter, r *http.Request, report Report) error {
+		mw := h.NewMultiStatusWriter(ctx, w)
+		if report.Depth != 0 {
+			pstats, err := h.Props(ctx, "/dir/file", []xml.Name{{Space: "DAV:", Local: "getcontentlength"}})
+			if err != nil {
+				return err
+			}
+			if err := mw.Write("/dir/file", false, pstats); err != nil {
+				return err
+			}
+			if err := mw.WriteStatus("/dir/missing", http.StatusNotFound); err != nil {
+				return err
+			}
+		}
+		return mw.Close()
+	})
+	testCases := []struct {
+		depth string
+		want  string
+	}{
+		{"0", `<D:multistatus xmlns:D="DAV:"></D:multistatus>`},
+		{"1", `<D:multistatus xmlns:D="DAV:"><D:response><D:href>/dav/dir/file</D:href><D:propstat><D:prop><D:getcontentlength>5</D:getcontentlength></D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>` +
+			`<D:response><D:href>/dav/dir/missing</D:href><D:status>HTTP/1.1 404 Not Found</D:status></D:response></D:multistatus>`},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest("REPORT", "/dav/dir", strings.NewReader(`<list xmlns="urn:test"/>`))
+		r.Header.Set("Depth", tc.depth)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusMultiStatus || !strings.HasSuffix(w.Body.String(), tc.want) {
+			t.Errorf("Depth %s: got %d %q, want %d %q", tc.depth, w.Code, w.Body.String(), http.StatusMultiStatus, tc.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	retainUntilPropName = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "retain-until"}
+	legalHoldPropName   = xml.Name{Space: "https://github.com/drakkan/webdav", Local: "legal-hold"}
+)
+
+// forbiddenRetention returns the Propstats failing patches if they change
+// the retention properties of resource name in a way that is not allowed,
+// or nil. The retention-until and legal-hold properties, in the
+// "https://github.com/drakkan/webdav" namespace, are stored in the
+// PropStore and may only be changed by the principals allowed by
+// Handler.CanHold. A retention period may be extended but not shortened or
+// removed until it expires, and a legal hold is released by setting it to
+// "0" or removing it.
+func (h *Handler) forbiddenRetention(r *http.Request, name string, patches []Proppatch) []Propstat {
+	var current map[xml.Name]Property
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			if p.XMLName != retainUntilPropName && p.XMLName != legalHoldPropName {
+				continue
+			}
+			if h.PropStore == nil || h.CanHold == nil || !h.CanHold(r, h.principal(r)) {
+				return patchFailed(patches, p.XMLName, http.StatusForbidden)
+			}
+			if current == nil {
+				var err error
+				if current, err = h.PropStore.Get(r.Context(), name); err != nil {
+					return patchFailed(patches, p.XMLName, http.StatusInternalServerError)
+				}
+				if current == nil {
+					current = make(map[xml.Name]Property)
+				}
+			}
+			value := strings.TrimSpace(string(p.InnerXML))
+			if p.XMLName == legalHoldPropName {
+				if !patch.Remove && value != "0" && value != "1" {
+					return patchFailed(patches, p.XMLName, http.StatusConflict)
+				}
+				continue
+			}
+			until, active := retainedUntil(current)
+			if patch.Remove {
+				if active {
+					return patchFailed(patches, p.XMLName, http.StatusForbidden)
+				}
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return patchFailed(patches, p.XMLName, http.StatusConflict)
+			}
+			if active && t.Before(until) {
+				return patchFailed(patches, p.XMLName, http.StatusForbidden)
+			}
+		}
+	}
+	return nil
+}
+
+// retainedUntil returns the retention period in props, and reports whether
+// it is still active.
+func retainedUntil(props map[xml.Name]Property) (time.Time, bool) {
+	p, ok := props[retainUntilPropName]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(p.InnerXML)))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, time.Now().Before(t)
+}
+
+// retained reports whether resource name is under an active retention
+// period or legal hold.
+func (h *Handler) retained(ctx context.Context, name string) (bool, error) {
+	props, err := h.PropStore.Get(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if p, ok := props[legalHoldPropName]; ok && strings.TrimSpace(string(p.InnerXML)) == "1" {
+		return true, nil
+	}
+	_, active := retainedUntil(props)
+	return active, nil
+}
+
+// checkRetention writes a "403 Forbidden" response, and returns
+// errRetained, if resource name, or any member of the collection name, is
+// under retention or legal hold, so that it cannot be overwritten, moved or
+// deleted. Missing resources are not retained.
+func (h *Handler) checkRetention(ctx context.Context, w http.ResponseWriter, name string) (status int, err error) {
+	if h.CanHold == nil || h.PropStore == nil {
+		return 0, nil
+	}
+	fi, err := h.FileSystem.Stat(ctx, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return http.StatusInternalServerError, err
+	}
+	err = walkFS(ctx, h.FileSystem, infiniteDepth, name, fi, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if held, err := h.retained(ctx, name); err != nil {
+			return err
+		} else if held {
+			return errRetained
+		}
+		return nil
+	})
+	if err == nil {
+		return 0, nil
+	}
+	if err != errRetained {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><D:error xmlns:D="DAV:">`+
+		`<W:resource-retained xmlns:W="https://github.com/drakkan/webdav"/></D:error>`)
+	return 0, errRetained
+}
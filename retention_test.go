@@ -0,0 +1,141 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRetention(t *testing.T) {
+	h := &Handler{
+		FileSystem: Dir(t.TempDir()),
+		LockSystem: NewMemLS(),
+		PropStore:  NewMemPropStore(),
+		Principal: func(r *http.Request) string {
+			user, _, _ := r.BasicAuth()
+			return user
+		},
+		CanHold: func(r *http.Request, principal string) bool {
+			return principal == "admin"
+		},
+	}
+	do := func(user, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth(user, "password")
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	proppatch := func(op, prop, value string) string {
+		return `<D:propertyupdate xmlns:D="DAV:" xmlns:W="https://github.com/drakkan/webdav"><D:` + op +
+			`><D:prop><W:` + prop + `>` + value + `</W:` + prop + `></D:prop></D:` + op + `></D:propertyupdate>`
+	}
+	for _, req := range [][3]string{{"PUT", "/f", "content"}, {"MKCOL", "/dir", ""}, {"PUT", "/dir/g", "content"}, {"PUT", "/expired", "content"}} {
+		if w := do("bob", req[0], req[1], req[2]); w.Code != http.StatusCreated {
+			t.Fatalf("%s %s: got status %d, want %d", req[0], req[1], w.Code, http.StatusCreated)
+		}
+	}
+	testCases := []struct {
+		desc, user, method, target, body string
+		headers                          []string
+		wantStatus                       int
+		wantBody                         string
+	}{
+		{"unprivileged hold", "bob", "PROPPATCH", "/dir/g", proppatch("set", "legal-hold", "1"), nil, StatusMulti, "403 Forbidden"},
+		{"invalid hold", "admin", "PROPPATCH", "/dir/g", proppatch("set", "legal-hold", "yes"), nil, StatusMulti, "409 Conflict"},
+		{"hold", "admin", "PROPPATCH", "/dir/g", proppatch("set", "legal-hold", "1"), nil, StatusMulti, "200 OK"},
+		{"delete held member", "bob", "DELETE", "/dir", "", nil, http.StatusForbidden, "resource-retained"},
+		{"move held", "bob", "MOVE", "/dir/g", "", []string{"Destination", "/moved"}, http.StatusForbidden, "resource-retained"},
+		{"overwrite held", "bob", "PUT", "/dir/g", "new", nil, http.StatusForbidden, "resource-retained"},
+		{"copy over held", "bob", "COPY", "/f", "", []string{"Destination", "/dir/g"}, http.StatusForbidden, "resource-retained"},
+		{"release", "admin", "PROPPATCH", "/dir/g", proppatch("remove", "legal-hold", ""), nil, StatusMulti, "200 OK"},
+		{"delete released", "bob", "DELETE", "/dir/g", "", nil, http.StatusNoContent, ""},
+		{"retain", "admin", "PROPPATCH", "/f", proppatch("set", "retain-until", "2999-01-01T00:00:00Z"), nil, StatusMulti, "200 OK"},
+		{"invalid retention", "admin", "PROPPATCH", "/f", proppatch("set", "retain-until", "tomorrow"), nil, StatusMulti, "409 Conflict"},
+		{"shorten retention", "admin", "PROPPATCH", "/f", proppatch("set", "retain-until", "2998-01-01T00:00:00Z"), nil, StatusMulti, "403 Forbidden"},
+		{"remove retention", "admin", "PROPPATCH", "/f", proppatch("remove", "retain-until", ""), nil, StatusMulti, "403 Forbidden"},
+		{"extend retention", "admin", "PROPPATCH", "/f", proppatch("set", "retain-until", "3000-01-01T00:00:00Z"), nil, StatusMulti, "200 OK"},
+		{"delete retained", "admin", "DELETE", "/f", "", nil, http.StatusForbidden, "resource-retained"},
+		{"expired retention", "admin", "PROPPATCH", "/expired", proppatch("set", "retain-until", "2000-01-01T00:00:00Z"), nil, StatusMulti, "200 OK"},
+		{"delete expired", "bob", "DELETE", "/expired", "", nil, http.StatusNoContent, ""},
+	}
+	for _, tc := range testCases {
+		w := do(tc.user, tc.method, tc.target, tc.body, tc.headers...)
+		if w.Code != tc.wantStatus || !strings.Contains(w.Body.String(), tc.wantBody) {
+			t.Errorf("%s: got %d %q, want %d containing %q", tc.desc, w.Code, w.Body.String(), tc.wantStatus, tc.wantBody)
+		}
+	}
+}
+
+func TestRetentionResumableUpload(t *testing.T) {
+	dir := t.TempDir()
+	h := &Handler{
+		FileSystem:       Dir(dir),
+		LockSystem:       NewMemLS(),
+		PropStore:        NewMemPropStore(),
+		ResumableUploads: &ResumableUploads{},
+		CanHold:          func(r *http.Request, principal string) bool { return true },
+	}
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	tus := func(headers ...string) []string {
+		return append([]string{"Tus-Resumable", "1.0.0", "Content-Type", "application/offset+octet-stream"}, headers...)
+	}
+	if w := do("PUT", "/f.txt", "original"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("f.txt"))
+	if w := do("POST", "/", "", tus("Upload-Length", "11", "Upload-Metadata", metadata)...); w.Code != http.StatusCreated {
+		t.Fatalf("POST: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := do("PATCH", "/f.txt", "hello", tus("Upload-Offset", "0")...); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	const hold = `<D:propertyupdate xmlns:D="DAV:" xmlns:W="https://github.com/drakkan/webdav">` +
+		`<D:set><D:prop><W:legal-hold>1</W:legal-hold></D:prop></D:set></D:propertyupdate>`
+	if w := do("PROPPATCH", "/f.txt", hold); !strings.Contains(w.Body.String(), "200 OK") {
+		t.Fatalf("PROPPATCH: got %q", w.Body.String())
+	}
+	w := do("PATCH", "/f.txt", " world", tus("Upload-Offset", "5")...)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "resource-retained") {
+		t.Fatalf("last PATCH of a held file: got %d %q, want %d", w.Code, w.Body.String(), http.StatusForbidden)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "f.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "original" {
+		t.Errorf("got content %q, want %q", b, "original")
+	}
+	if list, err := os.ReadDir(dir); err != nil || len(list) != 1 {
+		t.Errorf("got entries %v, %v, want the held file only", list, err)
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package s3 exposes a read-only subset of the Amazon S3 REST API over a
+// webdav.FileSystem, so that tools that only speak S3 can read the same
+// files served by a webdav.Handler.
+//
+// Only path-style requests are supported. The GetObject, HeadObject and
+// ListObjectsV2 operations are implemented, any other request gets a "501
+// Not Implemented" response. AWS signatures are not verified: requests
+// should be authenticated using Handler.Authorize, typically sharing the
+// authentication of the WebDAV endpoint.
+package s3
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drakkan/webdav"
+)
+
+const (
+	defaultMaxKeys = 1000
+	s3Namespace    = "http://s3.amazonaws.com/doc/2006-03-01/"
+)
+
+// Handler serves a single bucket backed by a webdav.FileSystem.
+type Handler struct {
+	// Prefix is the URL path prefix to strip from the request paths.
+	Prefix string
+	// Bucket is the name of the bucket.
+	Bucket string
+	// FileSystem is the virtual file system.
+	FileSystem webdav.FileSystem
+	// Authorize optionally authorizes the request. If it returns an error,
+	// the Handler writes an AccessDenied error.
+	Authorize func(*http.Request) error
+	// Logger is an optional error logger. If non-nil, it will be called
+	// for all HTTP requests.
+	Logger func(*http.Request, error)
+}
+
+// s3Error is a S3 error response.
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+	status   int
+}
+
+func (e *s3Error) Error() string {
+	return "s3: " + e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied    = &s3Error{Code: "AccessDenied", Message: "Access Denied", status: http.StatusForbidden}
+	errInvalidArgument = &s3Error{Code: "InvalidArgument", Message: "Invalid Argument", status: http.StatusBadRequest}
+	errInternal        = &s3Error{Code: "InternalError", Message: "We encountered an internal error. Please try again.", status: http.StatusInternalServerError}
+	errNoSuchBucket    = &s3Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist", status: http.StatusNotFound}
+	errNoSuchKey       = &s3Error{Code: "NoSuchKey", Message: "The specified key does not exist.", status: http.StatusNotFound}
+	errNotImplemented  = &s3Error{Code: "NotImplemented", Message: "A header or query you provided implies functionality that is not implemented.", status: http.StatusNotImplemented}
+)
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := h.serve(w, r)
+	if err != nil {
+		var e *s3Error
+		if !errors.As(err, &e) {
+			e = errInternal
+		}
+		if os.IsNotExist(err) {
+			e = errNoSuchKey
+		} else if os.IsPermission(err) {
+			e = errAccessDenied
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(e.status)
+		if r.Method != http.MethodHead {
+			io.WriteString(w, xml.Header)
+			xml.NewEncoder(w).Encode(&s3Error{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+		}
+	}
+	if h.Logger != nil {
+		h.Logger(r, err)
+	}
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) error {
+	if h.Authorize != nil {
+		if err := h.Authorize(r); err != nil {
+			return errAccessDenied
+		}
+	}
+	p := strings.TrimPrefix(r.URL.Path, h.Prefix)
+	if len(p) == len(r.URL.Path) && h.Prefix != "" {
+		return errNoSuchBucket
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	if bucket != h.Bucket {
+		return errNoSuchBucket
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return errNotImplemented
+	}
+	if key == "" {
+		if r.Method == http.MethodHead {
+			return nil
+		}
+		if r.URL.Query().Get("list-type") != "2" {
+			return errNotImplemented
+		}
+		return h.listObjects(w, r)
+	}
+	return h.getObject(w, r, key)
+}
+
+// getObject implements the GetObject and HeadObject operations.
+func (h *Handler) getObject(w http.ResponseWriter, r *http.Request, key string) error {
+	if strings.HasSuffix(key, "/") {
+		return errNoSuchKey
+	}
+	ctx := r.Context()
+	name := path.Clean("/" + key)
+	f, err := h.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errNoSuchKey
+	}
+	etag, err := findETag(ctx, fi)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag)
+	if ctyper, ok := fi.(webdav.ContentTyper); ok {
+		if ctype, err := ctyper.ContentType(ctx); err == nil {
+			w.Header().Set("Content-Type", ctype)
+		}
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	return nil
+}
+
+func findETag(ctx context.Context, fi os.FileInfo) (string, error) {
+	if do, ok := fi.(webdav.ETager); ok {
+		etag, err := do.ETag(ctx)
+		if err != webdav.ErrNotImplemented {
+			return etag, err
+		}
+	}
+	return fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size()), nil
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []object       `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listObjects implements the ListObjectsV2 operation.
+func (h *Handler) listObjects(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	res := listBucketResult{
+		Xmlns:      s3Namespace,
+		Name:       h.Bucket,
+		Prefix:     q.Get("prefix"),
+		Delimiter:  q.Get("delimiter"),
+		StartAfter: q.Get("start-after"),
+		MaxKeys:    defaultMaxKeys,
+	}
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+		if n < res.MaxKeys {
+			res.MaxKeys = n
+		}
+	}
+	after := res.StartAfter
+	if token := q.Get("continuation-token"); token != "" {
+		b, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return errInvalidArgument
+		}
+		res.ContinuationToken = token
+		after = string(b)
+	}
+
+	// Keys never start with a slash, they are FileSystem names without the
+	// leading slash. Directories, even empty ones, are listed as common
+	// prefixes when the delimiter is a slash, and walked otherwise.
+	entries := make(map[string]os.FileInfo)
+	prefixes := make(map[string]bool)
+	dir := res.Prefix[:strings.LastIndexByte(res.Prefix, '/')+1]
+	err := h.walk(r.Context(), dir, res.Delimiter == "/", func(key string, fi os.FileInfo) {
+		if !strings.HasPrefix(key, res.Prefix) {
+			return
+		}
+		if res.Delimiter != "" {
+			if i := strings.Index(key[len(res.Prefix):], res.Delimiter); i >= 0 {
+				prefixes[key[:len(res.Prefix)+i+len(res.Delimiter)]] = true
+				return
+			}
+		}
+		if !fi.IsDir() {
+			entries[key] = fi
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	keys := make([]string, 0, len(entries)+len(prefixes))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	for k := range prefixes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k <= after {
+			continue
+		}
+		if res.KeyCount == res.MaxKeys {
+			res.IsTruncated = true
+			break
+		}
+		res.KeyCount++
+		if fi, ok := entries[k]; ok {
+			etag, err := findETag(r.Context(), fi)
+			if err != nil {
+				return err
+			}
+			res.Contents = append(res.Contents, object{
+				Key:          k,
+				LastModified: fi.ModTime().UTC().Format(time.RFC3339),
+				ETag:         etag,
+				Size:         fi.Size(),
+				StorageClass: "STANDARD",
+			})
+		} else {
+			res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{Prefix: k})
+		}
+		after = k
+	}
+	if res.IsTruncated {
+		res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(after))
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header)
+	return xml.NewEncoder(w).Encode(&res)
+}
+
+// walk calls fn for each entry in the directory named by the key prefix dir.
+// Directory keys end with a slash. If shallow is true, subdirectories are
+// not walked.
+func (h *Handler) walk(ctx context.Context, dir string, shallow bool, fn func(key string, fi os.FileInfo)) error {
+	f, err := h.FileSystem.OpenFile(ctx, "/"+dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	fis, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		key := dir + fi.Name()
+		if !fi.IsDir() {
+			fn(key, fi)
+			continue
+		}
+		fn(key+"/", fi)
+		if shallow {
+			continue
+		}
+		if err := h.walk(ctx, key+"/", false, fn); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/drakkan/webdav"
+)
+
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	for _, dir := range []string{"/a", "/a/b", "/c"} {
+		if err := fs.Mkdir(ctx, dir, 0777); err != nil {
+			t.Fatalf("Mkdir %q: %v", dir, err)
+		}
+	}
+	for _, name := range []string{"/1.txt", "/a/2.txt", "/a/3.txt", "/a/b/4.txt"} {
+		f, err := fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			t.Fatalf("OpenFile %q: %v", name, err)
+		}
+		f.Write([]byte("content of " + name))
+		f.Close()
+	}
+	return &Handler{
+		Bucket:     "bucket",
+		FileSystem: fs,
+	}
+}
+
+func TestGetObject(t *testing.T) {
+	h := newTestHandler(t)
+	testCases := []struct {
+		method     string
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"GET", "/bucket/a/2.txt", http.StatusOK, "content of /a/2.txt"},
+		{"HEAD", "/bucket/a/2.txt", http.StatusOK, ""},
+		{"GET", "/bucket/a", http.StatusNotFound, ""},
+		{"GET", "/bucket/a/", http.StatusNotFound, ""},
+		{"GET", "/bucket/missing", http.StatusNotFound, ""},
+		{"GET", "/other/a/2.txt", http.StatusNotFound, ""},
+		{"PUT", "/bucket/a/2.txt", http.StatusNotImplemented, ""},
+	}
+
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.target, w.Code, tc.wantStatus)
+			continue
+		}
+		if tc.wantStatus == http.StatusOK {
+			if got := w.Body.String(); got != tc.wantBody {
+				t.Errorf("%s %s: got body %q, want %q", tc.method, tc.target, got, tc.wantBody)
+			}
+			if w.Header().Get("ETag") == "" {
+				t.Errorf("%s %s: missing ETag", tc.method, tc.target)
+			}
+		}
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	h := newTestHandler(t)
+	testCases := []struct {
+		query        string
+		wantKeys     []string
+		wantPrefixes []string
+		wantNext     bool
+	}{{
+		query:    "",
+		wantKeys: []string{"1.txt", "a/2.txt", "a/3.txt", "a/b/4.txt"},
+	}, {
+		query:        "&delimiter=/",
+		wantKeys:     []string{"1.txt"},
+		wantPrefixes: []string{"a/", "c/"},
+	}, {
+		query:        "&delimiter=/&prefix=a/",
+		wantKeys:     []string{"a/2.txt", "a/3.txt"},
+		wantPrefixes: []string{"a/b/"},
+	}, {
+		query:    "&prefix=a/b",
+		wantKeys: []string{"a/b/4.txt"},
+	}, {
+		query:    "&max-keys=2",
+		wantKeys: []string{"1.txt", "a/2.txt"},
+		wantNext: true,
+	}, {
+		query:    "&start-after=a/2.txt",
+		wantKeys: []string{"a/3.txt", "a/b/4.txt"},
+	}, {
+		query: "&prefix=missing/",
+	}}
+
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/bucket?list-type=2"+tc.query, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: got status %d, want %d", tc.query, w.Code, http.StatusOK)
+			continue
+		}
+		var res listBucketResult
+		if err := xml.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Errorf("%q: unmarshal: %v", tc.query, err)
+			continue
+		}
+		var keys, prefixes []string
+		for _, o := range res.Contents {
+			keys = append(keys, o.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !reflect.DeepEqual(keys, tc.wantKeys) {
+			t.Errorf("%q: got keys %q, want %q", tc.query, keys, tc.wantKeys)
+		}
+		if !reflect.DeepEqual(prefixes, tc.wantPrefixes) {
+			t.Errorf("%q: got prefixes %q, want %q", tc.query, prefixes, tc.wantPrefixes)
+		}
+		if got := res.NextContinuationToken != ""; got != tc.wantNext || res.IsTruncated != tc.wantNext {
+			t.Errorf("%q: got truncated %t, want %t", tc.query, got, tc.wantNext)
+		}
+	}
+}
+
+func TestListObjectsContinuation(t *testing.T) {
+	h := newTestHandler(t)
+	var keys []string
+	token := ""
+	for i := 0; i < 10; i++ {
+		target := "/bucket?list-type=2&max-keys=1"
+		if token != "" {
+			target += "&continuation-token=" + token
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		var res listBucketResult
+		if err := xml.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		for _, o := range res.Contents {
+			keys = append(keys, o.Key)
+		}
+		if !res.IsTruncated {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+	want := []string{"1.txt", "a/2.txt", "a/3.txt", "a/b/4.txt"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got keys %q, want %q", keys, want)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	h := newTestHandler(t)
+	h.Authorize = func(r *http.Request) error {
+		if r.Header.Get("Authorization") == "" {
+			return errors.New("unauthenticated")
+		}
+		return nil
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/bucket/1.txt", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	r := httptest.NewRequest("GET", "/bucket/1.txt", nil)
+	r.Header.Set("Authorization", "token")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Priority orders the background work waiting for a Scheduler.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// SchedulerConfig configures the rate limits of NewScheduler.
+type SchedulerConfig struct {
+	// Rate is the number of tokens per second granted to background work
+	// while no foreground request is being served. Zero means unlimited.
+	Rate float64
+	// BusyRate is the number of tokens per second granted to background
+	// work while foreground requests are being served. Zero pauses the
+	// background work until they are completed.
+	BusyRate float64
+	// Burst is the maximum number of tokens that can be accumulated. Zero
+	// means 1.
+	Burst int
+}
+
+// Scheduler shares the backend throughput among background work, such as
+// prefetching, scrubbing or replication, with a token bucket, so that it
+// never competes with the foreground requests of clients.
+//
+// Background work calls Wait before each unit of work, such as a file read
+// or a listing. Foreground requests are marked with Foreground, which the
+// Handler does for all its requests when its Scheduler field is set.
+type Scheduler struct {
+	config SchedulerConfig
+
+	mu         sync.Mutex
+	tokens     float64
+	last       time.Time
+	foreground int
+	// waiting is the number of waiters for each Priority.
+	waiting map[Priority]int
+	// changed is closed, and replaced, when the waiters must reevaluate
+	// whether they can proceed.
+	changed chan struct{}
+}
+
+// NewScheduler returns a Scheduler with the given configuration. Its bucket
+// is initially full.
+func NewScheduler(config SchedulerConfig) *Scheduler {
+	if config.Burst <= 0 {
+		config.Burst = 1
+	}
+	return &Scheduler{
+		config:  config,
+		tokens:  float64(config.Burst),
+		last:    time.Now(),
+		waiting: make(map[Priority]int),
+		changed: make(chan struct{}),
+	}
+}
+
+// Foreground marks the beginning of a foreground request, which lowers the
+// rate granted to background work to BusyRate. The returned function marks
+// its end.
+func (s *Scheduler) Foreground() (done func()) {
+	s.mu.Lock()
+	s.refill(time.Now())
+	s.foreground++
+	s.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			s.refill(time.Now())
+			s.foreground--
+			s.broadcast()
+			s.mu.Unlock()
+		})
+	}
+}
+
+// Wait blocks until n tokens are granted to background work with priority p,
+// or until ctx is done. Waiters with a higher priority are granted tokens
+// first. Work larger than the burst is granted once the bucket is full, and
+// delays the following work accordingly.
+func (s *Scheduler) Wait(ctx context.Context, p Priority, n int) error {
+	s.mu.Lock()
+	s.waiting[p]++
+	defer func() {
+		s.mu.Lock()
+		s.waiting[p]--
+		s.broadcast()
+		s.mu.Unlock()
+	}()
+	for {
+		s.refill(time.Now())
+		rate := s.rate()
+		need := float64(n)
+		if burst := float64(s.config.Burst); need > burst {
+			need = burst
+		}
+		paused := s.foreground > 0 && rate <= 0
+		unlimited := s.foreground == 0 && rate <= 0
+		preempted := s.preempted(p)
+		if !preempted && !paused && (unlimited || s.tokens >= need) {
+			if !unlimited {
+				s.tokens -= float64(n)
+			}
+			s.mu.Unlock()
+			return nil
+		}
+		changed := s.changed
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !preempted && !paused {
+			d := time.Duration((need - s.tokens) / rate * float64(time.Second))
+			timer = time.NewTimer(d + time.Millisecond)
+			expired = timer.C
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return ctx.Err()
+		case <-changed:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		s.mu.Lock()
+	}
+}
+
+// rate returns the current refill rate, in tokens per second. s.mu must be
+// held.
+func (s *Scheduler) rate() float64 {
+	if s.foreground > 0 {
+		return s.config.BusyRate
+	}
+	return s.config.Rate
+}
+
+// refill adds the tokens accumulated since the last refill. s.mu must be
+// held.
+func (s *Scheduler) refill(now time.Time) {
+	if rate := s.rate(); rate > 0 {
+		s.tokens += now.Sub(s.last).Seconds() * rate
+	} else if s.foreground == 0 {
+		// Unlimited.
+		s.tokens = float64(s.config.Burst)
+	}
+	if burst := float64(s.config.Burst); s.tokens > burst {
+		s.tokens = burst
+	}
+	s.last = now
+}
+
+// preempted returns whether waiters with a priority higher than p are
+// waiting. s.mu must be held.
+func (s *Scheduler) preempted(p Priority) bool {
+	for q, n := range s.waiting {
+		if q > p && n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcast wakes up the waiters. s.mu must be held.
+func (s *Scheduler) broadcast() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSchedulerRate(t *testing.T) {
+	s := NewScheduler(SchedulerConfig{Rate: 50, Burst: 1})
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := s.Wait(ctx, PriorityNormal, 1); err != nil {
+			t.Fatalf("Wait #%d: %v", i, err)
+		}
+	}
+	// The first token is in the bucket, the two others take 20ms each.
+	if got, want := time.Since(start), 40*time.Millisecond; got < want {
+		t.Errorf("got %v for three tokens, want at least %v", got, want)
+	}
+
+	s = NewScheduler(SchedulerConfig{})
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		if err := s.Wait(ctx, PriorityNormal, 10); err != nil {
+			t.Fatalf("unlimited Wait #%d: %v", i, err)
+		}
+	}
+	if got := time.Since(start); got > time.Second {
+		t.Errorf("unlimited: got %v for a hundred waits, want no delay", got)
+	}
+}
+
+func TestSchedulerForeground(t *testing.T) {
+	// Only the token initially in the bucket is granted in the test.
+	s := NewScheduler(SchedulerConfig{Rate: 0.1, Burst: 1})
+	done := s.Foreground()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Wait(ctx, PriorityHigh, 1); err != context.DeadlineExceeded {
+		t.Fatalf("Wait while busy: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	granted := make(chan Priority, 2)
+	wait := func(p Priority) {
+		if s.Wait(ctx, p, 1) == nil {
+			granted <- p
+		}
+	}
+	go wait(PriorityLow)
+	time.Sleep(10 * time.Millisecond)
+	go wait(PriorityHigh)
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case p := <-granted:
+		t.Fatalf("got priority %d granted while busy, want none", p)
+	default:
+	}
+
+	done()
+	select {
+	case p := <-granted:
+		if p != PriorityHigh {
+			t.Errorf("got priority %d granted, want %d", p, PriorityHigh)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("nothing granted once idle")
+	}
+	select {
+	case p := <-granted:
+		t.Errorf("got priority %d granted with an empty bucket, want none", p)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
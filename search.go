@@ -0,0 +1,694 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ixml "github.com/drakkan/webdav/internal/xml"
+)
+
+// Searcher is the query backend of the SEARCH method, defined by RFC 5323,
+// with the DAV:basicsearch grammar. Embedders can plug a database or a
+// full-text index, WalkSearcher evaluates simple queries by walking the
+// FileSystem.
+type Searcher interface {
+	// Search returns the names of the resources matching q, sorted according
+	// to q.OrderBy. If q.Limit is positive, it returns at most q.Limit names,
+	// and whether more resources matched.
+	//
+	// It returns ErrNotImplemented if it can't evaluate q, which is then
+	// refused with 422 Unprocessable Entity.
+	Search(ctx context.Context, fs FileSystem, q SearchQuery) (names []string, truncated bool, err error)
+}
+
+// SearchQuery is a parsed DAV:basicsearch query.
+type SearchQuery struct {
+	// Select are the properties reported for the matching resources. It is
+	// nil if Allprop is set.
+	Select []xml.Name
+	// Allprop is whether all the properties are reported.
+	Allprop bool
+	// Scope is the name of the searched collection.
+	Scope string
+	// Depth is the depth of the search below Scope: 0, 1, or -1 for
+	// infinity.
+	Depth int
+	// Where is the condition the resources must match, nil matches all the
+	// resources.
+	Where *SearchExpr
+	// OrderBy is how the resources are sorted.
+	OrderBy []SearchOrder
+	// Limit is the maximum number of resources reported, zero means no
+	// limit.
+	Limit int
+}
+
+// SearchExpr is a DAV:basicsearch condition.
+type SearchExpr struct {
+	// Op is the local name of the operator, in the DAV: namespace: "and",
+	// "or", "not", "eq", "lt", "lte", "gt", "gte", "like", "is-collection",
+	// "is-defined" or "contains".
+	Op string
+	// Operands are the operands of "and", "or" and "not".
+	Operands []*SearchExpr
+	// Prop is the property compared by "eq", "lt", "lte", "gt", "gte" and
+	// "like", or tested by "is-defined".
+	Prop xml.Name
+	// Literal is the value Prop is compared to, the pattern of "like", or
+	// the text looked for by "contains".
+	Literal string
+	// CaseSensitive is whether string comparisons are case sensitive. The
+	// default of the DAV:basicsearch grammar is to ignore the case.
+	CaseSensitive bool
+}
+
+// SearchOrder is a DAV:basicsearch sort key.
+type SearchOrder struct {
+	Prop          xml.Name
+	Descending    bool
+	CaseSensitive bool
+}
+
+// dasl is the DASL header value advertising the supported grammars.
+const dasl = "<DAV:basicsearch>"
+
+// searchNode is an element of a DAV:searchrequest.
+type searchNode struct {
+	name     xml.Name
+	attrs    []ixml.Attr
+	text     string
+	children []*searchNode
+}
+
+func (n *searchNode) attr(local string) string {
+	for _, a := range n.attrs {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// child returns the first child of n named DAV:local, if any.
+func (n *searchNode) child(local string) *searchNode {
+	for _, c := range n.children {
+		if c.name == (xml.Name{Space: "DAV:", Local: local}) {
+			return c
+		}
+	}
+	return nil
+}
+
+// readSearchNode reads the element starting with start.
+func readSearchNode(d *ixml.Decoder, start ixml.StartElement) (*searchNode, error) {
+	n := &searchNode{name: xml.Name(start.Name), attrs: start.Attr}
+	for {
+		t, err := next(d)
+		if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case ixml.StartElement:
+			c, err := readSearchNode(d, t)
+			if err != nil {
+				return nil, err
+			}
+			n.children = append(n.children, c)
+		case ixml.CharData:
+			n.text += string(t)
+		case ixml.EndElement:
+			return n, nil
+		}
+	}
+}
+
+// searchProp returns the single property named by the DAV:prop child of n.
+func searchProp(n *searchNode) (xml.Name, error) {
+	prop := n.child("prop")
+	if prop == nil || len(prop.children) != 1 {
+		return xml.Name{}, fmt.Errorf("%w: %s needs a single property", errInvalidSearch, n.name.Local)
+	}
+	return prop.children[0].name, nil
+}
+
+func parseSearchExpr(n *searchNode) (*SearchExpr, error) {
+	if n.name.Space != "DAV:" {
+		return nil, fmt.Errorf("%w: unknown operator %s %s", ErrNotImplemented, n.name.Space, n.name.Local)
+	}
+	e := &SearchExpr{
+		Op:            n.name.Local,
+		CaseSensitive: n.attr("caseless") == "no",
+	}
+	switch e.Op {
+	case "and", "or", "not":
+		for _, c := range n.children {
+			operand, err := parseSearchExpr(c)
+			if err != nil {
+				return nil, err
+			}
+			e.Operands = append(e.Operands, operand)
+		}
+		if len(e.Operands) == 0 || e.Op == "not" && len(e.Operands) != 1 {
+			return nil, fmt.Errorf("%w: invalid number of operands for %s", errInvalidSearch, e.Op)
+		}
+	case "eq", "lt", "lte", "gt", "gte", "like":
+		prop, err := searchProp(n)
+		if err != nil {
+			return nil, err
+		}
+		literal := n.child("literal")
+		if literal == nil {
+			literal = n.child("typed-literal")
+		}
+		if literal == nil {
+			return nil, fmt.Errorf("%w: %s needs a literal", errInvalidSearch, e.Op)
+		}
+		e.Prop, e.Literal = prop, literal.text
+	case "is-defined":
+		prop, err := searchProp(n)
+		if err != nil {
+			return nil, err
+		}
+		e.Prop = prop
+	case "is-collection":
+	case "contains":
+		e.Literal = n.text
+	default:
+		return nil, fmt.Errorf("%w: unknown operator %s", ErrNotImplemented, e.Op)
+	}
+	return e, nil
+}
+
+// readSearch parses the DAV:searchrequest body of the SEARCH request r, whose
+// scope is resolved by h.
+func (h *Handler) readSearch(r *http.Request) (q SearchQuery, status int, err error) {
+	d := ixml.NewDecoder(r.Body)
+	var root *searchNode
+	for root == nil {
+		t, err := next(d)
+		if err != nil {
+			if err == io.EOF {
+				err = errInvalidSearch
+			}
+			return q, http.StatusBadRequest, err
+		}
+		if start, ok := t.(ixml.StartElement); ok {
+			if root, err = readSearchNode(d, start); err != nil {
+				return q, http.StatusBadRequest, err
+			}
+		}
+	}
+	if root.name != (xml.Name{Space: "DAV:", Local: "searchrequest"}) {
+		return q, http.StatusBadRequest, errInvalidSearch
+	}
+	bs := root.child("basicsearch")
+	if bs == nil {
+		// The grammar is not advertised in the DASL header.
+		return q, StatusUnprocessableEntity, ErrNotImplemented
+	}
+
+	sel := bs.child("select")
+	if sel == nil {
+		return q, http.StatusBadRequest, errInvalidSearch
+	}
+	if sel.child("allprop") != nil {
+		q.Allprop = true
+	} else if prop := sel.child("prop"); prop != nil && len(prop.children) > 0 {
+		for _, c := range prop.children {
+			q.Select = append(q.Select, c.name)
+		}
+	} else {
+		return q, http.StatusBadRequest, errInvalidSearch
+	}
+
+	var scopes []*searchNode
+	if from := bs.child("from"); from != nil {
+		for _, c := range from.children {
+			if c.name == (xml.Name{Space: "DAV:", Local: "scope"}) {
+				scopes = append(scopes, c)
+			}
+		}
+	}
+	switch len(scopes) {
+	case 0:
+		return q, http.StatusBadRequest, errInvalidSearch
+	case 1:
+	default:
+		return q, StatusUnprocessableEntity, fmt.Errorf("%w: multiple scopes", ErrNotImplemented)
+	}
+	href := scopes[0].child("href")
+	if href == nil {
+		return q, http.StatusBadRequest, errInvalidSearch
+	}
+	u, err := url.Parse(strings.TrimSpace(href.text))
+	if err != nil {
+		return q, http.StatusBadRequest, errInvalidSearch
+	}
+	if u = r.URL.ResolveReference(u); u.Host != "" && u.Host != r.Host {
+		return q, http.StatusBadRequest, errInvalidSearch
+	}
+	if q.Scope, status, err = h.stripPrefix(u.Path); err != nil {
+		return q, http.StatusBadRequest, errInvalidSearch
+	}
+	q.Depth = infiniteDepth
+	if depth := scopes[0].child("depth"); depth != nil {
+		if q.Depth = parseDepth(strings.TrimSpace(depth.text)); q.Depth == invalidDepth {
+			return q, http.StatusBadRequest, errInvalidDepth
+		}
+	}
+
+	if where := bs.child("where"); where != nil {
+		if len(where.children) != 1 {
+			return q, http.StatusBadRequest, errInvalidSearch
+		}
+		if q.Where, err = parseSearchExpr(where.children[0]); err != nil {
+			if errors.Is(err, ErrNotImplemented) {
+				return q, StatusUnprocessableEntity, err
+			}
+			return q, http.StatusBadRequest, err
+		}
+	}
+	if orderby := bs.child("orderby"); orderby != nil {
+		for _, o := range orderby.children {
+			prop, err := searchProp(o)
+			if err != nil {
+				return q, http.StatusBadRequest, err
+			}
+			q.OrderBy = append(q.OrderBy, SearchOrder{
+				Prop:          prop,
+				Descending:    o.child("descending") != nil,
+				CaseSensitive: o.attr("caseless") == "no",
+			})
+		}
+	}
+	if limit := bs.child("limit"); limit != nil {
+		nresults := limit.child("nresults")
+		if nresults == nil {
+			return q, http.StatusBadRequest, errInvalidSearch
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(nresults.text))
+		if err != nil || n <= 0 {
+			return q, http.StatusBadRequest, errInvalidSearch
+		}
+		q.Limit = n
+	}
+	return q, 0, nil
+}
+
+func (h *Handler) handleSearch(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	if h.Searcher == nil {
+		return http.StatusBadRequest, errUnsupportedMethod
+	}
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	ctx := r.Context()
+	if _, err := h.FileSystem.Stat(ctx, reqPath); err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
+		return http.StatusMethodNotAllowed, err
+	}
+	q, status, err := h.readSearch(r)
+	if err != nil {
+		return status, err
+	}
+	if fi, err := h.FileSystem.Stat(ctx, q.Scope); err != nil || !fi.IsDir() {
+		return http.StatusBadRequest, fmt.Errorf("%w: invalid scope", errInvalidSearch)
+	}
+	if max := h.MaxPropfindResults; max > 0 && (q.Limit == 0 || q.Limit > max) {
+		q.Limit = max
+	}
+	names, truncated, err := h.Searcher.Search(ctx, h.FileSystem, q)
+	if err != nil {
+		if errors.Is(err, ErrNotImplemented) {
+			return StatusUnprocessableEntity, err
+		}
+		if errors.Is(err, errInvalidSearch) {
+			return http.StatusBadRequest, err
+		}
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("DASL", dasl)
+	minimal := returnMinimal(w, r)
+	// The responses are not sorted by href, even with CanonicalXML, as the
+	// order of the matches is part of the result.
+	mw := multistatusWriter{w: w, ctx: ctx}
+	writeErr := func() error {
+		// The response is a multistatus even if nothing matches.
+		if err := mw.writeHeader(); err != nil {
+			return err
+		}
+		for _, name := range names {
+			fi, err := h.FileSystem.Stat(ctx, name)
+			if err != nil {
+				// Removed since the search.
+				continue
+			}
+			var pstats []Propstat
+			if q.Allprop {
+				pstats, err = allprop(ctx, h.FileSystem, h.LockSystem, h.PropStore, name, nil, fi)
+			} else {
+				pstats, err = props(ctx, h.FileSystem, h.LockSystem, h.PropStore, name, q.Select, fi)
+			}
+			if err != nil {
+				return err
+			}
+			if minimal {
+				pstats = minimalPropstats(pstats)
+			}
+			href := path.Join(h.Prefix, name)
+			if href != "/" && fi.IsDir() {
+				href += "/"
+			}
+			resp := makePropstatResponse(href, pstats)
+			if h.CanonicalXML {
+				canonicalizeResponse(resp)
+			}
+			if err := mw.write(resp); err != nil {
+				return err
+			}
+		}
+		if truncated {
+			desc := fmt.Sprintf("Only the first %d matches have been listed.", len(names))
+			return mw.write(limitResponse(r.URL.Path, desc))
+		}
+		return nil
+	}()
+	if h.listingAborted(r, &mw, writeErr) {
+		return 0, writeErr
+	}
+	closeErr := mw.close()
+	if writeErr != nil {
+		return http.StatusInternalServerError, writeErr
+	}
+	if closeErr != nil {
+		return http.StatusInternalServerError, closeErr
+	}
+	return 0, nil
+}
+
+// WalkSearcher is a Searcher walking the FileSystem. Its conditions and sort
+// keys can only use the DAV:displayname, DAV:getcontenttype,
+// DAV:getcontentlength and DAV:getlastmodified properties, and the
+// DAV:is-collection operator. As every query walks its whole scope, it is
+// meant for small trees.
+type WalkSearcher struct{}
+
+// searchValue is the value of a property of a resource, compared according
+// to its type.
+type searchValue struct {
+	s string
+	n int64
+	t time.Time
+}
+
+// searchKind is the type of the values of a property.
+type searchKind int
+
+const (
+	searchString searchKind = iota
+	searchInt
+	searchTime
+)
+
+var searchProps = map[xml.Name]searchKind{
+	{Space: "DAV:", Local: "displayname"}:      searchString,
+	{Space: "DAV:", Local: "getcontenttype"}:   searchString,
+	{Space: "DAV:", Local: "getcontentlength"}: searchInt,
+	{Space: "DAV:", Local: "getlastmodified"}:  searchTime,
+}
+
+// searchMatch is a resource matching a search.
+type searchMatch struct {
+	name string
+	fi   os.FileInfo
+}
+
+func (WalkSearcher) Search(ctx context.Context, fs FileSystem, q SearchQuery) ([]string, bool, error) {
+	for _, o := range q.OrderBy {
+		if _, ok := searchProps[o.Prop]; !ok {
+			return nil, false, fmt.Errorf("%w: cannot sort by %s %s", ErrNotImplemented, o.Prop.Space, o.Prop.Local)
+		}
+	}
+	fi, err := fs.Stat(ctx, q.Scope)
+	if err != nil {
+		return nil, false, err
+	}
+	var matches []searchMatch
+	walkFn := func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return handlePropfindError(err, info)
+		}
+		if q.Where != nil {
+			ok, err := searchEval(ctx, fs, name, info, q.Where)
+			if err != nil || !ok {
+				return err
+			}
+		}
+		matches = append(matches, searchMatch{name, info})
+		return nil
+	}
+	if err := walkFS(ctx, fs, q.Depth, q.Scope, fi, walkFn); err != nil {
+		return nil, false, err
+	}
+
+	if len(q.OrderBy) > 0 {
+		var sortErr error
+		sort.SliceStable(matches, func(i, j int) bool {
+			for _, o := range q.OrderBy {
+				a, aok, err := searchPropValue(ctx, fs, matches[i].name, matches[i].fi, o.Prop)
+				if err != nil {
+					sortErr = err
+					return false
+				}
+				b, bok, err := searchPropValue(ctx, fs, matches[j].name, matches[j].fi, o.Prop)
+				if err != nil {
+					sortErr = err
+					return false
+				}
+				if aok != bok {
+					// The resources without the property come last.
+					return aok
+				}
+				c := searchCompare(searchProps[o.Prop], a, b, o.CaseSensitive)
+				if c == 0 {
+					continue
+				}
+				return c < 0 != o.Descending
+			}
+			return false
+		})
+		if sortErr != nil {
+			return nil, false, sortErr
+		}
+	}
+
+	truncated := q.Limit > 0 && len(matches) > q.Limit
+	if truncated {
+		matches = matches[:q.Limit]
+	}
+	names := make([]string, len(matches))
+	for i, m := range matches {
+		names[i] = m.name
+	}
+	return names, truncated, nil
+}
+
+// searchPropValue returns the value of the property prop of resource name,
+// and whether it is defined.
+func searchPropValue(ctx context.Context, fs FileSystem, name string, fi os.FileInfo, prop xml.Name) (searchValue, bool, error) {
+	switch prop.Local {
+	case "displayname":
+		return searchValue{s: fi.Name()}, slashClean(name) != "/", nil
+	case "getcontenttype":
+		if fi.IsDir() {
+			return searchValue{}, false, nil
+		}
+		ctype, err := findContentType(ctx, fs, nil, name, fi)
+		return searchValue{s: ctype}, err == nil, nil
+	case "getcontentlength":
+		return searchValue{n: fi.Size()}, !fi.IsDir(), nil
+	default:
+		return searchValue{t: fi.ModTime()}, true, nil
+	}
+}
+
+// parseSearchLiteral parses the literal value of a property of kind k.
+func parseSearchLiteral(k searchKind, literal string) (searchValue, error) {
+	literal = strings.TrimSpace(literal)
+	switch k {
+	case searchInt:
+		n, err := strconv.ParseInt(literal, 10, 64)
+		if err != nil {
+			return searchValue{}, fmt.Errorf("%w: %v", errInvalidSearch, err)
+		}
+		return searchValue{n: n}, nil
+	case searchTime:
+		t, err := http.ParseTime(literal)
+		if err != nil {
+			if t, err = time.Parse(time.RFC3339, literal); err != nil {
+				return searchValue{}, fmt.Errorf("%w: invalid date %q", errInvalidSearch, literal)
+			}
+		}
+		return searchValue{t: t}, nil
+	}
+	return searchValue{s: literal}, nil
+}
+
+// searchCompare returns -1, 0 or 1 depending on whether a is less than,
+// equal to or greater than b.
+func searchCompare(k searchKind, a, b searchValue, caseSensitive bool) int {
+	switch k {
+	case searchInt:
+		switch {
+		case a.n < b.n:
+			return -1
+		case a.n > b.n:
+			return 1
+		}
+		return 0
+	case searchTime:
+		// The dates of the properties have a precision of a second.
+		a, b := a.t.Truncate(time.Second), b.t.Truncate(time.Second)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+		return 0
+	}
+	if !caseSensitive {
+		return strings.Compare(strings.ToLower(a.s), strings.ToLower(b.s))
+	}
+	return strings.Compare(a.s, b.s)
+}
+
+// likePattern returns the regular expression equivalent to the pattern of
+// the DAV:like operator, where "%" matches any sequence of characters, "_"
+// matches any character, and "\" escapes them.
+func likePattern(pattern string, caseSensitive bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?s)")
+	if !caseSensitive {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '%':
+			b.WriteString(".*")
+		case c == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("%w: invalid like pattern %q", errInvalidSearch, pattern)
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// searchEval returns whether resource name matches e.
+func searchEval(ctx context.Context, fs FileSystem, name string, fi os.FileInfo, e *SearchExpr) (bool, error) {
+	switch e.Op {
+	case "and", "or":
+		for _, operand := range e.Operands {
+			ok, err := searchEval(ctx, fs, name, fi, operand)
+			if err != nil {
+				return false, err
+			}
+			if ok == (e.Op == "or") {
+				return ok, nil
+			}
+		}
+		return e.Op == "and", nil
+	case "not":
+		ok, err := searchEval(ctx, fs, name, fi, e.Operands[0])
+		return !ok, err
+	case "is-collection":
+		return fi.IsDir(), nil
+	case "contains":
+		return false, fmt.Errorf("%w: full-text search", ErrNotImplemented)
+	}
+
+	k, ok := searchProps[e.Prop]
+	if !ok {
+		return false, fmt.Errorf("%w: cannot search %s %s", ErrNotImplemented, e.Prop.Space, e.Prop.Local)
+	}
+	v, defined, err := searchPropValue(ctx, fs, name, fi, e.Prop)
+	if err != nil {
+		return false, err
+	}
+	if e.Op == "is-defined" {
+		return defined, nil
+	}
+	if e.Op == "like" {
+		if k != searchString {
+			return false, fmt.Errorf("%w: like needs a string property", errInvalidSearch)
+		}
+		re, err := likePattern(e.Literal, e.CaseSensitive)
+		if err != nil {
+			return false, err
+		}
+		return defined && re.MatchString(v.s), nil
+	}
+	literal, err := parseSearchLiteral(k, e.Literal)
+	if err != nil {
+		return false, err
+	}
+	if !defined {
+		return false, nil
+	}
+	c := searchCompare(k, v, literal, e.CaseSensitive)
+	switch e.Op {
+	case "eq":
+		return c == 0, nil
+	case "lt":
+		return c < 0, nil
+	case "lte":
+		return c <= 0, nil
+	case "gt":
+		return c > 0, nil
+	case "gte":
+		return c >= 0, nil
+	}
+	return false, fmt.Errorf("%w: cannot evaluate %s", ErrNotImplemented, e.Op)
+}
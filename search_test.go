@@ -0,0 +1,160 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	fs, err := buildTestFS([]string{
+		"mkdir /docs",
+		"write /docs/report.txt 12345",
+		"write /docs/Readme.md 1",
+		"mkdir /docs/old",
+		"write /docs/old/report-2019.txt 123",
+		"write /notes.txt 12",
+	})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		Searcher:   WalkSearcher{},
+	}
+	hrefRE := regexp.MustCompile(`<D:href>([^<]*)</D:href>`)
+	search := func(from, where, orderby, limit string) (int, string, []string) {
+		body := `<?xml version="1.0"?>
+<D:searchrequest xmlns:D="DAV:"><D:basicsearch>
+<D:select><D:prop><D:getcontentlength/></D:prop></D:select>
+<D:from>` + from + `</D:from>` + where + orderby + limit + `
+</D:basicsearch></D:searchrequest>`
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("SEARCH", "/", strings.NewReader(body)))
+		var hrefs []string
+		for _, m := range hrefRE.FindAllStringSubmatch(w.Body.String(), -1) {
+			hrefs = append(hrefs, m[1])
+		}
+		return w.Code, w.Body.String(), hrefs
+	}
+	const allDocs = `<D:scope><D:href>/docs</D:href><D:depth>infinity</D:depth></D:scope>`
+	const bySize = `<D:orderby><D:order><D:prop><D:getcontentlength/></D:prop><D:descending/></D:order></D:orderby>`
+
+	testCases := []struct {
+		desc    string
+		from    string
+		where   string
+		orderby string
+		limit   string
+		want    string
+	}{{
+		"all files by size",
+		allDocs,
+		`<D:where><D:not><D:is-collection/></D:not></D:where>`,
+		bySize,
+		"",
+		"/docs/report.txt /docs/old/report-2019.txt /docs/Readme.md",
+	}, {
+		"like ignores the case",
+		allDocs,
+		`<D:where><D:like><D:prop><D:displayname/></D:prop><D:literal>r%</D:literal></D:like></D:where>`,
+		bySize,
+		"",
+		"/docs/report.txt /docs/old/report-2019.txt /docs/Readme.md",
+	}, {
+		"case sensitive like",
+		allDocs,
+		`<D:where><D:like caseless="no"><D:prop><D:displayname/></D:prop><D:literal>report_2019%</D:literal></D:like></D:where>`,
+		"",
+		"",
+		"/docs/old/report-2019.txt",
+	}, {
+		"comparisons",
+		allDocs,
+		`<D:where><D:and>
+			<D:gte><D:prop><D:getcontentlength/></D:prop><D:literal>2</D:literal></D:gte>
+			<D:eq><D:prop><D:getcontenttype/></D:prop><D:literal>TEXT/PLAIN; charset=utf-8</D:literal></D:eq>
+			<D:lt><D:prop><D:getlastmodified/></D:prop><D:literal>Fri, 01 Jan 2100 00:00:00 GMT</D:literal></D:lt>
+		</D:and></D:where>`,
+		bySize,
+		"",
+		"/docs/report.txt /docs/old/report-2019.txt",
+	}, {
+		"depth one",
+		`<D:scope><D:href>docs/</D:href><D:depth>1</D:depth></D:scope>`,
+		`<D:where><D:is-collection/></D:where>`,
+		"",
+		"",
+		"/docs/ /docs/old/",
+	}, {
+		"no match",
+		allDocs,
+		`<D:where><D:gt><D:prop><D:getcontentlength/></D:prop><D:literal>100</D:literal></D:gt></D:where>`,
+		"",
+		"",
+		"",
+	}}
+	for _, tc := range testCases {
+		code, body, hrefs := search(tc.from, tc.where, tc.orderby, tc.limit)
+		if code != StatusMulti {
+			t.Errorf("%s: got status %d %s, want %d", tc.desc, code, body, StatusMulti)
+			continue
+		}
+		if got := strings.Join(hrefs, " "); got != tc.want {
+			t.Errorf("%s: got hrefs %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+
+	code, body, hrefs := search(allDocs, `<D:where><D:not><D:is-collection/></D:not></D:where>`, bySize,
+		`<D:limit><D:nresults>1</D:nresults></D:limit>`)
+	if code != StatusMulti || !strings.Contains(body, "<D:number-of-matches-within-limits/>") {
+		t.Errorf("limit: got %d %s, want a truncated multistatus", code, body)
+	}
+	if got, want := strings.Join(hrefs, " "), "/docs/report.txt /"; got != want {
+		t.Errorf("limit: got hrefs %q, want %q", got, want)
+	}
+
+	errorCases := []struct {
+		desc  string
+		from  string
+		where string
+		want  int
+	}{
+		{"full-text", allDocs, `<D:where><D:contains>foo</D:contains></D:where>`, StatusUnprocessableEntity},
+		{"unknown property", allDocs, `<D:where><D:is-defined><D:prop><D:foo/></D:prop></D:is-defined></D:where>`, StatusUnprocessableEntity},
+		{"invalid literal", allDocs, `<D:where><D:gt><D:prop><D:getcontentlength/></D:prop><D:literal>x</D:literal></D:gt></D:where>`, http.StatusBadRequest},
+		{"missing scope", `<D:scope><D:href>/missing</D:href></D:scope>`, "", http.StatusBadRequest},
+		{"no scope", "", "", http.StatusBadRequest},
+	}
+	for _, tc := range errorCases {
+		if code, body, _ := search(tc.from, tc.where, "", ""); code != tc.want {
+			t.Errorf("%s: got status %d %s, want %d", tc.desc, code, body, tc.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/docs", nil))
+	if got := w.Header().Get("DASL"); got != "<DAV:basicsearch>" {
+		t.Errorf("OPTIONS: got DASL %q, want %q", got, "<DAV:basicsearch>")
+	}
+	if got := w.Header().Get("Allow"); !strings.Contains(got, "SEARCH") {
+		t.Errorf("OPTIONS: got Allow %q, want SEARCH", got)
+	}
+}
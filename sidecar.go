@@ -0,0 +1,341 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SidecarDir is the name of the hidden directories holding the dead
+// properties stored by the PropStore returned by NewSidecarPropStore.
+const SidecarDir = ".davprops"
+
+// sidecarRoot is the sidecar file name of the root directory. It cannot
+// collide with the other sidecar file names, that end with ".json".
+const sidecarRoot = ".root"
+
+// NewSidecarPropStore returns a PropStore that persists the dead properties
+// of the resources served by d as JSON files in SidecarDir directories next
+// to them: the properties of "/a/b" are stored in "/a/.davprops/b.json".
+//
+// The sidecar directories are visible to WebDAV clients unless the Handler
+// FileSystem is wrapped using HideSidecars.
+func NewSidecarPropStore(d Dir) PropStore {
+	return &sidecarPropStore{dir: d}
+}
+
+type sidecarPropStore struct {
+	// mu serializes the read-modify-write cycles of Patch.
+	mu  sync.Mutex
+	dir Dir
+}
+
+// sidecarProperty is the JSON representation of a Property.
+type sidecarProperty struct {
+	Space    string `json:"space"`
+	Local    string `json:"local"`
+	Lang     string `json:"lang,omitempty"`
+	InnerXML string `json:"inner_xml"`
+}
+
+// sidecarPath returns the path of the sidecar file of resource name.
+func (s *sidecarPropStore) sidecarPath(name string) string {
+	name = slashClean(name)
+	if name == "/" {
+		return s.dir.resolve(path.Join("/", SidecarDir, sidecarRoot))
+	}
+	dir, base := path.Split(name)
+	return s.dir.resolve(path.Join(dir, SidecarDir, base+".json"))
+}
+
+func (s *sidecarPropStore) read(file string) (map[xml.Name]Property, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return decodeProps(data)
+}
+
+// encodeProps returns the JSON representation of props.
+func encodeProps(props map[xml.Name]Property) ([]byte, error) {
+	list := make([]sidecarProperty, 0, len(props))
+	for _, p := range props {
+		list = append(list, sidecarProperty{
+			Space:    p.XMLName.Space,
+			Local:    p.XMLName.Local,
+			Lang:     p.Lang,
+			InnerXML: string(p.InnerXML),
+		})
+	}
+	return json.Marshal(list)
+}
+
+// decodeProps parses the JSON representation of properties returned by
+// encodeProps.
+func decodeProps(data []byte) (map[xml.Name]Property, error) {
+	var props []sidecarProperty
+	if err := json.Unmarshal(data, &props); err != nil {
+		return nil, err
+	}
+	ret := make(map[xml.Name]Property, len(props))
+	for _, p := range props {
+		pn := xml.Name{Space: p.Space, Local: p.Local}
+		ret[pn] = Property{XMLName: pn, Lang: p.Lang, InnerXML: []byte(p.InnerXML)}
+	}
+	return ret, nil
+}
+
+// applyPatches applies patches to props and returns the resulting Propstat.
+func applyPatches(props map[xml.Name]Property, patches []Proppatch) Propstat {
+	pstat := Propstat{Status: http.StatusOK}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, Property{XMLName: p.XMLName})
+			if patch.Remove {
+				delete(props, p.XMLName)
+				continue
+			}
+			props[p.XMLName] = p
+		}
+	}
+	return pstat
+}
+
+// write atomically replaces file with props, or removes it if props is
+// empty.
+func (s *sidecarPropStore) write(file string, props map[xml.Name]Property) error {
+	if len(props) == 0 {
+		if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		// Remove the sidecar directory too, if it is now empty.
+		os.Remove(filepath.Dir(file))
+		return nil
+	}
+	data, err := encodeProps(props)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (s *sidecarPropStore) Get(ctx context.Context, name string) (map[xml.Name]Property, error) {
+	file := s.sidecarPath(name)
+	if file == "" {
+		return nil, os.ErrNotExist
+	}
+	return s.read(file)
+}
+
+func (s *sidecarPropStore) Patch(ctx context.Context, name string, patches []Proppatch) ([]Propstat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := s.sidecarPath(name)
+	if file == "" {
+		return nil, os.ErrNotExist
+	}
+	props, err := s.read(file)
+	if err != nil {
+		return nil, err
+	}
+	if props == nil {
+		props = make(map[xml.Name]Property)
+	}
+	pstat := applyPatches(props, patches)
+	if err := s.write(file, props); err != nil {
+		return nil, err
+	}
+	return []Propstat{pstat}, nil
+}
+
+// Delete deletes the sidecar file of resource name. The sidecar files of
+// its descendants are deleted together with the resource, as they are
+// stored inside it.
+func (s *sidecarPropStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := s.sidecarPath(name)
+	if file == "" {
+		return os.ErrNotExist
+	}
+	return s.write(file, nil)
+}
+
+// CopyMove copies or moves the sidecar file of src. The sidecar files of
+// its descendants are moved together with the resource, but they must be
+// copied explicitly if the FileSystem hides them.
+func (s *sidecarPropStore) CopyMove(ctx context.Context, src, dst string, move, recursive bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	srcFile, dstFile := s.sidecarPath(src), s.sidecarPath(dst)
+	if srcFile == "" || dstFile == "" {
+		return os.ErrNotExist
+	}
+	props, err := s.read(srcFile)
+	if err != nil {
+		return err
+	}
+	if err := s.write(dstFile, props); err != nil {
+		return err
+	}
+	if move {
+		return s.write(srcFile, nil)
+	}
+	if !recursive {
+		return nil
+	}
+	srcDir, dstDir := s.dir.resolve(src), s.dir.resolve(dst)
+	return filepath.WalkDir(srcDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || d.Name() != SidecarDir {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dstDir, rel)
+		if _, err := os.Stat(filepath.Dir(target)); err != nil {
+			// The parent resource was not copied.
+			return filepath.SkipDir
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+				continue
+			}
+			props, err := s.read(filepath.Join(p, e.Name()))
+			if err != nil {
+				return err
+			}
+			if err := s.write(filepath.Join(target, e.Name()), props); err != nil {
+				return err
+			}
+		}
+		return filepath.SkipDir
+	})
+}
+
+// HideSidecars returns a FileSystem that hides the SidecarDir directories
+// of fs from WebDAV clients.
+//
+// The returned FileSystem, and the files it opens, implement the FileSystem
+// and File methods only: the optional interfaces of fs, such as AppendFS,
+// QuotaFS, ETagFS, OwnerFS or VersionedFS, and of its files are not
+// forwarded, so the Handler serves it as a plain FileSystem, for example
+// without resumable uploads.
+func HideSidecars(fs FileSystem) FileSystem {
+	return sidecarHidingFS{fs}
+}
+
+type sidecarHidingFS struct {
+	FileSystem
+}
+
+// isSidecar reports whether name is, or is within, a sidecar directory.
+func isSidecar(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == SidecarDir {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs sidecarHidingFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if isSidecar(name) {
+		return os.ErrPermission
+	}
+	return fs.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (fs sidecarHidingFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	if isSidecar(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return sidecarHidingFile{f}, nil
+}
+
+func (fs sidecarHidingFS) RemoveAll(ctx context.Context, name string) error {
+	if isSidecar(name) {
+		return os.ErrNotExist
+	}
+	return fs.FileSystem.RemoveAll(ctx, name)
+}
+
+func (fs sidecarHidingFS) Rename(ctx context.Context, oldName, newName string) error {
+	if isSidecar(oldName) || isSidecar(newName) {
+		return os.ErrNotExist
+	}
+	return fs.FileSystem.Rename(ctx, oldName, newName)
+}
+
+func (fs sidecarHidingFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if isSidecar(name) {
+		return nil, os.ErrNotExist
+	}
+	return fs.FileSystem.Stat(ctx, name)
+}
+
+type sidecarHidingFile struct {
+	File
+}
+
+func (f sidecarHidingFile) Readdir(count int) ([]os.FileInfo, error) {
+	for {
+		fis, err := f.File.Readdir(count)
+		n := len(fis)
+		for i := 0; i < len(fis); i++ {
+			if fis[i].IsDir() && fis[i].Name() == SidecarDir {
+				fis = append(fis[:i], fis[i+1:]...)
+				i--
+			}
+		}
+		// A batch holding only the sidecar directory is read again: an
+		// empty batch must not look like the end of the directory.
+		if len(fis) > 0 || n == 0 || err != nil || count <= 0 {
+			return fis, err
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSidecarPropStore(t *testing.T) {
+	root := t.TempDir()
+	h := &Handler{
+		FileSystem: HideSidecars(Dir(root)),
+		LockSystem: NewMemLS(),
+		PropStore:  NewSidecarPropStore(Dir(root)),
+	}
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	hasColor := func(target string) bool {
+		const propfind = `<D:propfind xmlns:D="DAV:" xmlns:Z="ns"><D:prop><Z:color/></D:prop></D:propfind>`
+		w := do("PROPFIND", target, propfind, "Depth", "0")
+		return strings.Contains(w.Body.String(), ">red</")
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(root, filepath.FromSlash(name)))
+		return err == nil
+	}
+	const proppatch = `<D:propertyupdate xmlns:D="DAV:" xmlns:Z="ns">` +
+		`<D:set><D:prop><Z:color>red</Z:color></D:prop></D:set></D:propertyupdate>`
+
+	do("MKCOL", "/dir", "")
+	do("MKCOL", "/dir/sub", "")
+	do("PUT", "/dir/sub/file", "content")
+	for _, target := range []string{"/", "/dir", "/dir/sub/file"} {
+		if w := do("PROPPATCH", target, proppatch); !strings.Contains(w.Body.String(), "200 OK") {
+			t.Fatalf("PROPPATCH %s: got %s", target, w.Body.String())
+		}
+		if !hasColor(target) {
+			t.Fatalf("PROPFIND %s: missing property", target)
+		}
+	}
+	for _, name := range []string{"/.davprops/.root", "/.davprops/dir.json", "/dir/sub/.davprops/file.json"} {
+		if !exists(name) {
+			t.Fatalf("sidecar %s: not found", name)
+		}
+	}
+
+	w := do("PROPFIND", "/dir/sub", "", "Depth", "1")
+	if strings.Contains(w.Body.String(), SidecarDir) {
+		t.Fatalf("PROPFIND /dir/sub: sidecar directory not hidden: %s", w.Body.String())
+	}
+	f, err := h.FileSystem.OpenFile(context.Background(), "/dir/sub", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		fis, err := f.Readdir(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || len(fis) != 1 {
+			t.Fatalf("Readdir(1): got %v, %v, want one member", fis, err)
+		}
+		names = append(names, fis[0].Name())
+	}
+	f.Close()
+	if len(names) != 1 || names[0] != "file" {
+		t.Fatalf("Readdir(1): got %v, want [file]", names)
+	}
+	if w := do("GET", "/dir/sub/.davprops/file.json", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("GET sidecar: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if w := do("COPY", "/dir", "", "Destination", "/copy"); w.Code != http.StatusCreated {
+		t.Fatalf("COPY: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if !hasColor("/copy") || !hasColor("/copy/sub/file") || !hasColor("/dir/sub/file") {
+		t.Fatalf("COPY: properties not copied")
+	}
+	if w := do("MOVE", "/copy", "", "Destination", "/moved"); w.Code != http.StatusCreated {
+		t.Fatalf("MOVE: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if !hasColor("/moved") || !hasColor("/moved/sub/file") || exists("/.davprops/copy.json") {
+		t.Fatalf("MOVE: properties not moved")
+	}
+	if w := do("DELETE", "/moved", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if exists("/.davprops/moved.json") {
+		t.Fatalf("DELETE: sidecar not deleted")
+	}
+}
+
+func TestHideSidecarsOptionalInterfaces(t *testing.T) {
+	fs := HideSidecars(Dir(t.TempDir()))
+	if _, ok := fs.(AppendFS); ok {
+		t.Error("HideSidecars: got an AppendFS, want a plain FileSystem")
+	}
+	if _, ok := fs.(Chmoder); ok {
+		t.Error("HideSidecars: got a Chmoder, want a plain FileSystem")
+	}
+	if _, ok := fs.(OverwritingFS); ok {
+		t.Error("HideSidecars: got an OverwritingFS, want a plain FileSystem")
+	}
+
+	// Without an AppendFS the resumable uploads are not advertised.
+	h := &Handler{
+		FileSystem:       fs,
+		LockSystem:       NewMemLS(),
+		ResumableUploads: &ResumableUploads{},
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("OPTIONS: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("Tus-Version"); got != "" {
+		t.Errorf("OPTIONS: got Tus-Version %q, want none", got)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// SQLPropStoreConfig configures the PropStore returned by NewSQLPropStore.
+type SQLPropStoreConfig struct {
+	// Table is the name of the table holding the dead properties,
+	// "webdav_props" if empty. The schema version is recorded in the table
+	// with the same name and the "_version" suffix.
+	Table string
+	// Placeholder returns the placeholder of the n-th argument of a query,
+	// starting from 1. If nil, "?" is used, as required by SQLite and MySQL.
+	// PostgreSQL requires "$n".
+	Placeholder func(n int) string
+}
+
+// sqlPropStoreMigrations are the statements creating and upgrading the
+// schema, one for each version. The %s verb is replaced by the table name.
+//
+// Databases that can't use these column types, for example because of
+// limits on the length of primary keys, can create the table beforehand
+// with the same column names.
+var sqlPropStoreMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS %s (
+	path VARCHAR(1024) NOT NULL,
+	space VARCHAR(255) NOT NULL,
+	local VARCHAR(255) NOT NULL,
+	lang VARCHAR(64) NOT NULL,
+	inner_xml TEXT NOT NULL,
+	PRIMARY KEY (path, space, local)
+)`,
+}
+
+// NewSQLPropStore returns a PropStore that persists the dead properties in
+// the database db, one row for each property, so that they are consistent
+// across the instances serving the same files from a shared storage.
+//
+// The schema is created or upgraded if needed. PROPPATCH requests are
+// applied in a single transaction and the properties of a moved collection
+// are renamed by path prefix.
+func NewSQLPropStore(ctx context.Context, db *sql.DB, config SQLPropStoreConfig) (PropStore, error) {
+	s := &sqlPropStore{
+		db:          db,
+		table:       config.Table,
+		placeholder: config.Placeholder,
+	}
+	if s.table == "" {
+		s.table = "webdav_props"
+	}
+	if s.placeholder == nil {
+		s.placeholder = func(int) string { return "?" }
+	}
+	if err := s.migrate(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type sqlPropStore struct {
+	db          *sql.DB
+	table       string
+	placeholder func(n int) string
+}
+
+// sqlProp is a row of the properties table.
+type sqlProp struct {
+	path     string
+	space    string
+	local    string
+	lang     string
+	innerXML string
+}
+
+func (s *sqlPropStore) migrate(ctx context.Context) error {
+	versionTable := s.table + "_version"
+	if _, err := s.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+versionTable+" (version INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		version, exists := 0, true
+		err := tx.QueryRowContext(ctx, "SELECT version FROM "+versionTable).Scan(&version)
+		if errors.Is(err, sql.ErrNoRows) {
+			exists = false
+		} else if err != nil {
+			return err
+		}
+		if version < 0 || version > len(sqlPropStoreMigrations) {
+			return fmt.Errorf("webdav: unsupported property store schema version %d", version)
+		}
+		if version == len(sqlPropStoreMigrations) {
+			return nil
+		}
+		for _, m := range sqlPropStoreMigrations[version:] {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(m, s.table)); err != nil {
+				return err
+			}
+		}
+		q := "INSERT INTO " + versionTable + " (version) VALUES (" + s.placeholder(1) + ")"
+		if exists {
+			q = "UPDATE " + versionTable + " SET version = " + s.placeholder(1)
+		}
+		_, err = tx.ExecContext(ctx, q, len(sqlPropStoreMigrations))
+		return err
+	})
+}
+
+// inTx runs fn in a transaction, that is committed if fn succeeds and
+// rolled back otherwise.
+func (s *sqlPropStore) inTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// where returns the condition selecting the rows of name and, if recursive
+// is true, of its descendants, and its arguments.
+func (s *sqlPropStore) where(name string, recursive bool) (string, []any) {
+	if !recursive {
+		return "path = " + s.placeholder(1), []any{name}
+	}
+	prefix := name
+	if prefix != "/" {
+		prefix += "/"
+	}
+	r := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return "path = " + s.placeholder(1) + " OR path LIKE " + s.placeholder(2) + " ESCAPE '!'",
+		[]any{name, r.Replace(prefix) + "%"}
+}
+
+func (s *sqlPropStore) Get(ctx context.Context, name string) (map[xml.Name]Property, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT space, local, lang, inner_xml FROM "+s.table+
+		" WHERE path = "+s.placeholder(1), slashClean(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var props map[xml.Name]Property
+	for rows.Next() {
+		var p sqlProp
+		if err := rows.Scan(&p.space, &p.local, &p.lang, &p.innerXML); err != nil {
+			return nil, err
+		}
+		if props == nil {
+			props = make(map[xml.Name]Property)
+		}
+		pn := xml.Name{Space: p.space, Local: p.local}
+		props[pn] = Property{XMLName: pn, Lang: p.lang, InnerXML: []byte(p.innerXML)}
+	}
+	return props, rows.Err()
+}
+
+func (s *sqlPropStore) Patch(ctx context.Context, name string, patches []Proppatch) ([]Propstat, error) {
+	name = slashClean(name)
+	pstat := Propstat{Status: http.StatusOK}
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		del, err := tx.PrepareContext(ctx, "DELETE FROM "+s.table+" WHERE path = "+s.placeholder(1)+
+			" AND space = "+s.placeholder(2)+" AND local = "+s.placeholder(3))
+		if err != nil {
+			return err
+		}
+		defer del.Close()
+		ins, err := tx.PrepareContext(ctx, s.insertQuery())
+		if err != nil {
+			return err
+		}
+		defer ins.Close()
+
+		for _, patch := range patches {
+			for _, p := range patch.Props {
+				pstat.Props = append(pstat.Props, Property{XMLName: p.XMLName})
+				if _, err := del.ExecContext(ctx, name, p.XMLName.Space, p.XMLName.Local); err != nil {
+					return err
+				}
+				if patch.Remove {
+					continue
+				}
+				if _, err := ins.ExecContext(ctx, name, p.XMLName.Space, p.XMLName.Local, p.Lang, string(p.InnerXML)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []Propstat{pstat}, nil
+}
+
+func (s *sqlPropStore) insertQuery() string {
+	return "INSERT INTO " + s.table + " (path, space, local, lang, inner_xml) VALUES (" +
+		s.placeholder(1) + ", " + s.placeholder(2) + ", " + s.placeholder(3) + ", " +
+		s.placeholder(4) + ", " + s.placeholder(5) + ")"
+}
+
+func (s *sqlPropStore) deleteTree(ctx context.Context, tx *sql.Tx, name string, recursive bool) error {
+	where, args := s.where(name, recursive)
+	_, err := tx.ExecContext(ctx, "DELETE FROM "+s.table+" WHERE "+where, args...)
+	return err
+}
+
+func (s *sqlPropStore) Delete(ctx context.Context, name string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.deleteTree(ctx, tx, slashClean(name), true)
+	})
+}
+
+func (s *sqlPropStore) CopyMove(ctx context.Context, src, dst string, move, recursive bool) error {
+	src, dst = slashClean(src), slashClean(dst)
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		where, args := s.where(src, recursive)
+		rows, err := tx.QueryContext(ctx, "SELECT path, space, local, lang, inner_xml FROM "+s.table+
+			" WHERE "+where, args...)
+		if err != nil {
+			return err
+		}
+		var props []sqlProp
+		for rows.Next() {
+			var p sqlProp
+			if err := rows.Scan(&p.path, &p.space, &p.local, &p.lang, &p.innerXML); err != nil {
+				rows.Close()
+				return err
+			}
+			props = append(props, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if move {
+			if err := s.deleteTree(ctx, tx, src, recursive); err != nil {
+				return err
+			}
+		}
+		if err := s.deleteTree(ctx, tx, dst, recursive); err != nil {
+			return err
+		}
+		if len(props) == 0 {
+			return nil
+		}
+		ins, err := tx.PrepareContext(ctx, s.insertQuery())
+		if err != nil {
+			return err
+		}
+		defer ins.Close()
+		for _, p := range props {
+			if _, err := ins.ExecContext(ctx, path.Join(dst, strings.TrimPrefix(p.path, src)), p.space, p.local, p.lang, p.innerXML); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,343 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/xml"
+	"errors"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSQLDriver is a database/sql driver understanding just the queries
+// issued by sqlPropStore. Each data source name is a separate database.
+type fakeSQLDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*fakeSQLDB
+}
+
+var fakeSQL = &fakeSQLDriver{dbs: make(map[string]*fakeSQLDB)}
+
+func init() {
+	sql.Register("webdav-fake", fakeSQL)
+}
+
+type fakeSQLDB struct {
+	mu      sync.Mutex
+	version []int64
+	rows    []sqlProp
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dbs[name] == nil {
+		d.dbs[name] = &fakeSQLDB{}
+	}
+	return &fakeSQLConn{db: d.dbs[name]}, nil
+}
+
+type fakeSQLConn struct {
+	db *fakeSQLDB
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeSQLConn) Close() error { return nil }
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return &fakeSQLTx{
+		db:      c.db,
+		version: append([]int64(nil), c.db.version...),
+		rows:    append([]sqlProp(nil), c.db.rows...),
+	}, nil
+}
+
+// fakeSQLTx restores the state of the database at the beginning of the
+// transaction on rollback.
+type fakeSQLTx struct {
+	db      *fakeSQLDB
+	version []int64
+	rows    []sqlProp
+}
+
+func (tx *fakeSQLTx) Commit() error { return nil }
+
+func (tx *fakeSQLTx) Rollback() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.version, tx.db.rows = tx.version, tx.rows
+	return nil
+}
+
+type fakeSQLStmt struct {
+	db    *fakeSQLDB
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	q := s.query
+	switch {
+	case strings.HasPrefix(q, "CREATE TABLE"):
+	case strings.HasPrefix(q, "INSERT INTO webdav_props_version"):
+		s.db.version = append(s.db.version, args[0].(int64))
+	case strings.HasPrefix(q, "UPDATE webdav_props_version"):
+		for i := range s.db.version {
+			s.db.version[i] = args[0].(int64)
+		}
+	case strings.HasPrefix(q, "INSERT INTO webdav_props "):
+		p := sqlProp{args[0].(string), args[1].(string), args[2].(string), args[3].(string), args[4].(string)}
+		if p.innerXML == "fail" {
+			return nil, errors.New("insert failed")
+		}
+		for _, r := range s.db.rows {
+			if r.path == p.path && r.space == p.space && r.local == p.local {
+				return nil, errors.New("duplicate primary key")
+			}
+		}
+		s.db.rows = append(s.db.rows, p)
+	case strings.HasPrefix(q, "DELETE FROM webdav_props WHERE path = ? AND space = ? AND local = ?"):
+		s.db.filter(func(p sqlProp) bool {
+			return p.path == args[0] && p.space == args[1] && p.local == args[2]
+		})
+	case strings.HasPrefix(q, "DELETE FROM webdav_props WHERE "):
+		s.db.filter(func(p sqlProp) bool { return fakeSQLMatch(p, args) })
+	default:
+		return nil, errors.New("unsupported query: " + q)
+	}
+	return driver.ResultNoRows, nil
+}
+
+func (db *fakeSQLDB) filter(remove func(sqlProp) bool) {
+	rows := db.rows[:0:0]
+	for _, p := range db.rows {
+		if !remove(p) {
+			rows = append(rows, p)
+		}
+	}
+	db.rows = rows
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	q := s.query
+	rows := &fakeSQLRows{}
+	switch {
+	case strings.HasPrefix(q, "SELECT version FROM webdav_props_version"):
+		rows.cols = []string{"version"}
+		for _, v := range s.db.version {
+			rows.vals = append(rows.vals, []driver.Value{v})
+		}
+	case strings.HasPrefix(q, "SELECT space, local, lang, inner_xml FROM webdav_props WHERE path = ?"):
+		rows.cols = []string{"space", "local", "lang", "inner_xml"}
+		for _, p := range s.db.rows {
+			if p.path == args[0] {
+				rows.vals = append(rows.vals, []driver.Value{p.space, p.local, p.lang, p.innerXML})
+			}
+		}
+	case strings.HasPrefix(q, "SELECT path, space, local, lang, inner_xml FROM webdav_props WHERE "):
+		rows.cols = []string{"path", "space", "local", "lang", "inner_xml"}
+		for _, p := range s.db.rows {
+			if fakeSQLMatch(p, args) {
+				rows.vals = append(rows.vals, []driver.Value{p.path, p.space, p.local, p.lang, p.innerXML})
+			}
+		}
+	default:
+		return nil, errors.New("unsupported query: " + q)
+	}
+	return rows, nil
+}
+
+// fakeSQLMatch evaluates the conditions returned by sqlPropStore.where.
+func fakeSQLMatch(p sqlProp, args []driver.Value) bool {
+	if p.path == args[0] {
+		return true
+	}
+	if len(args) < 2 {
+		return false
+	}
+	var re strings.Builder
+	re.WriteString("^")
+	pattern := args[1].(string)
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '!':
+			i++
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '%':
+			re.WriteString(".*")
+		case '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.MustCompile(re.String()).MatchString(p.path)
+}
+
+type fakeSQLRows struct {
+	cols []string
+	vals [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return r.cols }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.vals) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.vals[0])
+	r.vals = r.vals[1:]
+	return nil
+}
+
+func TestSQLPropStore(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("webdav-fake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ps, err := NewSQLPropStore(ctx, db, SQLPropStoreConfig{})
+	if err != nil {
+		t.Fatalf("NewSQLPropStore: %v", err)
+	}
+	// Opening an up to date schema again is a no-op.
+	if _, err := NewSQLPropStore(ctx, db, SQLPropStoreConfig{}); err != nil {
+		t.Fatalf("NewSQLPropStore again: %v", err)
+	}
+	if v := fakeSQL.dbs[t.Name()].version; !reflect.DeepEqual(v, []int64{1}) {
+		t.Fatalf("schema version: got %v, want [1]", v)
+	}
+
+	p := func(v string) Property {
+		return Property{XMLName: xml.Name{Space: "ns", Local: "p"}, InnerXML: []byte(v)}
+	}
+	for _, name := range []string{"/a", "/a/b", "/a/b/c", "/ab", "/d", "/e_f", "/e_f/g", "/exf/g"} {
+		if _, err := ps.Patch(ctx, name, []Proppatch{{Props: []Property{p(name)}}}); err != nil {
+			t.Fatalf("Patch %q: %v", name, err)
+		}
+	}
+	names := func() []string {
+		var ret []string
+		for _, p := range fakeSQL.dbs[t.Name()].rows {
+			ret = append(ret, p.path+"="+p.innerXML)
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	testCases := []struct {
+		desc    string
+		op      func() error
+		wantErr bool
+		want    []string
+	}{{
+		desc: "copy depth 0",
+		op:   func() error { return ps.CopyMove(ctx, "/a", "/x", false, false) },
+		want: []string{"/a/b/c=/a/b/c", "/a/b=/a/b", "/a=/a", "/ab=/ab", "/d=/d",
+			"/e_f/g=/e_f/g", "/e_f=/e_f", "/exf/g=/exf/g", "/x=/a"},
+	}, {
+		desc: "copy replacing the destination",
+		op:   func() error { return ps.CopyMove(ctx, "/a/b", "/x", false, true) },
+		want: []string{"/a/b/c=/a/b/c", "/a/b=/a/b", "/a=/a", "/ab=/ab", "/d=/d",
+			"/e_f/g=/e_f/g", "/e_f=/e_f", "/exf/g=/exf/g", "/x/c=/a/b/c", "/x=/a/b"},
+	}, {
+		desc: "move",
+		op:   func() error { return ps.CopyMove(ctx, "/a", "/y", true, true) },
+		want: []string{"/ab=/ab", "/d=/d", "/e_f/g=/e_f/g", "/e_f=/e_f", "/exf/g=/exf/g",
+			"/x/c=/a/b/c", "/x=/a/b", "/y/b/c=/a/b/c", "/y/b=/a/b", "/y=/a"},
+	}, {
+		desc: "delete",
+		op:   func() error { return ps.Delete(ctx, "/y") },
+		want: []string{"/ab=/ab", "/d=/d", "/e_f/g=/e_f/g", "/e_f=/e_f", "/exf/g=/exf/g",
+			"/x/c=/a/b/c", "/x=/a/b"},
+	}, {
+		desc: "delete escaping wildcards",
+		op:   func() error { return ps.Delete(ctx, "/e_f") },
+		want: []string{"/ab=/ab", "/d=/d", "/exf/g=/exf/g", "/x/c=/a/b/c", "/x=/a/b"},
+	}, {
+		desc: "replace and remove",
+		op: func() error {
+			_, err := ps.Patch(ctx, "/d", []Proppatch{
+				{Props: []Property{p("new")}},
+				{Remove: true, Props: []Property{p("")}},
+			})
+			return err
+		},
+		want: []string{"/ab=/ab", "/exf/g=/exf/g", "/x/c=/a/b/c", "/x=/a/b"},
+	}, {
+		desc: "failed patch is rolled back",
+		op: func() error {
+			q := Property{XMLName: xml.Name{Space: "ns", Local: "q"}, InnerXML: []byte("fail")}
+			_, err := ps.Patch(ctx, "/ab", []Proppatch{
+				{Remove: true, Props: []Property{p("")}},
+				{Props: []Property{q}},
+			})
+			return err
+		},
+		wantErr: true,
+		want:    []string{"/ab=/ab", "/exf/g=/exf/g", "/x/c=/a/b/c", "/x=/a/b"},
+	}, {
+		desc: "copy the root",
+		op:   func() error { return ps.CopyMove(ctx, "/", "/r", false, true) },
+		want: []string{"/ab=/ab", "/exf/g=/exf/g", "/r/ab=/ab", "/r/exf/g=/exf/g",
+			"/r/x/c=/a/b/c", "/r/x=/a/b", "/x/c=/a/b/c", "/x=/a/b"},
+	}}
+
+	for _, tc := range testCases {
+		if err := tc.op(); (err != nil) != tc.wantErr {
+			t.Fatalf("%s: got error %v, want error %t", tc.desc, err, tc.wantErr)
+		}
+		if got := names(); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s:\ngot  %q\nwant %q", tc.desc, got, tc.want)
+		}
+	}
+
+	props, err := ps.Get(ctx, "/x")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if want := map[xml.Name]Property{p("").XMLName: p("/a/b")}; !reflect.DeepEqual(props, want) {
+		t.Fatalf("Get:\ngot  %v\nwant %v", props, want)
+	}
+
+	fakeSQL.dbs[t.Name()].version = []int64{2}
+	if _, err := NewSQLPropStore(ctx, db, SQLPropStoreConfig{}); err == nil {
+		t.Fatalf("NewSQLPropStore with a newer schema: got nil error, want non-nil")
+	}
+}
@@ -0,0 +1,474 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ixml "github.com/drakkan/webdav/internal/xml"
+)
+
+var (
+	syncCollectionReportName = xml.Name{Space: "DAV:", Local: "sync-collection"}
+	syncTokenPropName        = xml.Name{Space: "DAV:", Local: "sync-token"}
+)
+
+// ErrInvalidSyncToken is returned by a SyncTokenFS for the sync tokens it
+// doesn't know, or no longer has the changes of.
+var ErrInvalidSyncToken = errors.New("webdav: invalid sync token")
+
+// SyncChange is a change of a member of a collection.
+type SyncChange struct {
+	// Name is the name of the changed resource.
+	Name string
+	// Removed is whether the resource has been removed, or renamed.
+	Removed bool
+}
+
+// SyncTokenFS is an optional interface for the FileSystem, journaling the
+// changes of collections so that sync clients, such as DAVx5 and Nextcloud,
+// can synchronize them incrementally with the sync-collection REPORT defined
+// by RFC 6578, instead of listing them with PROPFIND. The sync token of a
+// collection is reported by the DAV:sync-token property.
+//
+// NewSyncFS adds an in-memory journal to any FileSystem.
+type SyncTokenFS interface {
+	// SyncToken returns the current sync token of collection name, which is
+	// a URI.
+	SyncToken(ctx context.Context, name string) (string, error)
+	// Changes returns the changes of the members of collection name since
+	// token was returned, and the current sync token. depth is 1 for the
+	// immediate members or -1 for all of them. It returns
+	// ErrInvalidSyncToken if token is unknown or too old.
+	Changes(ctx context.Context, name, token string, depth int) (changes []SyncChange, newToken string, err error)
+}
+
+func supportsSyncToken(fs FileSystem, fi os.FileInfo) bool {
+	_, ok := fs.(SyncTokenFS)
+	return ok && fi.IsDir()
+}
+
+func findSyncToken(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	token, err := fs.(SyncTokenFS).SyncToken(ctx, name)
+	return escapeXML(token), err
+}
+
+// maxSyncJournal is the number of changes remembered by the FileSystems
+// returned by NewSyncFS.
+const maxSyncJournal = 10000
+
+// NewSyncFS returns a FileSystem implementing SyncTokenFS on top of fs. It
+// journals the changes made through it in memory, so its sync tokens are
+// invalidated when the process restarts, and when they are older than the
+// last 10000 changes. Changes made to fs directly are not tracked, nor are
+// the changes of dead properties.
+//
+// The removal or the renaming of a collection is reported as the removal of
+// the collection itself, not of each of its members, and likewise its
+// creation at the destination of a rename.
+func NewSyncFS(fs FileSystem) FileSystem {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &syncFS{
+		FileSystem: fs,
+		prefix:     "urn:x-webdav-sync:" + hex.EncodeToString(id) + ":",
+		since:      time.Now(),
+	}
+}
+
+type syncFS struct {
+	FileSystem
+	// prefix is the prefix of the sync tokens, which end with the sequence
+	// number of the last change they include.
+	prefix string
+
+	mu sync.Mutex
+	// seq is the sequence number of the last change.
+	seq uint64
+	// journal are the last changes, journal[i] has the sequence number
+	// seq-len(journal)+i+1.
+	journal []syncEntry
+	// since is the time of the oldest state reachable from the journal:
+	// the creation of the syncFS, or the last change dropped from the
+	// journal.
+	since time.Time
+}
+
+// syncEntry is a journaled change.
+type syncEntry struct {
+	SyncChange
+	// created is whether the change created the resource.
+	created bool
+	// time is when the change was made.
+	time time.Time
+}
+
+// record journals the changes.
+func (fs *syncFS) record(changes ...syncEntry) {
+	now := time.Now()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, c := range changes {
+		c.Name = slashClean(c.Name)
+		c.time = now
+		fs.seq++
+		fs.journal = append(fs.journal, c)
+	}
+	if n := len(fs.journal) - maxSyncJournal; n > 0 {
+		fs.since = fs.journal[n-1].time
+		fs.journal = append(fs.journal[:0:0], fs.journal[n:]...)
+	}
+}
+
+func (fs *syncFS) SyncToken(ctx context.Context, name string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.token(fs.seq), nil
+}
+
+func (fs *syncFS) Changes(ctx context.Context, name, token string, depth int) ([]SyncChange, string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	from, err := fs.parseToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	entries := fs.collect(name, from, fs.seq, depth)
+	changes := make([]SyncChange, 0, len(entries))
+	for _, c := range entries {
+		// The resources both created and removed since token, such as the
+		// temporary files of uploads, are unknown to the client.
+		if !c.Removed || !c.created {
+			changes = append(changes, c.SyncChange)
+		}
+	}
+	return changes, fs.token(fs.seq), nil
+}
+
+func (fs *syncFS) Diff(ctx context.Context, name, from, to string, depth int) (*ListingDiff, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fromSeq, err := fs.parseToken(from)
+	if err != nil {
+		return nil, err
+	}
+	toSeq := fs.seq
+	if to != "" {
+		if toSeq, err = fs.parseToken(to); err != nil {
+			return nil, err
+		}
+	}
+	if toSeq < fromSeq {
+		return nil, ErrInvalidSyncToken
+	}
+	diff := &ListingDiff{From: from, To: fs.token(toSeq)}
+	for _, c := range fs.collect(name, fromSeq, toSeq, depth) {
+		switch {
+		case c.Removed && !c.created:
+			diff.Removed = append(diff.Removed, c.Name)
+		case c.Removed:
+		case c.created:
+			diff.Added = append(diff.Added, c.Name)
+		default:
+			diff.Modified = append(diff.Modified, c.Name)
+		}
+	}
+	return diff, nil
+}
+
+func (fs *syncFS) SyncTokenAt(ctx context.Context, name string, t time.Time) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if t.Before(fs.since) {
+		return "", ErrInvalidSyncToken
+	}
+	// The state at t includes the changes made up to t.
+	i := sort.Search(len(fs.journal), func(i int) bool {
+		return fs.journal[i].time.After(t)
+	})
+	return fs.token(fs.seq - uint64(len(fs.journal)-i)), nil
+}
+
+// token returns the sync token of the state after the change with sequence
+// number seq.
+func (fs *syncFS) token(seq uint64) string {
+	return fs.prefix + strconv.FormatUint(seq, 10)
+}
+
+// parseToken returns the sequence number of token, which must still be in
+// the journal. The caller must hold fs.mu.
+func (fs *syncFS) parseToken(token string) (uint64, error) {
+	seq, err := strconv.ParseUint(strings.TrimPrefix(token, fs.prefix), 10, 64)
+	if err != nil || !strings.HasPrefix(token, fs.prefix) {
+		return 0, ErrInvalidSyncToken
+	}
+	if seq > fs.seq || seq < fs.seq-uint64(len(fs.journal)) {
+		return 0, ErrInvalidSyncToken
+	}
+	return seq, nil
+}
+
+// collect returns the last change of each member of collection name made
+// after the change with sequence number from, up to the one with sequence
+// number to, in the order of their first change. The created field of the
+// changes is whether their first change created them. The caller must hold
+// fs.mu.
+func (fs *syncFS) collect(name string, from, to uint64, depth int) []syncEntry {
+	first := fs.seq - uint64(len(fs.journal))
+	name = slashClean(name)
+	var changes []syncEntry
+	// index maps the names to their position in changes, so that only the
+	// last change of each resource is reported.
+	index := make(map[string]int)
+	for _, c := range fs.journal[from-first : to-first] {
+		if c.Name == name || !isWithin(c.Name, name) {
+			continue
+		}
+		if depth != infiniteDepth && path.Dir(c.Name) != name {
+			continue
+		}
+		if i, ok := index[c.Name]; ok {
+			changes[i].SyncChange = c.SyncChange
+			changes[i].time = c.time
+			continue
+		}
+		index[c.Name] = len(changes)
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+func (fs *syncFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := fs.FileSystem.Mkdir(ctx, name, perm); err != nil {
+		return err
+	}
+	fs.record(syncEntry{SyncChange: SyncChange{Name: name}, created: true})
+	return nil
+}
+
+// exists reports whether name exists.
+func (fs *syncFS) exists(ctx context.Context, name string) bool {
+	_, err := fs.FileSystem.Stat(ctx, name)
+	return !os.IsNotExist(err)
+}
+
+func (fs *syncFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0 || IsUploadName(name) {
+		// The temporary files of uploads are only journaled once renamed
+		// over the uploaded file.
+		return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	}
+	created := flag&os.O_CREATE != 0 && !fs.exists(ctx, name)
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	// The change is recorded on close, so that the clients syncing after it
+	// get the new content.
+	return &syncFile{File: f, fs: fs, name: name, created: created}, nil
+}
+
+func (fs *syncFS) RemoveAll(ctx context.Context, name string) error {
+	if err := fs.FileSystem.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+	if !IsUploadName(name) {
+		fs.record(syncEntry{SyncChange: SyncChange{Name: name, Removed: true}})
+	}
+	return nil
+}
+
+func (fs *syncFS) Rename(ctx context.Context, oldName, newName string) error {
+	created := !fs.exists(ctx, newName)
+	if err := fs.FileSystem.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	if IsUploadName(oldName) {
+		fs.record(syncEntry{SyncChange: SyncChange{Name: newName}, created: created})
+		return nil
+	}
+	fs.record(syncEntry{SyncChange: SyncChange{Name: oldName, Removed: true}}, syncEntry{SyncChange: SyncChange{Name: newName}, created: created})
+	return nil
+}
+
+type syncFile struct {
+	File
+	fs      *syncFS
+	name    string
+	created bool
+}
+
+func (f *syncFile) Close() error {
+	err := f.File.Close()
+	f.fs.record(syncEntry{SyncChange: SyncChange{Name: f.name}, created: f.created})
+	return err
+}
+
+// syncCollection is the body of a sync-collection REPORT.
+// See RFC 6578 section 6.1.
+type syncCollection struct {
+	XMLName   ixml.Name     `xml:"DAV: sync-collection"`
+	SyncToken string        `xml:"DAV: sync-token"`
+	SyncLevel string        `xml:"DAV: sync-level"`
+	Limit     *syncLimit    `xml:"DAV: limit"`
+	Prop      propfindProps `xml:"DAV: prop"`
+}
+
+type syncLimit struct {
+	NResults string `xml:"DAV: nresults"`
+}
+
+// writeXMLError writes a response with status and an RFC 4918 DAV:error body
+// with the precondition or postcondition code.
+func writeXMLError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><D:error xmlns:D="DAV:"><D:%s/></D:error>`, code)
+}
+
+// syncCollectionReport serves the sync-collection REPORT, defined by RFC
+// 6578 section 3.2.
+func (h *Handler) syncCollectionReport(ctx context.Context, w http.ResponseWriter, r *http.Request, report Report) error {
+	sfs, ok := h.FileSystem.(SyncTokenFS)
+	if !ok {
+		return os.ErrPermission
+	}
+	var sc syncCollection
+	if err := ixml.NewDecoder(bytes.NewReader(report.Body)).Decode(&sc); err != nil || sc.Prop == nil {
+		return ErrInvalidReport
+	}
+	if report.Depth != 0 {
+		return ErrInvalidReport
+	}
+	depth := 1
+	switch sc.SyncLevel = strings.TrimSpace(sc.SyncLevel); sc.SyncLevel {
+	case "1":
+	case "infinite":
+		depth = infiniteDepth
+	default:
+		return ErrInvalidReport
+	}
+	limit := 0
+	if sc.Limit != nil {
+		n, err := strconv.Atoi(strings.TrimSpace(sc.Limit.NResults))
+		if err != nil || n <= 0 {
+			return ErrInvalidReport
+		}
+		limit = n
+	}
+	fi, err := h.FileSystem.Stat(ctx, report.Name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return ErrInvalidReport
+	}
+
+	var changes []SyncChange
+	var token string
+	if sc.SyncToken = strings.TrimSpace(sc.SyncToken); sc.SyncToken == "" {
+		// The initial synchronization lists all the members.
+		if token, err = sfs.SyncToken(ctx, report.Name); err != nil {
+			return err
+		}
+		walkFn := func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return handlePropfindError(err, info)
+			}
+			if name != report.Name {
+				changes = append(changes, SyncChange{Name: name})
+			}
+			return nil
+		}
+		if err := walkFS(ctx, h.FileSystem, depth, report.Name, fi, walkFn); err != nil {
+			return err
+		}
+	} else {
+		changes, token, err = sfs.Changes(ctx, report.Name, sc.SyncToken, depth)
+		if errors.Is(err, ErrInvalidSyncToken) {
+			writeXMLError(w, http.StatusForbidden, "valid-sync-token")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if limit > 0 && len(changes) > limit {
+		// There is no way to resume truncated results from a sync token.
+		writeXMLError(w, http.StatusInsufficientStorage, "number-of-matches-within-limits")
+		return nil
+	}
+
+	mw := multistatusWriter{w: w, canonical: h.CanonicalXML, syncToken: token, ctx: ctx}
+	writeErr := func() error {
+		// The response is a multistatus even if nothing changed.
+		if err := mw.writeHeader(); err != nil {
+			return err
+		}
+		for _, c := range changes {
+			href := path.Join(h.Prefix, c.Name)
+			var info os.FileInfo
+			if !c.Removed {
+				var err error
+				if info, err = h.FileSystem.Stat(ctx, c.Name); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			if info == nil {
+				resp := &response{
+					Href:   []string{hrefPath(href)},
+					Status: fmt.Sprintf("HTTP/1.1 %d %s", http.StatusNotFound, StatusText(http.StatusNotFound)),
+				}
+				if err := mw.write(resp); err != nil {
+					return err
+				}
+				continue
+			}
+			if info.IsDir() && !strings.HasSuffix(href, "/") {
+				href += "/"
+			}
+			pstats, err := props(ctx, h.FileSystem, h.LockSystem, h.PropStore, c.Name, sc.Prop, info)
+			if err != nil {
+				return err
+			}
+			if err := mw.write(makePropstatResponse(href, pstats)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if h.listingAborted(r, &mw, writeErr) {
+		return nil
+	}
+	closeErr := mw.close()
+	if writeErr != nil {
+		return writeErr
+	}
+	return closeErr
+}
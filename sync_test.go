@@ -0,0 +1,112 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSyncCollection(t *testing.T) {
+	mem, err := buildTestFS([]string{
+		"mkdir /dir",
+		"write /dir/a 1",
+		"write /dir/b 2",
+		"mkdir /dir/sub",
+		"write /dir/sub/c 3",
+	})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem: NewSyncFS(mem),
+		LockSystem: NewMemLS(),
+	}
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	tokenRE := regexp.MustCompile(`<D:sync-token>([^<]*)</D:sync-token>`)
+	responseRE := regexp.MustCompile(`<D:href>([^<]*)</D:href>(?:<D:propstat>.*?</D:propstat>)?(?:<D:status>HTTP/1.1 (\d+))?`)
+	sync := func(token, level string) (code int, responses []string, newToken string) {
+		body := `<D:sync-collection xmlns:D="DAV:"><D:sync-token>` + token + `</D:sync-token>` +
+			`<D:sync-level>` + level + `</D:sync-level><D:prop><D:getetag/></D:prop></D:sync-collection>`
+		w := do("REPORT", "/dir", body)
+		for _, m := range responseRE.FindAllStringSubmatch(w.Body.String(), -1) {
+			if m[2] == "404" {
+				m[1] += " removed"
+			}
+			responses = append(responses, m[1])
+		}
+		if m := tokenRE.FindStringSubmatch(w.Body.String()); m != nil {
+			newToken = m[1]
+		}
+		return w.Code, responses, newToken
+	}
+
+	code, responses, token := sync("", "1")
+	if code != StatusMulti || token == "" {
+		t.Fatalf("initial sync: got status %d and token %q, want %d and a token", code, token, StatusMulti)
+	}
+	if got, want := strings.Join(responses, " "), "/dir/a /dir/b /dir/sub/"; got != want {
+		t.Errorf("initial sync: got %q, want %q", got, want)
+	}
+	w := do("PROPFIND", "/dir", `<D:propfind xmlns:D="DAV:"><D:prop><D:sync-token/></D:prop></D:propfind>`, "Depth", "0")
+	if !strings.Contains(w.Body.String(), "<D:sync-token>"+token+"</D:sync-token>") {
+		t.Errorf("sync-token property: got %s, want %s", w.Body.String(), token)
+	}
+
+	do("PUT", "/dir/a", "new")
+	do("DELETE", "/dir/b", "")
+	do("PUT", "/dir/sub/d", "4")
+	do("MOVE", "/dir/sub/c", "", "Destination", "/dir/c")
+
+	_, responses, token1 := sync(token, "1")
+	if got, want := strings.Join(responses, " "), "/dir/a /dir/b removed /dir/c"; got != want {
+		t.Errorf("sync level 1: got %q, want %q", got, want)
+	}
+	if token1 == token {
+		t.Errorf("sync level 1: got the same token %q", token1)
+	}
+	_, responses, _ = sync(token, "infinite")
+	if got, want := strings.Join(responses, " "), "/dir/a /dir/b removed /dir/sub/d /dir/sub/c removed /dir/c"; got != want {
+		t.Errorf("sync level infinite: got %q, want %q", got, want)
+	}
+	_, responses, token2 := sync(token1, "1")
+	if len(responses) != 0 || token2 != token1 {
+		t.Errorf("sync without changes: got %q and token %q, want none and %q", responses, token2, token1)
+	}
+
+	w = do("REPORT", "/dir", `<D:sync-collection xmlns:D="DAV:"><D:sync-token>urn:unknown</D:sync-token><D:sync-level>1</D:sync-level><D:prop><D:getetag/></D:prop></D:sync-collection>`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "<D:valid-sync-token/>") {
+		t.Errorf("invalid token: got %d %s, want %d and valid-sync-token", w.Code, w.Body.String(), http.StatusForbidden)
+	}
+	w = do("REPORT", "/dir", `<D:sync-collection xmlns:D="DAV:"><D:sync-token/><D:sync-level>1</D:sync-level><D:limit><D:nresults>1</D:nresults></D:limit><D:prop><D:getetag/></D:prop></D:sync-collection>`)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("limit: got status %d, want %d", w.Code, http.StatusInsufficientStorage)
+	}
+	w = do("PROPFIND", "/dir", `<D:propfind xmlns:D="DAV:"><D:prop><D:supported-report-set/></D:prop></D:propfind>`, "Depth", "0")
+	if !strings.Contains(w.Body.String(), "<D:sync-collection/>") {
+		t.Errorf("supported-report-set: got %s, want sync-collection", w.Body.String())
+	}
+}
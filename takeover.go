@@ -0,0 +1,84 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+)
+
+// lockTakeoverHeader is the vendor header of the LOCK requests taking over an
+// existing lock. Its value is the token of that lock, as a Coded-URL like
+// the Lock-Token header.
+const lockTakeoverHeader = "X-Lock-Takeover"
+
+// LockTakeover allows principals to take over the locks of others, for
+// example the lock of an abandoned edit session, which would otherwise block
+// the resource until it expires.
+//
+// A client takes over a lock by sending a LOCK request creating a lock on the
+// locked resource, with the X-Lock-Takeover header set to the token of the
+// lock as a Coded-URL, such as "<opaquelocktoken:...>". If Authorize allows
+// it, the lock is replaced by the new lock. Taking over locks requires a
+// LockSystem implementing TokenLookup and LockReplacer, as the one returned
+// by NewMemLS does.
+type LockTakeover struct {
+	// Authorize reports whether principal may take over the lock. Since
+	// taking over a lock can make the previous owner lose their changes,
+	// it should require a second factor, such as a one-time password sent
+	// by the client in a request header, and not only the credentials of
+	// the request. Taking over a lock is refused if Authorize is nil.
+	Authorize func(r *http.Request, principal string, lock LockDetails) bool
+	// Notify, if non-nil, is called after principal took over the lock, so
+	// that its previous owner can be notified.
+	Notify func(r *http.Request, lock LockDetails, principal string)
+}
+
+// takeOverLock returns the details and the token of the lock named by the
+// X-Lock-Takeover header of r, a LOCK request for reqPath, if the principal
+// of r may take it over. The caller replaces it using the LockReplacer. It
+// returns nil if r doesn't take over a lock.
+func (h *Handler) takeOverLock(r *http.Request, reqPath string) (*LockDetails, string, int, error) {
+	t := r.Header.Get(lockTakeoverHeader)
+	if t == "" || h.LockTakeover == nil {
+		return nil, "", 0, nil
+	}
+	if len(t) < 2 || t[0] != '<' || t[len(t)-1] != '>' {
+		return nil, "", http.StatusBadRequest, errInvalidLockToken
+	}
+	t = t[1 : len(t)-1]
+
+	lookup, ok := h.LockSystem.(TokenLookup)
+	if !ok {
+		return nil, "", http.StatusNotImplemented, errLockTakeoverRefused
+	}
+	if _, ok := h.LockSystem.(LockReplacer); !ok {
+		return nil, "", http.StatusNotImplemented, errLockTakeoverRefused
+	}
+	ld, _, err := lookup.GetByToken(t)
+	if err != nil {
+		if err == ErrNoSuchLock {
+			return nil, "", http.StatusPreconditionFailed, err
+		}
+		return nil, "", http.StatusInternalServerError, err
+	}
+	// Only the locks applying to the request URI can be taken over.
+	if name := slashClean(reqPath); name != ld.Root && (ld.ZeroDepth || !isWithin(name, ld.Root)) {
+		return nil, "", http.StatusConflict, errLockTokenMismatch
+	}
+	if h.LockTakeover.Authorize == nil || !h.LockTakeover.Authorize(r, h.principal(r), ld) {
+		return nil, "", http.StatusForbidden, errLockTakeoverRefused
+	}
+	return &ld, t, 0, nil
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLockTakeover(t *testing.T) {
+	fs, err := buildTestFS([]string{"touch /file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	var notified []string
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		Principal:  func(r *http.Request) string { return r.Header.Get("X-User") },
+		LockTakeover: &LockTakeover{
+			Authorize: func(r *http.Request, principal string, lock LockDetails) bool {
+				return principal == "bob" && r.Header.Get("X-OTP") == "123456"
+			},
+			Notify: func(r *http.Request, lock LockDetails, principal string) {
+				notified = append(notified, lock.Principal+" -> "+principal)
+			},
+		},
+	}
+	lock := func(user, takeover, otp string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("LOCK", "/file", strings.NewReader(createLockBody))
+		r.Header.Set("X-User", user)
+		if takeover != "" {
+			r.Header.Set("X-Lock-Takeover", takeover)
+		}
+		if otp != "" {
+			r.Header.Set("X-OTP", otp)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := lock("alice", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("alice lock: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	token := w.Header().Get("Lock-Token")
+
+	testCases := []struct {
+		desc       string
+		takeover   string
+		otp        string
+		wantStatus int
+	}{
+		{"no takeover", "", "", http.StatusLocked},
+		{"invalid token", "opaquelocktoken:x", "123456", http.StatusBadRequest},
+		{"unknown lock", "<opaquelocktoken:x>", "123456", http.StatusPreconditionFailed},
+		{"no second factor", token, "", http.StatusForbidden},
+		{"wrong second factor", token, "000000", http.StatusForbidden},
+		{"takeover", token, "123456", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		w := lock("bob", tc.takeover, tc.otp)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+		}
+	}
+	if want := []string{"alice -> bob"}; strings.Join(notified, ",") != strings.Join(want, ",") {
+		t.Errorf("got notifications %q, want %q", notified, want)
+	}
+	if _, _, err := h.LockSystem.(TokenLookup).GetByToken(strings.Trim(token, "<>")); err != ErrNoSuchLock {
+		t.Errorf("previous lock: got %v, want %v", err, ErrNoSuchLock)
+	}
+}
+
+func TestLockTakeoverCreateFails(t *testing.T) {
+	fs, err := buildTestFS([]string{"touch /file", "touch /other"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	notified := false
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		Principal:  func(r *http.Request) string { return r.Header.Get("X-User") },
+		LockLimits: LockLimits{MaxPerPrincipal: 1},
+		LockTakeover: &LockTakeover{
+			Authorize: func(r *http.Request, principal string, lock LockDetails) bool { return true },
+			Notify:    func(r *http.Request, lock LockDetails, principal string) { notified = true },
+		},
+	}
+	lock := func(user, name, takeover string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("LOCK", name, strings.NewReader(createLockBody))
+		r.Header.Set("X-User", user)
+		if takeover != "" {
+			r.Header.Set("X-Lock-Takeover", takeover)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := lock("bob", "/other", ""); w.Code != http.StatusOK {
+		t.Fatalf("bob lock: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	w := lock("alice", "/file", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("alice lock: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	token := w.Header().Get("Lock-Token")
+	if w := lock("bob", "/file", token); w.Code != http.StatusLocked {
+		t.Errorf("takeover over the limit: got status %d, want %d", w.Code, http.StatusLocked)
+	}
+	if notified {
+		t.Error("takeover over the limit: the previous owner was notified")
+	}
+	locks, err := h.LockSystem.(LockLister).GetAllByName("/file")
+	if err != nil || len(locks) != 1 || locks[0].Details.Principal != "alice" {
+		t.Fatalf("got locks %+v, %v, want the lock of alice", locks, err)
+	}
+	if got := "<" + locks[0].Token + ">"; got != token {
+		t.Errorf("got the lock token %s, want the original %s", got, token)
+	}
+
+	// The original token of alice still works.
+	r := httptest.NewRequest("PUT", "/file", strings.NewReader("content"))
+	r.Header.Set("X-User", "alice")
+	r.Header.Set("If", "("+token+")")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Errorf("PUT with the original token: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	r = httptest.NewRequest("UNLOCK", "/file", nil)
+	r.Header.Set("X-User", "alice")
+	r.Header.Set("Lock-Token", token)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("UNLOCK with the original token: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
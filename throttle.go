@@ -0,0 +1,120 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ThrottledError is returned by the FileSystem, or wrapped in its errors,
+// when the storage backend throttles the requests, such as with the S3
+// "503 SlowDown" responses or the rate limits of an API. The requests
+// failing with it are refused with "503 Service Unavailable" and a
+// Retry-After header, so that sync clients back off. See Handler.Backoff.
+type ThrottledError struct {
+	// RetryAfter is the delay suggested by the backend, if known.
+	RetryAfter time.Duration
+	// Err is the error of the backend, if any.
+	Err error
+}
+
+func (e *ThrottledError) Error() string {
+	if e.Err == nil {
+		return "webdav: backend throttled"
+	}
+	return fmt.Sprintf("webdav: backend throttled: %v", e.Err)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	defaultBackoffMin = time.Second
+	defaultBackoffMax = 5 * time.Minute
+)
+
+// Backoff computes the Retry-After hints of the requests failing with a
+// ThrottledError. While the backend keeps throttling, the hints double with
+// each consecutive throttled request, from Min up to Max, and they are reset
+// by the first request served without error. The delay suggested by the
+// backend, if longer, is used instead. A Backoff must not be copied after
+// first use.
+type Backoff struct {
+	// Min is the hint of the first throttled request. If zero, one second
+	// is used.
+	Min time.Duration
+	// Max is the longest hint. If zero, five minutes are used.
+	Max time.Duration
+
+	throttled atomic.Int32
+}
+
+// retryAfter returns the Retry-After hint, in seconds, of a request failing
+// with err. Without a Backoff, the delay suggested by the backend, or one
+// second, is used.
+func (b *Backoff) retryAfter(err *ThrottledError) string {
+	delay := defaultBackoffMin
+	if b != nil {
+		if b.Min > 0 {
+			delay = b.Min
+		}
+		max := b.Max
+		if max <= 0 {
+			max = defaultBackoffMax
+		}
+		for n := b.throttled.Add(1); n > 1 && delay < max; n-- {
+			delay *= 2
+		}
+		if delay > max {
+			delay = max
+		}
+	}
+	if err.RetryAfter > delay {
+		delay = err.RetryAfter
+	}
+	seconds := int64((delay + time.Second - 1) / time.Second)
+	return strconv.FormatInt(seconds, 10)
+}
+
+// reset resets the hints, once a request is served without error.
+func (b *Backoff) reset() {
+	if b != nil && b.throttled.Load() != 0 {
+		b.throttled.Store(0)
+	}
+}
+
+// throttled returns "503 Service Unavailable", setting the Retry-After
+// header, if err reports that the backend throttled the request, or status
+// otherwise.
+func (h *Handler) throttled(w http.ResponseWriter, status int, err error) int {
+	if err == nil {
+		if status < 500 {
+			h.Backoff.reset()
+		}
+		return status
+	}
+	var te *ThrottledError
+	if status == 0 || !errors.As(err, &te) {
+		return status
+	}
+	w.Header().Set("Retry-After", h.Backoff.retryAfter(te))
+	return http.StatusServiceUnavailable
+}
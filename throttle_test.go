@@ -0,0 +1,83 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// throttledFS is a FileSystem whose backend throttles the requests while
+// err is set.
+type throttledFS struct {
+	FileSystem
+	err *ThrottledError
+}
+
+func (fs *throttledFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	if fs.err != nil {
+		return nil, fmt.Errorf("open %s: %w", name, fs.err)
+	}
+	return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+func TestThrottledBackend(t *testing.T) {
+	mem, err := buildTestFS([]string{"write /f content"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	fs := &throttledFS{FileSystem: mem}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	}
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/f", nil))
+		return w
+	}
+	testCases := []struct {
+		desc           string
+		backoff        bool
+		err            *ThrottledError
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{"default hint", false, &ThrottledError{}, http.StatusServiceUnavailable, "1"},
+		{"backend hint", false, &ThrottledError{RetryAfter: 1500 * time.Millisecond}, http.StatusServiceUnavailable, "2"},
+		{"first throttled", true, &ThrottledError{}, http.StatusServiceUnavailable, "2"},
+		{"second throttled", true, &ThrottledError{}, http.StatusServiceUnavailable, "4"},
+		{"third throttled", true, &ThrottledError{}, http.StatusServiceUnavailable, "8"},
+		{"capped", true, &ThrottledError{}, http.StatusServiceUnavailable, "10"},
+		{"longer backend hint", true, &ThrottledError{RetryAfter: time.Minute}, http.StatusServiceUnavailable, "60"},
+		{"served", true, nil, http.StatusOK, ""},
+		{"throttled after reset", true, &ThrottledError{}, http.StatusServiceUnavailable, "2"},
+	}
+	for _, tc := range testCases {
+		if tc.backoff && h.Backoff == nil {
+			h.Backoff = &Backoff{Min: 2 * time.Second, Max: 10 * time.Second}
+		}
+		fs.err = tc.err
+		w := get()
+		if w.Code != tc.wantStatus || w.Header().Get("Retry-After") != tc.wantRetryAfter {
+			t.Errorf("%s: got %d with Retry-After %q, want %d with %q", tc.desc, w.Code, w.Header().Get("Retry-After"), tc.wantStatus, tc.wantRetryAfter)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Timeouts are connection timeouts suited to WebDAV servers. The
+// ReadTimeout and WriteTimeout of an http.Server limit the duration of
+// whole requests, so they either abort the upload and download of large
+// files or let stalled connections linger indefinitely. Timeouts instead
+// limits how long the transfer of a request body or of a response may make
+// no progress: slow-loris clients are disconnected, while large transfers
+// take as long as they need. For example:
+//
+//	srv := &http.Server{Addr: ":8080", Handler: h}
+//	webdav.Timeouts{}.Apply(srv)
+//	log.Fatal(srv.ListenAndServe())
+type Timeouts struct {
+	// Header is the time allowed to read the request headers. The default
+	// is 10 seconds.
+	Header time.Duration
+	// Idle is how long a keep-alive connection may wait for the next
+	// request. The default is 2 minutes.
+	Idle time.Duration
+	// Stall is how long reading the request body may make no progress,
+	// and how long writing a part of the response may take. The default is
+	// 1 minute.
+	Stall time.Duration
+	// MinBytes is the number of bytes of the request body that must be
+	// received within Stall to make progress. The default is 1.
+	MinBytes int64
+}
+
+func (t Timeouts) header() time.Duration {
+	if t.Header <= 0 {
+		return 10 * time.Second
+	}
+	return t.Header
+}
+
+func (t Timeouts) idle() time.Duration {
+	if t.Idle <= 0 {
+		return 2 * time.Minute
+	}
+	return t.Idle
+}
+
+func (t Timeouts) stall() time.Duration {
+	if t.Stall <= 0 {
+		return time.Minute
+	}
+	return t.Stall
+}
+
+func (t Timeouts) minBytes() int64 {
+	if t.MinBytes <= 0 {
+		return 1
+	}
+	return t.MinBytes
+}
+
+// Apply sets the timeouts of srv, disabling its ReadTimeout and
+// WriteTimeout, and wraps its Handler, or http.DefaultServeMux if nil, with
+// t.Handler. It must be called before srv starts serving.
+func (t Timeouts) Apply(srv *http.Server) {
+	srv.ReadHeaderTimeout = t.header()
+	srv.IdleTimeout = t.idle()
+	srv.ReadTimeout = 0
+	srv.WriteTimeout = 0
+	next := srv.Handler
+	if next == nil {
+		next = http.DefaultServeMux
+	}
+	srv.Handler = t.Handler(next)
+}
+
+// Handler returns a handler enforcing the Stall timeout on the requests
+// served by next, using the read and write deadlines of their connections.
+// The server must not have a ReadTimeout or a WriteTimeout, which would
+// override the deadlines.
+func (t Timeouts) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		stall := t.stall()
+		// Errors are ignored: the connections not supporting deadlines,
+		// such as the ones of some HTTP/2 servers, are not protected.
+		if r.Body != nil && r.Body != http.NoBody {
+			rc.SetReadDeadline(time.Now().Add(stall))
+			r.Body = &stallReader{ReadCloser: r.Body, rc: rc, stall: stall, min: t.minBytes()}
+		}
+		next.ServeHTTP(&stallWriter{ResponseWriter: w, rc: rc, stall: stall}, r)
+		// Bound the flush of the buffered response.
+		rc.SetWriteDeadline(time.Now().Add(stall))
+	})
+}
+
+// stallReader is a request body extending the read deadline of the
+// connection whenever min bytes are read.
+type stallReader struct {
+	io.ReadCloser
+	rc    *http.ResponseController
+	stall time.Duration
+	min   int64
+	// n is the number of bytes read since the deadline was extended.
+	n int64
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.n += int64(n); r.n >= r.min {
+		r.n = 0
+		r.rc.SetReadDeadline(time.Now().Add(r.stall))
+	}
+	if err == io.EOF {
+		// The server keeps reading the connection in the background, to
+		// detect the clients going away: a deadline would cancel the
+		// request while the response is written.
+		r.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// stallWriter is a response writer setting the write deadline of the
+// connection before each write, so that the time spent by the handler
+// computing the response is not counted.
+type stallWriter struct {
+	http.ResponseWriter
+	rc    *http.ResponseController
+	stall time.Duration
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	w.rc.SetWriteDeadline(time.Now().Add(w.stall))
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *stallWriter) Flush() {
+	w.rc.SetWriteDeadline(time.Now().Add(w.stall))
+	w.rc.Flush()
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for
+// http.ResponseController.
+func (w *stallWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeouts(t *testing.T) {
+	type result struct {
+		n   int
+		err error
+	}
+	results := make(chan result, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			// The handler may take longer than Stall to compute the
+			// response.
+			time.Sleep(300 * time.Millisecond)
+			io.WriteString(w, "slow response")
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		results <- result{len(b), err}
+	}))
+	Timeouts{Stall: 150 * time.Millisecond}.Apply(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	if srv.Config.ReadHeaderTimeout != 10*time.Second || srv.Config.IdleTimeout != 2*time.Minute {
+		t.Errorf("got header and idle timeouts %v and %v, want the defaults", srv.Config.ReadHeaderTimeout, srv.Config.IdleTimeout)
+	}
+
+	// put sends a 10 bytes body, one byte every interval, stalling for
+	// stall after the fifth byte.
+	put := func(interval, stall time.Duration) result {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "PUT /f HTTP/1.1\r\nHost: example.com\r\nContent-Length: 10\r\n\r\n")
+		for i := 0; i < 10; i++ {
+			if i == 5 {
+				time.Sleep(stall)
+			}
+			time.Sleep(interval)
+			if _, err := conn.Write([]byte("x")); err != nil {
+				break
+			}
+		}
+		select {
+		case res := <-results:
+			return res
+		case <-time.After(5 * time.Second):
+			t.Fatal("the handler did not complete")
+			return result{}
+		}
+	}
+
+	// The upload lasts longer than Stall, but makes progress.
+	if res := put(50*time.Millisecond, 0); res.n != 10 || res.err != nil {
+		t.Errorf("slow upload: got %d bytes, %v, want 10 bytes, nil", res.n, res.err)
+	}
+	if res := put(0, 500*time.Millisecond); res.err == nil {
+		t.Errorf("stalled upload: got %d bytes, nil, want an error", res.n)
+	}
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /f HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("slow handler: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := string(b); !strings.Contains(got, "slow response") {
+		t.Errorf("slow handler: got %q, want %q", got, "slow response")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Checksum trailers, declared using the Trailer header of PUT requests with
+// chunked bodies of unknown length. Content-MD5 carries the base64 encoded
+// MD5 digest of the body as in RFC 1864, X-Checksum an "ALG:hexdigest" value
+// where ALG is one of the trailerHashes.
+const (
+	contentMD5Trailer = "Content-Md5"
+	checksumTrailer   = "X-Checksum"
+)
+
+// trailerHashes are the algorithms accepted in the X-Checksum trailer.
+var trailerHashes = map[string]func() hash.Hash{
+	"MD5":    md5.New,
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+}
+
+// trailerChecksum verifies a request body against the checksum sent in a
+// trailer.
+type trailerChecksum struct {
+	trailer string
+	hashes  map[string]hash.Hash
+}
+
+// newTrailerChecksum returns a trailerChecksum for the checksum trailer
+// declared by r, or nil if r declares none.
+func newTrailerChecksum(r *http.Request) *trailerChecksum {
+	c := &trailerChecksum{hashes: make(map[string]hash.Hash)}
+	if _, ok := r.Trailer[checksumTrailer]; ok {
+		// The algorithm is only known once the trailer is received.
+		c.trailer = checksumTrailer
+		for alg, newHash := range trailerHashes {
+			c.hashes[alg] = newHash()
+		}
+		return c
+	}
+	if _, ok := r.Trailer[contentMD5Trailer]; ok {
+		c.trailer = contentMD5Trailer
+		c.hashes["MD5"] = md5.New()
+		return c
+	}
+	return nil
+}
+
+// hashList returns the hashes the request body must be written to.
+func (c *trailerChecksum) hashList() []hash.Hash {
+	hs := make([]hash.Hash, 0, len(c.hashes))
+	for _, h := range c.hashes {
+		hs = append(hs, h)
+	}
+	return hs
+}
+
+// verify checks the checksum in trailer, received after the whole body was
+// written to the hashes of c.hashList.
+func (c *trailerChecksum) verify(trailer http.Header) error {
+	v := strings.TrimSpace(trailer.Get(c.trailer))
+	if v == "" {
+		return fmt.Errorf("%w: missing %s trailer", errChecksumMismatch, c.trailer)
+	}
+	var (
+		alg  = "MD5"
+		want []byte
+		err  error
+	)
+	if c.trailer == contentMD5Trailer {
+		want, err = base64.StdEncoding.DecodeString(v)
+	} else {
+		var digest string
+		alg, digest, _ = strings.Cut(v, ":")
+		alg = strings.ToUpper(alg)
+		want, err = hex.DecodeString(digest)
+	}
+	h, ok := c.hashes[alg]
+	if err != nil || !ok {
+		return fmt.Errorf("%w: invalid %s trailer %q", errChecksumMismatch, c.trailer, v)
+	}
+	if !bytes.Equal(h.Sum(nil), want) {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// uploadName returns the name of a temporary file, in the same directory as
+// name, an upload to name can be written to before being renamed over it.
+// The name has a random part, so that it is unique even among the processes
+// sharing the same backend.
+func uploadName(name string) string {
+	dir, base := path.Split(name)
+	id := make([]byte, 16)
+	rand.Read(id)
+	return path.Join(dir, fmt.Sprintf(".webdav-upload-%x-%s", id, base))
+}
+
+// uploadNameRE matches the base names returned by uploadName.
+var uploadNameRE = regexp.MustCompile(`^\.webdav-upload-[0-9a-f]{32}-(.+)$`)
+
+// uploadTarget returns the name of the file the upload written to name is
+// renamed over, if name is returned by uploadName.
+func uploadTarget(name string) (string, bool) {
+	dir, base := path.Split(name)
+	m := uploadNameRE.FindStringSubmatch(base)
+	if m == nil {
+		return "", false
+	}
+	return path.Join(dir, m[1]), true
+}
+
+// IsUploadName reports whether name is the name of a temporary file an
+// upload writes to, before renaming it over the uploaded file. These files
+// are not listed by PROPFIND requests, nor journaled by NewSyncFS, and the
+// clients cannot create resources with such names.
+//
+// The temporary files are removed once the upload ends, but the ones of
+// the requests interrupted by a crash of the process are left behind. They
+// can be removed by walking the backend directly, not through the Handler
+// that hides them, for example by a periodic job removing the files whose
+// name matches IsUploadName and older than the longest upload, including
+// the ResumableUploads.Expiry.
+func IsUploadName(name string) bool {
+	_, ok := uploadTarget(name)
+	return ok
+}
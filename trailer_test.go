@@ -0,0 +1,175 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPutChecksumTrailer(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+	srv := httptest.NewServer(&Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	})
+	defer srv.Close()
+
+	const content = "streamed content"
+	md5Sum := md5.Sum([]byte(content))
+	sha256Sum := sha256.Sum256([]byte(content))
+	put := func(name, trailer, value string) int {
+		req, err := http.NewRequest("PUT", srv.URL+name, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Send a chunked body, followed by the trailer.
+		req.ContentLength = -1
+		if trailer != "" {
+			req.Trailer = http.Header{trailer: {value}}
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	read := func(name string) string {
+		f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		b, _ := io.ReadAll(f)
+		return string(b)
+	}
+	listRoot := func() []string {
+		f, err := fs.OpenFile(ctx, "/", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		fis, err := f.Readdir(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+
+	testCases := []struct {
+		desc, trailer, value string
+		wantStatus           int
+	}{
+		{"Content-MD5", "Content-MD5", base64.StdEncoding.EncodeToString(md5Sum[:]), http.StatusCreated},
+		{"X-Checksum SHA256", "X-Checksum", "sha256:" + hex.EncodeToString(sha256Sum[:]), http.StatusCreated},
+		{"X-Checksum MD5", "X-Checksum", "MD5:" + hex.EncodeToString(md5Sum[:]), http.StatusCreated},
+		{"no trailer", "", "", http.StatusCreated},
+		{"Content-MD5 mismatch", "Content-MD5", base64.StdEncoding.EncodeToString(sha256Sum[:16]), http.StatusBadRequest},
+		{"X-Checksum mismatch", "X-Checksum", "SHA256:" + hex.EncodeToString(md5Sum[:]), http.StatusBadRequest},
+		{"X-Checksum unknown algorithm", "X-Checksum", "CRC32:00000000", http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		if err := fs.RemoveAll(ctx, "/file"); err != nil {
+			t.Fatal(err)
+		}
+		if status := put("/file", tc.trailer, tc.value); status != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, status, tc.wantStatus)
+			continue
+		}
+		want := content
+		if tc.wantStatus != http.StatusCreated {
+			want = ""
+		}
+		if got := read("/file"); got != want {
+			t.Errorf("%s: got content %q, want %q", tc.desc, got, want)
+		}
+		if names := listRoot(); len(names) > 1 {
+			t.Errorf("%s: got files %q, want no temporary files", tc.desc, names)
+		}
+	}
+
+	// A failed upload leaves the previous content in place.
+	if status := put("/file", "", ""); status != http.StatusCreated {
+		t.Fatalf("put: got status %d, want %d", status, http.StatusCreated)
+	}
+	if status := put("/file", "Content-MD5", "AAAAAAAAAAAAAAAAAAAAAA=="); status != http.StatusBadRequest {
+		t.Fatalf("overwrite mismatch: got status %d, want %d", status, http.StatusBadRequest)
+	}
+	if got := read("/file"); got != content {
+		t.Fatalf("overwrite mismatch: got content %q, want %q", got, content)
+	}
+}
+
+func TestUploadName(t *testing.T) {
+	a, b := uploadName("/dir/file.txt"), uploadName("/dir/file.txt")
+	if a == b {
+		t.Fatalf("uploadName: got %q twice", a)
+	}
+	if target, ok := uploadTarget(a); !ok || target != "/dir/file.txt" {
+		t.Fatalf("uploadTarget(%q): got %q, %t, want /dir/file.txt, true", a, target, ok)
+	}
+	// The names chosen by the users are not reserved.
+	for _, name := range []string{"/.file.txt.upload-1", "/.webdav-upload-file.txt", "/webdav-upload-" + strings.Repeat("0", 32) + "-f"} {
+		if IsUploadName(name) {
+			t.Errorf("IsUploadName(%q): got true, want false", name)
+		}
+	}
+
+	h := &Handler{
+		FileSystem: NewMemFS(),
+		LockSystem: NewMemLS(),
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/file.txt", strings.NewReader("content")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	reserved := uploadName("/file.txt")
+	testCases := []struct {
+		method, target string
+		hdrs           []string
+	}{
+		{"PUT", reserved, nil},
+		{"MKCOL", reserved, nil},
+		{"COPY", "/file.txt", []string{"Destination", reserved}},
+		{"MOVE", "/file.txt", []string{"Destination", reserved}},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		for i := 0; i+1 < len(tc.hdrs); i += 2 {
+			r.Header.Set(tc.hdrs[i], tc.hdrs[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.target, w.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net"
+	"net/http"
+)
+
+// insecureCredentialsMessage is the body of the responses to the requests
+// refused because of RequireSecureCredentials.
+const insecureCredentialsMessage = "Forbidden: credentials must not be sent over plaintext HTTP, " +
+	"connect using HTTPS and change the password if it was already used this way"
+
+// insecureCredentials reports whether r must be refused because it sends
+// credentials over plaintext HTTP. See Handler.RequireSecureCredentials.
+func (h *Handler) insecureCredentials(r *http.Request) bool {
+	if !h.RequireSecureCredentials || r.TLS != nil || r.Header.Get("Authorization") == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	if ip.IsLoopback() {
+		return false
+	}
+	for _, n := range h.InsecureNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
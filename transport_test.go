@@ -0,0 +1,77 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireSecureCredentials(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		desc       string
+		require    bool
+		remoteAddr string
+		auth       bool
+		tls        bool
+		want       int
+	}{
+		{"disabled", false, "192.0.2.1:1234", true, false, http.StatusOK},
+		{"no credentials", true, "192.0.2.1:1234", false, false, http.StatusOK},
+		{"tls", true, "192.0.2.1:1234", true, true, http.StatusOK},
+		{"loopback", true, "127.0.0.1:1234", true, false, http.StatusOK},
+		{"loopback ipv6", true, "[::1]:1234", true, false, http.StatusOK},
+		{"trusted network", true, "10.1.2.3:1234", true, false, http.StatusOK},
+		{"plaintext", true, "192.0.2.1:1234", true, false, http.StatusForbidden},
+		{"unparsable address", true, "unknown", true, false, http.StatusForbidden},
+	}
+
+	fs := NewMemFS()
+	for _, tc := range testCases {
+		h := &Handler{
+			FileSystem:               fs,
+			LockSystem:               NewMemLS(),
+			RequireSecureCredentials: tc.require,
+			InsecureNetworks:         []*net.IPNet{trusted},
+		}
+		req := httptest.NewRequest("OPTIONS", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.auth {
+			req.SetBasicAuth("user", "password")
+		}
+		if !tc.tls {
+			req.TLS = nil
+		} else if req.TLS == nil {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.desc, rec.Code, tc.want)
+			continue
+		}
+		if tc.want == http.StatusForbidden && !strings.Contains(rec.Body.String(), "HTTPS") {
+			t.Errorf("%s: got body %q, want guidance about HTTPS", tc.desc, rec.Body.String())
+		}
+	}
+}
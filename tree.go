@@ -0,0 +1,121 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TreeLimits protect the server and its backend from DELETE and COPY
+// requests on pathologically deep or wide collections. The tree is walked
+// before the request is served, and the request is refused if it exceeds
+// a limit. A zero limit means no limit.
+type TreeLimits struct {
+	// MaxDepth is the maximum depth of the tree, the members of the
+	// collection being at depth 1. It is enforced with "413 Request Entity
+	// Too Large".
+	MaxDepth int
+	// MaxItems is the maximum number of resources in the tree, the
+	// collection included. It is enforced with "413 Request Entity Too
+	// Large".
+	MaxItems int
+	// MaxBytes is the maximum total size of the files copied by a COPY
+	// request. It is enforced with "507 Insufficient Storage".
+	MaxBytes int64
+}
+
+func (l *TreeLimits) isZero() bool {
+	return l.MaxDepth == 0 && l.MaxItems == 0 && l.MaxBytes == 0
+}
+
+// treeLimitError reports a tree exceeding one of the TreeLimits.
+type treeLimitError struct {
+	// limit describes the exceeded limit, for example "resources".
+	limit string
+	max   int64
+}
+
+func (e *treeLimitError) Error() string {
+	return fmt.Sprintf("webdav: tree exceeds the maximum of %d %s", e.max, e.limit)
+}
+
+func (e *treeLimitError) status() int {
+	if e.limit == "bytes" {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusRequestEntityTooLarge
+}
+
+// message is the body of the response refusing the request.
+func (e *treeLimitError) message() string {
+	return fmt.Sprintf("%s: the collection exceeds the maximum of %d %s allowed for this operation",
+		StatusText(e.status()), e.max, e.limit)
+}
+
+// checkTreeLimits walks the tree rooted at name, at the given depth, and
+// returns an error if it exceeds h.TreeLimits. MaxBytes is only enforced
+// if copying is true.
+func (h *Handler) checkTreeLimits(ctx context.Context, name string, depth int, copying bool) (int, error) {
+	limits := h.TreeLimits
+	if limits.isZero() {
+		return 0, nil
+	}
+	fi, err := h.FileSystem.Stat(ctx, name)
+	if err != nil || (!fi.IsDir() && !copying) {
+		// Errors are reported by the request itself.
+		return 0, nil
+	}
+	root := slashClean(name)
+	var (
+		items int
+		bytes int64
+	)
+	err = walkFS(ctx, h.FileSystem, depth, root, fi, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		items++
+		if limits.MaxItems > 0 && items > limits.MaxItems {
+			return &treeLimitError{limit: "resources", max: int64(limits.MaxItems)}
+		}
+		if limits.MaxDepth > 0 && p != root {
+			d := strings.Count(strings.TrimPrefix(p, root), "/")
+			if root == "/" {
+				d++
+			}
+			if d > limits.MaxDepth {
+				return &treeLimitError{limit: "levels", max: int64(limits.MaxDepth)}
+			}
+		}
+		if copying && !info.IsDir() {
+			bytes += info.Size()
+			if limits.MaxBytes > 0 && bytes > limits.MaxBytes {
+				return &treeLimitError{limit: "bytes", max: limits.MaxBytes}
+			}
+		}
+		return nil
+	})
+	if tle, ok := err.(*treeLimitError); ok {
+		return tle.status(), tle
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTreeLimits(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		limits     TreeLimits
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{{
+		desc:       "delete within limits",
+		limits:     TreeLimits{MaxDepth: 3, MaxItems: 5},
+		method:     "DELETE",
+		path:       "/a",
+		wantStatus: http.StatusNoContent,
+	}, {
+		desc:       "delete too deep",
+		limits:     TreeLimits{MaxDepth: 1},
+		method:     "DELETE",
+		path:       "/a",
+		wantStatus: http.StatusRequestEntityTooLarge,
+		wantBody:   "maximum of 1 levels",
+	}, {
+		desc:       "delete too many items",
+		limits:     TreeLimits{MaxItems: 3},
+		method:     "DELETE",
+		path:       "/a",
+		wantStatus: http.StatusRequestEntityTooLarge,
+		wantBody:   "maximum of 3 resources",
+	}, {
+		desc:       "delete ignores bytes",
+		limits:     TreeLimits{MaxBytes: 1},
+		method:     "DELETE",
+		path:       "/a",
+		wantStatus: http.StatusNoContent,
+	}, {
+		desc:       "copy too large",
+		limits:     TreeLimits{MaxBytes: 10},
+		method:     "COPY",
+		path:       "/a",
+		wantStatus: http.StatusInsufficientStorage,
+		wantBody:   "maximum of 10 bytes",
+	}, {
+		desc:       "copy file too large",
+		limits:     TreeLimits{MaxBytes: 5},
+		method:     "COPY",
+		path:       "/a/b/c/f",
+		wantStatus: http.StatusInsufficientStorage,
+	}, {
+		desc:       "copy within limits",
+		limits:     TreeLimits{MaxDepth: 3, MaxItems: 5, MaxBytes: 14},
+		method:     "COPY",
+		path:       "/a",
+		wantStatus: http.StatusCreated,
+	}}
+	for _, tc := range testCases {
+		fs, err := buildTestFS([]string{
+			"mkdir /a",
+			"mkdir /a/b",
+			"mkdir /a/b/c",
+			"write /a/f content",
+			"write /a/b/c/f content",
+		})
+		if err != nil {
+			t.Fatalf("%s: cannot create test filesystem: %v", tc.desc, err)
+		}
+		h := &Handler{
+			FileSystem: fs,
+			LockSystem: NewMemLS(),
+			TreeLimits: tc.limits,
+		}
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.method == "COPY" {
+			r.Header.Set("Destination", "/copy")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+		}
+		if !strings.Contains(w.Body.String(), tc.wantBody) {
+			t.Errorf("%s: got body %q, want it to contain %q", tc.desc, w.Body.String(), tc.wantBody)
+		}
+		if tc.wantStatus >= 400 {
+			if _, err := fs.Stat(context.Background(), tc.path); err != nil {
+				t.Errorf("%s: refused request changed the tree: %v", tc.desc, err)
+			}
+			if _, err := fs.Stat(context.Background(), "/copy"); err == nil {
+				t.Errorf("%s: refused request created the copy", tc.desc)
+			}
+		}
+	}
+}
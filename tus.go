@@ -0,0 +1,393 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tusVersion is the version of the tus protocol supported.
+const tusVersion = "1.0.0"
+
+// ErrOffsetMismatch is returned by an AppendFS when the size of the file is
+// not the offset to append at.
+var ErrOffsetMismatch = errors.New("webdav: offset mismatch")
+
+// AppendFS is an optional interface for the FileSystem, appending to the end
+// of files. It is required by the resumable uploads, see ResumableUploads.
+type AppendFS interface {
+	// Append appends the content of r to file name, whose size must be
+	// offset, and returns the number of bytes written, even if reading r
+	// fails. It returns ErrOffsetMismatch if the size of the file is not
+	// offset.
+	Append(ctx context.Context, name string, offset int64, r io.Reader) (int64, error)
+}
+
+// ResumableUploads implements the creation extension of the tus resumable
+// upload protocol, version 1.0.0, which lets the clients behind unreliable
+// networks resume the uploads interrupted by a network failure. See
+// https://tus.io/protocols/resumable-upload.
+//
+// Only the requests having a Tus-Resumable header are tus requests, so
+// that they co-exist with the other requests on the same resources:
+//   - POST to a collection, with the Upload-Length header and the file name
+//     in the "filename" key of the Upload-Metadata header, starts the upload
+//     of the file, whose URL is returned in the Location header;
+//   - HEAD to the file returns the size received in the Upload-Offset
+//     header;
+//   - PATCH to the file, with the Upload-Offset header, appends the body.
+//
+// The content is appended to a temporary file, see IsUploadName, renamed
+// over the file once complete, so that the existing file is only replaced
+// by a complete upload, as by a PUT request. The uploads in progress are
+// tracked in memory, so they cannot be resumed once the process restarts.
+// An upload can only be resumed by the principal that created it, see
+// Handler.Principal. The body of the PATCH requests is read through the
+// Handler.UploadPipeline.
+//
+// The zero value is ready to use.
+type ResumableUploads struct {
+	// MaxSize, if positive, is the maximum size of the uploads.
+	MaxSize int64
+	// Expiry is how long an upload not receiving data is kept, after which
+	// it cannot be resumed and its temporary file is removed. If zero, the
+	// uploads expire after 24 hours.
+	Expiry time.Duration
+
+	mu sync.Mutex
+	// uploads are the uploads in progress, by principal and name.
+	uploads map[uploadKey]*resumableUpload
+}
+
+type uploadKey struct {
+	principal, name string
+}
+
+type resumableUpload struct {
+	// length is the size of the complete file.
+	length int64
+	// staging is the name of the temporary file the content is appended
+	// to.
+	staging string
+	// busy is whether a PATCH request is appending to the file.
+	busy bool
+	// updated is when the upload was created or last appended to.
+	updated time.Time
+}
+
+// setOptions sets the headers of the response to an OPTIONS request.
+func (u *ResumableUploads) setOptions(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation")
+	if u.MaxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(u.MaxSize, 10))
+	}
+}
+
+// start starts the upload key, appended to the temporary file staging. It
+// returns the temporary file of the upload it replaces, if any, so that it
+// can be removed.
+func (u *ResumableUploads) start(key uploadKey, length int64, staging string) (string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.uploads == nil {
+		u.uploads = make(map[uploadKey]*resumableUpload)
+	}
+	prev := u.uploads[key]
+	u.uploads[key] = &resumableUpload{length: length, staging: staging, updated: time.Now()}
+	if prev == nil || prev.busy {
+		return "", false
+	}
+	return prev.staging, true
+}
+
+// expire forgets the uploads not updated for longer than u.Expiry, and
+// returns their temporary files, that must be removed.
+func (u *ResumableUploads) expire(now time.Time) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	expiry := u.Expiry
+	if expiry <= 0 {
+		expiry = 24 * time.Hour
+	}
+	var expired []string
+	for key, up := range u.uploads {
+		if !up.busy && now.Sub(up.updated) > expiry {
+			delete(u.uploads, key)
+			expired = append(expired, up.staging)
+		}
+	}
+	return expired
+}
+
+// length returns the size of the complete file of the upload in progress
+// key, and its temporary file.
+func (u *ResumableUploads) length(key uploadKey) (int64, string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if up := u.uploads[key]; up != nil {
+		return up.length, up.staging, true
+	}
+	return 0, "", false
+}
+
+// begin marks the upload key as busy and returns the size of its complete
+// file and its temporary file. end must be called once the request
+// appending to it is done.
+func (u *ResumableUploads) begin(key uploadKey) (int64, string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	up := u.uploads[key]
+	if up == nil {
+		return 0, "", os.ErrNotExist
+	}
+	if up.busy {
+		return 0, "", errUploadInProgress
+	}
+	up.busy = true
+	return up.length, up.staging, nil
+}
+
+// end ends the request appending to the upload key, which is forgotten if
+// complete or abandoned.
+func (u *ResumableUploads) end(key uploadKey, forget bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if forget {
+		delete(u.uploads, key)
+	} else if up := u.uploads[key]; up != nil {
+		up.busy = false
+		up.updated = time.Now()
+	}
+}
+
+// resumableUploads reports whether the tus requests are served.
+func (h *Handler) resumableUploads() bool {
+	_, ok := h.FileSystem.(AppendFS)
+	return ok && h.ResumableUploads != nil
+}
+
+func (h *Handler) isResumableUpload(r *http.Request) bool {
+	switch r.Method {
+	case "POST", "HEAD", "PATCH":
+		return r.Header.Get("Tus-Resumable") != "" && h.resumableUploads()
+	}
+	return false
+}
+
+func (h *Handler) serveResumableUpload(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		return http.StatusPreconditionFailed, errUnsupportedTusVersion
+	}
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	reqPath = slashClean(reqPath)
+	for _, staging := range h.ResumableUploads.expire(time.Now()) {
+		h.FileSystem.RemoveAll(r.Context(), staging)
+	}
+	switch r.Method {
+	case "POST":
+		return h.createResumableUpload(w, r, reqPath)
+	case "HEAD":
+		length, staging, ok := h.ResumableUploads.length(uploadKey{h.principal(r), reqPath})
+		if !ok {
+			return http.StatusNotFound, os.ErrNotExist
+		}
+		fi, err := h.FileSystem.Stat(r.Context(), staging)
+		if err != nil {
+			return http.StatusNotFound, err
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(fi.Size(), 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(length, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		return 0, nil
+	}
+	return h.appendResumableUpload(w, r, reqPath)
+}
+
+// createResumableUpload starts a resumable upload in collection dir, by
+// creating its temporary file. The uploads of empty files are complete, so
+// the file is created directly.
+func (h *Handler) createResumableUpload(w http.ResponseWriter, r *http.Request, dir string) (status int, err error) {
+	ctx := r.Context()
+	fi, err := h.FileSystem.Stat(ctx, dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	if !fi.IsDir() {
+		return http.StatusMethodNotAllowed, errNotADirectory
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return http.StatusBadRequest, errInvalidUploadLength
+	}
+	if h.ResumableUploads.MaxSize > 0 && length > h.ResumableUploads.MaxSize {
+		return http.StatusRequestEntityTooLarge, ErrBodyTooLarge
+	}
+	filename, ok := parseUploadMetadata(r.Header.Get("Upload-Metadata"))["filename"]
+	if !ok || filename == "" || filename == "." || filename == ".." || strings.ContainsAny(filename, `/\`) {
+		return http.StatusBadRequest, errInvalidUploadMetadata
+	}
+	name := path.Join(dir, filename)
+	if IsUploadName(name) {
+		return http.StatusForbidden, errReservedName
+	}
+	if status, err := h.checkPreconditions(r, name); err != nil {
+		return status, err
+	}
+	if status, err := h.checkRetention(ctx, w, name); err != nil {
+		return status, err
+	}
+	release, status, err := h.confirmLocks(r, name, "")
+	if err != nil {
+		return status, err
+	}
+	defer release()
+	if status, err := h.checkQuota(ctx, name, length); err != nil {
+		return status, err
+	}
+	staging := name
+	if length > 0 {
+		staging = uploadName(name)
+	}
+	f, err := h.FileSystem.OpenFile(ctx, staging, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		if os.IsPermission(err) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	if err := f.Close(); err != nil {
+		h.FileSystem.RemoveAll(ctx, staging)
+		return http.StatusInternalServerError, err
+	}
+	if length > 0 {
+		if prev, ok := h.ResumableUploads.start(uploadKey{h.principal(r), name}, length, staging); ok {
+			h.FileSystem.RemoveAll(ctx, prev)
+		}
+	}
+	w.Header().Set("Location", hrefPath(h.Prefix+name))
+	return http.StatusCreated, nil
+}
+
+// appendResumableUpload appends the body of the PATCH request r to the
+// temporary file of the resumable upload name, renamed over name once
+// complete.
+func (h *Handler) appendResumableUpload(w http.ResponseWriter, r *http.Request, name string) (status int, err error) {
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/offset+octet-stream" {
+		return http.StatusUnsupportedMediaType, errUnsupportedPatch
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return http.StatusBadRequest, errInvalidUploadOffset
+	}
+	release, status, err := h.confirmLocks(r, name, "")
+	if err != nil {
+		return status, err
+	}
+	defer release()
+	key := uploadKey{h.principal(r), name}
+	length, staging, err := h.ResumableUploads.begin(key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
+		return http.StatusConflict, err
+	}
+	if offset > length {
+		h.ResumableUploads.end(key, false)
+		return http.StatusBadRequest, errInvalidUploadOffset
+	}
+	ctx := r.Context()
+	t, done := h.Admin.startTransfer(r, name)
+	defer done()
+	pipeline := NewBodyPipeline()
+	if h.UploadPipeline != nil {
+		h.UploadPipeline(r, name, pipeline)
+	}
+	body := pipeline.Reader(io.LimitReader(transferReader{r.Body, t}, length-offset))
+	n, err := h.FileSystem.(AppendFS).Append(ctx, staging, offset, body)
+	offset += n
+	// A rejected body cannot be resumed, its upload is removed.
+	rejected := errors.Is(err, ErrBodyTooLarge) || errors.Is(err, ErrBodyRejected)
+	complete := err == nil && offset == length
+	h.ResumableUploads.end(key, complete || rejected)
+	switch {
+	case errors.Is(err, ErrBodyTooLarge):
+		h.FileSystem.RemoveAll(ctx, staging)
+		return http.StatusRequestEntityTooLarge, err
+	case errors.Is(err, ErrBodyRejected):
+		h.FileSystem.RemoveAll(ctx, staging)
+		return http.StatusForbidden, err
+	case errors.Is(err, ErrOffsetMismatch):
+		return http.StatusConflict, err
+	case os.IsNotExist(err):
+		return http.StatusNotFound, err
+	case err != nil:
+		return http.StatusInternalServerError, err
+	}
+	if complete {
+		// The target may have been put under retention since the upload
+		// was created.
+		if status, err := h.checkRetention(ctx, w, name); err != nil {
+			h.FileSystem.RemoveAll(ctx, staging)
+			return status, err
+		}
+		if err := h.renameUpload(ctx, staging, name); err != nil {
+			h.FileSystem.RemoveAll(ctx, staging)
+			return http.StatusInternalServerError, err
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	return http.StatusNoContent, nil
+}
+
+// parseUploadMetadata parses the Upload-Metadata header, a comma separated
+// list of keys and base64 encoded values.
+func parseUploadMetadata(hdr string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(hdr, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(b)
+	}
+	return metadata
+}
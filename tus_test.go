@@ -0,0 +1,235 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumableUploads(t *testing.T) {
+	dir := t.TempDir()
+	h := &Handler{
+		FileSystem:       Dir(dir),
+		LockSystem:       NewMemLS(),
+		ResumableUploads: &ResumableUploads{MaxSize: 100},
+	}
+	filename := "filename " + base64.StdEncoding.EncodeToString([]byte("f.txt"))
+	testCases := []struct {
+		desc, method, target, body string
+		hdrs                       []string
+		wantStatus                 int
+		wantHdrs                   []string
+	}{
+		{"options", "OPTIONS", "/", "", nil, http.StatusOK,
+			[]string{"Tus-Version", "1.0.0", "Tus-Extension", "creation", "Tus-Max-Size", "100"}},
+		{"unsupported version", "POST", "/", "", []string{"Tus-Resumable", "0.2.0", "Upload-Length", "11", "Upload-Metadata", filename},
+			http.StatusPreconditionFailed, []string{"Tus-Version", "1.0.0"}},
+		{"too large", "POST", "/", "", []string{"Tus-Resumable", "1.0.0", "Upload-Length", "101", "Upload-Metadata", filename},
+			http.StatusRequestEntityTooLarge, nil},
+		{"no file name", "POST", "/", "", []string{"Tus-Resumable", "1.0.0", "Upload-Length", "11"},
+			http.StatusBadRequest, nil},
+		{"create", "POST", "/", "", []string{"Tus-Resumable", "1.0.0", "Upload-Length", "11", "Upload-Metadata", filename},
+			http.StatusCreated, []string{"Location", "/f.txt", "Tus-Resumable", "1.0.0"}},
+		{"initial offset", "HEAD", "/f.txt", "", []string{"Tus-Resumable", "1.0.0"},
+			http.StatusOK, []string{"Upload-Offset", "0", "Upload-Length", "11"}},
+		{"wrong content type", "PATCH", "/f.txt", "hello", []string{"Tus-Resumable", "1.0.0", "Upload-Offset", "0"},
+			http.StatusUnsupportedMediaType, nil},
+		{"first part", "PATCH", "/f.txt", "hello", []string{"Tus-Resumable", "1.0.0", "Upload-Offset", "0", "Content-Type", "application/offset+octet-stream"},
+			http.StatusNoContent, []string{"Upload-Offset", "5"}},
+		{"wrong offset", "PATCH", "/f.txt", "hello", []string{"Tus-Resumable", "1.0.0", "Upload-Offset", "0", "Content-Type", "application/offset+octet-stream"},
+			http.StatusConflict, nil},
+		{"resumed offset", "HEAD", "/f.txt", "", []string{"Tus-Resumable", "1.0.0"},
+			http.StatusOK, []string{"Upload-Offset", "5"}},
+		{"last part", "PATCH", "/f.txt", " world", []string{"Tus-Resumable", "1.0.0", "Upload-Offset", "5", "Content-Type", "application/offset+octet-stream"},
+			http.StatusNoContent, []string{"Upload-Offset", "11"}},
+		{"complete", "HEAD", "/f.txt", "", []string{"Tus-Resumable", "1.0.0"},
+			http.StatusNotFound, nil},
+		{"plain HEAD", "HEAD", "/f.txt", "", nil,
+			http.StatusOK, []string{"Content-Length", "11"}},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		for i := 0; i < len(tc.hdrs); i += 2 {
+			r.Header.Set(tc.hdrs[i], tc.hdrs[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+			continue
+		}
+		for i := 0; i < len(tc.wantHdrs); i += 2 {
+			if got := w.Header().Get(tc.wantHdrs[i]); got != tc.wantHdrs[i+1] {
+				t.Errorf("%s: got %s %q, want %q", tc.desc, tc.wantHdrs[i], got, tc.wantHdrs[i+1])
+			}
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "f.txt"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(b) != "hello world" {
+		t.Errorf("got content %q, want %q", b, "hello world")
+	}
+}
+
+func TestResumableUploadsOwnership(t *testing.T) {
+	dir := t.TempDir()
+	h := &Handler{
+		FileSystem:       Dir(dir),
+		LockSystem:       NewMemLS(),
+		Principal:        func(r *http.Request) string { return r.Header.Get("X-User") },
+		ResumableUploads: &ResumableUploads{},
+		UploadPipeline: func(r *http.Request, name string, p *BodyPipeline) {
+			p.Limit(5)
+		},
+	}
+	do := func(user, method, target, body string, hdrs ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("X-User", user)
+		r.Header.Set("Tus-Resumable", "1.0.0")
+		r.Header.Set("Content-Type", "application/offset+octet-stream")
+		for i := 0; i < len(hdrs); i += 2 {
+			r.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	create := func(name string) {
+		t.Helper()
+		metadata := "filename " + base64.StdEncoding.EncodeToString([]byte(name))
+		if w := do("alice", "POST", "/", "", "Upload-Length", "11", "Upload-Metadata", metadata); w.Code != http.StatusCreated {
+			t.Fatalf("POST %s: got status %d, want %d", name, w.Code, http.StatusCreated)
+		}
+	}
+
+	create("a.txt")
+	if w := do("bob", "HEAD", "/a.txt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD by another principal: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do("bob", "PATCH", "/a.txt", "hello", "Upload-Offset", "0"); w.Code != http.StatusNotFound {
+		t.Errorf("PATCH by another principal: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do("alice", "PATCH", "/a.txt", "hello", "Upload-Offset", "0"); w.Code != http.StatusNoContent {
+		t.Errorf("PATCH: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	// The body of each PATCH request is read through the UploadPipeline.
+	create("b.txt")
+	if w := do("alice", "PATCH", "/b.txt", "hello world", "Upload-Offset", "0"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PATCH over the pipeline limit: got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if w := do("alice", "HEAD", "/b.txt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a rejected upload: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("Stat of a rejected upload: got %v, want not exist", err)
+	}
+
+	// The uploads not updated within Expiry are forgotten.
+	h.ResumableUploads.Expiry = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	if w := do("alice", "HEAD", "/a.txt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of an expired upload: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestResumableUploadsKeepExisting(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f.txt"), []byte("original"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		FileSystem:       Dir(dir),
+		LockSystem:       NewMemLS(),
+		ResumableUploads: &ResumableUploads{},
+	}
+	do := func(method, target, body string, hdrs ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Tus-Resumable", "1.0.0")
+		r.Header.Set("Content-Type", "application/offset+octet-stream")
+		for i := 0; i < len(hdrs); i += 2 {
+			r.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("f.txt"))
+	content := func() string {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(dir, "f.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	entries := func() int {
+		t.Helper()
+		list, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(list)
+	}
+
+	if w := do("POST", "/", "", "Upload-Length", "11", "Upload-Metadata", metadata); w.Code != http.StatusCreated {
+		t.Fatalf("POST: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := do("PATCH", "/f.txt", "hello", "Upload-Offset", "0"); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if got := content(); got != "original" {
+		t.Fatalf("content of an incomplete upload: got %q, want %q", got, "original")
+	}
+
+	// The temporary file of an expired upload is removed.
+	h.ResumableUploads.Expiry = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	if w := do("HEAD", "/f.txt", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("HEAD of an expired upload: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if n := entries(); n != 1 {
+		t.Fatalf("entries after expiry: got %d, want 1", n)
+	}
+	if got := content(); got != "original" {
+		t.Fatalf("content of an expired upload: got %q, want %q", got, "original")
+	}
+
+	h.ResumableUploads.Expiry = 0
+	if w := do("POST", "/", "", "Upload-Length", "11", "Upload-Metadata", metadata); w.Code != http.StatusCreated {
+		t.Fatalf("POST: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := do("PATCH", "/f.txt", "hello", "Upload-Offset", "0"); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := do("PATCH", "/f.txt", " world", "Upload-Offset", "5"); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if got := content(); got != "hello world" {
+		t.Fatalf("content of a complete upload: got %q, want %q", got, "hello world")
+	}
+	if n := entries(); n != 1 {
+		t.Fatalf("entries after the upload: got %d, want 1", n)
+	}
+}
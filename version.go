@@ -0,0 +1,417 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	ixml "github.com/drakkan/webdav/internal/xml"
+)
+
+// versionsPath is the path of the virtual collection holding the version
+// histories of the files of a VersionedFS.
+const versionsPath = "/.versions"
+
+var versionTreeReportName = xml.Name{Space: "DAV:", Local: "version-tree"}
+
+// FileVersion describes a version of a file.
+type FileVersion struct {
+	// ID identifies the version among the versions of the file. It must not
+	// contain slashes.
+	ID      string
+	Size    int64
+	ModTime time.Time
+	// Creator, if non-empty, is the name of who created the version.
+	Creator string
+	// Comment, if non-empty, describes the version.
+	Comment string
+}
+
+// VersionedFS is an optional interface for the FileSystem, exposing the
+// history of files kept by backends with native versioning, such as S3
+// versioned buckets or file system snapshots, to RFC 3253 DeltaV clients.
+//
+// All the files are considered under version control: their version
+// history is listed by the version-tree REPORT and reported by the
+// DAV:version-history and DAV:checked-in properties. The versions of file
+// name are served at the virtual path "/.versions/name/id", and restored
+// with the UPDATE method. Collections are not versioned.
+type VersionedFS interface {
+	// ListVersions returns the versions of file name, the current one
+	// first.
+	ListVersions(ctx context.Context, name string) ([]FileVersion, error)
+	// OpenVersion opens the version id of file name for reading. It returns
+	// an error wrapping os.ErrNotExist if there is no such version.
+	OpenVersion(ctx context.Context, name, id string) (File, error)
+	// Restore makes the version id of file name its current content.
+	Restore(ctx context.Context, name, id string) error
+}
+
+func supportsVersions(fs FileSystem, fi os.FileInfo) bool {
+	_, ok := fs.(VersionedFS)
+	return ok && !fi.IsDir()
+}
+
+// versionHistoryHref returns the URL path of the version history of file
+// name, served by the Handler with prefix.
+func versionHistoryHref(prefix, name string) string {
+	return path.Join("/", prefix, versionsPath, name) + "/"
+}
+
+func findVersionHistory(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	return `<D:href xmlns:D="DAV:">` + escapeXML(hrefPath(versionHistoryHref(handlerPrefix(ctx), name))) + `</D:href>`, nil
+}
+
+func findCheckedIn(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	versions, err := fs.(VersionedFS).ListVersions(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if len(versions) == 0 {
+		return "", ErrNotImplemented
+	}
+	href := versionHistoryHref(handlerPrefix(ctx), name) + versions[0].ID
+	return `<D:href xmlns:D="DAV:">` + escapeXML(hrefPath(href)) + `</D:href>`, nil
+}
+
+type handlerPrefixKey struct{}
+
+func withHandlerPrefix(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, handlerPrefixKey{}, prefix)
+}
+
+// handlerPrefix returns the Prefix of the Handler serving ctx.
+func handlerPrefix(ctx context.Context) string {
+	prefix, _ := ctx.Value(handlerPrefixKey{}).(string)
+	return prefix
+}
+
+// handleVersionControl serves the VERSION-CONTROL method, defined by RFC
+// 3253 section 3.5. The files of a VersionedFS are always under version
+// control.
+func (h *Handler) handleVersionControl(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	if _, ok := h.FileSystem.(VersionedFS); !ok {
+		return http.StatusMethodNotAllowed, errUnsupportedMethod
+	}
+	fi, err := h.FileSystem.Stat(r.Context(), reqPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
+		return http.StatusMethodNotAllowed, err
+	}
+	if fi.IsDir() {
+		return http.StatusMethodNotAllowed, errUnsupportedMethod
+	}
+	return http.StatusOK, nil
+}
+
+// updateRequest is the body of an UPDATE request.
+// See RFC 3253 section 3.13.
+type updateRequest struct {
+	XMLName ixml.Name `xml:"DAV: update"`
+	Href    string    `xml:"DAV: version>href"`
+}
+
+// handleUpdate serves the UPDATE method, defined by RFC 3253 section 3.13,
+// restoring a version of a file.
+func (h *Handler) handleUpdate(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	vfs, ok := h.FileSystem.(VersionedFS)
+	if !ok {
+		return http.StatusMethodNotAllowed, errUnsupportedMethod
+	}
+	if status, err := h.checkRetention(r.Context(), w, reqPath); err != nil {
+		return status, err
+	}
+	release, status, err := h.confirmLocks(r, reqPath, "")
+	if err != nil {
+		return status, err
+	}
+	defer release()
+
+	var ur updateRequest
+	if err := ixml.NewDecoder(r.Body).Decode(&ur); err != nil {
+		return http.StatusBadRequest, errInvalidUpdate
+	}
+	u, err := url.Parse(strings.TrimSpace(ur.Href))
+	if err != nil {
+		return http.StatusBadRequest, errInvalidUpdate
+	}
+	versionPath, status, err := h.stripPrefix(u.Path)
+	if err != nil {
+		return status, err
+	}
+	ctx := r.Context()
+	name, id, err := h.parseVersionPath(ctx, versionPath)
+	if err != nil || id == "" || name != slashClean(reqPath) {
+		return http.StatusConflict, errInvalidUpdate
+	}
+	if err := vfs.Restore(ctx, name, id); err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusConflict, err
+		}
+		if os.IsPermission(err) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	mw := multistatusWriter{w: w, canonical: h.CanonicalXML, ctx: ctx}
+	writeErr := mw.write(&response{
+		Href:   []string{hrefPath(path.Join(h.Prefix, name))},
+		Status: fmt.Sprintf("HTTP/1.1 %d %s", http.StatusOK, StatusText(http.StatusOK)),
+	})
+	closeErr := mw.close()
+	if writeErr != nil {
+		return http.StatusInternalServerError, writeErr
+	}
+	if closeErr != nil {
+		return http.StatusInternalServerError, closeErr
+	}
+	return 0, nil
+}
+
+// isVersionRequest reports whether r targets the virtual collection holding
+// the version histories.
+func (h *Handler) isVersionRequest(r *http.Request) bool {
+	if _, ok := h.FileSystem.(VersionedFS); !ok {
+		return false
+	}
+	reqPath, _, err := h.stripPrefix(r.URL.Path)
+	return err == nil && isWithin(slashClean(reqPath), versionsPath)
+}
+
+// parseVersionPath returns the name of the file whose version history, or
+// whose version id, is at the virtual path reqPath. id is empty for the
+// version history.
+func (h *Handler) parseVersionPath(ctx context.Context, reqPath string) (name, id string, err error) {
+	reqPath = slashClean(reqPath)
+	if !isWithin(reqPath, versionsPath) || reqPath == versionsPath {
+		return "", "", os.ErrNotExist
+	}
+	name = strings.TrimPrefix(reqPath, versionsPath)
+	if fi, err := h.FileSystem.Stat(ctx, name); err == nil && !fi.IsDir() {
+		return name, "", nil
+	}
+	name, id = path.Dir(name), path.Base(name)
+	if fi, err := h.FileSystem.Stat(ctx, name); err != nil || fi.IsDir() {
+		return "", "", os.ErrNotExist
+	}
+	return name, id, nil
+}
+
+// serveVersions serves the read-only version histories and versions.
+func (h *Handler) serveVersions(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	ctx := r.Context()
+	name, id, err := h.parseVersionPath(ctx, reqPath)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	vfs := h.FileSystem.(VersionedFS)
+	versions, err := vfs.ListVersions(ctx, name)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	i := -1
+	if id != "" {
+		for j := range versions {
+			if versions[j].ID == id {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return http.StatusNotFound, os.ErrNotExist
+		}
+	}
+
+	switch r.Method {
+	case "OPTIONS":
+		allow := "OPTIONS, PROPFIND"
+		if id != "" {
+			allow = "OPTIONS, GET, HEAD, PROPFIND"
+		}
+		w.Header().Set("Allow", allow)
+		w.Header().Set("DAV", "1, version-control")
+		return 0, nil
+	case "GET", "HEAD":
+		if id == "" {
+			return http.StatusMethodNotAllowed, errUnsupportedMethod
+		}
+		f, err := vfs.OpenVersion(ctx, name, id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return http.StatusNotFound, err
+			}
+			return http.StatusInternalServerError, err
+		}
+		defer f.Close()
+		// Versions never change, their ID is a strong validator.
+		w.Header().Set("ETag", strconv.Quote(id))
+		http.ServeContent(w, h.limitRanges(r), path.Base(name), versions[i].ModTime, f)
+		return 0, nil
+	case "PROPFIND":
+	default:
+		return http.StatusMethodNotAllowed, errUnsupportedMethod
+	}
+
+	depth := 1
+	if hdr := r.Header.Get("Depth"); hdr != "" {
+		depth = parseDepth(hdr)
+		if depth == invalidDepth {
+			return http.StatusBadRequest, errInvalidDepth
+		}
+	}
+	if depth == infiniteDepth {
+		return http.StatusForbidden, errInvalidDepth
+	}
+	pf, status, err := readPropfind(r.Body)
+	if err != nil {
+		return status, err
+	}
+	mw := multistatusWriter{w: w, canonical: h.CanonicalXML, ctx: ctx}
+	var writeErr error
+	if id != "" {
+		writeErr = h.writeVersion(&mw, name, versions, i, pf)
+	} else {
+		history := []Property{{
+			XMLName:  xml.Name{Space: "DAV:", Local: "resourcetype"},
+			InnerXML: []byte(`<D:version-history xmlns:D="DAV:"/>`),
+		}}
+		writeErr = mw.write(makePropstatResponse(versionHistoryHref(h.Prefix, name), staticPropstats(history, pf)))
+		for i := range versions {
+			if writeErr != nil || depth == 0 {
+				break
+			}
+			writeErr = h.writeVersion(&mw, name, versions, i, pf)
+		}
+	}
+	if h.listingAborted(r, &mw, writeErr) {
+		return 0, writeErr
+	}
+	closeErr := mw.close()
+	if writeErr != nil {
+		return http.StatusInternalServerError, writeErr
+	}
+	if closeErr != nil {
+		return http.StatusInternalServerError, closeErr
+	}
+	return 0, nil
+}
+
+// writeVersion writes the response for versions[i] of file name, with the
+// properties requested by pf.
+func (h *Handler) writeVersion(mw *multistatusWriter, name string, versions []FileVersion, i int, pf propfind) error {
+	history := versionHistoryHref(h.Prefix, name)
+	href := func(v FileVersion) string {
+		return `<D:href xmlns:D="DAV:">` + escapeXML(hrefPath(history+v.ID)) + `</D:href>`
+	}
+	v := versions[i]
+	props := []Property{
+		{XMLName: xml.Name{Space: "DAV:", Local: "resourcetype"}},
+		{XMLName: xml.Name{Space: "DAV:", Local: "version-name"}, InnerXML: []byte(escapeXML(v.ID))},
+		{XMLName: xml.Name{Space: "DAV:", Local: "getcontentlength"}, InnerXML: []byte(strconv.FormatInt(v.Size, 10))},
+		{XMLName: xml.Name{Space: "DAV:", Local: "getlastmodified"}, InnerXML: []byte(v.ModTime.UTC().Format(http.TimeFormat))},
+		{XMLName: xml.Name{Space: "DAV:", Local: "getetag"}, InnerXML: []byte(escapeXML(strconv.Quote(v.ID)))},
+		{XMLName: xml.Name{Space: "DAV:", Local: "version-history"}, InnerXML: []byte(`<D:href xmlns:D="DAV:">` + escapeXML(hrefPath(history)) + `</D:href>`)},
+	}
+	// The versions are linear, the current one first.
+	var predecessors, successors string
+	if i+1 < len(versions) {
+		predecessors = href(versions[i+1])
+	}
+	if i > 0 {
+		successors = href(versions[i-1])
+	}
+	props = append(props,
+		Property{XMLName: xml.Name{Space: "DAV:", Local: "predecessor-set"}, InnerXML: []byte(predecessors)},
+		Property{XMLName: xml.Name{Space: "DAV:", Local: "successor-set"}, InnerXML: []byte(successors)},
+	)
+	if v.Creator != "" {
+		props = append(props, Property{XMLName: xml.Name{Space: "DAV:", Local: "creator-displayname"}, InnerXML: []byte(escapeXML(v.Creator))})
+	}
+	if v.Comment != "" {
+		props = append(props, Property{XMLName: xml.Name{Space: "DAV:", Local: "comment"}, InnerXML: []byte(escapeXML(v.Comment))})
+	}
+	return mw.write(makePropstatResponse(history+v.ID, staticPropstats(props, pf)))
+}
+
+// versionTree is the body of a version-tree REPORT.
+// See RFC 3253 section 3.7.
+type versionTree struct {
+	XMLName ixml.Name     `xml:"DAV: version-tree"`
+	Prop    propfindProps `xml:"DAV: prop"`
+}
+
+// versionTreeReport serves the version-tree REPORT, defined by RFC 3253
+// section 3.7, listing the versions of a file.
+func (h *Handler) versionTreeReport(ctx context.Context, w http.ResponseWriter, r *http.Request, report Report) error {
+	vfs, ok := h.FileSystem.(VersionedFS)
+	if !ok {
+		return os.ErrPermission
+	}
+	var vt versionTree
+	if err := ixml.NewDecoder(bytes.NewReader(report.Body)).Decode(&vt); err != nil {
+		return ErrInvalidReport
+	}
+	fi, err := h.FileSystem.Stat(ctx, report.Name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return ErrInvalidReport
+	}
+	versions, err := vfs.ListVersions(ctx, report.Name)
+	if err != nil {
+		return err
+	}
+	mw := multistatusWriter{w: w, canonical: h.CanonicalXML, ctx: ctx}
+	writeErr := mw.writeHeader()
+	for i := range versions {
+		if writeErr != nil {
+			break
+		}
+		writeErr = h.writeVersion(&mw, report.Name, versions, i, propfind{Prop: vt.Prop})
+	}
+	if h.listingAborted(r, &mw, writeErr) {
+		return nil
+	}
+	closeErr := mw.close()
+	if writeErr != nil {
+		return writeErr
+	}
+	return closeErr
+}
@@ -0,0 +1,228 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testVersionedFS keeps the versions of its files in another memFS, named
+// after the escaped name of the file and the version ID.
+type testVersionedFS struct {
+	FileSystem
+	store    FileSystem
+	versions map[string][]FileVersion
+}
+
+func (fs *testVersionedFS) addVersion(t *testing.T, name, id, content string) {
+	ctx := context.Background()
+	for _, n := range []string{versionStoreName(name, id), name} {
+		dst := FileSystem(fs)
+		if n != name {
+			dst = fs.store
+		}
+		f, err := dst.OpenFile(ctx, n, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+		f.Close()
+	}
+	v := FileVersion{ID: id, Size: int64(len(content)), ModTime: time.Unix(int64(len(fs.versions[name])), 0), Creator: "alice"}
+	fs.versions[name] = append([]FileVersion{v}, fs.versions[name]...)
+}
+
+func (fs *testVersionedFS) ListVersions(ctx context.Context, name string) ([]FileVersion, error) {
+	return fs.versions[name], nil
+}
+
+func (fs *testVersionedFS) OpenVersion(ctx context.Context, name, id string) (File, error) {
+	return fs.store.OpenFile(ctx, versionStoreName(name, id), os.O_RDONLY, 0)
+}
+
+func versionStoreName(name, id string) string {
+	return "/" + strings.ReplaceAll(name, "/", "_") + "@" + id
+}
+
+func (fs *testVersionedFS) Restore(ctx context.Context, name, id string) error {
+	src, err := fs.OpenVersion(ctx, name, id)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := fs.OpenFile(ctx, name, os.O_RDWR|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func TestVersions(t *testing.T) {
+	mem, err := buildTestFS([]string{"mkdir /d"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	fs := &testVersionedFS{FileSystem: mem, store: NewMemFS(), versions: make(map[string][]FileVersion)}
+	fs.addVersion(t, "/d/f", "v1", "first")
+	fs.addVersion(t, "/d/f", "v2", "second")
+	h := &Handler{FileSystem: fs, LockSystem: NewMemLS(), Prefix: "/dav"}
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	testCases := []struct {
+		desc, method, target, body, depth string
+		wantStatus                        int
+		want                              []string
+	}{{
+		"version control of a file",
+		"VERSION-CONTROL", "/dav/d/f", "", "",
+		http.StatusOK,
+		nil,
+	}, {
+		"version control of a collection",
+		"VERSION-CONTROL", "/dav/d", "", "",
+		http.StatusMethodNotAllowed,
+		nil,
+	}, {
+		"properties",
+		"PROPFIND", "/dav/d/f", `<D:propfind xmlns:D="DAV:"><D:prop><D:checked-in/><D:version-history/></D:prop></D:propfind>`, "0",
+		StatusMulti,
+		[]string{
+			`<D:checked-in><D:href xmlns:D="DAV:">/dav/.versions/d/f/v2</D:href></D:checked-in>`,
+			`<D:version-history><D:href xmlns:D="DAV:">/dav/.versions/d/f/</D:href></D:version-history>`,
+		},
+	}, {
+		"version tree",
+		"REPORT", "/dav/d/f", `<D:version-tree xmlns:D="DAV:"><D:prop><D:version-name/><D:predecessor-set/><D:creator-displayname/></D:prop></D:version-tree>`, "0",
+		StatusMulti,
+		[]string{
+			`<D:href>/dav/.versions/d/f/v2</D:href><D:propstat><D:prop><D:version-name>v2</D:version-name>` +
+				`<D:predecessor-set><D:href xmlns:D="DAV:">/dav/.versions/d/f/v1</D:href></D:predecessor-set>` +
+				`<D:creator-displayname>alice</D:creator-displayname>`,
+			`<D:href>/dav/.versions/d/f/v1</D:href><D:propstat><D:prop><D:version-name>v1</D:version-name>` +
+				`<D:predecessor-set></D:predecessor-set>`,
+		},
+	}, {
+		"version history",
+		"PROPFIND", "/dav/.versions/d/f/", `<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/></D:prop></D:propfind>`, "1",
+		StatusMulti,
+		[]string{
+			`<D:href>/dav/.versions/d/f/</D:href><D:propstat><D:prop><D:resourcetype><D:version-history xmlns:D="DAV:"/></D:resourcetype>`,
+			`<D:href>/dav/.versions/d/f/v1</D:href>`,
+		},
+	}, {
+		"get a version",
+		"GET", "/dav/.versions/d/f/v1", "", "",
+		http.StatusOK,
+		[]string{"first"},
+	}, {
+		"unknown version",
+		"GET", "/dav/.versions/d/f/v3", "", "",
+		http.StatusNotFound,
+		nil,
+	}, {
+		"versions are read-only",
+		"DELETE", "/dav/.versions/d/f/v1", "", "",
+		http.StatusMethodNotAllowed,
+		nil,
+	}, {
+		"restore of another file",
+		"UPDATE", "/dav/d/f", `<D:update xmlns:D="DAV:"><D:version><D:href>/dav/.versions/d/g/v1</D:href></D:version></D:update>`, "",
+		http.StatusConflict,
+		nil,
+	}, {
+		"restore",
+		"UPDATE", "/dav/d/f", `<D:update xmlns:D="DAV:"><D:version><D:href>http://example.com/dav/.versions/d/f/v1</D:href></D:version></D:update>`, "",
+		StatusMulti,
+		[]string{`<D:href>/dav/d/f</D:href><D:status>HTTP/1.1 200 OK</D:status>`},
+	}, {
+		"restored content",
+		"GET", "/dav/d/f", "", "",
+		http.StatusOK,
+		[]string{"first"},
+	}}
+
+	for _, tc := range testCases {
+		w := do(tc.method, tc.target, tc.body, "Depth", tc.depth)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s: got %s, want %s", tc.desc, w.Body.String(), want)
+			}
+		}
+	}
+
+	w := do("OPTIONS", "/dav/d/f", "")
+	if got := w.Header().Get("DAV"); !strings.Contains(got, "version-control") {
+		t.Errorf("OPTIONS: DAV header %q does not advertise version-control", got)
+	}
+	if got := w.Header().Get("Allow"); !strings.Contains(got, "VERSION-CONTROL") || !strings.Contains(got, "REPORT") {
+		t.Errorf("OPTIONS: Allow header %q does not include VERSION-CONTROL and REPORT", got)
+	}
+}
+
+func TestUpdateRetained(t *testing.T) {
+	// The retention properties are read from the PropStore, so the files
+	// must not hold their dead properties.
+	dir := Dir(t.TempDir())
+	if err := dir.Mkdir(context.Background(), "/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs := &testVersionedFS{FileSystem: dir, store: NewMemFS(), versions: make(map[string][]FileVersion)}
+	fs.addVersion(t, "/d/f", "v1", "first")
+	fs.addVersion(t, "/d/f", "v2", "second")
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		PropStore:  NewMemPropStore(),
+		CanHold:    func(r *http.Request, principal string) bool { return true },
+	}
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	hold := `<D:propertyupdate xmlns:D="DAV:" xmlns:W="https://github.com/drakkan/webdav"><D:set><D:prop>` +
+		`<W:legal-hold>1</W:legal-hold></D:prop></D:set></D:propertyupdate>`
+	if w := do("PROPPATCH", "/d/f", hold); !strings.Contains(w.Body.String(), "200 OK") {
+		t.Fatalf("PROPPATCH: got %s, want the hold set", w.Body.String())
+	}
+	update := `<D:update xmlns:D="DAV:"><D:version><D:href>/.versions/d/f/v1</D:href></D:version></D:update>`
+	if w := do("UPDATE", "/d/f", update); w.Code != http.StatusForbidden {
+		t.Errorf("UPDATE of a held file: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := do("GET", "/d/f", ""); w.Body.String() != "second" {
+		t.Errorf("GET: got %q, want %q", w.Body.String(), "second")
+	}
+}
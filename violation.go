@@ -0,0 +1,174 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ProtocolViolation identifies a class of client protocol violations.
+type ProtocolViolation string
+
+// Protocol violations reported to Handler.OnViolation.
+const (
+	// ViolationMissingDepth is reported for PROPFIND requests without a
+	// Depth header. RFC 4918 requires handling them as "Depth: infinity",
+	// but the Handler assumes "Depth: 1" instead, which may not be what the
+	// client wants.
+	ViolationMissingDepth ProtocolViolation = "missing-depth"
+	// ViolationInvalidDepth is reported for invalid Depth headers.
+	ViolationInvalidDepth ProtocolViolation = "invalid-depth"
+	// ViolationInvalidIfHeader is reported for If headers that cannot be
+	// parsed.
+	ViolationInvalidIfHeader ProtocolViolation = "invalid-if-header"
+	// ViolationInvalidDestination is reported for missing, malformed or
+	// foreign Destination headers.
+	ViolationInvalidDestination ProtocolViolation = "invalid-destination"
+	// ViolationInvalidLockToken is reported for malformed lock tokens.
+	ViolationInvalidLockToken ProtocolViolation = "invalid-lock-token"
+	// ViolationInvalidTimeout is reported for invalid Timeout headers.
+	ViolationInvalidTimeout ProtocolViolation = "invalid-timeout"
+	// ViolationInvalidBody is reported for malformed LOCK, PROPFIND and
+	// PROPPATCH request bodies.
+	ViolationInvalidBody ProtocolViolation = "invalid-body"
+	// ViolationETagMisuse is reported for If-Match and If-None-Match
+	// headers with unquoted entity tags, or weak entity tags in If-Match.
+	ViolationETagMisuse ProtocolViolation = "etag-misuse"
+)
+
+// violationErrors maps the errors returned for malformed requests to the
+// protocol violations they reveal.
+var violationErrors = map[error]ProtocolViolation{
+	errInvalidDepth:       ViolationInvalidDepth,
+	errInvalidIfHeader:    ViolationInvalidIfHeader,
+	errInvalidDestination: ViolationInvalidDestination,
+	errInvalidLockToken:   ViolationInvalidLockToken,
+	errInvalidTimeout:     ViolationInvalidTimeout,
+	errInvalidLockInfo:    ViolationInvalidBody,
+	errInvalidPropfind:    ViolationInvalidBody,
+	errInvalidProppatch:   ViolationInvalidBody,
+}
+
+// requestViolations returns the protocol violations of r that do not cause
+// the request to fail.
+func requestViolations(r *http.Request) []ProtocolViolation {
+	var ret []ProtocolViolation
+	if r.Method == "PROPFIND" && r.Header.Get("Depth") == "" {
+		ret = append(ret, ViolationMissingDepth)
+	}
+	if misusedETags(r.Header.Get("If-Match"), false) || misusedETags(r.Header.Get("If-None-Match"), true) {
+		ret = append(ret, ViolationETagMisuse)
+	}
+	return ret
+}
+
+// misusedETags reports whether the If-Match or If-None-Match header value s
+// contains unquoted entity tags, or weak ones if weakAllowed is false.
+func misusedETags(s string, weakAllowed bool) bool {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "*" {
+		return false
+	}
+	for _, etag := range strings.Split(s, ",") {
+		etag = strings.TrimSpace(etag)
+		if strings.HasPrefix(etag, "W/") {
+			if !weakAllowed {
+				return true
+			}
+			etag = etag[2:]
+		}
+		if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+			return true
+		}
+	}
+	return false
+}
+
+// reportViolations calls h.OnViolation for the protocol violations of r and
+// the one revealed by err, if any.
+func (h *Handler) reportViolations(r *http.Request, err error) {
+	if h.OnViolation == nil {
+		return
+	}
+	for _, v := range requestViolations(r) {
+		h.OnViolation(r, v)
+	}
+	if v, ok := violationErrors[err]; ok {
+		h.OnViolation(r, v)
+	}
+}
+
+// ViolationOtherAgents is the User-Agent the violations are counted for by
+// a ViolationCounter once it counts MaxUserAgents User-Agents.
+const ViolationOtherAgents = "(other)"
+
+// defaultMaxViolationAgents is the number of User-Agents counted by a
+// ViolationCounter if its MaxUserAgents is zero.
+const defaultMaxViolationAgents = 100
+
+// ViolationCounter counts protocol violations per User-Agent. Its Record
+// method can be used as Handler.OnViolation.
+//
+// The zero value is ready to use.
+type ViolationCounter struct {
+	// MaxUserAgents is the maximum number of User-Agents counted, so that
+	// clients sending random User-Agent values cannot grow the counters
+	// without bound. The violations of the other User-Agents are counted
+	// together as ViolationOtherAgents. If zero, 100 User-Agents are
+	// counted.
+	MaxUserAgents int
+
+	mu     sync.Mutex
+	counts map[string]map[ProtocolViolation]uint64
+}
+
+// Record counts the protocol violation v of r.
+func (c *ViolationCounter) Record(r *http.Request, v ProtocolViolation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]map[ProtocolViolation]uint64)
+	}
+	ua := r.UserAgent()
+	max := c.MaxUserAgents
+	if max <= 0 {
+		max = defaultMaxViolationAgents
+	}
+	if c.counts[ua] == nil && len(c.counts) >= max {
+		ua = ViolationOtherAgents
+	}
+	if c.counts[ua] == nil {
+		c.counts[ua] = make(map[ProtocolViolation]uint64)
+	}
+	c.counts[ua][v]++
+}
+
+// Counts returns a copy of the counters, keyed by User-Agent and violation.
+func (c *ViolationCounter) Counts() map[string]map[ProtocolViolation]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := make(map[string]map[ProtocolViolation]uint64, len(c.counts))
+	for ua, counts := range c.counts {
+		ret[ua] = make(map[ProtocolViolation]uint64, len(counts))
+		for v, n := range counts {
+			ret[ua][v] = n
+		}
+	}
+	return ret
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMisusedETags(t *testing.T) {
+	testCases := []struct {
+		s           string
+		weakAllowed bool
+		want        bool
+	}{
+		{"", false, false},
+		{"*", false, false},
+		{`"abc"`, false, false},
+		{`"abc", "def"`, false, false},
+		{`abc`, false, true},
+		{`"abc", def`, false, true},
+		{`W/"abc"`, false, true},
+		{`W/"abc"`, true, false},
+		{`W/abc`, true, true},
+	}
+
+	for _, tc := range testCases {
+		if got := misusedETags(tc.s, tc.weakAllowed); got != tc.want {
+			t.Errorf("misusedETags(%q, %t): got %t, want %t", tc.s, tc.weakAllowed, got, tc.want)
+		}
+	}
+}
+
+func TestViolationCounter(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /a", "touch /a/1"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	c := &ViolationCounter{}
+	h := &Handler{
+		FileSystem:  fs,
+		LockSystem:  NewMemLS(),
+		OnViolation: c.Record,
+	}
+	testCases := []struct {
+		method, target, userAgent string
+		headers                   []string
+	}{
+		{"PROPFIND", "/a", "client1", nil},
+		{"PROPFIND", "/a", "client1", []string{"Depth", "1"}},
+		{"PROPFIND", "/a", "client2", []string{"Depth", "2"}},
+		{"COPY", "/a/1", "client2", nil},
+		{"PUT", "/a/1", "client2", []string{"If", "junk"}},
+		{"PUT", "/a/1", "client3", []string{"If-Match", "abc"}},
+		{"LOCK", "/a/1", "client3", []string{"Timeout", "Second-x"}},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		r.Header.Set("User-Agent", tc.userAgent)
+		for i := 0; i+1 < len(tc.headers); i += 2 {
+			r.Header.Set(tc.headers[i], tc.headers[i+1])
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	want := map[string]map[ProtocolViolation]uint64{
+		"client1": {
+			ViolationMissingDepth: 1,
+		},
+		"client2": {
+			ViolationInvalidDepth:       1,
+			ViolationInvalidDestination: 1,
+			ViolationInvalidIfHeader:    1,
+		},
+		"client3": {
+			ViolationETagMisuse:     1,
+			ViolationInvalidTimeout: 1,
+		},
+	}
+	if got := c.Counts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestViolationCounterMaxUserAgents(t *testing.T) {
+	c := &ViolationCounter{MaxUserAgents: 2}
+	for _, ua := range []string{"client1", "client2", "client3", "client4", "client1"} {
+		r := httptest.NewRequest("PROPFIND", "/", nil)
+		r.Header.Set("User-Agent", ua)
+		c.Record(r, ViolationMissingDepth)
+	}
+	want := map[string]map[ProtocolViolation]uint64{
+		"client1":            {ViolationMissingDepth: 2},
+		"client2":            {ViolationMissingDepth: 1},
+		ViolationOtherAgents: {ViolationMissingDepth: 2},
+	}
+	if got := c.Counts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
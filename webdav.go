@@ -20,15 +20,20 @@
 package webdav // import "github.com/drakkan/webdav"
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -41,8 +46,282 @@ type Handler struct {
 	// LockSystem is the lock management system.
 	LockSystem LockSystem
 	// Logger is an optional error logger. If non-nil, it will be called
-	// for all HTTP requests.
+	// for all HTTP requests, and for the errors that do not fail a request,
+	// such as a response header that cannot be computed, with the status of
+	// its response.
 	Logger func(*http.Request, int, error)
+	// LockNullResources enables the RFC 2518 lock-null resources compatibility
+	// mode for legacy clients. If true, a LOCK on an unmapped URL does not
+	// create an empty resource: the lock-null resource is reported in the
+	// PROPFIND responses of its parent collection, if the LockSystem
+	// implements LockNullLister, and it disappears once unlocked unless it
+	// was created in the meantime by a PUT or a MKCOL.
+	LockNullResources bool
+	// Principal optionally returns the name of the authenticated principal
+	// issuing the request. An empty name means an anonymous request.
+	Principal func(*http.Request) string
+	// LockLimits are optional limits to the number of locks created by LOCK
+	// requests. They are only enforced if the LockSystem implements
+	// LimitedLocker.
+	LockLimits LockLimits
+	// Operations, if non-nil, allows clients to run COPY, MOVE and DELETE
+	// requests asynchronously. See Operations.
+	Operations *Operations
+	// StrictUnlock, if true, only allows the principal that created a lock
+	// to UNLOCK it, other principals get a "403 Forbidden" HTTP status. If
+	// false, any client knowing the lock token may UNLOCK it. It is only
+	// enforced if the LockSystem implements TokenLookup. See Principal.
+	StrictUnlock bool
+	// MaxLockTimeout, if positive, is the maximum timeout granted to locks.
+	// The first value of the Timeout header not exceeding it is granted,
+	// infinite timeouts are never granted. If no value is acceptable, the
+	// lock gets MaxLockTimeout.
+	MaxLockTimeout time.Duration
+	// MinLockTimeout, if positive, is the minimum timeout granted to locks:
+	// shorter timeouts, including "Second-0", are raised to it, but never
+	// above MaxLockTimeout. Otherwise, locks requesting a zero timeout,
+	// which would expire before the response reaches the client, are
+	// refused with "400 Bad Request".
+	MinLockTimeout time.Duration
+	// Messages, if non-nil, localizes the human-readable response bodies
+	// according to the Accept-Language header. See MessageCatalog.
+	Messages MessageCatalog
+	// OnViolation, if non-nil, is called for each client protocol violation
+	// detected while serving a request, so that operators can identify
+	// misbehaving clients. See ViolationCounter.
+	OnViolation func(*http.Request, ProtocolViolation)
+	// VerifyWrites enables a paranoid mode for unreliable backends: the
+	// files written by PUT requests are read back and the request fails
+	// with "500 Internal Server Error" if their content does not match the
+	// request body. It trades throughput for integrity.
+	VerifyWrites bool
+	// PropStore, if non-nil, stores the dead properties of the resources,
+	// in place of the files implementing DeadPropsHolder. See PropStore.
+	PropStore PropStore
+	// RequireSecureCredentials, if true, refuses with "403 Forbidden" the
+	// requests carrying credentials in the Authorization header that were
+	// not received over TLS, so that misconfigured deployments don't leak
+	// Basic credentials. Requests from loopback addresses and from
+	// InsecureNetworks are still allowed.
+	RequireSecureCredentials bool
+	// InsecureNetworks lists the client networks allowed to send
+	// credentials over plaintext HTTP if RequireSecureCredentials is set,
+	// for example a trusted reverse proxy terminating TLS.
+	InsecureNetworks []*net.IPNet
+	// PrincipalURL optionally returns the URL path of the principal resource of
+	// the authenticated user issuing the request, reported by the RFC 5397
+	// DAV:current-user-principal property. CalDAV and CardDAV clients use
+	// it to discover the user's calendars and address books after
+	// following the redirects of WellKnown. An empty path means an anonymous
+	// request.
+	PrincipalURL func(*http.Request) string
+	// PresignPolicy, if non-nil, reports whether the GET or PUT request r
+	// for resource name may be answered with a "307 Temporary Redirect" to
+	// a URL returned by the FileSystem, if it implements Presigner, so that
+	// the data is transferred directly with the storage backend. Locks are
+	// still checked by the Handler before redirecting PUT requests, which
+	// are never redirected if VerifyWrites is set.
+	PresignPolicy func(r *http.Request, name string) bool
+	// CanonicalXML, if true, makes the multistatus responses deterministic:
+	// the responses are sorted by href, and the propstats and properties
+	// within them by status and by name. The namespace prefixes are always
+	// consistent: "D" for DAV: and a default namespace declaration on the
+	// other properties. It is useful for golden file testing and for
+	// clients assuming an order, but responses are buffered until complete.
+	CanonicalXML bool
+	// FeatureFlags, if non-nil, reports whether feature is enabled for the
+	// request r, issued by principal, on resource name, so that operators
+	// can roll extensions out gradually or restrict them to some users or
+	// shares. It is consulted at request time, before using an extension.
+	// If nil, all features are enabled.
+	FeatureFlags func(r *http.Request, feature Feature, principal, name string) bool
+	// QuotaWarnings are usage percentages of the quota of collections, as
+	// reported by a FileSystem implementing QuotaFS, from which users are
+	// warned before writes start failing. The successful PUT, MKCOL, COPY
+	// and MOVE responses get an X-Quota-Warning header with the highest
+	// threshold crossed by the collection written to, for example "90%",
+	// also reported by its quota-warning vendor property.
+	QuotaWarnings []int
+	// AllowedPropNamespaces, if non-empty, lists the XML namespaces clients
+	// may set dead properties in using PROPPATCH, so that they can't
+	// pollute the PropStore. Setting a dead property in another namespace,
+	// or in one of DeniedPropNamespaces, fails with "403 Forbidden". Live
+	// properties and removals are not restricted.
+	AllowedPropNamespaces []string
+	// DeniedPropNamespaces lists the XML namespaces clients may not set
+	// dead properties in. See AllowedPropNamespaces.
+	DeniedPropNamespaces []string
+	// Admin, if non-nil, is the administrative API of the Handler, which
+	// reports its data transfers to it and honors its maintenance mode.
+	// See NewAdmin.
+	Admin *Admin
+	// TreeLimits, if non-zero, refuses DELETE and COPY requests on
+	// collections that are too deep, have too many members or, for COPY,
+	// are too large.
+	TreeLimits TreeLimits
+	// OnPropChange, if non-nil, is called after a PROPPATCH request
+	// successfully set or removed the properties props of the resource
+	// name, on behalf of principal. See Principal.
+	OnPropChange func(r *http.Request, name string, props []xml.Name, principal string)
+	// OnAbortedListing, if non-nil, is called when the client of a
+	// PROPFIND, SEARCH or sync-collection REPORT request goes away while
+	// the response is streamed, after the given number of responses. The
+	// listing is stopped.
+	OnAbortedListing func(r *http.Request, responses int)
+	// CanChown, if non-nil, reports whether principal may change the owner
+	// and group properties of resources using PROPPATCH. It is only used
+	// if the FileSystem implements Chowner. See Principal.
+	CanChown func(r *http.Request, principal string) bool
+	// CanHold, if non-nil, enables the per-resource retention periods and
+	// legal holds, stored in the PropStore as the retain-until and
+	// legal-hold properties in the "https://github.com/drakkan/webdav"
+	// namespace, and reports whether principal may set them. While a
+	// resource is retained, the requests overwriting, moving or deleting it
+	// fail with "403 Forbidden".
+	CanHold func(r *http.Request, principal string) bool
+	// InvalidNames is how PROPFIND responses list the resources whose names
+	// are not valid UTF-8. The default is InvalidNamesEscape.
+	InvalidNames InvalidNamePolicy
+	// ContentTypes configures how the content type of files is resolved.
+	ContentTypes ContentTypes
+	// LockTakeover, if non-nil, allows principals to take over the locks of
+	// others.
+	LockTakeover *LockTakeover
+	// DirDefaults are the defaults applied to the resources created below
+	// some collections.
+	DirDefaults []DirDefaults
+	// MaxPropfindResults, if positive, is the maximum number of members of a
+	// collection listed by a PROPFIND. Longer listings are truncated, and the
+	// client can ask for the rest with the X-Propfind-Offset header.
+	MaxPropfindResults int
+	// Scheduler, if non-nil, is told about the requests being served, so
+	// that the background work it schedules yields to them.
+	Scheduler *Scheduler
+	// Searcher, if non-nil, enables the SEARCH method, with the
+	// DAV:basicsearch grammar. WalkSearcher is a simple implementation.
+	Searcher Searcher
+	// AccessController, if non-nil, reports the RFC 3744 access control
+	// properties of resources. If it implements ACLSetter, the ACL method
+	// is enabled. See Principal and PrincipalURL.
+	AccessController AccessController
+	// ConcurrentPuts, if non-nil, defines what happens when two clients
+	// write the same file at once without locking it, and has the uploads
+	// written to a temporary file renamed over the target once complete.
+	// If nil, the uploads are written in place, unless their body has to
+	// be checked first.
+	ConcurrentPuts *ConcurrentPuts
+	// Principals, if non-nil, is the resolver of the principals served by
+	// the virtual "/principals/" collection, which hides the resources of
+	// the FileSystem at that path. Unless PrincipalURL is set, the
+	// DAV:current-user-principal property reports the member of this
+	// collection named as returned by Principal.
+	Principals PrincipalResolver
+	// MediaMetadata, if non-nil, exposes the media attributes of files,
+	// such as the dimensions of images, as properties.
+	MediaMetadata *MediaMetadata
+	// Conversions, if non-nil, serves files converted to other formats,
+	// such as "/report.docx?convert=pdf".
+	Conversions *Conversions
+	// UploadPipeline, if non-nil, adds stages to the pipeline reading the
+	// body of PUT requests to file name, such as a size limit or an
+	// antivirus BodyScanner.
+	UploadPipeline func(r *http.Request, name string, p *BodyPipeline)
+	// PartialUpdates, if true, allows updating byte ranges of files in
+	// place, with PUT requests having a Content-Range header, which RFC 7231
+	// section 4.3.4 discourages, and with SabreDAV PATCH requests. The File
+	// is written using io.WriterAt, if implemented. See also
+	// FeaturePartialUpdates.
+	PartialUpdates bool
+	// MaxRanges is the maximum number of ranges of the GET requests served
+	// as multipart/byteranges responses. The requests with more ranges are
+	// served the full content. If zero, a default of 100 is used, and a
+	// negative value disables the limit.
+	MaxRanges int
+	// AncestorProbes, if true, answers the OPTIONS and PROPFIND requests to
+	// the ancestors of Prefix, outside of the served tree, as read-only
+	// collections. Some Microsoft Office versions probe every ancestor of a
+	// document, up to the root, before opening it, and fail with "cannot
+	// open from server" otherwise. The Handler must be routed the requests
+	// to these ancestors, for example by being mounted at the root.
+	AncestorProbes bool
+	// Backoff, if non-nil, computes exponential Retry-After hints for the
+	// requests failing because the backend throttles them, reported by the
+	// FileSystem with a ThrottledError.
+	Backoff *Backoff
+	// ChunkStore, if non-nil, enables the chunked upload protocols of the
+	// ownCloud and Nextcloud clients, and holds the chunks of the uploads
+	// in progress. The PUT requests having an OC-Chunked header upload the
+	// chunks of a file named "<name>-chunking-<transfer>-<count>-<index>",
+	// assembled into name once all of them are received. See also
+	// UploadsPrefix.
+	ChunkStore ChunkStore
+	// UploadsPrefix is the URL path prefix, outside of Prefix, of the
+	// Nextcloud upload collections, such as "/remote.php/dav/uploads". An
+	// upload is created with MKCOL, its chunks are uploaded with PUT and
+	// listed with PROPFIND, and it is assembled by a MOVE of its ".file"
+	// member to the destination file, or discarded with DELETE. It is only
+	// used if ChunkStore is non-nil.
+	UploadsPrefix string
+	// MaxChunkedUploadSize is the maximum total size of the chunks of an
+	// upload, stored by ChunkStore: the chunks exceeding it are refused
+	// with "413 Request Entity Too Large". If zero, 10 GiB is used, and if
+	// negative the size is not limited.
+	MaxChunkedUploadSize int64
+	// ResumableUploads, if non-nil, enables the tus resumable upload
+	// protocol for the FileSystems implementing AppendFS. See
+	// ResumableUploads.
+	ResumableUploads *ResumableUploads
+
+	// liveProps are the live properties registered using
+	// RegisterLiveProperty.
+	liveProps map[xml.Name]liveProp
+	// reports are the reports registered using RegisterReport.
+	reports map[xml.Name]ReportHandler
+	// resourceTypes are the resource types registered using
+	// RegisterResourceType.
+	resourceTypes []ResourceTypeFunc
+	// namespaces are the namespaces registered using RegisterNamespace, by
+	// name.
+	namespaces map[string]Namespace
+	// postHandlers are the POST handlers registered using
+	// RegisterPostHandler, by prefix.
+	postHandlers map[string]PostHandler
+}
+
+func (h *Handler) principal(r *http.Request) string {
+	if h.Principal == nil {
+		return ""
+	}
+	return h.Principal(r)
+}
+
+// setQuotaWarning sets the X-Quota-Warning header of the response to the
+// successful write request r, if the collection written to crossed one of
+// the QuotaWarnings thresholds.
+func (h *Handler) setQuotaWarning(w http.ResponseWriter, r *http.Request) {
+	if len(h.QuotaWarnings) == 0 {
+		return
+	}
+	target := r.URL.Path
+	switch r.Method {
+	case "PUT", "MKCOL":
+	case "COPY", "MOVE":
+		u, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			return
+		}
+		target = u.Path
+	default:
+		return
+	}
+	name, _, err := h.stripPrefix(target)
+	if err != nil {
+		return
+	}
+	warning, err := quotaWarning(r.Context(), h.FileSystem, path.Dir(slashClean(name)))
+	if err == nil && warning > 0 {
+		w.Header().Set("X-Quota-Warning", strconv.Itoa(warning)+"%")
+	}
 }
 
 func (h *Handler) stripPrefix(p string) (string, int, error) {
@@ -61,37 +340,120 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		status, err = http.StatusInternalServerError, errNoFileSystem
 	} else if h.LockSystem == nil {
 		status, err = http.StatusInternalServerError, errNoLockSystem
+	} else if h.insecureCredentials(r) {
+		status, err = http.StatusForbidden, errInsecureCredentials
+	} else if h.Admin.refuses(r) {
+		status, err = http.StatusServiceUnavailable, errMaintenance
 	} else {
-		switch r.Method {
-		case "OPTIONS":
-			status, err = h.handleOptions(w, r)
-		case "GET", "HEAD", "POST":
-			status, err = h.handleGetHeadPost(w, r)
-		case "DELETE":
-			status, err = h.handleDelete(w, r)
-		case "PUT":
-			status, err = h.handlePut(w, r)
-		case "MKCOL":
-			status, err = h.handleMkcol(w, r)
-		case "COPY", "MOVE":
-			status, err = h.handleCopyMove(w, r)
-		case "LOCK":
-			status, err = h.handleLock(w, r)
-		case "UNLOCK":
-			status, err = h.handleUnlock(w, r)
-		case "PROPFIND":
-			status, err = h.handlePropfind(w, r)
-		case "PROPPATCH":
-			status, err = h.handleProppatch(w, r)
+		if h.Scheduler != nil {
+			defer h.Scheduler.Foreground()()
+		}
+		if h.liveProps != nil {
+			r = r.WithContext(withLiveProps(r.Context(), h.liveProps))
+		}
+		if h.reports != nil {
+			r = r.WithContext(withReports(r.Context(), h.reports))
+		}
+		if h.resourceTypes != nil {
+			r = r.WithContext(withResourceTypes(r.Context(), h.resourceTypes))
+		}
+		if h.namespaces != nil {
+			r = r.WithContext(withNamespaces(r.Context(), h.namespaces))
+		}
+		if h.PrincipalURL != nil {
+			r = r.WithContext(withPrincipalURL(r.Context(), h.PrincipalURL(r)))
+		} else if h.Principals != nil {
+			r = r.WithContext(withPrincipalURL(r.Context(), h.principalURL(r)))
+		}
+		if h.Principals != nil {
+			r = r.WithContext(withPrincipalCollection(r.Context(), h.principalCollectionHref()))
+		}
+		if h.AccessController != nil {
+			r = r.WithContext(withAccessControl(r.Context(), h.AccessController, h.principal(r)))
 		}
+		if len(h.QuotaWarnings) > 0 {
+			r = r.WithContext(withQuotaWarnings(r.Context(), h.QuotaWarnings))
+		}
+		r = r.WithContext(withContentTypes(r.Context(), &h.ContentTypes))
+		if h.MediaMetadata != nil {
+			r = r.WithContext(withMediaMetadata(r.Context(), h.MediaMetadata))
+		}
+		if _, ok := h.FileSystem.(VersionedFS); ok {
+			r = r.WithContext(withHandlerPrefix(r.Context(), h.Prefix))
+		}
+		if h.isAncestorProbe(r) {
+			status, err = h.serveAncestorProbe(w, r)
+		} else if h.isChunkedUpload(r) {
+			status, err = h.serveChunkedUpload(w, r)
+		} else if h.isResumableUpload(r) {
+			status, err = h.serveResumableUpload(w, r)
+		} else if h.isPrincipalRequest(r) {
+			status, err = h.servePrincipals(w, r)
+		} else if h.isVersionRequest(r) {
+			status, err = h.serveVersions(w, r)
+		} else {
+			switch r.Method {
+			case "OPTIONS":
+				status, err = h.handleOptions(w, r)
+			case "GET", "HEAD", "POST":
+				status, err = h.handleGetHeadPost(w, r)
+			case "DELETE":
+				status, err = h.handleDelete(w, r)
+			case "PUT":
+				status, err = h.handlePut(w, r)
+			case "PATCH":
+				status, err = h.handlePatch(w, r)
+			case "MKCOL":
+				status, err = h.handleMkcol(w, r)
+			case "COPY", "MOVE":
+				status, err = h.handleCopyMove(w, r)
+			case "LOCK":
+				status, err = h.handleLock(w, r)
+			case "UNLOCK":
+				status, err = h.handleUnlock(w, r)
+			case "PROPFIND":
+				status, err = h.handlePropfind(w, r)
+			case "PROPPATCH":
+				status, err = h.handleProppatch(w, r)
+			case "SEARCH":
+				status, err = h.handleSearch(w, r)
+			case "REPORT":
+				status, err = h.handleReport(w, r)
+			case "ACL":
+				status, err = h.handleACL(w, r)
+			case "VERSION-CONTROL":
+				status, err = h.handleVersionControl(w, r)
+			case "UPDATE":
+				status, err = h.handleUpdate(w, r)
+			}
+		}
+		if status == http.StatusCreated || status == http.StatusNoContent {
+			h.setQuotaWarning(w, r)
+		}
+		status = h.throttled(w, status, err)
 	}
 
 	if status != 0 {
-		w.WriteHeader(status)
-		if status != http.StatusNoContent {
-			w.Write([]byte(StatusText(status)))
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+		} else {
+			msg, lang := h.statusMessage(r, status, err)
+			if lang != "" {
+				w.Header().Set("Content-Language", lang)
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(msg))
 		}
 	}
+	h.reportViolations(r, err)
+	if h.Logger != nil {
+		h.Logger(r, status, err)
+	}
+}
+
+// logError reports err, that does not fail r, to h.Logger, with the status
+// of the response to r.
+func (h *Handler) logError(r *http.Request, status int, err error) {
 	if h.Logger != nil {
 		h.Logger(r, status, err)
 	}
@@ -281,16 +643,59 @@ func (h *Handler) handleOptions(w http.ResponseWriter, r *http.Request) (status
 	}
 	ctx := r.Context()
 	allow := "OPTIONS, LOCK, PUT, MKCOL"
+	// The compliance classes are followed by the extensions supported.
+	classes := "1, 2"
+	var extensions []string
 	if fi, err := h.FileSystem.Stat(ctx, reqPath); err == nil {
 		if fi.IsDir() {
 			allow = "OPTIONS, LOCK, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND"
+			if h.postHandler(reqPath) != nil || h.resumableUploads() {
+				allow = "OPTIONS, LOCK, POST, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND"
+			}
 		} else {
 			allow = "OPTIONS, LOCK, GET, HEAD, POST, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND, PUT"
+			if h.resumableUploads() && !h.partialUpdates(r, reqPath) {
+				allow += ", PATCH"
+			}
+			if h.partialUpdates(r, reqPath) {
+				allow += ", PATCH"
+				// https://sabre.io/dav/http-patch/
+				extensions = append(extensions, "sabredav-partialupdate")
+			}
+		}
+		if supportsVersions(h.FileSystem, fi) {
+			allow += ", VERSION-CONTROL, UPDATE"
+		}
+		if entries, err := supportedLocks(ctx, fi); err == nil && len(entries) == 0 {
+			allow = strings.Replace(strings.Replace(allow, "LOCK, ", "", 1), "UNLOCK, ", "", 1)
+			classes = "1"
+		}
+	}
+	if (len(h.reports) > 0 || len(h.builtinReports()) > 0) && strings.Contains(allow, "PROPFIND") {
+		allow = strings.Replace(allow, "PROPFIND", "PROPFIND, REPORT", 1)
+	}
+	if h.Searcher != nil && strings.Contains(allow, "PROPFIND") {
+		allow = strings.Replace(allow, "PROPFIND", "PROPFIND, SEARCH", 1)
+		// RFC 5323 section 3.2.
+		w.Header().Set("DASL", dasl)
+	}
+	if h.AccessController != nil && strings.Contains(allow, "PROPFIND") {
+		if _, ok := h.AccessController.(ACLSetter); ok {
+			allow = strings.Replace(allow, "PROPFIND", "PROPFIND, ACL", 1)
 		}
+		// RFC 3744 section 7.2.
+		extensions = append(extensions, "access-control")
+	}
+	if _, ok := h.FileSystem.(VersionedFS); ok {
+		// RFC 3253 section 3.6.
+		extensions = append(extensions, "version-control")
+	}
+	if h.resumableUploads() {
+		h.ResumableUploads.setOptions(w)
 	}
 	w.Header().Set("Allow", allow)
 	// http://www.webdav.org/specs/rfc4918.html#dav.compliance.classes
-	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("DAV", strings.Join(append([]string{classes}, extensions...), ", "))
 	// http://msdn.microsoft.com/en-au/library/cc250217.aspx
 	w.Header().Set("MS-Author-Via", "DAV")
 	return 0, nil
@@ -303,6 +708,15 @@ func (h *Handler) handleGetHeadPost(w http.ResponseWriter, r *http.Request) (sta
 	}
 	// TODO: check locks for read-only access??
 	ctx := r.Context()
+	if r.Method == "GET" && h.PresignPolicy != nil {
+		if fi, err := h.FileSystem.Stat(ctx, reqPath); err == nil && !fi.IsDir() {
+			if ok, err := h.redirectPresigned(w, r, reqPath); err != nil {
+				return http.StatusInternalServerError, err
+			} else if ok {
+				return 0, nil
+			}
+		}
+	}
 	f, err := h.FileSystem.OpenFile(ctx, reqPath, os.O_RDONLY, 0)
 	if err != nil {
 		if os.IsPermission(err) {
@@ -319,36 +733,154 @@ func (h *Handler) handleGetHeadPost(w http.ResponseWriter, r *http.Request) (sta
 		return http.StatusNotFound, err
 	}
 	if fi.IsDir() {
+		if r.Method == "POST" {
+			if fn := h.postHandler(reqPath); fn != nil {
+				return h.servePost(w, r, reqPath, fn)
+			}
+		}
 		return http.StatusMethodNotAllowed, nil
 	}
-	etag, err := findETag(ctx, h.FileSystem, h.LockSystem, reqPath, fi)
+	if h.Conversions != nil && r.URL.Query().Has("convert") {
+		return h.serveConversion(w, r, reqPath, f, fi)
+	}
+	etag, err := fileETag(ctx, h.FileSystem, h.LockSystem, reqPath, f, fi)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
 	w.Header().Set("ETag", etag)
-	if ctyper, ok := fi.(ContentTyper); ok {
-		ctype, err := ctyper.ContentType(context.Background())
-		if err == nil && ctype != "" {
-			w.Header().Set("Content-Type", ctype)
-		}
+	// The checksum is omitted if it cannot be computed.
+	if checksum, err := checksumHeader(ctx, h.FileSystem, reqPath); err != nil {
+		h.logError(r, http.StatusOK, err)
+	} else if checksum != "" {
+		w.Header().Set("OC-Checksum", checksum)
 	}
-	http.ServeContent(w, r, reqPath, fi.ModTime(), f)
+	lang, err := contentLanguage(ctx, h.PropStore, reqPath)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if lang != "" {
+		w.Header().Set("Content-Language", lang)
+	}
+	ctype, err := overriddenContentType(ctx, h.PropStore, reqPath)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if ctype == "" {
+		// If the content type must be detected, http.ServeContent does it.
+		ctype, _ = knownContentType(ctx, reqPath, fi)
+	}
+	if ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	t, done := h.Admin.startTransfer(r, reqPath)
+	defer done()
+	// http.ServeContent evaluates the conditional headers against the ETag
+	// set above and the modification time, including If-Range: a range
+	// whose validator does not match is served as the full content.
+	var content io.ReadSeeker = f
+	ofs, ok := h.FileSystem.(OverwritingFS)
+	if check := ok && ofs.OverwritesInPlace(); check || t != nil {
+		content = &stableReader{File: f, fi: fi, t: t, check: check}
+	}
+	http.ServeContent(w, h.limitRanges(r), reqPath, fi.ModTime(), content)
 	return 0, nil
 }
 
-func (h *Handler) handleDelete(_ http.ResponseWriter, r *http.Request) (status int, err error) {
+// OverwritingFS is an optional interface for the FileSystems whose opened
+// files can be overwritten in place while they are read, such as Dir, so
+// that a GET response could mix old and new content. The Handler checks
+// that the files it serves are not modified while being read, see
+// OverwritesInPlace. Backends that keep serving the opened content, such as
+// the in-memory file system, don't need the checks.
+type OverwritingFS interface {
+	// OverwritesInPlace reports whether the files must be checked for
+	// changes while served. A changed file ends the response short of its
+	// Content-Length, so that clients see an incomplete transfer. The files
+	// are checked using their Stat method, every stableCheckInterval bytes
+	// and once their end is read.
+	OverwritesInPlace() bool
+}
+
+// stableCheckInterval is how many bytes of a file are served between the
+// checks of stableReader.
+const stableCheckInterval = 1 << 20
+
+// stableReader reads a file being served by GET, counting the bytes
+// transferred in t, and, if check is true, fails once the file is found to
+// have changed since it was opened. The read reaching the end of the file
+// is always checked, so a response mixing old and new bytes is never
+// complete.
+type stableReader struct {
+	File
+	fi os.FileInfo
+	// t, if non-nil, is the transfer reported to Handler.Admin.
+	t     *transfer
+	check bool
+	// pos is the offset of the next read, unchecked the number of bytes
+	// read since the last check.
+	pos, unchecked int64
+}
+
+func (r *stableReader) Read(p []byte) (int, error) {
+	n, err := r.File.Read(p)
+	r.pos += int64(n)
+	r.unchecked += int64(n)
+	if r.check && r.unchecked > 0 && (r.unchecked >= stableCheckInterval || r.pos >= r.fi.Size() || err == io.EOF) {
+		r.unchecked = 0
+		fi, statErr := r.File.Stat()
+		if statErr != nil {
+			return 0, statErr
+		}
+		if fi.Size() != r.fi.Size() || !fi.ModTime().Equal(r.fi.ModTime()) {
+			return 0, errFileChanged
+		}
+	}
+	r.t.add(n)
+	return n, err
+}
+
+func (r *stableReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.File.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request) (status int, err error) {
 	reqPath, status, err := h.stripPrefix(r.URL.Path)
 	if err != nil {
 		return status, err
 	}
+	if status, err := h.checkPreconditions(r, reqPath); err != nil {
+		return status, err
+	}
+	if status, err := h.checkRetention(r.Context(), w, reqPath); err != nil {
+		return status, err
+	}
 	release, status, err := h.confirmLocks(r, reqPath, "")
 	if err != nil {
 		return status, err
 	}
+	if status, err := h.checkTreeLimits(r.Context(), reqPath, infiniteDepth, false); err != nil {
+		release()
+		return status, err
+	}
+	if isDryRun(r) {
+		defer release()
+		return h.dryRun(r.Context(), w, reqPath, "", false)
+	}
+	if h.respondAsync(r, reqPath) {
+		return h.runAsync(w, r, "", release, func(ctx context.Context) (int, error) {
+			return h.delete(ctx, reqPath)
+		})
+	}
 	defer release()
 
-	ctx := r.Context()
+	return h.delete(r.Context(), reqPath)
+}
 
+func (h *Handler) delete(ctx context.Context, reqPath string) (status int, err error) {
 	// TODO: return MultiStatus where appropriate.
 
 	if err := h.FileSystem.RemoveAll(ctx, reqPath); err != nil {
@@ -359,7 +891,13 @@ func (h *Handler) handleDelete(_ http.ResponseWriter, r *http.Request) (status i
 		}
 		return http.StatusMethodNotAllowed, err
 	}
+	reportProgress(ctx)
 
+	if h.PropStore != nil {
+		if err := h.PropStore.Delete(ctx, reqPath); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
 	if status, err := h.deleteLocks(reqPath); err != nil {
 		return status, err
 	}
@@ -371,16 +909,88 @@ func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request) (status int,
 	if err != nil {
 		return status, err
 	}
+	if IsUploadName(reqPath) {
+		return http.StatusForbidden, errReservedName
+	}
+	if status, err := h.checkPreconditions(r, reqPath); err != nil {
+		return status, err
+	}
+	if status, err := h.checkRetention(r.Context(), w, reqPath); err != nil {
+		return status, err
+	}
 	release, status, err := h.confirmLocks(r, reqPath, "")
 	if err != nil {
 		return status, err
 	}
-	defer release()
-	// TODO(rost): Support the If-Match, If-None-Match headers? See bradfitz'
-	// comments in http.checkEtag.
+	// The locks are confirmed again once the body is uploaded, so they are
+	// not held during the transfer, and concurrent uploads are handled as
+	// defined by h.ConcurrentPuts.
+	release()
+	if r.Header.Get("Content-Range") != "" && h.partialUpdates(r, reqPath) {
+		return h.handlePartialPut(w, r, reqPath)
+	}
 	ctx := r.Context()
 
-	f, err := h.FileSystem.OpenFile(ctx, reqPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	var checksum *trailerChecksum
+	if h.featureEnabled(r, FeatureChecksumTrailers, reqPath) {
+		checksum = newTrailerChecksum(r)
+	}
+	if !h.VerifyWrites && checksum == nil && !isAssembledUpload(ctx) {
+		if ok, err := h.redirectPresigned(w, r, reqPath); err != nil {
+			return http.StatusInternalServerError, err
+		} else if ok {
+			return 0, nil
+		}
+	}
+
+	target, end, err := h.ConcurrentPuts.begin(ctx, h.FileSystem, reqPath)
+	if err != nil {
+		if err == errConcurrentPut {
+			return StatusLocked, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	defer end()
+
+	created := false
+	if fi, err := h.FileSystem.Stat(ctx, target); err == nil {
+		if fi.IsDir() {
+			return http.StatusMethodNotAllowed, errIsADirectory
+		}
+	} else {
+		created = os.IsNotExist(err)
+	}
+	expected, err := expectedLength(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	mtime, err := ocMTime(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if expected >= 0 {
+		if status, err := h.checkQuota(ctx, target, expected); err != nil {
+			return status, err
+		}
+	}
+	// The uploads that must not replace target unless complete are written
+	// to a temporary file, renamed over target once complete: the uploads
+	// whose checksum follows the body in a trailer, once the checksum
+	// matches, the uploads whose length is announced, the uploads whose
+	// body h.UploadPipeline may reject, and the concurrent uploads handled
+	// by h.ConcurrentPuts. The others are written in place, holding the
+	// locks during the transfer.
+	name := target
+	if checksum != nil || expected >= 0 || h.UploadPipeline != nil || h.ConcurrentPuts != nil {
+		name = uploadName(target)
+	} else {
+		release, status, err := h.confirmLocks(r, target, "")
+		if err != nil {
+			return status, err
+		}
+		defer release()
+	}
+	f, err := h.FileSystem.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		if os.IsPermission(err) {
 			return http.StatusForbidden, err
@@ -390,9 +1000,57 @@ func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request) (status int,
 		}
 		return http.StatusNotFound, err
 	}
-	_, copyErr := io.Copy(f, r.Body)
+	t, done := h.Admin.startTransfer(r, reqPath)
+	defer done()
+	pipeline := NewBodyPipeline()
+	hash := sha256.New()
+	if h.VerifyWrites {
+		pipeline.Hash(hash)
+	}
+	if checksum != nil {
+		pipeline.Hash(checksum.hashList()...)
+	}
+	if h.UploadPipeline != nil {
+		h.UploadPipeline(r, target, pipeline)
+	}
+	written, copyErr := io.Copy(f, pipeline.Reader(transferReader{r.Body, t}))
 	fi, statErr := f.Stat()
 	closeErr := f.Close()
+	if copyErr == nil && statErr == nil && closeErr == nil && name != target {
+		if expected >= 0 && written != expected {
+			// The body was truncated, it must not be stored.
+			h.FileSystem.RemoveAll(ctx, name)
+			return http.StatusBadRequest, errIncompleteBody
+		}
+		if checksum != nil {
+			if err := checksum.verify(r.Trailer); err != nil {
+				h.FileSystem.RemoveAll(ctx, name)
+				return http.StatusBadRequest, err
+			}
+		}
+		release, status, err := h.confirmLocks(r, target, "")
+		if err != nil {
+			h.FileSystem.RemoveAll(ctx, name)
+			return status, err
+		}
+		defer release()
+		// The preconditions are evaluated again, now that the locks are
+		// held, so that an update racing with the upload is detected.
+		if status, err := h.checkPreconditions(r, reqPath); err != nil {
+			h.FileSystem.RemoveAll(ctx, name)
+			return status, err
+		}
+		copyErr = h.renameUpload(ctx, name, target)
+	}
+	if (copyErr != nil || statErr != nil || closeErr != nil) && name != target {
+		h.FileSystem.RemoveAll(ctx, name)
+	}
+	switch {
+	case errors.Is(copyErr, ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge, copyErr
+	case errors.Is(copyErr, ErrBodyRejected):
+		return http.StatusForbidden, copyErr
+	}
 	// TODO(rost): Returning 405 Method Not Allowed might not be appropriate.
 	if copyErr != nil {
 		return http.StatusMethodNotAllowed, copyErr
@@ -403,19 +1061,162 @@ func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request) (status int,
 	if closeErr != nil {
 		return http.StatusMethodNotAllowed, closeErr
 	}
-	etag, err := findETag(ctx, h.FileSystem, h.LockSystem, reqPath, fi)
+	if h.VerifyWrites {
+		if err := h.verifyWrite(ctx, target, written, hash.Sum(nil)); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if created {
+		if status, err := h.applyDirDefaults(ctx, target, false, written == 0); err != nil {
+			return status, err
+		}
+		if fi, err = h.FileSystem.Stat(ctx, target); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	// The file is stored: the errors setting its modification time or
+	// computing its checksum are logged, and not reported to the client.
+	if !mtime.IsZero() {
+		if ok, err := h.setModTime(ctx, target, mtime); err != nil {
+			h.logError(r, http.StatusCreated, err)
+		} else if ok {
+			w.Header().Set("X-OC-MTime", "accepted")
+			if fi, err = h.FileSystem.Stat(ctx, target); err != nil {
+				return http.StatusInternalServerError, err
+			}
+		}
+	}
+	etag, err := findETag(ctx, h.FileSystem, h.LockSystem, target, fi)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
 	w.Header().Set("ETag", etag)
+	if ocChecksum, err := checksumHeader(ctx, h.FileSystem, target); err != nil {
+		h.logError(r, http.StatusCreated, err)
+	} else if ocChecksum != "" {
+		w.Header().Set("OC-Checksum", ocChecksum)
+	}
+	if target != reqPath {
+		w.Header().Set("Content-Location", hrefPath(h.Prefix+target))
+	}
 	return http.StatusCreated, nil
 }
 
+// renameUpload renames the temporary file name of an upload over target.
+// The permission bits and the dead properties of target, if it exists, are
+// kept.
+func (h *Handler) renameUpload(ctx context.Context, name, target string) error {
+	fi, err := h.FileSystem.Stat(ctx, target)
+	if os.IsNotExist(err) {
+		return h.commitUpload(ctx, name, target)
+	}
+	if err != nil {
+		return err
+	}
+	// The properties held by the File are moved with it, the ones of the
+	// PropStore are patched again once renamed, for the PropStores that
+	// keep them with the file, such as the ones using extended attributes.
+	var fileProps, storeProps []Property
+	if f, err := h.FileSystem.OpenFile(ctx, target, os.O_RDONLY, 0); err == nil {
+		if dph, ok := f.(DeadPropsHolder); ok {
+			m, err := dph.DeadProps()
+			if err != nil {
+				f.Close()
+				return err
+			}
+			for _, p := range m {
+				fileProps = append(fileProps, p)
+			}
+		}
+		f.Close()
+	}
+	if len(fileProps) > 0 {
+		if _, err := patchDead(ctx, h.FileSystem, nil, name, []Proppatch{{Props: fileProps}}); err != nil {
+			return err
+		}
+	}
+	if h.PropStore != nil {
+		m, err := h.PropStore.Get(ctx, target)
+		if err != nil {
+			return err
+		}
+		for _, p := range m {
+			storeProps = append(storeProps, p)
+		}
+	}
+	if c, ok := h.FileSystem.(Chmoder); ok {
+		if err := c.Chmod(ctx, name, fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if err := h.commitUpload(ctx, name, target); err != nil {
+		return err
+	}
+	if len(storeProps) > 0 {
+		if _, err := h.PropStore.Patch(ctx, target, []Proppatch{{Props: storeProps}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitUpload renames the temporary file name to target. The FileSystems
+// that cannot rename, such as an IOFS without RenameFS, get the content
+// copied over target in place instead.
+func (h *Handler) commitUpload(ctx context.Context, name, target string) error {
+	err := h.FileSystem.Rename(ctx, name, target)
+	if !errors.Is(err, os.ErrPermission) && !errors.Is(err, ErrNotImplemented) {
+		return err
+	}
+	src, err := h.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := h.FileSystem.OpenFile(ctx, target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return h.FileSystem.RemoveAll(ctx, name)
+}
+
+// verifyWrite reads back the file written by a PUT request and checks that
+// its size and SHA-256 checksum match the request body.
+func (h *Handler) verifyWrite(ctx context.Context, name string, size int64, sum []byte) error {
+	f, err := h.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if n != size || !bytes.Equal(hash.Sum(nil), sum) {
+		return errWriteVerification
+	}
+	return nil
+}
+
 func (h *Handler) handleMkcol(_ http.ResponseWriter, r *http.Request) (status int, err error) {
 	reqPath, status, err := h.stripPrefix(r.URL.Path)
 	if err != nil {
 		return status, err
 	}
+	if IsUploadName(reqPath) {
+		return http.StatusForbidden, errReservedName
+	}
+	if status, err := h.checkPreconditions(r, reqPath); err != nil {
+		return status, err
+	}
 	release, status, err := h.confirmLocks(r, reqPath, "")
 	if err != nil {
 		return status, err
@@ -435,10 +1236,13 @@ func (h *Handler) handleMkcol(_ http.ResponseWriter, r *http.Request) (status in
 		}
 		return http.StatusMethodNotAllowed, err
 	}
+	if status, err := h.applyDirDefaults(ctx, reqPath, true, false); err != nil {
+		return status, err
+	}
 	return http.StatusCreated, nil
 }
 
-func (h *Handler) handleCopyMove(_ http.ResponseWriter, r *http.Request) (status int, err error) {
+func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) (status int, err error) {
 	hdr := r.Header.Get("Destination")
 	if hdr == "" {
 		return http.StatusBadRequest, errInvalidDestination
@@ -455,6 +1259,9 @@ func (h *Handler) handleCopyMove(_ http.ResponseWriter, r *http.Request) (status
 	if err != nil {
 		return status, err
 	}
+	if status, err := h.checkPreconditions(r, src); err != nil {
+		return status, err
+	}
 
 	dst, status, err := h.stripPrefix(u.Path)
 	if err != nil {
@@ -467,8 +1274,19 @@ func (h *Handler) handleCopyMove(_ http.ResponseWriter, r *http.Request) (status
 	if dst == src {
 		return http.StatusForbidden, errDestinationEqualsSource
 	}
+	if IsUploadName(dst) {
+		return http.StatusForbidden, errReservedName
+	}
 
 	ctx := r.Context()
+	if r.Method == "MOVE" {
+		if status, err := h.checkRetention(ctx, w, src); err != nil {
+			return status, err
+		}
+	}
+	if status, err := h.checkRetention(ctx, w, dst); err != nil {
+		return status, err
+	}
 
 	if r.Method == "COPY" {
 		// Section 7.5.1 says that a COPY only needs to lock the destination,
@@ -480,7 +1298,6 @@ func (h *Handler) handleCopyMove(_ http.ResponseWriter, r *http.Request) (status
 		if err != nil {
 			return status, err
 		}
-		defer release()
 
 		// Section 9.8.3 says that "The COPY method on a collection without a Depth
 		// header must act as if a Depth header with value "infinity" was included".
@@ -490,30 +1307,79 @@ func (h *Handler) handleCopyMove(_ http.ResponseWriter, r *http.Request) (status
 			if depth != 0 && depth != infiniteDepth {
 				// Section 9.8.3 says that "A client may submit a Depth header on a
 				// COPY on a collection with a value of "0" or "infinity"."
+				release()
 				return http.StatusBadRequest, errInvalidDepth
 			}
 		}
-		return copyFiles(ctx, h.FileSystem, src, dst, r.Header.Get("Overwrite") != "F", depth, 0)
+		if status, err := h.checkTreeLimits(ctx, src, depth, true); err != nil {
+			release()
+			return status, err
+		}
+		overwrite := r.Header.Get("Overwrite") != "F"
+		if isDryRun(r) {
+			defer release()
+			return h.dryRun(ctx, w, src, dst, overwrite)
+		}
+		if h.respondAsync(r, src) {
+			return h.runAsync(w, r, dst, release, func(ctx context.Context) (int, error) {
+				return h.copy(ctx, src, dst, overwrite, depth)
+			})
+		}
+		defer release()
+		return h.copy(ctx, src, dst, overwrite, depth)
 	}
 
 	release, status, err := h.confirmLocks(r, src, dst)
 	if err != nil {
 		return status, err
 	}
-	defer release()
 
 	// Section 9.9.2 says that "The MOVE method on a collection must act as if
 	// a "Depth: infinity" header was used on it. A client must not submit a
 	// Depth header on a MOVE on a collection with any value but "infinity"."
 	if hdr := r.Header.Get("Depth"); hdr != "" {
 		if parseDepth(hdr) != infiniteDepth {
+			release()
 			return http.StatusBadRequest, errInvalidDepth
 		}
 	}
-	status, err = moveFiles(ctx, h.FileSystem, src, dst, r.Header.Get("Overwrite") == "T")
+	overwrite := r.Header.Get("Overwrite") == "T"
+	if isDryRun(r) {
+		defer release()
+		return h.dryRun(ctx, w, src, dst, overwrite)
+	}
+	if h.respondAsync(r, src) {
+		return h.runAsync(w, r, dst, release, func(ctx context.Context) (int, error) {
+			return h.move(ctx, src, dst, overwrite)
+		})
+	}
+	defer release()
+	return h.move(ctx, src, dst, overwrite)
+}
+
+func (h *Handler) copy(ctx context.Context, src, dst string, overwrite bool, depth int) (status int, err error) {
+	status, err = copyFiles(ctx, h.FileSystem, src, dst, overwrite, depth, 0)
+	if status < 200 || status > 300 || h.PropStore == nil {
+		return status, err
+	}
+	if err := h.PropStore.CopyMove(ctx, src, dst, false, depth != 0); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return status, nil
+}
+
+func (h *Handler) move(ctx context.Context, src, dst string, overwrite bool) (status int, err error) {
+	status, err = moveFiles(ctx, h.FileSystem, src, dst, overwrite)
 	if status < 200 || status > 300 {
 		return status, err
 	}
+	reportProgress(ctx)
+
+	if h.PropStore != nil {
+		if err := h.PropStore.CopyMove(ctx, src, dst, true, true); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
 
 	delStatus, err := h.deleteLocks(src)
 	if err != nil {
@@ -524,7 +1390,10 @@ func (h *Handler) handleCopyMove(_ http.ResponseWriter, r *http.Request) (status
 }
 
 func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (retStatus int, retErr error) {
-	duration, err := parseTimeout(r.Header.Get("Timeout"))
+	duration, err := parseTimeout(r.Header.Get("Timeout"), h.MaxLockTimeout)
+	if err == nil {
+		duration, err = minTimeout(duration, h.MinLockTimeout, h.MaxLockTimeout)
+	}
 	if err != nil {
 		return http.StatusBadRequest, err
 	}
@@ -572,17 +1441,58 @@ func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (retStatus
 		if err != nil {
 			return status, err
 		}
+		fi, statErr := h.FileSystem.Stat(ctx, reqPath)
+		if statErr == nil {
+			entries, err := supportedLocks(ctx, fi)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			if len(entries) == 0 {
+				return http.StatusMethodNotAllowed, errLockNotSupported
+			}
+			// readLockInfo only accepts exclusive write locks, they must
+			// be advertised.
+			supported := false
+			for _, e := range entries {
+				supported = supported || e == defaultLockEntries[0]
+			}
+			if !supported {
+				return StatusUnprocessableEntity, errUnsupportedLockInfo
+			}
+		}
+		takenOver, takenToken, status, err := h.takeOverLock(r, reqPath)
+		if err != nil {
+			return status, err
+		}
 		ld = LockDetails{
 			Root:      reqPath,
 			Duration:  duration,
 			OwnerXML:  li.Owner.InnerXML,
 			ZeroDepth: depth == 0,
+			Principal: h.principal(r),
+			LockNull:  statErr != nil && h.LockNullResources,
+		}
+		if takenOver != nil {
+			token, err = h.LockSystem.(LockReplacer).Replace(now, takenToken, ld, h.LockLimits)
+		} else if limiter, ok := h.LockSystem.(LimitedLocker); ok && !h.LockLimits.isZero() {
+			token, err = limiter.CreateWithLimits(now, ld, h.LockLimits)
+		} else {
+			token, err = h.LockSystem.Create(now, ld)
 		}
-		token, err = h.LockSystem.Create(now, ld)
 		if err != nil {
 			if err == ErrLocked {
 				return StatusLocked, err
 			}
+			if err == ErrLockLimitExceeded {
+				if h.LockLimits.Status != 0 {
+					return h.LockLimits.Status, err
+				}
+				return StatusLocked, err
+			}
+			if err == ErrNoSuchLock {
+				// The lock taken over expired or was unlocked meanwhile.
+				return http.StatusPreconditionFailed, err
+			}
 			return http.StatusInternalServerError, err
 		}
 		defer func() {
@@ -591,8 +1501,9 @@ func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (retStatus
 			}
 		}()
 
-		// Create the resource if it didn't previously exist.
-		if _, err := h.FileSystem.Stat(ctx, reqPath); err != nil {
+		// Create the resource if it didn't previously exist, unless we are
+		// creating a lock-null resource.
+		if statErr != nil && !ld.LockNull {
 			f, err := h.FileSystem.OpenFile(ctx, reqPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 			if err != nil {
 				// TODO: detect missing intermediate dirs and return http.StatusConflict?
@@ -600,11 +1511,18 @@ func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (retStatus
 			}
 			f.Close()
 			created = true
+			if status, err := h.applyDirDefaults(ctx, reqPath, false, true); err != nil {
+				return status, err
+			}
 		}
 
 		// http://www.webdav.org/specs/rfc4918.html#HEADER_Lock-Token says that the
 		// Lock-Token value is a Coded-URL. We add angle brackets.
 		w.Header().Set("Lock-Token", "<"+token+">")
+
+		if takenOver != nil && h.LockTakeover.Notify != nil {
+			h.LockTakeover.Notify(r, *takenOver, ld.Principal)
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
@@ -627,6 +1545,28 @@ func (h *Handler) handleUnlock(_ http.ResponseWriter, r *http.Request) (status i
 	}
 	t = t[1 : len(t)-1]
 
+	if lookup, ok := h.LockSystem.(TokenLookup); ok {
+		reqPath, status, err := h.stripPrefix(r.URL.Path)
+		if err != nil {
+			return status, err
+		}
+		ld, _, err := lookup.GetByToken(t)
+		if err != nil {
+			if err == ErrNoSuchLock {
+				return http.StatusConflict, err
+			}
+			return http.StatusInternalServerError, err
+		}
+		// Section 9.11.1 says that the request URI must be within the scope
+		// of the lock identified by the Lock-Token header.
+		if name := slashClean(reqPath); name != ld.Root && (ld.ZeroDepth || !isWithin(name, ld.Root)) {
+			return http.StatusConflict, errLockTokenMismatch
+		}
+		if h.StrictUnlock && ld.Principal != h.principal(r) {
+			return http.StatusForbidden, errLockPrincipalMismatch
+		}
+	}
+
 	switch err = h.LockSystem.Unlock(time.Now(), t); err {
 	case nil:
 		return http.StatusNoContent, err
@@ -650,6 +1590,9 @@ func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (status
 	fi, err := h.FileSystem.Stat(ctx, reqPath)
 	if err != nil {
 		if os.IsNotExist(err) {
+			if l, ok := h.lockNull(reqPath); ok {
+				return h.handlePropfindLockNull(w, r, l)
+			}
 			return http.StatusNotFound, err
 		} else if os.IsPermission(err) {
 			return http.StatusForbidden, err
@@ -671,16 +1614,35 @@ func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (status
 		return status, err
 	}
 
-	mw := multistatusWriter{w: w}
+	offset, err := parsePropfindOffset(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	pager := propfindPager{offset: offset, max: h.MaxPropfindResults}
+	minimal := returnMinimal(w, r)
 
+	mw := multistatusWriter{w: w, canonical: h.CanonicalXML, ctx: ctx}
+
+	root := reqPath
 	walkFn := func(reqPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return handlePropfindError(err, info)
 		}
+		if reqPath != root && h.skipName(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if reqPath != root {
+			if ok, err := pager.next(); !ok {
+				return err
+			}
+		}
 
 		var pstats []Propstat
 		if pf.Propname != nil {
-			pnames, err := propnames(ctx, h.FileSystem, h.LockSystem, reqPath, info)
+			pnames, err := propnames(ctx, h.FileSystem, h.LockSystem, h.PropStore, reqPath, info)
 			if err != nil {
 				return handlePropfindError(err, info)
 			}
@@ -690,13 +1652,16 @@ func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (status
 			}
 			pstats = append(pstats, pstat)
 		} else if pf.Allprop != nil {
-			pstats, err = allprop(ctx, h.FileSystem, h.LockSystem, reqPath, pf.Prop, info)
+			pstats, err = allprop(ctx, h.FileSystem, h.LockSystem, h.PropStore, reqPath, pf.Include, info)
 		} else {
-			pstats, err = props(ctx, h.FileSystem, h.LockSystem, reqPath, pf.Prop, info)
+			pstats, err = props(ctx, h.FileSystem, h.LockSystem, h.PropStore, reqPath, pf.Prop, info)
 		}
 		if err != nil {
 			return handlePropfindError(err, info)
 		}
+		if minimal {
+			pstats = minimalPropstats(pstats)
+		}
 		href := path.Join(h.Prefix, reqPath)
 		if href != "/" && info.IsDir() {
 			href += "/"
@@ -705,6 +1670,18 @@ func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (status
 	}
 
 	walkErr := walkFS(ctx, h.FileSystem, depth, reqPath, fi, walkFn)
+	if walkErr == errPropfindTruncated {
+		href := path.Join(h.Prefix, reqPath)
+		if href != "/" {
+			href += "/"
+		}
+		walkErr = mw.write(pager.truncatedResponse(href))
+	} else if walkErr == nil && depth != 0 && fi.IsDir() {
+		walkErr = h.writeLockNullChildren(ctx, &mw, reqPath, pf)
+	}
+	if h.listingAborted(r, &mw, walkErr) {
+		return 0, walkErr
+	}
 	closeErr := mw.close()
 	if walkErr != nil {
 		return http.StatusInternalServerError, walkErr
@@ -715,11 +1692,147 @@ func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (status
 	return 0, nil
 }
 
+// listingAborted returns whether err reports that the client of r went away
+// while mw was written, in which case it calls h.OnAbortedListing.
+func (h *Handler) listingAborted(r *http.Request, mw *multistatusWriter, err error) bool {
+	if err != errListingAborted {
+		return false
+	}
+	if h.OnAbortedListing != nil {
+		h.OnAbortedListing(r, mw.written)
+	}
+	return true
+}
+
+// lockNull returns the lock of the lock-null resource at reqPath, if any.
+func (h *Handler) lockNull(reqPath string) (ActiveLock, bool) {
+	if !h.LockNullResources {
+		return ActiveLock{}, false
+	}
+	token, expiry, ld, err := h.LockSystem.GetByName(reqPath)
+	if err != nil || !ld.LockNull || ld.Root != slashClean(reqPath) {
+		return ActiveLock{}, false
+	}
+	return ActiveLock{Token: token, Expiry: expiry, Details: ld}, true
+}
+
+func (h *Handler) handlePropfindLockNull(w http.ResponseWriter, r *http.Request, l ActiveLock) (status int, err error) {
+	pf, status, err := readPropfind(r.Body)
+	if err != nil {
+		return status, err
+	}
+	mw := multistatusWriter{w: w, canonical: h.CanonicalXML, ctx: r.Context()}
+	writeErr := mw.write(makePropstatResponse(path.Join(h.Prefix, l.Details.Root), lockNullPropstats(l, pf)))
+	closeErr := mw.close()
+	if writeErr != nil {
+		return http.StatusInternalServerError, writeErr
+	}
+	if closeErr != nil {
+		return http.StatusInternalServerError, closeErr
+	}
+	return 0, nil
+}
+
+// writeLockNullChildren writes the responses for the lock-null resources
+// within the collection reqPath that have not been created in the meantime.
+func (h *Handler) writeLockNullChildren(ctx context.Context, mw *multistatusWriter, reqPath string, pf propfind) error {
+	if !h.LockNullResources {
+		return nil
+	}
+	lister, ok := h.LockSystem.(LockNullLister)
+	if !ok {
+		return nil
+	}
+	locks, err := lister.LockNullChildren(reqPath)
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		if _, err := h.FileSystem.Stat(ctx, l.Details.Root); err == nil {
+			continue
+		}
+		err := mw.write(makePropstatResponse(path.Join(h.Prefix, l.Details.Root), lockNullPropstats(l, pf)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forbiddenPropNamespaces returns the Propstats failing patches if they set
+// dead properties in namespaces not allowed by AllowedPropNamespaces and
+// DeniedPropNamespaces, or nil if they are all allowed.
+func (h *Handler) forbiddenPropNamespaces(ctx context.Context, patches []Proppatch) []Propstat {
+	if len(h.AllowedPropNamespaces) == 0 && len(h.DeniedPropNamespaces) == 0 {
+		return nil
+	}
+	contains := func(namespaces []string, ns string) bool {
+		for _, v := range namespaces {
+			if v == ns {
+				return true
+			}
+		}
+		return false
+	}
+	forbidden := func(patch Proppatch, p Property) bool {
+		if patch.Remove {
+			return false
+		}
+		if _, live := findLiveProp(ctx, p.XMLName); live {
+			return false
+		}
+		ns := p.XMLName.Space
+		return contains(h.DeniedPropNamespaces, ns) ||
+			len(h.AllowedPropNamespaces) > 0 && !contains(h.AllowedPropNamespaces, ns)
+	}
+	pstatForbidden := Propstat{
+		Status:   http.StatusForbidden,
+		XMLError: `<W:forbidden-property-namespace xmlns:W="https://github.com/drakkan/webdav"/>`,
+	}
+	pstatFailedDep := Propstat{Status: StatusFailedDependency}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			if forbidden(patch, p) {
+				pstatForbidden.Props = append(pstatForbidden.Props, Property{XMLName: p.XMLName})
+			} else {
+				pstatFailedDep.Props = append(pstatFailedDep.Props, Property{XMLName: p.XMLName})
+			}
+		}
+	}
+	if len(pstatForbidden.Props) == 0 {
+		return nil
+	}
+	return makePropstats(pstatForbidden, pstatFailedDep)
+}
+
+func lockNullPropstats(l ActiveLock, pf propfind) []Propstat {
+	if pf.Propname != nil {
+		return lockNullProps(l, nil, true)
+	}
+	if pf.Allprop != nil {
+		pnames := append([]xml.Name(nil), lockNullPropNames...)
+	include:
+		for _, pn := range pf.Include {
+			for _, known := range lockNullPropNames {
+				if pn == known {
+					continue include
+				}
+			}
+			pnames = append(pnames, pn)
+		}
+		return lockNullProps(l, pnames, false)
+	}
+	return lockNullProps(l, pf.Prop, false)
+}
+
 func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request) (status int, err error) {
 	reqPath, status, err := h.stripPrefix(r.URL.Path)
 	if err != nil {
 		return status, err
 	}
+	if status, err := h.checkPreconditions(r, reqPath); err != nil {
+		return status, err
+	}
 	release, status, err := h.confirmLocks(r, reqPath, "")
 	if err != nil {
 		return status, err
@@ -727,6 +1840,9 @@ func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request) (statu
 	defer release()
 
 	ctx := r.Context()
+	if h.CanChown != nil && h.CanChown(r, h.principal(r)) {
+		ctx = withChown(ctx)
+	}
 
 	if _, err := h.FileSystem.Stat(ctx, reqPath); err != nil {
 		if os.IsNotExist(err) {
@@ -740,11 +1856,25 @@ func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request) (statu
 	if err != nil {
 		return status, err
 	}
-	pstats, err := patch(ctx, h.FileSystem, h.LockSystem, reqPath, patches)
-	if err != nil {
-		return http.StatusInternalServerError, err
+	pstats := h.checkProppatch(ctx, r, reqPath, patches)
+	if pstats == nil {
+		pstats, err = patch(ctx, h.FileSystem, h.LockSystem, h.PropStore, reqPath, patches)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		h.notifyPropChange(r, reqPath, pstats)
 	}
-	mw := multistatusWriter{w: w}
+	if returnMinimal(w, r) {
+		if allPropstatsOK(pstats) {
+			return http.StatusNoContent, nil
+		}
+		for _, pstat := range pstats {
+			for i, p := range pstat.Props {
+				pstat.Props[i] = Property{XMLName: p.XMLName}
+			}
+		}
+	}
+	mw := multistatusWriter{w: w, canonical: h.CanonicalXML, ctx: ctx}
 	writeErr := mw.write(makePropstatResponse(r.URL.Path, pstats))
 	closeErr := mw.close()
 	if writeErr != nil {
@@ -756,9 +1886,72 @@ func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request) (statu
 	return 0, nil
 }
 
+// checkProppatch returns the failed propstats of patches, a PROPPATCH of
+// resource name by r, if they set properties in a forbidden namespace, break
+// the retention rules or cannot be decoded by their Namespace. It returns
+// nil if patches can be applied.
+func (h *Handler) checkProppatch(ctx context.Context, r *http.Request, name string, patches []Proppatch) []Propstat {
+	pstats := h.forbiddenPropNamespaces(ctx, patches)
+	if pstats == nil {
+		pstats = h.forbiddenRetention(r, name, patches)
+	}
+	if pstats == nil {
+		pstats = decodeNamespaces(ctx, patches)
+	}
+	return pstats
+}
+
+// PatchProps patches the dead properties of resource name in the PropStore
+// on behalf of r, with the checks of a PROPPATCH request, so that the
+// requests creating resources with their properties, such as an extended
+// MKCOL, can't set the properties PROPPATCH refuses. The locks are not
+// confirmed. All the patches are forbidden if there is no PropStore.
+func (h *Handler) PatchProps(r *http.Request, name string, patches []Proppatch) ([]Propstat, error) {
+	if h.PropStore == nil {
+		return patchesForbidden(patches), nil
+	}
+	ctx := r.Context()
+	if h.liveProps != nil {
+		ctx = withLiveProps(ctx, h.liveProps)
+	}
+	if h.namespaces != nil {
+		ctx = withNamespaces(ctx, h.namespaces)
+	}
+	r = r.WithContext(ctx)
+	if pstats := h.checkProppatch(ctx, r, name, patches); pstats != nil {
+		return pstats, nil
+	}
+	pstats, err := patchPropStore(ctx, h.PropStore, name, patches)
+	if err != nil {
+		return nil, err
+	}
+	h.notifyPropChange(r, name, pstats)
+	return pstats, nil
+}
+
+// notifyPropChange calls h.OnPropChange with the properties successfully
+// patched, if any.
+func (h *Handler) notifyPropChange(r *http.Request, name string, pstats []Propstat) {
+	if h.OnPropChange == nil {
+		return
+	}
+	var props []xml.Name
+	for _, p := range pstats {
+		if p.Status != http.StatusOK {
+			continue
+		}
+		for _, prop := range p.Props {
+			props = append(props, prop.XMLName)
+		}
+	}
+	if len(props) > 0 {
+		h.OnPropChange(r, name, props, h.principal(r))
+	}
+}
+
 func makePropstatResponse(href string, pstats []Propstat) *response {
 	resp := response{
-		Href:     []string{(&url.URL{Path: href}).EscapedPath()},
+		Href:     []string{hrefPath(href)},
 		Propstat: make([]propstat, 0, len(pstats)),
 	}
 	for _, p := range pstats {
@@ -855,22 +2048,64 @@ func StatusText(code int) string {
 }
 
 var (
+	errChecksumMismatch        = errors.New("webdav: checksum mismatch")
+	errConcurrentPut           = errors.New("webdav: concurrent upload in progress")
 	errDestinationEqualsSource = errors.New("webdav: destination equals source")
+	errDirDefaults             = errors.New("webdav: cannot apply directory defaults")
 	errDirectoryNotEmpty       = errors.New("webdav: directory not empty")
+	errFileChanged             = errors.New("webdav: file changed while being read")
+	errIncompleteBody          = errors.New("webdav: incomplete body")
+	errInsecureCredentials     = errors.New("webdav: credentials sent over plaintext HTTP")
+	errInvalidACL              = errors.New("webdav: invalid acl")
+	errInvalidChunk            = errors.New("webdav: invalid chunk")
+	errInvalidContentRange     = errors.New("webdav: invalid content range")
 	errInvalidDepth            = errors.New("webdav: invalid depth")
 	errInvalidDestination      = errors.New("webdav: invalid destination")
+	errInvalidExpectedLength   = errors.New("webdav: invalid expected length")
 	errInvalidIfHeader         = errors.New("webdav: invalid If header")
 	errInvalidLockInfo         = errors.New("webdav: invalid lock info")
+	errInvalidLockSnapshot     = errors.New("webdav: invalid lock snapshot")
 	errInvalidLockToken        = errors.New("webdav: invalid lock token")
+	errInvalidMTime            = errors.New("webdav: invalid modification time")
+	errInvalidPropValue        = errors.New("webdav: invalid property value")
 	errInvalidPropfind         = errors.New("webdav: invalid propfind")
+	errInvalidPropfindOffset   = errors.New("webdav: invalid propfind offset")
 	errInvalidProppatch        = errors.New("webdav: invalid proppatch")
 	errInvalidResponse         = errors.New("webdav: invalid response")
+	errInvalidSearch           = errors.New("webdav: invalid search")
 	errInvalidTimeout          = errors.New("webdav: invalid timeout")
+	errInvalidUpdate           = errors.New("webdav: invalid update")
+	errInvalidUploadLength     = errors.New("webdav: invalid upload length")
+	errInvalidUploadMetadata   = errors.New("webdav: invalid upload metadata")
+	errInvalidUploadOffset     = errors.New("webdav: invalid upload offset")
+	errIsADirectory            = errors.New("webdav: is a directory")
+	errListingAborted          = errors.New("webdav: listing aborted by the client")
+	errLockNotSupported        = errors.New("webdav: locks not supported")
+	errLockPrincipalMismatch   = errors.New("webdav: lock owned by another principal")
+	errLockTakeoverRefused     = errors.New("webdav: lock takeover refused")
+	errLockTokenMismatch       = errors.New("webdav: lock token does not match the request URI")
+	errMaintenance             = errors.New("webdav: maintenance mode")
+	errNoCache                 = errors.New("webdav: no cache to flush")
 	errNoFileSystem            = errors.New("webdav: no file system")
+	errNoHandler               = errors.New("webdav: no administered handler")
 	errNoLockSystem            = errors.New("webdav: no lock system")
+	errNoOperations            = errors.New("webdav: no asynchronous operations")
 	errNotADirectory           = errors.New("webdav: not a directory")
+	errPreconditionFailed      = errors.New("webdav: precondition failed")
 	errPrefixMismatch          = errors.New("webdav: prefix mismatch")
+	errPropfindTruncated       = errors.New("webdav: propfind results truncated")
+	errQuotaExceeded           = errors.New("webdav: quota exceeded")
+	errRangeNotSatisfiable     = errors.New("webdav: range not satisfiable")
 	errRecursionTooDeep        = errors.New("webdav: recursion too deep")
+	errReservedName            = errors.New("webdav: reserved name")
+	errRetained                = errors.New("webdav: resource under retention")
+	errTooManyChunks           = errors.New("webdav: too many chunks")
+	errUnsupportedConversion   = errors.New("webdav: unsupported conversion")
 	errUnsupportedLockInfo     = errors.New("webdav: unsupported lock info")
 	errUnsupportedMethod       = errors.New("webdav: unsupported method")
+	errUnsupportedPatch        = errors.New("webdav: unsupported patch")
+	errUnsupportedReport       = errors.New("webdav: unsupported report")
+	errUnsupportedTusVersion   = errors.New("webdav: unsupported tus version")
+	errUploadInProgress        = errors.New("webdav: upload in progress")
+	errWriteVerification       = errors.New("webdav: write verification failed")
 )
@@ -5,7 +5,9 @@
 package webdav
 
 import (
+	"bytes"
 	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
@@ -13,11 +15,13 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 // createLockBody comes from the example in Section 9.10.7.
@@ -455,3 +459,1107 @@ func TestDelete(t *testing.T) {
 		}
 	}
 }
+
+func TestLockNullResources(t *testing.T) {
+	fs := NewMemFS()
+	h := &Handler{
+		FileSystem:        fs,
+		LockSystem:        NewMemLS(),
+		LockNullResources: true,
+	}
+	do := func(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+		var bodyReader io.Reader
+		if body != "" {
+			bodyReader = strings.NewReader(body)
+		}
+		req := httptest.NewRequest(method, path, bodyReader)
+		for len(headers) >= 2 {
+			req.Header.Add(headers[0], headers[1])
+			headers = headers[2:]
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	ctx := context.Background()
+	if err := fs.Mkdir(ctx, "/dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := do("LOCK", "/dir/null", createLockBody)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("LOCK: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	token := rec.Header().Get("Lock-Token")
+	if _, err := fs.Stat(ctx, "/dir/null"); !os.IsNotExist(err) {
+		t.Fatalf("Stat after LOCK: got %v, want not exist", err)
+	}
+
+	rec = do("PROPFIND", "/dir", "", "Depth", "1")
+	if rec.Code != StatusMulti {
+		t.Fatalf("PROPFIND /dir: got status %d, want %d", rec.Code, StatusMulti)
+	}
+	if !strings.Contains(rec.Body.String(), "<D:response><D:href>/dir/null</D:href>") {
+		t.Fatalf("PROPFIND /dir: lock-null resource not listed:\n%s", rec.Body.String())
+	}
+	rec = do("PROPFIND", "/dir/null", "", "Depth", "0")
+	if rec.Code != StatusMulti {
+		t.Fatalf("PROPFIND /dir/null: got status %d, want %d", rec.Code, StatusMulti)
+	}
+	if !strings.Contains(rec.Body.String(), "<D:activelock>") {
+		t.Fatalf("PROPFIND /dir/null: lockdiscovery not reported:\n%s", rec.Body.String())
+	}
+
+	rec = do("UNLOCK", "/dir/null", "", "Lock-Token", token)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("UNLOCK: got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	rec = do("PROPFIND", "/dir", "", "Depth", "1")
+	if strings.Contains(rec.Body.String(), "/dir/null") {
+		t.Fatalf("PROPFIND /dir after UNLOCK: lock-null resource still listed:\n%s", rec.Body.String())
+	}
+	rec = do("PROPFIND", "/dir/null", "", "Depth", "0")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("PROPFIND /dir/null after UNLOCK: got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// A PUT turns the lock-null resource into a regular one.
+	rec = do("LOCK", "/dir/null", createLockBody)
+	token = rec.Header().Get("Lock-Token")
+	rec = do("PUT", "/dir/null", "content", "If", "("+token+")")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+	rec = do("PROPFIND", "/dir", "", "Depth", "1")
+	if n := strings.Count(rec.Body.String(), "<D:response><D:href>/dir/null</D:href>"); n != 1 {
+		t.Fatalf("PROPFIND /dir after PUT: got %d responses for /dir/null, want 1", n)
+	}
+	rec = do("UNLOCK", "/dir/null", "", "Lock-Token", token)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("UNLOCK after PUT: got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if _, err := fs.Stat(ctx, "/dir/null"); err != nil {
+		t.Fatalf("Stat after UNLOCK: %v", err)
+	}
+}
+
+func TestLockLimits(t *testing.T) {
+	h := &Handler{
+		FileSystem: NewMemFS(),
+		LockSystem: NewMemLS(),
+		Principal: func(r *http.Request) string {
+			user, _, _ := r.BasicAuth()
+			return user
+		},
+		LockLimits: LockLimits{
+			MaxPerPrincipal: 1,
+			Status:          http.StatusServiceUnavailable,
+		},
+	}
+	lock := func(path, user string) int {
+		req := httptest.NewRequest("LOCK", path, strings.NewReader(createLockBody))
+		req.SetBasicAuth(user, "password")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := lock("/a", "alice"); code != http.StatusCreated {
+		t.Fatalf("LOCK /a by alice: got status %d, want %d", code, http.StatusCreated)
+	}
+	if code := lock("/b", "alice"); code != http.StatusServiceUnavailable {
+		t.Fatalf("LOCK /b by alice: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := lock("/b", "bob"); code != http.StatusCreated {
+		t.Fatalf("LOCK /b by bob: got status %d, want %d", code, http.StatusCreated)
+	}
+	// Writes are not affected by the limits.
+	req := httptest.NewRequest("PUT", "/c", strings.NewReader("content"))
+	req.SetBasicAuth("alice", "password")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("PUT /c by alice: got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+}
+
+func TestUnlockTokenMismatch(t *testing.T) {
+	h := &Handler{
+		FileSystem: NewMemFS(),
+		LockSystem: NewMemLS(),
+	}
+	do := func(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+		var bodyReader io.Reader
+		if body != "" {
+			bodyReader = strings.NewReader(body)
+		}
+		req := httptest.NewRequest(method, path, bodyReader)
+		for len(headers) >= 2 {
+			req.Header.Add(headers[0], headers[1])
+			headers = headers[2:]
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := do("MKCOL", "/dir", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+	rec := do("LOCK", "/dir", createLockBody, "Depth", "0")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("LOCK: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	token := rec.Header().Get("Lock-Token")
+
+	testCases := []struct {
+		path, token string
+		want        int
+	}{
+		{"/other", token, http.StatusConflict},
+		{"/dir/child", token, http.StatusConflict},
+		{"/dir", "<unknown>", http.StatusConflict},
+		{"/dir/", token, http.StatusNoContent},
+	}
+	for _, tc := range testCases {
+		if rec := do("UNLOCK", tc.path, "", "Lock-Token", tc.token); rec.Code != tc.want {
+			t.Errorf("UNLOCK %s %s: got status %d, want %d", tc.path, tc.token, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestStrictUnlock(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		h := &Handler{
+			FileSystem: NewMemFS(),
+			LockSystem: NewMemLS(),
+			Principal: func(r *http.Request) string {
+				user, _, _ := r.BasicAuth()
+				return user
+			},
+			StrictUnlock: strict,
+		}
+		do := func(method, path, user string, headers ...string) *httptest.ResponseRecorder {
+			var body io.Reader
+			if method == "LOCK" {
+				body = strings.NewReader(createLockBody)
+			}
+			req := httptest.NewRequest(method, path, body)
+			req.SetBasicAuth(user, "password")
+			for len(headers) >= 2 {
+				req.Header.Add(headers[0], headers[1])
+				headers = headers[2:]
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec
+		}
+		rec := do("LOCK", "/file", "alice")
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("strict=%t: LOCK: got status %d, want %d", strict, rec.Code, http.StatusCreated)
+		}
+		token := rec.Header().Get("Lock-Token")
+
+		want := http.StatusNoContent
+		if strict {
+			want = http.StatusForbidden
+		}
+		if rec := do("UNLOCK", "/file", "bob", "Lock-Token", token); rec.Code != want {
+			t.Fatalf("strict=%t: UNLOCK by bob: got status %d, want %d", strict, rec.Code, want)
+		}
+		if strict {
+			if rec := do("UNLOCK", "/file", "alice", "Lock-Token", token); rec.Code != http.StatusNoContent {
+				t.Fatalf("strict=%t: UNLOCK by alice: got status %d, want %d", strict, rec.Code, http.StatusNoContent)
+			}
+		}
+	}
+}
+
+type locksFileInfo struct {
+	os.FileInfo
+	entries []LockEntry
+}
+
+func (fi locksFileInfo) SupportedLocks(ctx context.Context) ([]LockEntry, error) {
+	return fi.entries, nil
+}
+
+// locksFS reports the lock entries of its files.
+type locksFS struct {
+	FileSystem
+	entries []LockEntry
+}
+
+func (fs locksFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := fs.FileSystem.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return locksFileInfo{fi, fs.entries}, nil
+}
+
+func TestSupportedLocks(t *testing.T) {
+	memFS, err := buildTestFS([]string{"touch /file"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	testCases := []struct {
+		desc        string
+		fs          FileSystem
+		partial     bool
+		wantDAV     string
+		wantAllow   string
+		wantLock    int
+		wantSupport string
+	}{{
+		desc:        "default",
+		fs:          memFS,
+		wantDAV:     "1, 2",
+		wantAllow:   "OPTIONS, LOCK, GET, HEAD, POST, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND, PUT",
+		wantLock:    http.StatusOK,
+		wantSupport: "<D:lockscope><D:exclusive/></D:lockscope>",
+	}, {
+		desc:      "no locks",
+		fs:        locksFS{memFS, nil},
+		wantDAV:   "1",
+		wantAllow: "OPTIONS, GET, HEAD, POST, DELETE, PROPPATCH, COPY, MOVE, PROPFIND, PUT",
+		wantLock:  http.StatusMethodNotAllowed,
+	}, {
+		desc:        "shared locks only",
+		fs:          locksFS{memFS, []LockEntry{{Scope: "shared", Type: "write"}}},
+		wantDAV:     "1, 2",
+		wantAllow:   "OPTIONS, LOCK, GET, HEAD, POST, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND, PUT",
+		wantLock:    StatusUnprocessableEntity,
+		wantSupport: "<D:lockscope><D:shared/></D:lockscope>",
+	}, {
+		desc:      "invalid entries",
+		fs:        locksFS{memFS, []LockEntry{{Scope: "exclusive/><D:injected", Type: "write"}}},
+		wantDAV:   "1",
+		wantAllow: "OPTIONS, GET, HEAD, POST, DELETE, PROPPATCH, COPY, MOVE, PROPFIND, PUT",
+		wantLock:  http.StatusMethodNotAllowed,
+	}, {
+		desc:      "no locks with partial updates",
+		fs:        locksFS{memFS, nil},
+		partial:   true,
+		wantDAV:   "1, sabredav-partialupdate",
+		wantAllow: "OPTIONS, GET, HEAD, POST, DELETE, PROPPATCH, COPY, MOVE, PROPFIND, PUT, PATCH",
+		wantLock:  http.StatusMethodNotAllowed,
+	}}
+
+	for _, tc := range testCases {
+		h := &Handler{
+			FileSystem:     tc.fs,
+			LockSystem:     NewMemLS(),
+			PartialUpdates: tc.partial,
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("OPTIONS", "/file", nil))
+		if got := rec.Header().Get("DAV"); got != tc.wantDAV {
+			t.Errorf("%s: OPTIONS: got DAV %q, want %q", tc.desc, got, tc.wantDAV)
+		}
+		if got := rec.Header().Get("Allow"); got != tc.wantAllow {
+			t.Errorf("%s: OPTIONS: got Allow %q, want %q", tc.desc, got, tc.wantAllow)
+		}
+
+		rec = httptest.NewRecorder()
+		req := httptest.NewRequest("PROPFIND", "/file", strings.NewReader(
+			`<D:propfind xmlns:D="DAV:"><D:prop><D:supportedlock/></D:prop></D:propfind>`))
+		req.Header.Set("Depth", "0")
+		h.ServeHTTP(rec, req)
+		body := rec.Body.String()
+		if tc.wantSupport != "" && !strings.Contains(body, tc.wantSupport) {
+			t.Errorf("%s: PROPFIND: got %s, want it to contain %s", tc.desc, body, tc.wantSupport)
+		}
+		if tc.wantSupport == "" && strings.Contains(body, "lockentry") {
+			t.Errorf("%s: PROPFIND: got %s, want no lock entries", tc.desc, body)
+		}
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("LOCK", "/file", strings.NewReader(createLockBody)))
+		if rec.Code != tc.wantLock {
+			t.Errorf("%s: LOCK: got status %d, want %d", tc.desc, rec.Code, tc.wantLock)
+		}
+	}
+}
+
+type corruptFile struct {
+	File
+}
+
+func (f corruptFile) Write(p []byte) (int, error) {
+	q := append([]byte(nil), p...)
+	for i := range q {
+		q[i] ^= 0xff
+	}
+	return f.File.Write(q)
+}
+
+type corruptFS struct {
+	FileSystem
+}
+
+func (fs corruptFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return corruptFile{f}, nil
+}
+
+func TestVerifyWrites(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		fs           FileSystem
+		verifyWrites bool
+		want         int
+	}{
+		{"reliable", NewMemFS(), true, http.StatusCreated},
+		{"unreliable without verification", corruptFS{NewMemFS()}, false, http.StatusCreated},
+		{"unreliable with verification", corruptFS{NewMemFS()}, true, http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		h := &Handler{
+			FileSystem:   tc.fs,
+			LockSystem:   NewMemLS(),
+			VerifyWrites: tc.verifyWrites,
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("PUT", "/file", strings.NewReader("content")))
+		if rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.desc, rec.Code, tc.want)
+		}
+	}
+}
+
+// overwriteFS overwrites a file in place, keeping the same inode, after
+// the first read of it.
+type overwriteFS struct {
+	Dir
+}
+
+func (fs overwriteFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.Dir.OpenFile(ctx, name, flag, perm)
+	if err != nil || flag != os.O_RDONLY {
+		return f, err
+	}
+	return &overwriteFile{File: f, fs: fs, name: name}, nil
+}
+
+type overwriteFile struct {
+	File
+	fs   overwriteFS
+	name string
+	done bool
+}
+
+func (f *overwriteFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if !f.done {
+		f.done = true
+		data := bytes.Repeat([]byte("b"), 100*1024)
+		if err := os.WriteFile(filepath.Join(string(f.fs.Dir), f.name), data, 0644); err != nil {
+			return 0, err
+		}
+		// Make sure the change is visible even with coarse timestamps.
+		future := time.Now().Add(time.Hour)
+		if err := os.Chtimes(filepath.Join(string(f.fs.Dir), f.name), future, future); err != nil {
+			return 0, err
+		}
+	}
+	return n, err
+}
+
+func TestGetConcurrentOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	old := bytes.Repeat([]byte("a"), 100*1024)
+	if err := os.WriteFile(filepath.Join(dir, "file"), old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		FileSystem: overwriteFS{Dir(dir)},
+		LockSystem: NewMemLS(),
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/file", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	// The response mixing old and new content is incomplete.
+	if body := rec.Body.Bytes(); len(body) >= len(old) {
+		t.Fatalf("got %d bytes, want a truncated response", len(body))
+	}
+}
+
+// statCountFS counts the Stat calls of its opened files.
+type statCountFS struct {
+	FileSystem
+	stats *int
+}
+
+func (fs statCountFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return statCountFile{f, fs.stats}, nil
+}
+
+type statCountFile struct {
+	File
+	stats *int
+}
+
+func (f statCountFile) Stat() (os.FileInfo, error) {
+	*f.stats++
+	return f.File.Stat()
+}
+
+type overwritingStatCountFS struct {
+	statCountFS
+}
+
+func (fs overwritingStatCountFS) OverwritesInPlace() bool {
+	return true
+}
+
+func TestGetStableChecks(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 3*stableCheckInterval+1)
+	testCases := []struct {
+		desc      string
+		overwrite bool
+		wantStats int
+	}{
+		// One Stat call is made by the Handler before serving the file.
+		{"not overwriting", false, 1},
+		{"overwriting", true, 5},
+	}
+	for _, tc := range testCases {
+		mem := NewMemFS()
+		var stats int
+		var fs FileSystem = statCountFS{mem, &stats}
+		if tc.overwrite {
+			fs = overwritingStatCountFS{statCountFS{mem, &stats}}
+		}
+		h := &Handler{
+			FileSystem: fs,
+			LockSystem: NewMemLS(),
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("PUT", "/file", bytes.NewReader(content)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("%s: PUT: got status %d, want %d", tc.desc, rec.Code, http.StatusCreated)
+		}
+		stats = 0
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/file", nil))
+		if rec.Code != http.StatusOK || rec.Body.Len() != len(content) {
+			t.Fatalf("%s: GET: got status %d and %d bytes", tc.desc, rec.Code, rec.Body.Len())
+		}
+		if stats != tc.wantStats {
+			t.Errorf("%s: got %d Stat calls, want %d", tc.desc, stats, tc.wantStats)
+		}
+	}
+}
+
+func TestCanonicalXML(t *testing.T) {
+	fs, err := buildTestFS([]string{"mkdir /dir", "touch /dir/c", "touch /dir/a", "mkdir /dir/b", "touch /dir/d"})
+	if err != nil {
+		t.Fatalf("cannot create test filesystem: %v", err)
+	}
+	h := &Handler{
+		FileSystem:   fs,
+		LockSystem:   NewMemLS(),
+		CanonicalXML: true,
+	}
+	const body = `<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getetag/>` +
+		`<D:displayname/><D:getcontentlength/></D:prop></D:propfind>`
+	var first string
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("PROPFIND", "/dir", strings.NewReader(body)))
+		if rec.Code != StatusMulti {
+			t.Fatalf("got status %d, want %d", rec.Code, StatusMulti)
+		}
+		if i == 0 {
+			first = rec.Body.String()
+		} else if got := rec.Body.String(); got != first {
+			t.Fatalf("got different responses:\n%s\n%s", first, got)
+		}
+	}
+	hrefs := regexp.MustCompile(`<D:href>([^<]*)</D:href>`).FindAllStringSubmatch(first, -1)
+	var got []string
+	for _, m := range hrefs {
+		got = append(got, m[1])
+	}
+	if want := []string{"/dir/", "/dir/a", "/dir/b/", "/dir/c", "/dir/d"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got hrefs %q, want %q", got, want)
+	}
+	// The properties of the files are sorted by name, the ones not defined
+	// for collections are reported after the others.
+	if !strings.Contains(first, "<D:href>/dir/a</D:href><D:propstat><D:prop><D:displayname>a</D:displayname>"+
+		"<D:getcontentlength>0</D:getcontentlength><D:getetag>") {
+		t.Fatalf("got %s, want sorted properties", first)
+	}
+	if !strings.Contains(first, "<D:status>HTTP/1.1 200 OK</D:status></D:propstat><D:propstat><D:prop>"+
+		"<D:getcontentlength></D:getcontentlength><D:getetag></D:getetag></D:prop><D:status>HTTP/1.1 404 Not Found") {
+		t.Fatalf("got %s, want the missing properties of collections last", first)
+	}
+}
+
+func TestContentLanguage(t *testing.T) {
+	h := &Handler{
+		FileSystem: Dir(t.TempDir()),
+		LockSystem: NewMemLS(),
+		PropStore:  NewMemPropStore(),
+	}
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	const proppatch = `<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop>` +
+		`<D:getcontentlanguage>de-CH</D:getcontentlanguage></D:prop></D:set></D:propertyupdate>`
+	const propfind = `<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlanguage/></D:prop></D:propfind>`
+
+	do("PUT", "/doc.txt", "Grüezi")
+	if got := do("GET", "/doc.txt", "").Header().Get("Content-Language"); got != "" {
+		t.Fatalf("GET before PROPPATCH: got Content-Language %q, want none", got)
+	}
+	if w := do("PROPPATCH", "/doc.txt", proppatch); !strings.Contains(w.Body.String(), "200 OK") {
+		t.Fatalf("PROPPATCH: got %s", w.Body.String())
+	}
+	if w := do("PROPFIND", "/doc.txt", propfind); !strings.Contains(w.Body.String(), "<D:getcontentlanguage>de-CH</D:getcontentlanguage>") {
+		t.Fatalf("PROPFIND: got %s", w.Body.String())
+	}
+	if got, want := do("GET", "/doc.txt", "").Header().Get("Content-Language"), "de-CH"; got != want {
+		t.Fatalf("GET: got Content-Language %q, want %q", got, want)
+	}
+}
+
+func TestPropfindPropnameAndAllpropInclude(t *testing.T) {
+	h := &Handler{
+		FileSystem: Dir(t.TempDir()),
+		LockSystem: NewMemLS(),
+		PropStore:  NewMemPropStore(),
+	}
+	do := func(method, target, body string) string {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	do("PUT", "/file", "content")
+	do("PROPPATCH", "/file", `<D:propertyupdate xmlns:D="DAV:" xmlns:Z="ns"><D:set><D:prop>`+
+		`<Z:color>red</Z:color></D:prop></D:set></D:propertyupdate>`)
+
+	testCases := []struct {
+		desc, body  string
+		want, avoid []string
+	}{{
+		desc:  "propname",
+		body:  `<D:propfind xmlns:D="DAV:"><D:propname/></D:propfind>`,
+		want:  []string{`<color xmlns="ns"></color>`, "<D:getetag></D:getetag>"},
+		avoid: []string{"red", "Win32FileAttributes"},
+	}, {
+		desc:  "allprop",
+		body:  `<D:propfind xmlns:D="DAV:"><D:allprop/></D:propfind>`,
+		want:  []string{`<color xmlns="ns">red</color>`, "<D:getcontentlength>7</D:getcontentlength>"},
+		avoid: []string{"Win32FileAttributes"},
+	}, {
+		desc: "allprop with include",
+		body: `<D:propfind xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:"><D:allprop/>` +
+			`<D:include><Z:Win32FileAttributes/><D:getcontentlength/></D:include></D:propfind>`,
+		want: []string{
+			`<color xmlns="ns">red</color>`,
+			`<Win32FileAttributes xmlns="urn:schemas-microsoft-com:">00000020</Win32FileAttributes>`,
+		},
+	}}
+	for _, tc := range testCases {
+		got := do("PROPFIND", "/file", tc.body)
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: got %s, want %s", tc.desc, got, want)
+			}
+		}
+		for _, avoid := range tc.avoid {
+			if strings.Contains(got, avoid) {
+				t.Errorf("%s: got %s, want no %s", tc.desc, got, avoid)
+			}
+		}
+		if n := strings.Count(got, "<D:getcontentlength>"); n != 1 {
+			t.Errorf("%s: got getcontentlength %d times, want once", tc.desc, n)
+		}
+	}
+}
+
+func TestPropNamespaces(t *testing.T) {
+	proppatch := func(remove bool, props ...string) string {
+		op := "set"
+		if remove {
+			op = "remove"
+		}
+		return `<D:propertyupdate xmlns:D="DAV:" xmlns:O="http://owncloud.org/ns" xmlns:X="urn:x">` +
+			`<D:` + op + `><D:prop>` + strings.Join(props, "") + `</D:prop></D:` + op + `></D:propertyupdate>`
+	}
+	const forbidden = `<D:error><W:forbidden-property-namespace xmlns:W="https://github.com/drakkan/webdav"/></D:error>`
+
+	testCases := []struct {
+		desc            string
+		allowed, denied []string
+		body            string
+		wantForbidden   bool
+	}{{
+		desc:    "allowed namespace",
+		allowed: []string{"http://owncloud.org/ns"},
+		body:    proppatch(false, "<O:favorite>1</O:favorite>"),
+	}, {
+		desc:          "namespace not allowed",
+		allowed:       []string{"http://owncloud.org/ns"},
+		body:          proppatch(false, "<O:favorite>1</O:favorite>", "<X:junk>1</X:junk>"),
+		wantForbidden: true,
+	}, {
+		desc:          "denied namespace",
+		denied:        []string{"urn:x"},
+		body:          proppatch(false, "<X:junk>1</X:junk>"),
+		wantForbidden: true,
+	}, {
+		desc:    "removal",
+		allowed: []string{"http://owncloud.org/ns"},
+		body:    proppatch(true, "<X:junk/>"),
+	}, {
+		desc:    "writable live property",
+		allowed: []string{"http://owncloud.org/ns"},
+		body:    proppatch(false, "<D:displayname>Report</D:displayname>"),
+	}}
+	for _, tc := range testCases {
+		h := &Handler{
+			FileSystem:            Dir(t.TempDir()),
+			LockSystem:            NewMemLS(),
+			PropStore:             NewMemPropStore(),
+			AllowedPropNamespaces: tc.allowed,
+			DeniedPropNamespaces:  tc.denied,
+		}
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/file", strings.NewReader("content")))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PROPPATCH", "/file", strings.NewReader(tc.body)))
+		got := w.Body.String()
+		if tc.wantForbidden {
+			if !strings.Contains(got, "403 Forbidden") || !strings.Contains(got, forbidden) {
+				t.Errorf("%s: got %s, want 403 with the forbidden-property-namespace precondition", tc.desc, got)
+			}
+			if strings.Contains(got, "200 OK") {
+				t.Errorf("%s: got %s, want no property set", tc.desc, got)
+			}
+			if props, _ := h.PropStore.Get(context.Background(), "/file"); len(props) != 0 {
+				t.Errorf("%s: got stored properties %v, want none", tc.desc, props)
+			}
+		} else if !strings.Contains(got, "200 OK") || strings.Contains(got, "403") {
+			t.Errorf("%s: got %s, want 200 OK", tc.desc, got)
+		}
+	}
+}
+
+func TestOnPropChange(t *testing.T) {
+	type change struct {
+		name      string
+		props     []xml.Name
+		principal string
+	}
+	var got []change
+	h := &Handler{
+		FileSystem: Dir(t.TempDir()),
+		LockSystem: NewMemLS(),
+		PropStore:  NewMemPropStore(),
+		Principal:  func(*http.Request) string { return "alice" },
+		OnPropChange: func(r *http.Request, name string, props []xml.Name, principal string) {
+			got = append(got, change{name, props, principal})
+		},
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/file", strings.NewReader("content")))
+	proppatch := func(body string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PROPPATCH", "/file", strings.NewReader(
+			`<D:propertyupdate xmlns:D="DAV:" xmlns:X="urn:x">`+body+`</D:propertyupdate>`)))
+	}
+
+	proppatch(`<D:set><D:prop><X:a>1</X:a><D:displayname>File</D:displayname></D:prop></D:set>`)
+	proppatch(`<D:set><D:prop><X:b>1</X:b><D:resourcetype/></D:prop></D:set>`)
+	proppatch(`<D:remove><D:prop><X:a/></D:prop></D:remove>`)
+
+	want := []change{{
+		name:      "/file",
+		props:     []xml.Name{{Space: "urn:x", Local: "a"}, {Space: "DAV:", Local: "displayname"}},
+		principal: "alice",
+	}, {
+		name:      "/file",
+		props:     []xml.Name{{Space: "urn:x", Local: "a"}},
+		principal: "alice",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got changes %v, want %v", got, want)
+	}
+}
+
+func TestPropfindHrefs(t *testing.T) {
+	ctx := context.Background()
+	fs := NewMemFS()
+	if err := fs.Mkdir(ctx, "/bad\xff", 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a b#c?d%e", "/café", "/bad\xff/f"} {
+		f, err := fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	const propfind = `<D:propfind xmlns:D="DAV:"><D:prop><D:displayname/></D:prop></D:propfind>`
+
+	testCases := []struct {
+		policy   InvalidNamePolicy
+		want     []string
+		wantNone []string
+	}{{
+		policy: InvalidNamesEscape,
+		want: []string{
+			"<D:href>/a%20b%23c%3Fd%25e</D:href>",
+			"<D:href>/caf%C3%A9</D:href>",
+			"<D:href>/bad%FF/</D:href>",
+			"<D:displayname>bad�</D:displayname>",
+		},
+	}, {
+		policy: InvalidNamesSkip,
+		want: []string{
+			"<D:href>/a%20b%23c%3Fd%25e</D:href>",
+			"<D:href>/caf%C3%A9</D:href>",
+		},
+		wantNone: []string{"bad"},
+	}}
+	for _, tc := range testCases {
+		h := &Handler{
+			FileSystem:   fs,
+			LockSystem:   NewMemLS(),
+			InvalidNames: tc.policy,
+		}
+		r := httptest.NewRequest("PROPFIND", "/", strings.NewReader(propfind))
+		r.Header.Set("Depth", "1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		got := w.Body.String()
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("policy %d: got %s, want it to contain %s", tc.policy, got, want)
+			}
+		}
+		for _, s := range tc.wantNone {
+			if strings.Contains(got, s) {
+				t.Errorf("policy %d: got %s, want it not to contain %s", tc.policy, got, s)
+			}
+		}
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	const (
+		propfind = `<D:propfind xmlns:D="DAV:"><D:prop><D:getcontenttype/></D:prop></D:propfind>`
+		setType  = `<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop>` +
+			`<D:getcontenttype>application/vnd.custom</D:getcontenttype></D:prop></D:set></D:propertyupdate>`
+	)
+	testCases := []struct {
+		desc          string
+		config        ContentTypes
+		name          string
+		wantType      string
+		wantProppatch string
+	}{{
+		desc:          "sniffed",
+		name:          "/page",
+		wantType:      "text/html; charset=utf-8",
+		wantProppatch: "403 Forbidden",
+	}, {
+		desc:          "no sniffing",
+		config:        ContentTypes{NoSniff: true},
+		name:          "/page",
+		wantType:      "application/octet-stream",
+		wantProppatch: "403 Forbidden",
+	}, {
+		desc:          "extension map",
+		config:        ContentTypes{Extensions: map[string]string{".md": "text/markdown"}},
+		name:          "/README.MD",
+		wantType:      "text/markdown",
+		wantProppatch: "403 Forbidden",
+	}, {
+		desc:          "override",
+		config:        ContentTypes{Overrides: true},
+		name:          "/page",
+		wantType:      "application/vnd.custom",
+		wantProppatch: "200 OK",
+	}}
+	for _, tc := range testCases {
+		h := &Handler{
+			FileSystem:   Dir(t.TempDir()),
+			LockSystem:   NewMemLS(),
+			PropStore:    NewMemPropStore(),
+			ContentTypes: tc.config,
+		}
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", tc.name, strings.NewReader("<html><body>page</body></html>")))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PROPPATCH", tc.name, strings.NewReader(setType)))
+		if !strings.Contains(w.Body.String(), tc.wantProppatch) {
+			t.Errorf("%s: proppatch: got %s, want %s", tc.desc, w.Body.String(), tc.wantProppatch)
+		}
+
+		r := httptest.NewRequest("PROPFIND", tc.name, strings.NewReader(propfind))
+		r.Header.Set("Depth", "0")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if want := "<D:getcontenttype>" + tc.wantType + "</D:getcontenttype>"; !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: propfind: got %s, want it to contain %s", tc.desc, w.Body.String(), want)
+		}
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tc.name, nil))
+		if got := w.Header().Get("Content-Type"); got != tc.wantType {
+			t.Errorf("%s: get: got Content-Type %q, want %q", tc.desc, got, tc.wantType)
+		}
+	}
+}
+
+// batchFS is a FileSystem recording the largest number of directory members
+// read at once.
+type batchFS struct {
+	FileSystem
+	maxBatch int
+}
+
+func (fs *batchFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return batchFile{f, fs}, nil
+}
+
+type batchFile struct {
+	File
+	fs *batchFS
+}
+
+func (f batchFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	if len(fis) > f.fs.maxBatch {
+		f.fs.maxBatch = len(fis)
+	}
+	return fis, err
+}
+
+// flushRecorder is a ResponseRecorder recording the size of the body when
+// first flushed.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes      int
+	firstFlushed int
+}
+
+func (w *flushRecorder) Flush() {
+	if w.flushes == 0 {
+		w.firstFlushed = w.Body.Len()
+	}
+	w.flushes++
+	w.ResponseRecorder.Flush()
+}
+
+func TestPropfindStreaming(t *testing.T) {
+	const n = 2500
+	ctx := context.Background()
+	mem := NewMemFS()
+	if err := mem.Mkdir(ctx, "/dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		f, err := mem.OpenFile(ctx, fmt.Sprintf("/dir/file%d", i), os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	fs := &batchFS{FileSystem: mem}
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+	}
+	r := httptest.NewRequest("PROPFIND", "/dir", strings.NewReader(
+		`<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/></D:prop></D:propfind>`))
+	r.Header.Set("Depth", "1")
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, r)
+
+	if w.Code != StatusMulti {
+		t.Fatalf("got status %d, want %d", w.Code, StatusMulti)
+	}
+	if got := strings.Count(w.Body.String(), "<D:response>"); got != n+1 {
+		t.Errorf("got %d responses, want %d", got, n+1)
+	}
+	if fs.maxBatch > walkBatchSize {
+		t.Errorf("got %d members read at once, want at most %d", fs.maxBatch, walkBatchSize)
+	}
+	if w.flushes < n/multistatusFlushInterval {
+		t.Errorf("got %d flushes, want at least %d", w.flushes, n/multistatusFlushInterval)
+	}
+	if w.firstFlushed == 0 || w.firstFlushed >= w.Body.Len()/10 {
+		t.Errorf("got %d of %d bytes written when first flushed, want the response to be streamed", w.firstFlushed, w.Body.Len())
+	}
+}
+
+// readdirFS is a FileSystem whose directories return an empty batch before
+// each batch of members, or all their members at once if ignoreCount is set,
+// and then all their members again on every call if repeat is set too.
+type readdirFS struct {
+	FileSystem
+	ignoreCount bool
+	repeat      bool
+}
+
+func (fs readdirFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &readdirFile{File: f, ignoreCount: fs.ignoreCount, repeat: fs.repeat}, nil
+}
+
+type readdirFile struct {
+	File
+	ignoreCount bool
+	repeat      bool
+	calls       int
+	all         []os.FileInfo
+}
+
+func (f *readdirFile) Readdir(count int) ([]os.FileInfo, error) {
+	f.calls++
+	if f.repeat {
+		if f.all == nil {
+			var err error
+			if f.all, err = f.File.Readdir(-1); err != nil {
+				return nil, err
+			}
+		}
+		return f.all, nil
+	}
+	if f.ignoreCount {
+		return f.File.Readdir(-1)
+	}
+	if f.calls%2 == 1 {
+		return nil, nil
+	}
+	return f.File.Readdir(count)
+}
+
+func TestWalkFSEmptyBatches(t *testing.T) {
+	const n = 2500
+	ctx := context.Background()
+	mem := NewMemFS()
+	if err := mem.Mkdir(ctx, "/dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		f, err := mem.OpenFile(ctx, fmt.Sprintf("/dir/file%d", i), os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	for _, ignoreCount := range []bool{false, true} {
+		fs := readdirFS{mem, ignoreCount, false}
+		fi, err := fs.Stat(ctx, "/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := 0
+		err = walkFS(ctx, fs, -1, "/dir", fi, func(name string, info os.FileInfo, err error) error {
+			got++
+			return err
+		})
+		if err != nil || got != n+1 {
+			t.Errorf("ignoreCount=%t: got %d members, %v, want %d", ignoreCount, got, err, n+1)
+		}
+	}
+
+	// The directories returning all their members on each call, even if
+	// fewer than a batch, are listed once.
+	for _, size := range []int{10, walkBatchSize} {
+		if err := mem.Mkdir(ctx, fmt.Sprintf("/repeat%d", size), 0777); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < size; i++ {
+			f, err := mem.OpenFile(ctx, fmt.Sprintf("/repeat%d/file%d", size, i), os.O_RDWR|os.O_CREATE, 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+		}
+		fs := readdirFS{mem, true, true}
+		fi, err := fs.Stat(ctx, fmt.Sprintf("/repeat%d", size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := 0
+		err = walkFS(ctx, fs, -1, fmt.Sprintf("/repeat%d", size), fi, func(name string, info os.FileInfo, err error) error {
+			got++
+			return err
+		})
+		if err != nil || got != size+1 {
+			t.Errorf("repeat %d: got %d members, %v, want %d", size, got, err, size+1)
+		}
+	}
+}
+
+// disconnectRecorder is a ResponseRecorder whose client goes away when it is
+// first flushed.
+type disconnectRecorder struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w *disconnectRecorder) Flush() {
+	w.cancel()
+	w.ResponseRecorder.Flush()
+}
+
+func TestPropfindAbortedListing(t *testing.T) {
+	const n = 2500
+	ctx := context.Background()
+	fs := NewMemFS()
+	if err := fs.Mkdir(ctx, "/dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		f, err := fs.OpenFile(ctx, fmt.Sprintf("/dir/file%d", i), os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	aborted := -1
+	h := &Handler{
+		FileSystem: fs,
+		LockSystem: NewMemLS(),
+		OnAbortedListing: func(r *http.Request, responses int) {
+			aborted = responses
+		},
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r := httptest.NewRequest("PROPFIND", "/dir", strings.NewReader(
+		`<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/></D:prop></D:propfind>`)).WithContext(ctx)
+	r.Header.Set("Depth", "1")
+	w := &disconnectRecorder{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+	h.ServeHTTP(w, r)
+
+	if aborted != multistatusFlushInterval {
+		t.Errorf("got OnAbortedListing after %d responses, want %d", aborted, multistatusFlushInterval)
+	}
+	if got := strings.Count(w.Body.String(), "<D:response>"); got != multistatusFlushInterval {
+		t.Errorf("got %d responses, want the listing to stop after %d", got, multistatusFlushInterval)
+	}
+}
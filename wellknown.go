@@ -0,0 +1,74 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"os"
+)
+
+// WellKnown is an http.Handler redirecting the RFC 6764 well-known URIs,
+// "/.well-known/caldav" and "/.well-known/carddav", to the context path of
+// the CalDAV and CardDAV services, so that clients such as Apple Calendar
+// and DAVx5 can configure accounts given just the server name. It must be
+// mounted at the root of the server, for example:
+//
+//	mux.Handle("/.well-known/", &webdav.WellKnown{CalDAV: "/dav/", CardDAV: "/dav/"})
+//
+// Clients then look up the DAV:current-user-principal property of the
+// context path, see Handler.PrincipalURL.
+type WellKnown struct {
+	// CalDAV is the context path of the CalDAV service. If empty,
+	// "/.well-known/caldav" is not found.
+	CalDAV string
+	// CardDAV is the context path of the CardDAV service. If empty,
+	// "/.well-known/carddav" is not found.
+	CardDAV string
+}
+
+func (wk *WellKnown) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var target string
+	switch r.URL.Path {
+	case "/.well-known/caldav", "/.well-known/caldav/":
+		target = wk.CalDAV
+	case "/.well-known/carddav", "/.well-known/carddav/":
+		target = wk.CardDAV
+	}
+	if target == "" {
+		http.NotFound(w, r)
+		return
+	}
+	// RFC 6764 section 5 allows 301, 303 and 307. Clients are expected to
+	// repeat the request, usually a PROPFIND, to the new location.
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+type principalURLKey struct{}
+
+func withPrincipalURL(ctx context.Context, u string) context.Context {
+	return context.WithValue(ctx, principalURLKey{}, u)
+}
+
+func findCurrentUserPrincipal(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	u, ok := ctx.Value(principalURLKey{}).(string)
+	if !ok {
+		return "", ErrNotImplemented
+	}
+	if u == "" {
+		return `<D:unauthenticated xmlns:D="DAV:"/>`, nil
+	}
+	return `<D:href xmlns:D="DAV:">` + escapeXML(hrefPath(u)) + `</D:href>`, nil
+}
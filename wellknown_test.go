@@ -0,0 +1,92 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWellKnown(t *testing.T) {
+	wk := &WellKnown{CalDAV: "/dav/cal/"}
+	testCases := []struct {
+		method, target string
+		wantStatus     int
+		wantLocation   string
+	}{
+		{"GET", "/.well-known/caldav", http.StatusMovedPermanently, "/dav/cal/"},
+		{"PROPFIND", "/.well-known/caldav/", http.StatusMovedPermanently, "/dav/cal/"},
+		{"PROPFIND", "/.well-known/carddav", http.StatusNotFound, ""},
+		{"GET", "/.well-known/other", http.StatusNotFound, ""},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		wk.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.target, nil))
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.target, rec.Code, tc.wantStatus)
+		}
+		if got := rec.Header().Get("Location"); got != tc.wantLocation {
+			t.Errorf("%s %s: got location %q, want %q", tc.method, tc.target, got, tc.wantLocation)
+		}
+	}
+}
+
+func TestCurrentUserPrincipal(t *testing.T) {
+	const propfind = `<D:propfind xmlns:D="DAV:"><D:prop><D:current-user-principal/></D:prop></D:propfind>`
+	testCases := []struct {
+		desc         string
+		principalURL func(*http.Request) string
+		body         string
+		want         string
+	}{{
+		desc:         "authenticated",
+		principalURL: func(*http.Request) string { return "/principals/a b/" },
+		body:         propfind,
+		want:         "/principals/a%20b/</D:href>",
+	}, {
+		desc:         "anonymous",
+		principalURL: func(*http.Request) string { return "" },
+		body:         propfind,
+		want:         "<D:unauthenticated",
+	}, {
+		desc: "not configured",
+		body: propfind,
+		want: "404 Not Found",
+	}, {
+		desc:         "not in allprop",
+		principalURL: func(*http.Request) string { return "/principals/a/" },
+		want:         "<D:resourcetype>",
+	}}
+	for _, tc := range testCases {
+		h := &Handler{
+			FileSystem:   NewMemFS(),
+			LockSystem:   NewMemLS(),
+			PrincipalURL: tc.principalURL,
+		}
+		req := httptest.NewRequest("PROPFIND", "/", strings.NewReader(tc.body))
+		req.Header.Set("Depth", "0")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		body := rec.Body.String()
+		if rec.Code != StatusMulti || !strings.Contains(body, tc.want) {
+			t.Errorf("%s: got %d %s, want %q", tc.desc, rec.Code, body, tc.want)
+		}
+		if tc.body == "" && strings.Contains(body, "current-user-principal") {
+			t.Errorf("%s: got %s, want no current-user-principal", tc.desc, body)
+		}
+	}
+}
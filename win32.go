@@ -0,0 +1,205 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Windows file attributes reported by the Win32FileAttributes property.
+const (
+	win32AttrReadOnly  = 0x01
+	win32AttrHidden    = 0x02
+	win32AttrDirectory = 0x10
+	win32AttrArchive   = 0x20
+)
+
+// win32Namespace is the namespace of the properties set by Windows clients,
+// such as Explorer and Office, on the files they create.
+const win32Namespace = "urn:schemas-microsoft-com:"
+
+var (
+	win32CreationTimePropName     = xml.Name{Space: win32Namespace, Local: "Win32CreationTime"}
+	win32LastAccessTimePropName   = xml.Name{Space: win32Namespace, Local: "Win32LastAccessTime"}
+	win32LastModifiedTimePropName = xml.Name{Space: win32Namespace, Local: "Win32LastModifiedTime"}
+	win32FileAttributesPropName   = xml.Name{Space: win32Namespace, Local: "Win32FileAttributes"}
+)
+
+// Win32FS is an optional interface for the FileSystem, applying the
+// changes of the Windows file properties, in the "urn:schemas-microsoft-com:"
+// namespace, made by Windows clients using PROPPATCH.
+type Win32FS interface {
+	// Chtimes changes the access and modification times of resource name.
+	// A zero time is left unchanged.
+	Chtimes(ctx context.Context, name string, atime, mtime time.Time) error
+	// SetWin32Attributes sets the Windows attributes of resource name, such
+	// as FILE_ATTRIBUTE_READONLY (0x1) and FILE_ATTRIBUTE_HIDDEN (0x2). The
+	// attributes that can't be represented should be ignored.
+	SetWin32Attributes(ctx context.Context, name string, attrs uint32) error
+}
+
+// Win32FileInfo is an optional interface for the os.FileInfo objects
+// returned by the FileSystem, reporting the Windows file properties not
+// available from os.FileInfo.
+type Win32FileInfo interface {
+	// Win32Times returns the creation and last access times of the file. A
+	// zero time is unknown and not reported.
+	Win32Times() (creation, access time.Time)
+	// Win32Attributes returns the Windows attributes of the file.
+	Win32Attributes() uint32
+}
+
+// win32Attributes returns the Windows attributes of fi. Unless fi
+// implements Win32FileInfo, they are derived from its mode, according to the
+// ModePolicy of fs, and name.
+func win32Attributes(fs FileSystem, fi os.FileInfo) uint32 {
+	if wfi, ok := fi.(Win32FileInfo); ok {
+		return wfi.Win32Attributes()
+	}
+	var attrs uint32 = win32AttrArchive
+	if fi.IsDir() {
+		attrs = win32AttrDirectory
+	}
+	if fi.Mode().Perm()&modePolicy(fs).writeBits() == 0 {
+		attrs |= win32AttrReadOnly
+	}
+	if strings.HasPrefix(fi.Name(), ".") {
+		attrs |= win32AttrHidden
+	}
+	return attrs
+}
+
+func findWin32CreationTime(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	if wfi, ok := fi.(Win32FileInfo); ok {
+		if creation, _ := wfi.Win32Times(); !creation.IsZero() {
+			return creation.UTC().Format(http.TimeFormat), nil
+		}
+	}
+	if ct, ok := fi.(CreationTimer); ok {
+		if creation := ct.CreationTime(); !creation.IsZero() {
+			return creation.UTC().Format(http.TimeFormat), nil
+		}
+	}
+	return "", ErrNotImplemented
+}
+
+func findWin32LastAccessTime(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	if wfi, ok := fi.(Win32FileInfo); ok {
+		if _, access := wfi.Win32Times(); !access.IsZero() {
+			return access.UTC().Format(http.TimeFormat), nil
+		}
+	}
+	return "", ErrNotImplemented
+}
+
+func findWin32LastModifiedTime(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	return fi.ModTime().UTC().Format(http.TimeFormat), nil
+}
+
+func findWin32FileAttributes(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	return fmt.Sprintf("%08X", win32Attributes(fs, fi)), nil
+}
+
+func noUndo() error { return nil }
+
+// parseWin32Time parses the value of a Windows time property.
+func parseWin32Time(p Property) (time.Time, error) {
+	t, err := http.ParseTime(strings.TrimSpace(string(p.InnerXML)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %v", errInvalidPropValue, err)
+	}
+	return t, nil
+}
+
+func patchWin32CreationTime(ctx context.Context, fs FileSystem, name string, remove bool, p Property) (func() error, error) {
+	if !remove {
+		if _, err := parseWin32Time(p); err != nil {
+			return nil, err
+		}
+	}
+	// The creation time can't be changed through the FileSystem.
+	return noUndo, nil
+}
+
+func patchWin32LastAccessTime(ctx context.Context, fs FileSystem, name string, remove bool, p Property) (func() error, error) {
+	wfs, ok := fs.(Win32FS)
+	if remove || !ok {
+		return noUndo, nil
+	}
+	atime, err := parseWin32Time(p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := wfs.Chtimes(ctx, name, atime, time.Time{}); err != nil {
+		return nil, err
+	}
+	if wfi, ok := fi.(Win32FileInfo); ok {
+		if _, prev := wfi.Win32Times(); !prev.IsZero() {
+			return func() error { return wfs.Chtimes(ctx, name, prev, time.Time{}) }, nil
+		}
+	}
+	return noUndo, nil
+}
+
+func patchWin32LastModifiedTime(ctx context.Context, fs FileSystem, name string, remove bool, p Property) (func() error, error) {
+	wfs, ok := fs.(Win32FS)
+	if remove || !ok {
+		return noUndo, nil
+	}
+	mtime, err := parseWin32Time(p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := wfs.Chtimes(ctx, name, time.Time{}, mtime); err != nil {
+		return nil, err
+	}
+	prev := fi.ModTime()
+	return func() error { return wfs.Chtimes(ctx, name, time.Time{}, prev) }, nil
+}
+
+func patchWin32FileAttributes(ctx context.Context, fs FileSystem, name string, remove bool, p Property) (func() error, error) {
+	wfs, ok := fs.(Win32FS)
+	if remove || !ok {
+		return noUndo, nil
+	}
+	attrs, err := strconv.ParseUint(strings.TrimSpace(string(p.InnerXML)), 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidPropValue, err)
+	}
+	fi, err := fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := wfs.SetWin32Attributes(ctx, name, uint32(attrs)); err != nil {
+		return nil, err
+	}
+	prev := win32Attributes(fs, fi)
+	return func() error { return wfs.SetWin32Attributes(ctx, name, prev) }, nil
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWin32Props(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		FileSystem: Dir(dir),
+		LockSystem: NewMemLS(),
+	}
+	do := func(method, body string) string {
+		r := httptest.NewRequest(method, "/file", strings.NewReader(body))
+		r.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != StatusMulti {
+			t.Fatalf("%s: got status %d, want %d", method, w.Code, StatusMulti)
+		}
+		return w.Body.String()
+	}
+	proppatch := func(mtime, attrs string) string {
+		// As sent by Windows Explorer.
+		return `<?xml version="1.0" encoding="utf-8" ?>` +
+			`<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:"><D:set><D:prop>` +
+			`<Z:Win32CreationTime>Mon, 01 Jan 2024 10:00:00 GMT</Z:Win32CreationTime>` +
+			`<Z:Win32LastAccessTime>Tue, 02 Jan 2024 10:00:00 GMT</Z:Win32LastAccessTime>` +
+			`<Z:Win32LastModifiedTime>` + mtime + `</Z:Win32LastModifiedTime>` +
+			`<Z:Win32FileAttributes>` + attrs + `</Z:Win32FileAttributes>` +
+			`</D:prop></D:set></D:propertyupdate>`
+	}
+	const propfind = `<D:propfind xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:"><D:prop>` +
+		`<Z:Win32LastModifiedTime/><Z:Win32FileAttributes/><Z:Win32CreationTime/></D:prop></D:propfind>`
+
+	got := do("PROPPATCH", proppatch("Wed, 03 Jan 2024 10:00:00 GMT", "00000021"))
+	if strings.Contains(got, "403") || strings.Contains(got, "409") || !strings.Contains(got, "200 OK") {
+		t.Fatalf("PROPPATCH: got %s, want all properties patched", got)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC); !fi.ModTime().Equal(want) {
+		t.Errorf("got mtime %v, want %v", fi.ModTime(), want)
+	}
+	if fi.Mode().Perm()&0222 != 0 {
+		t.Errorf("got mode %v, want read-only", fi.Mode())
+	}
+	// The creation time can't be changed, Dir reports the birth time of
+	// the file where the platform supports it.
+	wantCreation := "<Win32CreationTime xmlns=\"urn:schemas-microsoft-com:\"></Win32CreationTime></D:prop><D:status>HTTP/1.1 404"
+	if dfi, err := Dir(dir).Stat(context.Background(), "/file"); err != nil {
+		t.Fatal(err)
+	} else if c := dfi.(CreationTimer).CreationTime(); !c.IsZero() {
+		wantCreation = ">" + c.UTC().Format(http.TimeFormat) + "</Win32CreationTime>"
+	}
+	got = do("PROPFIND", propfind)
+	for _, want := range []string{
+		">Wed, 03 Jan 2024 10:00:00 GMT</Win32LastModifiedTime>",
+		">00000021</Win32FileAttributes>",
+		wantCreation,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("PROPFIND: got %s, want %s", got, want)
+		}
+	}
+
+	// An invalid value fails the whole PROPPATCH, reverting the other
+	// changes.
+	got = do("PROPPATCH", proppatch("Thu, 04 Jan 2024 10:00:00 GMT", "invalid"))
+	if !strings.Contains(got, "409 Conflict") || !strings.Contains(got, "424 Failed Dependency") {
+		t.Fatalf("PROPPATCH invalid: got %s, want 409 and 424", got)
+	}
+	if fi, err = os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC); !fi.ModTime().Equal(want) {
+		t.Errorf("PROPPATCH invalid: got mtime %v, want %v", fi.ModTime(), want)
+	}
+
+	// Clearing the read-only attribute makes the file writable again.
+	do("PROPPATCH", proppatch("Wed, 03 Jan 2024 10:00:00 GMT", "00000020"))
+	if fi, err = os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&0200 == 0 {
+		t.Errorf("got mode %v, want writable", fi.Mode())
+	}
+}
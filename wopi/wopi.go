@@ -0,0 +1,414 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package wopi exposes the WOPI endpoints used by online office editors,
+// such as Collabora Online and OnlyOffice, over the same webdav.FileSystem
+// and webdav.LockSystem served by a webdav.Handler.
+//
+// WOPI locks are mapped to zero-depth exclusive DAV locks, so WebDAV clients
+// and office editors cannot overwrite each other's changes.
+//
+// See https://learn.microsoft.com/en-us/microsoft-365/cloud-storage-partner-program/rest/
+package wopi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/drakkan/webdav"
+)
+
+// LockDuration is the duration of WOPI locks, as required by the WOPI
+// specification.
+const LockDuration = 30 * time.Minute
+
+var (
+	errInvalidFileID = errors.New("wopi: invalid file id")
+	errLockMismatch  = errors.New("wopi: lock mismatch")
+	errNoAuthorize   = errors.New("wopi: no Authorize function")
+	errNoLock        = errors.New("wopi: missing X-WOPI-Lock header")
+	errNoOwnerSwap   = errors.New("wopi: the LockSystem cannot swap lock owners")
+	errNotAFile      = errors.New("wopi: not a file")
+)
+
+// Handler serves the WOPI files endpoints. It must be mounted at a path
+// ending with "/files/", for example "/wopi/files/".
+type Handler struct {
+	// Prefix is the URL path prefix to strip from the WOPI request paths,
+	// for example "/wopi/files/".
+	Prefix string
+	// FileSystem is the virtual file system.
+	FileSystem webdav.FileSystem
+	// LockSystem is the lock management system. The UnlockAndRelock
+	// operation is only supported if it implements webdav.LockOwnerSwapper,
+	// as the one returned by webdav.NewMemLS does.
+	LockSystem webdav.LockSystem
+	// ResolveID optionally maps a WOPI file ID to a FileSystem name. If nil,
+	// file IDs are the base64 URL encoding, without padding, of the names.
+	// See FileID.
+	ResolveID func(r *http.Request, id string) (string, error)
+	// Authorize validates the WOPI access token of the request for the
+	// given name. It returns the ID of the user and whether the user can
+	// write the file. If it returns an error, the Handler writes a "401
+	// Unauthorized" HTTP status. All the requests are refused if Authorize
+	// is nil.
+	Authorize func(r *http.Request, name string) (userID string, canWrite bool, err error)
+	// Logger is an optional error logger. If non-nil, it will be called
+	// for all HTTP requests.
+	Logger func(*http.Request, int, error)
+}
+
+// FileID returns the default WOPI file ID for name.
+func FileID(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(path.Clean("/" + name)))
+}
+
+func (h *Handler) resolve(r *http.Request, id string) (string, error) {
+	if h.ResolveID != nil {
+		return h.ResolveID(r, id)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return "", errInvalidFileID
+	}
+	return path.Clean("/" + string(b)), nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status, err := h.serve(w, r)
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+	if h.Logger != nil {
+		h.Logger(r, status, err)
+	}
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	rest := strings.TrimPrefix(r.URL.Path, h.Prefix)
+	if len(rest) == len(r.URL.Path) && h.Prefix != "" {
+		return http.StatusNotFound, errInvalidFileID
+	}
+	id, contents := rest, false
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		if rest[i:] != "/contents" {
+			return http.StatusNotFound, errInvalidFileID
+		}
+		id, contents = rest[:i], true
+	}
+	name, err := h.resolve(r, id)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	if h.Authorize == nil {
+		return http.StatusUnauthorized, errNoAuthorize
+	}
+	userID, canWrite, err := h.Authorize(r, name)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+	override := r.Header.Get("X-WOPI-Override")
+
+	switch {
+	case contents && r.Method == http.MethodGet:
+		return h.getFile(w, r, name)
+	case contents && r.Method == http.MethodPost && override == "PUT":
+		if !canWrite {
+			return http.StatusUnauthorized, os.ErrPermission
+		}
+		return h.putFile(w, r, name)
+	case !contents && r.Method == http.MethodGet:
+		return h.checkFileInfo(w, r, name, userID, canWrite)
+	case !contents && r.Method == http.MethodPost:
+		switch override {
+		case "LOCK", "UNLOCK", "REFRESH_LOCK":
+			if !canWrite {
+				return http.StatusUnauthorized, os.ErrPermission
+			}
+			return h.lock(w, r, name, override)
+		case "GET_LOCK":
+			w.Header().Set("X-WOPI-Lock", h.currentLock(name).id)
+			return http.StatusOK, nil
+		}
+	}
+	return http.StatusNotImplemented, fmt.Errorf("wopi: unsupported operation %s %q", r.Method, override)
+}
+
+func (h *Handler) stat(r *http.Request, name string) (os.FileInfo, int, error) {
+	fi, err := h.FileSystem.Stat(r.Context(), name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, http.StatusNotFound, err
+		}
+		if os.IsPermission(err) {
+			return nil, http.StatusUnauthorized, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+	if fi.IsDir() {
+		return nil, http.StatusNotFound, errNotAFile
+	}
+	return fi, 0, nil
+}
+
+// checkFileInfo is the WOPI CheckFileInfo operation.
+func (h *Handler) checkFileInfo(w http.ResponseWriter, r *http.Request, name, userID string, canWrite bool) (int, error) {
+	fi, status, err := h.stat(r, name)
+	if err != nil {
+		return status, err
+	}
+	info := struct {
+		BaseFileName     string
+		Size             int64
+		Version          string
+		OwnerId          string
+		UserId           string
+		UserCanWrite     bool
+		ReadOnly         bool
+		SupportsLocks    bool
+		SupportsGetLock  bool
+		SupportsUpdate   bool
+		LastModifiedTime string
+	}{
+		BaseFileName:     fi.Name(),
+		Size:             fi.Size(),
+		Version:          version(fi),
+		UserId:           userID,
+		UserCanWrite:     canWrite,
+		ReadOnly:         !canWrite,
+		SupportsLocks:    true,
+		SupportsGetLock:  true,
+		SupportsUpdate:   true,
+		LastModifiedTime: fi.ModTime().UTC().Format(time.RFC3339),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	return 0, json.NewEncoder(w).Encode(info)
+}
+
+func version(fi os.FileInfo) string {
+	return fmt.Sprintf("%x%x", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// getFile is the WOPI GetFile operation.
+func (h *Handler) getFile(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	fi, status, err := h.stat(r, name)
+	if err != nil {
+		return status, err
+	}
+	f, err := h.FileSystem.OpenFile(r.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-WOPI-ItemVersion", version(fi))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	return 0, nil
+}
+
+// putFile is the WOPI PutFile operation.
+func (h *Handler) putFile(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	lockID := r.Header.Get("X-WOPI-Lock")
+	now := time.Now()
+	cur := h.currentLock(name)
+	var release func()
+	switch {
+	case cur.token == "":
+		// Section PutFile says that an unlocked file can only be written if
+		// it is empty, to allow creating new files.
+		fi, err := h.FileSystem.Stat(r.Context(), name)
+		if err == nil && fi.Size() > 0 {
+			w.Header().Set("X-WOPI-Lock", "")
+			return http.StatusConflict, errNoLock
+		}
+		token, err := h.LockSystem.Create(now, webdav.LockDetails{
+			Root:      name,
+			Duration:  -1,
+			ZeroDepth: true,
+		})
+		if err != nil {
+			return lockStatus(err), err
+		}
+		release = func() { h.LockSystem.Unlock(now, token) }
+	case cur.id != lockID || !cur.wopi:
+		w.Header().Set("X-WOPI-Lock", cur.id)
+		return http.StatusConflict, errLockMismatch
+	default:
+		var err error
+		release, err = h.LockSystem.Confirm(now, name, "", webdav.Condition{Token: cur.token})
+		if err != nil {
+			return lockStatus(err), err
+		}
+	}
+	defer release()
+
+	f, err := h.FileSystem.OpenFile(r.Context(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		if os.IsPermission(err) {
+			return http.StatusUnauthorized, err
+		}
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	_, copyErr := io.Copy(f, r.Body)
+	fi, statErr := f.Stat()
+	closeErr := f.Close()
+	for _, err := range []error{copyErr, statErr, closeErr} {
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	w.Header().Set("X-WOPI-ItemVersion", version(fi))
+	return http.StatusOK, nil
+}
+
+// lock implements the WOPI Lock, UnlockAndRelock, Unlock and RefreshLock
+// operations.
+func (h *Handler) lock(w http.ResponseWriter, r *http.Request, name, op string) (int, error) {
+	if _, status, err := h.stat(r, name); err != nil {
+		return status, err
+	}
+	lockID := r.Header.Get("X-WOPI-Lock")
+	if lockID == "" {
+		return http.StatusBadRequest, errNoLock
+	}
+	oldLockID := r.Header.Get("X-WOPI-OldLock")
+	now := time.Now()
+	cur := h.currentLock(name)
+
+	// conflict writes the "409 Conflict" response, reporting the current
+	// lock. Locks not created through WOPI are reported as an empty string.
+	conflict := func(reason string) (int, error) {
+		w.Header().Set("X-WOPI-Lock", cur.id)
+		w.Header().Set("X-WOPI-LockFailureReason", reason)
+		return http.StatusConflict, errLockMismatch
+	}
+
+	switch {
+	case op == "LOCK" && oldLockID != "":
+		// UnlockAndRelock. The lock is swapped in place: unlocking and then
+		// locking again would let another client take the lock in between.
+		if cur.token == "" || !cur.wopi || cur.id != oldLockID {
+			return conflict("lock mismatch")
+		}
+		swapper, ok := h.LockSystem.(webdav.LockOwnerSwapper)
+		if !ok {
+			return http.StatusNotImplemented, errNoOwnerSwap
+		}
+		_, err := swapper.SwapOwner(now, cur.token, cur.owner, ownerXML(lockID), LockDuration)
+		if err == webdav.ErrConfirmationFailed || err == webdav.ErrNoSuchLock {
+			// The lock changed since it was looked up.
+			cur = h.currentLock(name)
+			return conflict("lock mismatch")
+		}
+		if err != nil {
+			return lockStatus(err), err
+		}
+		return http.StatusOK, nil
+	case op == "LOCK" && cur.token == "":
+		return h.createLock(name, lockID, now)
+	case op == "LOCK" && cur.wopi && cur.id == lockID:
+		// Locking again with the same lock ID refreshes the lock.
+		if _, err := h.LockSystem.Refresh(now, cur.token, LockDuration); err != nil {
+			return lockStatus(err), err
+		}
+		return http.StatusOK, nil
+	case op == "LOCK":
+		return conflict("locked by another client")
+	case cur.token == "":
+		return conflict("not locked")
+	case !cur.wopi || cur.id != lockID:
+		return conflict("lock mismatch")
+	case op == "UNLOCK":
+		if err := h.LockSystem.Unlock(now, cur.token); err != nil {
+			return lockStatus(err), err
+		}
+		return http.StatusOK, nil
+	default:
+		if _, err := h.LockSystem.Refresh(now, cur.token, LockDuration); err != nil {
+			return lockStatus(err), err
+		}
+		return http.StatusOK, nil
+	}
+}
+
+func (h *Handler) createLock(name, lockID string, now time.Time) (int, error) {
+	_, err := h.LockSystem.Create(now, webdav.LockDetails{
+		Root:      name,
+		Duration:  LockDuration,
+		OwnerXML:  ownerXML(lockID),
+		ZeroDepth: true,
+	})
+	if err != nil {
+		return lockStatus(err), err
+	}
+	return http.StatusOK, nil
+}
+
+func lockStatus(err error) int {
+	if err == webdav.ErrLocked || err == webdav.ErrConfirmationFailed {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+const (
+	ownerPrefix = `<wopi:lock xmlns:wopi="urn:wopi">`
+	ownerSuffix = `</wopi:lock>`
+)
+
+// ownerXML returns the DAV lock owner recording the WOPI lock ID.
+func ownerXML(lockID string) string {
+	return ownerPrefix + html.EscapeString(lockID) + ownerSuffix
+}
+
+type currentLock struct {
+	// token is the DAV lock token, or empty if the file is not locked.
+	token string
+	// id is the WOPI lock ID.
+	id string
+	// owner is the OwnerXML of the DAV lock.
+	owner string
+	// wopi is whether the lock was created through WOPI.
+	wopi bool
+}
+
+// currentLock returns the lock applying to name.
+func (h *Handler) currentLock(name string) currentLock {
+	token, _, ld, err := h.LockSystem.GetByName(name)
+	if err != nil {
+		return currentLock{}
+	}
+	if ld.Root != name && ld.ZeroDepth {
+		// A zero-depth lock on an ancestor does not apply to name.
+		return currentLock{}
+	}
+	if ld.Root == name && strings.HasPrefix(ld.OwnerXML, ownerPrefix) && strings.HasSuffix(ld.OwnerXML, ownerSuffix) {
+		id := ld.OwnerXML[len(ownerPrefix) : len(ld.OwnerXML)-len(ownerSuffix)]
+		return currentLock{token: token, id: html.UnescapeString(id), owner: ld.OwnerXML, wopi: true}
+	}
+	return currentLock{token: token, owner: ld.OwnerXML}
+}
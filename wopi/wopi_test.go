@@ -0,0 +1,276 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package wopi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drakkan/webdav"
+)
+
+func newTestHandler(t *testing.T, content string) *Handler {
+	t.Helper()
+	fs := webdav.NewMemFS()
+	f, err := fs.OpenFile(context.Background(), "/doc.odt", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	f.Close()
+	return &Handler{
+		Prefix:     "/wopi/files/",
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+		Authorize: func(r *http.Request, name string) (string, bool, error) {
+			return "user", true, nil
+		},
+	}
+}
+
+func do(h *Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCheckFileInfoAndGetFile(t *testing.T) {
+	h := newTestHandler(t, "hello")
+	url := "/wopi/files/" + FileID("/doc.odt")
+
+	w := do(h, "GET", url, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("CheckFileInfo: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var info struct {
+		BaseFileName  string
+		Size          int64
+		SupportsLocks bool
+	}
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("CheckFileInfo: decode: %v", err)
+	}
+	if info.BaseFileName != "doc.odt" || info.Size != 5 || !info.SupportsLocks {
+		t.Fatalf("CheckFileInfo: got %+v", info)
+	}
+
+	w = do(h, "GET", url+"/contents", "")
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("GetFile: got %d %q, want %d %q", w.Code, w.Body.String(), http.StatusOK, "hello")
+	}
+
+	if w := do(h, "GET", "/wopi/files/"+FileID("/missing"), ""); w.Code != http.StatusNotFound {
+		t.Fatalf("CheckFileInfo missing: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(h, "GET", "/wopi/files/!!!", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("CheckFileInfo invalid id: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	h := newTestHandler(t, "hello")
+	url := "/wopi/files/" + FileID("/doc.odt")
+
+	testCases := []struct {
+		desc       string
+		override   string
+		target     string
+		body       string
+		header     []string
+		wantStatus int
+		wantLock   string
+	}{{
+		desc:       "put without lock on non empty file",
+		override:   "PUT",
+		target:     url + "/contents",
+		body:       "x",
+		wantStatus: http.StatusConflict,
+	}, {
+		desc:       "lock",
+		override:   "LOCK",
+		target:     url,
+		header:     []string{"X-WOPI-Lock", "a"},
+		wantStatus: http.StatusOK,
+	}, {
+		desc:       "get lock",
+		override:   "GET_LOCK",
+		target:     url,
+		wantStatus: http.StatusOK,
+		wantLock:   "a",
+	}, {
+		desc:       "lock again with the same id",
+		override:   "LOCK",
+		target:     url,
+		header:     []string{"X-WOPI-Lock", "a"},
+		wantStatus: http.StatusOK,
+	}, {
+		desc:       "lock with another id",
+		override:   "LOCK",
+		target:     url,
+		header:     []string{"X-WOPI-Lock", "b"},
+		wantStatus: http.StatusConflict,
+		wantLock:   "a",
+	}, {
+		desc:       "put with the wrong lock",
+		override:   "PUT",
+		target:     url + "/contents",
+		body:       "x",
+		header:     []string{"X-WOPI-Lock", "b"},
+		wantStatus: http.StatusConflict,
+		wantLock:   "a",
+	}, {
+		desc:       "put with the lock",
+		override:   "PUT",
+		target:     url + "/contents",
+		body:       "updated",
+		header:     []string{"X-WOPI-Lock", "a"},
+		wantStatus: http.StatusOK,
+	}, {
+		desc:       "refresh",
+		override:   "REFRESH_LOCK",
+		target:     url,
+		header:     []string{"X-WOPI-Lock", "a"},
+		wantStatus: http.StatusOK,
+	}, {
+		desc:       "unlock and relock with the wrong old lock",
+		override:   "LOCK",
+		target:     url,
+		header:     []string{"X-WOPI-Lock", "c", "X-WOPI-OldLock", "b"},
+		wantStatus: http.StatusConflict,
+		wantLock:   "a",
+	}, {
+		desc:       "unlock and relock",
+		override:   "LOCK",
+		target:     url,
+		header:     []string{"X-WOPI-Lock", "c", "X-WOPI-OldLock", "a"},
+		wantStatus: http.StatusOK,
+	}, {
+		desc:       "unlock with the wrong lock",
+		override:   "UNLOCK",
+		target:     url,
+		header:     []string{"X-WOPI-Lock", "a"},
+		wantStatus: http.StatusConflict,
+		wantLock:   "c",
+	}, {
+		desc:       "unlock",
+		override:   "UNLOCK",
+		target:     url,
+		header:     []string{"X-WOPI-Lock", "c"},
+		wantStatus: http.StatusOK,
+	}, {
+		desc:       "refresh without lock",
+		override:   "REFRESH_LOCK",
+		target:     url,
+		header:     []string{"X-WOPI-Lock", "c"},
+		wantStatus: http.StatusConflict,
+	}}
+
+	for _, tc := range testCases {
+		header := append([]string{"X-WOPI-Override", tc.override}, tc.header...)
+		w := do(h, "POST", tc.target, tc.body, header...)
+		if w.Code != tc.wantStatus {
+			t.Fatalf("%s: got status %d, want %d", tc.desc, w.Code, tc.wantStatus)
+		}
+		if got := w.Header().Get("X-WOPI-Lock"); got != tc.wantLock {
+			t.Fatalf("%s: got lock %q, want %q", tc.desc, got, tc.wantLock)
+		}
+	}
+
+	if w := do(h, "GET", url+"/contents", ""); w.Body.String() != "updated" {
+		t.Fatalf("GetFile: got %q, want %q", w.Body.String(), "updated")
+	}
+}
+
+func TestDAVLockConflict(t *testing.T) {
+	h := newTestHandler(t, "hello")
+	url := "/wopi/files/" + FileID("/doc.odt")
+
+	_, err := h.LockSystem.Create(time.Now(), webdav.LockDetails{
+		Root:     "/",
+		Duration: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	w := do(h, "POST", url, "", "X-WOPI-Override", "LOCK", "X-WOPI-Lock", "a")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("LOCK: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if got := w.Header().Get("X-WOPI-Lock"); got != "" {
+		t.Fatalf("LOCK: got lock %q, want empty", got)
+	}
+}
+
+func TestNoAuthorize(t *testing.T) {
+	h := newTestHandler(t, "hello")
+	h.Authorize = nil
+	url := "/wopi/files/" + FileID("/doc.odt")
+
+	if w := do(h, "GET", url, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("CheckFileInfo: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := do(h, "GET", url+"/contents", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("GetFile: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// plainLS is a LockSystem implementing none of the optional interfaces.
+type plainLS struct {
+	webdav.LockSystem
+}
+
+func TestUnlockAndRelock(t *testing.T) {
+	h := newTestHandler(t, "hello")
+	url := "/wopi/files/" + FileID("/doc.odt")
+
+	if w := do(h, "POST", url, "", "X-WOPI-Override", "LOCK", "X-WOPI-Lock", "a"); w.Code != http.StatusOK {
+		t.Fatalf("LOCK: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	token, _, _, err := h.LockSystem.GetByName("/doc.odt")
+	if err != nil {
+		t.Fatalf("GetByName: %v", err)
+	}
+	if w := do(h, "POST", url, "", "X-WOPI-Override", "LOCK", "X-WOPI-Lock", "b", "X-WOPI-OldLock", "a"); w.Code != http.StatusOK {
+		t.Fatalf("UnlockAndRelock: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	// The DAV lock is kept, so no other client could take it in between.
+	got, _, ld, err := h.LockSystem.GetByName("/doc.odt")
+	if err != nil {
+		t.Fatalf("GetByName: %v", err)
+	}
+	if got != token || ld.OwnerXML != ownerXML("b") {
+		t.Fatalf("UnlockAndRelock: got lock %q owned by %q, want %q owned by %q", got, ld.OwnerXML, token, ownerXML("b"))
+	}
+
+	h.LockSystem = plainLS{h.LockSystem}
+	if w := do(h, "POST", url, "", "X-WOPI-Override", "LOCK", "X-WOPI-Lock", "c", "X-WOPI-OldLock", "b"); w.Code != http.StatusNotImplemented {
+		t.Fatalf("UnlockAndRelock without LockOwnerSwapper: got status %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+	if w := do(h, "POST", url, "", "X-WOPI-Override", "GET_LOCK"); w.Header().Get("X-WOPI-Lock") != "b" {
+		t.Fatalf("GET_LOCK: got lock %q, want %q", w.Header().Get("X-WOPI-Lock"), "b")
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// xattrName is the name of the extended attribute holding the dead
+// properties stored by the PropStore returned by NewXattrPropStore.
+const xattrName = "user.webdav.props"
+
+// defaultMaxXattrSize is the default maximum size of the extended
+// attribute. It fits the single block available to the extended attributes
+// of a file on ext4 file systems.
+const defaultMaxXattrSize = 3072
+
+var errXattrUnsupported = errors.New("webdav: extended attributes not supported")
+
+// NewXattrPropStore returns a PropStore that persists the dead properties
+// of the resources served by d into a user extended attribute of the
+// underlying files, so that they travel with the files even when they are
+// manipulated outside WebDAV.
+//
+// Properties whose encoded size exceeds maxSize bytes, or that the file
+// system refuses to store as extended attributes, are stored in sidecar
+// files as done by NewSidecarPropStore. If maxSize is zero or negative, a
+// default suitable for ext4 file systems is used.
+//
+// Extended attributes are supported on Linux, macOS and FreeBSD, on other
+// platforms or on file systems without extended attributes support an
+// error is returned.
+func NewXattrPropStore(d Dir, maxSize int) (PropStore, error) {
+	if err := checkXattr(d.resolve("/")); err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxXattrSize
+	}
+	return &xattrPropStore{
+		dir:     d,
+		maxSize: maxSize,
+		sidecar: &sidecarPropStore{dir: d},
+	}, nil
+}
+
+type xattrPropStore struct {
+	// mu serializes the read-modify-write cycles of Patch.
+	mu      sync.Mutex
+	dir     Dir
+	maxSize int
+	sidecar *sidecarPropStore
+}
+
+// get returns the properties of the file at path p, either from its
+// extended attribute or from its sidecar file.
+func (s *xattrPropStore) get(p, name string) (map[xml.Name]Property, error) {
+	data, err := getXattr(p, xattrName)
+	if err == nil {
+		return decodeProps(data)
+	}
+	if !errors.Is(err, errNoXattr) {
+		return nil, &fs.PathError{Op: "getxattr", Path: p, Err: err}
+	}
+	return s.sidecar.read(s.sidecar.sidecarPath(name))
+}
+
+func (s *xattrPropStore) Get(ctx context.Context, name string) (map[xml.Name]Property, error) {
+	p := s.dir.resolve(name)
+	if p == "" {
+		return nil, os.ErrNotExist
+	}
+	return s.get(p, name)
+}
+
+func (s *xattrPropStore) Patch(ctx context.Context, name string, patches []Proppatch) ([]Propstat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.dir.resolve(name)
+	if p == "" {
+		return nil, os.ErrNotExist
+	}
+	props, err := s.get(p, name)
+	if err != nil {
+		return nil, err
+	}
+	if props == nil {
+		props = make(map[xml.Name]Property)
+	}
+	pstat := applyPatches(props, patches)
+	if err := s.put(p, name, props); err != nil {
+		return nil, err
+	}
+	return []Propstat{pstat}, nil
+}
+
+// put stores props into the extended attribute of the file at path p or,
+// if they do not fit, into its sidecar file.
+func (s *xattrPropStore) put(p, name string, props map[xml.Name]Property) error {
+	sidecarFile := s.sidecar.sidecarPath(name)
+	if len(props) == 0 {
+		if err := removeXattr(p, xattrName); err != nil && !errors.Is(err, errNoXattr) {
+			return &fs.PathError{Op: "removexattr", Path: p, Err: err}
+		}
+		return s.sidecar.write(sidecarFile, nil)
+	}
+	data, err := encodeProps(props)
+	if err != nil {
+		return err
+	}
+	if len(data) <= s.maxSize {
+		err := setXattr(p, xattrName, data)
+		if err == nil {
+			return s.sidecar.write(sidecarFile, nil)
+		}
+		if !errors.Is(err, errXattrTooLarge) {
+			return &fs.PathError{Op: "setxattr", Path: p, Err: err}
+		}
+	}
+	if err := s.sidecar.write(sidecarFile, props); err != nil {
+		return err
+	}
+	if err := removeXattr(p, xattrName); err != nil && !errors.Is(err, errNoXattr) {
+		return &fs.PathError{Op: "removexattr", Path: p, Err: err}
+	}
+	return nil
+}
+
+// Delete deletes the sidecar file of resource name, if any. Its extended
+// attribute is deleted together with the file.
+func (s *xattrPropStore) Delete(ctx context.Context, name string) error {
+	return s.sidecar.Delete(ctx, name)
+}
+
+// CopyMove copies or moves the properties of src to dst. Extended
+// attributes are moved together with the files, but they must be copied
+// explicitly.
+func (s *xattrPropStore) CopyMove(ctx context.Context, src, dst string, move, recursive bool) error {
+	if err := s.sidecar.CopyMove(ctx, src, dst, move, recursive); err != nil || move {
+		return err
+	}
+	srcPath, dstPath := s.dir.resolve(src), s.dir.resolve(dst)
+	if srcPath == "" || dstPath == "" {
+		return os.ErrNotExist
+	}
+	return filepath.WalkDir(srcPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == SidecarDir {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(srcPath, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dstPath, rel)
+		if _, err := os.Lstat(target); err != nil {
+			// The resource was not copied.
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		data, err := getXattr(p, xattrName)
+		if err != nil {
+			if errors.Is(err, errNoXattr) {
+				err = nil
+			}
+		} else {
+			err = setXattr(target, xattrName, data)
+		}
+		if err != nil {
+			return &fs.PathError{Op: "copyxattr", Path: p, Err: err}
+		}
+		if d.IsDir() && !recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
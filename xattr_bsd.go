@@ -0,0 +1,62 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build darwin || freebsd
+
+package webdav
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// On FreeBSD the "user." prefix of the attribute names selects the user
+// namespace of the extattr API, on macOS it is part of the name.
+const (
+	errNoXattr       = unix.ENOATTR
+	errXattrTooLarge = unix.E2BIG
+)
+
+func checkXattr(p string) error {
+	_, err := unix.Listxattr(p, nil)
+	if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+		return errXattrUnsupported
+	}
+	return err
+}
+
+func getXattr(p, attr string) ([]byte, error) {
+	size, err := unix.Getxattr(p, attr, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	n, err := unix.Getxattr(p, attr, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func setXattr(p, attr string, data []byte) error {
+	err := unix.Setxattr(p, attr, data, 0)
+	if err == unix.ENOSPC || err == unix.ERANGE {
+		// The file system has no room for an attribute of this size.
+		return errXattrTooLarge
+	}
+	return err
+}
+
+func removeXattr(p, attr string) error {
+	return unix.Removexattr(p, attr)
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"syscall"
+)
+
+const (
+	errNoXattr       = syscall.ENODATA
+	errXattrTooLarge = syscall.E2BIG
+)
+
+func checkXattr(p string) error {
+	_, err := syscall.Listxattr(p, nil)
+	if err == syscall.ENOTSUP {
+		return errXattrUnsupported
+	}
+	return err
+}
+
+func getXattr(p, attr string) ([]byte, error) {
+	size, err := syscall.Getxattr(p, attr, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	n, err := syscall.Getxattr(p, attr, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func setXattr(p, attr string, data []byte) error {
+	err := syscall.Setxattr(p, attr, data, 0)
+	if err == syscall.ENOSPC || err == syscall.ERANGE {
+		// The file system has no room for an attribute of this size.
+		return errXattrTooLarge
+	}
+	return err
+}
+
+func removeXattr(p, attr string) error {
+	return syscall.Removexattr(p, attr)
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2022  Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestXattrPropStore(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	ps, err := NewXattrPropStore(Dir(root), 128)
+	if err == errXattrUnsupported {
+		t.Skip("extended attributes not supported")
+	}
+	if err != nil {
+		t.Fatalf("NewXattrPropStore: %v", err)
+	}
+	fs := Dir(root)
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	for _, name := range []string{"/dir/small", "/dir/large"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatalf("WriteFile %s: %v", name, err)
+		}
+	}
+	pn := xml.Name{Space: "ns", Local: "p"}
+	set := func(name, v string) {
+		t.Helper()
+		if _, err := ps.Patch(ctx, name, []Proppatch{{Props: []Property{{XMLName: pn, InnerXML: []byte(v)}}}}); err != nil {
+			t.Fatalf("Patch %s: %v", name, err)
+		}
+	}
+	check := func(name, want string) {
+		t.Helper()
+		props, err := ps.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("Get %s: %v", name, err)
+		}
+		if got := string(props[pn].InnerXML); got != want {
+			t.Fatalf("Get %s: got %q, want %q", name, got, want)
+		}
+	}
+	hasXattr := func(name string) bool {
+		_, err := getXattr(filepath.Join(root, name), xattrName)
+		return err == nil
+	}
+	hasSidecar := func(name string) bool {
+		_, err := os.Stat((&sidecarPropStore{dir: fs}).sidecarPath(name))
+		return err == nil
+	}
+
+	large := strings.Repeat("x", 256)
+	set("/dir", "dir")
+	set("/dir/small", "small")
+	set("/dir/large", large)
+	check("/dir", "dir")
+	check("/dir/small", "small")
+	check("/dir/large", large)
+	if !hasXattr("/dir/small") || hasSidecar("/dir/small") {
+		t.Fatalf("small property not stored as extended attribute")
+	}
+	if hasXattr("/dir/large") || !hasSidecar("/dir/large") {
+		t.Fatalf("large property not stored in a sidecar file")
+	}
+	// Shrinking the property moves it back to the extended attribute.
+	set("/dir/large", "now small")
+	if !hasXattr("/dir/large") || hasSidecar("/dir/large") {
+		t.Fatalf("shrunk property not stored as extended attribute")
+	}
+
+	// Properties travel with files renamed outside WebDAV.
+	if err := os.Rename(filepath.Join(root, "dir", "small"), filepath.Join(root, "dir", "renamed")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	check("/dir/renamed", "small")
+
+	if _, err := copyFiles(ctx, fs, "/dir", "/copy", false, infiniteDepth, 0); err != nil {
+		t.Fatalf("copyFiles: %v", err)
+	}
+	if err := ps.CopyMove(ctx, "/dir", "/copy", false, true); err != nil {
+		t.Fatalf("CopyMove: %v", err)
+	}
+	check("/copy", "dir")
+	check("/copy/renamed", "small")
+	check("/copy/large", "now small")
+}
@@ -23,11 +23,12 @@ package webdav
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
+	"sort"
 	"time"
 
 	// As of https://go-review.googlesource.com/#/c/12772/ which was submitted
@@ -96,22 +97,42 @@ func (c *countingReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// lockTimeout returns the DAV:timeout value of a lock expiring at expiry,
+// that is the remaining time and not the duration requested when the lock was
+// created or last refreshed.
+func lockTimeout(ld LockDetails, expiry, now time.Time) string {
+	if ld.Duration < 0 {
+		return "Infinite"
+	}
+	remaining := expiry.Sub(now)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return fmt.Sprintf("Second-%d", remaining/time.Second)
+}
+
+// lockRoot returns the DAV:lockroot href of a lock.
+func lockRoot(ld LockDetails) string {
+	// PathEscape the root. Any URLs in this response body should match data on the wire
+	// meaning if a request came in escaped (which it should have), it should go out that
+	// way as well.
+	return hrefPath(ld.Root)
+}
+
+// writeLockInfo writes the response to a LOCK request, reporting the
+// duration of the lock just created or refreshed as its timeout.
 func writeLockInfo(w io.Writer, token string, ld LockDetails) (int, error) {
 	depth := "infinity"
 	if ld.ZeroDepth {
 		depth = "0"
 	}
 	var timeout string
-	if ld.Duration == infiniteTimeout {
+	if ld.Duration < 0 {
 		timeout = "Infinite"
 	} else {
 		timeout = fmt.Sprintf("Second-%d", ld.Duration/time.Second)
 	}
-	// PathEscape the root. Any URLs in this response body should match data on the wire
-	// meaning if a request came in escaped (which it should have), it should go out that
-	// way as well.
-	rootUrl := url.URL{Path: ld.Root}
-	root := rootUrl.EscapedPath()
+	root := lockRoot(ld)
 	return fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n"+
 		"<D:prop xmlns:D=\"DAV:\"><D:lockdiscovery><D:activelock>\n"+
 		"	<D:locktype><D:write/></D:locktype>\n"+
@@ -337,11 +358,38 @@ type multistatusWriter struct {
 	// close will be emitted. Empty response descriptions are not
 	// written.
 	responseDescription string
-
-	w   http.ResponseWriter
-	enc *ixml.Encoder
+	// canonical, if true, makes the output deterministic: the responses
+	// are buffered and written by href on close, and the propstats and
+	// their properties are sorted by status and by name. Otherwise, the
+	// responses are streamed as they are written.
+	canonical bool
+	// syncToken, if not empty, is the RFC 6578 sync-token element of the
+	// multistatus XML element.
+	syncToken string
+	// ctx, if non-nil, is the context of the request. Once it is done,
+	// because the client went away, write fails with errListingAborted, so
+	// that the listing producing the responses stops.
+	ctx context.Context
+
+	w       http.ResponseWriter
+	enc     *ixml.Encoder
+	pending []*response
+	// written is the number of responses written.
+	written int
+	// flushed is when the http.ResponseWriter was last flushed.
+	flushed time.Time
 }
 
+// multistatusFlushInterval and multistatusFlushPeriod are the number of
+// responses, and the time, after which a multistatusWriter flushes its
+// http.ResponseWriter, so that clients can start parsing large responses
+// while they are being produced, and slow listings don't pin the buffered
+// responses in memory.
+const (
+	multistatusFlushInterval = 100
+	multistatusFlushPeriod   = time.Second
+)
+
 // Write validates and emits a DAV response as part of a multistatus response
 // element.
 //
@@ -351,6 +399,9 @@ type multistatusWriter struct {
 // of r with a multistatus tag. Callers must call close after the last response
 // has been written.
 func (w *multistatusWriter) write(r *response) error {
+	if w.ctx != nil && w.ctx.Err() != nil {
+		return errListingAborted
+	}
 	switch len(r.Href) {
 	case 0:
 		return errInvalidResponse
@@ -363,11 +414,53 @@ func (w *multistatusWriter) write(r *response) error {
 			return errInvalidResponse
 		}
 	}
+	if w.canonical {
+		canonicalizeResponse(r)
+		w.pending = append(w.pending, r)
+		return nil
+	}
 	err := w.writeHeader()
 	if err != nil {
 		return err
 	}
-	return w.enc.Encode(r)
+	return w.encode(r)
+}
+
+// encode writes r, which is streamed to the client instead of being
+// buffered, periodically flushing the http.ResponseWriter.
+func (w *multistatusWriter) encode(r *response) error {
+	if namespaces := findNamespaces(w.ctx); namespaces != nil {
+		r = encodeNamespaces(w.ctx, namespaces, r)
+	}
+	if err := w.enc.Encode(r); err != nil {
+		return err
+	}
+	w.written++
+	if w.written%multistatusFlushInterval == 0 || time.Since(w.flushed) >= multistatusFlushPeriod {
+		if f, ok := w.w.(http.Flusher); ok {
+			f.Flush()
+		}
+		w.flushed = time.Now()
+	}
+	return nil
+}
+
+// canonicalizeResponse sorts the hrefs, the propstats and their properties
+// of r. See multistatusWriter.canonical.
+func canonicalizeResponse(r *response) {
+	sort.Strings(r.Href)
+	sort.SliceStable(r.Propstat, func(i, j int) bool {
+		return r.Propstat[i].Status < r.Propstat[j].Status
+	})
+	for _, ps := range r.Propstat {
+		sort.SliceStable(ps.Prop, func(i, j int) bool {
+			a, b := ps.Prop[i].XMLName, ps.Prop[j].XMLName
+			if a.Space != b.Space {
+				return a.Space < b.Space
+			}
+			return a.Local < b.Local
+		})
+	}
 }
 
 // writeHeader writes a XML multistatus start element on w's underlying
@@ -384,15 +477,16 @@ func (w *multistatusWriter) writeHeader() error {
 		return err
 	}
 	w.enc = ixml.NewEncoder(w.w)
+	w.flushed = time.Now()
 	return w.enc.EncodeToken(ixml.StartElement{
 		Name: ixml.Name{
 			Space: "DAV:",
 			Local: "multistatus",
 		},
-		Attr: []ixml.Attr{{
+		Attr: append([]ixml.Attr{{
 			Name:  ixml.Name{Space: "xmlns", Local: "D"},
 			Value: "DAV:",
-		}},
+		}}, namespaceAttrs(findNamespaces(w.ctx))...),
 	})
 }
 
@@ -401,6 +495,20 @@ func (w *multistatusWriter) writeHeader() error {
 // return value and field enc of w are nil, then no multistatus response has
 // been written.
 func (w *multistatusWriter) close() error {
+	if len(w.pending) > 0 {
+		sort.SliceStable(w.pending, func(i, j int) bool {
+			return w.pending[i].Href[0] < w.pending[j].Href[0]
+		})
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+		for _, r := range w.pending {
+			if err := w.encode(r); err != nil {
+				return err
+			}
+		}
+		w.pending = nil
+	}
 	if w.enc == nil {
 		return nil
 	}
@@ -413,6 +521,14 @@ func (w *multistatusWriter) close() error {
 			ixml.EndElement{Name: name},
 		)
 	}
+	if w.syncToken != "" {
+		name := ixml.Name{Space: "DAV:", Local: "sync-token"}
+		end = append(end,
+			ixml.StartElement{Name: name},
+			ixml.CharData(w.syncToken),
+			ixml.EndElement{Name: name},
+		)
+	}
 	end = append(end, ixml.EndElement{
 		Name: ixml.Name{Space: "DAV:", Local: "multistatus"},
 	})
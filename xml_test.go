@@ -15,6 +15,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	ixml "github.com/drakkan/webdav/internal/xml"
 )
@@ -135,6 +136,37 @@ func TestReadLockInfo(t *testing.T) {
 	}
 }
 
+func TestLockTimeout(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		desc   string
+		ld     LockDetails
+		expiry time.Time
+		want   string
+	}{{
+		desc:   "infinite",
+		ld:     LockDetails{Duration: infiniteTimeout},
+		expiry: time.Time{},
+		want:   "Infinite",
+	}, {
+		desc:   "remaining",
+		ld:     LockDetails{Duration: time.Hour},
+		expiry: now.Add(90 * time.Second),
+		want:   "Second-90",
+	}, {
+		desc:   "expired",
+		ld:     LockDetails{Duration: time.Hour},
+		expiry: now.Add(-time.Second),
+		want:   "Second-0",
+	}}
+
+	for _, tc := range testCases {
+		if got := lockTimeout(tc.ld, tc.expiry, now); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
 func TestReadPropfind(t *testing.T) {
 	testCases := []struct {
 		desc       string